@@ -1,8 +1,12 @@
 package admin
 
 import (
+	"encoding/json"
 	"net/http"
+	"sort"
 
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/exchange"
 	"github.com/valinurovam/garagemq/server"
 )
 
@@ -15,9 +19,20 @@ type BindingsResponse struct {
 }
 
 type Binding struct {
-	Queue      string `json:"queue"`
-	Exchange   string `json:"exchange"`
-	RoutingKey string `json:"routing_key"`
+	Queue      string      `json:"queue"`
+	Exchange   string      `json:"exchange"`
+	RoutingKey string      `json:"routing_key"`
+	Arguments  *amqp.Table `json:"arguments"`
+}
+
+// BindingRequest is a body of POST and DELETE /bindings requests
+// Only queues are supported as destination at the moment
+type BindingRequest struct {
+	Vhost       string                 `json:"vhost"`
+	Source      string                 `json:"source"`
+	Destination string                 `json:"destination"`
+	RoutingKey  string                 `json:"routing_key"`
+	Arguments   map[string]interface{} `json:"arguments"`
 }
 
 func NewBindingsHandler(amqpServer *server.Server) http.Handler {
@@ -25,6 +40,94 @@ func NewBindingsHandler(amqpServer *server.Server) http.Handler {
 }
 
 func (h *BindingsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost, http.MethodDelete:
+		h.change(resp, req)
+	default:
+		h.list(resp, req)
+	}
+}
+
+func (h *BindingsHandler) change(resp http.ResponseWriter, req *http.Request) {
+	bindReq := &BindingRequest{}
+	decoder := json.NewDecoder(req.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(bindReq); err != nil {
+		JSONResponse(resp, map[string]string{"error": "invalid request body: " + err.Error()}, 400)
+		return
+	}
+
+	vhost := h.amqpServer.GetVhost(bindReq.Vhost)
+	if vhost == nil {
+		JSONResponse(resp, map[string]string{"error": "vhost not found"}, 404)
+		return
+	}
+
+	if vhost.GetExchange(bindReq.Source) == nil {
+		JSONResponse(resp, map[string]string{"error": "source exchange not found"}, 404)
+		return
+	}
+
+	if vhost.GetQueue(bindReq.Destination) == nil {
+		JSONResponse(resp, map[string]string{"error": "destination queue not found"}, 404)
+		return
+	}
+
+	var arguments *amqp.Table
+	if bindReq.Arguments != nil {
+		arguments = convertArguments(bindReq.Arguments)
+	}
+
+	var err error
+	if req.Method == http.MethodPost {
+		err = vhost.BindQueue(bindReq.Source, bindReq.Destination, bindReq.RoutingKey, arguments)
+	} else {
+		err = vhost.UnbindQueue(bindReq.Source, bindReq.Destination, bindReq.RoutingKey, arguments)
+	}
+	if err != nil {
+		JSONResponse(resp, map[string]string{"error": err.Error()}, 400)
+		return
+	}
+
+	JSONResponse(resp, &Binding{
+		Queue:      bindReq.Destination,
+		Exchange:   bindReq.Source,
+		RoutingKey: bindReq.RoutingKey,
+		Arguments:  arguments,
+	}, 200)
+}
+
+// convertArguments converts decoded json values into types supported by amqp tables
+// integer numbers become int64, other numbers float64, objects nested tables
+func convertArguments(args map[string]interface{}) *amqp.Table {
+	table := amqp.Table{}
+	for key, value := range args {
+		table[key] = convertArgument(value)
+	}
+	return &table
+}
+
+func convertArgument(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		return convertArguments(v)
+	case []interface{}:
+		for i, item := range v {
+			v[i] = convertArgument(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func (h *BindingsHandler) list(resp http.ResponseWriter, req *http.Request) {
 	response := &BindingsResponse{}
 	req.ParseForm()
 	vhName := req.Form.Get("vhost")
@@ -36,22 +139,42 @@ func (h *BindingsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	exchange := vhost.GetExchange(exName)
-	if exchange == nil {
-		JSONResponse(resp, response, 200)
-		return
+	// without exchange param we list bindings of all vhost's exchanges
+	// empty exchange param means default exchange
+	var exchanges []*exchange.Exchange
+	if _, ok := req.Form["exchange"]; ok {
+		if ex := vhost.GetExchange(exName); ex != nil {
+			exchanges = append(exchanges, ex)
+		}
+	} else {
+		for _, ex := range vhost.GetExchanges() {
+			exchanges = append(exchanges, ex)
+		}
 	}
 
-	for _, bind := range exchange.GetBindings() {
-		response.Items = append(
-			response.Items,
-			&Binding{
-				Queue:      bind.GetQueue(),
-				Exchange:   bind.GetExchange(),
-				RoutingKey: bind.GetExchange(),
-			},
-		)
+	for _, ex := range exchanges {
+		for _, bind := range ex.GetBindings() {
+			response.Items = append(
+				response.Items,
+				&Binding{
+					Queue:      bind.GetQueue(),
+					Exchange:   bind.GetExchange(),
+					RoutingKey: bind.GetRoutingKey(),
+					Arguments:  bind.Arguments,
+				},
+			)
+		}
 	}
 
+	sort.Slice(
+		response.Items,
+		func(i, j int) bool {
+			if response.Items[i].Exchange != response.Items[j].Exchange {
+				return response.Items[i].Exchange < response.Items[j].Exchange
+			}
+			return response.Items[i].Queue < response.Items[j].Queue
+		},
+	)
+
 	JSONResponse(resp, response, 200)
 }
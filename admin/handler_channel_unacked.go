@@ -0,0 +1,76 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/valinurovam/garagemq/server"
+)
+
+type ChannelUnackedHandler struct {
+	amqpServer *server.Server
+}
+
+type ChannelUnackedResponse struct {
+	ConnID    uint64            `json:"connection"`
+	ChannelID uint16            `json:"channel"`
+	Items     []*UnackedMessage `json:"items"`
+}
+
+type UnackedMessage struct {
+	DeliveryTag uint64 `json:"delivery_tag"`
+	ConsumerTag string `json:"consumer_tag"`
+	Queue       string `json:"queue"`
+	MessageID   uint64 `json:"message_id"`
+	Size        uint64 `json:"size"`
+	// unix time in milliseconds
+	DeliveredAt int64 `json:"delivered_at"`
+}
+
+func NewChannelUnackedHandler(amqpServer *server.Server) http.Handler {
+	return &ChannelUnackedHandler{amqpServer: amqpServer}
+}
+
+func (h *ChannelUnackedHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	connID, err := strconv.ParseUint(req.Form.Get("connection"), 10, 64)
+	if err != nil {
+		JSONResponse(resp, map[string]string{"error": "invalid connection"}, 400)
+		return
+	}
+	chID, err := strconv.ParseUint(req.Form.Get("channel"), 10, 16)
+	if err != nil {
+		JSONResponse(resp, map[string]string{"error": "invalid channel"}, 400)
+		return
+	}
+
+	conn, ok := h.amqpServer.GetConnections()[connID]
+	if !ok {
+		JSONResponse(resp, map[string]string{"error": "connection not found"}, 404)
+		return
+	}
+	ch, ok := conn.GetChannels()[uint16(chID)]
+	if !ok {
+		JSONResponse(resp, map[string]string{"error": "channel not found"}, 404)
+		return
+	}
+
+	response := &ChannelUnackedResponse{
+		ConnID:    connID,
+		ChannelID: uint16(chID),
+		Items:     []*UnackedMessage{},
+	}
+	for _, uMsg := range ch.GetUnackedMessages() {
+		response.Items = append(response.Items, &UnackedMessage{
+			DeliveryTag: uMsg.DeliveryTag,
+			ConsumerTag: uMsg.ConsumerTag,
+			Queue:       uMsg.Queue,
+			MessageID:   uMsg.MessageID,
+			Size:        uMsg.Size,
+			DeliveredAt: uMsg.DeliveredAt.UnixNano() / int64(time.Millisecond),
+		})
+	}
+
+	JSONResponse(resp, response, 200)
+}
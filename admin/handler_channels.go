@@ -26,7 +26,22 @@ type Channel struct {
 	Qos       string `json:"qos"`
 	Confirm   bool   `json:"confirm"`
 
-	Counters map[string]*metrics.TrackItem `json:"counters"`
+	Counters  map[string]*metrics.TrackItem `json:"counters"`
+	Consumers []*Consumer                   `json:"consumers"`
+	// the last error server closed channel with, kept after channel is closed until it is opened again
+	LastError *LastError `json:"last_error,omitempty"`
+}
+
+// Consumer represents consumer of channel with options it is started with
+type Consumer struct {
+	ConsumerTag string `json:"consumer_tag"`
+	Queue       string `json:"queue"`
+	NoAck       bool   `json:"no_ack"`
+	Exclusive   bool   `json:"exclusive"`
+	NoLocal     bool   `json:"no_local"`
+	Filter      string `json:"filter,omitempty"`
+	// x-additional-queues of consumer of several queues
+	AdditionalQueues []string `json:"additional_queues,omitempty"`
 }
 
 func NewChannelsHandler(amqpServer *server.Server) http.Handler {
@@ -61,6 +76,8 @@ func (h *ChannelsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request)
 						"ack":     ack,
 						"unacked": unacked,
 					},
+					Consumers: getConsumers(ch),
+					LastError: newLastError(ch.GetLastError()),
 				},
 			)
 		}
@@ -79,3 +96,25 @@ func (h *ChannelsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request)
 
 	JSONResponse(resp, response, 200)
 }
+
+func getConsumers(ch *server.Channel) []*Consumer {
+	consumers := make([]*Consumer, 0)
+	for _, cmr := range ch.GetConsumers() {
+		options := cmr.Options()
+		item := &Consumer{
+			ConsumerTag: cmr.Tag(),
+			Queue:       cmr.Queue,
+			NoAck:       options.NoAck,
+			Exclusive:   options.Exclusive,
+			NoLocal:     options.NoLocal,
+		}
+		if options.Filter != nil {
+			item.Filter = options.Filter.String()
+		}
+		if queues := cmr.Queues(); len(queues) > 1 {
+			item.AdditionalQueues = queues[1:]
+		}
+		consumers = append(consumers, item)
+	}
+	return consumers
+}
@@ -3,6 +3,7 @@ package admin
 import (
 	"net/http"
 	"sort"
+	"time"
 
 	"github.com/valinurovam/garagemq/metrics"
 	"github.com/valinurovam/garagemq/server"
@@ -13,7 +14,10 @@ type ConnectionsHandler struct {
 }
 
 type ConnectionsResponse struct {
+	ListPage
 	Items []*Connection `json:"items"`
+	// last errors of connections closed recently, from the oldest one
+	ClosedWithError []*ClosedConnection `json:"closed_with_error"`
 }
 
 type Connection struct {
@@ -25,6 +29,66 @@ type Connection struct {
 	Protocol      string             `json:"protocol"`
 	FromClient    *metrics.TrackItem `json:"from_client"`
 	ToClient      *metrics.TrackItem `json:"to_client"`
+	// total heartbeat frames received from and sent to client
+	HeartbeatsIn  int64 `json:"heartbeats_in"`
+	HeartbeatsOut int64 `json:"heartbeats_out"`
+	// parameters negotiated by connection.tune, absent until client replied with connection.tune-ok
+	Tune *ConnectionTune `json:"tune,omitempty"`
+	// the last error server closed connection or any of its channels with
+	LastError *LastError `json:"last_error,omitempty"`
+}
+
+// ConnectionTune represents negotiated connection parameters, heartbeat is interval in seconds, 0 - disabled
+type ConnectionTune struct {
+	Heartbeat  uint16 `json:"heartbeat"`
+	FrameMax   uint32 `json:"frame_max"`
+	ChannelMax uint16 `json:"channel_max"`
+}
+
+func newConnectionTune(params *server.TuneParams) *ConnectionTune {
+	if params == nil {
+		return nil
+	}
+	return &ConnectionTune{
+		Heartbeat:  params.Heartbeat,
+		FrameMax:   params.FrameMax,
+		ChannelMax: params.ChannelMax,
+	}
+}
+
+// ClosedConnection represents already closed connection with its last error
+type ClosedConnection struct {
+	ID        int        `json:"id"`
+	Vhost     string     `json:"vhost"`
+	Addr      string     `json:"addr"`
+	User      string     `json:"user"`
+	LastError *LastError `json:"last_error"`
+}
+
+// LastError represents error server closed channel or connection with, Time is unix time in milliseconds
+type LastError struct {
+	ChannelID       uint16 `json:"channel"`
+	ReplyCode       uint16 `json:"reply_code"`
+	ReplyText       string `json:"reply_text"`
+	ClassID         uint16 `json:"class_id"`
+	MethodID        uint16 `json:"method_id"`
+	ConnectionError bool   `json:"connection_error"`
+	Time            int64  `json:"time"`
+}
+
+func newLastError(lastErr *server.LastError) *LastError {
+	if lastErr == nil {
+		return nil
+	}
+	return &LastError{
+		ChannelID:       lastErr.ChannelID,
+		ReplyCode:       lastErr.ReplyCode,
+		ReplyText:       lastErr.ReplyText,
+		ClassID:         lastErr.ClassID,
+		MethodID:        lastErr.MethodID,
+		ConnectionError: lastErr.ConnectionError,
+		Time:            lastErr.Time.UnixNano() / int64(time.Millisecond),
+	}
 }
 
 func NewConnectionsHandler(amqpServer *server.Server) http.Handler {
@@ -32,8 +96,19 @@ func NewConnectionsHandler(amqpServer *server.Server) http.Handler {
 }
 
 func (h *ConnectionsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	response := &ConnectionsResponse{}
-	for _, conn := range h.amqpServer.GetConnections() {
+	params, err := parseListParams(req, "id", "user")
+	if err != nil {
+		JSONResponse(resp, map[string]string{"error": err.Error()}, 400)
+		return
+	}
+
+	response := &ConnectionsResponse{Items: []*Connection{}}
+	connections := h.amqpServer.GetConnections()
+	for _, conn := range connections {
+		// connections have no names, so filter is applied to client address and user
+		if !params.matchName(conn.GetRemoteAddr().String(), conn.GetUsername()) {
+			continue
+		}
 		response.Items = append(
 			response.Items,
 			&Connection{
@@ -42,9 +117,13 @@ func (h *ConnectionsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reque
 				Addr:          conn.GetRemoteAddr().String(),
 				ChannelsCount: len(conn.GetChannels()),
 				User:          conn.GetUsername(),
-				Protocol:      h.amqpServer.GetProtoVersion(),
+				Protocol:      conn.GetProtoVersion(),
 				FromClient:    conn.GetMetrics().TrafficIn.Track.GetLastDiffTrackItem(),
 				ToClient:      conn.GetMetrics().TrafficOut.Track.GetLastDiffTrackItem(),
+				HeartbeatsIn:  conn.GetMetrics().HeartbeatsIn.Counter.Count(),
+				HeartbeatsOut: conn.GetMetrics().HeartbeatsOut.Counter.Count(),
+				Tune:          newConnectionTune(conn.GetTuneParams()),
+				LastError:     newLastError(conn.GetLastError()),
 			},
 		)
 	}
@@ -52,9 +131,37 @@ func (h *ConnectionsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reque
 	sort.Slice(
 		response.Items,
 		func(i, j int) bool {
-			return response.Items[i].ID > response.Items[j].ID
+			a, b := response.Items[i], response.Items[j]
+			switch params.sortBy {
+			case "id":
+				return params.less(a.ID < b.ID)
+			case "user":
+				if a.User != b.User {
+					return params.less(a.User < b.User)
+				}
+				return params.less(a.ID < b.ID)
+			}
+			return params.less(a.ID > b.ID)
 		},
 	)
 
+	from, to, page := params.paginate(len(connections), len(response.Items))
+	response.ListPage = page
+	response.Items = response.Items[from:to]
+
+	response.ClosedWithError = []*ClosedConnection{}
+	for _, closed := range h.amqpServer.GetClosedConnectionErrors() {
+		if !params.matchName(closed.Addr.String(), closed.User) {
+			continue
+		}
+		response.ClosedWithError = append(response.ClosedWithError, &ClosedConnection{
+			ID:        int(closed.ConnID),
+			Vhost:     closed.Vhost,
+			Addr:      closed.Addr.String(),
+			User:      closed.User,
+			LastError: newLastError(closed.Err),
+		})
+	}
+
 	JSONResponse(resp, response, 200)
 }
@@ -0,0 +1,150 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/valinurovam/garagemq/server"
+)
+
+type ConsumersHandler struct {
+	amqpServer *server.Server
+}
+
+type ConsumersResponse struct {
+	Items []*ConsumerInfo `json:"items"`
+}
+
+// ConsumerInfo represents consumer of any channel of broker
+// Prefetch is the lowest prefetch count applied to consumer, 0 - no limit
+// BatchSize is x-batch-size of consumer, 0 - not set
+// MaxUnacked is x-max-unacked of consumer, 0 - not set
+// Weight is x-consumer-weight of consumer, 1 if not set
+// AdditionalQueues and QueueOrder are x-additional-queues and x-queue-order of consumer of several queues
+type ConsumerInfo struct {
+	ConsumerTag string `json:"consumer_tag"`
+	Queue       string `json:"queue"`
+	Vhost       string `json:"vhost"`
+	ConnID      uint64 `json:"connection"`
+	ChannelID   uint16 `json:"channel"`
+	NoAck       bool   `json:"no_ack"`
+	Prefetch    uint16 `json:"prefetch"`
+	BatchSize   uint16 `json:"batch_size"`
+	MaxUnacked  uint16 `json:"max_unacked"`
+	Weight      int    `json:"weight"`
+	Unacked     int    `json:"unacked"`
+
+	AdditionalQueues []string `json:"additional_queues,omitempty"`
+	QueueOrder       string   `json:"queue_order,omitempty"`
+}
+
+type ConsumerCancelHandler struct {
+	amqpServer *server.Server
+}
+
+// ConsumerCancelRequest is a body of POST /consumers/cancel request
+type ConsumerCancelRequest struct {
+	ConnID      uint64 `json:"connection"`
+	ChannelID   uint16 `json:"channel"`
+	ConsumerTag string `json:"consumer_tag"`
+}
+
+type ConsumerCancelResponse struct {
+	Requeued int `json:"requeued"`
+}
+
+func NewConsumersHandler(amqpServer *server.Server) http.Handler {
+	return &ConsumersHandler{amqpServer: amqpServer}
+}
+
+func (h *ConsumersHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	response := &ConsumersResponse{Items: []*ConsumerInfo{}}
+	for _, conn := range h.amqpServer.GetConnections() {
+		for chID, ch := range conn.GetChannels() {
+			unacked := make(map[string]int)
+			for _, uMsg := range ch.GetUnackedMessages() {
+				unacked[uMsg.ConsumerTag]++
+			}
+
+			for _, cmr := range ch.GetConsumers() {
+				var prefetch uint16
+				for _, cmrQos := range cmr.Qos() {
+					if cmrQos.IsBatch() {
+						continue
+					}
+					if count := cmrQos.PrefetchCount(); count != 0 && (prefetch == 0 || count < prefetch) {
+						prefetch = count
+					}
+				}
+				item := &ConsumerInfo{
+					ConsumerTag: cmr.Tag(),
+					Queue:       cmr.Queue,
+					Vhost:       conn.GetVirtualHost().GetName(),
+					ConnID:      conn.GetID(),
+					ChannelID:   chID,
+					NoAck:       cmr.Options().NoAck,
+					Prefetch:    prefetch,
+					BatchSize:   cmr.Options().BatchSize,
+					MaxUnacked:  cmr.Options().MaxUnacked,
+					Weight:      cmr.Weight(),
+					Unacked:     unacked[cmr.Tag()],
+				}
+				if queues := cmr.Queues(); len(queues) > 1 {
+					item.AdditionalQueues = queues[1:]
+					item.QueueOrder = cmr.Options().QueueOrder
+				}
+				response.Items = append(response.Items, item)
+			}
+		}
+	}
+
+	sort.Slice(response.Items, func(i, j int) bool {
+		a, b := response.Items[i], response.Items[j]
+		if a.ConnID != b.ConnID {
+			return a.ConnID < b.ConnID
+		}
+		if a.ChannelID != b.ChannelID {
+			return a.ChannelID < b.ChannelID
+		}
+		return a.ConsumerTag < b.ConsumerTag
+	})
+
+	JSONResponse(resp, response, 200)
+}
+
+func NewConsumerCancelHandler(amqpServer *server.Server) http.Handler {
+	return &ConsumerCancelHandler{amqpServer: amqpServer}
+}
+
+func (h *ConsumerCancelHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		JSONResponse(resp, map[string]string{"error": "method not allowed"}, 405)
+		return
+	}
+
+	cancelReq := &ConsumerCancelRequest{}
+	if err := json.NewDecoder(req.Body).Decode(cancelReq); err != nil {
+		JSONResponse(resp, map[string]string{"error": "invalid request body: " + err.Error()}, 400)
+		return
+	}
+
+	conn, ok := h.amqpServer.GetConnections()[cancelReq.ConnID]
+	if !ok {
+		JSONResponse(resp, map[string]string{"error": "connection not found"}, 404)
+		return
+	}
+	ch, ok := conn.GetChannels()[cancelReq.ChannelID]
+	if !ok {
+		JSONResponse(resp, map[string]string{"error": "channel not found"}, 404)
+		return
+	}
+
+	requeued, ok := ch.CancelConsumer(cancelReq.ConsumerTag)
+	if !ok {
+		JSONResponse(resp, map[string]string{"error": "consumer not found"}, 404)
+		return
+	}
+
+	JSONResponse(resp, &ConsumerCancelResponse{Requeued: requeued}, 200)
+}
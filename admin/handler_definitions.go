@@ -0,0 +1,61 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/valinurovam/garagemq/server"
+)
+
+type DefinitionsHandler struct {
+	amqpServer *server.Server
+}
+
+func NewDefinitionsHandler(amqpServer *server.Server) http.Handler {
+	return &DefinitionsHandler{amqpServer: amqpServer}
+}
+
+// ServeHTTP exports definitions on GET and imports them on POST
+func (h *DefinitionsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		JSONResponse(resp, h.amqpServer.ExportDefinitions(), 200)
+		return
+	}
+
+	defs := &server.Definitions{}
+	decoder := json.NewDecoder(req.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(defs); err != nil {
+		JSONResponse(resp, map[string]string{"error": "invalid request body: " + err.Error()}, 400)
+		return
+	}
+
+	for _, bind := range defs.Bindings {
+		if bind.Arguments != nil {
+			bind.Arguments = convertArguments(*bind.Arguments)
+		}
+	}
+	for _, ex := range defs.Exchanges {
+		if ex.Meta != nil {
+			ex.Meta = convertArguments(*ex.Meta)
+		}
+		if ex.SetProperties != nil {
+			ex.SetProperties = convertArguments(*ex.SetProperties)
+		}
+		if ex.DefaultProperties != nil {
+			ex.DefaultProperties = convertArguments(*ex.DefaultProperties)
+		}
+	}
+	for _, qu := range defs.Queues {
+		if qu.Meta != nil {
+			qu.Meta = convertArguments(*qu.Meta)
+		}
+	}
+
+	if err := h.amqpServer.ImportDefinitions(defs); err != nil {
+		JSONResponse(resp, map[string]string{"error": err.Error()}, 400)
+		return
+	}
+
+	JSONResponse(resp, map[string]string{"status": "ok"}, 200)
+}
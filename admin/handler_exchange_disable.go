@@ -0,0 +1,57 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/valinurovam/garagemq/server"
+)
+
+type ExchangeDisableHandler struct {
+	amqpServer *server.Server
+}
+
+// ExchangeDisableRequest is a body of POST /exchanges/disable request
+// Publishes into disabled exchange are rejected with channel error
+type ExchangeDisableRequest struct {
+	Vhost    string `json:"vhost"`
+	Exchange string `json:"exchange"`
+	Disable  bool   `json:"disable"`
+}
+
+type ExchangeDisableResponse struct {
+	Disabled bool `json:"disabled"`
+}
+
+func NewExchangeDisableHandler(amqpServer *server.Server) http.Handler {
+	return &ExchangeDisableHandler{amqpServer: amqpServer}
+}
+
+func (h *ExchangeDisableHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		JSONResponse(resp, map[string]string{"error": "method not allowed"}, 405)
+		return
+	}
+
+	disableReq := &ExchangeDisableRequest{}
+	if err := json.NewDecoder(req.Body).Decode(disableReq); err != nil {
+		JSONResponse(resp, map[string]string{"error": "invalid request body: " + err.Error()}, 400)
+		return
+	}
+
+	vhost := h.amqpServer.GetVhost(disableReq.Vhost)
+	if vhost == nil {
+		JSONResponse(resp, map[string]string{"error": "vhost not found"}, 404)
+		return
+	}
+
+	ex := vhost.GetExchange(disableReq.Exchange)
+	if ex == nil {
+		JSONResponse(resp, map[string]string{"error": "exchange not found"}, 404)
+		return
+	}
+
+	ex.SetDisabled(disableReq.Disable)
+
+	JSONResponse(resp, &ExchangeDisableResponse{Disabled: ex.IsDisabled()}, 200)
+}
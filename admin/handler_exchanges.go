@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"sort"
 
+	"github.com/valinurovam/garagemq/amqp"
 	"github.com/valinurovam/garagemq/metrics"
 	"github.com/valinurovam/garagemq/server"
 )
@@ -13,6 +14,7 @@ type ExchangesHandler struct {
 }
 
 type ExchangesResponse struct {
+	ListPage
 	Items []*Exchange `json:"items"`
 }
 
@@ -23,8 +25,21 @@ type Exchange struct {
 	Durable    bool               `json:"durable"`
 	Internal   bool               `json:"internal"`
 	AutoDelete bool               `json:"auto_delete"`
+	Disabled   bool               `json:"disabled"`
 	MsgRateIn  *metrics.TrackItem `json:"msg_rate_in"`
 	MsgRateOut *metrics.TrackItem `json:"msg_rate_out"`
+	// published messages routed into at least one queue and unroutable ones, returned or dropped
+	MsgRouted     int64 `json:"msg_routed"`
+	MsgUnroutable int64 `json:"msg_unroutable"`
+	// x-meta-* arguments of exchange declaration
+	Meta *amqp.Table `json:"meta,omitempty"`
+	// properties stamped on routed messages, x-set-properties and x-default-properties arguments
+	SetProperties     amqp.Table `json:"set_properties,omitempty"`
+	DefaultProperties amqp.Table `json:"default_properties,omitempty"`
+	// type of x-schema message bodies are validated against, empty if exchange has no schema
+	SchemaType string `json:"schema_type,omitempty"`
+	// x-allowed-content-types argument, empty if exchange accepts any message
+	AllowedContentTypes []string `json:"allowed_content_types,omitempty"`
 }
 
 func NewExchangesHandler(amqpServer *server.Server) http.Handler {
@@ -32,30 +47,66 @@ func NewExchangesHandler(amqpServer *server.Server) http.Handler {
 }
 
 func (h *ExchangesHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	response := &ExchangesResponse{}
+	params, err := parseListParams(req, "name", "type")
+	if err != nil {
+		JSONResponse(resp, map[string]string{"error": err.Error()}, 400)
+		return
+	}
 
+	response := &ExchangesResponse{Items: []*Exchange{}}
+	exchangesCount := 0
 	for vhostName, vhost := range h.amqpServer.GetVhosts() {
 		for _, exchange := range vhost.GetExchanges() {
+			exchangesCount++
 			name := exchange.GetName()
 			if name == "" {
 				name = "(AMQP default)"
 			}
+			if !params.matchName(name) {
+				continue
+			}
+			set, defaults := exchange.GetProperties()
+			var schemaType string
+			if validator := exchange.GetSchema(); validator != nil {
+				schemaType = validator.Type()
+			}
 			response.Items = append(
 				response.Items,
 				&Exchange{
-					Name:       name,
-					Vhost:      vhostName,
-					Durable:    exchange.IsDurable(),
-					Internal:   exchange.IsInternal(),
-					AutoDelete: exchange.IsAutoDelete(),
-					Type:       exchange.GetTypeAlias(),
-					MsgRateIn:  exchange.GetMetrics().MsgIn.Track.GetLastDiffTrackItem(),
-					MsgRateOut: exchange.GetMetrics().MsgOut.Track.GetLastDiffTrackItem(),
+					Name:          name,
+					Vhost:         vhostName,
+					Durable:       exchange.IsDurable(),
+					Internal:      exchange.IsInternal(),
+					AutoDelete:    exchange.IsAutoDelete(),
+					Disabled:      exchange.IsDisabled(),
+					Type:          exchange.GetTypeAlias(),
+					MsgRateIn:     exchange.GetMetrics().MsgIn.Track.GetLastDiffTrackItem(),
+					MsgRateOut:    exchange.GetMetrics().MsgOut.Track.GetLastDiffTrackItem(),
+					MsgRouted:     exchange.GetMetrics().MsgRouted.Counter.Count(),
+					MsgUnroutable: exchange.GetMetrics().MsgUnroutable.Counter.Count(),
+					Meta:          exchange.GetMeta(),
+
+					SetProperties:     set,
+					DefaultProperties: defaults,
+					SchemaType:        schemaType,
+
+					AllowedContentTypes: exchange.GetAllowedContentTypes(),
 				},
 			)
 		}
 	}
 
-	sort.Slice(response.Items, func(i, j int) bool { return response.Items[i].Name < response.Items[j].Name })
+	sort.Slice(response.Items, func(i, j int) bool {
+		a, b := response.Items[i], response.Items[j]
+		if params.sortBy == "type" && a.Type != b.Type {
+			return params.less(a.Type < b.Type)
+		}
+		return params.less(a.Name < b.Name)
+	})
+
+	from, to, page := params.paginate(exchangesCount, len(response.Items))
+	response.ListPage = page
+	response.Items = response.Items[from:to]
+
 	JSONResponse(resp, response, 200)
 }
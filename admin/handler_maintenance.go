@@ -0,0 +1,71 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/valinurovam/garagemq/server"
+)
+
+type MaintenanceHandler struct {
+	amqpServer *server.Server
+}
+
+// MaintenanceRequest is a body of POST /maintenance request
+type MaintenanceRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// MaintenanceResponse is a maintenance mode state, drained is true when existing consumers have nothing to drain
+type MaintenanceResponse struct {
+	Enabled bool `json:"enabled"`
+	Drained bool `json:"drained"`
+}
+
+type ReadyHandler struct {
+	amqpServer *server.Server
+}
+
+type ReadyResponse struct {
+	Status  string `json:"status"`
+	Drained bool   `json:"drained"`
+}
+
+func NewMaintenanceHandler(amqpServer *server.Server) http.Handler {
+	return &MaintenanceHandler{amqpServer: amqpServer}
+}
+
+func (h *MaintenanceHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		maintenanceReq := &MaintenanceRequest{}
+		if err := json.NewDecoder(req.Body).Decode(maintenanceReq); err != nil {
+			JSONResponse(resp, map[string]string{"error": "invalid request body: " + err.Error()}, 400)
+			return
+		}
+		h.amqpServer.SetMaintenance(maintenanceReq.Enabled)
+	default:
+		JSONResponse(resp, map[string]string{"error": "method not allowed"}, 405)
+		return
+	}
+
+	JSONResponse(resp, &MaintenanceResponse{
+		Enabled: h.amqpServer.IsMaintenance(),
+		Drained: h.amqpServer.IsDrained(),
+	}, 200)
+}
+
+func NewReadyHandler(amqpServer *server.Server) http.Handler {
+	return &ReadyHandler{amqpServer: amqpServer}
+}
+
+// ServeHTTP responds 503 in maintenance mode, so load balancer stops sending new clients to the node
+func (h *ReadyHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if h.amqpServer.IsMaintenance() {
+		JSONResponse(resp, &ReadyResponse{Status: "maintenance", Drained: h.amqpServer.IsDrained()}, 503)
+		return
+	}
+
+	JSONResponse(resp, &ReadyResponse{Status: "ready"}, 200)
+}
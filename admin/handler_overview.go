@@ -14,6 +14,8 @@ type OverviewHandler struct {
 type OverviewResponse struct {
 	Metrics  []*Metric      `json:"metrics"`
 	Counters map[string]int `json:"counters"`
+	// histograms of traced message stages in microseconds, omitted if tracing is disabled
+	Traces map[string]*metrics.HistogramSnapshot `json:"traces,omitempty"`
 }
 
 type Metric struct {
@@ -31,6 +33,7 @@ func (h *OverviewHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request)
 	}
 	h.populateMetrics(response)
 	h.populateCounters(response)
+	response.Traces = metrics.TraceSnapshots()
 
 	JSONResponse(resp, response, 200)
 }
@@ -61,6 +64,14 @@ func (h *OverviewHandler) populateMetrics(response *OverviewResponse) {
 		Name:   "server.traffic_out",
 		Sample: serverMetrics.TrafficOut.Track.GetDiffTrack(),
 	})
+	response.Metrics = append(response.Metrics, &Metric{
+		Name:   "server.heartbeats_in",
+		Sample: serverMetrics.HeartbeatsIn.Track.GetDiffTrack(),
+	})
+	response.Metrics = append(response.Metrics, &Metric{
+		Name:   "server.heartbeats_out",
+		Sample: serverMetrics.HeartbeatsOut.Track.GetDiffTrack(),
+	})
 	response.Metrics = append(response.Metrics, &Metric{
 		Name:   "server.get",
 		Sample: serverMetrics.Get.Track.GetDiffTrack(),
@@ -77,6 +88,26 @@ func (h *OverviewHandler) populateMetrics(response *OverviewResponse) {
 		Name:   "server.total",
 		Sample: serverMetrics.Total.Track.GetTrack(),
 	})
+	response.Metrics = append(response.Metrics, &Metric{
+		Name:   "server.connections",
+		Sample: serverMetrics.Connections.Track.GetTrack(),
+	})
+	response.Metrics = append(response.Metrics, &Metric{
+		Name:   "server.channels",
+		Sample: serverMetrics.Channels.Track.GetTrack(),
+	})
+	response.Metrics = append(response.Metrics, &Metric{
+		Name:   "server.storage_used",
+		Sample: serverMetrics.StorageUsed.Track.GetTrack(),
+	})
+	response.Metrics = append(response.Metrics, &Metric{
+		Name:   "server.disk_alarm",
+		Sample: serverMetrics.DiskAlarm.Track.GetTrack(),
+	})
+	response.Metrics = append(response.Metrics, &Metric{
+		Name:   "server.publish_rejected",
+		Sample: serverMetrics.PublishRejected.Track.GetDiffTrack(),
+	})
 }
 
 func (h *OverviewHandler) populateCounters(response *OverviewResponse) {
@@ -84,11 +115,22 @@ func (h *OverviewHandler) populateCounters(response *OverviewResponse) {
 	response.Counters["channels"] = 0
 	response.Counters["exchanges"] = 0
 	response.Counters["queues"] = 0
+	response.Counters["storage_used"] = 0
 	response.Counters["consumers"] = 0
 
+	response.Counters["disk_alarm"] = 0
+	if raised, _ := h.amqpServer.DiskAlarm(); raised {
+		response.Counters["disk_alarm"] = 1
+	}
+
+	openFds, fdsLimit := h.amqpServer.FileDescriptors()
+	response.Counters["fds"] = openFds
+	response.Counters["fds_limit"] = int(fdsLimit)
+
 	for _, vhost := range h.amqpServer.GetVhosts() {
 		response.Counters["exchanges"] += len(vhost.GetExchanges())
 		response.Counters["queues"] += len(vhost.GetQueues())
+		response.Counters["storage_used"] += int(vhost.StorageUsed())
 	}
 
 	for _, conn := range h.amqpServer.GetConnections() {
@@ -0,0 +1,59 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/valinurovam/garagemq/server"
+)
+
+type QueueElectHandler struct {
+	amqpServer *server.Server
+}
+
+// QueueElectRequest is a body of POST /queues/elect request
+type QueueElectRequest struct {
+	Vhost string `json:"vhost"`
+	Queue string `json:"queue"`
+}
+
+type QueueElectResponse struct {
+	ActiveConsumer string `json:"active_consumer"`
+}
+
+func NewQueueElectHandler(amqpServer *server.Server) http.Handler {
+	return &QueueElectHandler{amqpServer: amqpServer}
+}
+
+func (h *QueueElectHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		JSONResponse(resp, map[string]string{"error": "method not allowed"}, 405)
+		return
+	}
+
+	electReq := &QueueElectRequest{}
+	if err := json.NewDecoder(req.Body).Decode(electReq); err != nil {
+		JSONResponse(resp, map[string]string{"error": "invalid request body: " + err.Error()}, 400)
+		return
+	}
+
+	vhost := h.amqpServer.GetVhost(electReq.Vhost)
+	if vhost == nil {
+		JSONResponse(resp, map[string]string{"error": "vhost not found"}, 404)
+		return
+	}
+
+	queue := vhost.GetQueue(electReq.Queue)
+	if queue == nil {
+		JSONResponse(resp, map[string]string{"error": "queue not found"}, 404)
+		return
+	}
+
+	tag, err := queue.ElectNextConsumer()
+	if err != nil {
+		JSONResponse(resp, map[string]string{"error": err.Error()}, 400)
+		return
+	}
+
+	JSONResponse(resp, &QueueElectResponse{ActiveConsumer: tag}, 200)
+}
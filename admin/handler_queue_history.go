@@ -0,0 +1,78 @@
+package admin
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/valinurovam/garagemq/metrics"
+	"github.com/valinurovam/garagemq/server"
+)
+
+type QueueHistoryHandler struct {
+	amqpServer *server.Server
+}
+
+type QueueHistoryResponse struct {
+	Name  string `json:"name"`
+	Vhost string `json:"vhost"`
+	// interval between samples in seconds
+	Resolution int64 `json:"resolution"`
+	// depth counters are sampled as is, rate counters as diff between samples
+	Metrics []*Metric `json:"metrics"`
+}
+
+var queueDepthCounters = map[string]bool{
+	"ready":   true,
+	"unacked": true,
+	"total":   true,
+	"state":   true,
+}
+
+func NewQueueHistoryHandler(amqpServer *server.Server) http.Handler {
+	return &QueueHistoryHandler{amqpServer: amqpServer}
+}
+
+func (h *QueueHistoryHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	vhName := req.Form.Get("vhost")
+	quName := req.Form.Get("queue")
+
+	vhost := h.amqpServer.GetVhost(vhName)
+	if vhost == nil {
+		JSONResponse(resp, map[string]string{"error": "vhost not found"}, 404)
+		return
+	}
+
+	queue := vhost.GetQueue(quName)
+	if queue == nil {
+		JSONResponse(resp, map[string]string{"error": "queue not found"}, 404)
+		return
+	}
+
+	response := &QueueHistoryResponse{
+		Name:       queue.GetName(),
+		Vhost:      vhName,
+		Resolution: int64(metrics.HistoryResolution().Seconds()),
+		Metrics:    []*Metric{},
+	}
+
+	for name, track := range queue.GetMetrics().History {
+		sample := track.GetDiffTrack()
+		if queueDepthCounters[name] {
+			sample = track.GetTrack()
+		}
+		response.Metrics = append(response.Metrics, &Metric{
+			Name:   "queue." + name,
+			Sample: sample,
+		})
+	}
+
+	sort.Slice(
+		response.Metrics,
+		func(i, j int) bool {
+			return response.Metrics[i].Name < response.Metrics[j].Name
+		},
+	)
+
+	JSONResponse(resp, response, 200)
+}
@@ -0,0 +1,169 @@
+package admin
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/server"
+)
+
+// defaultMessageLookupLimit is a max number of messages returned on lookup by message_id property
+const defaultMessageLookupLimit = 10
+
+type QueueMessageHandler struct {
+	amqpServer *server.Server
+}
+
+type QueueMessageResponse struct {
+	Vhost string          `json:"vhost"`
+	Queue string          `json:"queue"`
+	Items []*QueueMessage `json:"items"`
+}
+
+// QueueMessage represents message of queue, payload is empty for message with body spooled to disk
+type QueueMessage struct {
+	ID         uint64                 `json:"id"`
+	Exchange   string                 `json:"exchange"`
+	RoutingKey string                 `json:"routing_key"`
+	Properties map[string]interface{} `json:"properties"`
+	Size       uint64                 `json:"size"`
+	Spooled    bool                   `json:"spooled,omitempty"`
+	Payload    string                 `json:"payload"`
+	// string or base64 for payload not valid UTF-8
+	PayloadEncoding string `json:"payload_encoding"`
+}
+
+func NewQueueMessageHandler(amqpServer *server.Server) http.Handler {
+	return &QueueMessageHandler{amqpServer: amqpServer}
+}
+
+func (h *QueueMessageHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	vhName := req.Form.Get("vhost")
+	quName := req.Form.Get("queue")
+
+	vhost := h.amqpServer.GetVhost(vhName)
+	if vhost == nil {
+		JSONResponse(resp, map[string]string{"error": "vhost not found"}, 404)
+		return
+	}
+
+	queue := vhost.GetQueue(quName)
+	if queue == nil {
+		JSONResponse(resp, map[string]string{"error": "queue not found"}, 404)
+		return
+	}
+
+	var messages []*amqp.Message
+	switch {
+	case req.Form.Get("id") != "":
+		id, err := strconv.ParseUint(req.Form.Get("id"), 10, 64)
+		if err != nil {
+			JSONResponse(resp, map[string]string{"error": "invalid id"}, 400)
+			return
+		}
+		if message := queue.GetMessage(id); message != nil {
+			messages = append(messages, message)
+		}
+	case req.Form.Get("message_id") != "":
+		limit := defaultMessageLookupLimit
+		if req.Form.Get("limit") != "" {
+			var err error
+			if limit, err = strconv.Atoi(req.Form.Get("limit")); err != nil || limit <= 0 {
+				JSONResponse(resp, map[string]string{"error": "invalid limit"}, 400)
+				return
+			}
+		}
+		messageID := req.Form.Get("message_id")
+		messages = queue.FindMessages(limit, func(message *amqp.Message) bool {
+			props := message.Header.PropertyList
+			return props.MessageId != nil && *props.MessageId == messageID
+		})
+	default:
+		JSONResponse(resp, map[string]string{"error": "id or message_id is required"}, 400)
+		return
+	}
+
+	if len(messages) == 0 {
+		JSONResponse(resp, map[string]string{"error": "message not found"}, 404)
+		return
+	}
+
+	response := &QueueMessageResponse{
+		Vhost: vhName,
+		Queue: quName,
+		Items: []*QueueMessage{},
+	}
+	for _, message := range messages {
+		response.Items = append(response.Items, getQueueMessage(message))
+	}
+
+	JSONResponse(resp, response, 200)
+}
+
+func getQueueMessage(message *amqp.Message) *QueueMessage {
+	item := &QueueMessage{
+		ID:              message.ID,
+		Exchange:        message.Exchange,
+		RoutingKey:      message.RoutingKey,
+		Properties:      getMessageProperties(message.Header.PropertyList),
+		Size:            message.BodySize,
+		Spooled:         message.SpoolPath != "",
+		PayloadEncoding: "string",
+	}
+
+	var payload []byte
+	for _, frame := range message.Body {
+		payload = append(payload, frame.Payload...)
+	}
+	if utf8.Valid(payload) {
+		item.Payload = string(payload)
+	} else {
+		item.Payload = base64.StdEncoding.EncodeToString(payload)
+		item.PayloadEncoding = "base64"
+	}
+
+	return item
+}
+
+func getMessageProperties(props *amqp.BasicPropertyList) map[string]interface{} {
+	properties := make(map[string]interface{})
+	if props == nil {
+		return properties
+	}
+
+	strings := map[string]*string{
+		"content_type":     props.ContentType,
+		"content_encoding": props.ContentEncoding,
+		"correlation_id":   props.CorrelationId,
+		"reply_to":         props.ReplyTo,
+		"expiration":       props.Expiration,
+		"message_id":       props.MessageId,
+		"type":             props.Type,
+		"user_id":          props.UserId,
+		"app_id":           props.AppId,
+	}
+	for name, value := range strings {
+		if value != nil {
+			properties[name] = *value
+		}
+	}
+	if props.DeliveryMode != nil {
+		properties["delivery_mode"] = *props.DeliveryMode
+	}
+	if props.Priority != nil {
+		properties["priority"] = *props.Priority
+	}
+	if props.Timestamp != nil {
+		properties["timestamp"] = props.Timestamp.UnixNano() / int64(time.Second)
+	}
+	if props.Headers != nil {
+		properties["headers"] = props.Headers
+	}
+
+	return properties
+}
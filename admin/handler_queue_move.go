@@ -0,0 +1,72 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/valinurovam/garagemq/server"
+)
+
+type QueueMoveHandler struct {
+	amqpServer *server.Server
+}
+
+// QueueMoveRequest is a body of POST /queues/move request
+type QueueMoveRequest struct {
+	Vhost       string `json:"vhost"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Count       int    `json:"count"`
+	// copy messages instead of move, source queue is not changed
+	Copy bool `json:"copy"`
+}
+
+type QueueMoveResponse struct {
+	Moved int `json:"moved"`
+}
+
+func NewQueueMoveHandler(amqpServer *server.Server) http.Handler {
+	return &QueueMoveHandler{amqpServer: amqpServer}
+}
+
+func (h *QueueMoveHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		JSONResponse(resp, map[string]string{"error": "method not allowed"}, 405)
+		return
+	}
+
+	moveReq := &QueueMoveRequest{}
+	if err := json.NewDecoder(req.Body).Decode(moveReq); err != nil {
+		JSONResponse(resp, map[string]string{"error": "invalid request body: " + err.Error()}, 400)
+		return
+	}
+
+	if moveReq.Count <= 0 {
+		JSONResponse(resp, map[string]string{"error": "count should be greater than 0"}, 400)
+		return
+	}
+
+	vhost := h.amqpServer.GetVhost(moveReq.Vhost)
+	if vhost == nil {
+		JSONResponse(resp, map[string]string{"error": "vhost not found"}, 404)
+		return
+	}
+
+	if vhost.GetQueue(moveReq.Source) == nil {
+		JSONResponse(resp, map[string]string{"error": "source queue not found"}, 404)
+		return
+	}
+
+	if vhost.GetQueue(moveReq.Destination) == nil {
+		JSONResponse(resp, map[string]string{"error": "destination queue not found"}, 404)
+		return
+	}
+
+	moved, err := vhost.MoveMessages(moveReq.Source, moveReq.Destination, moveReq.Count, moveReq.Copy)
+	if err != nil {
+		JSONResponse(resp, map[string]interface{}{"error": err.Error(), "moved": moved}, 400)
+		return
+	}
+
+	JSONResponse(resp, &QueueMoveResponse{Moved: moved}, 200)
+}
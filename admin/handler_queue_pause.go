@@ -0,0 +1,61 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/valinurovam/garagemq/server"
+)
+
+type QueuePauseHandler struct {
+	amqpServer *server.Server
+}
+
+// QueuePauseRequest is a body of POST /queues/pause request
+// Paused queue holds deliveries to consumers and basic.get, but still accepts publishes
+type QueuePauseRequest struct {
+	Vhost string `json:"vhost"`
+	Queue string `json:"queue"`
+	Pause bool   `json:"pause"`
+}
+
+type QueuePauseResponse struct {
+	Paused bool `json:"paused"`
+}
+
+func NewQueuePauseHandler(amqpServer *server.Server) http.Handler {
+	return &QueuePauseHandler{amqpServer: amqpServer}
+}
+
+func (h *QueuePauseHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		JSONResponse(resp, map[string]string{"error": "method not allowed"}, 405)
+		return
+	}
+
+	pauseReq := &QueuePauseRequest{}
+	if err := json.NewDecoder(req.Body).Decode(pauseReq); err != nil {
+		JSONResponse(resp, map[string]string{"error": "invalid request body: " + err.Error()}, 400)
+		return
+	}
+
+	vhost := h.amqpServer.GetVhost(pauseReq.Vhost)
+	if vhost == nil {
+		JSONResponse(resp, map[string]string{"error": "vhost not found"}, 404)
+		return
+	}
+
+	queue := vhost.GetQueue(pauseReq.Queue)
+	if queue == nil {
+		JSONResponse(resp, map[string]string{"error": "queue not found"}, 404)
+		return
+	}
+
+	if pauseReq.Pause {
+		queue.Pause()
+	} else {
+		queue.Resume()
+	}
+
+	JSONResponse(resp, &QueuePauseResponse{Paused: queue.IsPaused()}, 200)
+}
@@ -0,0 +1,94 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/valinurovam/garagemq/server"
+)
+
+type QueueQuarantinedHandler struct {
+	amqpServer *server.Server
+}
+
+type QueueQuarantinedResponse struct {
+	Items []*QuarantinedQueue `json:"items"`
+}
+
+// QuarantinedQueue is durable queue which recovery failed on startup in safe mode
+type QuarantinedQueue struct {
+	Name  string    `json:"name"`
+	Vhost string    `json:"vhost"`
+	Error string    `json:"error"`
+	Since time.Time `json:"since"`
+}
+
+func NewQueueQuarantinedHandler(amqpServer *server.Server) http.Handler {
+	return &QueueQuarantinedHandler{amqpServer: amqpServer}
+}
+
+func (h *QueueQuarantinedHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	response := &QueueQuarantinedResponse{Items: []*QuarantinedQueue{}}
+	for vhostName, vhost := range h.amqpServer.GetVhosts() {
+		for _, qu := range vhost.GetQuarantinedQueues() {
+			response.Items = append(response.Items, &QuarantinedQueue{
+				Name:  qu.Name,
+				Vhost: vhostName,
+				Error: qu.Error,
+				Since: qu.Since,
+			})
+		}
+	}
+
+	sort.Slice(response.Items, func(i, j int) bool {
+		if response.Items[i].Vhost != response.Items[j].Vhost {
+			return response.Items[i].Vhost < response.Items[j].Vhost
+		}
+		return response.Items[i].Name < response.Items[j].Name
+	})
+
+	JSONResponse(resp, response, 200)
+}
+
+type QueueQuarantinedDropHandler struct {
+	amqpServer *server.Server
+}
+
+// QueueQuarantinedDropRequest is a body of POST /queues/quarantined/drop request
+// Record, bindings and messages of quarantined queue are removed from storage, then queue may be declared again
+type QueueQuarantinedDropRequest struct {
+	Vhost string `json:"vhost"`
+	Queue string `json:"queue"`
+}
+
+func NewQueueQuarantinedDropHandler(amqpServer *server.Server) http.Handler {
+	return &QueueQuarantinedDropHandler{amqpServer: amqpServer}
+}
+
+func (h *QueueQuarantinedDropHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		JSONResponse(resp, map[string]string{"error": "method not allowed"}, 405)
+		return
+	}
+
+	dropReq := &QueueQuarantinedDropRequest{}
+	if err := json.NewDecoder(req.Body).Decode(dropReq); err != nil {
+		JSONResponse(resp, map[string]string{"error": "invalid request body: " + err.Error()}, 400)
+		return
+	}
+
+	vhost := h.amqpServer.GetVhost(dropReq.Vhost)
+	if vhost == nil {
+		JSONResponse(resp, map[string]string{"error": "vhost not found"}, 404)
+		return
+	}
+
+	if err := vhost.DropQuarantinedQueue(dropReq.Queue); err != nil {
+		JSONResponse(resp, map[string]string{"error": err.Error()}, 404)
+		return
+	}
+
+	JSONResponse(resp, map[string]string{"status": "ok"}, 200)
+}
@@ -0,0 +1,54 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/valinurovam/garagemq/server"
+)
+
+type QueueRequeueUnackedHandler struct {
+	amqpServer *server.Server
+}
+
+// QueueRequeueUnackedRequest is a body of POST /queues/requeue-unacked request
+// All messages of queue delivered on any channel and not acknowledged yet are returned into queue and redelivered
+type QueueRequeueUnackedRequest struct {
+	Vhost string `json:"vhost"`
+	Queue string `json:"queue"`
+}
+
+type QueueRequeueUnackedResponse struct {
+	Requeued int `json:"requeued"`
+}
+
+func NewQueueRequeueUnackedHandler(amqpServer *server.Server) http.Handler {
+	return &QueueRequeueUnackedHandler{amqpServer: amqpServer}
+}
+
+func (h *QueueRequeueUnackedHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		JSONResponse(resp, map[string]string{"error": "method not allowed"}, 405)
+		return
+	}
+
+	requeueReq := &QueueRequeueUnackedRequest{}
+	if err := json.NewDecoder(req.Body).Decode(requeueReq); err != nil {
+		JSONResponse(resp, map[string]string{"error": "invalid request body: " + err.Error()}, 400)
+		return
+	}
+
+	vhost := h.amqpServer.GetVhost(requeueReq.Vhost)
+	if vhost == nil {
+		JSONResponse(resp, map[string]string{"error": "vhost not found"}, 404)
+		return
+	}
+
+	requeued, err := vhost.RequeueUnacked(requeueReq.Queue)
+	if err != nil {
+		JSONResponse(resp, map[string]string{"error": err.Error()}, 404)
+		return
+	}
+
+	JSONResponse(resp, &QueueRequeueUnackedResponse{Requeued: requeued}, 200)
+}
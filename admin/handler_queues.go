@@ -4,7 +4,9 @@ import (
 	"net/http"
 	"sort"
 
+	"github.com/valinurovam/garagemq/amqp"
 	"github.com/valinurovam/garagemq/metrics"
+	"github.com/valinurovam/garagemq/msgstorage"
 	"github.com/valinurovam/garagemq/server"
 )
 
@@ -13,6 +15,7 @@ type QueuesHandler struct {
 }
 
 type QueuesResponse struct {
+	ListPage
 	Items []*Queue `json:"items"`
 }
 
@@ -22,8 +25,21 @@ type Queue struct {
 	Durable    bool   `json:"durable"`
 	AutoDelete bool   `json:"auto_delete"`
 	Exclusive  bool   `json:"exclusive"`
+	State      string `json:"state"`
+	Paused     bool   `json:"paused"`
+	// tag of the only consumer getting messages of queue with single active consumer
+	ActiveConsumer string `json:"active_consumer,omitempty"`
+	// number and size of persisted messages
+	Stored msgstorage.QueueStats `json:"stored"`
+	// x-meta-* arguments of queue declaration
+	Meta *amqp.Table `json:"meta,omitempty"`
+	// type of x-schema message bodies are validated against, empty if queue has no schema
+	SchemaType string `json:"schema_type,omitempty"`
+	// time the head ready message is in queue in milliseconds, 0 if queue has no ready messages
+	OldestMessageAge int64 `json:"oldest_message_age"`
 
-	Counters map[string]*metrics.TrackItem `json:"counters"`
+	Counters        map[string]*metrics.TrackItem `json:"counters"`
+	DeliveryLatency *metrics.HistogramSnapshot    `json:"delivery_latency"`
 }
 
 func NewQueuesHandler(amqpServer *server.Server) http.Handler {
@@ -31,9 +47,26 @@ func NewQueuesHandler(amqpServer *server.Server) http.Handler {
 }
 
 func (h *QueuesHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	response := &QueuesResponse{}
+	params, err := parseListParams(req, "name", "depth", "age")
+	if err != nil {
+		JSONResponse(resp, map[string]string{"error": err.Error()}, 400)
+		return
+	}
+
+	response := &QueuesResponse{Items: []*Queue{}}
+	depth := make(map[string]uint64)
+	age := make(map[string]int64)
+	queuesCount := 0
 	for vhostName, vhost := range h.amqpServer.GetVhosts() {
 		for _, queue := range vhost.GetQueues() {
+			queuesCount++
+			if !params.matchName(queue.GetName()) {
+				continue
+			}
+			depth[vhostName+"/"+queue.GetName()] = queue.Length()
+			oldestAge := queue.OldestMessageAge()
+			age[vhostName+"/"+queue.GetName()] = oldestAge
+
 			ready := queue.GetMetrics().Ready.Track.GetLastTrackItem()
 			total := queue.GetMetrics().Total.Track.GetLastTrackItem()
 			unacked := queue.GetMetrics().Unacked.Track.GetLastTrackItem()
@@ -43,6 +76,11 @@ func (h *QueuesHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 			get := queue.GetMetrics().Get.Track.GetLastDiffTrackItem()
 			ack := queue.GetMetrics().Ack.Track.GetLastDiffTrackItem()
 
+			var schemaType string
+			if validator := queue.GetSchema(); validator != nil {
+				schemaType = validator.Type()
+			}
+
 			response.Items = append(
 				response.Items,
 				&Queue{
@@ -51,6 +89,15 @@ func (h *QueuesHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 					Durable:    queue.IsDurable(),
 					AutoDelete: queue.IsAutoDelete(),
 					Exclusive:  queue.IsExclusive(),
+					State:      queue.State(),
+					Paused:     queue.IsPaused(),
+
+					ActiveConsumer: queue.ActiveConsumer(),
+					Stored:         vhost.GetQueueStorageStats(queue.GetName()),
+					Meta:           queue.GetMeta(),
+					SchemaType:     schemaType,
+
+					OldestMessageAge: oldestAge,
 					Counters: map[string]*metrics.TrackItem{
 						"ready":   ready,
 						"total":   total,
@@ -61,6 +108,7 @@ func (h *QueuesHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 						"incoming": incoming,
 						"deliver":  deliver,
 					},
+					DeliveryLatency: queue.GetMetrics().DeliveryLatency.Snapshot(),
 				},
 			)
 		}
@@ -69,9 +117,30 @@ func (h *QueuesHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	sort.Slice(
 		response.Items,
 		func(i, j int) bool {
-			return response.Items[i].Name > response.Items[j].Name
+			a, b := response.Items[i], response.Items[j]
+			switch params.sortBy {
+			case "name":
+				return params.less(a.Name < b.Name)
+			case "depth":
+				aDepth, bDepth := depth[a.Vhost+"/"+a.Name], depth[b.Vhost+"/"+b.Name]
+				if aDepth != bDepth {
+					return params.less(aDepth < bDepth)
+				}
+				return params.less(a.Name < b.Name)
+			case "age":
+				aAge, bAge := age[a.Vhost+"/"+a.Name], age[b.Vhost+"/"+b.Name]
+				if aAge != bAge {
+					return params.less(aAge < bAge)
+				}
+				return params.less(a.Name < b.Name)
+			}
+			return params.less(a.Name > b.Name)
 		},
 	)
 
+	from, to, page := params.paginate(queuesCount, len(response.Items))
+	response.ListPage = page
+	response.Items = response.Items[from:to]
+
 	JSONResponse(resp, response, 200)
 }
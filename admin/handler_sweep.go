@@ -0,0 +1,44 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/valinurovam/garagemq/server"
+)
+
+type SweepHandler struct {
+	amqpServer *server.Server
+}
+
+type SweepResponse struct {
+	Items []*SweepResult `json:"items"`
+}
+
+// SweepResult lists queues and exchanges removed from vhost
+type SweepResult struct {
+	Vhost     string   `json:"vhost"`
+	Queues    []string `json:"queues"`
+	Exchanges []string `json:"exchanges"`
+}
+
+func NewSweepHandler(amqpServer *server.Server) http.Handler {
+	return &SweepHandler{amqpServer: amqpServer}
+}
+
+func (h *SweepHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		JSONResponse(resp, map[string]string{"error": "method not allowed"}, 405)
+		return
+	}
+
+	response := &SweepResponse{Items: []*SweepResult{}}
+	for _, result := range h.amqpServer.Sweep() {
+		response.Items = append(response.Items, &SweepResult{
+			Vhost:     result.Vhost,
+			Queues:    result.Queues,
+			Exchanges: result.Exchanges,
+		})
+	}
+
+	JSONResponse(resp, response, 200)
+}
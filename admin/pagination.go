@@ -0,0 +1,133 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// listParams represents filter, sort and pagination query params of list endpoints
+// Without page and size params list is returned in one page
+type listParams struct {
+	name    string
+	sortBy  string
+	reverse bool
+	page    int
+	size    int
+}
+
+// ListPage represents pagination info of list response
+type ListPage struct {
+	Total     int `json:"total"`
+	Filtered  int `json:"filtered"`
+	Page      int `json:"page"`
+	PageSize  int `json:"page_size"`
+	PageCount int `json:"page_count"`
+}
+
+// parseListParams reads name, sort, sort_reverse, page and size query params
+// sortFields are allowed values of sort param
+func parseListParams(req *http.Request, sortFields ...string) (*listParams, error) {
+	query := req.URL.Query()
+	params := &listParams{
+		name:   query.Get("name"),
+		sortBy: query.Get("sort"),
+		page:   1,
+	}
+
+	if params.sortBy != "" {
+		allowed := false
+		for _, field := range sortFields {
+			allowed = allowed || field == params.sortBy
+		}
+		if !allowed {
+			return nil, fmt.Errorf("sort should be one of: %s", strings.Join(sortFields, ", "))
+		}
+	}
+
+	if value := query.Get("sort_reverse"); value != "" {
+		reverse, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sort_reverse '%s'", value)
+		}
+		params.reverse = reverse
+	}
+
+	var err error
+	if params.page, err = parsePositiveParam(query.Get("page"), 1); err != nil {
+		return nil, fmt.Errorf("invalid page: %s", err)
+	}
+	if params.size, err = parsePositiveParam(query.Get("size"), 0); err != nil {
+		return nil, fmt.Errorf("invalid size: %s", err)
+	}
+
+	return params, nil
+}
+
+func parsePositiveParam(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if number < 1 {
+		return 0, fmt.Errorf("%d is less than 1", number)
+	}
+
+	return number, nil
+}
+
+// matchName checks that any of values contains name filter
+func (params *listParams) matchName(values ...string) bool {
+	if params.name == "" {
+		return true
+	}
+	for _, value := range values {
+		if strings.Contains(value, params.name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// less applies sort_reverse to ascending comparison result
+func (params *listParams) less(ascending bool) bool {
+	return ascending != params.reverse
+}
+
+// paginate returns bounds of requested page within filtered items and pagination info
+func (params *listParams) paginate(total int, filtered int) (from int, to int, page ListPage) {
+	size := params.size
+	if size == 0 {
+		size = filtered
+	}
+
+	page = ListPage{
+		Total:    total,
+		Filtered: filtered,
+		Page:     params.page,
+		PageSize: size,
+	}
+	if size > 0 {
+		page.PageCount = filtered / size
+		if filtered%size != 0 {
+			page.PageCount++
+		}
+	}
+
+	// bounds are checked before multiplying and adding, so huge page or size does not overflow
+	from = filtered
+	if size > 0 && params.page-1 <= filtered/size {
+		from = (params.page - 1) * size
+	}
+	to = filtered
+	if size < filtered-from {
+		to = from + size
+	}
+
+	return from, to, page
+}
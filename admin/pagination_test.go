@@ -0,0 +1,79 @@
+package admin
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseListParams(t *testing.T) {
+	testCases := []struct {
+		query    string
+		expected listParams
+		failed   bool
+	}{
+		{"", listParams{page: 1}, false},
+		{"name=test&sort=name&sort_reverse=true", listParams{name: "test", sortBy: "name", reverse: true, page: 1}, false},
+		{"page=3&size=10", listParams{page: 3, size: 10}, false},
+		{"sort=unknown", listParams{}, true},
+		{"sort_reverse=maybe", listParams{}, true},
+		{"page=0", listParams{}, true},
+		{"page=-1", listParams{}, true},
+		{"page=first", listParams{}, true},
+		{"size=0", listParams{}, true},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/queues?"+tc.query, nil)
+		params, err := parseListParams(req, "name", "messages")
+		if tc.failed {
+			if err == nil {
+				t.Fatalf("Expected error for query '%s'", tc.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *params != tc.expected {
+			t.Fatalf("Expected params %+v for query '%s', actual %+v", tc.expected, tc.query, *params)
+		}
+	}
+}
+
+func TestListParams_Paginate(t *testing.T) {
+	const maxInt = int(^uint(0) >> 1)
+	testCases := []struct {
+		page      int
+		size      int
+		filtered  int
+		from      int
+		to        int
+		pageCount int
+	}{
+		{1, 0, 0, 0, 0, 0},
+		{1, 0, 5, 0, 5, 1},
+		{2, 0, 5, 5, 5, 1},
+		{1, 2, 5, 0, 2, 3},
+		{3, 2, 5, 4, 5, 3},
+		{4, 2, 5, 5, 5, 3},
+		{2, 5, 5, 5, 5, 1},
+		{maxInt/4 + 1, 4, 5, 5, 5, 2},
+		{maxInt, maxInt, 5, 5, 5, 1},
+		{2, maxInt, 5, 5, 5, 1},
+		{1, maxInt, 5, 0, 5, 1},
+	}
+
+	for _, tc := range testCases {
+		params := &listParams{page: tc.page, size: tc.size}
+		from, to, page := params.paginate(tc.filtered+1, tc.filtered)
+		if from != tc.from || to != tc.to {
+			t.Fatalf("Expected bounds [%d:%d] of page %d size %d, actual [%d:%d]", tc.from, tc.to, tc.page, tc.size, from, to)
+		}
+		if page.PageCount != tc.pageCount {
+			t.Fatalf("Expected %d pages of size %d, actual %d", tc.pageCount, tc.size, page.PageCount)
+		}
+		if page.Total != tc.filtered+1 || page.Filtered != tc.filtered || page.Page != tc.page {
+			t.Fatalf("Unexpected page info %+v", page)
+		}
+	}
+}
@@ -16,9 +16,25 @@ func NewAdminServer(amqpServer *server.Server, host string, port string) *AdminS
 	http.Handle("/overview", NewOverviewHandler(amqpServer))
 	http.Handle("/exchanges", NewExchangesHandler(amqpServer))
 	http.Handle("/queues", NewQueuesHandler(amqpServer))
+	http.Handle("/queues/history", NewQueueHistoryHandler(amqpServer))
+	http.Handle("/queues/move", NewQueueMoveHandler(amqpServer))
+	http.Handle("/queues/elect", NewQueueElectHandler(amqpServer))
+	http.Handle("/queues/pause", NewQueuePauseHandler(amqpServer))
+	http.Handle("/queues/message", NewQueueMessageHandler(amqpServer))
+	http.Handle("/queues/requeue-unacked", NewQueueRequeueUnackedHandler(amqpServer))
+	http.Handle("/queues/quarantined", NewQueueQuarantinedHandler(amqpServer))
+	http.Handle("/queues/quarantined/drop", NewQueueQuarantinedDropHandler(amqpServer))
+	http.Handle("/exchanges/disable", NewExchangeDisableHandler(amqpServer))
 	http.Handle("/connections", NewConnectionsHandler(amqpServer))
 	http.Handle("/bindings", NewBindingsHandler(amqpServer))
 	http.Handle("/channels", NewChannelsHandler(amqpServer))
+	http.Handle("/channels/unacked", NewChannelUnackedHandler(amqpServer))
+	http.Handle("/consumers", NewConsumersHandler(amqpServer))
+	http.Handle("/consumers/cancel", NewConsumerCancelHandler(amqpServer))
+	http.Handle("/definitions", NewDefinitionsHandler(amqpServer))
+	http.Handle("/sweep", NewSweepHandler(amqpServer))
+	http.Handle("/maintenance", NewMaintenanceHandler(amqpServer))
+	http.Handle("/readyz", NewReadyHandler(amqpServer))
 
 	adminServer := &AdminServer{}
 	adminServer.s = &http.Server{
@@ -135,6 +135,12 @@ const MethodConnectionBlocked = 60
 // MethodConnectionUnblocked
 const MethodConnectionUnblocked = 61
 
+// MethodConnectionUpdateSecret
+const MethodConnectionUpdateSecret = 70
+
+// MethodConnectionUpdateSecretOk
+const MethodConnectionUpdateSecretOk = 71
+
 // ClassChannel
 const ClassChannel = 20
 
@@ -273,6 +279,9 @@ const MethodBasicRecoverOk = 111
 // MethodBasicNack
 const MethodBasicNack = 120
 
+// MethodBasicRouted
+const MethodBasicRouted = 130
+
 // ClassTx
 const ClassTx = 90
 
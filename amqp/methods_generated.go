@@ -797,6 +797,110 @@ func (method *ConnectionUnblocked) Write(writer io.Writer, protoVersion string)
 	return
 }
 
+// ConnectionUpdateSecret This method updates the secret used to authenticate this connection.
+// It is used when secrets have an expiration date and need to be renewed,
+// like OAuth 2 tokens.
+type ConnectionUpdateSecret struct {
+	NewSecret []byte
+	Reason    string
+}
+
+// Name returns method name as string, usefully for logging
+func (method *ConnectionUpdateSecret) Name() string {
+	return "ConnectionUpdateSecret"
+}
+
+// FrameType returns method frame type
+func (method *ConnectionUpdateSecret) FrameType() byte {
+	return 1
+}
+
+// ClassIdentifier returns method classID
+func (method *ConnectionUpdateSecret) ClassIdentifier() uint16 {
+	return 10
+}
+
+// MethodIdentifier returns method methodID
+func (method *ConnectionUpdateSecret) MethodIdentifier() uint16 {
+	return 70
+}
+
+// Sync is method should me sent synchronous
+func (method *ConnectionUpdateSecret) Sync() bool {
+	return true
+}
+
+// Read method from io reader
+func (method *ConnectionUpdateSecret) Read(reader io.Reader, protoVersion string) (err error) {
+
+	method.NewSecret, err = ReadLongstr(reader)
+	if err != nil {
+		return err
+	}
+
+	method.Reason, err = ReadShortstr(reader)
+	if err != nil {
+		return err
+	}
+
+	return
+}
+
+// Write method from io reader
+func (method *ConnectionUpdateSecret) Write(writer io.Writer, protoVersion string) (err error) {
+
+	if err = WriteLongstr(writer, method.NewSecret); err != nil {
+		return err
+	}
+
+	if err = WriteShortstr(writer, method.Reason); err != nil {
+		return err
+	}
+
+	return
+}
+
+// ConnectionUpdateSecretOk This method confirms the update of the secret used to authenticate this connection.
+type ConnectionUpdateSecretOk struct {
+}
+
+// Name returns method name as string, usefully for logging
+func (method *ConnectionUpdateSecretOk) Name() string {
+	return "ConnectionUpdateSecretOk"
+}
+
+// FrameType returns method frame type
+func (method *ConnectionUpdateSecretOk) FrameType() byte {
+	return 1
+}
+
+// ClassIdentifier returns method classID
+func (method *ConnectionUpdateSecretOk) ClassIdentifier() uint16 {
+	return 10
+}
+
+// MethodIdentifier returns method methodID
+func (method *ConnectionUpdateSecretOk) MethodIdentifier() uint16 {
+	return 71
+}
+
+// Sync is method should me sent synchronous
+func (method *ConnectionUpdateSecretOk) Sync() bool {
+	return true
+}
+
+// Read method from io reader
+func (method *ConnectionUpdateSecretOk) Read(reader io.Reader, protoVersion string) (err error) {
+
+	return
+}
+
+// Write method from io reader
+func (method *ConnectionUpdateSecretOk) Write(writer io.Writer, protoVersion string) (err error) {
+
+	return
+}
+
 // Channel methods
 
 // ChannelOpen This method opens a channel to the server.
@@ -4087,6 +4191,70 @@ func (method *BasicNack) Write(writer io.Writer, protoVersion string) (err error
 	return
 }
 
+// BasicRouted This method is sent by the server to publishers which advertised basic.routed
+// capability, one method for each published message in publish order. It carries
+// number of queues message is pushed into, so publisher detects unroutable,
+// rejected or dropped messages without mandatory flag.
+type BasicRouted struct {
+	DeliveryTag uint64
+	QueueCount  uint32
+}
+
+// Name returns method name as string, usefully for logging
+func (method *BasicRouted) Name() string {
+	return "BasicRouted"
+}
+
+// FrameType returns method frame type
+func (method *BasicRouted) FrameType() byte {
+	return 1
+}
+
+// ClassIdentifier returns method classID
+func (method *BasicRouted) ClassIdentifier() uint16 {
+	return 60
+}
+
+// MethodIdentifier returns method methodID
+func (method *BasicRouted) MethodIdentifier() uint16 {
+	return 130
+}
+
+// Sync is method should me sent synchronous
+func (method *BasicRouted) Sync() bool {
+	return false
+}
+
+// Read method from io reader
+func (method *BasicRouted) Read(reader io.Reader, protoVersion string) (err error) {
+
+	method.DeliveryTag, err = ReadLonglong(reader)
+	if err != nil {
+		return err
+	}
+
+	method.QueueCount, err = ReadLong(reader)
+	if err != nil {
+		return err
+	}
+
+	return
+}
+
+// Write method from io reader
+func (method *BasicRouted) Write(writer io.Writer, protoVersion string) (err error) {
+
+	if err = WriteLonglong(writer, method.DeliveryTag); err != nil {
+		return err
+	}
+
+	if err = WriteLong(writer, method.QueueCount); err != nil {
+		return err
+	}
+
+	return
+}
+
 // Tx methods
 
 // TxSelect This method sets the channel to use standard transactions. The client must use this
@@ -4548,6 +4716,18 @@ func ReadMethod(reader io.Reader, protoVersion string) (Method, error) {
 				return nil, err
 			}
 			return method, nil
+		case 70:
+			var method = &ConnectionUpdateSecret{}
+			if err := method.Read(reader, protoVersion); err != nil {
+				return nil, err
+			}
+			return method, nil
+		case 71:
+			var method = &ConnectionUpdateSecretOk{}
+			if err := method.Read(reader, protoVersion); err != nil {
+				return nil, err
+			}
+			return method, nil
 		}
 	case 20:
 		switch methodId {
@@ -4816,6 +4996,12 @@ func ReadMethod(reader io.Reader, protoVersion string) (Method, error) {
 				return nil, err
 			}
 			return method, nil
+		case 130:
+			var method = &BasicRouted{}
+			if err := method.Read(reader, protoVersion); err != nil {
+				return nil, err
+			}
+			return method, nil
 		}
 	case 90:
 		switch methodId {
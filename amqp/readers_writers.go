@@ -173,7 +173,11 @@ func ReadShortstr(r io.Reader) (data string, err error) {
 }
 
 // WriteShortstr writes string
+// Short string length is limited by one octet, longer strings can not be written
 func WriteShortstr(wr io.Writer, data string) error {
+	if len(data) > 255 {
+		return fmt.Errorf("short string length %d exceeds 255 octets", len(data))
+	}
 	err := binary.Write(wr, binary.BigEndian, byte(len(data)))
 	if err != nil {
 		return err
@@ -356,34 +360,34 @@ func readValue091(r io.Reader) (data interface{}, err error) {
 		return rData, nil
 	case 's':
 		var rData string
-		if rData, err = ReadShortstr(r); err == nil {
+		if rData, err = ReadShortstr(r); err != nil {
 			return nil, err
 		}
 
 		return rData, nil
 	case 'S':
 		var rData []byte
-		if rData, err = ReadLongstr(r); err == nil {
+		if rData, err = ReadLongstr(r); err != nil {
 			return nil, err
 		}
 
 		return rData, nil
 	case 'T':
 		var rData time.Time
-		if rData, err = ReadTimestamp(r); err == nil {
+		if rData, err = ReadTimestamp(r); err != nil {
 			return nil, err
 		}
 
 		return rData, nil
 	case 'A':
 		var rData []interface{}
-		if rData, err = readArray(r, Proto091); err == nil {
+		if rData, err = readArray(r, Proto091); err != nil {
 			return nil, err
 		}
 		return rData, nil
 	case 'F':
 		var rData *Table
-		if rData, err = ReadTable(r, Proto091); err == nil {
+		if rData, err = ReadTable(r, Proto091); err != nil {
 			return nil, err
 		}
 		return rData, nil
@@ -409,7 +413,8 @@ Rabbitmq table fields
 'T' time.Time		timestamp
 'F' Table			field-table
 'V' nil				no-field
-'x' []interface{} 	field-array
+'A' []interface{} 	field-array
+'x' []byte			byte-array, field-array written by previous versions with the same tag is read as []interface{}
 */
 func readValueRabbit(r io.Reader) (data interface{}, err error) {
 	vType, err := ReadOctet(r)
@@ -485,12 +490,24 @@ func readValueRabbit(r io.Reader) (data interface{}, err error) {
 		}
 
 		return rData, nil
-	case 'x':
+	case 'A':
 		var rData []interface{}
 		if rData, err = readArray(r, ProtoRabbit); err != nil {
 			return nil, err
 		}
 		return rData, nil
+	case 'x':
+		var rData []byte
+		if rData, err = ReadLongstr(r); err != nil {
+			return nil, err
+		}
+		// field-array was written with 'x' tag before, so tables stored by previous versions are kept readable
+		if len(rData) > 0 {
+			if arrData, errArr := parseArray(rData, ProtoRabbit); errArr == nil {
+				return arrData, nil
+			}
+		}
+		return rData, nil
 	case 'F':
 		var rData *Table
 		if rData, err = ReadTable(r, ProtoRabbit); err != nil {
@@ -632,6 +649,11 @@ func writeValue091(writer io.Writer, v interface{}) (err error) {
 		if err = WriteOctet(writer, byte('F')); err == nil {
 			err = WriteTable(writer, &value, Proto091)
 		}
+	case *Table:
+		// nested tables are read as *Table, so they should be written back the same way
+		if err = WriteOctet(writer, byte('F')); err == nil {
+			err = WriteTable(writer, value, Proto091)
+		}
 	case nil:
 		err = binary.Write(writer, binary.BigEndian, byte('V'))
 	default:
@@ -656,7 +678,8 @@ Rabbitmq table fields
 'T' time.Time		timestamp
 'F' Table			field-table
 'V' nil				no-field
-'x' []interface{} 	field-array
+'A' []interface{} 	field-array
+'x' []byte			byte-array
 */
 func writeValueRabbit(writer io.Writer, v interface{}) (err error) {
 	switch value := v.(type) {
@@ -727,17 +750,21 @@ func writeValueRabbit(writer io.Writer, v interface{}) (err error) {
 			err = WriteTimestamp(writer, value)
 		}
 	case []interface{}:
-		if err = WriteOctet(writer, byte('x')); err == nil {
+		if err = WriteOctet(writer, byte('A')); err == nil {
 			err = writeArray(writer, value, ProtoRabbit)
 		}
 	case Table:
 		if err = WriteOctet(writer, byte('F')); err == nil {
 			err = WriteTable(writer, &value, ProtoRabbit)
 		}
+	case *Table:
+		if err = WriteOctet(writer, byte('F')); err == nil {
+			err = WriteTable(writer, value, ProtoRabbit)
+		}
 	case nil:
 		err = binary.Write(writer, binary.BigEndian, byte('V'))
 	default:
-		err = fmt.Errorf("unsupported type by %s protocol", Proto091)
+		err = fmt.Errorf("unsupported type by %s protocol", ProtoRabbit)
 	}
 
 	return
@@ -756,12 +783,17 @@ func writeArray(writer io.Writer, array []interface{}, protoVersion string) erro
 }
 
 func readArray(r io.Reader, protoVersion string) (data []interface{}, err error) {
-	data = make([]interface{}, 0)
 	var arrayData []byte
 	if arrayData, err = ReadLongstr(r); err != nil {
 		return nil, err
 	}
 
+	return parseArray(arrayData, protoVersion)
+}
+
+// parseArray parses field-array items from arrayData
+func parseArray(arrayData []byte, protoVersion string) (data []interface{}, err error) {
+	data = make([]interface{}, 0)
 	arrayBuffer := bytes.NewBuffer(arrayData)
 	for arrayBuffer.Len() > 0 {
 		var itemV interface{}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -267,7 +268,8 @@ Rabbitmq table fields
 'T' time.Time		timestamp
 'F' Table			field-table
 'V' nil				no-field
-'x' []interface{} 	field-array
+'A' []interface{} 	field-array
+'x' []byte			byte-array
 */
 func TestReadWriteTable(t *testing.T) {
 
@@ -313,3 +315,206 @@ func TestReadWriteTable(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestWriteShortstr_Failed_TooLong(t *testing.T) {
+	wr := bytes.NewBuffer(make([]byte, 0))
+	if err := WriteShortstr(wr, strings.Repeat("a", 256)); err == nil {
+		t.Fatal("Expected error on too long short string")
+	}
+}
+
+func TestReadTable_Proto091_Values(t *testing.T) {
+	table := Table{
+		"string": "string",
+		"bytes":  []byte("bytes"),
+		"time":   time.Unix(time.Now().Unix(), 0),
+		"array":  []interface{}{int32(1), []byte("a")},
+		"table":  Table{"int32": int32(32)},
+	}
+
+	wr := bytes.NewBuffer(make([]byte, 0))
+	if err := WriteTable(wr, &table, Proto091); err != nil {
+		t.Fatal(err)
+	}
+
+	rTable, err := ReadTable(wr, Proto091)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Table{
+		"string": "string",
+		"bytes":  []byte("bytes"),
+		"time":   table["time"],
+		"array":  []interface{}{int32(1), []byte("a")},
+		"table":  &Table{"int32": int32(32)},
+	}
+	if !reflect.DeepEqual(*rTable, expected) {
+		t.Fatalf("Expected %v, actual %v", expected, *rTable)
+	}
+}
+
+// propertyListByFlags returns property list with fields filled in accordance with mask bits,
+// bit i of mask means i-th field of BasicPropertyList is present
+func propertyListByFlags(mask int) *BasicPropertyList {
+	props := &BasicPropertyList{}
+	value := reflect.ValueOf(props).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		if mask&(1<<uint(i)) == 0 {
+			continue
+		}
+		field := value.Field(i)
+		switch field.Interface().(type) {
+		case *string:
+			str := value.Type().Field(i).Name + "-value"
+			field.Set(reflect.ValueOf(&str))
+		case *byte:
+			b := byte(i + 1)
+			field.Set(reflect.ValueOf(&b))
+		case *time.Time:
+			ts := time.Unix(1500000000, 0)
+			field.Set(reflect.ValueOf(&ts))
+		case *Table:
+			field.Set(reflect.ValueOf(&Table{
+				"int32":  int32(32),
+				"string": "string",
+				"table":  &Table{"int32": int32(32)},
+			}))
+		default:
+			panic("unexpected property type " + field.Type().String())
+		}
+	}
+
+	return props
+}
+
+func TestReadWriteContentHeader_AllPropertyFlags(t *testing.T) {
+	fieldsCount := reflect.TypeOf(BasicPropertyList{}).NumField()
+	for _, protoVersion := range []string{Proto091, ProtoRabbit} {
+		for mask := 0; mask < 1<<uint(fieldsCount); mask++ {
+			header := &ContentHeader{
+				ClassID:      ClassBasic,
+				BodySize:     uint64(mask),
+				PropertyList: propertyListByFlags(mask),
+			}
+
+			wr := bytes.NewBuffer(make([]byte, 0))
+			if err := WriteContentHeader(wr, header, protoVersion); err != nil {
+				t.Fatal(err)
+			}
+
+			rHeader, err := ReadContentHeader(wr, protoVersion)
+			if err != nil {
+				t.Fatalf("Mask %014b, %s: %s", mask, protoVersion, err)
+			}
+
+			if wr.Len() != 0 {
+				t.Fatalf("Mask %014b, %s: %d unread bytes", mask, protoVersion, wr.Len())
+			}
+
+			if !reflect.DeepEqual(header, rHeader) {
+				t.Fatalf("Mask %014b, %s: written and read headers not equal", mask, protoVersion)
+			}
+		}
+	}
+}
+
+func TestReadWriteMethod_ProtoVersions(t *testing.T) {
+	arguments := Table{
+		"uint8":  uint8(10),
+		"int16":  int16(-2),
+		"uint16": uint16(7),
+		"uint32": uint32(5),
+		"uint64": uint64(9),
+		"string": "name",
+	}
+	// RabbitMQ has no unsigned field types, so unsigned values are written as signed ones
+	expected := map[string]Table{
+		Proto091: arguments,
+		ProtoRabbit: {
+			"uint8":  int8(10),
+			"int16":  int16(-2),
+			"uint16": int16(7),
+			"uint32": int32(5),
+			"uint64": int64(9),
+			"string": "name",
+		},
+	}
+
+	for protoVersion, expectedArguments := range expected {
+		method := &QueueDeclare{Queue: "test", Durable: true, Arguments: &arguments}
+		wr := bytes.NewBuffer(make([]byte, 0))
+		if err := WriteMethod(wr, method, protoVersion); err != nil {
+			t.Fatal(err)
+		}
+
+		rMethod, err := ReadMethod(wr, protoVersion)
+		if err != nil {
+			t.Fatalf("%s: %s", protoVersion, err)
+		}
+		declare := rMethod.(*QueueDeclare)
+		if declare.Queue != "test" || !declare.Durable {
+			t.Fatalf("%s: unexpected method %+v", protoVersion, declare)
+		}
+		if !reflect.DeepEqual(*declare.Arguments, expectedArguments) {
+			t.Fatalf("%s: expected %#v, actual %#v", protoVersion, expectedArguments, *declare.Arguments)
+		}
+	}
+}
+
+func TestReadTable_ShortInt_ProtoVersions(t *testing.T) {
+	// 's' is short-int in RabbitMQ and short-string in AMQP 0-9-1
+	table := bytes.NewBuffer(make([]byte, 0))
+	WriteShortstr(table, "key")
+	WriteOctet(table, 's')
+	WriteShort(table, 2)
+	data := bytes.NewBuffer(make([]byte, 0))
+	WriteLongstr(data, table.Bytes())
+
+	rTable, err := ReadTable(bytes.NewReader(data.Bytes()), ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := (*rTable)["key"]; value != int16(2) {
+		t.Fatalf("Expected short-int, actual %#v", value)
+	}
+
+	if _, err = ReadTable(bytes.NewReader(data.Bytes()), Proto091); err == nil {
+		t.Fatal("Expected error on read short-int as short-string")
+	}
+}
+
+func TestReadTable_Rabbit_Arrays(t *testing.T) {
+	wr := bytes.NewBuffer(make([]byte, 0))
+	table := bytes.NewBuffer(make([]byte, 0))
+	// field-array
+	WriteShortstr(table, "array")
+	WriteOctet(table, 'A')
+	array := bytes.NewBuffer(make([]byte, 0))
+	WriteOctet(array, 'S')
+	WriteLongstr(array, []byte("key"))
+	WriteLongstr(table, array.Bytes())
+	// byte-array
+	WriteShortstr(table, "bytes")
+	WriteOctet(table, 'x')
+	WriteLongstr(table, []byte("raw"))
+	// field-array written with 'x' tag by previous versions
+	WriteShortstr(table, "legacyArray")
+	WriteOctet(table, 'x')
+	WriteLongstr(table, array.Bytes())
+	WriteLongstr(wr, table.Bytes())
+
+	rTable, err := ReadTable(wr, ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Table{
+		"array":       []interface{}{"key"},
+		"bytes":       []byte("raw"),
+		"legacyArray": []interface{}{"key"},
+	}
+	if !reflect.DeepEqual(*rTable, expected) {
+		t.Fatalf("Expected %v, actual %v", expected, *rTable)
+	}
+}
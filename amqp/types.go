@@ -2,6 +2,12 @@ package amqp
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -38,13 +44,24 @@ type ConfirmMeta struct {
 	ChanID           uint16
 	ConnID           uint64
 	DeliveryTag      uint64
-	ExpectedConfirms int
-	ActualConfirms   int
+	ExpectedConfirms int32
+	ActualConfirms   int32
+	// Nack is true if message is rejected by broker, publisher gets basic.nack instead of basic.ack
+	Nack bool
 }
 
 // CanConfirm returns is message can be confirmed
 func (meta *ConfirmMeta) CanConfirm() bool {
-	return meta.ActualConfirms == meta.ExpectedConfirms
+	return atomic.LoadInt32(&meta.ActualConfirms) == meta.ExpectedConfirms
+}
+
+// AddConfirms adds confirms of queues message is enqueued into
+// Returns true if message got all expected confirms with the added ones, so only one of concurrent callers gets true
+func (meta *ConfirmMeta) AddConfirms(count int32) bool {
+	if count <= 0 {
+		return false
+	}
+	return atomic.AddInt32(&meta.ActualConfirms, count) == meta.ExpectedConfirms
 }
 
 // Message represents amqp-message and meta-data
@@ -52,6 +69,7 @@ type Message struct {
 	ID            uint64
 	BodySize      uint64
 	DeliveryCount uint32
+	EnqueueTime   int64
 	Mandatory     bool
 	Immediate     bool
 	Exchange      string
@@ -59,10 +77,113 @@ type Message struct {
 	ConfirmMeta   *ConfirmMeta
 	Header        *ContentHeader
 	Body          []*Frame
+	// SpoolPath is the path of file with message body if body is not kept in memory
+	SpoolPath string
+	// StoredBodySize is the size of body frames in storage format of message with body left in persistent storage,
+	// 0 if body is kept in memory
+	StoredBodySize int
+	// TraceStart is publish time in unix nanoseconds of message sampled for tracing, 0 if message is not traced
+	TraceStart int64
+}
+
+// IDGenerator generates message ids, ids should be unique and increasing
+type IDGenerator interface {
+	NextID() uint64
+	// Advance makes next generated ids greater than given id
+	Advance(id uint64)
+}
+
+// SeqIDGenerator generates sequential ids starting from given value
+type SeqIDGenerator struct {
+	seq uint64
+}
+
+// NewSeqIDGenerator returns new instance of SeqIDGenerator, first generated id is start + 1
+func NewSeqIDGenerator(start uint64) *SeqIDGenerator {
+	return &SeqIDGenerator{seq: start}
+}
+
+// NextID returns next id in sequence
+func (gen *SeqIDGenerator) NextID() uint64 {
+	return atomic.AddUint64(&gen.seq, 1)
+}
+
+// Advance moves sequence forward to id, if it is behind
+func (gen *SeqIDGenerator) Advance(id uint64) {
+	for {
+		seq := atomic.LoadUint64(&gen.seq)
+		if seq >= id || atomic.CompareAndSwapUint64(&gen.seq, seq, id) {
+			return
+		}
+	}
+}
+
+// BlockIDGenerator generates sequential ids and reserves them by blocks
+// Upper bound of reserved block is persisted before any id of block is returned,
+// so after restart sequence could be resumed from persisted bound without collisions
+type BlockIDGenerator struct {
+	seq       uint64
+	lock      sync.Mutex
+	reserved  uint64
+	blockSize uint64
+	persist   func(reserved uint64) error
+}
+
+// NewBlockIDGenerator returns new instance of BlockIDGenerator, first generated id is start + 1
+func NewBlockIDGenerator(start uint64, blockSize uint64, persist func(reserved uint64) error) *BlockIDGenerator {
+	return &BlockIDGenerator{
+		seq:       start,
+		reserved:  start,
+		blockSize: blockSize,
+		persist:   persist,
+	}
+}
+
+// NextID returns next id in sequence, reserving new block if current one is exhausted
+func (gen *BlockIDGenerator) NextID() uint64 {
+	id := atomic.AddUint64(&gen.seq, 1)
+	if id <= atomic.LoadUint64(&gen.reserved) {
+		return id
+	}
+
+	gen.lock.Lock()
+	defer gen.lock.Unlock()
+	reserved := gen.reserved
+	for reserved < id {
+		reserved += gen.blockSize
+	}
+	// if bound is not persisted, reserving is retried with next id
+	if reserved != gen.reserved && gen.persist(reserved) == nil {
+		atomic.StoreUint64(&gen.reserved, reserved)
+	}
+
+	return id
+}
+
+// Advance moves sequence forward to id, if it is behind
+func (gen *BlockIDGenerator) Advance(id uint64) {
+	for {
+		seq := atomic.LoadUint64(&gen.seq)
+		if seq >= id || atomic.CompareAndSwapUint64(&gen.seq, seq, id) {
+			return
+		}
+	}
 }
 
 // when server restart we can't start again count messages from 0
-var msgID = uint64(time.Now().UnixNano())
+var msgIDGenerator IDGenerator = NewSeqIDGenerator(uint64(time.Now().UnixNano()))
+
+// SetIDGenerator replaces message id generator, e.g. with deterministic one for tests
+// Should be called before any message is published
+func SetIDGenerator(gen IDGenerator) {
+	msgIDGenerator = gen
+}
+
+// AdvanceID makes next message ids greater than id of already stored message
+// Used on messages load to avoid ids collision if clock goes back between restarts
+func AdvanceID(id uint64) {
+	msgIDGenerator.Advance(id)
+}
 
 // NewMessage returns new message instance
 func NewMessage(method *BasicPublish) *Message {
@@ -82,9 +203,127 @@ func (message *Message) IsPersistent() bool {
 	return deliveryMode != nil && *deliveryMode == 2
 }
 
+// Expiration returns per-message TTL in milliseconds from expiration property
+// ok is false if property is not set or invalid
+func (message *Message) Expiration() (ttl int64, ok bool) {
+	if message.Header == nil || message.Header.PropertyList == nil || message.Header.PropertyList.Expiration == nil {
+		return 0, false
+	}
+	ttl, err := ParseExpiration(*message.Header.PropertyList.Expiration)
+	return ttl, err == nil
+}
+
+// ParseExpiration parses expiration property value, non-negative number of milliseconds
+func ParseExpiration(value string) (int64, error) {
+	ttl, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ttl < 0 {
+		return 0, fmt.Errorf("invalid expiration '%s'", value)
+	}
+	return ttl, nil
+}
+
+// GetRoutingKeys returns message routing key and additional keys from CC and BCC headers
+func (message *Message) GetRoutingKeys() []string {
+	keys := []string{message.RoutingKey}
+	if message.Header == nil || message.Header.PropertyList.Headers == nil {
+		return keys
+	}
+
+	headers := *message.Header.PropertyList.Headers
+	for _, header := range []string{"CC", "BCC"} {
+		values, ok := headers[header].([]interface{})
+		if !ok {
+			continue
+		}
+		for _, value := range values {
+			switch key := value.(type) {
+			case string:
+				keys = append(keys, key)
+			case []byte:
+				keys = append(keys, string(key))
+			}
+		}
+	}
+
+	return keys
+}
+
+// Route is exchange and routing key message is published to
+type Route struct {
+	Exchange   string
+	RoutingKey string
+}
+
+// GetAdditionalRoutes returns extra exchanges message is published to from x-additional-exchanges header
+// Header is array of tables with "exchange" and "routing-key" fields, missing routing key means empty one
+func (message *Message) GetAdditionalRoutes() ([]Route, error) {
+	if message.Header == nil || message.Header.PropertyList.Headers == nil {
+		return nil, nil
+	}
+
+	value, ok := (*message.Header.PropertyList.Headers)["x-additional-exchanges"]
+	if !ok {
+		return nil, nil
+	}
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, errors.New("x-additional-exchanges header must be array of tables")
+	}
+
+	routes := make([]Route, 0, len(values))
+	for _, value := range values {
+		var target Table
+		switch table := value.(type) {
+		case Table:
+			target = table
+		case *Table:
+			target = *table
+		default:
+			return nil, errors.New("x-additional-exchanges header must be array of tables")
+		}
+
+		exchange, ok := tableString(target, "exchange")
+		if !ok {
+			return nil, errors.New("x-additional-exchanges target must have exchange name")
+		}
+		routingKey, ok := tableString(target, "routing-key")
+		if !ok && target["routing-key"] != nil {
+			return nil, fmt.Errorf("invalid routing-key of x-additional-exchanges target '%s'", exchange)
+		}
+		routes = append(routes, Route{Exchange: exchange, RoutingKey: routingKey})
+	}
+
+	return routes, nil
+}
+
+func tableString(table Table, key string) (string, bool) {
+	switch value := table[key].(type) {
+	case string:
+		return value, true
+	case []byte:
+		return string(value), true
+	}
+	return "", false
+}
+
+// StripBCC removes BCC header, so it is not visible to consumers
+func (message *Message) StripBCC() {
+	if message.Header == nil || message.Header.PropertyList.Headers == nil {
+		return
+	}
+	delete(*message.Header.PropertyList.Headers, "BCC")
+}
+
 func (message *Message) GenerateSeq() {
 	if message.ID == 0 {
-		message.ID = atomic.AddUint64(&msgID, 1)
+		message.ID = msgIDGenerator.NextID()
+	}
+}
+
+// MarkEnqueued sets message enqueue time in unix nanoseconds, if not set yet
+func (message *Message) MarkEnqueued() {
+	if message.EnqueueTime == 0 {
+		message.EnqueueTime = time.Now().UnixNano()
 	}
 }
 
@@ -94,9 +333,64 @@ func (message *Message) Append(body *Frame) {
 	message.BodySize += uint64(len(body.Payload))
 }
 
+// WithoutBody returns copy of message without body frames, body is expected to be read from persistent storage
+// Message without body frames in memory is returned as is
+func (message *Message) WithoutBody() *Message {
+	if len(message.Body) == 0 {
+		return message
+	}
+	stripped := *message
+	stripped.Body = nil
+	for _, frame := range message.Body {
+		stripped.StoredBodySize += frameStoredSize(frame)
+	}
+	return &stripped
+}
+
+// IsBodyStored returns true if message body is not kept in memory and should be read from persistent storage
+func (message *Message) IsBodyStored() bool {
+	return message.StoredBodySize > 0
+}
+
+// MessageFormatVersion is current version of stored message format
+// Version 2 starts with version header and ends with CRC32 checksum of message body
+// Versions 1 and 0 have no header, version 1 has trailing version octet and checksum, version 0 has no checksum
+const MessageFormatVersion = 2
+
+// messageVersionFlag marks version header
+// Formats without header start with message id, which is always less than 1<<63, so its first byte never has highest bit set
+const messageVersionFlag = 0x80
+
+// ErrBodyChecksum is returned on unmarshal of message with corrupted body
+var ErrBodyChecksum = errors.New("message body checksum mismatch")
+
+// ErrMessageFormat is returned on unmarshal of message stored in format of unknown newer version
+var ErrMessageFormat = errors.New("unsupported message format version")
+
+// StoredMessageVersion returns format version of marshaled message, formats without version header are reported as 0
+func StoredMessageVersion(data []byte) byte {
+	if len(data) == 0 || data[0]&messageVersionFlag == 0 {
+		return 0
+	}
+	return data[0] &^ messageVersionFlag
+}
+
+// bodyChecksum returns CRC32 checksum of message body loaded into memory, spooled body is not included
+func (message *Message) bodyChecksum() uint32 {
+	hash := crc32.NewIEEE()
+	for _, frame := range message.Body {
+		hash.Write(frame.Payload)
+	}
+	return hash.Sum32()
+}
+
 // Marshal converts message into bytes to store into db
+// Message is always marshaled in current format version
 func (message *Message) Marshal(protoVersion string) (data []byte, err error) {
 	buffer := bytes.NewBuffer([]byte{})
+	if err = WriteOctet(buffer, messageVersionFlag|MessageFormatVersion); err != nil {
+		return nil, err
+	}
 	if err = WriteLonglong(buffer, message.ID); err != nil {
 		return nil, err
 	}
@@ -127,50 +421,201 @@ func (message *Message) Marshal(protoVersion string) (data []byte, err error) {
 	if err = WriteLong(buffer, message.DeliveryCount); err != nil {
 		return nil, err
 	}
+	if err = WriteLonglong(buffer, uint64(message.EnqueueTime)); err != nil {
+		return nil, err
+	}
+	if err = WriteLongstr(buffer, []byte(message.SpoolPath)); err != nil {
+		return nil, err
+	}
+	if err = WriteLong(buffer, message.bodyChecksum()); err != nil {
+		return nil, err
+	}
 
 	return buffer.Bytes(), nil
 }
 
+// StoredSize returns size of message marshalled into storage format without marshalling it
+func (message *Message) StoredSize(protoVersion string) int {
+	header := &byteCounter{}
+	if message.Header != nil {
+		WriteContentHeader(header, message.Header, protoVersion)
+	}
+
+	// version, id, header, exchange, routing key, body size and body length
+	size := 1 + 8 + header.count + 1 + len(message.Exchange) + 1 + len(message.RoutingKey) + 8 + 4
+	for _, frame := range message.Body {
+		size += frameStoredSize(frame)
+	}
+	size += message.StoredBodySize
+	// delivery count, enqueue time, spool path and body checksum
+	return size + 4 + 8 + 4 + len(message.SpoolPath) + 4
+}
+
+// frameStoredSize returns size of body frame in storage format: type, channel, payload size, payload and frame end
+func frameStoredSize(frame *Frame) int {
+	return 1 + 2 + 4 + len(frame.Payload) + 1
+}
+
+// byteCounter is a writer counting written bytes
+type byteCounter struct {
+	count int
+}
+
+func (counter *byteCounter) Write(p []byte) (int, error) {
+	counter.count += len(p)
+	return len(p), nil
+}
+
 // Unmarshal restore message entity from bytes
+// Messages stored in any previous format version are supported
+// Buffer must be consumed exactly, error of truncated or over-long buffer names the field decoding failed at
 func (message *Message) Unmarshal(buffer []byte, protoVersion string) (err error) {
 	reader := bytes.NewReader(buffer)
-	if message.ID, err = ReadLonglong(reader); err != nil {
+	version := StoredMessageVersion(buffer)
+	if version == 0 {
+		return message.unmarshalUnversioned(reader, protoVersion)
+	}
+	if version > MessageFormatVersion {
+		return ErrMessageFormat
+	}
+
+	if _, err = ReadOctet(reader); err != nil {
+		return errMessageField("version", err)
+	}
+	if err = message.unmarshalFields(reader, protoVersion); err != nil {
 		return err
 	}
 
-	if message.Header, err = ReadContentHeader(reader, protoVersion); err != nil {
+	enqueueTime, err := ReadLonglong(reader)
+	if err != nil {
+		return errMessageField("enqueue time", err)
+	}
+	message.EnqueueTime = int64(enqueueTime)
+
+	spoolPath, err := ReadLongstr(reader)
+	if err != nil {
+		return errMessageField("spool path", err)
+	}
+	message.SpoolPath = string(spoolPath)
+
+	checksum, err := ReadLong(reader)
+	if err != nil {
+		return errMessageField("checksum", err)
+	}
+	if reader.Len() != 0 {
+		return errMessageTrailing(reader, "checksum")
+	}
+	if checksum != message.bodyChecksum() {
+		return ErrBodyChecksum
+	}
+
+	return nil
+}
+
+// unmarshalUnversioned restores message stored in format versions 0 and 1, which have no version header
+func (message *Message) unmarshalUnversioned(reader *bytes.Reader, protoVersion string) (err error) {
+	if err = message.unmarshalFields(reader, protoVersion); err != nil {
 		return err
 	}
+
+	// messages stored by previous versions have no enqueue time
+	if reader.Len() != 0 {
+		enqueueTime, err := ReadLonglong(reader)
+		if err != nil {
+			return errMessageField("enqueue time", err)
+		}
+		message.EnqueueTime = int64(enqueueTime)
+	}
+	if reader.Len() != 0 {
+		spoolPath, err := ReadLongstr(reader)
+		if err != nil {
+			return errMessageField("spool path", err)
+		}
+		message.SpoolPath = string(spoolPath)
+	}
+
+	// version 0 has no checksum trailer
+	if reader.Len() != 0 {
+		if _, err = ReadOctet(reader); err != nil {
+			return errMessageField("version", err)
+		}
+		checksum, err := ReadLong(reader)
+		if err != nil {
+			return errMessageField("checksum", err)
+		}
+		if reader.Len() != 0 {
+			return errMessageTrailing(reader, "checksum")
+		}
+		if checksum != message.bodyChecksum() {
+			return ErrBodyChecksum
+		}
+	}
+	return nil
+}
+
+// unmarshalFields reads fields common for all format versions
+func (message *Message) unmarshalFields(reader *bytes.Reader, protoVersion string) (err error) {
+	if message.ID, err = ReadLonglong(reader); err != nil {
+		return errMessageField("id", err)
+	}
+
+	if message.Header, err = ReadContentHeader(reader, protoVersion); err != nil {
+		return errMessageField("header", err)
+	}
 	if message.Exchange, err = ReadShortstr(reader); err != nil {
-		return err
+		return errMessageField("exchange", err)
 	}
 	if message.RoutingKey, err = ReadShortstr(reader); err != nil {
-		return err
+		return errMessageField("routing key", err)
 	}
 	if message.BodySize, err = ReadLonglong(reader); err != nil {
-		return err
+		return errMessageField("body size", err)
 	}
 
 	rawBody, err := ReadLongstr(reader)
 	if err != nil {
-		return err
+		return errMessageField("body", err)
 	}
 	bodyBuffer := bytes.NewReader(rawBody)
 
 	for bodyBuffer.Len() != 0 {
 		body, errFrame := ReadFrame(bodyBuffer)
 		if errFrame != nil {
-			return errFrame
+			return errMessageField(fmt.Sprintf("body frame %d", len(message.Body)), errFrame)
 		}
 		message.Body = append(message.Body, body)
 	}
 
 	if message.DeliveryCount, err = ReadLong(reader); err != nil {
-		return err
+		return errMessageField("delivery count", err)
 	}
 	return nil
 }
 
+// MessageFieldError is error of decoding stored message field, so corrupted record is pinpointed in logs
+type MessageFieldError struct {
+	Field string
+	Err   error
+}
+
+func (err *MessageFieldError) Error() string {
+	return fmt.Sprintf("error on reading message field '%s': %s", err.Field, err.Err)
+}
+
+// errMessageField returns error of decoding stored message field
+// Buffer ended in the middle of field is reported as unexpected EOF
+func errMessageField(field string, err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return &MessageFieldError{Field: field, Err: err}
+}
+
+// errMessageTrailing returns error of bytes left in buffer after the last field of stored message
+func errMessageTrailing(reader *bytes.Reader, field string) error {
+	return fmt.Errorf("unexpected %d bytes after message field '%s'", reader.Len(), field)
+}
+
 // Constants to detect connection or channel error thrown
 const (
 	ErrorOnConnection = iota
@@ -1,7 +1,14 @@
 package amqp
 
 import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -69,7 +76,9 @@ func TestMessage_Marshal_Unmarshal(t *testing.T) {
 	ctype := "text/plain"
 
 	mM := &Message{
-		ID: 1,
+		ID:          1,
+		EnqueueTime: 1530000000000000000,
+		SpoolPath:   "db/spool/1",
 		Header: &ContentHeader{
 			ClassID:       ClassBasic,
 			Weight:        0,
@@ -119,6 +128,318 @@ func TestMessage_Marshal_Unmarshal(t *testing.T) {
 	}
 }
 
+func TestMessage_StoredSize(t *testing.T) {
+	ctype := "text/plain"
+	headers := Table{"x-key": "value"}
+	messages := []*Message{
+		{
+			ID:         1,
+			Header:     &ContentHeader{ClassID: ClassBasic, BodySize: 4, PropertyList: &BasicPropertyList{ContentType: &ctype, Headers: &headers}},
+			RoutingKey: "test",
+			BodySize:   4,
+			Body:       []*Frame{{Type: 3, ChannelID: 1, Payload: []byte{'t', 'e'}}, {Type: 3, ChannelID: 1, Payload: []byte{'s', 't'}}},
+		},
+		{
+			ID:        2,
+			Header:    &ContentHeader{ClassID: ClassBasic, PropertyList: &BasicPropertyList{}},
+			Exchange:  "test",
+			SpoolPath: "db/spool/2",
+		},
+	}
+
+	for _, message := range messages {
+		data, err := message.Marshal(ProtoRabbit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := message.StoredSize(ProtoRabbit); size != len(data) {
+			t.Fatalf("Expected stored size %d, actual %d", len(data), size)
+		}
+		if size := message.WithoutBody().StoredSize(ProtoRabbit); size != len(data) {
+			t.Fatalf("Expected stored size without body %d, actual %d", len(data), size)
+		}
+	}
+}
+
+func TestMessage_WithoutBody(t *testing.T) {
+	message := &Message{
+		ID:       1,
+		BodySize: 4,
+		Body:     []*Frame{{Type: 3, ChannelID: 1, Payload: []byte{'t', 'e', 's', 't'}}},
+	}
+
+	stripped := message.WithoutBody()
+	if stripped.Body != nil || !stripped.IsBodyStored() {
+		t.Fatal("Expected body is dropped")
+	}
+	if len(message.Body) != 1 || message.IsBodyStored() {
+		t.Fatal("Expected original message keeps body")
+	}
+	if stripped.ID != message.ID || stripped.BodySize != message.BodySize {
+		t.Fatal("Expected message fields are copied")
+	}
+
+	empty := &Message{ID: 2}
+	if empty.WithoutBody() != empty {
+		t.Fatal("Expected message without body is returned as is")
+	}
+}
+
+func TestMessage_Marshal_Unmarshal_EmptyBody(t *testing.T) {
+	mM := &Message{
+		ID: 1,
+		Header: &ContentHeader{
+			ClassID:      ClassBasic,
+			BodySize:     0,
+			PropertyList: &BasicPropertyList{},
+		},
+		RoutingKey: "test",
+	}
+
+	bytes, err := mM.Marshal(ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mU := &Message{}
+	if err := mU.Unmarshal(bytes, ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mM, mU) {
+		t.Fatalf("Marshaled and unmarshaled structures not equal")
+	}
+}
+
+func TestMessage_Unmarshal_Checksum(t *testing.T) {
+	mM := &Message{
+		ID:         1,
+		Header:     &ContentHeader{ClassID: ClassBasic, BodySize: 4, PropertyList: &BasicPropertyList{}},
+		RoutingKey: "key",
+		BodySize:   4,
+		Body: []*Frame{
+			{Type: 3, ChannelID: 1, Payload: []byte{'t', 'e', 's', 't'}},
+		},
+	}
+
+	data, err := mM.Marshal(ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data[bytes.LastIndex(data, []byte("test"))] = 'T'
+	if err = (&Message{}).Unmarshal(data, ProtoRabbit); err != ErrBodyChecksum {
+		t.Fatalf("Expected checksum error on corrupted body, actual %v", err)
+	}
+}
+
+func TestMessage_Unmarshal_Truncated(t *testing.T) {
+	mM := &Message{
+		ID:         1,
+		Header:     &ContentHeader{ClassID: ClassBasic, BodySize: 4, PropertyList: &BasicPropertyList{}},
+		Exchange:   "ex",
+		RoutingKey: "key",
+		BodySize:   4,
+		Body: []*Frame{
+			{Type: 3, ChannelID: 1, Payload: []byte{'t', 'e', 's', 't'}},
+		},
+		SpoolPath: "path",
+	}
+
+	data, err := mM.Marshal(ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for size := 1; size < len(data); size++ {
+		if err = (&Message{}).Unmarshal(data[:size], ProtoRabbit); err == nil {
+			t.Fatalf("Expected error on message truncated to %d bytes", size)
+		}
+	}
+
+	err = (&Message{}).Unmarshal(data[:5], ProtoRabbit)
+	if fieldErr, ok := err.(*MessageFieldError); !ok || fieldErr.Err != io.ErrUnexpectedEOF || fieldErr.Field != "id" {
+		t.Fatalf("Expected unexpected EOF error on field 'id', actual %v", err)
+	}
+	if err = (&Message{}).Unmarshal(data[:len(data)-2], ProtoRabbit); err == nil || !strings.Contains(err.Error(), "'checksum'") {
+		t.Fatalf("Expected error on field 'checksum', actual %v", err)
+	}
+}
+
+func TestMessage_Unmarshal_TrailingBytes(t *testing.T) {
+	mM := &Message{
+		ID:         1,
+		Header:     &ContentHeader{ClassID: ClassBasic, BodySize: 4, PropertyList: &BasicPropertyList{}},
+		RoutingKey: "key",
+		BodySize:   4,
+		Body: []*Frame{
+			{Type: 3, ChannelID: 1, Payload: []byte{'t', 'e', 's', 't'}},
+		},
+	}
+
+	data, err := mM.Marshal(ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, garbage := range [][]byte{{0}, {1, 2, 3, 4, 5, 6, 7, 8, 9}} {
+		err = (&Message{}).Unmarshal(append(append([]byte{}, data...), garbage...), ProtoRabbit)
+		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("unexpected %d bytes", len(garbage))) {
+			t.Fatalf("Expected trailing bytes error, actual %v", err)
+		}
+	}
+
+	// version 1 fixture is version 0 one with version octet and checksum, anything after them is garbage
+	v1, _ := hex.DecodeString("153ba6e4ca590001003c0000000000000000000480000a746578742f706c61696e026578036b657900000000000000040000000c0300010000000474657374ce00000002153ba6e4ca5900000000000001d87f7e0c")
+	if err = (&Message{}).Unmarshal(append(v1, 0), ProtoRabbit); err == nil || !strings.Contains(err.Error(), "unexpected 1 bytes") {
+		t.Fatalf("Expected trailing bytes error on version 1 message, actual %v", err)
+	}
+}
+
+func TestMessage_Unmarshal_FormatVersions(t *testing.T) {
+	ctype := "text/plain"
+	expected := &Message{
+		ID:            1530000000000000001,
+		DeliveryCount: 2,
+		EnqueueTime:   1530000000000000000,
+		Header: &ContentHeader{
+			ClassID:       ClassBasic,
+			BodySize:      4,
+			propertyFlags: 32768,
+			PropertyList:  &BasicPropertyList{ContentType: &ctype},
+		},
+		Exchange:   "ex",
+		RoutingKey: "key",
+		BodySize:   4,
+		Body: []*Frame{
+			{Type: 3, ChannelID: 1, Payload: []byte{'t', 'e', 's', 't'}},
+		},
+	}
+
+	current, err := expected.Marshal(ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := StoredMessageVersion(current); version != MessageFormatVersion {
+		t.Fatalf("Expected current format version %d, actual %d", MessageFormatVersion, version)
+	}
+
+	fixtures := map[string]string{
+		"v0": "153ba6e4ca590001003c0000000000000000000480000a746578742f706c61696e026578036b657900000000000000040000000c0300010000000474657374ce00000002153ba6e4ca59000000000000",
+		"v1": "153ba6e4ca590001003c0000000000000000000480000a746578742f706c61696e026578036b657900000000000000040000000c0300010000000474657374ce00000002153ba6e4ca5900000000000001d87f7e0c",
+		"v2": hex.EncodeToString(current),
+	}
+	for name, fixture := range fixtures {
+		data, err := hex.DecodeString(fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		message := &Message{}
+		if err = message.Unmarshal(data, ProtoRabbit); err != nil {
+			t.Fatalf("Format %s: %s", name, err)
+		}
+		if !reflect.DeepEqual(expected, message) {
+			t.Fatalf("Format %s: unmarshaled message not equal to expected", name)
+		}
+	}
+
+	next := append([]byte{}, current...)
+	next[0] = messageVersionFlag | (MessageFormatVersion + 1)
+	if err = (&Message{}).Unmarshal(next, ProtoRabbit); err != ErrMessageFormat {
+		t.Fatalf("Expected format error on unknown version, actual %v", err)
+	}
+}
+
+func TestMessage_Marshal_Unmarshal_AllPropertyFlags(t *testing.T) {
+	fieldsCount := reflect.TypeOf(BasicPropertyList{}).NumField()
+	for mask := 0; mask < 1<<uint(fieldsCount); mask++ {
+		mM := &Message{
+			ID: uint64(mask),
+			Header: &ContentHeader{
+				ClassID:      ClassBasic,
+				BodySize:     4,
+				PropertyList: propertyListByFlags(mask),
+			},
+			RoutingKey: "test",
+			BodySize:   4,
+			Body: []*Frame{
+				{Type: 3, ChannelID: 1, Payload: []byte{'t', 'e', 's', 't'}},
+			},
+		}
+
+		data, err := mM.Marshal(ProtoRabbit)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mU := &Message{}
+		if err = mU.Unmarshal(data, ProtoRabbit); err != nil {
+			t.Fatalf("Mask %014b: %s", mask, err)
+		}
+		if !reflect.DeepEqual(mM, mU) {
+			t.Fatalf("Mask %014b: marshaled and unmarshaled messages not equal", mask)
+		}
+	}
+}
+
+func TestMessage_GetRoutingKeys(t *testing.T) {
+	message := &Message{
+		RoutingKey: "rk",
+		Header: &ContentHeader{
+			PropertyList: &BasicPropertyList{
+				Headers: &Table{
+					"CC":  []interface{}{"cc1", []byte("cc2")},
+					"BCC": []interface{}{"bcc"},
+				},
+			},
+		},
+	}
+
+	expected := []string{"rk", "cc1", "cc2", "bcc"}
+	if keys := message.GetRoutingKeys(); !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Expected %v, actual %v", expected, keys)
+	}
+
+	message.StripBCC()
+	if _, ok := (*message.Header.PropertyList.Headers)["BCC"]; ok {
+		t.Fatal("Expected BCC header stripped")
+	}
+
+	expected = []string{"rk", "cc1", "cc2"}
+	if keys := message.GetRoutingKeys(); !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Expected %v, actual %v", expected, keys)
+	}
+}
+
+func TestMessage_GetAdditionalRoutes(t *testing.T) {
+	headers := Table{
+		"x-additional-exchanges": []interface{}{
+			Table{"exchange": "ex1", "routing-key": "rk1"},
+			&Table{"exchange": []byte("ex2")},
+		},
+	}
+	message := &Message{Header: &ContentHeader{PropertyList: &BasicPropertyList{Headers: &headers}}}
+
+	expected := []Route{{Exchange: "ex1", RoutingKey: "rk1"}, {Exchange: "ex2"}}
+	routes, err := message.GetAdditionalRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(routes, expected) {
+		t.Fatalf("Expected %v, actual %v", expected, routes)
+	}
+
+	for _, value := range []interface{}{
+		"ex1",
+		[]interface{}{"ex1"},
+		[]interface{}{Table{"routing-key": "rk1"}},
+		[]interface{}{Table{"exchange": "ex1", "routing-key": int32(1)}},
+	} {
+		headers["x-additional-exchanges"] = value
+		if _, err := message.GetAdditionalRoutes(); err == nil {
+			t.Fatalf("Expected error on header %v", value)
+		}
+	}
+}
+
 func TestMessage_IsPersistent(t *testing.T) {
 	var dMode byte = 2
 	message := &Message{
@@ -138,6 +459,21 @@ func TestMessage_IsPersistent(t *testing.T) {
 	}
 }
 
+func TestMessage_Expiration(t *testing.T) {
+	message := &Message{Header: &ContentHeader{PropertyList: &BasicPropertyList{}}}
+	if _, ok := message.Expiration(); ok {
+		t.Fatal("Expected no expiration")
+	}
+
+	for value, expected := range map[string]bool{"0": true, "1000": true, "-1": false, "1s": false} {
+		expiration := value
+		message.Header.PropertyList.Expiration = &expiration
+		if ttl, ok := message.Expiration(); ok != expected || (ok && strconv.FormatInt(ttl, 10) != value) {
+			t.Fatalf("Unexpected expiration for '%s': %d, %t", value, ttl, ok)
+		}
+	}
+}
+
 func TestConfirmMeta_CanConfirm(t *testing.T) {
 	meta := &ConfirmMeta{
 		ExpectedConfirms: 5,
@@ -149,6 +485,23 @@ func TestConfirmMeta_CanConfirm(t *testing.T) {
 	}
 }
 
+func TestConfirmMeta_AddConfirms(t *testing.T) {
+	meta := &ConfirmMeta{ExpectedConfirms: 3}
+
+	if meta.AddConfirms(0) {
+		t.Fatalf("Expected no confirm on zero added confirms")
+	}
+	if meta.AddConfirms(2) || meta.CanConfirm() {
+		t.Fatalf("Expected no confirm on 2 of 3 confirms")
+	}
+	if !meta.AddConfirms(1) || !meta.CanConfirm() {
+		t.Fatalf("Expected confirm on 3 of 3 confirms")
+	}
+	if meta.AddConfirms(1) {
+		t.Fatalf("Expected message confirmed once")
+	}
+}
+
 func TestNewChannelError(t *testing.T) {
 	er := NewChannelError(PreconditionFailed, "text", 0, 0)
 
@@ -164,3 +517,84 @@ func TestNewConnectionError(t *testing.T) {
 		t.Fatal("Expected connection error")
 	}
 }
+
+func TestSeqIDGenerator(t *testing.T) {
+	gen := NewSeqIDGenerator(10)
+	if id := gen.NextID(); id != 11 {
+		t.Fatalf("Expected id %d, actual %d", 11, id)
+	}
+
+	gen.Advance(5)
+	if id := gen.NextID(); id != 12 {
+		t.Fatalf("Expected id %d after advance behind sequence, actual %d", 12, id)
+	}
+
+	gen.Advance(100)
+	if id := gen.NextID(); id != 101 {
+		t.Fatalf("Expected id %d after advance, actual %d", 101, id)
+	}
+}
+
+func TestSetIDGenerator(t *testing.T) {
+	defaultGenerator := msgIDGenerator
+	defer SetIDGenerator(defaultGenerator)
+
+	SetIDGenerator(NewSeqIDGenerator(0))
+	for expected := uint64(1); expected <= 3; expected++ {
+		message := &Message{}
+		message.GenerateSeq()
+		if message.ID != expected {
+			t.Fatalf("Expected id %d, actual %d", expected, message.ID)
+		}
+	}
+
+	AdvanceID(1000)
+	message := &Message{ID: 5}
+	message.GenerateSeq()
+	if message.ID != 5 {
+		t.Fatal("Expected id is not changed if already set")
+	}
+	message = &Message{}
+	message.GenerateSeq()
+	if message.ID != 1001 {
+		t.Fatalf("Expected id %d after advance, actual %d", 1001, message.ID)
+	}
+}
+
+func TestBlockIDGenerator(t *testing.T) {
+	var persisted []uint64
+	fail := false
+	gen := NewBlockIDGenerator(10, 5, func(reserved uint64) error {
+		if fail {
+			return errors.New("storage error")
+		}
+		persisted = append(persisted, reserved)
+		return nil
+	})
+
+	for expected := uint64(11); expected <= 16; expected++ {
+		if id := gen.NextID(); id != expected {
+			t.Fatalf("Expected id %d, actual %d", expected, id)
+		}
+	}
+	if !reflect.DeepEqual(persisted, []uint64{15, 20}) {
+		t.Fatalf("Expected reserved bounds %v, actual %v", []uint64{15, 20}, persisted)
+	}
+
+	gen.Advance(42)
+	if id := gen.NextID(); id != 43 {
+		t.Fatalf("Expected id %d after advance, actual %d", 43, id)
+	}
+	if persisted[len(persisted)-1] != 45 {
+		t.Fatalf("Expected reserved bound %d after advance, actual %d", 45, persisted[len(persisted)-1])
+	}
+
+	fail = true
+	gen.NextID()
+	gen.NextID()
+	gen.NextID()
+	fail = false
+	if id := gen.NextID(); id != 47 || persisted[len(persisted)-1] != 50 {
+		t.Fatal("Expected reserving retried after persist error")
+	}
+}
@@ -2,7 +2,10 @@ package binding
 
 import (
 	"bytes"
+	"fmt"
+	"hash/fnv"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/valinurovam/garagemq/amqp"
@@ -39,7 +42,7 @@ func NewBinding(queue string, exchange string, routingKey string, arguments *amq
 	return binding
 }
 
-// @todo may be better will be trie or dfa than regexp
+// Exchange routes messages with TopicTrie, regexp is used to match single binding only
 // @see http://www.rabbitmq.com/blog/2010/09/14/very-fast-and-scalable-topic-routing-part-1/
 // @see http://www.rabbitmq.com/blog/2011/03/28/very-fast-and-scalable-topic-routing-part-2/
 //
@@ -117,23 +120,87 @@ func (b *Binding) GetQueue() string {
 }
 
 // Equal returns is given binding equal to current
-// with compare exchange, routing key and queue
+// with compare exchange, routing key, queue and arguments
 func (b *Binding) Equal(bind *Binding) bool {
 	return b.Exchange == bind.GetExchange() &&
 		b.Queue == bind.GetQueue() &&
-		b.RoutingKey == bind.GetRoutingKey()
+		b.RoutingKey == bind.GetRoutingKey() &&
+		b.GetArgumentsKey() == bind.GetArgumentsKey()
+}
+
+// GetKey returns key identifying binding among bindings of one exchange
+// Bindings of the same queue and routing key with different arguments have different keys
+func (b *Binding) GetKey() string {
+	return b.Queue + "\x00" + b.RoutingKey + "\x00" + b.GetArgumentsKey()
+}
+
+// GetArgumentsKey returns canonical representation of binding arguments
+// Tables are written with sorted keys, so equal arguments always have equal keys
+// Empty arguments are represented by empty string
+func (b *Binding) GetArgumentsKey() string {
+	if b.Arguments == nil || len(*b.Arguments) == 0 {
+		return ""
+	}
+	buf := &strings.Builder{}
+	writeArgumentsKey(buf, b.Arguments)
+	return buf.String()
+}
+
+func writeArgumentsKey(buf *strings.Builder, value interface{}) {
+	switch value := value.(type) {
+	case *amqp.Table:
+		if value == nil {
+			buf.WriteString("nil")
+			return
+		}
+		writeArgumentsKey(buf, *value)
+	case amqp.Table:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buf.WriteString("{")
+		for idx, key := range keys {
+			if idx > 0 {
+				buf.WriteString(",")
+			}
+			fmt.Fprintf(buf, "%q=", key)
+			writeArgumentsKey(buf, value[key])
+		}
+		buf.WriteString("}")
+	case []interface{}:
+		buf.WriteString("[")
+		for idx, item := range value {
+			if idx > 0 {
+				buf.WriteString(",")
+			}
+			writeArgumentsKey(buf, item)
+		}
+		buf.WriteString("]")
+	default:
+		fmt.Fprintf(buf, "%T:%v", value, value)
+	}
 }
 
 // GetName generate binding name by concatenating its params
+// Name of binding with arguments ends with hash of arguments,
+// so bindings differ only by arguments are stored separately
 func (b *Binding) GetName() string {
-	return strings.Join(
+	name := strings.Join(
 		[]string{b.Queue, b.Exchange, b.RoutingKey},
 		"_",
 	)
+	if argumentsKey := b.GetArgumentsKey(); argumentsKey != "" {
+		hash := fnv.New64a()
+		hash.Write([]byte(argumentsKey))
+		name = fmt.Sprintf("%s_%016x", name, hash.Sum64())
+	}
+	return name
 }
 
 // Marshal returns raw representation of binding to store into storage
-func (b *Binding) Marshal() (data []byte, err error) {
+func (b *Binding) Marshal(protoVersion string) (data []byte, err error) {
 	buf := bytes.NewBuffer(make([]byte, 0))
 	if err = amqp.WriteShortstr(buf, b.Queue); err != nil {
 		return nil, err
@@ -151,11 +218,18 @@ func (b *Binding) Marshal() (data []byte, err error) {
 	if err = amqp.WriteOctet(buf, topic); err != nil {
 		return nil, err
 	}
+	arguments := b.Arguments
+	if arguments == nil {
+		arguments = &amqp.Table{}
+	}
+	if err = amqp.WriteTable(buf, arguments, protoVersion); err != nil {
+		return nil, err
+	}
 	return buf.Bytes(), nil
 }
 
 // Unmarshal returns binding from storage raw bytes data
-func (b *Binding) Unmarshal(data []byte) (err error) {
+func (b *Binding) Unmarshal(data []byte, protoVersion string) (err error) {
 	buf := bytes.NewReader(data)
 	if b.Queue, err = amqp.ReadShortstr(buf); err != nil {
 		return err
@@ -172,6 +246,15 @@ func (b *Binding) Unmarshal(data []byte) (err error) {
 	}
 	b.topic = topic == 1
 
+	// bindings stored before arguments were persisted have no table at the end
+	if buf.Len() > 0 {
+		if b.Arguments, err = amqp.ReadTable(buf, protoVersion); err != nil {
+			return err
+		}
+	} else {
+		b.Arguments = &amqp.Table{}
+	}
+
 	if b.topic {
 		if b.regexp, err = buildRegexp(b.RoutingKey); err != nil {
 			return err
@@ -96,6 +96,49 @@ func TestBinding_MatchTopic(t *testing.T) {
 	}
 }
 
+func TestTopicTrie_Match(t *testing.T) {
+	trie := binding.NewTopicTrie()
+	for _, bind := range bindingsProviderData(true) {
+		trie.Add(bind)
+	}
+
+	for key, matches := range matchesProviderDataTopic() {
+		matched := map[string]bool{}
+		trie.Match(key, func(bind *binding.Binding) {
+			matched[bind.GetQueue()] = true
+		})
+		bindMatches := []string{}
+		for queue := range matched {
+			bindMatches = append(bindMatches, queue)
+		}
+		if !testEq(matches, bindMatches) {
+			t.Fatalf("Error on matching key '%s'", key)
+		}
+	}
+}
+
+func TestTopicTrie_Remove(t *testing.T) {
+	trie := binding.NewTopicTrie()
+	for _, bind := range bindingsProviderData(true) {
+		trie.Add(bind)
+	}
+	for _, bind := range bindingsProviderData(true) {
+		if bind.GetQueue() != "t5" {
+			trie.Remove(bind)
+		}
+	}
+
+	for key := range matchesProviderDataTopic() {
+		bindMatches := []string{}
+		trie.Match(key, func(bind *binding.Binding) {
+			bindMatches = append(bindMatches, bind.GetQueue())
+		})
+		if !testEq([]string{"t5"}, bindMatches) {
+			t.Fatalf("Expected only not removed binding matched key '%s', actual %v", key, bindMatches)
+		}
+	}
+}
+
 func TestBinding_MatchDirect(t *testing.T) {
 	bindings := bindingsProviderData(false)
 	matchesExpected := matchesProviderDataDirect()
@@ -154,6 +197,47 @@ func TestBinding_Equal(t *testing.T) {
 	if b1.Equal(b2) {
 		t.Fatalf("Excpected not equal bindings")
 	}
+
+	b1 = binding.NewBinding("test_q", "test_ex", "test_key", &amqp.Table{"x-match": "all"}, false)
+	b2 = binding.NewBinding("test_q", "test_ex", "test_key", &amqp.Table{"x-match": "any"}, false)
+
+	if b1.Equal(b2) {
+		t.Fatalf("Excpected not equal bindings")
+	}
+
+	b1 = binding.NewBinding("test_q", "test_ex", "test_key", nil, false)
+	b2 = binding.NewBinding("test_q", "test_ex", "test_key", &amqp.Table{}, false)
+
+	if !b1.Equal(b2) {
+		t.Fatalf("Excpected nil and empty arguments are equal")
+	}
+}
+
+func TestBinding_GetArgumentsKey(t *testing.T) {
+	b1 := binding.NewBinding("test_q", "test_ex", "test_key", &amqp.Table{
+		"x-match": "all",
+		"format":  "pdf",
+		"nested":  &amqp.Table{"b": int32(1), "a": []interface{}{"x", int64(2)}},
+	}, false)
+	b2 := binding.NewBinding("test_q", "test_ex", "test_key", &amqp.Table{
+		"nested":  &amqp.Table{"a": []interface{}{"x", int64(2)}, "b": int32(1)},
+		"format":  "pdf",
+		"x-match": "all",
+	}, false)
+
+	if b1.GetArgumentsKey() != b2.GetArgumentsKey() || b1.GetKey() != b2.GetKey() {
+		t.Fatalf("Expected equal keys, actual %s and %s", b1.GetArgumentsKey(), b2.GetArgumentsKey())
+	}
+
+	b2 = binding.NewBinding("test_q", "test_ex", "test_key", &amqp.Table{
+		"nested":  &amqp.Table{"a": []interface{}{"x", int64(2)}, "b": int64(1)},
+		"format":  "pdf",
+		"x-match": "all",
+	}, false)
+
+	if b1.GetArgumentsKey() == b2.GetArgumentsKey() {
+		t.Fatal("Expected arguments of different types have different keys")
+	}
 }
 
 func testEq(a, b []string) bool {
@@ -190,19 +274,28 @@ func TestBinding_GetName(t *testing.T) {
 	if b.GetName() != name {
 		t.Fatalf("Expected %s, actual %s", name, b.GetName())
 	}
+
+	bArgs := binding.NewBinding("test_q", "test_ex", "test_key", &amqp.Table{"x-match": "all"}, true)
+	if bArgs.GetName() == name || !strings.HasPrefix(bArgs.GetName(), name+"_") {
+		t.Fatalf("Expected name with arguments hash, actual %s", bArgs.GetName())
+	}
 }
 
 func TestBinding_Marshal(t *testing.T) {
-	b := binding.NewBinding("test_q", "test_ex", "test_key", &amqp.Table{}, true)
-	data, err := b.Marshal()
+	b := binding.NewBinding("test_q", "test_ex", "test_key", &amqp.Table{"x-match": "all"}, true)
+	data, err := b.Marshal(amqp.ProtoRabbit)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	bUm := &binding.Binding{}
-	bUm.Unmarshal(data)
+	bUm.Unmarshal(data, amqp.ProtoRabbit)
 
 	if !b.Equal(bUm) {
 		t.Fatal("Unmarshaled binding does not equal marshaled")
 	}
+
+	if (*bUm.Arguments)["x-match"] != "all" {
+		t.Fatal("Unmarshaled binding arguments does not equal marshaled")
+	}
 }
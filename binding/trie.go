@@ -0,0 +1,114 @@
+package binding
+
+import (
+	"strings"
+)
+
+// TopicTrie indexes topic bindings by words of their routing key patterns
+// Lookup cost depends on routing key length and wildcard branches, not on number of bindings
+// TopicTrie is not safe for concurrent use
+type TopicTrie struct {
+	root *trieNode
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	// bindings ending at node by binding key
+	bindings map[string]*Binding
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{
+		children: make(map[string]*trieNode),
+		bindings: make(map[string]*Binding),
+	}
+}
+
+// NewTopicTrie returns new empty instance of TopicTrie
+func NewTopicTrie() *TopicTrie {
+	return &TopicTrie{root: newTrieNode()}
+}
+
+// splitTopicKey returns words of routing key, empty routing key has no words
+func splitTopicKey(routingKey string) []string {
+	if routingKey == "" {
+		return nil
+	}
+	return strings.Split(routingKey, ".")
+}
+
+// Add appends binding, binding with the same key is replaced
+func (trie *TopicTrie) Add(bind *Binding) {
+	node := trie.root
+	for _, word := range splitTopicKey(strings.TrimSpace(bind.RoutingKey)) {
+		child, ok := node.children[word]
+		if !ok {
+			child = newTrieNode()
+			node.children[word] = child
+		}
+		node = child
+	}
+	node.bindings[bind.GetKey()] = bind
+}
+
+// Remove removes binding equal to given one and prunes nodes left empty
+func (trie *TopicTrie) Remove(bind *Binding) {
+	words := splitTopicKey(strings.TrimSpace(bind.RoutingKey))
+	path := make([]*trieNode, 0, len(words)+1)
+	node := trie.root
+	path = append(path, node)
+	for _, word := range words {
+		child, ok := node.children[word]
+		if !ok {
+			return
+		}
+		node = child
+		path = append(path, node)
+	}
+
+	key := bind.GetKey()
+	if current, ok := node.bindings[key]; !ok || !current.Equal(bind) {
+		return
+	}
+	delete(node.bindings, key)
+
+	for idx := len(words); idx > 0; idx-- {
+		node = path[idx]
+		if len(node.bindings) != 0 || len(node.children) != 0 {
+			return
+		}
+		delete(path[idx-1].children, words[idx-1])
+	}
+}
+
+// Match calls fn for each binding matched routing key
+// Binding may be passed more than once if its pattern matches routing key in several ways
+func (trie *TopicTrie) Match(routingKey string, fn func(bind *Binding)) {
+	trie.root.match(splitTopicKey(routingKey), fn)
+}
+
+// @spec-note
+// The routing pattern follows the same rules as the routing key with the addition that * matches a single word,
+// and # matches zero or more words.
+func (node *trieNode) match(words []string, fn func(bind *Binding)) {
+	if hashNode, ok := node.children["#"]; ok {
+		for idx := 0; idx <= len(words); idx++ {
+			hashNode.match(words[idx:], fn)
+		}
+	}
+
+	if len(words) == 0 {
+		for _, bind := range node.bindings {
+			fn(bind)
+		}
+		return
+	}
+
+	if child, ok := node.children[words[0]]; ok {
+		child.match(words[1:], fn)
+	}
+	// empty word is not matched by * as well as by regexp of binding
+	if starNode, ok := node.children["*"]; ok && words[0] != "" {
+		starNode.match(words[1:], fn)
+	}
+}
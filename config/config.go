@@ -1,7 +1,9 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
+	"regexp"
 
 	"gopkg.in/yaml.v2"
 )
@@ -11,12 +13,17 @@ type Config struct {
 	Proto      string
 	Users      []User
 	TCP        TCPConfig
+	Listeners  []Listener
 	Queue      Queue
 	Db         Db
 	Vhost      Vhost
 	Security   Security
 	Connection Connection
 	Admin      AdminConfig
+	Metrics    Metrics
+	AccessLog  AccessLog `yaml:"accessLog"`
+	// LogLevel overrides log level given by flag if set
+	LogLevel string `yaml:"logLevel"`
 }
 
 // User for auth check
@@ -32,6 +39,24 @@ type TCPConfig struct {
 	Nodelay      bool
 	ReadBufSize  int `yaml:"readBufSize"`
 	WriteBufSize int `yaml:"writeBufSize"`
+	// Backlog is a listen backlog of AMQP listeners, system default is used if zero
+	Backlog int
+	// AcceptRate limits accepted connections per second for all listeners, unlimited if zero
+	AcceptRate int `yaml:"acceptRate"`
+	// AcceptBurst is a number of connections accepted at once over AcceptRate, at least 1
+	AcceptBurst int `yaml:"acceptBurst"`
+}
+
+// Listener represents AMQP listener address with optional TLS
+// If no listeners configured, server listens plaintext on TCP ip and port
+type Listener struct {
+	IP       string `yaml:"ip"`
+	Port     string
+	TLS      bool   `yaml:"tls"`
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// Expect PROXY protocol v1 or v2 header before AMQP handshake, used behind TCP load balancer
+	ProxyProtocol bool `yaml:"proxyProtocol"`
 }
 
 // TCPConfig represents properties for tune network connections
@@ -44,28 +69,89 @@ type AdminConfig struct {
 type Queue struct {
 	ShardSize        int    `yaml:"shardSize"`
 	MaxMessagesInRam uint64 `yaml:"maxMessagesInRam"`
+	// Milliseconds to wait for acknowledgement of delivered message before its channel is closed, 0 - disabled
+	// Overridden by x-consumer-timeout queue argument
+	ConsumerTimeout int64 `yaml:"consumerTimeout"`
+	// LazyBodies keeps only metadata of persistent messages of durable queues in memory,
+	// bodies are read from storage on delivery
+	LazyBodies bool `yaml:"lazyBodies"`
+	// Defaults applied to queues on queue.declare
+	Defaults QueueDefaults `yaml:"defaults"`
+}
+
+// QueueDefaults are flags and arguments applied to declared queues unless client overrides them
+type QueueDefaults struct {
+	// Durable makes declared queues durable, except exclusive and auto-delete ones
+	Durable bool `yaml:"durable"`
+	// Arguments are merged with queue.declare arguments, argument given by client takes precedence
+	Arguments map[string]interface{} `yaml:"arguments"`
 }
 
 // Db settings, such as path to load/save and engine
 type Db struct {
 	DefaultPath string `yaml:"defaultPath"`
 	Engine      string `yaml:"engine"`
+	// Base paths for messages of vhosts by vhost name, messages of other vhosts are stored at DefaultPath
+	VhostPaths map[string]string `yaml:"vhostPaths"`
+	// Base paths of named storages selected by x-queue-storage queue argument
+	Storages map[string]string `yaml:"storages"`
+	// Body size in bytes starting from which message body is spooled to disk instead of memory, 0 - disabled
+	SpoolThreshold uint64 `yaml:"spoolThreshold"`
+	// DiskFullMode is applied to persistent messages while storage has no free disk space:
+	// block - publishers wait until space is freed, transient - messages are accepted as transient,
+	// reject - messages are rejected
+	DiskFullMode string `yaml:"diskFullMode"`
+	// SafeMode quarantines durable queues which recovery fails on startup instead of aborting startup
+	SafeMode bool `yaml:"safeMode"`
 }
 
 // Vhost settings
 type Vhost struct {
 	DefaultPath string `yaml:"defaultPath"`
+	// Seconds between sweeps of orphaned exclusive and auto-delete queues and exchanges, 0 - disabled
+	SweepInterval int `yaml:"sweepInterval"`
 }
 
 // Security settings
 type Security struct {
 	PasswordCheck string `yaml:"passwordCheck"`
+	// UserIDCheck enables validation of user-id message property against authenticated user
+	UserIDCheck bool `yaml:"userIdCheck"`
+	// Regular expressions names of declared exchanges and queues should match, empty - any name
+	ExchangeNamePattern string `yaml:"exchangeNamePattern"`
+	QueueNamePattern    string `yaml:"queueNamePattern"`
 }
 
 // Connection settings for AMQP-connection
 type Connection struct {
 	ChannelsMax  uint16 `yaml:"channelsMax"`
 	FrameMaxSize uint32 `yaml:"frameMaxSize"`
+	// timeout in seconds of socket write, peer not reading in time is disconnected, 0 - no timeout
+	WriteTimeout int `yaml:"writeTimeout"`
+	// max unacked messages per channel regardless of basic.qos, deliveries stop until acks, 0 - no limit
+	ChannelMaxUnacked uint16 `yaml:"channelMaxUnacked"`
+}
+
+// Metrics settings
+type Metrics struct {
+	// interval in seconds between queue history samples
+	QueueHistoryResolution int `yaml:"queueHistoryResolution"`
+	// how long in seconds queue history samples are kept
+	QueueHistoryRetention int `yaml:"queueHistoryRetention"`
+	// fraction of published messages traced through routing, enqueue, persist and delivery stages, 0 - disabled
+	TraceSampleRate float64 `yaml:"traceSampleRate"`
+	// milliseconds from which traced stage is logged as slow, 0 - disabled
+	TraceSlowThreshold int `yaml:"traceSlowThreshold"`
+}
+
+// AccessLog settings of audit log of publishes and consumer registrations
+type AccessLog struct {
+	// log file path, stdout or stderr, empty - access log is disabled
+	Path string `yaml:"path"`
+	// every n-th publish is written, 0 and 1 - each publish, consumer registrations are not sampled
+	PublishSample int `yaml:"publishSample"`
+	// maximum number of entries written per second, the rest are dropped and counted, 0 - not limited
+	RateLimit int `yaml:"rateLimit"`
 }
 
 func CreateFromFile(path string) (*Config, error) {
@@ -78,10 +164,28 @@ func CreateFromFile(path string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = cfg.Validate(); err != nil {
+		return nil, err
+	}
 
 	return cfg, nil
 }
 
+// Validate returns error if config has settings server could not start with
+func (cfg *Config) Validate() error {
+	patterns := map[string]string{
+		"exchangeNamePattern": cfg.Security.ExchangeNamePattern,
+		"queueNamePattern":    cfg.Security.QueueNamePattern,
+	}
+	for setting, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid security %s '%s': %s", setting, pattern, err.Error())
+		}
+	}
+
+	return nil
+}
+
 func CreateDefault() (*Config, error) {
 	return defaultConfig(), nil
 }
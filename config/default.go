@@ -15,6 +15,9 @@ func defaultConfig() *Config {
 			Nodelay:      false,
 			ReadBufSize:  196608,
 			WriteBufSize: 196608,
+			Backlog:      0,
+			AcceptRate:   0,
+			AcceptBurst:  0,
 		},
 		Admin: AdminConfig{
 			IP:   "0.0.0.0",
@@ -23,20 +26,46 @@ func defaultConfig() *Config {
 		Queue: Queue{
 			ShardSize:        8192,
 			MaxMessagesInRam: 131072,
+			ConsumerTimeout:  0,
+			LazyBodies:       false,
+			Defaults: QueueDefaults{
+				Durable:   false,
+				Arguments: map[string]interface{}{},
+			},
 		},
 		Db: Db{
-			DefaultPath: "db",
-			Engine:      "badger",
+			DefaultPath:    "db",
+			Engine:         "badger",
+			SpoolThreshold: 0,
+			DiskFullMode:   "block",
+			SafeMode:       false,
 		},
 		Vhost: Vhost{
-			DefaultPath: "/",
+			DefaultPath:   "/",
+			SweepInterval: 60,
 		},
 		Security: Security{
-			PasswordCheck: "md5",
+			PasswordCheck:       "md5",
+			UserIDCheck:         false,
+			ExchangeNamePattern: "",
+			QueueNamePattern:    "",
 		},
 		Connection: Connection{
-			ChannelsMax:  4096,
-			FrameMaxSize: 65536,
+			ChannelsMax:       4096,
+			FrameMaxSize:      65536,
+			WriteTimeout:      30,
+			ChannelMaxUnacked: 10000,
+		},
+		Metrics: Metrics{
+			QueueHistoryResolution: 5,
+			QueueHistoryRetention:  600,
+			TraceSampleRate:        0,
+			TraceSlowThreshold:     0,
+		},
+		AccessLog: AccessLog{
+			Path:          "",
+			PublishSample: 0,
+			RateLimit:     0,
 		},
 	}
 }
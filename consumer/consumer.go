@@ -7,9 +7,11 @@ import (
 	"time"
 
 	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/filter"
 	"github.com/valinurovam/garagemq/interfaces"
 	"github.com/valinurovam/garagemq/qos"
 	"github.com/valinurovam/garagemq/queue"
+	"github.com/valinurovam/garagemq/spool"
 )
 
 const (
@@ -18,6 +20,15 @@ const (
 	paused
 )
 
+// Orders of queues consumer of several queues takes messages from
+const (
+	// OrderRoundRobin - each delivery is taken from the queue next to the previous source one, so queues share deliveries
+	OrderRoundRobin = "round-robin"
+	// OrderPriority - delivery is taken from the first queue with ready message, the next queue is consumed only
+	// while previous ones are empty
+	OrderPriority = "priority"
+)
+
 var cid uint64
 
 // Consumer implements AMQP consumer
@@ -25,17 +36,43 @@ type Consumer struct {
 	ID          uint64
 	Queue       string
 	ConsumerTag string
-	noAck       bool
+	options     Options
 	channel     interfaces.Channel
-	queue       *queue.Queue
-	statusLock  sync.RWMutex
-	status      int
-	qos         []*qos.AmqpQos
-	consume     chan bool
+	// source queues of consumer, the first one is queue consumer is created for
+	queues []*queue.Queue
+	// index of queue round robin starts from, used only by consume goroutine
+	nextQueue  int
+	statusLock sync.RWMutex
+	status     int
+	qos        []*qos.AmqpQos
+	consume    chan bool
+}
+
+// Options represents consumer options set by basic.consume flags and arguments
+// Options are fixed for consumer lifetime
+type Options struct {
+	// NoAck consumer gets messages without acknowledgements and is not limited by qos
+	NoAck bool
+	// Exclusive consumer is the only consumer of queue
+	Exclusive bool
+	// NoLocal flag is accepted, but messages published by the same connection are delivered anyway
+	NoLocal bool
+	// Filter is parsed x-filter argument, consumer gets only messages with headers matched by it, nil if not set
+	Filter *filter.Filter
+	// BatchSize is x-batch-size argument, consumer gets up to BatchSize messages and then waits until all of them are
+	// acknowledged, 0 if not set
+	BatchSize uint16
+	// QueueOrder is x-queue-order argument of consumer of several queues, OrderRoundRobin if not set
+	QueueOrder string
+	// Weight is x-consumer-weight argument, consumer gets Weight messages in a row in queue round robin, 1 if not set
+	Weight int
+	// MaxUnacked is x-max-unacked argument, consumer gets no more messages while it holds MaxUnacked unacked ones
+	// regardless of basic.qos of channel, 0 if not set
+	MaxUnacked uint16
 }
 
 // NewConsumer returns new instance of Consumer
-func NewConsumer(queueName string, consumerTag string, noAck bool, channel interfaces.Channel, queue *queue.Queue, qos []*qos.AmqpQos) *Consumer {
+func NewConsumer(queueName string, consumerTag string, options Options, channel interfaces.Channel, qu *queue.Queue, qos []*qos.AmqpQos) *Consumer {
 	id := atomic.AddUint64(&cid, 1)
 	if consumerTag == "" {
 		consumerTag = generateTag(id)
@@ -44,9 +81,9 @@ func NewConsumer(queueName string, consumerTag string, noAck bool, channel inter
 		ID:          id,
 		Queue:       queueName,
 		ConsumerTag: consumerTag,
-		noAck:       noAck,
+		options:     options,
 		channel:     channel,
-		queue:       queue,
+		queues:      []*queue.Queue{qu},
 		qos:         qos,
 		consume:     make(chan bool, 1),
 	}
@@ -56,6 +93,21 @@ func generateTag(id uint64) string {
 	return fmt.Sprintf("%d_%d", time.Now().Unix(), id)
 }
 
+// AddQueue adds source queue, consumer takes messages from all its queues in QueueOrder
+// Should be called before consumer is started
+func (consumer *Consumer) AddQueue(queue *queue.Queue) {
+	consumer.queues = append(consumer.queues, queue)
+}
+
+// Queues returns names of source queues of consumer
+func (consumer *Consumer) Queues() []string {
+	names := make([]string, 0, len(consumer.queues))
+	for _, qu := range consumer.queues {
+		names = append(names, qu.GetName())
+	}
+	return names
+}
+
 // Start starting consumer to fetch messages from queue
 func (consumer *Consumer) Start() {
 	consumer.status = started
@@ -67,59 +119,109 @@ func (consumer *Consumer) Start() {
 // if not set noAck consumer pop message with qos rules and add message to unacked message queue
 func (consumer *Consumer) startConsume() {
 	for range consumer.consume {
-		consumer.retrieveAndSendMessage()
+		// consumer with weight gets up to weight messages in a row, then the next consumer is called
+		sent := 0
+		for sent < consumer.Weight() && consumer.retrieveAndSendMessage() {
+			sent++
+		}
+		if sent > 0 {
+			// next message goes to the next consumer in round robin order, not to the current one
+			// consumer of several queues is called by all of them, so it gets messages of queue it skipped this time
+			for _, qu := range consumer.queues {
+				qu.CallConsumers()
+			}
+		}
 	}
 }
 
-func (consumer *Consumer) retrieveAndSendMessage() {
-	var message *amqp.Message
+// retrieveAndSendMessage returns true if message was sent to the client
+// Consumer of several queues sends message of the first queue in its order which has one
+func (consumer *Consumer) retrieveAndSendMessage() bool {
 	consumer.statusLock.RLock()
 	defer consumer.statusLock.RUnlock()
 	if consumer.status == stopped {
-		return
+		return false
 	}
 
-	if consumer.noAck {
-		message = consumer.queue.Pop()
-	} else {
-		message = consumer.queue.PopQos(consumer.qos)
+	var qosList []*qos.AmqpQos
+	if !consumer.options.NoAck {
+		qosList = consumer.qos
 	}
 
-	if message == nil {
-		return
+	count := len(consumer.queues)
+	roundRobin := count > 1 && consumer.options.QueueOrder != OrderPriority
+	for i := 0; i < count; i++ {
+		idx := i
+		if roundRobin {
+			idx = (consumer.nextQueue + i) % count
+		}
+		qu := consumer.queues[idx]
+		message := consumer.pop(qu, qosList)
+		if message == nil {
+			continue
+		}
+		if roundRobin {
+			consumer.nextQueue = (idx + 1) % count
+		}
+		consumer.sendMessage(qu, message)
+		return true
 	}
 
+	return false
+}
+
+// pop returns the next message of queue for consumer, nil if there is no one
+// Queue with single active consumer gives messages only to its active one
+func (consumer *Consumer) pop(qu *queue.Queue, qosList []*qos.AmqpQos) *amqp.Message {
+	if qu.IsPaused() {
+		return nil
+	}
+	if len(consumer.queues) > 1 && qu.IsSingleActiveConsumer() && qu.ActiveConsumer() != consumer.ConsumerTag {
+		return nil
+	}
+
+	if consumer.options.Filter != nil {
+		return qu.PopQosFilter(qosList, consumer.matchFilter)
+	}
+	return qu.PopQos(qosList)
+}
+
+func (consumer *Consumer) sendMessage(qu *queue.Queue, message *amqp.Message) {
 	dTag := consumer.channel.NextDeliveryTag()
-	if !consumer.noAck {
-		consumer.channel.AddUnackedMessage(dTag, consumer.ConsumerTag, consumer.queue.GetName(), message)
+	if !consumer.options.NoAck {
+		consumer.channel.AddUnackedMessage(dTag, consumer.ConsumerTag, qu.GetName(), message)
 	}
 
 	// handle metrics
-	if consumer.noAck {
-		consumer.queue.GetMetrics().Total.Counter.Dec(1)
-		consumer.queue.GetMetrics().ServerTotal.Counter.Dec(1)
+	if consumer.options.NoAck {
+		qu.GetMetrics().Total.Counter.Dec(1)
+		qu.GetMetrics().ServerTotal.Counter.Dec(1)
 	} else {
-		consumer.queue.GetMetrics().Unacked.Counter.Inc(1)
-		consumer.queue.GetMetrics().ServerUnacked.Counter.Inc(1)
+		qu.GetMetrics().Unacked.Counter.Inc(1)
+		qu.GetMetrics().ServerUnacked.Counter.Inc(1)
 	}
 
-	consumer.queue.GetMetrics().Ready.Counter.Dec(1)
-	consumer.queue.GetMetrics().ServerReady.Counter.Dec(1)
+	qu.GetMetrics().Ready.Counter.Dec(1)
+	qu.GetMetrics().ServerReady.Counter.Dec(1)
 
 	consumer.channel.SendContent(&amqp.BasicDeliver{
 		ConsumerTag: consumer.ConsumerTag,
 		DeliveryTag: dTag,
-		Redelivered: message.DeliveryCount > 1,
+		Redelivered: message.DeliveryCount > 0,
 		Exchange:    message.Exchange,
 		RoutingKey:  message.RoutingKey,
 	}, message)
 
-	consumer.queue.GetMetrics().Deliver.Counter.Inc(1)
-	consumer.queue.GetMetrics().ServerDeliver.Counter.Inc(1)
+	if consumer.options.NoAck {
+		spool.Release(message)
+	}
 
-	consumer.consumeMsg()
+	qu.GetMetrics().Deliver.Counter.Inc(1)
+	qu.GetMetrics().ServerDeliver.Counter.Inc(1)
+}
 
-	return
+func (consumer *Consumer) matchFilter(message *amqp.Message) bool {
+	return consumer.options.Filter.Match(message.Header.PropertyList.Headers)
 }
 
 // Pause pause consumer, used by channel.flow change
@@ -137,11 +239,13 @@ func (consumer *Consumer) UnPause() {
 }
 
 // Consume send signal into consumer channel, than consumer can try to pop message from queue
+// Consumer with filter never takes the signal exclusively, because it can skip the message,
+// so queue continues to call next consumers
 func (consumer *Consumer) Consume() bool {
 	consumer.statusLock.RLock()
 	defer consumer.statusLock.RUnlock()
 
-	return consumer.consumeMsg()
+	return consumer.consumeMsg() && consumer.options.Filter == nil
 }
 
 func (consumer *Consumer) consumeMsg() bool {
@@ -149,6 +253,11 @@ func (consumer *Consumer) consumeMsg() bool {
 		return false
 	}
 
+	// consumer at prefetch limit is skipped, so queue can pass message to the next one
+	if !consumer.options.NoAck && !consumer.hasCapacity() {
+		return false
+	}
+
 	select {
 	case consumer.consume <- true:
 		return true
@@ -157,6 +266,15 @@ func (consumer *Consumer) consumeMsg() bool {
 	}
 }
 
+func (consumer *Consumer) hasCapacity() bool {
+	for _, q := range consumer.qos {
+		if q.IsActive() && !q.HasCapacity() {
+			return false
+		}
+	}
+	return true
+}
+
 // Stop stops consumer and remove it from queue consumers list
 func (consumer *Consumer) Stop() {
 	consumer.statusLock.Lock()
@@ -166,7 +284,9 @@ func (consumer *Consumer) Stop() {
 	}
 	consumer.status = stopped
 	consumer.statusLock.Unlock()
-	consumer.queue.RemoveConsumer(consumer.ConsumerTag)
+	for _, qu := range consumer.queues {
+		qu.RemoveConsumer(consumer.ConsumerTag)
+	}
 	close(consumer.consume)
 }
 
@@ -181,6 +301,19 @@ func (consumer *Consumer) Tag() string {
 	return consumer.ConsumerTag
 }
 
+// Weight returns number of messages consumer gets in a row in queue round robin, at least 1
+func (consumer *Consumer) Weight() int {
+	if consumer.options.Weight < 1 {
+		return 1
+	}
+	return consumer.options.Weight
+}
+
+// Options returns options consumer is started with
+func (consumer *Consumer) Options() Options {
+	return consumer.options
+}
+
 // Qos returns consumer qos rules
 func (consumer *Consumer) Qos() []*qos.AmqpQos {
 	return consumer.qos
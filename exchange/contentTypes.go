@@ -0,0 +1,81 @@
+package exchange
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// ArgAllowedContentTypes - exchange argument with list of content types of messages accepted by exchange
+const ArgAllowedContentTypes = "x-allowed-content-types"
+
+// SetAllowedContentTypes sets content types of messages accepted by exchange, empty list allows any message
+// Types are compared case-insensitively and without parameters, so "application/json; charset=utf-8" is "application/json"
+func (ex *Exchange) SetAllowedContentTypes(contentTypes []string) error {
+	if len(contentTypes) == 0 {
+		ex.contentTypes = nil
+		return nil
+	}
+
+	listed := make(map[string]bool, len(contentTypes))
+	allowed := make([]string, 0, len(contentTypes))
+	for _, contentType := range contentTypes {
+		normalized := normalizeContentType(contentType)
+		if normalized == "" || strings.Contains(normalized, ",") {
+			return fmt.Errorf("invalid content type '%s' in %s", contentType, ArgAllowedContentTypes)
+		}
+		if !listed[normalized] {
+			listed[normalized] = true
+			allowed = append(allowed, normalized)
+		}
+	}
+	sort.Strings(allowed)
+	ex.contentTypes = allowed
+	return nil
+}
+
+// GetAllowedContentTypes returns sorted content types of messages accepted by exchange, nil if any message is accepted
+func (ex *Exchange) GetAllowedContentTypes() []string {
+	return ex.contentTypes
+}
+
+// CheckContentType returns error if content-type of message is not allowed by exchange
+// Message without content-type is not accepted by exchange with allowed content types
+func (ex *Exchange) CheckContentType(message *amqp.Message) error {
+	if len(ex.contentTypes) == 0 {
+		return nil
+	}
+
+	var contentType string
+	if message.Header != nil && message.Header.PropertyList != nil && message.Header.PropertyList.ContentType != nil {
+		contentType = *message.Header.PropertyList.ContentType
+	}
+	normalized := normalizeContentType(contentType)
+	for _, allowed := range ex.contentTypes {
+		if allowed == normalized {
+			return nil
+		}
+	}
+	return fmt.Errorf("content type '%s' is not allowed by exchange '%s'", contentType, ex.Name)
+}
+
+func normalizeContentType(contentType string) string {
+	if idx := strings.IndexByte(contentType, ';'); idx >= 0 {
+		contentType = contentType[:idx]
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+func equalContentTypes(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
@@ -3,39 +3,32 @@ package exchange
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/valinurovam/garagemq/amqp"
 	"github.com/valinurovam/garagemq/binding"
 	"github.com/valinurovam/garagemq/metrics"
+	"github.com/valinurovam/garagemq/schema"
 )
 
-// available exchange types
+// message properties available for routing by x-property exchange
 const (
-	ExTypeDirect = iota + 1
-	ExTypeFanout
-	ExTypeTopic
-	ExTypeHeaders
+	PropertyType   = "type"
+	PropertyAppID  = "app-id"
+	PropertyUserID = "user-id"
 )
 
-var exchangeTypeIDAliasMap = map[byte]string{
-	ExTypeDirect:  "direct",
-	ExTypeFanout:  "fanout",
-	ExTypeTopic:   "topic",
-	ExTypeHeaders: "headers",
-}
-
-var exchangeTypeAliasIDMap = map[string]byte{
-	"direct":  ExTypeDirect,
-	"fanout":  ExTypeFanout,
-	"topic":   ExTypeTopic,
-	"headers": ExTypeHeaders,
-}
-
 // MetricsState implements exchange's metrics state
 type MetricsState struct {
 	MsgIn  *metrics.TrackCounter
 	MsgOut *metrics.TrackCounter
+	// published messages pushed into at least one queue and ones returned or dropped as unroutable
+	MsgRouted     *metrics.TrackCounter
+	MsgUnroutable *metrics.TrackCounter
 }
 
 // Exchange implements AMQP-exchange
@@ -46,14 +39,33 @@ type Exchange struct {
 	autoDelete bool
 	internal   bool
 	system     bool
-	bindLock   sync.Mutex
-	bindings   []*binding.Binding
-	metrics    *MetricsState
+	bindLock   sync.RWMutex
+	// bindings by queue name and binding key
+	bindings map[string]map[string]*binding.Binding
+	// router of exchange type, it is notified about added and removed bindings
+	router Router
+	// exchange had at least one binding
+	wasBound bool
+	// message property routed by x-property exchange
+	property string
+	// disabled is 1 while publishes into exchange are rejected
+	disabled int32
+	// x-meta-* arguments of declaration, stored and reported as is
+	meta *amqp.Table
+	// x-set-properties and x-default-properties arguments, see SetProperties
+	setProperties     amqp.Table
+	defaultProperties amqp.Table
+	// x-schema argument, bodies of messages published into exchange are validated against it
+	schema schema.Validator
+	// x-allowed-content-types argument, normalized and sorted, see SetAllowedContentTypes
+	contentTypes []string
+	metrics      *MetricsState
 }
 
 // NewExchange returns new instance of Exchange
+// x-property exchange routes by message type unless other property is set
 func NewExchange(name string, exType byte, durable bool, autoDelete bool, internal bool, system bool) *Exchange {
-	return &Exchange{
+	ex := &Exchange{
 		Name:       name,
 		exType:     exType,
 		durable:    durable,
@@ -61,26 +73,55 @@ func NewExchange(name string, exType byte, durable bool, autoDelete bool, intern
 		internal:   internal,
 		system:     system,
 		metrics: &MetricsState{
-			MsgIn:  metrics.NewTrackCounter(0, true),
-			MsgOut: metrics.NewTrackCounter(0, true),
+			MsgIn:         metrics.NewTrackCounter(0, true),
+			MsgOut:        metrics.NewTrackCounter(0, true),
+			MsgRouted:     metrics.NewTrackCounter(0, true),
+			MsgUnroutable: metrics.NewTrackCounter(0, true),
 		},
 	}
+	if exType == ExTypeProperty {
+		ex.property = PropertyType
+	}
+	ex.router = newRouter(ex)
+	return ex
 }
 
-// GetExchangeTypeAlias returns exchange type alias by id
-func GetExchangeTypeAlias(id byte) (alias string, err error) {
-	if alias, ok := exchangeTypeIDAliasMap[id]; ok {
-		return alias, nil
+// SetRoutingProperty sets message property routed by x-property exchange - PropertyType, PropertyAppID or PropertyUserID
+func (ex *Exchange) SetRoutingProperty(property string) error {
+	if ex.exType != ExTypeProperty {
+		return fmt.Errorf("routing property is not supported by exchange type '%s'", ex.GetTypeAlias())
+	}
+	switch property {
+	case PropertyType, PropertyAppID, PropertyUserID:
+		ex.property = property
+		return nil
 	}
-	return "", fmt.Errorf("undefined exchange type '%d'", id)
+	return fmt.Errorf("unsupported routing property '%s', expected '%s', '%s' or '%s'", property, PropertyType, PropertyAppID, PropertyUserID)
 }
 
-// GetExchangeTypeID returns exchange type id by alias
-func GetExchangeTypeID(alias string) (id byte, err error) {
-	if id, ok := exchangeTypeAliasIDMap[alias]; ok {
-		return id, nil
-	}
-	return 0, fmt.Errorf("undefined exchange alias '%s'", alias)
+// GetRoutingProperty returns message property routed by x-property exchange, empty string for other types
+func (ex *Exchange) GetRoutingProperty() string {
+	return ex.property
+}
+
+// SetMeta sets x-meta-* arguments of exchange, nil if exchange has no one
+func (ex *Exchange) SetMeta(meta *amqp.Table) {
+	ex.meta = meta
+}
+
+// GetMeta returns x-meta-* arguments of exchange, nil if exchange has no one
+func (ex *Exchange) GetMeta() *amqp.Table {
+	return ex.meta
+}
+
+// SetSchema sets validator of bodies of messages published into exchange, nil disables validation
+func (ex *Exchange) SetSchema(validator schema.Validator) {
+	ex.schema = validator
+}
+
+// GetSchema returns validator of message bodies, nil if exchange has no x-schema
+func (ex *Exchange) GetSchema() schema.Validator {
+	return ex.schema
 }
 
 func (ex *Exchange) GetTypeAlias() string {
@@ -91,6 +132,7 @@ func (ex *Exchange) GetTypeAlias() string {
 
 // AppendBinding check and append binding
 // method check if binding already exists and ignore it
+// Bindings of exchange are identified by queue, routing key and arguments
 func (ex *Exchange) AppendBinding(newBind *binding.Binding) {
 	ex.bindLock.Lock()
 	defer ex.bindLock.Unlock()
@@ -98,76 +140,111 @@ func (ex *Exchange) AppendBinding(newBind *binding.Binding) {
 	// @spec-note
 	// A server MUST allow ignore duplicate bindings ­ that is, two or more bind methods for a specific queue,
 	// with identical arguments ­ without treating these as an error.
-	for _, bind := range ex.bindings {
-		if bind.Equal(newBind) {
-			return
-		}
+	key := newBind.GetKey()
+	if _, ok := ex.bindings[newBind.Queue][key]; ok {
+		return
 	}
-	ex.bindings = append(ex.bindings, newBind)
+
+	if ex.bindings == nil {
+		ex.bindings = make(map[string]map[string]*binding.Binding)
+	}
+	addIndexed(ex.bindings, newBind.Queue, key, newBind)
+	ex.wasBound = true
+
+	// router of exchange restored from storage is created with the first binding
+	if ex.router == nil {
+		ex.router = newRouter(ex)
+	}
+	ex.router.Bind(newBind)
 }
 
-// RemoveBinding remove binding
-func (ex *Exchange) RemoveBinding(rmBind *binding.Binding) {
+// RemoveBinding remove the only binding matched queue, routing key and arguments of given one
+// Returns removed binding or nil if there is no such binding
+func (ex *Exchange) RemoveBinding(rmBind *binding.Binding) *binding.Binding {
 	ex.bindLock.Lock()
 	defer ex.bindLock.Unlock()
-	for i, bind := range ex.bindings {
-		if bind.Equal(rmBind) {
-			ex.bindings = append(ex.bindings[:i], ex.bindings[i+1:]...)
-			return
-		}
+
+	bind, ok := ex.bindings[rmBind.Queue][rmBind.GetKey()]
+	if !ok || !bind.Equal(rmBind) {
+		return nil
 	}
+	ex.removeBinding(bind)
+
+	return bind
 }
 
 // RemoveQueueBindings remove bindings for queue and return removed bindings
 func (ex *Exchange) RemoveQueueBindings(queueName string) []*binding.Binding {
-	var newBindings []*binding.Binding
 	var removedBindings []*binding.Binding
 	ex.bindLock.Lock()
 	defer ex.bindLock.Unlock()
-	for _, bind := range ex.bindings {
-		if bind.GetQueue() != queueName {
-			newBindings = append(newBindings, bind)
-		} else {
-			removedBindings = append(removedBindings, bind)
-		}
+	for _, bind := range ex.bindings[queueName] {
+		removedBindings = append(removedBindings, bind)
+	}
+	for _, bind := range removedBindings {
+		ex.removeBinding(bind)
 	}
 
-	ex.bindings = newBindings
 	return removedBindings
 }
 
-// GetMatchedQueues returns queues matched for message routing key
+func (ex *Exchange) removeBinding(bind *binding.Binding) {
+	key := bind.GetKey()
+	removeIndexed(ex.bindings, bind.Queue, key)
+	ex.router.Unbind(bind)
+}
+
+func addIndexed(index map[string]map[string]*binding.Binding, key string, subKey string, bind *binding.Binding) {
+	bindings, ok := index[key]
+	if !ok {
+		bindings = make(map[string]*binding.Binding)
+		index[key] = bindings
+	}
+	bindings[subKey] = bind
+}
+
+func removeIndexed(index map[string]map[string]*binding.Binding, key string, subKey string) {
+	delete(index[key], subKey)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
+
+// GetMatchedQueues returns queues matched for message by router of exchange type
 func (ex *Exchange) GetMatchedQueues(message *amqp.Message) (matchedQueues map[string]bool) {
 	// @spec-note
 	// The server MUST implement these standard exchange types: fanout, direct.
 	// The server SHOULD implement these standard exchange types: topic, headers.
-
-	// TODO implement "headers" exchange
 	matchedQueues = make(map[string]bool)
-	switch ex.exType {
-	case ExTypeDirect:
-		for _, bind := range ex.bindings {
-			if bind.MatchDirect(message.Exchange, message.RoutingKey) {
-				matchedQueues[bind.GetQueue()] = true
-				return
-			}
-		}
-	case ExTypeFanout:
-		for _, bind := range ex.bindings {
-			if bind.MatchFanout(message.Exchange) {
-				matchedQueues[bind.GetQueue()] = true
-			}
-		}
-	case ExTypeTopic:
-		for _, bind := range ex.bindings {
-			if bind.MatchTopic(message.Exchange, message.RoutingKey) {
-				matchedQueues[bind.GetQueue()] = true
-			}
-		}
+	ex.bindLock.RLock()
+	defer ex.bindLock.RUnlock()
+	if ex.router != nil {
+		ex.router.GetMatchedQueues(message, ex.bindings, matchedQueues)
 	}
 	return
 }
 
+// routingPropertyValue returns value of message property by its name, message without property is not routed
+func routingPropertyValue(message *amqp.Message, property string) (string, bool) {
+	if message.Header == nil || message.Header.PropertyList == nil {
+		return "", false
+	}
+
+	var value *string
+	switch property {
+	case PropertyType:
+		value = message.Header.PropertyList.Type
+	case PropertyAppID:
+		value = message.Header.PropertyList.AppId
+	case PropertyUserID:
+		value = message.Header.PropertyList.UserId
+	}
+	if value == nil {
+		return "", false
+	}
+	return *value, true
+}
+
 // EqualWithErr returns is given exchange equal to current
 func (ex *Exchange) EqualWithErr(exB *Exchange) error {
 	errTemplate := "inequivalent arg '%s' for exchange '%s': received '%s' but current is '%s'"
@@ -197,14 +274,46 @@ func (ex *Exchange) EqualWithErr(exB *Exchange) error {
 	if ex.internal != exB.IsInternal() {
 		return fmt.Errorf(errTemplate, "internal", ex.Name, exB.IsInternal(), ex.internal)
 	}
-	return nil
+	if ex.property != exB.GetRoutingProperty() {
+		return fmt.Errorf(errTemplate, "routing-property", ex.Name, exB.GetRoutingProperty(), ex.property)
+	}
+	if !schema.Equal(ex.schema, exB.GetSchema()) {
+		return fmt.Errorf("inequivalent arg 'x-schema' for exchange '%s'", ex.Name)
+	}
+	if !equalContentTypes(ex.contentTypes, exB.GetAllowedContentTypes()) {
+		return fmt.Errorf(
+			errTemplate,
+			ArgAllowedContentTypes,
+			ex.Name,
+			strings.Join(exB.GetAllowedContentTypes(), ","),
+			strings.Join(ex.contentTypes, ","),
+		)
+	}
+	return ex.equalProperties(exB)
 }
 
-// GetBindings returns exchange's bindings
+// GetBindings returns exchange's bindings sorted by queue, routing key and arguments
 func (ex *Exchange) GetBindings() []*binding.Binding {
-	ex.bindLock.Lock()
-	defer ex.bindLock.Unlock()
-	return ex.bindings
+	ex.bindLock.RLock()
+	bindings := make([]*binding.Binding, 0, len(ex.bindings))
+	for _, queueBindings := range ex.bindings {
+		for _, bind := range queueBindings {
+			bindings = append(bindings, bind)
+		}
+	}
+	ex.bindLock.RUnlock()
+
+	sort.Slice(bindings, func(i, j int) bool {
+		if bindings[i].Queue != bindings[j].Queue {
+			return bindings[i].Queue < bindings[j].Queue
+		}
+		if bindings[i].RoutingKey != bindings[j].RoutingKey {
+			return bindings[i].RoutingKey < bindings[j].RoutingKey
+		}
+		return bindings[i].GetArgumentsKey() < bindings[j].GetArgumentsKey()
+	})
+
+	return bindings
 }
 
 // IsDurable returns is exchange durable
@@ -222,6 +331,27 @@ func (ex *Exchange) IsAutoDelete() bool {
 	return ex.autoDelete
 }
 
+// IsUnused returns is exchange left without bindings after it had any
+func (ex *Exchange) IsUnused() bool {
+	ex.bindLock.RLock()
+	defer ex.bindLock.RUnlock()
+	return ex.wasBound && len(ex.bindings) == 0
+}
+
+// SetDisabled disables or enables exchange, publishes into disabled exchange are rejected
+func (ex *Exchange) SetDisabled(disabled bool) {
+	var value int32
+	if disabled {
+		value = 1
+	}
+	atomic.StoreInt32(&ex.disabled, value)
+}
+
+// IsDisabled returns is publishes into exchange rejected
+func (ex *Exchange) IsDisabled() bool {
+	return atomic.LoadInt32(&ex.disabled) == 1
+}
+
 // IsInternal returns that the exchange may not be used directly by publishers,
 // but only when bound to other exchanges
 func (ex *Exchange) IsInternal() bool {
@@ -237,11 +367,53 @@ func (ex *Exchange) Marshal(protoVersion string) (data []byte, err error) {
 	if err = amqp.WriteOctet(buf, ex.exType); err != nil {
 		return nil, err
 	}
+	if err = amqp.WriteShortstr(buf, ex.property); err != nil {
+		return nil, err
+	}
+
+	meta := ex.meta
+	if meta == nil {
+		meta = &amqp.Table{}
+	}
+	if err = amqp.WriteTable(buf, meta, protoVersion); err != nil {
+		return nil, err
+	}
+
+	for _, properties := range []amqp.Table{ex.setProperties, ex.defaultProperties} {
+		if properties == nil {
+			properties = amqp.Table{}
+		}
+		if err = amqp.WriteTable(buf, &properties, protoVersion); err != nil {
+			return nil, err
+		}
+	}
+
+	var schemaType, definition string
+	if ex.schema != nil {
+		schemaType, definition = ex.schema.Type(), ex.schema.Definition()
+	}
+	if err = amqp.WriteShortstr(buf, schemaType); err != nil {
+		return nil, err
+	}
+	if err = amqp.WriteLongstr(buf, []byte(definition)); err != nil {
+		return nil, err
+	}
+
+	// ids of registered types depend on registration order, so they are restored by alias
+	if err = amqp.WriteShortstr(buf, ex.GetTypeAlias()); err != nil {
+		return nil, err
+	}
+
+	// allowed content types never contain comma, see SetAllowedContentTypes
+	if err = amqp.WriteLongstr(buf, []byte(strings.Join(ex.contentTypes, ","))); err != nil {
+		return nil, err
+	}
 	return buf.Bytes(), nil
 }
 
 // Unmarshal returns exchange from storage raw bytes data
-func (ex *Exchange) Unmarshal(data []byte) (err error) {
+// Error is returned for exchange of type which is not registered
+func (ex *Exchange) Unmarshal(data []byte, protoVersion string) (err error) {
 	buf := bytes.NewReader(data)
 	if ex.Name, err = amqp.ReadShortstr(buf); err != nil {
 		return err
@@ -250,7 +422,84 @@ func (ex *Exchange) Unmarshal(data []byte) (err error) {
 		return err
 	}
 	ex.durable = true
-	return
+
+	// exchanges stored by previous versions have no routing property
+	if ex.property, err = amqp.ReadShortstr(buf); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+
+	// exchanges stored by previous versions have no x-meta-* arguments
+	if buf.Len() == 0 {
+		return nil
+	}
+	var meta *amqp.Table
+	if meta, err = amqp.ReadTable(buf, protoVersion); err != nil {
+		return err
+	}
+	if len(*meta) > 0 {
+		ex.meta = meta
+	}
+
+	// exchanges stored by previous versions have no stamped properties
+	if buf.Len() == 0 {
+		return nil
+	}
+	var set, defaults *amqp.Table
+	if set, err = amqp.ReadTable(buf, protoVersion); err != nil {
+		return err
+	}
+	if defaults, err = amqp.ReadTable(buf, protoVersion); err != nil {
+		return err
+	}
+	if err = ex.SetProperties(*set, *defaults); err != nil {
+		return err
+	}
+
+	// exchanges stored by previous versions have no x-schema
+	if buf.Len() == 0 {
+		return nil
+	}
+	var schemaType string
+	var definition []byte
+	if schemaType, err = amqp.ReadShortstr(buf); err != nil {
+		return err
+	}
+	if definition, err = amqp.ReadLongstr(buf); err != nil {
+		return err
+	}
+	if schemaType != "" {
+		if ex.schema, err = schema.New(schemaType, string(definition)); err != nil {
+			return err
+		}
+	}
+
+	// exchanges stored by previous versions have built-in types only
+	if buf.Len() == 0 {
+		return nil
+	}
+	var alias string
+	if alias, err = amqp.ReadShortstr(buf); err != nil {
+		return err
+	}
+	if ex.exType, err = GetExchangeTypeID(alias); err != nil {
+		return err
+	}
+
+	// exchanges stored by previous versions have no allowed content types
+	if buf.Len() == 0 {
+		return nil
+	}
+	var contentTypes []byte
+	if contentTypes, err = amqp.ReadLongstr(buf); err != nil {
+		return err
+	}
+	if len(contentTypes) > 0 {
+		return ex.SetAllowedContentTypes(strings.Split(string(contentTypes), ","))
+	}
+	return nil
 }
 
 // GetName returns exchange name
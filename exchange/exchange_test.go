@@ -1,10 +1,13 @@
 package exchange
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/valinurovam/garagemq/amqp"
 	"github.com/valinurovam/garagemq/binding"
+	"github.com/valinurovam/garagemq/schema"
 )
 
 func getTestEx() *Exchange {
@@ -67,6 +70,60 @@ func TestExchange_RemoveBinding(t *testing.T) {
 	}
 }
 
+func TestExchange_RemoveBinding_OnlyMatched(t *testing.T) {
+	for _, exType := range []byte{ExTypeDirect, ExTypeFanout, ExTypeTopic} {
+		e := NewExchange("test", exType, false, false, false, false)
+		topic := exType == ExTypeTopic
+		bindings := []*binding.Binding{
+			binding.NewBinding("q1", "test", "rk", &amqp.Table{}, topic),
+			binding.NewBinding("q1", "test", "rk2", &amqp.Table{}, topic),
+			binding.NewBinding("q1", "test", "rk", &amqp.Table{"x-match": "all", "format": "pdf"}, topic),
+			binding.NewBinding("q1", "test", "rk", &amqp.Table{"x-match": "any", "format": "pdf"}, topic),
+			binding.NewBinding("q2", "test", "rk", &amqp.Table{"x-match": "all", "format": "pdf"}, topic),
+		}
+		for _, bind := range bindings {
+			e.AppendBinding(bind)
+		}
+		if l := len(e.GetBindings()); l != len(bindings) {
+			t.Fatalf("Expected %d bindings, actual %d", len(bindings), l)
+		}
+
+		rmBind := binding.NewBinding("q1", "test", "rk", &amqp.Table{"format": "pdf", "x-match": "all"}, topic)
+		if removed := e.RemoveBinding(rmBind); removed != bindings[2] {
+			t.Fatalf("Expected removed binding %v, actual %v", bindings[2], removed)
+		}
+		if removed := e.RemoveBinding(rmBind); removed != nil {
+			t.Fatal("Expected nothing removed on second unbind")
+		}
+
+		left := e.GetBindings()
+		if len(left) != len(bindings)-1 {
+			t.Fatalf("Expected %d bindings after remove, actual %d", len(bindings)-1, len(left))
+		}
+		for _, bind := range left {
+			if bind == bindings[2] {
+				t.Fatal("Removed binding found after remove")
+			}
+		}
+
+		// queue is still routed by other bindings with the same routing key
+		matched := e.GetMatchedQueues(&amqp.Message{Exchange: "test", RoutingKey: "rk"})
+		if !matched["q1"] || !matched["q2"] {
+			t.Fatalf("Expected both queues matched, actual %v", matched)
+		}
+
+		e.RemoveBinding(binding.NewBinding("q1", "test", "rk", nil, topic))
+		e.RemoveBinding(binding.NewBinding("q1", "test", "rk", &amqp.Table{"x-match": "any", "format": "pdf"}, topic))
+		matched = e.GetMatchedQueues(&amqp.Message{Exchange: "test", RoutingKey: "rk"})
+		if exType != ExTypeFanout && matched["q1"] {
+			t.Fatal("Expected q1 is not matched after all its bindings with routing key removed")
+		}
+		if l := len(e.GetBindings()); l != 2 {
+			t.Fatalf("Expected 2 bindings left, actual %d", l)
+		}
+	}
+}
+
 func TestExchange_GetBindings(t *testing.T) {
 	e := getTestEx()
 	b := binding.NewBinding("test", "test", "test", &amqp.Table{}, false)
@@ -122,6 +179,77 @@ func TestExchange_GetMatchedQueues_Direct(t *testing.T) {
 	}
 }
 
+func TestExchange_GetMatchedQueues_Direct_MultipleQueues(t *testing.T) {
+	e := getTestEx()
+	e.AppendBinding(binding.NewBinding("test_q1", "test", "test_rk", &amqp.Table{}, false))
+	e.AppendBinding(binding.NewBinding("test_q2", "test", "test_rk", &amqp.Table{}, false))
+	e.AppendBinding(binding.NewBinding("test_q3", "test", "other_rk", &amqp.Table{}, false))
+
+	matched := e.GetMatchedQueues(&amqp.Message{
+		Exchange:   "test",
+		RoutingKey: "test_rk",
+	})
+
+	if len(matched) != 2 || !matched["test_q1"] || !matched["test_q2"] {
+		t.Fatalf("Expected direct match of all queues bound with routing key, actual %v", matched)
+	}
+
+	e.RemoveQueueBindings("test_q1")
+	matched = e.GetMatchedQueues(&amqp.Message{
+		Exchange:   "test",
+		RoutingKey: "test_rk",
+	})
+
+	if len(matched) != 1 || !matched["test_q2"] {
+		t.Fatalf("Expected direct match of queue left bound, actual %v", matched)
+	}
+}
+
+func TestExchange_GetMatchedQueues_Property(t *testing.T) {
+	e := NewExchange("test", ExTypeProperty, false, false, false, false)
+	e.AppendBinding(binding.NewBinding("test_q1", "test", "order.created", &amqp.Table{}, false))
+	e.AppendBinding(binding.NewBinding("test_q2", "test", "billing", &amqp.Table{}, false))
+
+	msgType := "order.created"
+	appID := "billing"
+	message := &amqp.Message{
+		Exchange:   "test",
+		RoutingKey: "billing",
+		Header: &amqp.ContentHeader{
+			PropertyList: &amqp.BasicPropertyList{Type: &msgType, AppId: &appID},
+		},
+	}
+
+	matched := e.GetMatchedQueues(message)
+	if len(matched) != 1 || !matched["test_q1"] {
+		t.Fatalf("Expected match by message type, actual %v", matched)
+	}
+
+	if err := e.SetRoutingProperty(PropertyAppID); err != nil {
+		t.Fatal(err)
+	}
+	matched = e.GetMatchedQueues(message)
+	if len(matched) != 1 || !matched["test_q2"] {
+		t.Fatalf("Expected match by message app-id, actual %v", matched)
+	}
+
+	if err := e.SetRoutingProperty(PropertyUserID); err != nil {
+		t.Fatal(err)
+	}
+	if matched = e.GetMatchedQueues(message); len(matched) != 0 {
+		t.Fatalf("Expected message without user-id not routed, actual %v", matched)
+	}
+}
+
+func TestExchange_SetRoutingProperty_Failed(t *testing.T) {
+	if err := NewExchange("test", ExTypeProperty, false, false, false, false).SetRoutingProperty("routing-key"); err == nil {
+		t.Fatal("Expected unsupported routing property error")
+	}
+	if err := NewExchange("test", ExTypeDirect, false, false, false, false).SetRoutingProperty(PropertyType); err == nil {
+		t.Fatal("Expected routing property is not supported error")
+	}
+}
+
 func TestExchange_GetMatchedQueues_Fanout(t *testing.T) {
 	e := &Exchange{
 		Name:       "test",
@@ -195,6 +323,36 @@ func TestExchange_GetMatchedQueues_Topic(t *testing.T) {
 	}
 }
 
+func TestExchange_GetMatchedQueues_CC_BCC(t *testing.T) {
+	for _, exType := range []byte{ExTypeDirect, ExTypeTopic} {
+		e := &Exchange{
+			Name:   "test",
+			exType: exType,
+		}
+		e.AppendBinding(binding.NewBinding("test_q1", "test", "rk1", &amqp.Table{}, exType == ExTypeTopic))
+		e.AppendBinding(binding.NewBinding("test_q2", "test", "rk2", &amqp.Table{}, exType == ExTypeTopic))
+		e.AppendBinding(binding.NewBinding("test_q3", "test", "rk3", &amqp.Table{}, exType == ExTypeTopic))
+		e.AppendBinding(binding.NewBinding("test_q4", "test", "rk4", &amqp.Table{}, exType == ExTypeTopic))
+
+		matched := e.GetMatchedQueues(&amqp.Message{
+			Exchange:   "test",
+			RoutingKey: "rk1",
+			Header: &amqp.ContentHeader{
+				PropertyList: &amqp.BasicPropertyList{
+					Headers: &amqp.Table{
+						"CC":  []interface{}{"rk2", "unknown"},
+						"BCC": []interface{}{[]byte("rk3")},
+					},
+				},
+			},
+		})
+
+		if len(matched) != 3 || !matched["test_q1"] || !matched["test_q2"] || !matched["test_q3"] {
+			t.Fatalf("Expected CC and BCC matches for exchange type %d, actual %v", exType, matched)
+		}
+	}
+}
+
 func TestExchange_EqualWithErr_Success(t *testing.T) {
 	e1 := &Exchange{
 		Name:       "test",
@@ -427,17 +585,306 @@ func TestExchange_Marshal(t *testing.T) {
 		t.Fatal(err)
 	}
 	ex := &Exchange{}
-	ex.Unmarshal(data)
+	ex.Unmarshal(data, amqp.ProtoRabbit)
 
 	if err := e.EqualWithErr(ex); err != nil {
 		t.Fatal("Unmarshaled exchange does not equal marshaled", err)
 	}
 }
 
+func TestExchange_Marshal_RoutingProperty(t *testing.T) {
+	e := NewExchange("test", ExTypeProperty, true, false, false, false)
+	e.SetRoutingProperty(PropertyAppID)
+
+	data, err := e.Marshal(amqp.Proto091)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := &Exchange{}
+	if err = ex.Unmarshal(data, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.EqualWithErr(ex); err != nil {
+		t.Fatal("Unmarshaled exchange does not equal marshaled", err)
+	}
+
+	// exchange stored without routing property
+	ex = &Exchange{}
+	if err = ex.Unmarshal([]byte{4, 't', 'e', 's', 't', ExTypeDirect}, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if ex.GetRoutingProperty() != "" {
+		t.Fatalf("Expected no routing property, actual '%s'", ex.GetRoutingProperty())
+	}
+}
+
 // useless, for coverage only
+func TestExchange_Marshal_Meta(t *testing.T) {
+	e := NewExchange("test", ExTypeDirect, true, false, false, false)
+	e.SetMeta(&amqp.Table{"x-meta-owner": "billing"})
+
+	data, err := e.Marshal(amqp.ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := &Exchange{}
+	if err = ex.Unmarshal(data, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if meta := ex.GetMeta(); meta == nil || (*meta)["x-meta-owner"] != "billing" {
+		t.Fatalf("Expected x-meta-owner restored, actual %v", meta)
+	}
+}
+
+func TestExchange_Marshal_Properties(t *testing.T) {
+	for _, protoVersion := range []string{amqp.Proto091, amqp.ProtoRabbit} {
+		e := NewExchange("test", ExTypeDirect, true, false, false, false)
+		if err := e.SetProperties(amqp.Table{"app-id": "billing"}, amqp.Table{"delivery-mode": int64(2)}); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := e.Marshal(protoVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex := &Exchange{}
+		if err = ex.Unmarshal(data, protoVersion); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.EqualWithErr(ex); err != nil {
+			t.Fatalf("Expected properties restored with %s, %s", protoVersion, err)
+		}
+	}
+}
+
+func TestExchange_Marshal_Schema(t *testing.T) {
+	validator, err := schema.New(schema.TypeJSON, `{"type": "object", "required": ["id"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewExchange("test", ExTypeDirect, true, false, false, false)
+	e.SetSchema(validator)
+
+	data, err := e.Marshal(amqp.ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := &Exchange{}
+	if err = ex.Unmarshal(data, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.EqualWithErr(ex); err != nil {
+		t.Fatal("Expected schema restored", err)
+	}
+	if ex.GetSchema().Validate([]byte(`{"name": "test"}`)) == nil {
+		t.Fatal("Expected restored schema validates bodies")
+	}
+
+	if err := e.EqualWithErr(NewExchange("test", ExTypeDirect, true, false, false, false)); err == nil {
+		t.Fatal("Expected inequivalent schema")
+	}
+}
+
+func TestExchange_CheckContentType(t *testing.T) {
+	e := NewExchange("test", ExTypeDirect, true, false, false, false)
+	message := &amqp.Message{Header: &amqp.ContentHeader{PropertyList: &amqp.BasicPropertyList{}}}
+	if err := e.CheckContentType(message); err != nil {
+		t.Fatal("Expected any message allowed by default", err)
+	}
+
+	if err := e.SetAllowedContentTypes([]string{"Application/JSON", "text/plain", "application/json"}); err != nil {
+		t.Fatal(err)
+	}
+	if types := e.GetAllowedContentTypes(); len(types) != 2 || types[0] != "application/json" || types[1] != "text/plain" {
+		t.Fatalf("Expected normalized content types, actual %v", types)
+	}
+	if err := e.CheckContentType(message); err == nil {
+		t.Fatal("Expected message without content type is not allowed")
+	}
+	for contentType, allowed := range map[string]bool{
+		"application/json":                true,
+		"application/json; charset=utf-8": true,
+		"TEXT/PLAIN":                      true,
+		"application/xml":                 false,
+		"application/jsonx":               false,
+	} {
+		value := contentType
+		message.Header.PropertyList.ContentType = &value
+		if err := e.CheckContentType(message); (err == nil) != allowed {
+			t.Fatalf("Unexpected check of content type '%s': %v", contentType, err)
+		}
+	}
+
+	for _, contentTypes := range [][]string{{""}, {" ; charset=utf-8"}, {"text/plain, text/html"}} {
+		if err := e.SetAllowedContentTypes(contentTypes); err == nil {
+			t.Fatalf("Expected error on content types %v", contentTypes)
+		}
+	}
+}
+
+func TestExchange_Marshal_AllowedContentTypes(t *testing.T) {
+	e := NewExchange("test", ExTypeDirect, true, false, false, false)
+	e.SetAllowedContentTypes([]string{"text/plain", "application/json"})
+
+	data, err := e.Marshal(amqp.ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := &Exchange{}
+	if err = ex.Unmarshal(data, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.EqualWithErr(ex); err != nil {
+		t.Fatal("Expected allowed content types restored", err)
+	}
+
+	if err := e.EqualWithErr(NewExchange("test", ExTypeDirect, true, false, false, false)); err == nil {
+		t.Fatal("Expected inequivalent allowed content types")
+	}
+}
+
+// prefixRouter routes message to queues bound with key routing key starts with
+type prefixRouter struct {
+	bindings map[*binding.Binding]bool
+}
+
+func (router *prefixRouter) Bind(bind *binding.Binding) {
+	router.bindings[bind] = true
+}
+
+func (router *prefixRouter) Unbind(bind *binding.Binding) {
+	delete(router.bindings, bind)
+}
+
+func (router *prefixRouter) GetMatchedQueues(message *amqp.Message, bindings map[string]map[string]*binding.Binding, matchedQueues map[string]bool) {
+	for bind := range router.bindings {
+		if strings.HasPrefix(message.RoutingKey, bind.RoutingKey) {
+			matchedQueues[bind.Queue] = true
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	exType, err := Register("x-prefix", func(ex *Exchange) Router {
+		return &prefixRouter{bindings: make(map[*binding.Binding]bool)}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := GetExchangeTypeID("x-prefix"); id != exType {
+		t.Fatalf("Expected registered type id %d, actual %d", exType, id)
+	}
+	if _, err := Register("direct", nil); err == nil {
+		t.Fatal("Expected error on replacing built-in type")
+	}
+
+	e := NewExchange("test", exType, true, false, false, false)
+	first := binding.NewBinding("q1", "test", "orders.", &amqp.Table{}, false)
+	e.AppendBinding(first)
+	e.AppendBinding(binding.NewBinding("q2", "test", "orders.eu", &amqp.Table{}, false))
+
+	matched := e.GetMatchedQueues(&amqp.Message{Exchange: "test", RoutingKey: "orders.eu.1"})
+	if len(matched) != 2 {
+		t.Fatalf("Expected 2 matched queues, actual %v", matched)
+	}
+	e.RemoveBinding(first)
+	matched = e.GetMatchedQueues(&amqp.Message{Exchange: "test", RoutingKey: "orders.us.1"})
+	if len(matched) != 0 {
+		t.Fatalf("Expected no matched queues after unbind, actual %v", matched)
+	}
+
+	data, err := e.Marshal(amqp.ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := &Exchange{}
+	if err = ex.Unmarshal(data, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if ex.GetTypeAlias() != "x-prefix" {
+		t.Fatalf("Expected registered type restored, actual '%s'", ex.GetTypeAlias())
+	}
+}
+
+func TestExchange_Unmarshal_FailedUnregisteredType(t *testing.T) {
+	data, err := NewExchange("test", ExTypeDirect, true, false, false, false).Marshal(amqp.ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// type alias is the last field of stored exchange
+	data = append(data[:len(data)-len("direct")-1], byte(len("x-unknown")))
+	data = append(data, "x-unknown"...)
+
+	if err = (&Exchange{}).Unmarshal(data, amqp.ProtoRabbit); err == nil {
+		t.Fatal("Expected error on unregistered exchange type")
+	}
+}
+
+func TestExchange_SetProperties_Failed(t *testing.T) {
+	invalid := []amqp.Table{
+		{"user-id": "guest"},
+		{"headers": amqp.Table{}},
+		{"app-id": int64(1)},
+		{"expiration": "soon"},
+		{"delivery-mode": int64(3)},
+		{"priority": int64(256)},
+		{"priority": "high"},
+	}
+	for _, properties := range invalid {
+		e := NewExchange("test", ExTypeDirect, true, false, false, false)
+		if err := e.SetProperties(properties, nil); err == nil {
+			t.Fatalf("Expected error on set properties %v", properties)
+		}
+		if err := e.SetProperties(nil, properties); err == nil {
+			t.Fatalf("Expected error on default properties %v", properties)
+		}
+	}
+}
+
+func TestExchange_StampProperties(t *testing.T) {
+	e := NewExchange("test", ExTypeDirect, true, false, false, false)
+	err := e.SetProperties(
+		amqp.Table{"app-id": []byte("billing"), "priority": int32(5)},
+		amqp.Table{"type": "invoice", "app-id": "unused", "delivery-mode": int64(2)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appID := "client"
+	msgType := "receipt"
+	message := &amqp.Message{Header: &amqp.ContentHeader{PropertyList: &amqp.BasicPropertyList{AppId: &appID, Type: &msgType}}}
+	e.StampProperties(message)
+
+	props := message.Header.PropertyList
+	if *props.AppId != "billing" || *props.Priority != 5 {
+		t.Fatal("Expected set properties replace ones of publisher")
+	}
+	if *props.Type != "receipt" || *props.DeliveryMode != 2 {
+		t.Fatal("Expected default properties applied only to missing ones")
+	}
+	if appID != "client" {
+		t.Fatal("Expected value of publisher property is not changed")
+	}
+}
+
+func TestExchange_EqualWithErr_Failed_Properties(t *testing.T) {
+	exA := NewExchange("test", ExTypeDirect, true, false, false, false)
+	exB := NewExchange("test", ExTypeDirect, true, false, false, false)
+	exB.SetProperties(amqp.Table{"app-id": "billing"}, nil)
+	if exA.EqualWithErr(exB) == nil {
+		t.Fatal("Expected inequivalent set properties")
+	}
+
+	exB.SetProperties(nil, amqp.Table{"app-id": "billing"})
+	if exA.EqualWithErr(exB) == nil {
+		t.Fatal("Expected inequivalent default properties")
+	}
+}
+
 func TestExchange_Unmarshal_FailedEmpty(t *testing.T) {
 	ex := &Exchange{}
-	if ex.Unmarshal([]byte{}) == nil {
+	if ex.Unmarshal([]byte{}, amqp.ProtoRabbit) == nil {
 		t.Fatal("Expected unmarshal error")
 	}
 }
@@ -445,7 +892,7 @@ func TestExchange_Unmarshal_FailedEmpty(t *testing.T) {
 // useless, for coverage only
 func TestExchange_Unmarshal_FailedNameOnly(t *testing.T) {
 	ex := &Exchange{}
-	if ex.Unmarshal([]byte{4, 't', 'e', 's', 't'}) == nil {
+	if ex.Unmarshal([]byte{4, 't', 'e', 's', 't'}, amqp.ProtoRabbit) == nil {
 		t.Fatal("Expected unmarshal error")
 	}
 }
@@ -497,3 +944,45 @@ func TestExchange_GetTypeAlias(t *testing.T) {
 		}
 	}
 }
+
+const benchBindingsCount = 100000
+
+func benchExchange(exType byte) *Exchange {
+	e := NewExchange("test", exType, false, false, false, false)
+	for i := 0; i < benchBindingsCount; i++ {
+		routingKey := fmt.Sprintf("rk%d", i)
+		if exType == ExTypeTopic {
+			routingKey = fmt.Sprintf("stock.rk%d.#", i)
+		}
+		e.AppendBinding(binding.NewBinding(fmt.Sprintf("q%d", i), "test", routingKey, &amqp.Table{}, exType == ExTypeTopic))
+	}
+	return e
+}
+
+func BenchmarkExchange_AppendRemoveBinding_100k(b *testing.B) {
+	e := benchExchange(ExTypeDirect)
+	bind := binding.NewBinding("bench_q", "test", "bench_rk", &amqp.Table{}, false)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.AppendBinding(bind)
+		e.RemoveBinding(bind)
+	}
+}
+
+func BenchmarkExchange_GetMatchedQueues_Direct_100k(b *testing.B) {
+	e := benchExchange(ExTypeDirect)
+	message := &amqp.Message{Exchange: "test", RoutingKey: fmt.Sprintf("rk%d", benchBindingsCount/2)}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.GetMatchedQueues(message)
+	}
+}
+
+func BenchmarkExchange_GetMatchedQueues_Topic_100k(b *testing.B) {
+	e := benchExchange(ExTypeTopic)
+	message := &amqp.Message{Exchange: "test", RoutingKey: fmt.Sprintf("stock.rk%d.usd", benchBindingsCount/2)}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.GetMatchedQueues(message)
+	}
+}
@@ -0,0 +1,179 @@
+package exchange
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// Exchange arguments with content-header properties stamped on messages routed by exchange
+const (
+	// ArgSetProperties - properties replacing ones given by publisher
+	ArgSetProperties = "x-set-properties"
+	// ArgDefaultProperties - properties applied only to messages without them
+	ArgDefaultProperties = "x-default-properties"
+)
+
+// stringProperty returns field of string property by its name, nil for unsupported property
+// user-id is not supported, as it is checked against authenticated user
+func stringProperty(props *amqp.BasicPropertyList, name string) **string {
+	switch name {
+	case "content-type":
+		return &props.ContentType
+	case "content-encoding":
+		return &props.ContentEncoding
+	case "correlation-id":
+		return &props.CorrelationId
+	case "reply-to":
+		return &props.ReplyTo
+	case "expiration":
+		return &props.Expiration
+	case "message-id":
+		return &props.MessageId
+	case "type":
+		return &props.Type
+	case "app-id":
+		return &props.AppId
+	}
+	return nil
+}
+
+// octetProperty returns field of octet property by its name, nil for unsupported property
+func octetProperty(props *amqp.BasicPropertyList, name string) **byte {
+	switch name {
+	case "delivery-mode":
+		return &props.DeliveryMode
+	case "priority":
+		return &props.Priority
+	}
+	return nil
+}
+
+// SetProperties sets properties stamped on messages routed by exchange from x-set-properties and x-default-properties tables
+// Property of set table replaces one given by publisher, property of default table is applied only if publisher did not set it
+// Tables are validated and kept with values converted to string or byte, nil table means no properties
+func (ex *Exchange) SetProperties(set amqp.Table, defaults amqp.Table) (err error) {
+	if set, err = normalizeProperties(ArgSetProperties, set); err != nil {
+		return err
+	}
+	if defaults, err = normalizeProperties(ArgDefaultProperties, defaults); err != nil {
+		return err
+	}
+	ex.setProperties = set
+	ex.defaultProperties = defaults
+	return nil
+}
+
+// GetProperties returns properties stamped on messages routed by exchange, nil if exchange has no one
+func (ex *Exchange) GetProperties() (set amqp.Table, defaults amqp.Table) {
+	return ex.setProperties, ex.defaultProperties
+}
+
+// StampProperties applies properties of exchange to message, default properties first and then set ones
+// Message property list is changed in place, so it should not be shared with already routed messages
+func (ex *Exchange) StampProperties(message *amqp.Message) {
+	if ex.setProperties == nil && ex.defaultProperties == nil {
+		return
+	}
+	props := message.Header.PropertyList
+	stampProperties(props, ex.defaultProperties, false)
+	stampProperties(props, ex.setProperties, true)
+}
+
+func stampProperties(props *amqp.BasicPropertyList, properties amqp.Table, override bool) {
+	for name, value := range properties {
+		switch value := value.(type) {
+		case string:
+			if field := stringProperty(props, name); *field == nil || override {
+				*field = &value
+			}
+		case byte:
+			if field := octetProperty(props, name); *field == nil || override {
+				*field = &value
+			}
+		}
+	}
+}
+
+func normalizeProperties(arg string, properties amqp.Table) (amqp.Table, error) {
+	if len(properties) == 0 {
+		return nil, nil
+	}
+
+	normalized := amqp.Table{}
+	for name, value := range properties {
+		if stringProperty(&amqp.BasicPropertyList{}, name) != nil {
+			var str string
+			switch value := value.(type) {
+			case string:
+				str = value
+			case []byte:
+				str = string(value)
+			default:
+				return nil, fmt.Errorf("%s: property '%s' should be a string", arg, name)
+			}
+			if name == "expiration" {
+				if _, err := strconv.ParseUint(str, 10, 32); err != nil {
+					return nil, fmt.Errorf("%s: property '%s' should be a non-negative number of milliseconds", arg, name)
+				}
+			}
+			normalized[name] = str
+			continue
+		}
+
+		if octetProperty(&amqp.BasicPropertyList{}, name) != nil {
+			octet, ok := octetValue(value)
+			if !ok || (name == "delivery-mode" && octet != 1 && octet != 2) {
+				return nil, fmt.Errorf("%s: invalid value of property '%s'", arg, name)
+			}
+			normalized[name] = octet
+			continue
+		}
+
+		return nil, fmt.Errorf("%s: unsupported property '%s'", arg, name)
+	}
+
+	return normalized, nil
+}
+
+func octetValue(value interface{}) (byte, bool) {
+	var number int64
+	switch value := value.(type) {
+	case int8:
+		number = int64(value)
+	case uint8:
+		number = int64(value)
+	case int16:
+		number = int64(value)
+	case uint16:
+		number = int64(value)
+	case int32:
+		number = int64(value)
+	case uint32:
+		number = int64(value)
+	case int64:
+		number = value
+	case int:
+		number = int64(value)
+	default:
+		return 0, false
+	}
+	if number < 0 || number > 255 {
+		return 0, false
+	}
+	return byte(number), true
+}
+
+// equalProperties returns are stamped properties of exchanges the same
+func (ex *Exchange) equalProperties(exB *Exchange) error {
+	setB, defaultsB := exB.GetProperties()
+	if !reflect.DeepEqual(ex.setProperties, setB) {
+		return fmt.Errorf("inequivalent arg '%s' for exchange '%s'", ArgSetProperties, ex.Name)
+	}
+	if !reflect.DeepEqual(ex.defaultProperties, defaultsB) {
+		return fmt.Errorf("inequivalent arg '%s' for exchange '%s'", ArgDefaultProperties, ex.Name)
+	}
+	return nil
+}
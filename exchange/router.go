@@ -0,0 +1,230 @@
+package exchange
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/binding"
+)
+
+// available exchange types
+const (
+	ExTypeDirect = iota + 1
+	ExTypeFanout
+	ExTypeTopic
+	ExTypeHeaders
+	// ExTypeProperty routes message to queues bound with key equal to value of message property
+	ExTypeProperty
+)
+
+// ids of registered exchange types start from customTypeFirstID, so they never clash with built-in ones
+const customTypeFirstID = 128
+
+// Router routes messages published into exchange by its bindings
+// Router is created for every exchange by factory of exchange type, so it may keep own index of bindings
+// Bind and Unbind are called under exclusive lock of exchange, GetMatchedQueues under shared one
+type Router interface {
+	// Bind is called after binding is added into exchange
+	Bind(bind *binding.Binding)
+	// Unbind is called after binding is removed from exchange
+	Unbind(bind *binding.Binding)
+	// GetMatchedQueues puts names of queues message is routed into matchedQueues
+	// bindings are all bindings of exchange by queue name and binding key, they must not be changed
+	GetMatchedQueues(message *amqp.Message, bindings map[string]map[string]*binding.Binding, matchedQueues map[string]bool)
+}
+
+// RouterFactory creates router of new exchange
+type RouterFactory func(ex *Exchange) Router
+
+var typesLock sync.RWMutex
+var nextCustomTypeID = customTypeFirstID
+
+var exchangeTypeIDAliasMap = map[byte]string{
+	ExTypeDirect:   "direct",
+	ExTypeFanout:   "fanout",
+	ExTypeTopic:    "topic",
+	ExTypeHeaders:  "headers",
+	ExTypeProperty: "x-property",
+}
+
+var exchangeTypeAliasIDMap = map[string]byte{
+	"direct":     ExTypeDirect,
+	"fanout":     ExTypeFanout,
+	"topic":      ExTypeTopic,
+	"headers":    ExTypeHeaders,
+	"x-property": ExTypeProperty,
+}
+
+var routerFactories = map[byte]RouterFactory{
+	ExTypeDirect:   func(ex *Exchange) Router { return &directRouter{} },
+	ExTypeFanout:   func(ex *Exchange) Router { return &fanoutRouter{} },
+	ExTypeTopic:    func(ex *Exchange) Router { return &topicRouter{index: binding.NewTopicTrie()} },
+	ExTypeHeaders:  func(ex *Exchange) Router { return &headersRouter{} },
+	ExTypeProperty: func(ex *Exchange) Router { return &propertyRouter{ex: ex} },
+}
+
+// Register adds exchange type declared by alias and returns its id
+// Types should be registered at startup before exchanges are declared or loaded from storage,
+// registering already registered custom type replaces its factory and keeps its id, built-in types can't be replaced
+func Register(alias string, factory RouterFactory) (byte, error) {
+	typesLock.Lock()
+	defer typesLock.Unlock()
+	if id, ok := exchangeTypeAliasIDMap[alias]; ok {
+		if id < customTypeFirstID {
+			return 0, fmt.Errorf("built-in exchange type '%s' can't be replaced", alias)
+		}
+		routerFactories[id] = factory
+		return id, nil
+	}
+	if nextCustomTypeID > 255 {
+		return 0, fmt.Errorf("too many exchange types registered, can't register '%s'", alias)
+	}
+
+	id := byte(nextCustomTypeID)
+	nextCustomTypeID++
+	exchangeTypeIDAliasMap[id] = alias
+	exchangeTypeAliasIDMap[alias] = id
+	routerFactories[id] = factory
+	return id, nil
+}
+
+// Types returns aliases of built-in and registered exchange types
+func Types() []string {
+	typesLock.RLock()
+	defer typesLock.RUnlock()
+	types := make([]string, 0, len(exchangeTypeAliasIDMap))
+	for alias := range exchangeTypeAliasIDMap {
+		types = append(types, alias)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// GetExchangeTypeAlias returns exchange type alias by id
+func GetExchangeTypeAlias(id byte) (alias string, err error) {
+	typesLock.RLock()
+	defer typesLock.RUnlock()
+	if alias, ok := exchangeTypeIDAliasMap[id]; ok {
+		return alias, nil
+	}
+	return "", fmt.Errorf("undefined exchange type '%d'", id)
+}
+
+// GetExchangeTypeID returns exchange type id by alias
+func GetExchangeTypeID(alias string) (id byte, err error) {
+	typesLock.RLock()
+	defer typesLock.RUnlock()
+	if id, ok := exchangeTypeAliasIDMap[alias]; ok {
+		return id, nil
+	}
+	return 0, fmt.Errorf("undefined exchange alias '%s'", alias)
+}
+
+// newRouter returns router of exchange type, exchange of undefined type routes nothing
+func newRouter(ex *Exchange) Router {
+	typesLock.RLock()
+	factory, ok := routerFactories[ex.exType]
+	typesLock.RUnlock()
+	if !ok {
+		return &headersRouter{}
+	}
+	return factory(ex)
+}
+
+// directRouter routes message to queues bound with key equal to routing key
+// message is routed by own routing key and each key from CC and BCC headers
+type directRouter struct {
+	// bindings by routing key and binding key
+	index map[string]map[string]*binding.Binding
+}
+
+func (router *directRouter) Bind(bind *binding.Binding) {
+	if router.index == nil {
+		router.index = make(map[string]map[string]*binding.Binding)
+	}
+	addIndexed(router.index, bind.RoutingKey, bind.GetKey(), bind)
+}
+
+func (router *directRouter) Unbind(bind *binding.Binding) {
+	removeIndexed(router.index, bind.RoutingKey, bind.GetKey())
+}
+
+func (router *directRouter) GetMatchedQueues(message *amqp.Message, bindings map[string]map[string]*binding.Binding, matchedQueues map[string]bool) {
+	for _, routingKey := range message.GetRoutingKeys() {
+		router.matchKey(message.Exchange, routingKey, matchedQueues)
+	}
+}
+
+func (router *directRouter) matchKey(exchange string, key string, matchedQueues map[string]bool) {
+	for _, bind := range router.index[key] {
+		if bind.MatchDirect(exchange, key) {
+			matchedQueues[bind.GetQueue()] = true
+		}
+	}
+}
+
+// fanoutRouter routes message to all bound queues
+type fanoutRouter struct{}
+
+func (router *fanoutRouter) Bind(bind *binding.Binding) {}
+
+func (router *fanoutRouter) Unbind(bind *binding.Binding) {}
+
+func (router *fanoutRouter) GetMatchedQueues(message *amqp.Message, bindings map[string]map[string]*binding.Binding, matchedQueues map[string]bool) {
+	for _, queueBindings := range bindings {
+		for _, bind := range queueBindings {
+			if bind.MatchFanout(message.Exchange) {
+				matchedQueues[bind.GetQueue()] = true
+			}
+		}
+	}
+}
+
+// topicRouter routes message to queues bound with pattern matched routing key
+type topicRouter struct {
+	index *binding.TopicTrie
+}
+
+func (router *topicRouter) Bind(bind *binding.Binding) {
+	router.index.Add(bind)
+}
+
+func (router *topicRouter) Unbind(bind *binding.Binding) {
+	router.index.Remove(bind)
+}
+
+func (router *topicRouter) GetMatchedQueues(message *amqp.Message, bindings map[string]map[string]*binding.Binding, matchedQueues map[string]bool) {
+	for _, routingKey := range message.GetRoutingKeys() {
+		router.index.Match(routingKey, func(bind *binding.Binding) {
+			if bind.GetExchange() == message.Exchange {
+				matchedQueues[bind.GetQueue()] = true
+			}
+		})
+	}
+}
+
+// headersRouter keeps bindings of headers exchange
+// TODO implement "headers" exchange
+type headersRouter struct{}
+
+func (router *headersRouter) Bind(bind *binding.Binding) {}
+
+func (router *headersRouter) Unbind(bind *binding.Binding) {}
+
+func (router *headersRouter) GetMatchedQueues(message *amqp.Message, bindings map[string]map[string]*binding.Binding, matchedQueues map[string]bool) {
+}
+
+// propertyRouter routes message to queues bound with key equal to value of routing property of exchange
+// CC and BCC headers are not used, message without property is not routed
+type propertyRouter struct {
+	directRouter
+	ex *Exchange
+}
+
+func (router *propertyRouter) GetMatchedQueues(message *amqp.Message, bindings map[string]map[string]*binding.Binding, matchedQueues map[string]bool) {
+	if value, ok := routingPropertyValue(message, router.ex.property); ok {
+		router.matchKey(message.Exchange, value, matchedQueues)
+	}
+}
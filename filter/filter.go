@@ -0,0 +1,288 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+/*
+Filter is a simple header selector used by consumers with x-filter argument
+
+Grammar:
+
+	expr      = and-expr { "OR" and-expr }
+	and-expr  = primary { "AND" primary }
+	primary   = "(" expr ")" | condition
+	condition = header ( "=" | "!=" ) value
+	header    = word
+	value     = word | "'" any chars except "'" "'"
+
+Words are sequences of any chars except whitespace, parentheses, quotes, '=' and '!'.
+AND and OR are case-insensitive, AND has higher priority than OR.
+Header values are compared as strings, numbers and booleans are formatted with fmt.
+Condition with '=' never matches missing header, condition with '!=' always does.
+
+Example: format = json AND (region = 'eu west' OR priority != 0)
+*/
+type Filter struct {
+	expr string
+	root node
+}
+
+// Parse parses filter expression
+func Parse(expr string) (*Filter, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return nil, errors.New("empty filter expression")
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.end() {
+		return nil, fmt.Errorf("unexpected '%s' at position %d", p.peek().value, p.peek().pos)
+	}
+
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// Match returns is message headers satisfy filter
+func (filter *Filter) Match(headers *amqp.Table) bool {
+	if headers == nil {
+		return filter.root.match(amqp.Table{})
+	}
+	return filter.root.match(*headers)
+}
+
+// String returns source filter expression
+func (filter *Filter) String() string {
+	return filter.expr
+}
+
+type node interface {
+	match(headers amqp.Table) bool
+}
+
+type orNode struct {
+	left, right node
+}
+
+func (n *orNode) match(headers amqp.Table) bool {
+	return n.left.match(headers) || n.right.match(headers)
+}
+
+type andNode struct {
+	left, right node
+}
+
+func (n *andNode) match(headers amqp.Table) bool {
+	return n.left.match(headers) && n.right.match(headers)
+}
+
+type condNode struct {
+	header string
+	value  string
+	equal  bool
+}
+
+func (n *condNode) match(headers amqp.Table) bool {
+	value, ok := headers[n.header]
+	if !ok {
+		return !n.equal
+	}
+
+	return (formatValue(value) == n.value) == n.equal
+}
+
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+const (
+	tokenWord = iota
+	tokenString
+	tokenLParen
+	tokenRParen
+	tokenEqual
+	tokenNotEqual
+)
+
+type token struct {
+	kind  int
+	value string
+	pos   int
+}
+
+func isWordChar(r rune) bool {
+	return !unicode.IsSpace(r) && !strings.ContainsRune("()'=!", r)
+}
+
+func tokenize(expr string) ([]token, error) {
+	var tokens []token
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokenLParen, "(", i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokenRParen, ")", i})
+			i++
+		case r == '=':
+			tokens = append(tokens, token{tokenEqual, "=", i})
+			i++
+		case r == '!':
+			if i+1 >= len(runes) || runes[i+1] != '=' {
+				return nil, fmt.Errorf("unexpected '!' at position %d", i)
+			}
+			tokens = append(tokens, token{tokenNotEqual, "!=", i})
+			i += 2
+		case r == '\'':
+			end := i + 1
+			for end < len(runes) && runes[end] != '\'' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			tokens = append(tokens, token{tokenString, string(runes[i+1 : end]), i})
+			i = end + 1
+		default:
+			end := i
+			for end < len(runes) && isWordChar(runes[end]) {
+				end++
+			}
+			tokens = append(tokens, token{tokenWord, string(runes[i:end]), i})
+			i = end
+		}
+	}
+
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) end() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() (token, error) {
+	if p.end() {
+		return token{}, errors.New("unexpected end of filter expression")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t, nil
+}
+
+func (p *parser) isKeyword(keyword string) bool {
+	return !p.end() && p.peek().kind == tokenWord && strings.EqualFold(p.peek().value, keyword)
+}
+
+func (p *parser) parseExpr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("OR") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("AND") {
+		p.pos++
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if t.kind == tokenLParen {
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		closing, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if closing.kind != tokenRParen {
+			return nil, fmt.Errorf("expected ')' at position %d", closing.pos)
+		}
+		return expr, nil
+	}
+
+	if t.kind != tokenWord || strings.EqualFold(t.value, "AND") || strings.EqualFold(t.value, "OR") {
+		return nil, fmt.Errorf("expected header name at position %d", t.pos)
+	}
+
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if op.kind != tokenEqual && op.kind != tokenNotEqual {
+		return nil, fmt.Errorf("expected '=' or '!=' at position %d", op.pos)
+	}
+
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if value.kind != tokenWord && value.kind != tokenString {
+		return nil, fmt.Errorf("expected value at position %d", value.pos)
+	}
+
+	return &condNode{header: t.value, value: value.value, equal: op.kind == tokenEqual}, nil
+}
@@ -0,0 +1,85 @@
+package filter_test
+
+import (
+	"testing"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/filter"
+)
+
+func TestParse_Failed(t *testing.T) {
+	exprs := []string{
+		"",
+		"   ",
+		"format",
+		"format =",
+		"= json",
+		"format = json AND",
+		"format = json OR OR region = eu",
+		"(format = json",
+		"format = json)",
+		"format ! json",
+		"format = 'json",
+		"AND = json",
+		"format = (json)",
+	}
+
+	for _, expr := range exprs {
+		if _, err := filter.Parse(expr); err == nil {
+			t.Fatalf("Expected error on parsing '%s'", expr)
+		}
+	}
+}
+
+func TestFilter_Match(t *testing.T) {
+	headers := &amqp.Table{
+		"format":   "json",
+		"region":   "eu west",
+		"priority": int32(5),
+		"bytes":    []byte("raw"),
+		"flag":     true,
+	}
+
+	cases := map[string]bool{
+		"format = json":                                    true,
+		"format = xml":                                     false,
+		"format != xml":                                    true,
+		"missing = json":                                   false,
+		"missing != json":                                  true,
+		"region = 'eu west'":                               true,
+		"priority = 5":                                     true,
+		"bytes = raw":                                      true,
+		"flag = true":                                      true,
+		"format = json AND priority = 5":                   true,
+		"format = json and priority = 4":                   false,
+		"format = xml OR priority = 5":                     true,
+		"format = xml or priority = 4":                     false,
+		"format = xml AND priority = 4 OR flag = true":     true,
+		"format = xml AND (priority = 4 OR flag = true)":   false,
+		"(format = json OR format = xml) AND bytes != raw": false,
+		"format=json AND region='eu west'":                 true,
+	}
+
+	for expr, expected := range cases {
+		f, err := filter.Parse(expr)
+		if err != nil {
+			t.Fatalf("Unexpected error on parsing '%s': %s", expr, err)
+		}
+
+		if f.Match(headers) != expected {
+			t.Fatalf("Expected match %t for '%s'", expected, expr)
+		}
+	}
+}
+
+func TestFilter_Match_NilHeaders(t *testing.T) {
+	f, _ := filter.Parse("format != json")
+	if !f.Match(nil) {
+		t.Fatal("Expected match on nil headers")
+	}
+
+	f, _ = filter.Parse("format = json")
+	if f.Match(nil) {
+		t.Fatal("Expected no match on nil headers")
+	}
+}
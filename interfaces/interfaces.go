@@ -53,4 +53,5 @@ type MsgStorage interface {
 	Update(message *amqp.Message, queue string) error
 	IterateByQueueFromMsgID(queue string, msgId uint64, limit uint64, fn func(message *amqp.Message)) uint64
 	GetQueueLength(queue string) uint64
+	Get(id uint64, queue string) (*amqp.Message, error)
 }
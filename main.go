@@ -37,6 +37,8 @@ func init() {
 	flag.Bool("hprof", false, "Starts server with hprof profiler.")
 	flag.String("hprof-host", "0.0.0.0", "hprof profiler host.")
 	flag.String("hprof-port", "8080", "hprof profiler port.")
+	flag.Bool("maintenance", false, "Starts server in maintenance mode, new connections and consumers are refused.")
+	flag.Bool("safe-mode", false, "Starts server in safe mode, queues which recovery fails are quarantined instead of aborting startup.")
 
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.Parse()
@@ -60,17 +62,37 @@ func main() {
 	} else {
 		cfg, _ = config.CreateDefault()
 	}
+	if cfg.LogLevel != "" {
+		level, err := logrus.ParseLevel(cfg.LogLevel)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		logrus.SetLevel(level)
+	}
 
 	if viper.GetBool("hprof") {
 		// for hprof debugging
 		go http.ListenAndServe(fmt.Sprintf("%s:%s", viper.GetString("hprof-host"), viper.GetString("hprof-port")), nil)
 	}
 
+	if viper.GetBool("safe-mode") {
+		cfg.Db.SafeMode = true
+	}
+
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	metrics.NewTrackRegistry(15, time.Second, false)
+	initQueueHistory(cfg.Metrics)
+	initTracer(cfg.Metrics)
 
-	srv := server.NewServer(cfg.TCP.IP, cfg.TCP.Port, cfg.Proto, cfg)
+	srv, err := server.NewServer(cfg.TCP.IP, cfg.TCP.Port, cfg.Proto, cfg)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	srv.SetConfigFile(viper.GetString("config"))
+	srv.SetMaintenance(viper.GetBool("maintenance"))
 	adminServer := admin.NewAdminServer(srv, cfg.Admin.IP, cfg.Admin.Port)
 
 	// Start admin server
@@ -80,6 +102,43 @@ func main() {
 	srv.Start()
 }
 
+func initQueueHistory(cfg config.Metrics) {
+	if cfg.QueueHistoryResolution <= 0 {
+		return
+	}
+
+	if cfg.QueueHistoryRetention < cfg.QueueHistoryResolution {
+		logrus.WithFields(logrus.Fields{
+			"resolution": cfg.QueueHistoryResolution,
+			"retention":  cfg.QueueHistoryRetention,
+		}).Warn("Queue history retention is less than resolution, history disabled")
+		return
+	}
+
+	metrics.NewHistoryRegistry(
+		cfg.QueueHistoryRetention/cfg.QueueHistoryResolution,
+		time.Duration(cfg.QueueHistoryResolution)*time.Second,
+		false,
+	)
+}
+
+func initTracer(cfg config.Metrics) {
+	if cfg.TraceSampleRate <= 0 {
+		return
+	}
+
+	metrics.NewTracer(
+		cfg.TraceSampleRate,
+		time.Duration(cfg.TraceSlowThreshold)*time.Millisecond,
+		func(stage string, duration time.Duration, fields map[string]interface{}) {
+			logrus.WithFields(fields).WithFields(logrus.Fields{
+				"stage":    stage,
+				"duration": duration,
+			}).Warn("Slow traced message")
+		},
+	)
+}
+
 func initLogger(lvl string, path string) {
 	level, err := logrus.ParseLevel(lvl)
 	if err != nil {
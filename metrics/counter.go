@@ -60,6 +60,34 @@ func (c *StandardCounter) Inc(i int64) {
 	atomic.AddInt64(&c.count, i)
 }
 
+// GaugeCounter implements Counter reporting value computed on demand, e.g. age of the oldest message
+// Clear, Dec and Inc are no-op
+type GaugeCounter struct {
+	fn func() int64
+}
+
+// NewGaugeCounter returns Nil or Gauge counter reporting value of fn
+func NewGaugeCounter(fn func() int64, isNil bool) Counter {
+	if isNil {
+		return NilCounter{}
+	}
+	return &GaugeCounter{fn: fn}
+}
+
+// Clear is a no-op.
+func (c *GaugeCounter) Clear() {}
+
+// Count returns current value of gauge
+func (c *GaugeCounter) Count() int64 {
+	return c.fn()
+}
+
+// Dec is a no-op.
+func (c *GaugeCounter) Dec(i int64) {}
+
+// Inc is a no-op.
+func (c *GaugeCounter) Inc(i int64) {}
+
 // TrackCounter implement counter with tracked values
 type TrackCounter struct {
 	Counter Counter
@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"sync/atomic"
+)
+
+// DefaultLatencyBuckets is a list of upper bounds in milliseconds used for latency histograms
+var DefaultLatencyBuckets = []int64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+// Histogram implements distribution of int64 values over buckets
+type Histogram interface {
+	Observe(int64)
+	Snapshot() *HistogramSnapshot
+}
+
+// HistogramBucket implements cumulative count of values less or equal than bound
+type HistogramBucket struct {
+	Le    int64 `json:"le"`
+	Count int64 `json:"count"`
+}
+
+// HistogramSnapshot implements histogram state at the moment
+// Count and Sum include values greater than the last bucket bound
+type HistogramSnapshot struct {
+	Buckets []*HistogramBucket `json:"buckets"`
+	Count   int64              `json:"count"`
+	Sum     int64              `json:"sum"`
+}
+
+// NilHistogram is a no-op Histogram.
+type NilHistogram struct{}
+
+// Observe is a no-op.
+func (NilHistogram) Observe(v int64) {}
+
+// Snapshot is a no-op.
+func (NilHistogram) Snapshot() *HistogramSnapshot { return &HistogramSnapshot{} }
+
+// StandardHistogram implements histogram with atomic ops
+type StandardHistogram struct {
+	bounds []int64
+	counts []int64
+	count  int64
+	sum    int64
+}
+
+// NewHistogram returns Nil or Standard histogram with bounds as buckets upper bounds
+func NewHistogram(bounds []int64, isNil bool) Histogram {
+	if isNil {
+		return NilHistogram{}
+	}
+	return &StandardHistogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)),
+	}
+}
+
+// Observe adds value into histogram
+func (h *StandardHistogram) Observe(v int64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			atomic.AddInt64(&h.counts[i], 1)
+			break
+		}
+	}
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sum, v)
+}
+
+// Snapshot returns current histogram state with cumulative buckets
+func (h *StandardHistogram) Snapshot() *HistogramSnapshot {
+	snapshot := &HistogramSnapshot{
+		Buckets: make([]*HistogramBucket, len(h.bounds)),
+		Count:   atomic.LoadInt64(&h.count),
+		Sum:     atomic.LoadInt64(&h.sum),
+	}
+
+	var cumulative int64
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadInt64(&h.counts[i])
+		snapshot.Buckets[i] = &HistogramBucket{Le: bound, Count: cumulative}
+	}
+
+	return snapshot
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"time"
+)
+
+var h *TrackRegistry
+var hResolution time.Duration
+
+// NewHistoryRegistry creates registry for long-term history of already existing counters
+// Each counter will be sampled every d duration and keep last trackLength samples
+func NewHistoryRegistry(trackLength int, d time.Duration, isNil bool) {
+	h = newTrackRegistry(trackLength, d, isNil)
+	hResolution = d
+}
+
+// DestroyHistory release current history registry
+func DestroyHistory() {
+	if h != nil {
+		h.trackTick.Stop()
+	}
+	h = nil
+}
+
+// HistoryResolution returns interval between history samples
+func HistoryResolution() time.Duration {
+	return hResolution
+}
+
+// AddHistory starts sampling counter into history and returns history track
+// Returns nil if history registry is not created
+func AddHistory(name string, counter Counter) *TrackBuffer {
+	if h == nil {
+		return nil
+	}
+
+	h.cntLock.Lock()
+	defer h.cntLock.Unlock()
+
+	c := &TrackCounter{
+		Counter: counter,
+		Track:   NewTrackBuffer(h.trackLength),
+	}
+	h.Counters[name] = c
+	return c.Track
+}
+
+// RemoveHistory stops sampling counter into history
+func RemoveHistory(name string) {
+	if h == nil {
+		return
+	}
+
+	h.cntLock.Lock()
+	defer h.cntLock.Unlock()
+	delete(h.Counters, name)
+}
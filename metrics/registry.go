@@ -11,6 +11,7 @@ var r *TrackRegistry
 type TrackRegistry struct {
 	cntLock     sync.Mutex
 	Counters    map[string]*TrackCounter
+	Histograms  map[string]Histogram
 	trackLength int
 	trackTick   *time.Ticker
 	isNil       bool
@@ -20,16 +21,22 @@ type TrackRegistry struct {
 // Each counter will be tracked every d duration
 // Each counter track length will be trackLength items
 func NewTrackRegistry(trackLength int, d time.Duration, isNil bool) {
-	r = &TrackRegistry{
+	r = newTrackRegistry(trackLength, d, isNil)
+}
+
+func newTrackRegistry(trackLength int, d time.Duration, isNil bool) *TrackRegistry {
+	registry := &TrackRegistry{
 		Counters:    make(map[string]*TrackCounter),
+		Histograms:  make(map[string]Histogram),
 		trackLength: trackLength,
 		trackTick:   time.NewTicker(d),
 		isNil:       isNil,
 	}
 	if !isNil {
-		go r.trackMetrics()
+		go registry.trackMetrics()
 	}
 
+	return registry
 }
 
 // Destroy release current registry
@@ -48,11 +55,61 @@ func AddCounter(name string) *TrackCounter {
 	return c
 }
 
+// AddGauge add gauge reporting value of fn into registry and return it
+func AddGauge(name string, fn func() int64) *TrackCounter {
+	r.cntLock.Lock()
+	defer r.cntLock.Unlock()
+
+	c := &TrackCounter{
+		Counter: NewGaugeCounter(fn, r.isNil),
+		Track:   NewTrackBuffer(r.trackLength),
+	}
+	r.Counters[name] = c
+	return c
+}
+
+// RemoveCounter removes counter or gauge from registry, so it is not tracked anymore
+func RemoveCounter(name string) {
+	if r == nil {
+		return
+	}
+
+	r.cntLock.Lock()
+	defer r.cntLock.Unlock()
+	delete(r.Counters, name)
+}
+
 // GetCounter returns counter by name
 func GetCounter(name string) *TrackCounter {
 	return r.Counters[name]
 }
 
+// AddHistogram add latency histogram into registry and return it
+func AddHistogram(name string) Histogram {
+	r.cntLock.Lock()
+	defer r.cntLock.Unlock()
+
+	h := NewHistogram(DefaultLatencyBuckets, r.isNil)
+	r.Histograms[name] = h
+	return h
+}
+
+// GetHistogram returns histogram by name
+func GetHistogram(name string) Histogram {
+	return r.Histograms[name]
+}
+
+// RemoveHistogram removes histogram from registry
+func RemoveHistogram(name string) {
+	if r == nil {
+		return
+	}
+
+	r.cntLock.Lock()
+	defer r.cntLock.Unlock()
+	delete(r.Histograms, name)
+}
+
 func (r *TrackRegistry) trackMetrics() {
 	for range r.trackTick.C {
 		r.cntLock.Lock()
@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stages of traced messages
+const (
+	// TraceRouting is time of matching message with exchange bindings
+	TraceRouting = "routing"
+	// TraceEnqueue is time of pushing routed message into matched queues
+	TraceEnqueue = "enqueue"
+	// TracePersist is time from message enqueue to its write into storage
+	TracePersist = "persist"
+	// TraceDelivery is time from message enqueue to its first delivery to consumer
+	TraceDelivery = "delivery"
+)
+
+// TraceStages is list of all stages of traced messages
+var TraceStages = []string{TraceRouting, TraceEnqueue, TracePersist, TraceDelivery}
+
+// TraceBuckets is a list of upper bounds in microseconds used for trace stage histograms
+var TraceBuckets = []int64{10, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 25000, 50000, 100000, 250000, 1000000, 5000000}
+
+// SlowTraceHandler is called for traced stage took longer than threshold
+type SlowTraceHandler func(stage string, duration time.Duration, fields map[string]interface{})
+
+// tr holds current *Tracer, nil one if tracing is disabled
+// It is replaced while messages are traced, so it is loaded atomically
+var tr atomic.Value
+
+// Tracer samples fraction of published messages and tracks time spent by them in each stage
+type Tracer struct {
+	rate      float64
+	threshold time.Duration
+	onSlow    SlowTraceHandler
+	stages    map[string]Histogram
+	randLock  sync.Mutex
+	rand      *rand.Rand
+}
+
+// NewTracer enables tracing of rate fraction of published messages
+// Stage took longer than threshold is passed to onSlow, zero threshold disables it
+func NewTracer(rate float64, threshold time.Duration, onSlow SlowTraceHandler) {
+	tracer := &Tracer{
+		rate:      rate,
+		threshold: threshold,
+		onSlow:    onSlow,
+		stages:    make(map[string]Histogram),
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, stage := range TraceStages {
+		tracer.stages[stage] = NewHistogram(TraceBuckets, false)
+	}
+	tr.Store(tracer)
+}
+
+// DestroyTracer disables tracing
+func DestroyTracer() {
+	tr.Store((*Tracer)(nil))
+}
+
+func getTracer() *Tracer {
+	tracer, _ := tr.Load().(*Tracer)
+	return tracer
+}
+
+// SampleTrace returns current time in unix nanoseconds if message should be traced, otherwise 0
+func SampleTrace() int64 {
+	tracer := getTracer()
+	if tracer == nil || tracer.rate <= 0 {
+		return 0
+	}
+	if tracer.rate < 1 {
+		tracer.randLock.Lock()
+		sampled := tracer.rand.Float64() < tracer.rate
+		tracer.randLock.Unlock()
+		if !sampled {
+			return 0
+		}
+	}
+	return time.Now().UnixNano()
+}
+
+// TraceStage tracks time of stage started at start unix nanoseconds and returns current time as start of next stage
+// Returns 0 and tracks nothing if start is 0, so message not sampled stays not traced
+func TraceStage(stage string, start int64, fields map[string]interface{}) int64 {
+	tracer := getTracer()
+	if tracer == nil || start == 0 {
+		return 0
+	}
+
+	now := time.Now().UnixNano()
+	duration := time.Duration(now - start)
+	if histogram, ok := tracer.stages[stage]; ok {
+		histogram.Observe(int64(duration / time.Microsecond))
+	}
+	if tracer.threshold > 0 && duration > tracer.threshold && tracer.onSlow != nil {
+		tracer.onSlow(stage, duration, fields)
+	}
+
+	return now
+}
+
+// TraceSnapshots returns histograms of traced stages in microseconds, nil if tracing is disabled
+func TraceSnapshots() map[string]*HistogramSnapshot {
+	tracer := getTracer()
+	if tracer == nil {
+		return nil
+	}
+
+	snapshots := make(map[string]*HistogramSnapshot, len(tracer.stages))
+	for stage, histogram := range tracer.stages {
+		snapshots[stage] = histogram.Snapshot()
+	}
+	return snapshots
+}
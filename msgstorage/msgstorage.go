@@ -1,19 +1,33 @@
 package msgstorage
 
 import (
+	"fmt"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/valinurovam/garagemq/amqp"
 	"github.com/valinurovam/garagemq/interfaces"
+	"github.com/valinurovam/garagemq/metrics"
 )
 
+// QueueStats represents number and size of messages of queue written into storage
+type QueueStats struct {
+	Messages int64 `json:"messages"`
+	Bytes    int64 `json:"bytes"`
+}
+
 // MsgStorage represents storage for store all durable messages
 // All operations (add, update and delete) store into little queues and
 // periodically persist every 20ms
 // If storage in confirm-mode - in every persisted message storage send confirm to vhost
+// Message is confirmed only after batch with it is written, and all pending operations are written on close,
+// so clean shutdown never loses confirmed message
 type MsgStorage struct {
 	db            interfaces.DbStorage
 	persistLock   sync.Mutex
@@ -21,10 +35,24 @@ type MsgStorage struct {
 	update        map[string]*amqp.Message
 	del           map[string]*amqp.Message
 	protoVersion  string
-	closeCh       chan bool
+	closeCh       chan struct{}
+	stoppedCh     chan struct{}
 	confirmSyncCh chan *amqp.Message
 	confirmMode   bool
 	writeCh       chan struct{}
+
+	// added messages of batch being written, so they could be read before batch is written
+	writing map[string]*amqp.Message
+
+	// stats are changed after batch is written, so pending operations are not counted
+	statsLock   sync.Mutex
+	stats       map[string]*QueueStats
+	usedBytes   int64
+	usedCounter metrics.Counter
+
+	// full is set while batches fail to be written because of no free disk space
+	full        int32
+	fullHandler func(full bool)
 }
 
 // NewMsgStorage returns new instance of message storage
@@ -32,10 +60,16 @@ func NewMsgStorage(db interfaces.DbStorage, protoVersion string) *MsgStorage {
 	msgStorage := &MsgStorage{
 		db:            db,
 		protoVersion:  protoVersion,
-		closeCh:       make(chan bool),
+		closeCh:       make(chan struct{}),
+		stoppedCh:     make(chan struct{}),
 		confirmSyncCh: make(chan *amqp.Message, 4096),
 		writeCh:       make(chan struct{}, 5),
+		stats:         make(map[string]*QueueStats),
+		usedCounter:   metrics.NilCounter{},
+		fullHandler:   func(full bool) {},
 	}
+	msgStorage.migrateKeys()
+	msgStorage.loadStats()
 	msgStorage.cleanPersistQueue()
 	go msgStorage.periodicPersist()
 	return msgStorage
@@ -48,28 +82,27 @@ func (storage *MsgStorage) cleanPersistQueue() {
 }
 
 // We try to persist messages every 20ms and every 1000msg
+// Loop is stopped by close, stoppedCh is closed after the last started persist is finished
 func (storage *MsgStorage) periodicPersist() {
 	tick := time.NewTicker(20 * time.Millisecond)
+	defer tick.Stop()
+	defer close(storage.stoppedCh)
 
-	go func() {
-		for range tick.C {
-			storage.writeCh <- struct{}{}
-		}
-	}()
-
-	for range storage.writeCh {
+	for {
 		select {
 		case <-storage.closeCh:
 			return
-		default:
+		case <-tick.C:
+			storage.persist()
+		case <-storage.writeCh:
 			storage.persist()
 		}
 	}
 }
 
-// no need to be thread safe
+// getQueueLen returns number of pending operations, should be called under persistLock
 func (storage *MsgStorage) getQueueLen() int {
-	return len(storage.add) + len(storage.add) + len(storage.add)
+	return len(storage.add) + len(storage.update) + len(storage.del)
 }
 
 func (storage *MsgStorage) persist() {
@@ -78,13 +111,14 @@ func (storage *MsgStorage) persist() {
 	del := storage.del
 	update := storage.update
 	storage.cleanPersistQueue()
-	storage.persistLock.Unlock()
 
 	rmDel := make([]string, 0)
+	var consumed []*amqp.Message
 	for delKey := range del {
-		if _, ok := add[delKey]; ok {
+		if message, ok := add[delKey]; ok {
 			delete(add, delKey)
 			rmDel = append(rmDel, delKey)
+			consumed = append(consumed, message)
 		}
 
 		delete(update, delKey)
@@ -93,6 +127,14 @@ func (storage *MsgStorage) persist() {
 	for _, delKey := range rmDel {
 		delete(del, delKey)
 	}
+	storage.writing = add
+	storage.persistLock.Unlock()
+
+	defer func() {
+		storage.persistLock.Lock()
+		storage.writing = nil
+		storage.persistLock.Unlock()
+	}()
 
 	batch := make([]*interfaces.Operation, 0, len(add)+len(update)+len(del))
 	for key, message := range add {
@@ -129,16 +171,125 @@ func (storage *MsgStorage) persist() {
 		)
 	}
 
+	// message deleted before it is written is already consumed, so it is confirmed without writing,
+	// even if the rest of batch is kept pending on full disk
+	for _, message := range consumed {
+		storage.confirm(message)
+	}
+
 	if err := storage.db.ProcessBatch(batch); err != nil {
-		panic(err)
+		if !isNoSpaceError(err) {
+			panic(err)
+		}
+		// batch is kept pending and retried on next persist until disk space is freed
+		storage.restorePersistQueue(add, update, del)
+		storage.setFull(true, err)
+		return
+	}
+	storage.setFull(false, nil)
+
+	// updated messages keep their size, only delivery count is changed
+	storage.statsLock.Lock()
+	for _, op := range batch[:len(add)] {
+		storage.changeStats(getQueueFromKey(op.Key), 1, int64(len(op.Value)))
+	}
+	for key, message := range del {
+		storage.changeStats(getQueueFromKey(key), -1, -int64(message.StoredSize(storage.protoVersion)))
+	}
+	storage.statsLock.Unlock()
+
+	for key, message := range add {
+		if message.TraceStart != 0 {
+			metrics.TraceStage(metrics.TracePersist, message.EnqueueTime, map[string]interface{}{"queue": getQueueFromKey(key)})
+		}
+		storage.confirm(message)
+	}
+}
+
+// confirm sends message into confirm channel when storage confirms of all its durable queues are added
+func (storage *MsgStorage) confirm(message *amqp.Message) {
+	if message.ConfirmMeta != nil && storage.confirmMode && message.ConfirmMeta.DeliveryTag > 0 && message.ConfirmMeta.AddConfirms(1) {
+		storage.confirmSyncCh <- message
+	}
+}
+
+// flush writes pending operations until there is nothing left
+// Operations are kept not written if storage is full, they are lost then
+func (storage *MsgStorage) flush() {
+	for {
+		storage.persistLock.Lock()
+		pending := storage.getQueueLen()
+		storage.persistLock.Unlock()
+		if pending == 0 {
+			return
+		}
+
+		storage.persist()
+		if storage.IsFull() {
+			log.WithField("operations", pending).Error("Pending operations are not written on close, no space left on device")
+			return
+		}
 	}
+}
 
-	for _, message := range add {
-		if message.ConfirmMeta != nil && storage.confirmMode && message.ConfirmMeta.DeliveryTag > 0 {
-			message.ConfirmMeta.ActualConfirms++
-			storage.confirmSyncCh <- message
+// restorePersistQueue returns operations of not written batch into queues
+// Operations added after batch was taken are newer, so they are kept as is
+func (storage *MsgStorage) restorePersistQueue(add map[string]*amqp.Message, update map[string]*amqp.Message, del map[string]*amqp.Message) {
+	storage.persistLock.Lock()
+	defer storage.persistLock.Unlock()
+	for key, message := range add {
+		if _, ok := storage.add[key]; !ok {
+			storage.add[key] = message
 		}
 	}
+	for key, message := range update {
+		if _, ok := storage.update[key]; !ok {
+			storage.update[key] = message
+		}
+	}
+	for key, message := range del {
+		storage.del[key] = message
+	}
+}
+
+// setFull changes storage full state and calls handler if state is changed
+func (storage *MsgStorage) setFull(full bool, err error) {
+	var value int32
+	if full {
+		value = 1
+	}
+	if atomic.SwapInt32(&storage.full, value) == value {
+		return
+	}
+	if full {
+		log.WithError(err).Error("No space left on device, messages are kept in memory until disk space is freed")
+	} else {
+		log.Info("Message storage writes are resumed")
+	}
+	storage.fullHandler(full)
+}
+
+// IsFull returns true while storage fails to write messages because of no free disk space
+func (storage *MsgStorage) IsFull() bool {
+	return atomic.LoadInt32(&storage.full) == 1
+}
+
+// SetFullHandler sets func called when storage becomes full and when writes are resumed
+// Handler is called from storage persist goroutine and should not block
+func (storage *MsgStorage) SetFullHandler(fn func(full bool)) {
+	storage.fullHandler = fn
+}
+
+// isNoSpaceError returns true if error is caused by no free disk space
+// Storage engines do not always wrap os errors, so error text is checked too
+func isNoSpaceError(err error) bool {
+	switch osErr := err.(type) {
+	case *os.PathError:
+		err = osErr.Err
+	case *os.SyscallError:
+		err = osErr.Err
+	}
+	return err == syscall.ENOSPC || strings.Contains(err.Error(), syscall.ENOSPC.Error())
 }
 
 // ReceiveConfirms set message storage in confirm mode and return channel for receive confirms
@@ -149,14 +300,17 @@ func (storage *MsgStorage) ReceiveConfirms() chan *amqp.Message {
 
 // Add append message into add-queue
 func (storage *MsgStorage) Add(message *amqp.Message, queue string) error {
-	if storage.getQueueLen() > 1000 {
-		storage.writeCh <- struct{}{}
-	}
-
 	storage.persistLock.Lock()
-	defer storage.persistLock.Unlock()
-
 	storage.add[makeKey(message.ID, queue)] = message
+	pending := storage.getQueueLen()
+	storage.persistLock.Unlock()
+
+	if pending > 1000 {
+		select {
+		case storage.writeCh <- struct{}{}:
+		default:
+		}
+	}
 	return nil
 }
 
@@ -176,14 +330,67 @@ func (storage *MsgStorage) Del(message *amqp.Message, queue string) error {
 	return nil
 }
 
+// Get returns message of queue by its id, messages not written yet are returned too
+func (storage *MsgStorage) Get(id uint64, queue string) (*amqp.Message, error) {
+	key := makeKey(id, queue)
+
+	storage.persistLock.Lock()
+	for _, pending := range []map[string]*amqp.Message{storage.update, storage.add, storage.writing} {
+		if message, ok := pending[key]; ok {
+			storage.persistLock.Unlock()
+			return message, nil
+		}
+	}
+	storage.persistLock.Unlock()
+
+	value, err := storage.db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(value) == 0 {
+		return nil, fmt.Errorf("message %s not found", key)
+	}
+	message, ok := storage.unmarshal([]byte(key), value)
+	if !ok {
+		return nil, fmt.Errorf("message %s could not be read", key)
+	}
+	return message, nil
+}
+
+// unmarshal decodes stored message
+// Corrupted message is logged and deleted from storage instead of being delivered,
+// message of unknown newer format is skipped, message of older format is rewritten in current one
+func (storage *MsgStorage) unmarshal(key []byte, value []byte) (*amqp.Message, bool) {
+	message := &amqp.Message{}
+	err := message.Unmarshal(value, storage.protoVersion)
+	if err == amqp.ErrMessageFormat {
+		log.WithError(err).WithField("key", string(key)).Error("Error on unmarshal stored message, message skipped")
+		return nil, false
+	}
+
+	storage.persistLock.Lock()
+	defer storage.persistLock.Unlock()
+	if err != nil {
+		log.WithError(err).WithField("key", string(key)).Error("Error on unmarshal stored message, message dropped")
+		storage.del[string(key)] = message
+		return nil, false
+	}
+	if amqp.StoredMessageVersion(value) < amqp.MessageFormatVersion {
+		storage.update[string(key)] = message
+	}
+
+	return message, true
+}
+
 // Iterate with func fn over messages
 func (storage *MsgStorage) Iterate(fn func(queue string, message *amqp.Message)) {
 	storage.db.Iterate(
 		func(key []byte, value []byte) {
-			queueName := getQueueFromKey(string(key))
-			message := &amqp.Message{}
-			message.Unmarshal(value, storage.protoVersion)
-			fn(queueName, message)
+			message, ok := storage.unmarshal(key, value)
+			if !ok {
+				return
+			}
+			fn(getQueueFromKey(string(key)), message)
 		},
 	)
 }
@@ -195,8 +402,10 @@ func (storage *MsgStorage) IterateByQueue(queue string, limit uint64, fn func(me
 		[]byte(prefix),
 		limit,
 		func(key []byte, value []byte) {
-			message := &amqp.Message{}
-			message.Unmarshal(value, storage.protoVersion)
+			message, ok := storage.unmarshal(key, value)
+			if !ok {
+				return
+			}
 			fn(message)
 		},
 	)
@@ -211,8 +420,10 @@ func (storage *MsgStorage) IterateByQueueFromMsgID(queue string, msgId uint64, l
 		[]byte(from),
 		limit,
 		func(key []byte, value []byte) {
-			message := &amqp.Message{}
-			message.Unmarshal(value, storage.protoVersion)
+			message, ok := storage.unmarshal(key, value)
+			if !ok {
+				return
+			}
 			fn(message)
 		},
 	)
@@ -227,21 +438,124 @@ func (storage *MsgStorage) GetQueueLength(queue string) uint64 {
 func (storage *MsgStorage) PurgeQueue(queue string) {
 	prefix := []byte("msg." + queue + ".")
 	storage.db.DeleteByPrefix(prefix)
+
+	storage.statsLock.Lock()
+	defer storage.statsLock.Unlock()
+	if stats, ok := storage.stats[queue]; ok {
+		storage.changeStats(queue, -stats.Messages, -stats.Bytes)
+	}
+}
+
+// loadStats counts messages already written into storage
+func (storage *MsgStorage) loadStats() {
+	storage.db.Iterate(
+		func(key []byte, value []byte) {
+			storage.changeStats(getQueueFromKey(string(key)), 1, int64(len(value)))
+		},
+	)
+}
+
+// changeStats adds delta to queue stats, should be called under statsLock except on load
+func (storage *MsgStorage) changeStats(queue string, messages int64, bytes int64) {
+	stats, ok := storage.stats[queue]
+	if !ok {
+		stats = &QueueStats{}
+		storage.stats[queue] = stats
+	}
+	stats.Messages += messages
+	stats.Bytes += bytes
+	storage.usedBytes += bytes
+	storage.usedCounter.Inc(bytes)
+
+	if stats.Messages <= 0 {
+		storage.usedBytes -= stats.Bytes
+		storage.usedCounter.Dec(stats.Bytes)
+		delete(storage.stats, queue)
+	}
+}
+
+// GetQueueStats returns number and size of messages of queue written into storage
+func (storage *MsgStorage) GetQueueStats(queue string) QueueStats {
+	storage.statsLock.Lock()
+	defer storage.statsLock.Unlock()
+	if stats, ok := storage.stats[queue]; ok {
+		return *stats
+	}
+	return QueueStats{}
+}
+
+// UsedBytes returns size of all messages written into storage
+func (storage *MsgStorage) UsedBytes() int64 {
+	storage.statsLock.Lock()
+	defer storage.statsLock.Unlock()
+	return storage.usedBytes
+}
+
+// SetUsedCounter sets counter tracking size of all messages written into storage
+func (storage *MsgStorage) SetUsedCounter(counter metrics.Counter) {
+	storage.statsLock.Lock()
+	defer storage.statsLock.Unlock()
+	counter.Inc(storage.usedBytes)
+	storage.usedCounter = counter
 }
 
 // Close properly "stop" message storage
+// Periodic persist is stopped first, then all pending operations are written and database is closed
 func (storage *MsgStorage) Close() error {
-	storage.closeCh <- true
+	close(storage.closeCh)
+	<-storage.stoppedCh
+	storage.flush()
+
 	storage.persistLock.Lock()
 	defer storage.persistLock.Unlock()
 	return storage.db.Close()
 }
 
+// keyIDWidth is width of zero padded message id of key, so keys of queue are ordered by id
+// uint64 takes up to 20 decimal digits
+const keyIDWidth = 20
+
 func makeKey(id uint64, queue string) string {
-	return "msg." + queue + "." + strconv.FormatInt(int64(id), 10)
+	return fmt.Sprintf("msg.%s.%0*d", queue, keyIDWidth, id)
+}
+
+// migrateKeys rewrites keys of older versions with id of variable width, e.g. msg.q.10 was iterated before msg.q.9
+// Migration is done once on start before messages are loaded, keys of current format are not changed
+func (storage *MsgStorage) migrateKeys() {
+	var batch []*interfaces.Operation
+	storage.db.Iterate(
+		func(key []byte, value []byte) {
+			oldKey := string(key)
+			idx := strings.LastIndex(oldKey, ".")
+			if idx < 0 || len(oldKey)-idx-1 == keyIDWidth {
+				return
+			}
+			id, err := strconv.ParseUint(oldKey[idx+1:], 10, 64)
+			if err != nil {
+				return
+			}
+			batch = append(
+				batch,
+				&interfaces.Operation{Key: makeKey(id, getQueueFromKey(oldKey)), Value: value, Op: interfaces.OpSet},
+				&interfaces.Operation{Key: oldKey, Op: interfaces.OpDel},
+			)
+		},
+	)
+	if len(batch) == 0 {
+		return
+	}
+
+	if err := storage.db.ProcessBatch(batch); err != nil {
+		panic(err)
+	}
+	log.WithField("messages", len(batch)/2).Info("Message keys migrated")
 }
 
+// getQueueFromKey returns queue name of message key, queue name may contain dots
 func getQueueFromKey(key string) string {
-	parts := strings.Split(key, ".")
-	return parts[1]
+	key = strings.TrimPrefix(key, "msg.")
+	if idx := strings.LastIndex(key, "."); idx >= 0 {
+		return key[:idx]
+	}
+	return key
 }
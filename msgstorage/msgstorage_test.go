@@ -0,0 +1,312 @@
+package msgstorage
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/interfaces"
+)
+
+// fullDb is in-memory storage failing batches while it is full
+type fullDb struct {
+	lock sync.Mutex
+	full bool
+	data map[string][]byte
+}
+
+func (db *fullDb) setFull(full bool) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.full = full
+}
+
+func (db *fullDb) get(key string) ([]byte, bool) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	value, ok := db.data[key]
+	return value, ok
+}
+
+func (db *fullDb) ProcessBatch(batch []*interfaces.Operation) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.full {
+		return &os.PathError{Op: "write", Path: "db", Err: syscall.ENOSPC}
+	}
+	for _, op := range batch {
+		if op.Op == interfaces.OpSet {
+			db.data[op.Key] = op.Value
+		} else {
+			delete(db.data, op.Key)
+		}
+	}
+	return nil
+}
+
+func (db *fullDb) Set(key string, value []byte) error { return nil }
+func (db *fullDb) Del(key string) error               { return nil }
+func (db *fullDb) Iterate(fn func(key []byte, value []byte)) {
+	for key, value := range db.data {
+		fn([]byte(key), value)
+	}
+}
+func (db *fullDb) IterateByPrefix(prefix []byte, limit uint64, fn func(key []byte, value []byte)) uint64 {
+	return 0
+}
+func (db *fullDb) IterateByPrefixFrom(prefix []byte, from []byte, limit uint64, fn func(key []byte, value []byte)) uint64 {
+	return 0
+}
+func (db *fullDb) DeleteByPrefix(prefix []byte)           {}
+func (db *fullDb) KeysByPrefixCount(prefix []byte) uint64 { return 0 }
+func (db *fullDb) Close() error                           { return nil }
+
+func (db *fullDb) Get(key string) ([]byte, error) {
+	value, _ := db.get(key)
+	return value, nil
+}
+
+func TestMsgStorage_NoSpace_Retry(t *testing.T) {
+	db := &fullDb{data: make(map[string][]byte), full: true}
+	storage := NewMsgStorage(db, amqp.ProtoRabbit)
+	states := make(chan bool, 2)
+	storage.SetFullHandler(func(full bool) {
+		states <- full
+	})
+
+	message := &amqp.Message{
+		ID:     1,
+		Header: &amqp.ContentHeader{PropertyList: &amqp.BasicPropertyList{}},
+	}
+	deleted := &amqp.Message{
+		ID:     2,
+		Header: &amqp.ContentHeader{PropertyList: &amqp.BasicPropertyList{}},
+	}
+	storage.Add(message, "test")
+	storage.Add(deleted, "test")
+
+	select {
+	case full := <-states:
+		if !full || !storage.IsFull() {
+			t.Fatal("Expected storage is full")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected full handler called")
+	}
+
+	// message deleted while disk is full is never written
+	storage.Del(deleted, "test")
+	db.setFull(false)
+
+	select {
+	case full := <-states:
+		if full || storage.IsFull() {
+			t.Fatal("Expected storage writes resumed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected full handler called")
+	}
+
+	if _, ok := db.get(makeKey(message.ID, "test")); !ok {
+		t.Fatal("Expected message written after disk space is freed")
+	}
+	if _, ok := db.get(makeKey(deleted.ID, "test")); ok {
+		t.Fatal("Expected deleted message is not written")
+	}
+	if stats := storage.GetQueueStats("test"); stats.Messages != 1 {
+		t.Fatalf("Expected 1 message in stats, actual %d", stats.Messages)
+	}
+}
+
+func TestMsgStorage_NoSpace_ConfirmConsumed(t *testing.T) {
+	db := &fullDb{data: make(map[string][]byte), full: true}
+	storage := NewMsgStorage(db, amqp.ProtoRabbit)
+	confirms := storage.ReceiveConfirms()
+	states := make(chan bool, 2)
+	storage.SetFullHandler(func(full bool) {
+		states <- full
+	})
+
+	message := &amqp.Message{
+		ID:          1,
+		Header:      &amqp.ContentHeader{PropertyList: &amqp.BasicPropertyList{}},
+		ConfirmMeta: &amqp.ConfirmMeta{DeliveryTag: 1, ExpectedConfirms: 1},
+	}
+	storage.Add(message, "test")
+
+	select {
+	case full := <-states:
+		if !full {
+			t.Fatal("Expected storage is full")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected full handler called")
+	}
+
+	// message consumed while disk is full is confirmed without waiting for free space
+	storage.Del(message, "test")
+
+	select {
+	case confirmed := <-confirms:
+		if confirmed != message {
+			t.Fatal("Expected consumed message confirmed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected consumed message confirmed while storage is full")
+	}
+	if !storage.IsFull() {
+		t.Fatal("Expected storage is still full")
+	}
+}
+
+func TestMsgStorage_Get(t *testing.T) {
+	db := &fullDb{data: make(map[string][]byte), full: true}
+	storage := NewMsgStorage(db, amqp.ProtoRabbit)
+	written := make(chan bool, 2)
+	storage.SetFullHandler(func(full bool) {
+		written <- !full
+	})
+
+	message := &amqp.Message{
+		ID:       1,
+		Header:   &amqp.ContentHeader{BodySize: 4, PropertyList: &amqp.BasicPropertyList{}},
+		BodySize: 4,
+		Body:     []*amqp.Frame{{Type: byte(amqp.FrameBody), Payload: []byte("test")}},
+	}
+	storage.Add(message, "test")
+
+	// message waiting to be written is returned as is
+	if found, err := storage.Get(message.ID, "test"); err != nil || found != message {
+		t.Fatalf("Expected pending message, actual %v, error %v", found, err)
+	}
+
+	<-written
+	db.setFull(false)
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("Expected message written")
+	}
+
+	found, err := storage.Get(message.ID, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.ID != message.ID || len(found.Body) != 1 || string(found.Body[0].Payload) != "test" {
+		t.Fatal("Expected message read with body")
+	}
+
+	if _, err := storage.Get(2, "test"); err == nil {
+		t.Fatal("Expected error on missing message")
+	}
+}
+
+// slowDb is in-memory storage blocking the first batch until it is released
+type slowDb struct {
+	*fullDb
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (db *slowDb) ProcessBatch(batch []*interfaces.Operation) error {
+	db.once.Do(func() {
+		close(db.started)
+		<-db.release
+	})
+	return db.fullDb.ProcessBatch(batch)
+}
+
+func TestMsgStorage_Close_FlushPending(t *testing.T) {
+	db := &slowDb{
+		fullDb:  &fullDb{data: make(map[string][]byte)},
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	storage := NewMsgStorage(db, amqp.ProtoRabbit)
+	confirms := storage.ReceiveConfirms()
+
+	newMessage := func(id uint64) *amqp.Message {
+		return &amqp.Message{
+			ID:          id,
+			Header:      &amqp.ContentHeader{PropertyList: &amqp.BasicPropertyList{}},
+			ConfirmMeta: &amqp.ConfirmMeta{DeliveryTag: id, ExpectedConfirms: 1},
+		}
+	}
+
+	storage.Add(newMessage(1), "test")
+	<-db.started
+
+	// shutdown happens while the first batch is being written and the next operations are pending
+	pending := []*amqp.Message{newMessage(2), newMessage(3)}
+	for _, message := range pending {
+		storage.Add(message, "test")
+	}
+	consumed := newMessage(4)
+	storage.Add(consumed, "test")
+	storage.Del(consumed, "test")
+
+	closed := make(chan error)
+	go func() {
+		closed <- storage.Close()
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Expected close waits for batch being written")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(db.release)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected storage closed")
+	}
+
+	for id := uint64(1); id <= 3; id++ {
+		if _, ok := db.get(makeKey(id, "test")); !ok {
+			t.Fatalf("Expected message %d written on close", id)
+		}
+	}
+	if _, ok := db.get(makeKey(consumed.ID, "test")); ok {
+		t.Fatal("Expected consumed message is not written")
+	}
+
+	// every message is confirmed, written ones only after they are written
+	confirmed := make(map[uint64]bool)
+	for len(confirms) > 0 {
+		confirmed[(<-confirms).ConfirmMeta.DeliveryTag] = true
+	}
+	if len(confirmed) != 4 {
+		t.Fatalf("Expected %d confirms, actual %v", 4, confirmed)
+	}
+}
+
+func TestMsgStorage_MigrateKeys(t *testing.T) {
+	db := &fullDb{data: map[string][]byte{
+		"msg.test.9":   []byte("9"),
+		"msg.test.10":  []byte("10"),
+		"msg.te.st.11": []byte("11"),
+	}}
+	db.data[makeKey(12, "test")] = []byte("12")
+	storage := NewMsgStorage(db, amqp.ProtoRabbit)
+	defer storage.Close()
+
+	if len(db.data) != 4 {
+		t.Fatalf("Expected %d keys after migration, actual %d", 4, len(db.data))
+	}
+	for id, queue := range map[uint64]string{9: "test", 10: "test", 11: "te.st", 12: "test"} {
+		if value, ok := db.get(makeKey(id, queue)); !ok || string(value) != strconv.FormatUint(id, 10) {
+			t.Fatalf("Expected message %d of queue %s migrated", id, queue)
+		}
+	}
+	if makeKey(9, "test") > makeKey(10, "test") {
+		t.Fatal("Expected keys ordered by id")
+	}
+}
@@ -0,0 +1,195 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// v1 header is a text line not longer than 107 bytes including CRLF
+const v1MaxLength = 107
+
+var v1Prefix = []byte("PROXY")
+var v2Signature = []byte{'\r', '\n', '\r', '\n', 0, '\r', '\n', 'Q', 'U', 'I', 'T', '\n'}
+
+// Conn implements PROXY protocol v1 and v2 header parsing on accepted connection
+// Header is read on first Read, after that RemoteAddr returns source address given by proxy
+// Connection without valid header fails on first Read
+type Conn struct {
+	net.Conn
+	timeout    time.Duration
+	once       sync.Once
+	err        error
+	lock       sync.RWMutex
+	remoteAddr net.Addr
+}
+
+// NewConn returns new instance of Conn, header should be received in timeout
+func NewConn(conn net.Conn, timeout time.Duration) *Conn {
+	return &Conn{
+		Conn:    conn,
+		timeout: timeout,
+	}
+}
+
+// Read reads header on first call and then data from underlying connection
+func (conn *Conn) Read(b []byte) (int, error) {
+	conn.once.Do(conn.readHeader)
+	if conn.err != nil {
+		return 0, conn.err
+	}
+	return conn.Conn.Read(b)
+}
+
+// RemoteAddr returns source address from header or address of underlying connection
+// if header is not read yet or proxy did not send source address
+func (conn *Conn) RemoteAddr() net.Addr {
+	conn.lock.RLock()
+	defer conn.lock.RUnlock()
+	if conn.remoteAddr != nil {
+		return conn.remoteAddr
+	}
+	return conn.Conn.RemoteAddr()
+}
+
+// NetConn returns underlying connection
+func (conn *Conn) NetConn() net.Conn {
+	return conn.Conn
+}
+
+func (conn *Conn) readHeader() {
+	if conn.timeout > 0 {
+		conn.Conn.SetReadDeadline(time.Now().Add(conn.timeout))
+		defer conn.Conn.SetReadDeadline(time.Time{})
+	}
+
+	addr, err := ReadHeader(conn.Conn)
+	if err != nil {
+		conn.err = fmt.Errorf("proxy protocol: %s", err)
+		return
+	}
+
+	conn.lock.Lock()
+	conn.remoteAddr = addr
+	conn.lock.Unlock()
+}
+
+// ReadHeader reads PROXY protocol header of v1 or v2 from reader and returns source address
+// Nil address is returned for UNKNOWN (v1) and LOCAL or not TCP (v2) headers
+// Reader is never read after the end of header
+func ReadHeader(reader io.Reader) (net.Addr, error) {
+	prefix := make([]byte, len(v1Prefix))
+	if _, err := io.ReadFull(reader, prefix); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.Equal(prefix, v1Prefix):
+		return readV1(reader)
+	case bytes.Equal(prefix, v2Signature[:len(prefix)]):
+		return readV2(reader)
+	}
+
+	return nil, errors.New("header not found")
+}
+
+func readV1(reader io.Reader) (net.Addr, error) {
+	line := make([]byte, 0, v1MaxLength)
+	line = append(line, v1Prefix...)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == v1MaxLength {
+			return nil, errors.New("v1 header is too long")
+		}
+		if _, err := io.ReadFull(reader, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header '%s'", line[:len(line)-2])
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid v1 source address '%s'", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source port '%s'", fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readV2(reader io.Reader) (net.Addr, error) {
+	// rest of signature, version with command, family with protocol and length of addresses
+	header := make([]byte, len(v2Signature)-len(v1Prefix)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(v2Signature)-len(v1Prefix)], v2Signature[len(v1Prefix):]) {
+		return nil, errors.New("header not found")
+	}
+
+	verCmd := header[len(header)-4]
+	family := header[len(header)-3]
+	length := binary.BigEndian.Uint16(header[len(header)-2:])
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", verCmd>>4)
+	}
+
+	addresses := make([]byte, length)
+	if _, err := io.ReadFull(reader, addresses); err != nil {
+		return nil, err
+	}
+
+	const (
+		cmdLocal = 0
+		cmdProxy = 1
+		tcp4     = 0x11
+		tcp6     = 0x21
+	)
+
+	switch verCmd & 0x0F {
+	case cmdLocal:
+		return nil, nil
+	case cmdProxy:
+	default:
+		return nil, fmt.Errorf("unsupported command %d", verCmd&0x0F)
+	}
+
+	// addresses block is source address, destination address, source port, destination port
+	var ipLen int
+	switch family {
+	case tcp4:
+		ipLen = net.IPv4len
+	case tcp6:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil
+	}
+
+	if len(addresses) < 2*ipLen+4 {
+		return nil, errors.New("v2 addresses are too short")
+	}
+
+	ip := make(net.IP, ipLen)
+	copy(ip, addresses[:ipLen])
+	port := binary.BigEndian.Uint16(addresses[2*ipLen:])
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,136 @@
+package proxyproto_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/valinurovam/garagemq/proxyproto"
+)
+
+var v2Signature = []byte{'\r', '\n', '\r', '\n', 0, '\r', '\n', 'Q', 'U', 'I', 'T', '\n'}
+
+func v2Header(verCmd byte, family byte, addresses []byte) []byte {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, verCmd, family)
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(addresses)))
+	header = append(header, length...)
+	return append(header, addresses...)
+}
+
+func TestReadHeader_V1(t *testing.T) {
+	cases := map[string]string{
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 5672\r\n": "192.168.0.1:56324",
+		"PROXY TCP6 2001:db8::1 2001:db8::2 56324 5672\r\n":  "[2001:db8::1]:56324",
+		"PROXY UNKNOWN\r\n": "",
+		"PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n": "",
+	}
+
+	for header, expected := range cases {
+		reader := bytes.NewReader(append([]byte(header), "AMQP"...))
+		addr, err := proxyproto.ReadHeader(reader)
+		if err != nil {
+			t.Fatalf("Unexpected error on header '%q': %s", header, err)
+		}
+		if addr == nil && expected != "" || addr != nil && addr.String() != expected {
+			t.Fatalf("Expected address '%s' for header '%q', actual '%v'", expected, header, addr)
+		}
+		if rest, _ := ioutil.ReadAll(reader); string(rest) != "AMQP" {
+			t.Fatalf("Expected data after header untouched for header '%q'", header)
+		}
+	}
+}
+
+func TestReadHeader_V2(t *testing.T) {
+	tcp4 := []byte{10, 0, 0, 1, 10, 0, 0, 2, 0xDC, 0x04, 0x16, 0x28}
+	tcp6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xDC, 0x04, 0x16, 0x28)
+
+	cases := []struct {
+		header   []byte
+		expected string
+	}{
+		{v2Header(0x21, 0x11, tcp4), "10.0.0.1:56324"},
+		{v2Header(0x21, 0x21, tcp6), "[2001:db8::1]:56324"},
+		// TLVs after addresses are skipped
+		{v2Header(0x21, 0x11, append(tcp4, 0x04, 0x00, 0x01, 0x00)), "10.0.0.1:56324"},
+		{v2Header(0x20, 0x00, nil), ""},
+		{v2Header(0x21, 0x00, nil), ""},
+	}
+
+	for i, c := range cases {
+		reader := bytes.NewReader(append(c.header, "AMQP"...))
+		addr, err := proxyproto.ReadHeader(reader)
+		if err != nil {
+			t.Fatalf("Unexpected error on case %d: %s", i, err)
+		}
+		if addr == nil && c.expected != "" || addr != nil && addr.String() != c.expected {
+			t.Fatalf("Expected address '%s' on case %d, actual '%v'", c.expected, i, addr)
+		}
+		if rest, _ := ioutil.ReadAll(reader); string(rest) != "AMQP" {
+			t.Fatalf("Expected data after header untouched on case %d", i)
+		}
+	}
+}
+
+func TestReadHeader_Failed(t *testing.T) {
+	headers := [][]byte{
+		[]byte("AMQP\x00\x00\x09\x01"),
+		[]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n"),
+		[]byte("PROXY TCP4 2001:db8::1 192.168.0.11 56324 5672\r\n"),
+		[]byte("PROXY TCP4 192.168.0.1 192.168.0.11 port 5672\r\n"),
+		[]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 5672"),
+		append([]byte("PROXY "), bytes.Repeat([]byte("A"), 120)...),
+		v2Header(0x11, 0x11, make([]byte, 12)),
+		v2Header(0x22, 0x11, make([]byte, 12)),
+		v2Header(0x21, 0x11, make([]byte, 4)),
+	}
+
+	for i, header := range headers {
+		if _, err := proxyproto.ReadHeader(bytes.NewReader(header)); err == nil {
+			t.Fatalf("Expected error on case %d", i)
+		}
+	}
+}
+
+func TestConn(t *testing.T) {
+	client, server := net.Pipe()
+	conn := proxyproto.NewConn(server, time.Second)
+
+	go func() {
+		client.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 5672\r\nAMQP"))
+	}()
+
+	buf := make([]byte, 4)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "AMQP" {
+		t.Fatalf("Expected data after header, actual '%s'", buf)
+	}
+	if conn.RemoteAddr().String() != "192.168.0.1:56324" {
+		t.Fatalf("Expected remote address from header, actual '%s'", conn.RemoteAddr())
+	}
+	if conn.NetConn() != server {
+		t.Fatal("Expected underlying connection")
+	}
+}
+
+func TestConn_Failed(t *testing.T) {
+	client, server := net.Pipe()
+	conn := proxyproto.NewConn(server, time.Second)
+
+	go func() {
+		client.Write([]byte("AMQP\x00\x00\x09\x01"))
+	}()
+
+	if _, err := conn.Read(make([]byte, 8)); err == nil {
+		t.Fatal("Expected error on connection without header")
+	}
+	if _, err := conn.Read(make([]byte, 8)); err == nil {
+		t.Fatal("Expected error on next reads")
+	}
+}
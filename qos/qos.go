@@ -3,12 +3,19 @@ package qos
 import "sync"
 
 // AmqpQos represents qos system
+// Zero prefetchCount or prefetchSize means no limit, current counters are kept anyway,
+// so limit set later takes already delivered messages into account
 type AmqpQos struct {
 	sync.Mutex
 	prefetchCount uint16
-	currentCount  uint16
+	currentCount  uint32
 	prefetchSize  uint32
-	currentSize   uint32
+	currentSize   uint64
+	// batch qos takes up to prefetchCount messages and then gives no credit until all of them are released
+	batch      bool
+	batchCount uint32
+	// fixed qos is set once for a consumer and is not changed by basic.qos
+	fixed bool
 }
 
 // NewAmqpQos returns new instance of AmqpQos
@@ -21,18 +28,52 @@ func NewAmqpQos(prefetchCount uint16, prefetchSize uint32) *AmqpQos {
 	}
 }
 
+// NewBatchQos returns qos of batches with batchSize messages
+// Up to batchSize messages are taken, then next batch is started only after all messages of the current one are released
+func NewBatchQos(batchSize uint16) *AmqpQos {
+	return &AmqpQos{
+		prefetchCount: batchSize,
+		batch:         true,
+	}
+}
+
+// NewFixedQos returns qos of prefetchCount messages which is not changed by basic.qos
+func NewFixedQos(prefetchCount uint16) *AmqpQos {
+	return &AmqpQos{
+		prefetchCount: prefetchCount,
+		fixed:         true,
+	}
+}
+
+// IsFixed returns true for qos which is not changed by basic.qos
+func (qos *AmqpQos) IsFixed() bool {
+	return qos.fixed
+}
+
+// IsBatch returns true for qos of batches
+func (qos *AmqpQos) IsBatch() bool {
+	return qos.batch
+}
+
 // PrefetchCount returns prefetchCount
 func (qos *AmqpQos) PrefetchCount() uint16 {
+	qos.Lock()
+	defer qos.Unlock()
 	return qos.prefetchCount
 }
 
 // PrefetchSize returns prefetchSize
 func (qos *AmqpQos) PrefetchSize() uint32 {
+	qos.Lock()
+	defer qos.Unlock()
 	return qos.prefetchSize
 }
 
 // Update set new prefetchCount and prefetchSize
+// Current counters are kept, so lower limits throttle until messages are released
 func (qos *AmqpQos) Update(prefetchCount uint16, prefetchSize uint32) {
+	qos.Lock()
+	defer qos.Unlock()
 	qos.prefetchCount = prefetchCount
 	qos.prefetchSize = prefetchSize
 }
@@ -40,6 +81,8 @@ func (qos *AmqpQos) Update(prefetchCount uint16, prefetchSize uint32) {
 // IsActive check is qos rules are active
 // both prefetchSize and prefetchCount must be 0
 func (qos *AmqpQos) IsActive() bool {
+	qos.Lock()
+	defer qos.Unlock()
 	return qos.prefetchCount != 0 || qos.prefetchSize != 0
 }
 
@@ -50,10 +93,19 @@ func (qos *AmqpQos) Inc(count uint16, size uint32) bool {
 	qos.Lock()
 	defer qos.Unlock()
 
-	newCount := qos.currentCount + count
-	newSize := qos.currentSize + size
+	if qos.batch {
+		if qos.batchCount+uint32(count) > uint32(qos.prefetchCount) {
+			return false
+		}
+		qos.batchCount += uint32(count)
+		qos.currentCount += uint32(count)
+		return true
+	}
+
+	newCount := qos.currentCount + uint32(count)
+	newSize := qos.currentSize + uint64(size)
 
-	if (qos.prefetchCount == 0 || newCount <= qos.prefetchCount) && (qos.prefetchSize == 0 || newSize <= qos.prefetchSize) {
+	if (qos.prefetchCount == 0 || newCount <= uint32(qos.prefetchCount)) && (qos.prefetchSize == 0 || newSize <= uint64(qos.prefetchSize)) {
 		qos.currentCount = newCount
 		qos.currentSize = newSize
 		return true
@@ -62,21 +114,38 @@ func (qos *AmqpQos) Inc(count uint16, size uint32) bool {
 	return false
 }
 
+// HasCapacity check is at least one more message can be taken
+// Size of next message is unknown, so only already reached prefetchSize is checked
+func (qos *AmqpQos) HasCapacity() bool {
+	qos.Lock()
+	defer qos.Unlock()
+
+	if qos.batch {
+		return qos.batchCount < uint32(qos.prefetchCount)
+	}
+	return (qos.prefetchCount == 0 || qos.currentCount < uint32(qos.prefetchCount)) && (qos.prefetchSize == 0 || qos.currentSize < uint64(qos.prefetchSize))
+}
+
 // Dec decrement current count and size
 func (qos *AmqpQos) Dec(count uint16, size uint32) {
 	qos.Lock()
 	defer qos.Unlock()
 
-	if qos.currentCount < count {
+	if qos.currentCount < uint32(count) {
 		qos.currentCount = 0
 	} else {
-		qos.currentCount = qos.currentCount - count
+		qos.currentCount = qos.currentCount - uint32(count)
 	}
 
-	if qos.currentSize < size {
+	if qos.currentSize < uint64(size) {
 		qos.currentSize = 0
 	} else {
-		qos.currentSize = qos.currentSize - size
+		qos.currentSize = qos.currentSize - uint64(size)
+	}
+
+	// batch is completed when all its messages are released
+	if qos.batch && qos.currentCount == 0 {
+		qos.batchCount = 0
 	}
 }
 
@@ -86,6 +155,7 @@ func (qos *AmqpQos) Release() {
 	defer qos.Unlock()
 	qos.currentCount = 0
 	qos.currentSize = 0
+	qos.batchCount = 0
 }
 
 // Copy safe copy current qos instance to new one
@@ -97,5 +167,8 @@ func (qos *AmqpQos) Copy() *AmqpQos {
 		prefetchSize:  qos.prefetchSize,
 		currentCount:  qos.currentCount,
 		currentSize:   qos.currentSize,
+		batch:         qos.batch,
+		batchCount:    qos.batchCount,
+		fixed:         qos.fixed,
 	}
 }
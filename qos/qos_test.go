@@ -69,6 +69,22 @@ func TestAmqpQos_Inc(t *testing.T) {
 	}
 }
 
+func TestAmqpQos_Inc_Unlimited(t *testing.T) {
+	q := NewAmqpQos(0, 0)
+	if !q.Inc(3, 5) {
+		t.Fatalf("Inc: Expected successful inc without limits")
+	}
+	if q.currentCount != 3 || q.currentSize != 5 {
+		t.Fatalf("Inc: Expected counters %d/%d, actual %d/%d", 3, 5, q.currentCount, q.currentSize)
+	}
+
+	// messages delivered without limit are counted by limit set later
+	q.Update(2, 0)
+	if q.HasCapacity() {
+		t.Fatalf("Expected no capacity after limit set below delivered count")
+	}
+}
+
 func TestAmqpQos_Update(t *testing.T) {
 	q := NewAmqpQos(5, 10)
 	q.Update(10, 20)
@@ -111,3 +127,87 @@ func TestAmqpQos_Copy(t *testing.T) {
 		t.Fatalf("Expected currentSize %d, actual %d", 0, q.currentCount)
 	}
 }
+
+func TestAmqpQos_HasCapacity(t *testing.T) {
+	q := NewAmqpQos(2, 0)
+	q.Inc(1, 100)
+	if !q.HasCapacity() {
+		t.Fatal("Expected capacity below prefetch count")
+	}
+
+	q.Inc(1, 100)
+	if q.HasCapacity() {
+		t.Fatal("Expected no capacity at prefetch count")
+	}
+
+	q = NewAmqpQos(0, 10)
+	q.Inc(1, 10)
+	if q.HasCapacity() {
+		t.Fatal("Expected no capacity at prefetch size")
+	}
+
+	q = NewAmqpQos(0, 0)
+	q.Inc(100, 100)
+	if !q.HasCapacity() {
+		t.Fatal("Expected capacity without limits")
+	}
+}
+
+func TestAmqpQos_Batch(t *testing.T) {
+	q := NewBatchQos(3)
+	if !q.IsBatch() || !q.IsActive() {
+		t.Fatalf("Expected active batch qos")
+	}
+
+	for i := 0; i < 3; i++ {
+		if !q.Inc(1, 10) {
+			t.Fatalf("Inc: Expected success for message %d of batch", i+1)
+		}
+	}
+	if q.Inc(1, 10) || q.HasCapacity() {
+		t.Fatalf("Expected no capacity for completely taken batch")
+	}
+
+	// released messages do not give credit until the whole batch is released
+	q.Dec(2, 20)
+	if q.Inc(1, 10) || q.HasCapacity() {
+		t.Fatalf("Expected no capacity while batch is not released")
+	}
+
+	q.Dec(1, 10)
+	if !q.HasCapacity() || !q.Inc(2, 20) {
+		t.Fatalf("Expected next batch after batch is released")
+	}
+
+	copied := q.Copy()
+	if !copied.IsBatch() || !copied.Inc(1, 10) || copied.HasCapacity() {
+		t.Fatalf("Expected copy with batch state")
+	}
+
+	q.Release()
+	if !q.Inc(3, 30) {
+		t.Fatalf("Expected whole batch after release")
+	}
+}
+
+func TestAmqpQos_Fixed(t *testing.T) {
+	q := NewFixedQos(2)
+	if !q.IsFixed() || q.IsBatch() || !q.IsActive() {
+		t.Fatalf("Expected active fixed qos")
+	}
+	if NewAmqpQos(2, 0).IsFixed() {
+		t.Fatalf("Expected not fixed qos")
+	}
+
+	if !q.Inc(2, 20) || q.Inc(1, 10) || q.HasCapacity() {
+		t.Fatalf("Expected no capacity above prefetch count")
+	}
+	q.Dec(1, 10)
+	if !q.HasCapacity() {
+		t.Fatalf("Expected capacity after release")
+	}
+
+	if !q.Copy().IsFixed() {
+		t.Fatalf("Expected fixed copy")
+	}
+}
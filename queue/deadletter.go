@@ -0,0 +1,71 @@
+package queue
+
+import (
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/spool"
+)
+
+// Reasons of message dead-lettering
+const (
+	DeadLetterRejected = "rejected"
+	DeadLetterExpired  = "expired"
+	// DeadLetterNoConsumers - message is routed into queue with x-drop-if-no-consumers which has no consumers
+	DeadLetterNoConsumers = "no_consumers"
+)
+
+// DeadLetter represents x-dead-letter-exchange, x-dead-letter-routing-key and x-dead-letter-persistent queue arguments
+type DeadLetter struct {
+	Exchange string
+	// RoutingKey replaces routing keys of dead-lettered message, empty means original keys are used
+	RoutingKey string
+	// Persistent marks dead-lettered messages persistent regardless of their delivery mode
+	Persistent bool
+}
+
+// DeadLetterHandler republishes messages dropped from queue into its dead-letter exchange
+type DeadLetterHandler func(queue *Queue, messages []*amqp.Message, reason string)
+
+// SetDeadLetter sets dead-letter exchange of queue, nil disables dead-lettering
+func (queue *Queue) SetDeadLetter(deadLetter *DeadLetter) {
+	queue.deadLetter = deadLetter
+}
+
+// GetDeadLetter returns dead-letter exchange of queue or nil if it is not set
+func (queue *Queue) GetDeadLetter() *DeadLetter {
+	return queue.deadLetter
+}
+
+// SetDeadLetterHandler sets handler called with expired messages of queue with dead-letter exchange
+func (queue *Queue) SetDeadLetterHandler(handler DeadLetterHandler) {
+	queue.deadLetterHandler = handler
+}
+
+// deadLetterExpired passes messages expired in queue head to dead-letter handler
+// Should be called without queue locks, as dead-lettered messages could be routed back into the same queue
+func (queue *Queue) deadLetterExpired() {
+	if queue.deadLetter == nil {
+		return
+	}
+
+	queue.SafeQueue.Lock()
+	expired := queue.expired
+	queue.expired = nil
+	queue.SafeQueue.Unlock()
+
+	if len(expired) == 0 {
+		return
+	}
+	if queue.deadLetterHandler != nil {
+		queue.deadLetterHandler(queue, expired, DeadLetterExpired)
+	}
+	for _, message := range expired {
+		spool.Release(message)
+	}
+}
+
+func (deadLetter *DeadLetter) equal(other *DeadLetter) bool {
+	if deadLetter == nil || other == nil {
+		return deadLetter == other
+	}
+	return *deadLetter == *other
+}
@@ -0,0 +1,49 @@
+package queue
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// inMemory returns message to keep in queue memory
+// Persistent message of durable queue with lazy bodies is kept without body, body is read from storage on delivery
+func (queue *Queue) inMemory(message *amqp.Message) *amqp.Message {
+	if queue.lazyBodies && queue.durable && message.IsPersistent() {
+		return message.WithoutBody()
+	}
+	return message
+}
+
+// loadBody returns copy of message with body read from persistent storage if body is not kept in memory
+// Error is returned if body could not be read, message must not be delivered or written back without its body
+func (queue *Queue) loadBody(message *amqp.Message) (*amqp.Message, error) {
+	if message == nil || !message.IsBodyStored() {
+		return message, nil
+	}
+
+	stored, err := queue.msgPStorage.Get(message.ID, queue.name)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"queue": queue.name,
+			"id":    message.ID,
+		}).Error("Error on read message body from storage")
+		return nil, err
+	}
+
+	loaded := *message
+	loaded.StoredBodySize = 0
+	loaded.Body = stored.Body
+	return &loaded, nil
+}
+
+// loadBodies reads bodies of messages not kept in memory, messages are replaced in the same slice
+// Messages which bodies could not be read are skipped
+func (queue *Queue) loadBodies(messages []*amqp.Message) []*amqp.Message {
+	loaded := messages[:0]
+	for _, message := range messages {
+		if message, err := queue.loadBody(message); err == nil {
+			loaded = append(loaded, message)
+		}
+	}
+	return loaded
+}
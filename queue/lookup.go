@@ -0,0 +1,81 @@
+package queue
+
+import (
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/interfaces"
+)
+
+// GetMessage returns ready message of queue by its ID without removing it, nil if message is not found
+// Messages in memory are looked up first, then message is read from storages by its key
+// Message delivered but not acknowledged yet could still be found in persistent storage
+func (queue *Queue) GetMessage(id uint64) *amqp.Message {
+	if messages := queue.findInMemory(1, func(message *amqp.Message) bool { return message.ID == id }); len(messages) > 0 {
+		message, _ := queue.loadBody(messages[0])
+		return message
+	}
+
+	var found *amqp.Message
+	for _, storage := range queue.getMsgStorages() {
+		storage.IterateByQueueFromMsgID(queue.name, id, 1, func(message *amqp.Message) {
+			if message.ID == id {
+				found = message
+			}
+		})
+		if found != nil {
+			return found
+		}
+	}
+
+	return nil
+}
+
+// FindMessages returns up to limit messages of queue matched by fn without removing them, zero limit means no limit
+// Messages in memory are checked first, then all messages of queue in storages are scanned
+func (queue *Queue) FindMessages(limit int, fn func(message *amqp.Message) bool) []*amqp.Message {
+	messages := queue.loadBodies(queue.findInMemory(limit, fn))
+	if limit > 0 && len(messages) >= limit {
+		return messages
+	}
+
+	seen := make(map[uint64]bool, len(messages))
+	for _, message := range messages {
+		seen[message.ID] = true
+	}
+	for _, storage := range queue.getMsgStorages() {
+		storage.IterateByQueueFromMsgID(queue.name, 0, 0, func(message *amqp.Message) {
+			if (limit > 0 && len(messages) >= limit) || seen[message.ID] || !fn(message) {
+				return
+			}
+			seen[message.ID] = true
+			messages = append(messages, message)
+		})
+	}
+
+	return messages
+}
+
+func (queue *Queue) findInMemory(limit int, fn func(message *amqp.Message) bool) []*amqp.Message {
+	queue.SafeQueue.Lock()
+	defer queue.SafeQueue.Unlock()
+
+	var messages []*amqp.Message
+	length := int(queue.SafeQueue.DirtyLength())
+	for idx := 0; idx < length && (limit <= 0 || len(messages) < limit); idx++ {
+		message := queue.SafeQueue.DirtyItemAt(idx).(*amqp.Message)
+		if fn(message) {
+			messages = append(messages, message)
+		}
+	}
+
+	return messages
+}
+
+func (queue *Queue) getMsgStorages() []interfaces.MsgStorage {
+	storages := make([]interfaces.MsgStorage, 0, 2)
+	for _, storage := range []interfaces.MsgStorage{queue.msgPStorage, queue.msgTStorage} {
+		if storage != nil {
+			storages = append(storages, storage)
+		}
+	}
+	return storages
+}
@@ -0,0 +1,20 @@
+package queue
+
+// OverflowRejectPublish - x-overflow behaviour of queue with x-max-length, publishes into full queue are rejected
+// It is the only behaviour implemented, RabbitMQ drop-head and reject-publish-dlx are not supported
+const OverflowRejectPublish = "reject-publish"
+
+// SetMaxLength sets x-max-length, maximum number of ready messages in queue, 0 - queue length is not limited
+func (queue *Queue) SetMaxLength(maxLength int64) {
+	queue.maxLength = maxLength
+}
+
+// GetMaxLength returns x-max-length of queue, 0 if queue length is not limited
+func (queue *Queue) GetMaxLength() int64 {
+	return queue.maxLength
+}
+
+// IsFull returns whether queue with x-max-length holds maximum number of ready messages, so publishes into it are rejected
+func (queue *Queue) IsFull() bool {
+	return queue.maxLength > 0 && queue.Length() >= uint64(queue.maxLength)
+}
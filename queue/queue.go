@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/valinurovam/garagemq/amqp"
 	"github.com/valinurovam/garagemq/config"
@@ -13,6 +15,8 @@ import (
 	"github.com/valinurovam/garagemq/metrics"
 	"github.com/valinurovam/garagemq/qos"
 	"github.com/valinurovam/garagemq/safequeue"
+	"github.com/valinurovam/garagemq/schema"
+	"github.com/valinurovam/garagemq/spool"
 )
 
 type MetricsState struct {
@@ -24,13 +28,46 @@ type MetricsState struct {
 	Get      *metrics.TrackCounter
 	Ack      *metrics.TrackCounter
 
+	// time between enqueue and first delivery in milliseconds
+	DeliveryLatency metrics.Histogram
+	// current queue state code, see StateCode
+	State *metrics.TrackCounter
+	// age of the oldest ready message in milliseconds, see OldestMessageAge
+	OldestMessageAge *metrics.TrackCounter
+
 	ServerReady   *metrics.TrackCounter
 	ServerUnacked *metrics.TrackCounter
 	ServerTotal   *metrics.TrackCounter
 	ServerDeliver *metrics.TrackCounter
 	ServerAck     *metrics.TrackCounter
+
+	// long-term history of queue counters by counter name, nil if history is disabled
+	History map[string]*metrics.TrackBuffer
+}
+
+// Queue states reported for monitoring
+const (
+	// StateRunning - queue accepts messages and keeps them in memory
+	StateRunning = "running"
+	// StateFlow - queue holds more messages than max_messages_in_ram and new messages are swapped to disk,
+	// so publishing into the queue is bound by storage
+	StateFlow = "flow"
+	// StateBlocked - queue does not accept messages, published ones are dropped
+	StateBlocked = "blocked"
+)
+
+var stateCodes = map[string]int64{
+	StateRunning: 0,
+	StateFlow:    1,
+	StateBlocked: 2,
 }
 
+// NoTTL means queue has no x-message-ttl
+const NoTTL int64 = -1
+
+// NoConsumerTimeout means queue has no x-consumer-timeout and server default one is used
+const NoConsumerTimeout int64 = -1
+
 // Queue is an implementation of the AMQP-queue entity
 type Queue struct {
 	safequeue.SafeQueue
@@ -39,7 +76,25 @@ type Queue struct {
 	exclusive   bool
 	autoDelete  bool
 	durable     bool
-	cmrLock     sync.RWMutex
+	messageTTL  int64
+	deadLetter  *DeadLetter
+	// only the first consumer gets messages, the next one is promoted when it is gone
+	singleActive bool
+	// messages routed into queue without consumers are dropped or dead-lettered instead of being enqueued
+	dropIfNoConsumers bool
+	// milliseconds to wait before redelivery of message rejected without requeue, by retry attempt
+	retryDelays []int64
+	// maximum number of ready messages, publishes into full queue are rejected, 0 - not limited
+	maxLength int64
+	// milliseconds to wait for acknowledgement of delivered message before channel is closed
+	consumerTimeout int64
+	// x-meta-* arguments of declaration, stored and reported as is
+	meta *amqp.Table
+	// x-queue-storage argument, name of configured storage holding queue messages, empty for default one
+	storageName string
+	// x-schema argument, bodies of messages routed into queue are validated against it
+	schema schema.Validator
+	cmrLock      sync.RWMutex
 	consumers   []interfaces.Consumer
 	consumeExcl bool
 	call        chan bool
@@ -47,6 +102,8 @@ type Queue struct {
 	shardSize   int
 	actLock     sync.RWMutex
 	active      bool
+	// paused queue holds messages from consumers and basic.get, but accepts publishes
+	paused bool
 	// persistent storage
 	msgPStorage interfaces.MsgStorage
 	// transient storage
@@ -59,11 +116,17 @@ type Queue struct {
 	// lock for sync load swapped-messages from disk
 	loadSwapLock           sync.Mutex
 	maxMessagesInRam       uint64
+	// bodies of persistent messages are not kept in memory and read from storage on delivery
+	lazyBodies             bool
 	lastStoredMsgId        uint64
 	lastMemMsgId           uint64
 	swappedToDisk          bool
 	maybeLoadFromStorageCh chan bool
 	wg                     *sync.WaitGroup
+
+	deadLetterHandler DeadLetterHandler
+	// expired messages waiting for dead-lettering, guarded by SafeQueue lock
+	expired []*amqp.Message
 }
 
 // NewQueue returns new instance of Queue
@@ -75,12 +138,15 @@ func NewQueue(name string, connID uint64, exclusive bool, autoDelete bool, durab
 		exclusive:  exclusive,
 		autoDelete: autoDelete,
 		durable:    durable,
+		messageTTL: NoTTL,
+		consumerTimeout: NoConsumerTimeout,
 		call:       make(chan bool, 1),
 		maybeLoadFromStorageCh: make(chan bool, 1),
 		wasConsumed:            false,
 		active:                 false,
 		shardSize:              config.ShardSize,
 		maxMessagesInRam:       config.MaxMessagesInRam,
+		lazyBodies:             config.LazyBodies,
 		msgPStorage:            msgStorageP,
 		msgTStorage:            msgStorageT,
 		currentConsumer:        0,
@@ -96,6 +162,9 @@ func NewQueue(name string, connID uint64, exclusive bool, autoDelete bool, durab
 			Get:      metrics.NewTrackCounter(0, true),
 			Ack:      metrics.NewTrackCounter(0, true),
 
+			DeliveryLatency: metrics.NewHistogram(nil, true),
+			State:           metrics.NewTrackCounter(0, true),
+
 			ServerReady:   metrics.NewTrackCounter(0, true),
 			ServerUnacked: metrics.NewTrackCounter(0, true),
 			ServerTotal:   metrics.NewTrackCounter(0, true),
@@ -107,11 +176,14 @@ func NewQueue(name string, connID uint64, exclusive bool, autoDelete bool, durab
 
 // Start starts base queue loop to send events to consumers
 // Current consumer to handle message from queue selected by round robin
+// Consumers at their prefetch limit refuse the event and the next one is called
+// Queue with single active consumer sends events to the active one only
 func (queue *Queue) Start() {
 	queue.actLock.Lock()
 	defer queue.actLock.Unlock()
 
 	queue.active = true
+	queue.trackState()
 	queue.wg.Add(1)
 	go func() {
 		defer queue.wg.Done()
@@ -120,6 +192,10 @@ func (queue *Queue) Start() {
 				queue.cmrLock.RLock()
 				defer queue.cmrLock.RUnlock()
 				cmrCount := len(queue.consumers)
+				if queue.singleActive && cmrCount != 0 {
+					queue.consumers[0].Consume()
+					return
+				}
 				for i := 0; i < cmrCount; i++ {
 					if !queue.active {
 						return
@@ -150,12 +226,35 @@ func (queue *Queue) Stop() error {
 	defer queue.actLock.Unlock()
 
 	queue.active = false
+	queue.trackState()
 	close(queue.maybeLoadFromStorageCh)
 	close(queue.call)
 	queue.wg.Wait()
 	return nil
 }
 
+// Pause holds deliveries of queue until Resume, published messages are still accepted
+func (queue *Queue) Pause() {
+	queue.actLock.Lock()
+	defer queue.actLock.Unlock()
+	queue.paused = true
+}
+
+// Resume restarts deliveries of paused queue
+func (queue *Queue) Resume() {
+	queue.actLock.Lock()
+	defer queue.actLock.Unlock()
+	queue.paused = false
+	queue.callConsumers()
+}
+
+// IsPaused returns is queue deliveries held
+func (queue *Queue) IsPaused() bool {
+	queue.actLock.RLock()
+	defer queue.actLock.RUnlock()
+	return queue.paused
+}
+
 // GetName returns queue name
 func (queue *Queue) GetName() string {
 	return queue.name
@@ -163,12 +262,29 @@ func (queue *Queue) GetName() string {
 
 // Push append message into queue tail and put it into message storage
 // if queue is durable and message's persistent flag is true
-func (queue *Queue) Push(message *amqp.Message) {
+// Returns true if message is put into persistent storage, such message is confirmed by storage after it is written
+func (queue *Queue) Push(message *amqp.Message) bool {
 	queue.actLock.Lock()
 	defer queue.actLock.Unlock()
 
-	if !queue.active {
-		return
+	_, durable := queue.push(message, false)
+	return durable
+}
+
+// PushChecked pushes message as Push does unless queue is stopped or full with x-max-length
+// Returns false if message is not pushed
+func (queue *Queue) PushChecked(message *amqp.Message) bool {
+	queue.actLock.Lock()
+	defer queue.actLock.Unlock()
+
+	pushed, _ := queue.push(message, true)
+	return pushed
+}
+
+// push should be called under actLock
+func (queue *Queue) push(message *amqp.Message, checkFull bool) (pushed bool, durable bool) {
+	if !queue.active || (checkFull && queue.IsFull()) {
+		return false, false
 	}
 
 	atomic.AddInt64(&queue.queueLength, 1)
@@ -180,9 +296,11 @@ func (queue *Queue) Push(message *amqp.Message) {
 	queue.metrics.Ready.Counter.Inc(1)
 
 	message.GenerateSeq()
+	message.MarkEnqueued()
 
 	persisted := false
-	if queue.durable && message.IsPersistent() {
+	durable = queue.durable && message.IsPersistent()
+	if durable {
 		queue.msgPStorage.Add(message, queue.name)
 		persisted = true
 	} else {
@@ -190,25 +308,24 @@ func (queue *Queue) Push(message *amqp.Message) {
 			queue.msgTStorage.Add(message, queue.name)
 			persisted = true
 		}
-
-		if message.ConfirmMeta != nil {
-			message.ConfirmMeta.ActualConfirms++
-		}
 	}
 
 	if persisted && !queue.swappedToDisk && queue.SafeQueue.Length() > queue.maxMessagesInRam {
 		queue.swappedToDisk = true
 		queue.lastStoredMsgId = message.ID
+		queue.trackState()
 	}
 
 	queue.metrics.Incoming.Counter.Inc(1)
 
 	if queue.SafeQueue.Length() <= queue.maxMessagesInRam && !queue.swappedToDisk {
-		queue.SafeQueue.Push(message)
+		queue.SafeQueue.Push(queue.inMemory(message))
 		queue.lastMemMsgId = message.ID
 	}
 
 	queue.callConsumers()
+
+	return true, durable
 }
 
 // Pop returns message from queue head without QOS check
@@ -218,6 +335,12 @@ func (queue *Queue) Pop() *amqp.Message {
 
 // PopQos returns message from queue head with QOS check
 func (queue *Queue) PopQos(qosList []*qos.AmqpQos) *amqp.Message {
+	return queue.popQos(qosList)
+}
+
+func (queue *Queue) popQos(qosList []*qos.AmqpQos) *amqp.Message {
+	// runs after all locks are released
+	defer queue.deadLetterExpired()
 	queue.actLock.RLock()
 	defer queue.actLock.RUnlock()
 
@@ -233,22 +356,17 @@ func (queue *Queue) PopQos(qosList []*qos.AmqpQos) *amqp.Message {
 
 	queue.SafeQueue.Lock()
 	defer queue.SafeQueue.Unlock()
+	queue.dropExpired()
 	if headItem := queue.SafeQueue.HeadItem(); headItem != nil {
-		message := headItem.(*amqp.Message)
-		allowed := true
-		for _, q := range qosList {
-			if !q.IsActive() {
-				continue
-			}
-			if !q.Inc(1, uint32(message.BodySize)) {
-				allowed = false
-				break
-			}
+		// message which body could not be read is left at queue head
+		message, err := queue.loadBody(headItem.(*amqp.Message))
+		if err != nil {
+			return nil
 		}
-
-		if allowed {
+		if incQos(qosList, message) {
 			queue.SafeQueue.DirtyPop()
 			atomic.AddInt64(&queue.queueLength, -1)
+			queue.observeDeliveryLatency(message)
 			return message
 		}
 	}
@@ -256,6 +374,212 @@ func (queue *Queue) PopQos(qosList []*qos.AmqpQos) *amqp.Message {
 	return nil
 }
 
+// incQos takes message from credit of all qos rules or from none of them
+// Inactive rules are incremented too, so limit set later counts messages delivered before
+func incQos(qosList []*qos.AmqpQos, message *amqp.Message) bool {
+	for idx, q := range qosList {
+		if !q.Inc(1, uint32(message.BodySize)) {
+			for _, taken := range qosList[:idx] {
+				taken.Dec(1, uint32(message.BodySize))
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// PopQosFilter returns first message in queue matched by fn with QOS check
+// Only messages loaded into memory are checked
+func (queue *Queue) PopQosFilter(qosList []*qos.AmqpQos, fn func(message *amqp.Message) bool) *amqp.Message {
+	return queue.popQosFilter(qosList, fn)
+}
+
+func (queue *Queue) popQosFilter(qosList []*qos.AmqpQos, fn func(message *amqp.Message) bool) *amqp.Message {
+	// runs after all locks are released
+	defer queue.deadLetterExpired()
+	queue.actLock.RLock()
+	defer queue.actLock.RUnlock()
+
+	if !queue.active {
+		return nil
+	}
+
+	select {
+	case queue.maybeLoadFromStorageCh <- true:
+	default:
+
+	}
+
+	queue.SafeQueue.Lock()
+	defer queue.SafeQueue.Unlock()
+	queue.dropExpired()
+	now := time.Now()
+	idx := queue.SafeQueue.DirtyIndex(func(item interface{}) bool {
+		message := item.(*amqp.Message)
+		return !queue.isExpired(message, now) && fn(message)
+	})
+	if idx == -1 {
+		return nil
+	}
+
+	message, err := queue.loadBody(queue.SafeQueue.DirtyItemAt(idx).(*amqp.Message))
+	if err != nil {
+		return nil
+	}
+	if !incQos(qosList, message) {
+		return nil
+	}
+
+	queue.SafeQueue.DirtyRemove(idx)
+	atomic.AddInt64(&queue.queueLength, -1)
+	queue.observeDeliveryLatency(message)
+	return message
+}
+
+// Peek returns up to limit messages from queue head without removing them
+// Only messages loaded into memory are returned
+func (queue *Queue) Peek(limit int) []*amqp.Message {
+	queue.SafeQueue.Lock()
+	length := int(queue.SafeQueue.DirtyLength())
+	if limit > length {
+		limit = length
+	}
+	messages := make([]*amqp.Message, 0, limit)
+	for idx := 0; idx < limit; idx++ {
+		messages = append(messages, queue.SafeQueue.DirtyItemAt(idx).(*amqp.Message))
+	}
+	queue.SafeQueue.Unlock()
+
+	return queue.loadBodies(messages)
+}
+
+// OldestMessageAge returns time the head ready message is in queue in milliseconds, 0 if queue has no ready messages
+// Only messages loaded into memory are checked, requeued message keeps its enqueue time
+func (queue *Queue) OldestMessageAge() int64 {
+	queue.SafeQueue.Lock()
+	headItem := queue.SafeQueue.HeadItem()
+	queue.SafeQueue.Unlock()
+	if headItem == nil {
+		return 0
+	}
+	message := headItem.(*amqp.Message)
+	if message.EnqueueTime == 0 {
+		return 0
+	}
+	return int64(time.Since(time.Unix(0, message.EnqueueTime)) / time.Millisecond)
+}
+
+// SetMessageTTL sets x-message-ttl in milliseconds for messages in queue, NoTTL disables it
+func (queue *Queue) SetMessageTTL(ttl int64) {
+	queue.messageTTL = ttl
+}
+
+// State returns current queue state - StateRunning, StateFlow or StateBlocked
+func (queue *Queue) State() string {
+	queue.actLock.RLock()
+	defer queue.actLock.RUnlock()
+	return queue.state()
+}
+
+func (queue *Queue) state() string {
+	if !queue.active {
+		return StateBlocked
+	}
+	if queue.swappedToDisk {
+		return StateFlow
+	}
+	return StateRunning
+}
+
+// StateCode returns numeric code of queue state used in metrics: 0 - running, 1 - flow, 2 - blocked
+func StateCode(state string) int64 {
+	return stateCodes[state]
+}
+
+// trackState sets state metric to current queue state
+func (queue *Queue) trackState() {
+	if queue.metrics == nil || queue.metrics.State == nil {
+		return
+	}
+	counter := queue.metrics.State.Counter
+	counter.Inc(StateCode(queue.state()) - counter.Count())
+}
+
+// GetMessageTTL returns x-message-ttl of queue in milliseconds or NoTTL
+func (queue *Queue) GetMessageTTL() int64 {
+	return queue.messageTTL
+}
+
+// effectiveTTL returns TTL of message in queue in milliseconds - the minimum of queue x-message-ttl
+// and message expiration, missing value means no limit from its source
+func (queue *Queue) effectiveTTL(message *amqp.Message) int64 {
+	ttl := queue.messageTTL
+	if expiration, ok := message.Expiration(); ok && (ttl == NoTTL || expiration < ttl) {
+		ttl = expiration
+	}
+	return ttl
+}
+
+// isExpired checks message TTL measured from enqueue time, message with zero TTL is always expired
+func (queue *Queue) isExpired(message *amqp.Message, now time.Time) bool {
+	ttl := queue.effectiveTTL(message)
+	if ttl == NoTTL {
+		return false
+	}
+	return now.Sub(time.Unix(0, message.EnqueueTime)) >= time.Duration(ttl)*time.Millisecond
+}
+
+// dropExpired removes expired messages from queue head
+// Messages are dropped or kept for dead-lettering if queue has dead-letter exchange
+// Should be called under SafeQueue lock
+func (queue *Queue) dropExpired() {
+	now := time.Now()
+	for headItem := queue.SafeQueue.HeadItem(); headItem != nil; headItem = queue.SafeQueue.HeadItem() {
+		message := headItem.(*amqp.Message)
+		if !queue.isExpired(message, now) {
+			return
+		}
+
+		queue.SafeQueue.DirtyPop()
+		atomic.AddInt64(&queue.queueLength, -1)
+		deadLetter := queue.deadLetter != nil
+		if deadLetter {
+			// body is read before message is deleted from storage, message without body is dropped
+			if loaded, err := queue.loadBody(message); err == nil {
+				message = loaded
+			} else {
+				deadLetter = false
+			}
+		}
+		if queue.durable && message.IsPersistent() {
+			// TODO handle error
+			queue.msgPStorage.Del(message, queue.name)
+		}
+		if deadLetter {
+			queue.expired = append(queue.expired, message)
+		} else {
+			spool.Release(message)
+		}
+
+		queue.metrics.Total.Counter.Dec(1)
+		queue.metrics.Ready.Counter.Dec(1)
+
+		queue.metrics.ServerTotal.Counter.Dec(1)
+		queue.metrics.ServerReady.Counter.Dec(1)
+	}
+}
+
+// observeDeliveryLatency tracks time message waited in queue before first delivery
+func (queue *Queue) observeDeliveryLatency(message *amqp.Message) {
+	if message.DeliveryCount != 0 || message.EnqueueTime == 0 {
+		return
+	}
+	queue.metrics.DeliveryLatency.Observe(int64(time.Since(time.Unix(0, message.EnqueueTime)) / time.Millisecond))
+	if message.TraceStart != 0 {
+		metrics.TraceStage(metrics.TraceDelivery, message.EnqueueTime, map[string]interface{}{"queue": queue.name})
+	}
+}
+
 func (queue *Queue) mayBeLoadFromStorage() {
 	swappedToPersistent := true
 	swappedToTransient := true
@@ -281,7 +605,9 @@ func (queue *Queue) mayBeLoadFromStorage() {
 		if currentLength < queue.maxMessagesInRam/2 && queue.swappedToDisk {
 			iterated := queue.msgPStorage.IterateByQueueFromMsgID(queue.name, queue.lastStoredMsgId, needle, func(message *amqp.Message) {
 				lastIteratedMsgId = message.ID
-				pMessages = append(pMessages, message)
+				// messages stored before restart could be swapped in later than queue load
+				amqp.AdvanceID(message.ID)
+				pMessages = append(pMessages, queue.inMemory(message))
 			})
 
 			if iterated == 0 || lastMemMsgId == lastIteratedMsgId {
@@ -328,6 +654,7 @@ func (queue *Queue) mayBeLoadFromStorage() {
 	}
 
 	queue.swappedToDisk = swappedToPersistent || swappedToTransient
+	queue.trackState()
 }
 
 func (queue *Queue) mergeSortedMessageSlices(A, B []*amqp.Message) []*amqp.Message {
@@ -358,13 +685,21 @@ func (queue *Queue) mergeSortedMessageSlices(A, B []*amqp.Message) []*amqp.Messa
 	return result
 }
 
+// LoadFromMsgStorage loads persisted messages into queue on server start
+// Message keys are ordered by ID, so the oldest messages are loaded in ascending ID order and FIFO order is kept after restart
 func (queue *Queue) LoadFromMsgStorage() {
+	var messages []*amqp.Message
 	iterated := queue.msgPStorage.IterateByQueueFromMsgID(queue.name, 0, queue.maxMessagesInRam, func(message *amqp.Message) {
+		messages = append(messages, queue.inMemory(message))
+	})
+
+	for _, message := range messages {
 		queue.SafeQueue.Push(message)
+		amqp.AdvanceID(message.ID)
 
 		queue.lastStoredMsgId = message.ID
 		queue.lastMemMsgId = message.ID
-	})
+	}
 
 	if queue.SafeQueue.Length() >= queue.maxMessagesInRam {
 		queue.swappedToDisk = true
@@ -373,7 +708,8 @@ func (queue *Queue) LoadFromMsgStorage() {
 	if iterated >= queue.maxMessagesInRam {
 		queue.queueLength = int64(queue.msgPStorage.GetQueueLength(queue.name))
 	} else {
-		queue.queueLength = int64(iterated)
+		// corrupted messages are iterated but not loaded
+		queue.queueLength = int64(len(messages))
 	}
 	queue.metrics.ServerTotal.Counter.Inc(queue.queueLength)
 	queue.metrics.ServerReady.Counter.Inc(queue.queueLength)
@@ -393,6 +729,7 @@ func (queue *Queue) AckMsg(message *amqp.Message) {
 		// TODO handle error
 		queue.msgPStorage.Del(message, queue.name)
 	}
+	spool.Release(message)
 
 	queue.metrics.Ack.Counter.Inc(1)
 	queue.metrics.Total.Counter.Dec(1)
@@ -406,24 +743,39 @@ func (queue *Queue) AckMsg(message *amqp.Message) {
 
 // Requeue add message into queue head
 func (queue *Queue) Requeue(message *amqp.Message) {
+	queue.RequeueAll([]*amqp.Message{message})
+}
+
+// RequeueAll returns messages into queue head at once, messages keep their order
+// Consumers can not take any of messages until all of them are returned
+func (queue *Queue) RequeueAll(messages []*amqp.Message) {
 	queue.actLock.RLock()
 	defer queue.actLock.RUnlock()
 	if !queue.active {
 		return
 	}
-	message.DeliveryCount++
-	queue.SafeQueue.PushHead(message)
-	if queue.durable && message.IsPersistent() {
-		// TODO handle error
-		queue.msgPStorage.Update(message, queue.name)
+
+	queue.SafeQueue.Lock()
+	for idx := len(messages) - 1; idx >= 0; idx-- {
+		messages[idx].DeliveryCount++
+		queue.SafeQueue.DirtyPushHead(queue.inMemory(messages[idx]))
 	}
-	queue.metrics.Ready.Counter.Inc(1)
-	queue.metrics.ServerReady.Counter.Inc(1)
+	queue.SafeQueue.Unlock()
 
-	queue.metrics.Unacked.Counter.Dec(1)
-	queue.metrics.ServerUnacked.Counter.Dec(1)
+	count := int64(len(messages))
+	for _, message := range messages {
+		if queue.durable && message.IsPersistent() {
+			// TODO handle error
+			queue.msgPStorage.Update(message, queue.name)
+		}
+	}
+	queue.metrics.Ready.Counter.Inc(count)
+	queue.metrics.ServerReady.Counter.Inc(count)
 
-	atomic.AddInt64(&queue.queueLength, 1)
+	queue.metrics.Unacked.Counter.Dec(count)
+	queue.metrics.ServerUnacked.Counter.Dec(count)
+
+	atomic.AddInt64(&queue.queueLength, count)
 
 	queue.callConsumers()
 }
@@ -433,6 +785,7 @@ func (queue *Queue) Purge() (length uint64) {
 	queue.SafeQueue.Lock()
 	defer queue.SafeQueue.Unlock()
 	length = uint64(atomic.LoadInt64(&queue.queueLength))
+	queue.releaseSpooled()
 	queue.SafeQueue.DirtyPurge()
 
 	if queue.durable {
@@ -447,8 +800,38 @@ func (queue *Queue) Purge() (length uint64) {
 	return
 }
 
+// releaseSpooled removes spooled bodies of messages loaded into memory
+// and of persistent messages swapped to disk, which are removed from storage with queue purge
+// Should be called under SafeQueue lock
+func (queue *Queue) releaseSpooled() {
+	for idx := 0; idx < int(queue.SafeQueue.DirtyLength()); idx++ {
+		spool.Release(queue.SafeQueue.DirtyItemAt(idx).(*amqp.Message))
+	}
+
+	if queue.durable && queue.swappedToDisk {
+		queue.msgPStorage.IterateByQueueFromMsgID(queue.name, 0, 0, func(message *amqp.Message) {
+			spool.Release(message)
+		})
+	}
+}
+
 // Delete cancel consumers and delete its messages from storage
 func (queue *Queue) Delete(ifUnused bool, ifEmpty bool) (uint64, error) {
+	length, consumers, err := queue.delete(ifUnused, ifEmpty)
+	if err != nil {
+		return 0, err
+	}
+
+	// consumers are cancelled after queue locks are released,
+	// consumer being stopped could wait for them and cancelled consumer removes itself from queue
+	for _, cmr := range consumers {
+		cmr.Cancel()
+	}
+
+	return length, nil
+}
+
+func (queue *Queue) delete(ifUnused bool, ifEmpty bool) (uint64, []interfaces.Consumer, error) {
 	queue.actLock.Lock()
 	queue.cmrLock.Lock()
 	queue.SafeQueue.Lock()
@@ -456,18 +839,21 @@ func (queue *Queue) Delete(ifUnused bool, ifEmpty bool) (uint64, error) {
 	defer queue.cmrLock.Unlock()
 	defer queue.SafeQueue.Unlock()
 
-	queue.active = false
-
+	// refused queue stays active, messages swapped to disk are counted too
 	if ifUnused && len(queue.consumers) != 0 {
-		return 0, errors.New("queue has consumers")
+		return 0, nil, errors.New("queue has consumers")
 	}
 
-	if ifEmpty && queue.SafeQueue.DirtyLength() != 0 {
-		return 0, errors.New("queue has messages")
+	if ifEmpty && atomic.LoadInt64(&queue.queueLength) != 0 {
+		return 0, nil, errors.New("queue has messages")
 	}
 
-	queue.cancelConsumers()
+	queue.active = false
+
+	consumers := make([]interfaces.Consumer, len(queue.consumers))
+	copy(consumers, queue.consumers)
 	length := uint64(atomic.LoadInt64(&queue.queueLength))
+	queue.releaseSpooled()
 
 	if queue.durable {
 		queue.msgPStorage.PurgeQueue(queue.name)
@@ -479,7 +865,7 @@ func (queue *Queue) Delete(ifUnused bool, ifEmpty bool) (uint64, error) {
 	queue.metrics.ServerTotal.Counter.Dec(int64(length))
 	queue.metrics.ServerReady.Counter.Dec(int64(length))
 
-	return length, nil
+	return length, consumers, nil
 }
 
 // AddConsumer add consumer to consumer messages with exclusive check
@@ -515,6 +901,14 @@ func (queue *Queue) RemoveConsumer(cTag string) {
 	for i, cmr := range queue.consumers {
 		if cmr.Tag() == cTag {
 			queue.consumers = append(queue.consumers[:i], queue.consumers[i+1:]...)
+			// keep round robin position, consumer next to removed one should not be skipped
+			if i <= queue.currentConsumer {
+				queue.currentConsumer--
+			}
+			// next consumer is promoted to active one
+			if queue.singleActive && i == 0 {
+				queue.callConsumers()
+			}
 			break
 		}
 	}
@@ -522,8 +916,8 @@ func (queue *Queue) RemoveConsumer(cTag string) {
 	if cmrCount == 0 {
 		queue.currentConsumer = 0
 		queue.consumeExcl = false
-	} else {
-		queue.currentConsumer = (queue.currentConsumer + 1) % cmrCount
+	} else if queue.currentConsumer < 0 {
+		queue.currentConsumer = cmrCount - 1
 	}
 
 	if cmrCount == 0 && queue.wasConsumed && queue.autoDelete {
@@ -531,7 +925,108 @@ func (queue *Queue) RemoveConsumer(cTag string) {
 	}
 }
 
-// Send event to call next consumer, that it can receive next message
+// SetSingleActiveConsumer sets x-single-active-consumer, only one consumer of queue gets messages at a time
+func (queue *Queue) SetSingleActiveConsumer(singleActive bool) {
+	queue.singleActive = singleActive
+}
+
+// SetConsumerTimeout sets x-consumer-timeout in milliseconds, 0 disables timeout, NoConsumerTimeout resets it to server default
+func (queue *Queue) SetConsumerTimeout(timeout int64) {
+	queue.consumerTimeout = timeout
+}
+
+// GetConsumerTimeout returns x-consumer-timeout of queue in milliseconds or NoConsumerTimeout
+func (queue *Queue) GetConsumerTimeout() int64 {
+	return queue.consumerTimeout
+}
+
+// SetMeta sets x-meta-* arguments of queue, nil if queue has no one
+func (queue *Queue) SetMeta(meta *amqp.Table) {
+	queue.meta = meta
+}
+
+// GetMeta returns x-meta-* arguments of queue, nil if queue has no one
+func (queue *Queue) GetMeta() *amqp.Table {
+	return queue.meta
+}
+
+// SetSchema sets validator of bodies of messages routed into queue, nil disables validation
+func (queue *Queue) SetSchema(validator schema.Validator) {
+	queue.schema = validator
+}
+
+// GetSchema returns validator of message bodies, nil if queue has no x-schema
+func (queue *Queue) GetSchema() schema.Validator {
+	return queue.schema
+}
+
+// SetMsgStorages sets named storages holding queue messages instead of ones queue is created with
+// Should be called before queue is started
+func (queue *Queue) SetMsgStorages(name string, msgStorageP interfaces.MsgStorage, msgStorageT interfaces.MsgStorage) {
+	queue.storageName = name
+	queue.msgPStorage = msgStorageP
+	queue.msgTStorage = msgStorageT
+}
+
+// GetStorageName returns x-queue-storage of queue, empty for default storage
+func (queue *Queue) GetStorageName() string {
+	return queue.storageName
+}
+
+// SetDropIfNoConsumers sets x-drop-if-no-consumers, messages routed into queue without consumers are not enqueued
+func (queue *Queue) SetDropIfNoConsumers(drop bool) {
+	queue.dropIfNoConsumers = drop
+}
+
+// IsDropIfNoConsumers returns are messages routed into queue without consumers dropped
+func (queue *Queue) IsDropIfNoConsumers() bool {
+	return queue.dropIfNoConsumers
+}
+
+// IsSingleActiveConsumer returns is queue has single active consumer
+func (queue *Queue) IsSingleActiveConsumer() bool {
+	return queue.singleActive
+}
+
+// ActiveConsumer returns tag of active consumer of queue with single active consumer or empty string if there is no one
+func (queue *Queue) ActiveConsumer() string {
+	queue.cmrLock.RLock()
+	defer queue.cmrLock.RUnlock()
+	if !queue.singleActive || len(queue.consumers) == 0 {
+		return ""
+	}
+	return queue.consumers[0].Tag()
+}
+
+// ElectNextConsumer promotes the next consumer of queue with single active consumer and returns its tag
+// Active one is moved to the end of consumers list and keeps its unacked messages
+func (queue *Queue) ElectNextConsumer() (string, error) {
+	queue.cmrLock.Lock()
+	defer queue.cmrLock.Unlock()
+
+	if !queue.singleActive {
+		return "", fmt.Errorf("queue '%s' has no single active consumer", queue.name)
+	}
+	if len(queue.consumers) == 0 {
+		return "", fmt.Errorf("queue '%s' has no consumers", queue.name)
+	}
+
+	consumers := make([]interfaces.Consumer, 0, len(queue.consumers))
+	consumers = append(consumers, queue.consumers[1:]...)
+	queue.consumers = append(consumers, queue.consumers[0])
+	queue.callConsumers()
+
+	return queue.consumers[0].Tag(), nil
+}
+
+// CallConsumers sends event to call next consumer, that it can receive next message
+// Used by consumers after delivery, so next message goes to the next consumer in round robin order
+func (queue *Queue) CallConsumers() {
+	queue.actLock.RLock()
+	defer queue.actLock.RUnlock()
+	queue.callConsumers()
+}
+
 func (queue *Queue) callConsumers() {
 	if !queue.active {
 		return
@@ -542,17 +1037,18 @@ func (queue *Queue) callConsumers() {
 	}
 }
 
-func (queue *Queue) cancelConsumers() {
-	for _, cmr := range queue.consumers {
-		cmr.Cancel()
-	}
-}
-
 // Length returns queue length
 func (queue *Queue) Length() uint64 {
 	return uint64(atomic.LoadInt64(&queue.queueLength))
 }
 
+// IsUnused returns is queue left without consumers after it had any
+func (queue *Queue) IsUnused() bool {
+	queue.cmrLock.RLock()
+	defer queue.cmrLock.RUnlock()
+	return queue.wasConsumed && len(queue.consumers) == 0
+}
+
 // ConsumersCount returns consumers count
 func (queue *Queue) ConsumersCount() int {
 	queue.cmrLock.RLock()
@@ -572,6 +1068,33 @@ func (queue *Queue) EqualWithErr(qB *Queue) error {
 	if queue.exclusive != qB.IsExclusive() {
 		return fmt.Errorf(errTemplate, "exclusive", queue.name, qB.IsExclusive(), queue.exclusive)
 	}
+	if queue.messageTTL != qB.messageTTL {
+		return fmt.Errorf("inequivalent arg 'x-message-ttl' for queue '%s': received '%d' but current is '%d'", queue.name, qB.messageTTL, queue.messageTTL)
+	}
+	if !queue.deadLetter.equal(qB.deadLetter) {
+		return fmt.Errorf("inequivalent arg 'x-dead-letter-exchange' for queue '%s'", queue.name)
+	}
+	if queue.singleActive != qB.singleActive {
+		return fmt.Errorf(errTemplate, "x-single-active-consumer", queue.name, qB.singleActive, queue.singleActive)
+	}
+	if queue.consumerTimeout != qB.consumerTimeout {
+		return fmt.Errorf("inequivalent arg 'x-consumer-timeout' for queue '%s': received '%d' but current is '%d'", queue.name, qB.consumerTimeout, queue.consumerTimeout)
+	}
+	if queue.storageName != qB.storageName {
+		return fmt.Errorf("inequivalent arg 'x-queue-storage' for queue '%s': received '%s' but current is '%s'", queue.name, qB.storageName, queue.storageName)
+	}
+	if !schema.Equal(queue.schema, qB.schema) {
+		return fmt.Errorf("inequivalent arg 'x-schema' for queue '%s'", queue.name)
+	}
+	if queue.dropIfNoConsumers != qB.dropIfNoConsumers {
+		return fmt.Errorf(errTemplate, "x-drop-if-no-consumers", queue.name, qB.dropIfNoConsumers, queue.dropIfNoConsumers)
+	}
+	if !equalRetryDelays(queue.retryDelays, qB.retryDelays) {
+		return fmt.Errorf("inequivalent arg 'x-retry-delays' for queue '%s': received '%v' but current is '%v'", queue.name, qB.retryDelays, queue.retryDelays)
+	}
+	if queue.maxLength != qB.maxLength {
+		return fmt.Errorf("inequivalent arg 'x-max-length' for queue '%s': received '%d' but current is '%d'", queue.name, qB.maxLength, queue.maxLength)
+	}
 	return nil
 }
 
@@ -592,6 +1115,87 @@ func (queue *Queue) Marshal(protoVersion string) (data []byte, err error) {
 	if err = amqp.WriteOctet(buf, autoDelete); err != nil {
 		return nil, err
 	}
+	if err = amqp.WriteLonglong(buf, uint64(queue.messageTTL)); err != nil {
+		return nil, err
+	}
+
+	var hasDeadLetter byte
+	deadLetter := &DeadLetter{}
+	if queue.deadLetter != nil {
+		hasDeadLetter = 1
+		deadLetter = queue.deadLetter
+	}
+	if err = amqp.WriteOctet(buf, hasDeadLetter); err != nil {
+		return nil, err
+	}
+	if err = amqp.WriteShortstr(buf, deadLetter.Exchange); err != nil {
+		return nil, err
+	}
+	if err = amqp.WriteShortstr(buf, deadLetter.RoutingKey); err != nil {
+		return nil, err
+	}
+
+	var singleActive byte
+	if queue.singleActive {
+		singleActive = 1
+	}
+	if err = amqp.WriteOctet(buf, singleActive); err != nil {
+		return nil, err
+	}
+	if err = amqp.WriteLonglong(buf, uint64(queue.consumerTimeout)); err != nil {
+		return nil, err
+	}
+
+	meta := queue.meta
+	if meta == nil {
+		meta = &amqp.Table{}
+	}
+	if err = amqp.WriteTable(buf, meta, protoVersion); err != nil {
+		return nil, err
+	}
+	if err = amqp.WriteShortstr(buf, queue.storageName); err != nil {
+		return nil, err
+	}
+
+	var deadLetterPersistent byte
+	if deadLetter.Persistent {
+		deadLetterPersistent = 1
+	}
+	if err = amqp.WriteOctet(buf, deadLetterPersistent); err != nil {
+		return nil, err
+	}
+
+	var schemaType, definition string
+	if queue.schema != nil {
+		schemaType, definition = queue.schema.Type(), queue.schema.Definition()
+	}
+	if err = amqp.WriteShortstr(buf, schemaType); err != nil {
+		return nil, err
+	}
+	if err = amqp.WriteLongstr(buf, []byte(definition)); err != nil {
+		return nil, err
+	}
+
+	var dropIfNoConsumers byte
+	if queue.dropIfNoConsumers {
+		dropIfNoConsumers = 1
+	}
+	if err = amqp.WriteOctet(buf, dropIfNoConsumers); err != nil {
+		return nil, err
+	}
+
+	if err = amqp.WriteLong(buf, uint32(len(queue.retryDelays))); err != nil {
+		return nil, err
+	}
+	for _, delay := range queue.retryDelays {
+		if err = amqp.WriteLonglong(buf, uint64(delay)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = amqp.WriteLonglong(buf, uint64(queue.maxLength)); err != nil {
+		return nil, err
+	}
 	return buf.Bytes(), nil
 }
 
@@ -609,7 +1213,142 @@ func (queue *Queue) Unmarshal(data []byte, protoVersion string) (err error) {
 	}
 	queue.autoDelete = autoDelete > 0
 	queue.durable = true
-	return
+
+	// queues stored by previous versions have no x-message-ttl and x-consumer-timeout
+	queue.messageTTL = NoTTL
+	queue.consumerTimeout = NoConsumerTimeout
+	var messageTTL uint64
+	if messageTTL, err = amqp.ReadLonglong(buf); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	queue.messageTTL = int64(messageTTL)
+
+	// queues stored by previous versions have no dead-letter exchange
+	var hasDeadLetter byte
+	if hasDeadLetter, err = amqp.ReadOctet(buf); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	deadLetter := &DeadLetter{}
+	if deadLetter.Exchange, err = amqp.ReadShortstr(buf); err != nil {
+		return err
+	}
+	if deadLetter.RoutingKey, err = amqp.ReadShortstr(buf); err != nil {
+		return err
+	}
+	if hasDeadLetter > 0 {
+		queue.deadLetter = deadLetter
+	}
+
+	// queues stored by previous versions have no x-single-active-consumer
+	var singleActive byte
+	if singleActive, err = amqp.ReadOctet(buf); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	queue.singleActive = singleActive > 0
+
+	// queues stored by previous versions have no x-consumer-timeout
+	var consumerTimeout uint64
+	if consumerTimeout, err = amqp.ReadLonglong(buf); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	queue.consumerTimeout = int64(consumerTimeout)
+
+	// queues stored by previous versions have no x-meta-* arguments
+	if buf.Len() == 0 {
+		return nil
+	}
+	var meta *amqp.Table
+	if meta, err = amqp.ReadTable(buf, protoVersion); err != nil {
+		return err
+	}
+	if len(*meta) > 0 {
+		queue.meta = meta
+	}
+
+	// queues stored by previous versions have no x-queue-storage
+	if buf.Len() == 0 {
+		return nil
+	}
+	if queue.storageName, err = amqp.ReadShortstr(buf); err != nil {
+		return err
+	}
+
+	// queues stored by previous versions have no x-dead-letter-persistent
+	if buf.Len() == 0 {
+		return nil
+	}
+	var deadLetterPersistent byte
+	if deadLetterPersistent, err = amqp.ReadOctet(buf); err != nil {
+		return err
+	}
+	deadLetter.Persistent = deadLetterPersistent > 0
+
+	// queues stored by previous versions have no x-schema
+	if buf.Len() == 0 {
+		return nil
+	}
+	var schemaType string
+	var definition []byte
+	if schemaType, err = amqp.ReadShortstr(buf); err != nil {
+		return err
+	}
+	if definition, err = amqp.ReadLongstr(buf); err != nil {
+		return err
+	}
+	if schemaType != "" {
+		if queue.schema, err = schema.New(schemaType, string(definition)); err != nil {
+			return err
+		}
+	}
+
+	// queues stored by previous versions have no x-drop-if-no-consumers
+	if buf.Len() == 0 {
+		return nil
+	}
+	var dropIfNoConsumers byte
+	if dropIfNoConsumers, err = amqp.ReadOctet(buf); err != nil {
+		return err
+	}
+	queue.dropIfNoConsumers = dropIfNoConsumers > 0
+
+	// queues stored by previous versions have no x-retry-delays
+	if buf.Len() == 0 {
+		return nil
+	}
+	var count uint32
+	if count, err = amqp.ReadLong(buf); err != nil {
+		return err
+	}
+	for idx := uint32(0); idx < count; idx++ {
+		var delay uint64
+		if delay, err = amqp.ReadLonglong(buf); err != nil {
+			return err
+		}
+		queue.retryDelays = append(queue.retryDelays, int64(delay))
+	}
+
+	// queues stored by previous versions have no x-max-length
+	if buf.Len() == 0 {
+		return nil
+	}
+	var maxLength uint64
+	if maxLength, err = amqp.ReadLonglong(buf); err != nil {
+		return err
+	}
+	queue.maxLength = int64(maxLength)
+	return nil
 }
 
 // IsDurable returns is queue durable
@@ -640,6 +1379,7 @@ func (queue *Queue) IsActive() bool {
 // SetMetrics set external metrics
 func (queue *Queue) SetMetrics(m *MetricsState) {
 	queue.metrics = m
+	queue.trackState()
 }
 
 // GetMetrics returns metrics
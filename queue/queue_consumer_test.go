@@ -34,3 +34,19 @@ func (consumer *ConsumerMock) Tag() string {
 func (consumer *ConsumerMock) Qos() []*qos.AmqpQos {
 	return []*qos.AmqpQos{}
 }
+
+// RoundRobinConsumerMock implements consumer mock, that reports each accepted call
+type RoundRobinConsumerMock struct {
+	ConsumerMock
+	full  bool
+	calls chan string
+}
+
+// Consume accepts call if consumer is not at prefetch limit
+func (consumer *RoundRobinConsumerMock) Consume() bool {
+	if consumer.full {
+		return false
+	}
+	consumer.calls <- consumer.tag
+	return true
+}
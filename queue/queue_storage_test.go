@@ -1,6 +1,8 @@
 package queue
 
 import (
+	"errors"
+
 	"github.com/valinurovam/garagemq/amqp"
 )
 
@@ -53,6 +55,13 @@ func (storage *MsgStorageMock) PurgeQueue(queue string) {
 	storage.purged = true
 }
 
+func (storage *MsgStorageMock) Get(id uint64, queue string) (*amqp.Message, error) {
+	if pos, ok := storage.index[id]; ok {
+		return storage.messages[pos], nil
+	}
+	return nil, errors.New("message not found")
+}
+
 func (storage *MsgStorageMock) GetQueueLength(queue string) uint64 {
 	return uint64(len(storage.messages))
 }
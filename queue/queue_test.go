@@ -1,12 +1,16 @@
 package queue
 
 import (
+	"fmt"
+	"runtime"
 	"testing"
 	"time"
 
 	"github.com/valinurovam/garagemq/amqp"
 	"github.com/valinurovam/garagemq/config"
+	"github.com/valinurovam/garagemq/metrics"
 	"github.com/valinurovam/garagemq/qos"
+	"github.com/valinurovam/garagemq/schema"
 )
 
 const SIZE = 32
@@ -91,6 +95,74 @@ func TestQueue_PushPop(t *testing.T) {
 	}
 }
 
+func TestQueue_DeliveryLatency(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.SetMetrics(&MetricsState{
+		Ready:           metrics.NewTrackCounter(0, true),
+		Unacked:         metrics.NewTrackCounter(0, true),
+		Total:           metrics.NewTrackCounter(0, true),
+		Incoming:        metrics.NewTrackCounter(0, true),
+		ServerReady:     metrics.NewTrackCounter(0, true),
+		ServerUnacked:   metrics.NewTrackCounter(0, true),
+		ServerTotal:     metrics.NewTrackCounter(0, true),
+		DeliveryLatency: metrics.NewHistogram(metrics.DefaultLatencyBuckets, false),
+	})
+	queue.Start()
+
+	queue.Push(&amqp.Message{ID: 1})
+	queue.Push(&amqp.Message{ID: 2})
+	time.Sleep(20 * time.Millisecond)
+
+	message := queue.Pop()
+	if message.EnqueueTime == 0 {
+		t.Fatal("Expected enqueue time set on push")
+	}
+	queue.Requeue(message)
+	queue.Pop()
+
+	snapshot := queue.GetMetrics().DeliveryLatency.Snapshot()
+	if snapshot.Count != 1 {
+		t.Fatalf("Expected 1 first delivery tracked, actual %d", snapshot.Count)
+	}
+	if snapshot.Sum < 20 {
+		t.Fatalf("Expected latency at least 20ms, actual %d", snapshot.Sum)
+	}
+
+	queue.Pop()
+	snapshot = queue.GetMetrics().DeliveryLatency.Snapshot()
+	if snapshot.Count != 2 {
+		t.Fatalf("Expected 2 first deliveries tracked, actual %d", snapshot.Count)
+	}
+	if snapshot.Buckets[0].Count != 0 || snapshot.Buckets[len(snapshot.Buckets)-1].Count != 2 {
+		t.Fatal("Unexpected histogram buckets")
+	}
+}
+
+func TestQueue_OldestMessageAge(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.Start()
+	if age := queue.OldestMessageAge(); age != 0 {
+		t.Fatalf("Expected zero age of empty queue, actual %d", age)
+	}
+
+	queue.Push(&amqp.Message{ID: 1})
+	time.Sleep(30 * time.Millisecond)
+	queue.Push(&amqp.Message{ID: 2})
+	if age := queue.OldestMessageAge(); age < 30 {
+		t.Fatalf("Expected age of the first message at least 30ms, actual %d", age)
+	}
+
+	// requeued message is the oldest one again
+	message := queue.Pop()
+	if age := queue.OldestMessageAge(); age >= 30 {
+		t.Fatalf("Expected age of the second message, actual %d", age)
+	}
+	queue.Requeue(message)
+	if age := queue.OldestMessageAge(); age < 30 {
+		t.Fatalf("Expected age of requeued message at least 30ms, actual %d", age)
+	}
+}
+
 func TestQueue_Requeue(t *testing.T) {
 	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
 	queue.Start()
@@ -123,6 +195,28 @@ func TestQueue_Requeue(t *testing.T) {
 	}
 }
 
+func TestQueue_RequeueAll(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.Start()
+	queue.Push(&amqp.Message{ID: 4})
+
+	requeued := []*amqp.Message{{ID: 1}, {ID: 2}, {ID: 3}}
+	queue.RequeueAll(requeued)
+
+	if queue.Length() != 4 {
+		t.Fatalf("expected %d elements, have %d", 4, queue.Length())
+	}
+	for expected := 1; expected <= 4; expected++ {
+		pop := queue.Pop()
+		if expected != int(pop.ID) {
+			t.Fatalf("Pop: expected %d, actual %d", expected, pop.ID)
+		}
+		if expected < 4 && pop.DeliveryCount != 1 {
+			t.Fatalf("Expected delivery count %d, actual %d", 1, pop.DeliveryCount)
+		}
+	}
+}
+
 func TestQueue_PopQos_Empty(t *testing.T) {
 	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
 	queue.Start()
@@ -241,6 +335,98 @@ func TestQueue_PopQos_Multiple(t *testing.T) {
 	}
 }
 
+func TestQueue_PopQos_Multiple_Rollback(t *testing.T) {
+	qosRules := []*qos.AmqpQos{
+		qos.NewAmqpQos(4, 0),
+		qos.NewAmqpQos(2, 0),
+	}
+
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.Start()
+	for item := 0; item < 10; item++ {
+		queue.Push(&amqp.Message{ID: uint64(item)})
+	}
+
+	rcvCount := 0
+	for item := 0; item < 10; item++ {
+		if queue.PopQos(qosRules) != nil {
+			rcvCount++
+		}
+	}
+	if rcvCount != 2 {
+		t.Fatalf("Expected %d messages, actual %d", 2, rcvCount)
+	}
+
+	// credit taken from the first rule is returned when the second one refuses message
+	qosRules[1].Update(0, 0)
+	for item := 0; item < 10; item++ {
+		if queue.PopQos(qosRules) != nil {
+			rcvCount++
+		}
+	}
+	if rcvCount != 4 {
+		t.Fatalf("Expected %d messages, actual %d", 4, rcvCount)
+	}
+}
+
+func TestQueue_PopQosFilter(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.Start()
+
+	queueLength := SIZE * 8
+	for item := 0; item < queueLength; item++ {
+		message := &amqp.Message{ID: uint64(item + 1)}
+		queue.Push(message)
+	}
+
+	even := func(message *amqp.Message) bool {
+		return message.ID%2 == 0
+	}
+
+	for item := 2; item <= queueLength; item += 2 {
+		message := queue.PopQosFilter([]*qos.AmqpQos{}, even)
+		if message == nil || message.ID != uint64(item) {
+			t.Fatalf("Expected message %d, actual %v", item, message)
+		}
+	}
+
+	if queue.PopQosFilter([]*qos.AmqpQos{}, even) != nil {
+		t.Fatal("Expected nil when no messages matched")
+	}
+
+	if queue.Length() != uint64(queueLength/2) {
+		t.Fatalf("Expected %d messages in queue, actual %d", queueLength/2, queue.Length())
+	}
+
+	for item := 1; item <= queueLength; item += 2 {
+		if message := queue.Pop(); message == nil || message.ID != uint64(item) {
+			t.Fatalf("Expected message %d, actual %v", item, message)
+		}
+	}
+}
+
+func TestQueue_PopQosFilter_Qos(t *testing.T) {
+	qosRule := qos.NewAmqpQos(1, 0)
+
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.Start()
+	for item := 1; item <= 4; item++ {
+		queue.Push(&amqp.Message{ID: uint64(item)})
+	}
+
+	all := func(message *amqp.Message) bool {
+		return true
+	}
+
+	if queue.PopQosFilter([]*qos.AmqpQos{qosRule}, all) == nil {
+		t.Fatal("Expected message within qos")
+	}
+
+	if queue.PopQosFilter([]*qos.AmqpQos{qosRule}, all) != nil {
+		t.Fatal("Expected nil over qos")
+	}
+}
+
 func TestQueue_Purge(t *testing.T) {
 	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
 	queue.Start()
@@ -359,6 +545,16 @@ func TestQueue_EqualWithErr_Failed_Exclusive(t *testing.T) {
 	}
 }
 
+func TestQueue_EqualWithErr_Failed_MessageTTL(t *testing.T) {
+	queue1 := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue2 := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue2.SetMessageTTL(1000)
+
+	if err := queue1.EqualWithErr(queue2); err == nil {
+		t.Fatal("Expected error about x-message-ttl")
+	}
+}
+
 func TestQueue_Delete_Success(t *testing.T) {
 	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
 	if _, err := queue.Delete(false, false); err != nil {
@@ -380,6 +576,9 @@ func TestQueue_Delete_Failed_IfEmpty(t *testing.T) {
 	if _, err := queue.Delete(false, true); err == nil {
 		t.Fatal("Expected error on non empty queue")
 	}
+	if !queue.IsActive() {
+		t.Fatal("Expected queue active after refused delete")
+	}
 }
 
 func TestQueue_Delete_Failed_IfUnused(t *testing.T) {
@@ -394,6 +593,9 @@ func TestQueue_Delete_Failed_IfUnused(t *testing.T) {
 	if _, err := queue.Delete(true, false); err == nil {
 		t.Fatal("Expected error on consumed queue")
 	}
+	if !queue.IsActive() {
+		t.Fatal("Expected queue active after refused delete")
+	}
 }
 
 func TestQueue_Marshal(t *testing.T) {
@@ -409,6 +611,288 @@ func TestQueue_Marshal(t *testing.T) {
 	}
 }
 
+func TestQueue_Marshal_MessageTTL(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, true, baseConfig, nil, nil, nil)
+	queue.SetMessageTTL(1000)
+	marshaled, err := queue.Marshal(amqp.ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uQueue := &Queue{}
+	if err = uQueue.Unmarshal(marshaled, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if uQueue.GetMessageTTL() != 1000 {
+		t.Fatalf("Expected x-message-ttl %d, actual %d", 1000, uQueue.GetMessageTTL())
+	}
+
+	// queue stored without x-message-ttl
+	uQueue = &Queue{}
+	if err = uQueue.Unmarshal([]byte{4, 't', 'e', 's', 't', 0}, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if uQueue.GetMessageTTL() != NoTTL {
+		t.Fatalf("Expected no x-message-ttl, actual %d", uQueue.GetMessageTTL())
+	}
+}
+
+func TestQueue_Marshal_DeadLetter(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, true, baseConfig, nil, nil, nil)
+	queue.SetDeadLetter(&DeadLetter{Exchange: "", RoutingKey: "dead", Persistent: true})
+	marshaled, err := queue.Marshal(amqp.ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uQueue := &Queue{}
+	if err = uQueue.Unmarshal(marshaled, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if err = queue.EqualWithErr(uQueue); err != nil {
+		t.Fatal(err)
+	}
+	if !uQueue.GetDeadLetter().Persistent {
+		t.Fatal("Expected x-dead-letter-persistent unmarshaled")
+	}
+
+	// queue stored without dead-letter exchange
+	uQueue = &Queue{}
+	if err = uQueue.Unmarshal([]byte{4, 't', 'e', 's', 't', 0, 0, 0, 0, 0, 0, 0, 0, 1}, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if uQueue.GetDeadLetter() != nil {
+		t.Fatalf("Expected no dead-letter exchange, actual %v", uQueue.GetDeadLetter())
+	}
+}
+
+func TestQueue_Marshal_Meta(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, true, baseConfig, nil, nil, nil)
+	queue.SetMeta(&amqp.Table{"x-meta-owner": "billing"})
+	marshaled, err := queue.Marshal(amqp.ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uQueue := &Queue{}
+	if err = uQueue.Unmarshal(marshaled, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if meta := uQueue.GetMeta(); meta == nil || (*meta)["x-meta-owner"] != "billing" {
+		t.Fatalf("Expected x-meta-owner restored, actual %v", meta)
+	}
+
+	// queue without metadata is restored without it
+	queue.SetMeta(nil)
+	if marshaled, err = queue.Marshal(amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	uQueue = &Queue{}
+	if err = uQueue.Unmarshal(marshaled, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if uQueue.GetMeta() != nil {
+		t.Fatalf("Expected no metadata, actual %v", uQueue.GetMeta())
+	}
+}
+
+func TestQueue_Marshal_Schema(t *testing.T) {
+	validator, err := schema.New("", `{"type": "object", "required": ["id"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := NewQueue("test", 0, false, false, true, baseConfig, nil, nil, nil)
+	queue.SetSchema(validator)
+	marshaled, err := queue.Marshal(amqp.ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uQueue := &Queue{}
+	if err = uQueue.Unmarshal(marshaled, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if err = queue.EqualWithErr(uQueue); err != nil {
+		t.Fatal(err)
+	}
+	if uQueue.GetSchema().Validate([]byte(`{"id": 1}`)) != nil {
+		t.Fatal("Expected restored schema accepts valid body")
+	}
+
+	if err = queue.EqualWithErr(NewQueue("test", 0, false, false, true, baseConfig, nil, nil, nil)); err == nil {
+		t.Fatal("Expected inequivalent x-schema")
+	}
+}
+
+func TestQueue_Marshal_DropIfNoConsumers(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, true, baseConfig, nil, nil, nil)
+	queue.SetDropIfNoConsumers(true)
+	marshaled, err := queue.Marshal(amqp.ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uQueue := &Queue{}
+	if err = uQueue.Unmarshal(marshaled, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if !uQueue.IsDropIfNoConsumers() {
+		t.Fatal("Expected x-drop-if-no-consumers restored")
+	}
+
+	// queue stored by previous version keeps messages, x-drop-if-no-consumers octet is followed by empty x-retry-delays
+	// and x-max-length
+	uQueue = &Queue{}
+	if err = uQueue.Unmarshal(marshaled[:len(marshaled)-13], amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if uQueue.IsDropIfNoConsumers() {
+		t.Fatal("Expected x-drop-if-no-consumers is not set")
+	}
+	if err = queue.EqualWithErr(uQueue); err == nil {
+		t.Fatal("Expected inequivalent x-drop-if-no-consumers")
+	}
+}
+
+func TestQueue_Marshal_RetryDelays(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, true, baseConfig, nil, nil, nil)
+	queue.SetRetryDelays([]int64{100, 1000, 10000})
+	marshaled, err := queue.Marshal(amqp.ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uQueue := &Queue{}
+	if err = uQueue.Unmarshal(marshaled, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if err = queue.EqualWithErr(uQueue); err != nil {
+		t.Fatal("Expected x-retry-delays restored", err)
+	}
+
+	// queue stored by previous version has no retries
+	uQueue = &Queue{}
+	if err = uQueue.Unmarshal(marshaled[:len(marshaled)-4-3*8-8], amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if uQueue.GetRetryDelays() != nil {
+		t.Fatalf("Expected no x-retry-delays, actual %v", uQueue.GetRetryDelays())
+	}
+	if err = queue.EqualWithErr(uQueue); err == nil {
+		t.Fatal("Expected inequivalent x-retry-delays")
+	}
+}
+
+func TestQueue_Marshal_MaxLength(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, true, baseConfig, nil, nil, nil)
+	queue.SetMaxLength(1000)
+	marshaled, err := queue.Marshal(amqp.ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uQueue := &Queue{}
+	if err = uQueue.Unmarshal(marshaled, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if uQueue.GetMaxLength() != 1000 {
+		t.Fatalf("Expected x-max-length restored, actual %d", uQueue.GetMaxLength())
+	}
+
+	// queue stored by previous version is not limited
+	uQueue = &Queue{}
+	if err = uQueue.Unmarshal(marshaled[:len(marshaled)-8], amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if uQueue.GetMaxLength() != 0 {
+		t.Fatalf("Expected no x-max-length, actual %d", uQueue.GetMaxLength())
+	}
+	if err = queue.EqualWithErr(uQueue); err == nil {
+		t.Fatal("Expected inequivalent x-max-length")
+	}
+}
+
+func TestQueue_RetryDelay(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, true, baseConfig, nil, nil, nil)
+	headers := amqp.Table{"key": "value"}
+	message := &amqp.Message{Header: &amqp.ContentHeader{PropertyList: &amqp.BasicPropertyList{Headers: &headers}}}
+	if _, _, ok := queue.RetryDelay(message); ok {
+		t.Fatal("Expected no retry without x-retry-delays")
+	}
+
+	queue.SetRetryDelays([]int64{100, 1000})
+	for attempt, expected := range []time.Duration{100 * time.Millisecond, time.Second} {
+		delay, retried, ok := queue.RetryDelay(message)
+		if !ok || delay != expected {
+			t.Fatalf("Expected retry %d after %s, actual %s", attempt+1, expected, delay)
+		}
+		if RetryCount(retried) != attempt+1 || (*retried.Header.PropertyList.Headers)["key"] != "value" {
+			t.Fatalf("Unexpected headers of retried message %v", *retried.Header.PropertyList.Headers)
+		}
+		if RetryCount(message) != attempt {
+			t.Fatal("Expected headers of original message are not changed")
+		}
+		message = retried
+	}
+	if _, _, ok := queue.RetryDelay(message); ok {
+		t.Fatal("Expected no retry after all delays are used")
+	}
+}
+
+func TestQueue_Marshal_StorageName(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, true, baseConfig, nil, nil, nil)
+	queue.SetMsgStorages("ssd", nil, nil)
+	marshaled, err := queue.Marshal(amqp.ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uQueue := &Queue{}
+	if err = uQueue.Unmarshal(marshaled, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if uQueue.GetStorageName() != "ssd" {
+		t.Fatalf("Expected x-queue-storage restored, actual '%s'", uQueue.GetStorageName())
+	}
+
+	// queue stored without storage name is placed at default storage
+	uQueue = &Queue{}
+	// storage name is followed by x-dead-letter-persistent octet, empty x-schema, x-drop-if-no-consumers octet
+	// empty x-retry-delays and x-max-length
+	if err = uQueue.Unmarshal(marshaled[:len(marshaled)-23], amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if uQueue.GetStorageName() != "" {
+		t.Fatalf("Expected default storage, actual '%s'", uQueue.GetStorageName())
+	}
+}
+
+func TestQueue_Marshal_ConsumerTimeout(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, true, baseConfig, nil, nil, nil)
+	queue.SetConsumerTimeout(5000)
+	marshaled, err := queue.Marshal(amqp.ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uQueue := &Queue{}
+	if err = uQueue.Unmarshal(marshaled, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if err = queue.EqualWithErr(uQueue); err != nil {
+		t.Fatal(err)
+	}
+
+	// queue stored without x-consumer-timeout
+	uQueue = &Queue{}
+	if err = uQueue.Unmarshal([]byte{4, 't', 'e', 's', 't', 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0}, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if uQueue.GetConsumerTimeout() != NoConsumerTimeout {
+		t.Fatalf("Expected no x-consumer-timeout, actual %d", uQueue.GetConsumerTimeout())
+	}
+}
+
 // useless, for coverage only
 func TestQueue_Unmarshal_FailedEmpty(t *testing.T) {
 	queue := &Queue{}
@@ -483,6 +967,43 @@ func TestQueue_Push_Durable_NonPersistent(t *testing.T) {
 	}
 }
 
+func TestQueue_Push_NonDurable_Persistent(t *testing.T) {
+	storage := &MsgStorageMock{}
+	queue := NewQueue("test", 0, false, false, false, baseConfig, storage, nil, nil)
+	queue.Start()
+	var dMode byte = 2
+	message := &amqp.Message{
+		ID: 1,
+		Header: &amqp.ContentHeader{
+			PropertyList: &amqp.BasicPropertyList{
+				DeliveryMode: &dMode,
+			},
+		},
+	}
+
+	queue.Push(message)
+	if storage.add {
+		t.Fatal("Storage.Add called on message pushed into non durable queue")
+	}
+}
+
+func TestQueue_Push_NonDurable_NonPersistent(t *testing.T) {
+	storage := &MsgStorageMock{}
+	queue := NewQueue("test", 0, false, false, false, baseConfig, storage, nil, nil)
+	queue.Start()
+	message := &amqp.Message{
+		ID: 1,
+		Header: &amqp.ContentHeader{
+			PropertyList: &amqp.BasicPropertyList{},
+		},
+	}
+
+	queue.Push(message)
+	if storage.add {
+		t.Fatal("Storage.Add called on non persistent message")
+	}
+}
+
 func TestQueue_AckMsg_Persistent(t *testing.T) {
 	storage := &MsgStorageMock{}
 	queue := NewQueue("test", 0, false, false, true, baseConfig, storage, nil, nil)
@@ -668,6 +1189,34 @@ func TestQueue_LoadFromMsgStorage_LessMaxMessages(t *testing.T) {
 	}
 }
 
+func TestQueue_LoadFromMsgStorage_AdvanceID(t *testing.T) {
+	amqp.SetIDGenerator(amqp.NewSeqIDGenerator(0))
+	defer amqp.SetIDGenerator(amqp.NewSeqIDGenerator(uint64(time.Now().UnixNano())))
+
+	var baseConfig = config.Queue{ShardSize: SIZE, MaxMessagesInRam: 1000}
+	storagePersisted := NewStorageMock(100)
+	queue := NewQueue("test", 0, false, false, true, baseConfig, storagePersisted, NewStorageMock(0), nil)
+
+	var dMode byte = 2
+	for id := uint64(1); id <= 100; id++ {
+		storagePersisted.Add(&amqp.Message{
+			ID: id,
+			Header: &amqp.ContentHeader{
+				PropertyList: &amqp.BasicPropertyList{
+					DeliveryMode: &dMode,
+				},
+			},
+		}, "test")
+	}
+	queue.LoadFromMsgStorage()
+
+	message := &amqp.Message{}
+	message.GenerateSeq()
+	if message.ID != 101 {
+		t.Fatalf("Expected id %d after load of stored messages, actual %d", 101, message.ID)
+	}
+}
+
 func TestQueue_LoadFromMsgStorage_OverMaxMessages(t *testing.T) {
 	var baseConfig = config.Queue{ShardSize: SIZE, MaxMessagesInRam: 10}
 	count := baseConfig.MaxMessagesInRam * 5
@@ -748,3 +1297,384 @@ func TestQueue_CancelConsumers(t *testing.T) {
 		t.Fatalf("Expected call consumer.Cancel()")
 	}
 }
+
+func TestQueue_CallConsumers_RoundRobin(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.Start()
+
+	calls := make(chan string, 10)
+	cmrA := &RoundRobinConsumerMock{ConsumerMock: ConsumerMock{tag: "a"}, calls: calls}
+	cmrB := &RoundRobinConsumerMock{ConsumerMock: ConsumerMock{tag: "b"}, calls: calls, full: true}
+	cmrC := &RoundRobinConsumerMock{ConsumerMock: ConsumerMock{tag: "c"}, calls: calls}
+	queue.AddConsumer(cmrA, false)
+	<-calls
+	queue.AddConsumer(cmrB, false)
+	<-calls
+	queue.AddConsumer(cmrC, false)
+	<-calls
+
+	expected := []string{"a", "c", "a", "c"}
+	for _, tag := range expected {
+		queue.CallConsumers()
+		select {
+		case actual := <-calls:
+			if actual != tag {
+				t.Fatalf("Expected call of consumer %s, actual %s", tag, actual)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected consumer call")
+		}
+	}
+
+	// after "c" next consumer is "a", removing "a" passes turn to "c", "b" is still full
+	queue.RemoveConsumer("a")
+	queue.CallConsumers()
+	if actual := <-calls; actual != "c" {
+		t.Fatalf("Expected call of consumer c, actual %s", actual)
+	}
+
+	cmrB.full = false
+	queue.CallConsumers()
+	if actual := <-calls; actual != "b" {
+		t.Fatalf("Expected call of consumer b, actual %s", actual)
+	}
+}
+
+func TestQueue_SingleActiveConsumer(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, true, baseConfig, nil, nil, nil)
+	queue.SetSingleActiveConsumer(true)
+	queue.Start()
+
+	if _, err := queue.ElectNextConsumer(); err == nil {
+		t.Fatal("Expected error on queue without consumers")
+	}
+
+	calls := make(chan string, 10)
+	queue.AddConsumer(&RoundRobinConsumerMock{ConsumerMock: ConsumerMock{tag: "a"}, calls: calls}, false)
+	queue.AddConsumer(&RoundRobinConsumerMock{ConsumerMock: ConsumerMock{tag: "b"}, calls: calls}, false)
+	queue.AddConsumer(&RoundRobinConsumerMock{ConsumerMock: ConsumerMock{tag: "c"}, calls: calls}, false)
+
+	expectCall := func(tag string) {
+		select {
+		case actual := <-calls:
+			if actual != tag {
+				t.Fatalf("Expected call of consumer %s, actual %s", tag, actual)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected consumer call")
+		}
+	}
+	for i := 0; i < 3; i++ {
+		queue.CallConsumers()
+		expectCall("a")
+	}
+	// drain calls on add consumers
+	for len(calls) != 0 {
+		expectCall("a")
+	}
+
+	if tag, err := queue.ElectNextConsumer(); err != nil || tag != "b" {
+		t.Fatalf("Expected consumer b elected, actual %s, %v", tag, err)
+	}
+	expectCall("b")
+	if queue.ActiveConsumer() != "b" {
+		t.Fatalf("Expected active consumer b, actual %s", queue.ActiveConsumer())
+	}
+
+	queue.RemoveConsumer("b")
+	expectCall("c")
+	queue.RemoveConsumer("c")
+	expectCall("a")
+
+	marshaled, err := queue.Marshal(amqp.ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uQueue := &Queue{}
+	if err = uQueue.Unmarshal(marshaled, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if !uQueue.IsSingleActiveConsumer() {
+		t.Fatal("Expected single active consumer restored")
+	}
+}
+
+func TestQueue_ElectNextConsumer_Failed_RoundRobin(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.Start()
+	queue.AddConsumer(&ConsumerMock{tag: "a"}, false)
+
+	if _, err := queue.ElectNextConsumer(); err == nil {
+		t.Fatal("Expected error on queue without single active consumer")
+	}
+}
+
+func expiringMessage(id uint64, expiration string) *amqp.Message {
+	message := &amqp.Message{
+		ID: id,
+		Header: &amqp.ContentHeader{
+			PropertyList: &amqp.BasicPropertyList{},
+		},
+	}
+	if expiration != "" {
+		message.Header.PropertyList.Expiration = &expiration
+	}
+	return message
+}
+
+func TestQueue_IsExpired(t *testing.T) {
+	testCases := []struct {
+		name       string
+		queueTTL   int64
+		expiration string
+		age        time.Duration
+		expired    bool
+	}{
+		{"no ttl", NoTTL, "", time.Hour, false},
+		{"queue ttl alive", 100, "", 50 * time.Millisecond, false},
+		{"queue ttl expired", 100, "", 150 * time.Millisecond, true},
+		{"message ttl alive", NoTTL, "100", 50 * time.Millisecond, false},
+		{"message ttl expired", NoTTL, "100", 150 * time.Millisecond, true},
+		{"queue ttl is less", 100, "1000", 150 * time.Millisecond, true},
+		{"message ttl is less", 1000, "100", 150 * time.Millisecond, true},
+		{"both alive", 1000, "1000", 150 * time.Millisecond, false},
+		{"zero queue ttl", 0, "", 0, true},
+		{"zero message ttl", NoTTL, "0", 0, true},
+		{"zero queue ttl with message ttl", 0, "1000", 0, true},
+		{"zero message ttl with queue ttl", 1000, "0", 0, true},
+	}
+
+	now := time.Now()
+	for _, testCase := range testCases {
+		queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+		queue.SetMessageTTL(testCase.queueTTL)
+
+		message := expiringMessage(1, testCase.expiration)
+		message.EnqueueTime = now.Add(-testCase.age).UnixNano()
+
+		if queue.isExpired(message, now) != testCase.expired {
+			t.Fatalf("%s: expected expired %t", testCase.name, testCase.expired)
+		}
+	}
+}
+
+func TestQueue_PopQos_DropExpired(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.SetMessageTTL(50)
+	queue.Start()
+
+	queue.Push(expiringMessage(1, ""))
+	queue.Push(expiringMessage(2, "0"))
+	time.Sleep(60 * time.Millisecond)
+	queue.Push(expiringMessage(3, ""))
+	queue.Push(expiringMessage(4, "0"))
+	queue.Push(expiringMessage(5, ""))
+
+	if message := queue.Pop(); message == nil || message.ID != 3 {
+		t.Fatalf("Expected first non-expired message, actual %v", message)
+	}
+	// expired message is dropped only when it reaches queue head
+	if queue.Length() != 2 {
+		t.Fatalf("Expected %d messages in queue, actual %d", 2, queue.Length())
+	}
+
+	if message := queue.Pop(); message == nil || message.ID != 5 {
+		t.Fatalf("Expected message behind expired one, actual %v", message)
+	}
+	if queue.Length() != 0 || queue.Pop() != nil {
+		t.Fatal("Expected empty queue")
+	}
+}
+
+func TestQueue_PopQos_DeadLetterExpired(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.SetDeadLetter(&DeadLetter{Exchange: "dlx"})
+	var deadLettered []*amqp.Message
+	queue.SetDeadLetterHandler(func(qu *Queue, messages []*amqp.Message, reason string) {
+		if reason != DeadLetterExpired {
+			t.Fatalf("Expected reason %s, actual %s", DeadLetterExpired, reason)
+		}
+		deadLettered = append(deadLettered, messages...)
+	})
+	queue.Start()
+
+	queue.Push(expiringMessage(1, "0"))
+	queue.Push(expiringMessage(2, "0"))
+	queue.Push(expiringMessage(3, ""))
+
+	if message := queue.Pop(); message == nil || message.ID != 3 {
+		t.Fatalf("Expected first non-expired message, actual %v", message)
+	}
+	if len(deadLettered) != 2 || deadLettered[0].ID != 1 || deadLettered[1].ID != 2 {
+		t.Fatalf("Expected expired messages dead-lettered in order, actual %v", deadLettered)
+	}
+}
+
+func TestQueue_PopQosFilter_SkipExpired(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.Start()
+
+	queue.Push(expiringMessage(1, ""))
+	queue.Push(expiringMessage(2, "0"))
+	queue.Push(expiringMessage(3, ""))
+
+	message := queue.PopQosFilter([]*qos.AmqpQos{}, func(message *amqp.Message) bool {
+		return message.ID != 1
+	})
+	if message == nil || message.ID != 3 {
+		t.Fatalf("Expected expired message is skipped, actual %v", message)
+	}
+}
+
+func TestQueue_State(t *testing.T) {
+	var baseConfig = config.Queue{ShardSize: SIZE, MaxMessagesInRam: 10}
+	count := int(baseConfig.MaxMessagesInRam) * 2
+
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, NewStorageMock(count), nil)
+	state := metrics.NewTrackCounter(0, false)
+	queue.SetMetrics(&MetricsState{
+		Ready:         metrics.NewTrackCounter(0, true),
+		Unacked:       metrics.NewTrackCounter(0, true),
+		Total:         metrics.NewTrackCounter(0, true),
+		Incoming:      metrics.NewTrackCounter(0, true),
+		ServerReady:   metrics.NewTrackCounter(0, true),
+		ServerUnacked: metrics.NewTrackCounter(0, true),
+		ServerTotal:   metrics.NewTrackCounter(0, true),
+		State:         state,
+	})
+
+	checkState := func(expected string) {
+		if queue.State() != expected {
+			t.Fatalf("Expected state %s, actual %s", expected, queue.State())
+		}
+		if state.Counter.Count() != StateCode(expected) {
+			t.Fatalf("Expected state metric %d, actual %d", StateCode(expected), state.Counter.Count())
+		}
+	}
+
+	checkState(StateBlocked)
+
+	queue.Start()
+	checkState(StateRunning)
+
+	for i := 0; i < count; i++ {
+		queue.Push(&amqp.Message{
+			ID:     uint64(i + 1),
+			Header: &amqp.ContentHeader{PropertyList: &amqp.BasicPropertyList{}},
+		})
+	}
+	checkState(StateFlow)
+
+	queue.Stop()
+	checkState(StateBlocked)
+}
+
+func lazyBodyMessage(id uint64, body []byte) *amqp.Message {
+	var dMode byte = 2
+	return &amqp.Message{
+		ID:       id,
+		BodySize: uint64(len(body)),
+		Header: &amqp.ContentHeader{
+			BodySize: uint64(len(body)),
+			PropertyList: &amqp.BasicPropertyList{
+				DeliveryMode: &dMode,
+			},
+		},
+		Body: []*amqp.Frame{{Type: byte(amqp.FrameBody), Payload: body}},
+	}
+}
+
+func TestQueue_LazyBodies(t *testing.T) {
+	storage := NewStorageMock(2)
+	queue := NewQueue("test", 0, false, false, true, config.Queue{ShardSize: SIZE, MaxMessagesInRam: 10, LazyBodies: true}, storage, nil, nil)
+	queue.Start()
+
+	message := lazyBodyMessage(1, []byte("test"))
+	queue.Push(message)
+	if len(message.Body) != 1 {
+		t.Fatal("Expected pushed message keeps body")
+	}
+
+	head := queue.SafeQueue.HeadItem().(*amqp.Message)
+	if head.Body != nil || !head.IsBodyStored() {
+		t.Fatal("Expected message is kept in memory without body")
+	}
+
+	popped := queue.Pop()
+	if popped.IsBodyStored() || len(popped.Body) != 1 || string(popped.Body[0].Payload) != "test" {
+		t.Fatal("Expected popped message with body read from storage")
+	}
+
+	queue.Requeue(popped)
+	if head := queue.SafeQueue.HeadItem().(*amqp.Message); head.Body != nil || head.DeliveryCount != 1 {
+		t.Fatal("Expected requeued message is kept in memory without body")
+	}
+
+	// message which body could not be read is not delivered and is left at queue head
+	queue.Pop()
+	queue.Push(lazyBodyMessage(2, []byte("test")))
+	storedIdx := storage.index[2]
+	delete(storage.index, 2)
+	if popped := queue.Pop(); popped != nil {
+		t.Fatal("Expected no message delivered without body")
+	}
+	if head := queue.SafeQueue.HeadItem().(*amqp.Message); head.ID != 2 || queue.Length() != 1 {
+		t.Fatal("Expected message is left at queue head")
+	}
+	if queue.GetMessage(2) != nil {
+		t.Fatal("Expected message without body is not returned by lookup")
+	}
+
+	storage.index[2] = storedIdx
+	if popped := queue.Pop(); popped == nil || len(popped.Body) != 1 || string(popped.Body[0].Payload) != "test" {
+		t.Fatal("Expected message with body delivered after storage recovered")
+	}
+}
+
+func TestQueue_LazyBodies_NonPersistent(t *testing.T) {
+	storage := NewStorageMock(1)
+	queue := NewQueue("test", 0, false, false, true, config.Queue{ShardSize: SIZE, MaxMessagesInRam: 10, LazyBodies: true}, storage, nil, nil)
+	queue.Start()
+
+	message := lazyBodyMessage(1, []byte("test"))
+	var dMode byte = 1
+	message.Header.PropertyList.DeliveryMode = &dMode
+	queue.Push(message)
+
+	if head := queue.SafeQueue.HeadItem().(*amqp.Message); head != message {
+		t.Fatal("Expected non persistent message is kept in memory as is")
+	}
+}
+
+// BenchmarkQueue_DeepDurable_Memory reports heap held by deep durable queue per message,
+// bodies are kept by storage mock, as they are on disk with real storage
+func BenchmarkQueue_DeepDurable_Memory(b *testing.B) {
+	const depth = 100000
+	body := make([]byte, 1024)
+
+	for _, lazy := range []bool{false, true} {
+		b.Run(fmt.Sprintf("lazy=%t", lazy), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				storage := NewStorageMock(depth)
+				queue := NewQueue("test", 0, false, false, true, config.Queue{ShardSize: SIZE, MaxMessagesInRam: depth, LazyBodies: lazy}, storage, nil, nil)
+				queue.Start()
+
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				for id := 1; id <= depth; id++ {
+					payload := make([]byte, len(body))
+					queue.Push(lazyBodyMessage(uint64(id), payload))
+				}
+				// drop bodies referenced by storage mock, so only memory held by queue is measured
+				storage.messages = nil
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+
+				b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/depth, "heap-B/msg")
+				runtime.KeepAlive(queue)
+				queue.Stop()
+			}
+		})
+	}
+}
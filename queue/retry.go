@@ -0,0 +1,105 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// HeaderRetryCount - message header with number of retries of message rejected from queue with x-retry-delays
+const HeaderRetryCount = "x-retry-count"
+
+// SetRetryDelays sets x-retry-delays in milliseconds, message rejected without requeue is redelivered after them one by one
+func (queue *Queue) SetRetryDelays(delays []int64) {
+	queue.retryDelays = delays
+}
+
+// GetRetryDelays returns x-retry-delays in milliseconds, nil if rejected messages are not retried
+func (queue *Queue) GetRetryDelays() []int64 {
+	return queue.retryDelays
+}
+
+// RetryDelay returns delay before the next retry of message rejected without requeue and message to retry
+// Returned message is a copy with incremented x-retry-count header, as message could be shared with other queues
+// False is returned if queue has no retry delays or message has been retried as many times as there are delays
+func (queue *Queue) RetryDelay(message *amqp.Message) (time.Duration, *amqp.Message, bool) {
+	attempt := RetryCount(message)
+	if attempt >= len(queue.retryDelays) {
+		return 0, nil, false
+	}
+
+	properties := *message.Header.PropertyList
+	headers := amqp.Table{}
+	if properties.Headers != nil {
+		for key, value := range *properties.Headers {
+			headers[key] = value
+		}
+	}
+	headers[HeaderRetryCount] = int64(attempt + 1)
+	properties.Headers = &headers
+	header := *message.Header
+	header.PropertyList = &properties
+	retried := *message
+	retried.Header = &header
+
+	return time.Duration(queue.retryDelays[attempt]) * time.Millisecond, &retried, true
+}
+
+// RequeueAfter returns message into queue head after delay, message is counted as unacked meanwhile
+// Persistent message of durable queue is updated in storage at once, so its retry count is kept on restart,
+// though message is restored into queue without waiting for the rest of delay
+func (queue *Queue) RequeueAfter(message *amqp.Message, delay time.Duration) {
+	queue.actLock.RLock()
+	if !queue.active {
+		queue.actLock.RUnlock()
+		return
+	}
+	if queue.durable && message.IsPersistent() {
+		// TODO handle error
+		queue.msgPStorage.Update(message, queue.name)
+	}
+	queue.actLock.RUnlock()
+
+	time.AfterFunc(delay, func() {
+		queue.Requeue(message)
+	})
+}
+
+// RetryCount returns number of retries of message, it is 0 for message never retried
+func RetryCount(message *amqp.Message) int {
+	if message.Header == nil || message.Header.PropertyList == nil || message.Header.PropertyList.Headers == nil {
+		return 0
+	}
+
+	switch value := (*message.Header.PropertyList.Headers)[HeaderRetryCount].(type) {
+	case int8:
+		return int(value)
+	case uint8:
+		return int(value)
+	case int16:
+		return int(value)
+	case uint16:
+		return int(value)
+	case int32:
+		return int(value)
+	case uint32:
+		return int(value)
+	case int64:
+		return int(value)
+	case uint64:
+		return int(value)
+	}
+	return 0
+}
+
+func equalRetryDelays(a []int64, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
@@ -55,7 +55,11 @@ func (queue *SafeQueue) Push(item interface{}) {
 func (queue *SafeQueue) PushHead(item interface{}) {
 	queue.Lock()
 	defer queue.Unlock()
+	queue.DirtyPushHead(item)
+}
 
+// DirtyPushHead pushes item into queue head without lock
+func (queue *SafeQueue) DirtyPushHead(item interface{}) {
 	if queue.headPos == 0 {
 		buffer := make([][]interface{}, len(queue.shards)+1)
 		copy(buffer[1:], queue.shards)
@@ -113,12 +117,43 @@ func (queue *SafeQueue) HeadItem() (res interface{}) {
 	return queue.head[queue.headPos]
 }
 
+// DirtyIndex returns index of first item matched by fn or -1 if nothing matched
+func (queue *SafeQueue) DirtyIndex(fn func(item interface{}) bool) int {
+	for idx := 0; idx < int(queue.length); idx++ {
+		if fn(queue.DirtyItemAt(idx)) {
+			return idx
+		}
+	}
+	return -1
+}
+
+// DirtyItemAt returns item by index counted from queue head
+func (queue *SafeQueue) DirtyItemAt(idx int) interface{} {
+	pos := queue.headPos + idx
+	return queue.shards[queue.headIdx+pos/queue.shardSize][pos%queue.shardSize]
+}
+
+// DirtyRemove removes and returns item by index counted from queue head, order of other items is kept
+func (queue *SafeQueue) DirtyRemove(idx int) (item interface{}) {
+	item = queue.DirtyItemAt(idx)
+	// shift items before removed one to the tail and pop duplicated head
+	for i := idx; i > 0; i-- {
+		pos := queue.headPos + i
+		queue.shards[queue.headIdx+pos/queue.shardSize][pos%queue.shardSize] = queue.DirtyItemAt(i - 1)
+	}
+	queue.DirtyPop()
+
+	return item
+}
+
 func (queue *SafeQueue) DirtyPurge() {
 	queue.shards = [][]interface{}{make([]interface{}, queue.shardSize)}
 	queue.tailIdx = 0
 	queue.tail = queue.shards[queue.tailIdx]
+	queue.tailPos = 0
 	queue.headIdx = 0
 	queue.head = queue.shards[queue.headIdx]
+	queue.headPos = 0
 	queue.length = 0
 }
 
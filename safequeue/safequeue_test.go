@@ -114,4 +114,54 @@ func TestSafeQueue_Purge(t *testing.T) {
 	if nil != pop {
 		t.Fatalf("Pop: expected %v, actual %v", nil, pop)
 	}
+
+	// items pushed after purge are popped in order
+	queue.Push(1)
+	queue.Push(2)
+	queue.Pop()
+	queue.Purge()
+	queue.Push(3)
+	if pop = queue.Pop(); pop != 3 {
+		t.Fatalf("Pop: expected %v, actual %v", 3, pop)
+	}
+}
+
+func TestSafeQueue_DirtyRemove(t *testing.T) {
+	queue := NewSafeQueue(SIZE)
+	queueLength := SIZE * 4
+	// head is in the middle of shard
+	queue.Push(-1)
+	for item := 0; item < queueLength; item++ {
+		queue.Push(item)
+	}
+	queue.Pop()
+
+	removeItem := SIZE*2 + 3
+	idx := queue.DirtyIndex(func(item interface{}) bool {
+		return item == removeItem
+	})
+	if idx != removeItem {
+		t.Fatalf("expected index %d, actual %d", removeItem, idx)
+	}
+
+	if item := queue.DirtyRemove(idx); item != removeItem {
+		t.Fatalf("expected removed %d, actual %v", removeItem, item)
+	}
+
+	if queue.Length() != uint64(queueLength-1) {
+		t.Fatalf("expected %d elements, have %d", queueLength-1, queue.Length())
+	}
+
+	for item := 0; item < queueLength; item++ {
+		if item == removeItem {
+			continue
+		}
+		if pop := queue.Pop(); pop != item {
+			t.Fatalf("Pop: expected %d, actual %v", item, pop)
+		}
+	}
+
+	if idx := queue.DirtyIndex(func(item interface{}) bool { return true }); idx != -1 {
+		t.Fatalf("expected index %d on empty queue, actual %d", -1, idx)
+	}
 }
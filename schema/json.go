@@ -0,0 +1,472 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+)
+
+/*
+JSONValidator validates JSON bodies against a subset of JSON Schema
+
+Supported keywords:
+
+	type                        "null", "boolean", "object", "array", "number", "integer", "string" or list of them
+	enum, const                 allowed values
+	properties, required        object members
+	additionalProperties        false or schema of members not listed in properties
+	minProperties, maxProperties
+	items                       schema of all array items
+	minItems, maxItems
+	minimum, maximum            inclusive number bounds
+	exclusiveMinimum, exclusiveMaximum
+	multipleOf
+	minLength, maxLength        string length in unicode code points
+	pattern                     regular expression string should match, not anchored
+	allOf, anyOf, oneOf, not    combinations of schemas
+
+Other keywords, e.g. $schema, title or description, are ignored, as JSON Schema requires.
+Boolean schema true allows any value, false allows none.
+
+Example: {"type": "object", "required": ["id"], "properties": {"id": {"type": "integer", "minimum": 1}}}
+*/
+type JSONValidator struct {
+	definition string
+	root       *jsonSchema
+}
+
+type jsonSchema struct {
+	// schema given as boolean, nil for object schema
+	allow *bool
+
+	types         []string
+	enum          []interface{}
+	properties    map[string]*jsonSchema
+	required      []string
+	additional    *jsonSchema
+	minProperties *int
+	maxProperties *int
+	items         *jsonSchema
+	minItems      *int
+	maxItems      *int
+	minimum       *float64
+	maximum       *float64
+	exclusiveMin  *float64
+	exclusiveMax  *float64
+	multipleOf    *float64
+	minLength     *int
+	maxLength     *int
+	pattern       *regexp.Regexp
+	allOf         []*jsonSchema
+	anyOf         []*jsonSchema
+	oneOf         []*jsonSchema
+	not           *jsonSchema
+}
+
+var jsonTypes = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"object":  true,
+	"array":   true,
+	"number":  true,
+	"integer": true,
+	"string":  true,
+}
+
+// NewJSONValidator returns validator of JSON Schema definition
+func NewJSONValidator(definition string) (Validator, error) {
+	var raw interface{}
+	if err := json.Unmarshal([]byte(definition), &raw); err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %s", err.Error())
+	}
+	root, err := compileJSONSchema(raw, "#")
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %s", err.Error())
+	}
+	return &JSONValidator{definition: definition, root: root}, nil
+}
+
+// Type returns TypeJSON
+func (validator *JSONValidator) Type() string {
+	return TypeJSON
+}
+
+// Definition returns JSON Schema validator is created from
+func (validator *JSONValidator) Definition() string {
+	return validator.definition
+}
+
+// Validate checks that body is a JSON document conforming to schema
+func (validator *JSONValidator) Validate(body []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("body is not a valid JSON: %s", err.Error())
+	}
+	if decoder.More() {
+		return errors.New("body is not a valid JSON: unexpected data after document")
+	}
+	return validator.root.validate(value, "$")
+}
+
+func compileJSONSchema(raw interface{}, path string) (*jsonSchema, error) {
+	if allow, ok := raw.(bool); ok {
+		return &jsonSchema{allow: &allow}, nil
+	}
+	object, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: schema should be an object or a boolean", path)
+	}
+
+	compiled := &jsonSchema{}
+	var err error
+	for keyword, value := range object {
+		keywordPath := path + "/" + keyword
+		switch keyword {
+		case "type":
+			compiled.types, err = compileTypes(value, keywordPath)
+		case "enum":
+			values, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s should be an array", keywordPath)
+			}
+			compiled.enum = values
+		case "const":
+			compiled.enum = []interface{}{value}
+		case "properties":
+			members, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s should be an object", keywordPath)
+			}
+			compiled.properties = make(map[string]*jsonSchema, len(members))
+			for name, member := range members {
+				if compiled.properties[name], err = compileJSONSchema(member, keywordPath+"/"+name); err != nil {
+					return nil, err
+				}
+			}
+		case "required":
+			compiled.required, err = compileStrings(value, keywordPath)
+		case "additionalProperties":
+			compiled.additional, err = compileJSONSchema(value, keywordPath)
+		case "items":
+			compiled.items, err = compileJSONSchema(value, keywordPath)
+		case "not":
+			compiled.not, err = compileJSONSchema(value, keywordPath)
+		case "allOf":
+			compiled.allOf, err = compileSchemas(value, keywordPath)
+		case "anyOf":
+			compiled.anyOf, err = compileSchemas(value, keywordPath)
+		case "oneOf":
+			compiled.oneOf, err = compileSchemas(value, keywordPath)
+		case "minProperties":
+			compiled.minProperties, err = compileCount(value, keywordPath)
+		case "maxProperties":
+			compiled.maxProperties, err = compileCount(value, keywordPath)
+		case "minItems":
+			compiled.minItems, err = compileCount(value, keywordPath)
+		case "maxItems":
+			compiled.maxItems, err = compileCount(value, keywordPath)
+		case "minLength":
+			compiled.minLength, err = compileCount(value, keywordPath)
+		case "maxLength":
+			compiled.maxLength, err = compileCount(value, keywordPath)
+		case "minimum":
+			compiled.minimum, err = compileNumber(value, keywordPath)
+		case "maximum":
+			compiled.maximum, err = compileNumber(value, keywordPath)
+		case "exclusiveMinimum":
+			compiled.exclusiveMin, err = compileNumber(value, keywordPath)
+		case "exclusiveMaximum":
+			compiled.exclusiveMax, err = compileNumber(value, keywordPath)
+		case "multipleOf":
+			if compiled.multipleOf, err = compileNumber(value, keywordPath); err == nil && *compiled.multipleOf <= 0 {
+				err = fmt.Errorf("%s should be greater than 0", keywordPath)
+			}
+		case "pattern":
+			pattern, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s should be a string", keywordPath)
+			}
+			if compiled.pattern, err = regexp.Compile(pattern); err != nil {
+				err = fmt.Errorf("%s: %s", keywordPath, err.Error())
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return compiled, nil
+}
+
+func compileTypes(value interface{}, path string) ([]string, error) {
+	var types []string
+	if name, ok := value.(string); ok {
+		types = []string{name}
+	} else {
+		var err error
+		if types, err = compileStrings(value, path); err != nil {
+			return nil, fmt.Errorf("%s should be a string or an array of strings", path)
+		}
+	}
+	for _, name := range types {
+		if !jsonTypes[name] {
+			return nil, fmt.Errorf("%s: unknown type '%s'", path, name)
+		}
+	}
+	return types, nil
+}
+
+func compileStrings(value interface{}, path string) ([]string, error) {
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s should be an array of strings", path)
+	}
+	strings := make([]string, 0, len(values))
+	for _, item := range values {
+		str, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s should be an array of strings", path)
+		}
+		strings = append(strings, str)
+	}
+	return strings, nil
+}
+
+func compileSchemas(value interface{}, path string) ([]*jsonSchema, error) {
+	values, ok := value.([]interface{})
+	if !ok || len(values) == 0 {
+		return nil, fmt.Errorf("%s should be a non-empty array of schemas", path)
+	}
+	schemas := make([]*jsonSchema, 0, len(values))
+	for idx, item := range values {
+		compiled, err := compileJSONSchema(item, fmt.Sprintf("%s/%d", path, idx))
+		if err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, compiled)
+	}
+	return schemas, nil
+}
+
+func compileNumber(value interface{}, path string) (*float64, error) {
+	number, ok := value.(float64)
+	if !ok {
+		return nil, fmt.Errorf("%s should be a number", path)
+	}
+	return &number, nil
+}
+
+func compileCount(value interface{}, path string) (*int, error) {
+	number, ok := value.(float64)
+	if !ok || number < 0 || number != math.Trunc(number) {
+		return nil, fmt.Errorf("%s should be a non-negative integer", path)
+	}
+	count := int(number)
+	return &count, nil
+}
+
+func (compiled *jsonSchema) validate(value interface{}, path string) error {
+	if compiled.allow != nil {
+		if !*compiled.allow {
+			return fmt.Errorf("%s: value is not allowed", path)
+		}
+		return nil
+	}
+
+	if len(compiled.types) > 0 && !matchesType(value, compiled.types) {
+		return fmt.Errorf("%s: expected %v, actual %s", path, compiled.types, typeOf(value))
+	}
+	if compiled.enum != nil && !inEnum(value, compiled.enum) {
+		return fmt.Errorf("%s: value is not one of allowed values", path)
+	}
+
+	var err error
+	switch value := value.(type) {
+	case map[string]interface{}:
+		err = compiled.validateObject(value, path)
+	case []interface{}:
+		err = compiled.validateArray(value, path)
+	case float64:
+		err = compiled.validateNumber(value, path)
+	case string:
+		err = compiled.validateString(value, path)
+	}
+	if err != nil {
+		return err
+	}
+
+	return compiled.validateCombinations(value, path)
+}
+
+func (compiled *jsonSchema) validateObject(object map[string]interface{}, path string) error {
+	for _, name := range compiled.required {
+		if _, ok := object[name]; !ok {
+			return fmt.Errorf("%s: required property '%s' is missing", path, name)
+		}
+	}
+	if compiled.minProperties != nil && len(object) < *compiled.minProperties {
+		return fmt.Errorf("%s: expected at least %d properties, actual %d", path, *compiled.minProperties, len(object))
+	}
+	if compiled.maxProperties != nil && len(object) > *compiled.maxProperties {
+		return fmt.Errorf("%s: expected at most %d properties, actual %d", path, *compiled.maxProperties, len(object))
+	}
+
+	// members are checked in order of names, so the same body always gets the same error
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		member, ok := compiled.properties[name]
+		if !ok {
+			member = compiled.additional
+		}
+		if member == nil {
+			continue
+		}
+		if err := member.validate(object[name], path+"."+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (compiled *jsonSchema) validateArray(array []interface{}, path string) error {
+	if compiled.minItems != nil && len(array) < *compiled.minItems {
+		return fmt.Errorf("%s: expected at least %d items, actual %d", path, *compiled.minItems, len(array))
+	}
+	if compiled.maxItems != nil && len(array) > *compiled.maxItems {
+		return fmt.Errorf("%s: expected at most %d items, actual %d", path, *compiled.maxItems, len(array))
+	}
+	if compiled.items == nil {
+		return nil
+	}
+	for idx, item := range array {
+		if err := compiled.items.validate(item, fmt.Sprintf("%s[%d]", path, idx)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (compiled *jsonSchema) validateNumber(number float64, path string) error {
+	if compiled.minimum != nil && number < *compiled.minimum {
+		return fmt.Errorf("%s: %v is less than minimum %v", path, number, *compiled.minimum)
+	}
+	if compiled.maximum != nil && number > *compiled.maximum {
+		return fmt.Errorf("%s: %v is greater than maximum %v", path, number, *compiled.maximum)
+	}
+	if compiled.exclusiveMin != nil && number <= *compiled.exclusiveMin {
+		return fmt.Errorf("%s: %v is not greater than %v", path, number, *compiled.exclusiveMin)
+	}
+	if compiled.exclusiveMax != nil && number >= *compiled.exclusiveMax {
+		return fmt.Errorf("%s: %v is not less than %v", path, number, *compiled.exclusiveMax)
+	}
+	if compiled.multipleOf != nil {
+		quotient := number / *compiled.multipleOf
+		if quotient != math.Trunc(quotient) {
+			return fmt.Errorf("%s: %v is not a multiple of %v", path, number, *compiled.multipleOf)
+		}
+	}
+	return nil
+}
+
+func (compiled *jsonSchema) validateString(str string, path string) error {
+	length := utf8.RuneCountInString(str)
+	if compiled.minLength != nil && length < *compiled.minLength {
+		return fmt.Errorf("%s: expected at least %d characters, actual %d", path, *compiled.minLength, length)
+	}
+	if compiled.maxLength != nil && length > *compiled.maxLength {
+		return fmt.Errorf("%s: expected at most %d characters, actual %d", path, *compiled.maxLength, length)
+	}
+	if compiled.pattern != nil && !compiled.pattern.MatchString(str) {
+		return fmt.Errorf("%s: value does not match pattern '%s'", path, compiled.pattern.String())
+	}
+	return nil
+}
+
+func (compiled *jsonSchema) validateCombinations(value interface{}, path string) error {
+	for _, sub := range compiled.allOf {
+		if err := sub.validate(value, path); err != nil {
+			return err
+		}
+	}
+	if len(compiled.anyOf) > 0 {
+		matched := false
+		for _, sub := range compiled.anyOf {
+			if sub.validate(value, path) == nil {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: value does not match any of anyOf schemas", path)
+		}
+	}
+	if len(compiled.oneOf) > 0 {
+		matched := 0
+		for _, sub := range compiled.oneOf {
+			if sub.validate(value, path) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fmt.Errorf("%s: value matches %d of oneOf schemas instead of exactly one", path, matched)
+		}
+	}
+	if compiled.not != nil && compiled.not.validate(value, path) == nil {
+		return fmt.Errorf("%s: value matches schema it should not", path)
+	}
+	return nil
+}
+
+func matchesType(value interface{}, types []string) bool {
+	actual := typeOf(value)
+	for _, expected := range types {
+		if expected == actual {
+			return true
+		}
+		if expected == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+func typeOf(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case float64:
+		if value == math.Trunc(value) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	}
+	return "unknown"
+}
+
+func inEnum(value interface{}, enum []interface{}) bool {
+	for _, allowed := range enum {
+		if reflect.DeepEqual(value, allowed) {
+			return true
+		}
+	}
+	return false
+}
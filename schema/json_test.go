@@ -0,0 +1,155 @@
+package schema_test
+
+import (
+	"testing"
+
+	"github.com/valinurovam/garagemq/schema"
+)
+
+func TestNew_Failed(t *testing.T) {
+	definitions := []string{
+		``,
+		`{`,
+		`"object"`,
+		`{"type": "record"}`,
+		`{"type": 1}`,
+		`{"required": "id"}`,
+		`{"properties": {"id": 1}}`,
+		`{"minLength": -1}`,
+		`{"maxItems": 1.5}`,
+		`{"minimum": "1"}`,
+		`{"multipleOf": 0}`,
+		`{"pattern": "("}`,
+		`{"anyOf": []}`,
+		`{"items": {"type": "record"}}`,
+	}
+
+	for _, definition := range definitions {
+		if _, err := schema.New(schema.TypeJSON, definition); err == nil {
+			t.Fatalf("Expected error on schema '%s'", definition)
+		}
+	}
+
+	if _, err := schema.New("avro", `{}`); err == nil {
+		t.Fatal("Expected error on unsupported schema type")
+	}
+}
+
+func TestJSONValidator_Validate(t *testing.T) {
+	definition := `{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"type": "object",
+		"required": ["id", "kind"],
+		"additionalProperties": false,
+		"properties": {
+			"id": {"type": "integer", "minimum": 1},
+			"kind": {"enum": ["invoice", "receipt"]},
+			"amount": {"type": "number", "exclusiveMinimum": 0, "multipleOf": 0.5},
+			"currency": {"type": "string", "pattern": "^[A-Z]{3}$"},
+			"note": {"type": ["string", "null"], "maxLength": 5},
+			"tags": {"type": "array", "items": {"type": "string", "minLength": 1}, "maxItems": 2},
+			"payer": {"oneOf": [
+				{"type": "object", "required": ["account"]},
+				{"type": "object", "required": ["card"]}
+			]}
+		}
+	}`
+	validator, err := schema.New("", definition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validator.Type() != schema.TypeJSON || validator.Definition() != definition {
+		t.Fatal("Expected JSON validator keeps its definition")
+	}
+
+	cases := map[string]bool{
+		`{"id": 1, "kind": "invoice"}`:                                     true,
+		`{"id": 1, "kind": "invoice", "amount": 10.5, "currency": "EUR"}`:  true,
+		`{"id": 1, "kind": "invoice", "note": null, "tags": ["a", "b"]}`:   true,
+		`{"id": 1, "kind": "invoice", "note": "ключи"}`:                    true,
+		`{"id": 1, "kind": "invoice", "payer": {"card": "visa"}}`:          true,
+		` {"id": 1, "kind": "invoice"} `:                                   true,
+		`{"id": 1}`:                                                        false,
+		`{"id": 0, "kind": "invoice"}`:                                     false,
+		`{"id": 1.5, "kind": "invoice"}`:                                   false,
+		`{"id": "1", "kind": "invoice"}`:                                   false,
+		`{"id": 1, "kind": "order"}`:                                       false,
+		`{"id": 1, "kind": "invoice", "amount": 0}`:                        false,
+		`{"id": 1, "kind": "invoice", "amount": 10.25}`:                    false,
+		`{"id": 1, "kind": "invoice", "currency": "eur"}`:                  false,
+		`{"id": 1, "kind": "invoice", "note": "longer"}`:                   false,
+		`{"id": 1, "kind": "invoice", "tags": ["a", ""]}`:                  false,
+		`{"id": 1, "kind": "invoice", "tags": ["a", "b", "c"]}`:            false,
+		`{"id": 1, "kind": "invoice", "extra": true}`:                      false,
+		`{"id": 1, "kind": "invoice", "payer": {"account": 1, "card": 2}}`: false,
+		`[{"id": 1, "kind": "invoice"}]`:                                   false,
+		`{"id": 1, "kind": "invoice"} {}`:                                  false,
+		`not json`:                                                         false,
+		``:                                                                 false,
+	}
+
+	for body, expected := range cases {
+		err := validator.Validate([]byte(body))
+		if expected && err != nil {
+			t.Fatalf("Expected body '%s' is valid, actual error %s", body, err)
+		}
+		if !expected && err == nil {
+			t.Fatalf("Expected body '%s' is invalid", body)
+		}
+	}
+}
+
+func TestJSONValidator_BooleanSchema(t *testing.T) {
+	validator, err := schema.New(schema.TypeJSON, `{"properties": {"id": true, "secret": false}, "not": {"type": "array"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := validator.Validate([]byte(`{"id": [1, "a"]}`)); err != nil {
+		t.Fatal("Expected any value allowed by true schema", err)
+	}
+	if validator.Validate([]byte(`{"secret": 1}`)) == nil {
+		t.Fatal("Expected no value allowed by false schema")
+	}
+	if validator.Validate([]byte(`[]`)) == nil {
+		t.Fatal("Expected value matching not schema is invalid")
+	}
+}
+
+type lengthValidator struct {
+	definition string
+}
+
+func (validator *lengthValidator) Validate(body []byte) error {
+	return nil
+}
+
+func (validator *lengthValidator) Type() string {
+	return "length"
+}
+
+func (validator *lengthValidator) Definition() string {
+	return validator.definition
+}
+
+func TestRegister(t *testing.T) {
+	schema.Register("length", func(definition string) (schema.Validator, error) {
+		return &lengthValidator{definition: definition}, nil
+	})
+
+	validator, err := schema.New("length", "10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validator.Type() != "length" {
+		t.Fatalf("Expected registered validator, actual %s", validator.Type())
+	}
+
+	jsonValidator, _ := schema.New(schema.TypeJSON, "10")
+	if schema.Equal(validator, jsonValidator) {
+		t.Fatal("Expected validators of different types are not equal")
+	}
+	if !schema.Equal(nil, nil) || schema.Equal(validator, nil) {
+		t.Fatal("Expected nil validator equal to nil only")
+	}
+}
@@ -0,0 +1,70 @@
+package schema
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// TypeJSON is the type of JSON Schema validator, it is used if schema type is not given
+const TypeJSON = "json"
+
+// Validator checks message bodies against schema
+type Validator interface {
+	// Validate returns error describing the first violation of schema, nil if body conforms to it
+	Validate(body []byte) error
+	// Type returns schema type validator is created for
+	Type() string
+	// Definition returns schema definition validator is created from
+	Definition() string
+}
+
+// Factory creates validator from schema definition, error is returned for invalid definition
+type Factory func(definition string) (Validator, error)
+
+var factoriesLock sync.RWMutex
+var factories = map[string]Factory{
+	TypeJSON: NewJSONValidator,
+}
+
+// Register adds validator type selectable by schema type, validator of already registered type is replaced
+func Register(schemaType string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	factories[schemaType] = factory
+}
+
+// New returns validator of schema type created from definition
+func New(schemaType string, definition string) (Validator, error) {
+	if schemaType == "" {
+		schemaType = TypeJSON
+	}
+
+	factoriesLock.RLock()
+	factory, ok := factories[schemaType]
+	factoriesLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported schema type '%s', supported types are %v", schemaType, Types())
+	}
+	return factory(definition)
+}
+
+// Types returns registered schema types
+func Types() []string {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+	types := make([]string, 0, len(factories))
+	for schemaType := range factories {
+		types = append(types, schemaType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Equal returns are validators created from the same schema, nil validators are equal to each other only
+func Equal(validatorA Validator, validatorB Validator) bool {
+	if validatorA == nil || validatorB == nil {
+		return validatorA == validatorB
+	}
+	return validatorA.Type() == validatorB.Type() && validatorA.Definition() == validatorB.Definition()
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// acceptLimiter paces accepting of new connections with token bucket shared by all listeners
+// Bucket holds up to burst tokens and is refilled with rate tokens per second,
+// connections over the limit wait in listen backlog until token is available
+type acceptLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newAcceptLimiter returns limiter of rate connections per second, nil if rate is not positive
+func newAcceptLimiter(rate int, burst int) *acceptLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &acceptLimiter{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait takes token from bucket, blocking until it is refilled if bucket is empty
+// Taken tokens are reserved at once, so concurrent waiters are released one by one at limiter rate
+func (limiter *acceptLimiter) wait() {
+	if limiter == nil {
+		return
+	}
+
+	limiter.lock.Lock()
+	now := time.Now()
+	limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.rate
+	if limiter.tokens > limiter.burst {
+		limiter.tokens = limiter.burst
+	}
+	limiter.last = now
+	limiter.tokens--
+	delay := time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+	limiter.lock.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/config"
+)
+
+// accessLog writes JSON entries of publishes and consumer registrations of AMQP clients into separate sink for audit
+// Every n-th publish is written if publishes are sampled, entries above rate limit are dropped
+// and their number is written with the first entry of the next second
+type accessLog struct {
+	logger    *log.Logger
+	sample    uint64
+	published uint64
+
+	limit     int
+	limitLock sync.Mutex
+	window    int64
+	written   int
+	dropped   int
+}
+
+func newAccessLog(output io.Writer, cfg config.AccessLog) *accessLog {
+	logger := log.New()
+	logger.Out = output
+	logger.Formatter = &log.JSONFormatter{}
+	logger.Level = log.InfoLevel
+
+	result := &accessLog{logger: logger, limit: cfg.RateLimit}
+	if cfg.PublishSample > 1 {
+		result.sample = uint64(cfg.PublishSample)
+	}
+	return result
+}
+
+// initAccessLog opens sink of access log from config, access log is disabled without path
+func (srv *Server) initAccessLog() {
+	path := srv.getConfig().AccessLog.Path
+	if path == "" {
+		return
+	}
+
+	var output io.Writer
+	switch path {
+	case "stdout":
+		output = os.Stdout
+	case "stderr":
+		output = os.Stderr
+	default:
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+		if err != nil {
+			panic(err)
+		}
+		output = file
+	}
+
+	log.WithField("path", path).Info("Initialize access log")
+	srv.accessLog = newAccessLog(output, srv.getConfig().AccessLog)
+}
+
+// allow returns whether entry fits rate limit of the current second
+func (accessLog *accessLog) allow() bool {
+	if accessLog.limit <= 0 {
+		return true
+	}
+
+	now := time.Now().Unix()
+	accessLog.limitLock.Lock()
+	defer accessLog.limitLock.Unlock()
+	if now != accessLog.window {
+		if accessLog.dropped > 0 {
+			accessLog.logger.WithField("dropped", accessLog.dropped).Info("dropped")
+		}
+		accessLog.window = now
+		accessLog.written = 0
+		accessLog.dropped = 0
+	}
+	if accessLog.written >= accessLog.limit {
+		accessLog.dropped++
+		return false
+	}
+	accessLog.written++
+	return true
+}
+
+// logPublish writes entry of message published on channel and routed into given number of queues
+func (accessLog *accessLog) logPublish(channel *Channel, message *amqp.Message, routed int) {
+	if accessLog == nil {
+		return
+	}
+	if accessLog.sample > 0 && (atomic.AddUint64(&accessLog.published, 1)-1)%accessLog.sample != 0 {
+		return
+	}
+	if !accessLog.allow() {
+		return
+	}
+
+	fields := accessLog.connectionFields(channel)
+	fields["exchange"] = message.Exchange
+	fields["routing_key"] = message.RoutingKey
+	fields["size"] = message.BodySize
+	fields["queues"] = routed
+	if accessLog.sample > 0 {
+		fields["sample"] = accessLog.sample
+	}
+	accessLog.logger.WithFields(fields).Info("publish")
+}
+
+// logConsume writes entry of consumer registered on channel
+func (accessLog *accessLog) logConsume(channel *Channel, queues []string, consumerTag string) {
+	if accessLog == nil || !accessLog.allow() {
+		return
+	}
+
+	fields := accessLog.connectionFields(channel)
+	fields["queue"] = queues[0]
+	if len(queues) > 1 {
+		fields["queues"] = queues
+	}
+	fields["consumer_tag"] = consumerTag
+	accessLog.logger.WithFields(fields).Info("consume")
+}
+
+func (accessLog *accessLog) connectionFields(channel *Channel) log.Fields {
+	return log.Fields{
+		"user":       channel.conn.userName,
+		"vhost":      channel.conn.vhostName,
+		"connection": channel.conn.id,
+		"channel":    channel.id,
+		"addr":       channel.conn.GetRemoteAddr().String(),
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/valinurovam/garagemq/consumer"
 	"github.com/valinurovam/garagemq/qos"
 	"github.com/valinurovam/garagemq/queue"
+	"github.com/valinurovam/garagemq/spool"
 )
 
 func (channel *Channel) basicRoute(method amqp.Method) *amqp.Error {
@@ -54,6 +55,7 @@ func (channel *Channel) basicPublish(method *amqp.BasicPublish) (err *amqp.Error
 		return amqp.NewChannelError(amqp.NotImplemented, "Immediate = true", method.ClassIdentifier(), method.MethodIdentifier())
 	}
 
+	// disabled exchange is checked on routing, so message is rejected after its content is received
 	if _, err = channel.getExchangeWithError(method.Exchange, method); err != nil {
 		return err
 	}
@@ -70,11 +72,23 @@ func (channel *Channel) basicPublish(method *amqp.BasicPublish) (err *amqp.Error
 }
 
 func (channel *Channel) basicConsume(method *amqp.BasicConsume) (err *amqp.Error) {
+	if err = channel.resolveQueueName(&method.Queue, method); err != nil {
+		return err
+	}
+	if method.Queue == replyToQueue {
+		return channel.basicConsumeReply(method)
+	}
+	// existing consumers drain queues in maintenance mode, new ones could prevent it
+	if channel.server.IsMaintenance() {
+		return amqp.NewChannelError(amqp.PreconditionFailed, "server is in maintenance mode", method.ClassIdentifier(), method.MethodIdentifier())
+	}
+
 	var cmr *consumer.Consumer
 	if cmr, err = channel.addConsumer(method); err != nil {
 		return err
 	}
 
+	channel.server.accessLog.logConsume(channel, cmr.Queues(), cmr.Tag())
 	if !method.NoWait {
 		channel.SendMethod(&amqp.BasicConsumeOk{ConsumerTag: cmr.Tag()})
 	}
@@ -84,22 +98,54 @@ func (channel *Channel) basicConsume(method *amqp.BasicConsume) (err *amqp.Error
 	return nil
 }
 
+// basicConsumeReply starts direct reply-to consumer, there is no real queue to consume from
+func (channel *Channel) basicConsumeReply(method *amqp.BasicConsume) (err *amqp.Error) {
+	var tag string
+	if tag, err = channel.addReplyConsumer(method); err != nil {
+		return err
+	}
+
+	channel.server.accessLog.logConsume(channel, []string{replyToQueue}, tag)
+	if !method.NoWait {
+		channel.SendMethod(&amqp.BasicConsumeOk{ConsumerTag: tag})
+	}
+
+	return nil
+}
+
 func (channel *Channel) basicCancel(method *amqp.BasicCancel) (err *amqp.Error) {
+	if channel.removeReplyConsumer(method.ConsumerTag) {
+		if !method.NoWait {
+			channel.SendMethod(&amqp.BasicCancelOk{ConsumerTag: method.ConsumerTag})
+		}
+		return nil
+	}
 	if _, ok := channel.consumers[method.ConsumerTag]; !ok {
 		return amqp.NewChannelError(amqp.NotFound, "Consumer not found", method.ClassIdentifier(), method.MethodIdentifier())
 	}
 	channel.removeConsumer(method.ConsumerTag)
-	channel.SendMethod(&amqp.BasicCancelOk{ConsumerTag: method.ConsumerTag})
+	if !method.NoWait {
+		channel.SendMethod(&amqp.BasicCancelOk{ConsumerTag: method.ConsumerTag})
+	}
 	return nil
 }
 
 func (channel *Channel) basicGet(method *amqp.BasicGet) (err *amqp.Error) {
 	var qu *queue.Queue
 	var message *amqp.Message
+	if err = channel.resolveQueueName(&method.Queue, method); err != nil {
+		return err
+	}
 	if qu, err = channel.getQueueWithError(method.Queue, method); err != nil {
 		return err
 	}
 
+	// paused queue holds messages as it is empty
+	if qu.IsPaused() {
+		channel.SendMethod(&amqp.BasicGetEmpty{})
+		return nil
+	}
+
 	if method.NoAck {
 		message = qu.Pop()
 	} else {
@@ -125,12 +171,16 @@ func (channel *Channel) basicGet(method *amqp.BasicGet) (err *amqp.Error) {
 
 	channel.SendContent(&amqp.BasicGetOk{
 		DeliveryTag:  dTag,
-		Redelivered:  false,
+		Redelivered:  message.DeliveryCount > 0,
 		Exchange:     message.Exchange,
 		RoutingKey:   message.RoutingKey,
 		MessageCount: 1,
 	}, message)
 
+	if method.NoAck {
+		spool.Release(message)
+	}
+
 	channel.server.GetMetrics().Get.Counter.Inc(1)
 	channel.metrics.Get.Counter.Inc(1)
 	qu.GetMetrics().Get.Counter.Inc(1)
@@ -0,0 +1,20 @@
+package server
+
+import (
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// basicRoutedCapability is garagemq extension, client advertising it in connection.start-ok capabilities
+// gets basic.routed after each published message
+const basicRoutedCapability = "basic.routed"
+
+// sendRouted reports number of queues message is pushed into to publisher, 0 for unroutable, rejected or dropped one
+// Methods are sent in publish order, in confirm mode delivery tag of message is set, so publisher matches
+// basic.routed with confirm of the same message, which may be received earlier or later
+func (channel *Channel) sendRouted(message *amqp.Message, routed int) {
+	var deliveryTag uint64
+	if message.ConfirmMeta != nil {
+		deliveryTag = message.ConfirmMeta.DeliveryTag
+	}
+	channel.SendMethod(&amqp.BasicRouted{DeliveryTag: deliveryTag, QueueCount: uint32(routed)})
+}
@@ -3,6 +3,8 @@ package server
 import (
 	"bytes"
 	"fmt"
+	"math"
+	"runtime"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -13,9 +15,11 @@ import (
 	"github.com/valinurovam/garagemq/amqp"
 	"github.com/valinurovam/garagemq/consumer"
 	"github.com/valinurovam/garagemq/exchange"
+	"github.com/valinurovam/garagemq/filter"
 	"github.com/valinurovam/garagemq/metrics"
 	"github.com/valinurovam/garagemq/qos"
 	"github.com/valinurovam/garagemq/queue"
+	"github.com/valinurovam/garagemq/spool"
 )
 
 const (
@@ -45,7 +49,7 @@ type Channel struct {
 	conn               *Connection
 	server             *Server
 	incoming           chan *amqp.Frame
-	outgoing           chan *amqp.Frame
+	sendLock           sync.Mutex
 	logger             *log.Entry
 	statusLock         sync.RWMutex
 	status             int
@@ -53,22 +57,52 @@ type Channel struct {
 	currentMessage     *amqp.Message
 	cmrLock            sync.Mutex
 	consumers          map[string]*consumer.Consumer
+	replyTo            *directReply
 	qos                *qos.AmqpQos
 	consumerQos        *qos.AmqpQos
+	unackedLimit       *qos.AmqpQos
 	deliveryTag        uint64
 	confirmDeliveryTag uint64
 	confirmLock        sync.Mutex
 	confirmQueue       []*amqp.ConfirmMeta
+	confirmFlush       chan struct{}
+	confirmDone        chan struct{}
 	ackLock            sync.Mutex
 	ackStore           map[uint64]*UnackedMessage
 	metrics            *ChannelMetricsState
+	spoolWriter        *spool.Writer
+	// requeuedTags are delivery tags of unacked messages requeued out of band, their acks and rejects are ignored
+	requeuedTags map[uint64]struct{}
+	// opened is 1 while channel is counted in server channels gauge
+	opened int32
+	// ackTimeoutCheck is 1 while unacked messages are checked for consumer timeout
+	ackTimeoutCheck int32
+	// unackedLimitHit is 1 while consumers are stopped by channel unacked messages limit
+	unackedLimitHit int32
+	// the last error server closed channel with, cleared when channel is opened again
+	lastError lastErrorHolder
+	// name of the last queue declared on channel, methods with empty queue name refer to it
+	lastQueue string
 }
 
 // UnackedMessage represents the unacknowledged message
 type UnackedMessage struct {
-	cTag  string
-	msg   *amqp.Message
-	queue string
+	cTag        string
+	msg         *amqp.Message
+	queue       string
+	deliveredAt time.Time
+	// ack timeout of message, 0 - no timeout
+	timeout time.Duration
+}
+
+// UnackedMessageInfo represents read-only view of the unacknowledged message
+type UnackedMessageInfo struct {
+	DeliveryTag uint64
+	ConsumerTag string
+	Queue       string
+	MessageID   uint64
+	Size        uint64
+	DeliveredAt time.Time
 }
 
 // NewChannel returns new instance of Channel
@@ -81,14 +115,16 @@ func NewChannel(id uint16, conn *Connection) *Channel {
 		// for incoming channel much capacity is good for performance
 		// but it is difficult to implement processing already queued frames on shutdown or connection close
 		incoming:     make(chan *amqp.Frame, 1),
-		outgoing:     conn.outgoing,
 		status:       channelNew,
-		protoVersion: conn.server.protoVersion,
+		protoVersion: conn.protoVersion,
 		consumers:    make(map[string]*consumer.Consumer),
 		qos:          qos.NewAmqpQos(0, 0),
 		consumerQos:  qos.NewAmqpQos(0, 0),
+		unackedLimit: qos.NewAmqpQos(conn.server.getConfig().Connection.ChannelMaxUnacked, 0),
 		ackStore:     make(map[uint64]*UnackedMessage),
+		requeuedTags: make(map[uint64]struct{}),
 		confirmQueue: make([]*amqp.ConfirmMeta, 0),
+		confirmFlush: make(chan struct{}, 1),
 	}
 
 	channel.logger = log.WithFields(log.Fields{
@@ -123,7 +159,6 @@ func (channel *Channel) start() {
 func (channel *Channel) handleIncoming() {
 	buffer := bytes.NewReader([]byte{})
 
-	// TODO
 	// @spec-note
 	// After sending channel.close, any received methods except Close and Close­OK MUST be discarded.
 	// The response to receiving a Close after sending Close must be to send Close­Ok.
@@ -141,20 +176,36 @@ func (channel *Channel) handleIncoming() {
 			case amqp.FrameMethod:
 				buffer.Reset(frame.Payload)
 				method, err := amqp.ReadMethod(buffer, channel.protoVersion)
-				channel.logger.Debug("Incoming method <- " + method.Name())
 				if err != nil {
 					channel.logger.WithError(err).Error("Error on handling frame")
 					channel.sendError(amqp.NewConnectionError(amqp.FrameError, err.Error(), 0, 0))
+					continue
+				}
+				channel.logger.Debug("Incoming method <- " + method.Name())
+
+				if channel.isClosing() && !isChannelCloseMethod(method) {
+					continue
+				}
+
+				if channel.id == 0 && channel.conn.isClosing() && !isConnectionCloseMethod(method) {
+					continue
 				}
 
 				if err := channel.handleMethod(method); err != nil {
 					channel.sendError(err)
 				}
 			case amqp.FrameHeader:
+				// content of discarded method, e.g. basic.publish that caused channel error
+				if channel.isClosing() {
+					continue
+				}
 				if err := channel.handleContentHeader(frame); err != nil {
 					channel.sendError(err)
 				}
 			case amqp.FrameBody:
+				if channel.isClosing() {
+					continue
+				}
 				if err := channel.handleContentBody(frame); err != nil {
 					channel.sendError(err)
 				}
@@ -163,11 +214,37 @@ func (channel *Channel) handleIncoming() {
 	}
 }
 
+func (channel *Channel) isClosing() bool {
+	return channel.status == channelClosing
+}
+
+func isChannelCloseMethod(method amqp.Method) bool {
+	switch method.(type) {
+	case *amqp.ChannelClose, *amqp.ChannelCloseOk:
+		return true
+	}
+	return false
+}
+
+func isConnectionCloseMethod(method amqp.Method) bool {
+	switch method.(type) {
+	case *amqp.ConnectionClose, *amqp.ConnectionCloseOk:
+		return true
+	}
+	return false
+}
+
 func (channel *Channel) sendError(err *amqp.Error) {
 	channel.logger.Error(err)
+	channel.setLastError(err)
 	switch err.ErrorType {
 	case amqp.ErrorOnChannel:
+		// only current channel is closed, connection and other channels stay alive
+		// deliveries are stopped at once, unacked messages are requeued on close-ok
 		channel.status = channelClosing
+		channel.currentMessage = nil
+		channel.discardSpool()
+		channel.stopConsumers()
 		channel.SendMethod(&amqp.ChannelClose{
 			ReplyCode: err.ReplyCode,
 			ReplyText: err.ReplyText,
@@ -175,14 +252,16 @@ func (channel *Channel) sendError(err *amqp.Error) {
 			MethodId:  err.MethodID,
 		})
 	case amqp.ErrorOnConnection:
+		// connection is dropped on close-ok from client or after closeOkTimeout
 		ch := channel.conn.getChannel(0)
-		if ch != nil {
+		if ch != nil && channel.conn.setClosing() {
 			ch.SendMethod(&amqp.ConnectionClose{
 				ReplyCode: err.ReplyCode,
 				ReplyText: err.ReplyText,
 				ClassId:   err.ClassID,
 				MethodId:  err.MethodID,
 			})
+			go channel.conn.waitCloseOk()
 		}
 	}
 }
@@ -221,6 +300,124 @@ func (channel *Channel) handleContentHeader(headerFrame *amqp.Frame) *amqp.Error
 		return amqp.NewConnectionError(amqp.FrameError, "error on parsing content header frame", 0, 0)
 	}
 
+	// @spec-note
+	// Content with zero-size body has no body frames, so message is complete with its header
+	if channel.currentMessage.Header.BodySize == 0 {
+		return channel.publishMessage()
+	}
+
+	// large body is written into spool file frame by frame instead of memory
+	if channel.server.spool.ShouldSpool(channel.currentMessage.Header.BodySize) {
+		if channel.spoolWriter, err = channel.server.spool.Create(); err != nil {
+			channel.logger.WithError(err).Error("Error on creating spool file")
+			return amqp.NewConnectionError(amqp.InternalError, "error on spooling message body", 0, 0)
+		}
+		channel.currentMessage.SpoolPath = channel.spoolWriter.Path()
+	}
+
+	return nil
+}
+
+// discardSpool removes body file of not completely received message
+func (channel *Channel) discardSpool() {
+	if channel.spoolWriter != nil {
+		channel.spoolWriter.Discard()
+		channel.spoolWriter = nil
+	}
+}
+
+// queueMessage returns message to push into queue
+// Spooled message is copied with its own link to body file, so each queue can release body independently
+func (srv *Server) queueMessage(message *amqp.Message) (*amqp.Message, error) {
+	if message.SpoolPath == "" {
+		return message, nil
+	}
+
+	path, err := srv.spool.Link(message.SpoolPath)
+	if err != nil {
+		return nil, err
+	}
+	queueMessage := *message
+	queueMessage.SpoolPath = path
+
+	return &queueMessage, nil
+}
+
+// checkUserID validates that user-id property, if set, matches the authenticated user of the connection
+func (channel *Channel) checkUserID(message *amqp.Message) *amqp.Error {
+	if !channel.server.getConfig().Security.UserIDCheck {
+		return nil
+	}
+
+	userID := message.Header.PropertyList.UserId
+	if userID == nil || *userID == channel.conn.userName {
+		return nil
+	}
+
+	return amqp.NewChannelError(
+		amqp.AccessRefused,
+		fmt.Sprintf("user_id property set to '%s' but authenticated user was '%s'", *userID, channel.conn.userName),
+		amqp.ClassBasic,
+		amqp.MethodBasicPublish,
+	)
+}
+
+// checkExpiration validates that expiration property, if set, is a non-negative number of milliseconds
+func checkExpiration(message *amqp.Message) *amqp.Error {
+	expiration := message.Header.PropertyList.Expiration
+	if expiration == nil {
+		return nil
+	}
+
+	if _, err := amqp.ParseExpiration(*expiration); err != nil {
+		return amqp.NewChannelError(amqp.PreconditionFailed, err.Error(), amqp.ClassBasic, amqp.MethodBasicPublish)
+	}
+
+	return nil
+}
+
+// matchAdditionalExchanges adds queues matched by exchanges from x-additional-exchanges header into matchedQueues,
+// so message is pushed once into each queue and confirmed as single publish
+// All exchanges are checked before matching, message is not routed at all if any of them is not found
+func matchAdditionalExchanges(vhost *VirtualHost, message *amqp.Message, matchedQueues map[string]bool) *amqp.Error {
+	routes, err := message.GetAdditionalRoutes()
+	if err != nil {
+		return amqp.NewChannelError(amqp.PreconditionFailed, err.Error(), amqp.ClassBasic, amqp.MethodBasicPublish)
+	}
+
+	exchanges := make([]*exchange.Exchange, 0, len(routes))
+	for _, route := range routes {
+		ex := vhost.GetExchange(route.Exchange)
+		if ex == nil {
+			return amqp.NewChannelError(
+				amqp.NotFound,
+				fmt.Sprintf("exchange '%s' not found", route.Exchange),
+				amqp.ClassBasic,
+				amqp.MethodBasicPublish,
+			)
+		}
+		if ex.IsDisabled() {
+			return amqp.NewChannelError(
+				amqp.PreconditionFailed,
+				fmt.Sprintf("exchange '%s' is disabled", route.Exchange),
+				amqp.ClassBasic,
+				amqp.MethodBasicPublish,
+			)
+		}
+		exchanges = append(exchanges, ex)
+	}
+
+	// consumers get message with exchange and routing key it was published with
+	for idx, ex := range exchanges {
+		routed := *message
+		routed.Exchange = routes[idx].Exchange
+		routed.RoutingKey = routes[idx].RoutingKey
+		ex.GetMetrics().MsgIn.Counter.Inc(1)
+		for queueName := range ex.GetMatchedQueues(&routed) {
+			matchedQueues[queueName] = true
+		}
+	}
+
 	return nil
 }
 
@@ -233,79 +430,224 @@ func (channel *Channel) handleContentBody(bodyFrame *amqp.Frame) *amqp.Error {
 		return amqp.NewConnectionError(amqp.FrameError, "unexpected content body frame - no header yet", 0, 0)
 	}
 
-	channel.currentMessage.Append(bodyFrame)
+	if channel.spoolWriter != nil {
+		if err := channel.spoolWriter.Write(bodyFrame.Payload); err != nil {
+			channel.logger.WithError(err).Error("Error on writing spool file")
+			channel.discardSpool()
+			return amqp.NewConnectionError(amqp.InternalError, "error on spooling message body", 0, 0)
+		}
+		channel.currentMessage.BodySize += uint64(len(bodyFrame.Payload))
+	} else {
+		channel.currentMessage.Append(bodyFrame)
+	}
 
 	if channel.currentMessage.BodySize < channel.currentMessage.Header.BodySize {
 		return nil
 	}
 
+	return channel.publishMessage()
+}
+
+// publishMessage routes completely received message into matched queues
+func (channel *Channel) publishMessage() (err *amqp.Error) {
 	vhost := channel.conn.GetVirtualHost()
 	message := channel.currentMessage
-	ex := vhost.GetExchange(message.Exchange)
-	if ex == nil {
-		channel.SendContent(
-			&amqp.BasicReturn{ReplyCode: amqp.NoRoute, ReplyText: "No route", Exchange: message.Exchange, RoutingKey: message.RoutingKey},
-			message,
-		)
-
-		channel.addConfirm(message.ConfirmMeta)
+	channel.currentMessage = nil
+
+	// every received message is written into access log with number of queues it is pushed into,
+	// publisher supporting basic.routed gets that number unless channel is closed by publish
+	var routed int
+	reportRouted := channel.conn.supportsCapability(basicRoutedCapability)
+	if channel.server.accessLog != nil || reportRouted {
+		defer func() {
+			channel.server.accessLog.logPublish(channel, message, routed)
+			if reportRouted && err == nil {
+				channel.sendRouted(message, routed)
+			}
+		}()
+	}
 
-		return nil
+	if channel.spoolWriter != nil {
+		err := channel.spoolWriter.Close()
+		channel.spoolWriter = nil
+		// queues get their own links to body file, so the source one is not needed after routing
+		defer spool.Release(message)
+		if err != nil {
+			channel.logger.WithError(err).Error("Error on closing spool file")
+			return amqp.NewConnectionError(amqp.InternalError, "error on spooling message body", 0, 0)
+		}
+	}
+	if err := channel.checkUserID(message); err != nil {
+		return err
+	}
+	if err := checkExpiration(message); err != nil {
+		return err
+	}
+	if err := channel.resolveReplyTo(message); err != nil {
+		return err
+	}
+	if message.Exchange == exDefaultName && isReplyAddress(message.RoutingKey) {
+		return channel.deliverReply(message)
 	}
-	ex.GetMetrics().MsgIn.Counter.Inc(1)
-	matchedQueues := ex.GetMatchedQueues(message)
 
-	if len(matchedQueues) == 0 {
+	// exchange was checked on basic.publish, but it could be deleted or disabled while content is being received,
+	// so publisher in confirm mode gets basic.nack
+	route, reason, err := vhost.routePublish(message)
+	if err != nil {
+		if reason != "" {
+			return channel.rejectPublish(message, reason, err)
+		}
+		return err
+	}
+	if route.unroutable {
 		if message.Mandatory {
-			channel.SendContent(
-				&amqp.BasicReturn{ReplyCode: amqp.NoRoute, ReplyText: "No route", Exchange: message.Exchange, RoutingKey: message.RoutingKey},
-				message,
-			)
+			channel.returnMessage(message, "No route")
 		}
-
 		channel.addConfirm(message.ConfirmMeta)
+		return nil
+	}
+	// publisher in confirm mode gets basic.nack if any queue is full, message is still pushed into the rest of them
+	if route.overflowed && message.ConfirmMeta != nil {
+		message.ConfirmMeta.Nack = true
+	}
+	if route.rejected {
+		if message.Mandatory && !channel.confirmMode {
+			channel.returnMessage(message, queueOverflowReason)
+		}
+		channel.addConfirm(message.ConfirmMeta)
+		return nil
+	}
+	channel.metrics.Publish.Counter.Inc(1)
 
+	// message is dead-lettered or dropped from all queues it is routed into
+	if len(route.queues) == 0 {
+		channel.addConfirm(message.ConfirmMeta)
 		return nil
 	}
 
-	channel.server.GetMetrics().Publish.Counter.Inc(1)
-	channel.metrics.Publish.Counter.Inc(1)
+	// while disk is full persistent publisher waits here, so it is blocked by TCP backpressure
+	if !channel.server.waitDiskSpace(message, route.queues, channel.conn.ctx.Done()) {
+		return nil
+	}
 
 	if channel.confirmMode {
-		message.ConfirmMeta.ExpectedConfirms = len(matchedQueues)
+		message.ConfirmMeta.ExpectedConfirms = int32(len(route.queues))
 	}
 
-	for queueName := range matchedQueues {
-		qu := channel.conn.GetVirtualHost().GetQueue(queueName)
-		if qu == nil {
-			if message.Mandatory {
-				channel.SendContent(
-					&amqp.BasicReturn{ReplyCode: amqp.NoRoute, ReplyText: "No route", Exchange: message.Exchange, RoutingKey: message.RoutingKey},
-					message,
-				)
-			}
+	routed = len(route.queues)
+	confirms, errPush := channel.server.enqueuePublish(message, route)
+	if errPush != nil {
+		channel.logger.WithError(errPush).Error("Error on linking spool file")
+		return amqp.NewConnectionError(amqp.InternalError, "error on spooling message body", 0, 0)
+	}
 
-			channel.addConfirm(message.ConfirmMeta)
+	// message stored into durable queues is confirmed by storage after it is written,
+	// other queues confirm it at once
+	if channel.confirmMode && message.ConfirmMeta.AddConfirms(confirms) {
+		channel.addConfirm(message.ConfirmMeta)
+	}
+	return nil
+}
 
-			return nil
-		}
+// returnMessage returns mandatory message which is not pushed into any queue to publisher with basic.return
+func (channel *Channel) returnMessage(message *amqp.Message, replyText string) {
+	channel.SendContent(
+		&amqp.BasicReturn{ReplyCode: amqp.NoRoute, ReplyText: replyText, Exchange: message.Exchange, RoutingKey: message.RoutingKey},
+		message,
+	)
+}
+
+// traceMessage tracks stage of traced message, fields logged for slow stage are built only for traced ones
+// Enqueue stage of persistent message includes waiting for disk alarm to be cleared
+func traceMessage(stage string, start int64, message *amqp.Message) int64 {
+	if start == 0 {
+		return 0
+	}
+	return metrics.TraceStage(stage, start, map[string]interface{}{
+		"exchange":   message.Exchange,
+		"routingKey": message.RoutingKey,
+	})
+}
+
+// fanoutWorkers is max number of goroutines pushing single published message into matched queues
+var fanoutWorkers = runtime.GOMAXPROCS(0)
+
+// fanoutMinQueuesPerWorker is min number of queues pushed by each goroutine, narrow fanout is pushed sequentially
+const fanoutMinQueuesPerWorker = 16
+
+// pushToQueues pushes message into each of queues, wide fanout is split between several goroutines
+// Method returns after message is pushed into all queues, so messages of publisher keep their order in every queue
+// Returned number of queues is ones confirmed message at once, e.g. transient or deleted ones
+func (srv *Server) pushToQueues(message *amqp.Message, queues []*queue.Queue) (int32, error) {
+	// message is shared by queues, so it is changed before concurrent pushes
+	message.GenerateSeq()
+	message.MarkEnqueued()
+
+	workers := fanoutWorkers
+	if max := len(queues) / fanoutMinQueuesPerWorker; max < workers {
+		workers = max
+	}
+	if workers <= 1 {
+		return srv.pushToQueuesChunk(message, queues)
+	}
 
-		qu.Push(message)
+	confirms := make([]int32, workers)
+	errs := make([]error, workers)
+	chunkSize := (len(queues) + workers - 1) / workers
+	wg := sync.WaitGroup{}
+	for idx := 1; idx < workers; idx++ {
+		from := idx * chunkSize
+		if from >= len(queues) {
+			break
+		}
+		to := from + chunkSize
+		if to > len(queues) {
+			to = len(queues)
+		}
+		wg.Add(1)
+		go func(idx int, chunk []*queue.Queue) {
+			defer wg.Done()
+			confirms[idx], errs[idx] = srv.pushToQueuesChunk(message, chunk)
+		}(idx, queues[from:to])
+	}
+	confirms[0], errs[0] = srv.pushToQueuesChunk(message, queues[:chunkSize])
+	wg.Wait()
 
-		ex.GetMetrics().MsgOut.Counter.Inc(1)
+	var total int32
+	for idx, err := range errs {
+		if err != nil {
+			return 0, err
+		}
+		total += confirms[idx]
+	}
+	return total, nil
+}
 
-		if channel.confirmMode && message.ConfirmMeta.CanConfirm() && !message.IsPersistent() {
-			channel.addConfirm(message.ConfirmMeta)
+func (srv *Server) pushToQueuesChunk(message *amqp.Message, queues []*queue.Queue) (int32, error) {
+	var confirms int32
+	for _, qu := range queues {
+		queueMessage, err := srv.queueMessage(message)
+		if err != nil {
+			return 0, err
+		}
+		if !qu.Push(queueMessage) {
+			confirms++
 		}
 	}
-	return nil
+	return confirms, nil
 }
 
 // SendMethod send method to client
 // Method will be packed into frame and send to outgoing channel
 func (channel *Channel) SendMethod(method amqp.Method) {
+	channel.sendLock.Lock()
+	defer channel.sendLock.Unlock()
+	channel.sendMethod(method)
+}
+
+func (channel *Channel) sendMethod(method amqp.Method) {
 	var rawMethod = emptyBufferPool.Get()
-	if err := amqp.WriteMethod(rawMethod, method, channel.server.protoVersion); err != nil {
+	if err := amqp.WriteMethod(rawMethod, method, channel.protoVersion); err != nil {
 		logrus.WithError(err).Error("Error")
 	}
 
@@ -321,22 +663,32 @@ func (channel *Channel) SendMethod(method amqp.Method) {
 }
 
 func (channel *Channel) sendOutgoing(frame *amqp.Frame) {
-	select {
-	case <-channel.conn.ctx.Done():
-		if channel.id == 0 {
-			close(channel.outgoing)
-		}
-		return
-	case channel.outgoing <- frame:
-	}
+	channel.conn.outbound.push(channel.conn.ctx.Done(), frame)
 }
 
 // SendContent send message to consumers or returns to publishers
+// Frames of content are sent under sendLock, so consumers, returns and confirms of channel don't interleave them
 func (channel *Channel) SendContent(method amqp.Method, message *amqp.Message) {
-	channel.SendMethod(method)
+	if err := channel.sendContent(method, message); err != nil {
+		// content is already partially sent, so the only way is to drop the connection
+		channel.logger.WithError(err).Error("Error on reading spool file")
+		channel.sendError(amqp.NewConnectionError(amqp.InternalError, "error on reading spooled message body", 0, 0))
+	}
+
+	switch method.(type) {
+	case *amqp.BasicDeliver:
+		channel.metrics.Deliver.Counter.Inc(1)
+	}
+}
+
+func (channel *Channel) sendContent(method amqp.Method, message *amqp.Message) error {
+	channel.sendLock.Lock()
+	defer channel.sendLock.Unlock()
+
+	channel.sendMethod(method)
 
 	var rawHeader = emptyBufferPool.Get()
-	amqp.WriteContentHeader(rawHeader, message.Header, channel.server.protoVersion)
+	amqp.WriteContentHeader(rawHeader, message.Header, channel.protoVersion)
 
 	payload := make([]byte, rawHeader.Len())
 	copy(payload, rawHeader.Bytes())
@@ -344,15 +696,17 @@ func (channel *Channel) SendContent(method amqp.Method, message *amqp.Message) {
 
 	channel.sendOutgoing(&amqp.Frame{Type: byte(amqp.FrameHeader), ChannelID: channel.id, Payload: payload, CloseAfter: false})
 
+	if message.SpoolPath != "" {
+		if err := spool.ReadFrames(message, channel.id, channel.conn.bodyChunkSize(), channel.sendOutgoing); err != nil {
+			return err
+		}
+	}
 	for _, payload := range message.Body {
 		payload.ChannelID = channel.id
 		channel.sendOutgoing(payload)
 	}
 
-	switch method.(type) {
-	case *amqp.BasicDeliver:
-		channel.metrics.Deliver.Counter.Inc(1)
-	}
+	return nil
 }
 
 func (channel *Channel) addConfirm(meta *amqp.ConfirmMeta) {
@@ -366,27 +720,62 @@ func (channel *Channel) addConfirm(meta *amqp.ConfirmMeta) {
 		return
 	}
 	channel.confirmQueue = append(channel.confirmQueue, meta)
+
+	if len(channel.confirmQueue) >= confirmFlushSize {
+		select {
+		case channel.confirmFlush <- struct{}{}:
+		default:
+		}
+	}
 }
 
-func (channel *Channel) sendConfirms() {
-	tick := time.Tick(20 * time.Millisecond)
-	for range tick {
-		if channel.status == channelClosed {
+// sendConfirms sends collected confirms every confirmFlushInterval or as soon as confirmFlushSize of them are collected
+// Contiguous confirmed delivery tags are coalesced into single basic.ack with multiple flag, rejected ones are nacked
+func (channel *Channel) sendConfirms(done chan struct{}) {
+	ticker := time.NewTicker(confirmFlushInterval)
+	defer ticker.Stop()
+
+	batcher := newConfirmBatcher()
+	for {
+		select {
+		case <-done:
 			return
+		case <-ticker.C:
+		case <-channel.confirmFlush:
 		}
+
 		channel.confirmLock.Lock()
 		currentConfirms := channel.confirmQueue
 		channel.confirmQueue = make([]*amqp.ConfirmMeta, 0)
 		channel.confirmLock.Unlock()
+		if len(currentConfirms) == 0 {
+			continue
+		}
 
+		tags := make([]uint64, 0, len(currentConfirms))
+		var nacks []uint64
 		for _, confirm := range currentConfirms {
-			channel.SendMethod(&amqp.BasicAck{
-				DeliveryTag: confirm.DeliveryTag,
-				Multiple:    false,
-			})
-			channel.server.GetMetrics().Confirm.Counter.Inc(1)
-			channel.metrics.Confirm.Counter.Inc(1)
+			if confirm.Nack {
+				nacks = append(nacks, confirm.DeliveryTag)
+				continue
+			}
+			tags = append(tags, confirm.DeliveryTag)
 		}
+		for _, frame := range batcher.add(tags, nacks) {
+			channel.SendMethod(frame)
+		}
+		channel.server.GetMetrics().Confirm.Counter.Inc(int64(len(currentConfirms)))
+		channel.metrics.Confirm.Counter.Inc(int64(len(currentConfirms)))
+	}
+}
+
+// stopConfirms stops sending confirms of closed channel
+func (channel *Channel) stopConfirms() {
+	channel.confirmLock.Lock()
+	defer channel.confirmLock.Unlock()
+	if channel.confirmDone != nil {
+		close(channel.confirmDone)
+		channel.confirmDone = nil
 	}
 }
 
@@ -398,28 +787,231 @@ func (channel *Channel) addConsumer(method *amqp.BasicConsume) (cmr *consumer.Co
 	if qu, err = channel.getQueueWithError(method.Queue, method); err != nil {
 		return nil, err
 	}
+	var additional []*queue.Queue
+	if additional, err = channel.getConsumerAdditionalQueues(method); err != nil {
+		return nil, err
+	}
 
 	var consumerQos []*qos.AmqpQos
-	if channel.server.protoVersion == amqp.Proto091 {
-		consumerQos = []*qos.AmqpQos{channel.qos, channel.conn.qos}
+	if channel.protoVersion == amqp.Proto091 {
+		consumerQos = []*qos.AmqpQos{channel.qos, channel.conn.qos, channel.unackedLimit}
 	} else {
 		cmrQos := channel.consumerQos.Copy()
-		consumerQos = []*qos.AmqpQos{channel.qos, cmrQos}
+		consumerQos = []*qos.AmqpQos{channel.qos, cmrQos, channel.unackedLimit}
+	}
+
+	var options consumer.Options
+	if options, err = getConsumerOptions(method); err != nil {
+		return nil, err
+	}
+	if options.BatchSize > 0 {
+		consumerQos = append(consumerQos, qos.NewBatchQos(options.BatchSize))
+	}
+	if options.MaxUnacked > 0 {
+		consumerQos = append(consumerQos, qos.NewFixedQos(options.MaxUnacked))
 	}
 
-	cmr = consumer.NewConsumer(method.Queue, method.ConsumerTag, method.NoAck, channel, qu, consumerQos)
+	cmr = consumer.NewConsumer(method.Queue, method.ConsumerTag, options, channel, qu, consumerQos)
 	if _, ok := channel.consumers[cmr.Tag()]; ok {
 		return nil, amqp.NewChannelError(amqp.NotAllowed, fmt.Sprintf("Consumer with tag '%s' already exists", cmr.Tag()), method.ClassIdentifier(), method.MethodIdentifier())
 	}
+	for _, source := range additional {
+		cmr.AddQueue(source)
+	}
 
-	if quErr := qu.AddConsumer(cmr, method.Exclusive); quErr != nil {
+	if quErr := qu.AddConsumer(cmr, options.Exclusive); quErr != nil {
 		return nil, amqp.NewChannelError(amqp.AccessRefused, quErr.Error(), method.ClassIdentifier(), method.MethodIdentifier())
 	}
+	for idx, source := range additional {
+		if quErr := source.AddConsumer(cmr, options.Exclusive); quErr != nil {
+			// consumer is registered in all its queues or in none of them
+			qu.RemoveConsumer(cmr.Tag())
+			for _, added := range additional[:idx] {
+				added.RemoveConsumer(cmr.Tag())
+			}
+			return nil, amqp.NewChannelError(amqp.AccessRefused, fmt.Sprintf("queue '%s': %s", source.GetName(), quErr.Error()), method.ClassIdentifier(), method.MethodIdentifier())
+		}
+	}
 	channel.consumers[cmr.Tag()] = cmr
 
 	return cmr, nil
 }
 
+// getConsumerOptions returns consumer options from basic.consume flags and arguments
+// no-wait is not an option of consumer, it only suppresses basic.consume-ok
+func getConsumerOptions(method *amqp.BasicConsume) (consumer.Options, *amqp.Error) {
+	options := consumer.Options{
+		NoAck:     method.NoAck,
+		Exclusive: method.Exclusive,
+		NoLocal:   method.NoLocal,
+	}
+
+	var err *amqp.Error
+	if options.Filter, err = getConsumerFilter(method); err != nil {
+		return options, err
+	}
+	if options.BatchSize, err = getConsumerBatchSize(method); err != nil {
+		return options, err
+	}
+	if options.QueueOrder, err = getConsumerQueueOrder(method); err != nil {
+		return options, err
+	}
+	if options.Weight, err = getConsumerWeight(method); err != nil {
+		return options, err
+	}
+	if options.MaxUnacked, err = getConsumerMaxUnacked(method); err != nil {
+		return options, err
+	}
+
+	return options, nil
+}
+
+// getConsumerWeight returns x-consumer-weight consumer argument or 1 if argument is not set
+func getConsumerWeight(method *amqp.BasicConsume) (int, *amqp.Error) {
+	if method.Arguments == nil {
+		return 1, nil
+	}
+
+	weight, ok, err := getDurationArgument(*method.Arguments, "x-consumer-weight", method)
+	if err != nil || !ok {
+		return 1, err
+	}
+	if weight < 1 || weight > math.MaxUint16 {
+		return 0, amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("invalid x-consumer-weight %d, should be from 1 to %d", weight, math.MaxUint16), method.ClassIdentifier(), method.MethodIdentifier())
+	}
+
+	return int(weight), nil
+}
+
+// getConsumerQueueOrder returns x-queue-order consumer argument or consumer.OrderRoundRobin if argument is not set
+func getConsumerQueueOrder(method *amqp.BasicConsume) (string, *amqp.Error) {
+	if method.Arguments == nil {
+		return consumer.OrderRoundRobin, nil
+	}
+
+	order, ok, err := getStringArgument(*method.Arguments, "x-queue-order", method)
+	if err != nil || !ok {
+		return consumer.OrderRoundRobin, err
+	}
+	if order != consumer.OrderRoundRobin && order != consumer.OrderPriority {
+		return "", amqp.NewChannelError(
+			amqp.PreconditionFailed,
+			fmt.Sprintf("invalid x-queue-order '%s', expected '%s' or '%s'", order, consumer.OrderRoundRobin, consumer.OrderPriority),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		)
+	}
+
+	return order, nil
+}
+
+// getConsumerAdditionalQueues returns queues of x-additional-queues consumer argument, nil if argument is not set
+// Consumer takes messages from queue of basic.consume and from all additional ones, each queue is listed once
+func (channel *Channel) getConsumerAdditionalQueues(method *amqp.BasicConsume) ([]*queue.Queue, *amqp.Error) {
+	if method.Arguments == nil {
+		return nil, nil
+	}
+	value, ok := (*method.Arguments)["x-additional-queues"]
+	if !ok {
+		return nil, nil
+	}
+
+	names, ok := value.([]interface{})
+	if !ok {
+		return nil, amqp.NewChannelError(amqp.PreconditionFailed, "x-additional-queues argument should be an array of queue names", method.ClassIdentifier(), method.MethodIdentifier())
+	}
+	listed := map[string]bool{method.Queue: true}
+	queues := make([]*queue.Queue, 0, len(names))
+	for _, item := range names {
+		var name string
+		switch item := item.(type) {
+		case string:
+			name = item
+		case []byte:
+			name = string(item)
+		default:
+			return nil, amqp.NewChannelError(amqp.PreconditionFailed, "x-additional-queues argument should be an array of queue names", method.ClassIdentifier(), method.MethodIdentifier())
+		}
+		if listed[name] {
+			return nil, amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("queue '%s' is listed more than once", name), method.ClassIdentifier(), method.MethodIdentifier())
+		}
+		listed[name] = true
+
+		qu, err := channel.getQueueWithError(name, method)
+		if err != nil {
+			return nil, err
+		}
+		queues = append(queues, qu)
+	}
+
+	return queues, nil
+}
+
+// getConsumerMaxUnacked returns x-max-unacked consumer argument or 0 if argument is not set
+func getConsumerMaxUnacked(method *amqp.BasicConsume) (uint16, *amqp.Error) {
+	if method.Arguments == nil {
+		return 0, nil
+	}
+
+	maxUnacked, ok, err := getDurationArgument(*method.Arguments, "x-max-unacked", method)
+	if err != nil || !ok {
+		return 0, err
+	}
+	if maxUnacked < 1 || maxUnacked > math.MaxUint16 {
+		return 0, amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("invalid x-max-unacked %d, should be from 1 to %d", maxUnacked, math.MaxUint16), method.ClassIdentifier(), method.MethodIdentifier())
+	}
+	if method.NoAck {
+		return 0, amqp.NewChannelError(amqp.PreconditionFailed, "x-max-unacked argument requires consumer with acknowledgements", method.ClassIdentifier(), method.MethodIdentifier())
+	}
+
+	return uint16(maxUnacked), nil
+}
+
+// getConsumerBatchSize returns x-batch-size consumer argument or 0 if argument is not set
+// Batch is limited by acknowledgements, so no-ack consumer could not have it
+func getConsumerBatchSize(method *amqp.BasicConsume) (uint16, *amqp.Error) {
+	if method.Arguments == nil {
+		return 0, nil
+	}
+
+	size, ok, err := getDurationArgument(*method.Arguments, "x-batch-size", method)
+	if err != nil || !ok {
+		return 0, err
+	}
+	if size < 1 || size > math.MaxUint16 {
+		return 0, amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("invalid x-batch-size %d, should be from 1 to %d", size, math.MaxUint16), method.ClassIdentifier(), method.MethodIdentifier())
+	}
+	if method.NoAck {
+		return 0, amqp.NewChannelError(amqp.PreconditionFailed, "x-batch-size argument requires consumer with acknowledgements", method.ClassIdentifier(), method.MethodIdentifier())
+	}
+
+	return uint16(size), nil
+}
+
+// getConsumerFilter returns parsed x-filter consumer argument or nil if argument is not set
+func getConsumerFilter(method *amqp.BasicConsume) (*filter.Filter, *amqp.Error) {
+	if method.Arguments == nil {
+		return nil, nil
+	}
+
+	value, ok := (*method.Arguments)["x-filter"]
+	if !ok {
+		return nil, nil
+	}
+
+	expr, ok := value.(string)
+	if !ok {
+		return nil, amqp.NewChannelError(amqp.PreconditionFailed, "x-filter argument should be a string", method.ClassIdentifier(), method.MethodIdentifier())
+	}
+
+	msgFilter, err := filter.Parse(expr)
+	if err != nil {
+		return nil, amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("invalid x-filter '%s': %s", expr, err.Error()), method.ClassIdentifier(), method.MethodIdentifier())
+	}
+
+	return msgFilter, nil
+}
+
 func (channel *Channel) removeConsumer(cTag string) {
 	channel.cmrLock.Lock()
 	defer channel.cmrLock.Unlock()
@@ -429,8 +1021,31 @@ func (channel *Channel) removeConsumer(cTag string) {
 	}
 }
 
-func (channel *Channel) close() {
+// CancelConsumer cancels consumer out of band and sends basic.cancel to client
+// Messages delivered to consumer and not acknowledged yet are returned into their queues
+// Returns number of requeued messages, false if consumer is not found
+func (channel *Channel) CancelConsumer(cTag string) (int, bool) {
 	channel.cmrLock.Lock()
+	cmr, ok := channel.consumers[cTag]
+	delete(channel.consumers, cTag)
+	channel.cmrLock.Unlock()
+	if !ok {
+		return 0, false
+	}
+
+	cmr.Cancel()
+	channel.logger.WithFields(log.Fields{
+		"consumerTag": cTag,
+	}).Info("Consumer cancelled")
+
+	return channel.requeueUnackedMatched(true, func(uMsg *UnackedMessage) bool {
+		return uMsg.cTag == cTag
+	}), true
+}
+
+func (channel *Channel) stopConsumers() {
+	channel.cmrLock.Lock()
+	defer channel.cmrLock.Unlock()
 	for _, cmr := range channel.consumers {
 		cmr.Stop()
 		delete(channel.consumers, cmr.Tag())
@@ -438,20 +1053,57 @@ func (channel *Channel) close() {
 			"consumerTag": cmr.Tag(),
 		}).Info("Consumer stopped")
 	}
-	channel.cmrLock.Unlock()
+	if channel.replyTo != nil {
+		channel.conn.GetVirtualHost().removeReplyChannel(channel.replyTo.address)
+		channel.replyTo = nil
+	}
+}
+
+func (channel *Channel) close() {
+	if atomic.CompareAndSwapInt32(&channel.opened, 1, 0) {
+		channel.server.GetMetrics().Channels.Counter.Dec(1)
+	}
+	channel.stopConsumers()
+	channel.stopConfirms()
+	channel.discardSpool()
 	if channel.id > 0 {
-		channel.handleReject(0, true, true, &amqp.BasicNack{})
+		channel.requeueUnacked()
 	}
 	channel.status = channelClosed
 }
 
+// reset clears state of closed channel before it is opened again with the same id
+func (channel *Channel) reset() {
+	channel.active = true
+	channel.confirmMode = false
+	channel.currentMessage = nil
+	channel.qos = qos.NewAmqpQos(0, 0)
+	channel.consumerQos = qos.NewAmqpQos(0, 0)
+	channel.unackedLimit = qos.NewAmqpQos(channel.server.getConfig().Connection.ChannelMaxUnacked, 0)
+	atomic.StoreInt32(&channel.unackedLimitHit, 0)
+	atomic.StoreUint64(&channel.deliveryTag, 0)
+	atomic.StoreUint64(&channel.confirmDeliveryTag, 0)
+	channel.lastQueue = ""
+
+	channel.ackLock.Lock()
+	channel.requeuedTags = make(map[uint64]struct{})
+	channel.ackLock.Unlock()
+
+	channel.confirmLock.Lock()
+	channel.confirmQueue = make([]*amqp.ConfirmMeta, 0)
+	channel.confirmLock.Unlock()
+
+	channel.lastError.set(nil)
+	channel.conn.lastError.clearChannel(channel.id)
+}
+
 func (channel *Channel) delete() {
 	channel.close()
 	channel.status = channelDelete
 }
 
 func (channel *Channel) updateQos(prefetchCount uint16, prefetchSize uint32, global bool) {
-	if channel.server.protoVersion == amqp.Proto091 {
+	if channel.protoVersion == amqp.Proto091 {
 		if global {
 			channel.conn.qos.Update(prefetchCount, prefetchSize)
 		} else {
@@ -462,7 +1114,41 @@ func (channel *Channel) updateQos(prefetchCount uint16, prefetchSize uint32, glo
 			channel.qos.Update(prefetchCount, prefetchSize)
 		} else {
 			channel.consumerQos.Update(prefetchCount, prefetchSize)
+			channel.updateConsumersQos(prefetchCount, prefetchSize)
+		}
+	}
+
+	// limit could be increased, so consumers are called to take messages within new credit
+	if channel.protoVersion == amqp.Proto091 && global {
+		channel.conn.channelsLock.RLock()
+		for _, connChannel := range channel.conn.channels {
+			connChannel.callConsumers()
 		}
+		channel.conn.channelsLock.RUnlock()
+	} else {
+		channel.callConsumers()
+	}
+}
+
+// updateConsumersQos applies new per-consumer limits to existing consumers
+// Unacked messages are still counted, so decreased limit throttles consumer until acks
+func (channel *Channel) updateConsumersQos(prefetchCount uint16, prefetchSize uint32) {
+	channel.cmrLock.Lock()
+	defer channel.cmrLock.Unlock()
+	for _, cmr := range channel.consumers {
+		for _, cmrQos := range cmr.Qos() {
+			if cmrQos != channel.qos && cmrQos != channel.unackedLimit && !cmrQos.IsBatch() && !cmrQos.IsFixed() {
+				cmrQos.Update(prefetchCount, prefetchSize)
+			}
+		}
+	}
+}
+
+func (channel *Channel) callConsumers() {
+	channel.cmrLock.Lock()
+	defer channel.cmrLock.Unlock()
+	for _, cmr := range channel.consumers {
+		cmr.Consume()
 	}
 }
 
@@ -483,14 +1169,106 @@ func (channel *Channel) nextConfirmDeliveryTag() uint64 {
 func (channel *Channel) AddUnackedMessage(dTag uint64, cTag string, queue string, message *amqp.Message) {
 	channel.ackLock.Lock()
 	defer channel.ackLock.Unlock()
-	channel.ackStore[dTag] = &UnackedMessage{
-		cTag:  cTag,
-		msg:   message,
-		queue: queue,
+	uMsg := &UnackedMessage{
+		cTag:        cTag,
+		msg:         message,
+		queue:       queue,
+		deliveredAt: time.Now(),
+		timeout:     channel.consumerTimeout(queue),
 	}
+	channel.ackStore[dTag] = uMsg
 	channel.metrics.Unacked.Counter.Inc(1)
+
+	if channel.unackedLimit.IsActive() && !channel.unackedLimit.HasCapacity() && atomic.CompareAndSwapInt32(&channel.unackedLimitHit, 0, 1) {
+		channel.logger.WithField("limit", channel.unackedLimit.PrefetchCount()).Warn("Channel unacked messages limit reached, deliveries stopped until acks")
+	}
+
+	if uMsg.timeout > 0 && atomic.CompareAndSwapInt32(&channel.ackTimeoutCheck, 0, 1) {
+		go channel.checkAckTimeouts()
+	}
+}
+
+// consumerTimeout returns ack timeout of messages delivered from queue, x-consumer-timeout overrides server one
+func (channel *Channel) consumerTimeout(queueName string) time.Duration {
+	timeout := channel.server.getConfig().Queue.ConsumerTimeout
+	if qu := channel.conn.GetVirtualHost().GetQueue(queueName); qu != nil && qu.GetConsumerTimeout() != queue.NoConsumerTimeout {
+		timeout = qu.GetConsumerTimeout()
+	}
+	return time.Duration(timeout) * time.Millisecond
+}
+
+// ackTimeoutCheckInterval is how often unacked messages of channel are checked for consumer timeout
+var ackTimeoutCheckInterval = time.Second
+
+// checkAckTimeouts closes channel with precondition-failed error when delivered message is not acknowledged in time
+// Channel close requeues all its unacked messages, check is stopped when channel is not open anymore
+func (channel *Channel) checkAckTimeouts() {
+	defer atomic.StoreInt32(&channel.ackTimeoutCheck, 0)
+	ticker := time.NewTicker(ackTimeoutCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-channel.conn.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if channel.status != channelOpen {
+			return
+		}
+
+		if timeout := channel.expiredAckTimeout(); timeout > 0 {
+			channel.sendError(amqp.NewChannelError(
+				amqp.PreconditionFailed,
+				fmt.Sprintf("delivery acknowledgement on channel %d timed out, timeout value used: %d ms", channel.id, timeout/time.Millisecond),
+				0,
+				0,
+			))
+			return
+		}
+	}
+}
+
+// expiredAckTimeout returns timeout of the first unacked message not acknowledged in time, 0 if there is no one
+func (channel *Channel) expiredAckTimeout() time.Duration {
+	channel.ackLock.Lock()
+	defer channel.ackLock.Unlock()
+
+	now := time.Now()
+	for _, uMsg := range channel.ackStore {
+		if uMsg.timeout > 0 && now.Sub(uMsg.deliveredAt) >= uMsg.timeout {
+			return uMsg.timeout
+		}
+	}
+	return 0
 }
 
+// GetUnackedMessages returns unacknowledged messages of the channel sorted by delivery tag
+func (channel *Channel) GetUnackedMessages() []*UnackedMessageInfo {
+	channel.ackLock.Lock()
+	defer channel.ackLock.Unlock()
+
+	messages := make([]*UnackedMessageInfo, 0, len(channel.ackStore))
+	for dTag, uMsg := range channel.ackStore {
+		messages = append(messages, &UnackedMessageInfo{
+			DeliveryTag: dTag,
+			ConsumerTag: uMsg.cTag,
+			Queue:       uMsg.queue,
+			MessageID:   uMsg.msg.ID,
+			Size:        uMsg.msg.BodySize,
+			DeliveredAt: uMsg.deliveredAt,
+		})
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].DeliveryTag < messages[j].DeliveryTag
+	})
+
+	return messages
+}
+
+// handleAck acknowledges single delivery tag, or all unacked tags up to and including it if multiple is set
+// Tags may be acknowledged in any order, unacked set is indexed by tag and already acked ones are skipped by multiple ack
 func (channel *Channel) handleAck(method *amqp.BasicAck) *amqp.Error {
 	channel.ackLock.Lock()
 	defer channel.ackLock.Unlock()
@@ -503,10 +1281,14 @@ func (channel *Channel) handleAck(method *amqp.BasicAck) *amqp.Error {
 				channel.ackMsg(uMsg, tag)
 			}
 		}
+		channel.forgetRequeuedTag(method.DeliveryTag, true)
 
 		return nil
 	}
 
+	if channel.forgetRequeuedTag(method.DeliveryTag, false) {
+		return nil
+	}
 	if uMsg, msgFound = channel.ackStore[method.DeliveryTag]; !msgFound {
 		return amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("Delivery tag [%d] not found", method.DeliveryTag), method.ClassIdentifier(), method.MethodIdentifier())
 	}
@@ -524,6 +1306,8 @@ func (channel *Channel) ackMsg(unackedMessage *UnackedMessage, deliveryTag uint6
 
 		channel.metrics.Acknowledge.Counter.Inc(1)
 		channel.metrics.Unacked.Counter.Dec(1)
+	} else {
+		spool.Release(unackedMessage.msg)
 	}
 
 	channel.decQosAndConsumerNext(unackedMessage)
@@ -540,10 +1324,12 @@ func (channel *Channel) handleReject(deliveryTag uint64, multiple bool, requeue
 		for dTag := range channel.ackStore {
 			deliveryTags = append(deliveryTags, dTag)
 		}
+		// requeued messages are pushed into queue head, so they are rejected in reverse order to keep it,
+		// dead-lettered ones are republished in delivery order
 		sort.Slice(
 			deliveryTags,
 			func(i, j int) bool {
-				return deliveryTags[i] > deliveryTags[j]
+				return (deliveryTags[i] > deliveryTags[j]) == requeue
 			},
 		)
 		for _, tag := range deliveryTags {
@@ -551,10 +1337,14 @@ func (channel *Channel) handleReject(deliveryTag uint64, multiple bool, requeue
 				channel.rejectMsg(channel.ackStore[tag], tag, requeue)
 			}
 		}
+		channel.forgetRequeuedTag(deliveryTag, true)
 
 		return nil
 	}
 
+	if channel.forgetRequeuedTag(deliveryTag, false) {
+		return nil
+	}
 	if uMsg, msgFound = channel.ackStore[deliveryTag]; !msgFound {
 		return amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("Delivery tag [%d] not found", deliveryTag), method.ClassIdentifier(), method.MethodIdentifier())
 	}
@@ -571,32 +1361,126 @@ func (channel *Channel) rejectMsg(unackedMessage *UnackedMessage, deliveryTag ui
 	if qu != nil {
 		if requeue {
 			qu.Requeue(unackedMessage.msg)
+		} else if delay, retried, ok := qu.RetryDelay(unackedMessage.msg); ok {
+			qu.RequeueAfter(retried, delay)
 		} else {
+			channel.conn.GetVirtualHost().deadLetter(qu, []*amqp.Message{unackedMessage.msg}, queue.DeadLetterRejected)
 			qu.AckMsg(unackedMessage.msg)
 		}
 		channel.metrics.Unacked.Counter.Dec(1)
 	} else {
-		// TODO When a queue is deleted any pending messages are sent to a dead­letter
-		channel.metrics.Unacked.Counter.Dec(1)
-		channel.server.GetMetrics().Total.Counter.Dec(1)
-		channel.server.GetMetrics().Unacked.Counter.Dec(1)
+		channel.dropUnacked(unackedMessage)
 	}
 
 	channel.decQosAndConsumerNext(unackedMessage)
 }
 
+// forgetRequeuedTag removes tag of message requeued out of band, or all tags up to and including it if multiple is set
+// Returns true if single tag was requeued out of band, so its ack or reject is a no-op, should be called under ackLock
+func (channel *Channel) forgetRequeuedTag(deliveryTag uint64, multiple bool) bool {
+	if !multiple {
+		_, ok := channel.requeuedTags[deliveryTag]
+		delete(channel.requeuedTags, deliveryTag)
+		return ok
+	}
+
+	for tag := range channel.requeuedTags {
+		if deliveryTag == 0 || tag <= deliveryTag {
+			delete(channel.requeuedTags, tag)
+		}
+	}
+	return false
+}
+
+// requeueUnacked returns all unacked messages of closing channel into their queues
+// Messages of each queue are returned at once in delivery order, so other consumers never get them partially returned
+func (channel *Channel) requeueUnacked() {
+	channel.requeueUnackedMatched(false, func(uMsg *UnackedMessage) bool {
+		return true
+	})
+}
+
+// requeueUnackedMatched returns unacked messages matched by fn into their queues, see requeueUnacked
+// Tags of messages requeued out of band with forced flag are kept, so later ack or reject of them by client is ignored
+// Returns number of requeued messages
+func (channel *Channel) requeueUnackedMatched(forced bool, fn func(uMsg *UnackedMessage) bool) int {
+	channel.ackLock.Lock()
+	defer channel.ackLock.Unlock()
+
+	deliveryTags := make([]uint64, 0, len(channel.ackStore))
+	for dTag, uMsg := range channel.ackStore {
+		if fn(uMsg) {
+			deliveryTags = append(deliveryTags, dTag)
+		}
+	}
+	sort.Slice(
+		deliveryTags,
+		func(i, j int) bool {
+			return deliveryTags[i] < deliveryTags[j]
+		},
+	)
+
+	unacked := make([]*UnackedMessage, 0, len(deliveryTags))
+	queueMessages := make(map[string][]*amqp.Message)
+	for _, dTag := range deliveryTags {
+		uMsg := channel.ackStore[dTag]
+		delete(channel.ackStore, dTag)
+		if forced {
+			channel.requeuedTags[dTag] = struct{}{}
+		}
+		unacked = append(unacked, uMsg)
+		queueMessages[uMsg.queue] = append(queueMessages[uMsg.queue], uMsg.msg)
+	}
+
+	for _, uMsg := range unacked {
+		if channel.conn.GetVirtualHost().GetQueue(uMsg.queue) == nil {
+			channel.dropUnacked(uMsg)
+		}
+	}
+	for queueName, messages := range queueMessages {
+		if qu := channel.conn.GetVirtualHost().GetQueue(queueName); qu != nil {
+			qu.RequeueAll(messages)
+			channel.metrics.Unacked.Counter.Dec(int64(len(messages)))
+		}
+	}
+
+	for _, uMsg := range unacked {
+		channel.decQosAndConsumerNext(uMsg)
+	}
+
+	return len(unacked)
+}
+
+// dropUnacked releases unacked message of already deleted queue
+func (channel *Channel) dropUnacked(unackedMessage *UnackedMessage) {
+	// TODO When a queue is deleted any pending messages are sent to a dead­letter
+	spool.Release(unackedMessage.msg)
+	channel.metrics.Unacked.Counter.Dec(1)
+	channel.server.GetMetrics().Total.Counter.Dec(1)
+	channel.server.GetMetrics().Unacked.Counter.Dec(1)
+}
+
 func (channel *Channel) decQosAndConsumerNext(unackedMessage *UnackedMessage) {
 	channel.cmrLock.Lock()
 	defer channel.cmrLock.Unlock()
 	if cmr, ok := channel.consumers[unackedMessage.cTag]; ok {
-		cmr.Consume()
-
 		for _, amqpQos := range cmr.Qos() {
 			amqpQos.Dec(1, uint32(unackedMessage.msg.BodySize))
 		}
+
+		// credit is released first, otherwise consumer at prefetch limit refuses the call
+		cmr.Consume()
 	} else {
 		channel.qos.Dec(1, uint32(unackedMessage.msg.BodySize))
 		channel.conn.qos.Dec(1, uint32(unackedMessage.msg.BodySize))
+		// basic.get deliveries have no consumer tag and are not counted by channel unacked limit
+		if unackedMessage.cTag != "" {
+			channel.unackedLimit.Dec(1, uint32(unackedMessage.msg.BodySize))
+		}
+	}
+
+	if channel.unackedLimit.HasCapacity() {
+		atomic.StoreInt32(&channel.unackedLimitHit, 0)
 	}
 }
 
@@ -671,6 +1555,21 @@ func (channel *Channel) GetConsumersCount() int {
 	return len(channel.consumers)
 }
 
+// GetConsumers returns snapshot of channel consumers sorted by tag
+func (channel *Channel) GetConsumers() []*consumer.Consumer {
+	channel.cmrLock.Lock()
+	consumers := make([]*consumer.Consumer, 0, len(channel.consumers))
+	for _, cmr := range channel.consumers {
+		consumers = append(consumers, cmr)
+	}
+	channel.cmrLock.Unlock()
+
+	sort.Slice(consumers, func(i, j int) bool {
+		return consumers[i].Tag() < consumers[j].Tag()
+	})
+	return consumers
+}
+
 // GetMetrics returns metrics
 func (channel *Channel) GetMetrics() *ChannelMetricsState {
 	return channel.metrics
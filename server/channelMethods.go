@@ -1,6 +1,8 @@
 package server
 
 import (
+	"sync/atomic"
+
 	"github.com/valinurovam/garagemq/amqp"
 )
 
@@ -26,8 +28,15 @@ func (channel *Channel) channelOpen(method *amqp.ChannelOpen) (err *amqp.Error)
 		return amqp.NewConnectionError(amqp.ChannelError, "channel already open", method.ClassIdentifier(), method.MethodIdentifier())
 	}
 
+	if channel.status == channelClosed {
+		channel.reset()
+	}
+
 	channel.SendMethod(&amqp.ChannelOpenOk{})
 	channel.status = channelOpen
+	if atomic.CompareAndSwapInt32(&channel.opened, 0, 1) {
+		channel.server.GetMetrics().Channels.Counter.Inc(1)
+	}
 
 	return nil
 }
@@ -40,7 +49,8 @@ func (channel *Channel) channelClose(method *amqp.ChannelClose) (err *amqp.Error
 }
 
 func (channel *Channel) channelCloseOk(method *amqp.ChannelCloseOk) (err *amqp.Error) {
-	channel.status = channelClosed
+	// close-ok is the answer on channel.close sent by server on channel error
+	channel.close()
 	return nil
 }
 
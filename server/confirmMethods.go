@@ -1,9 +1,19 @@
 package server
 
 import (
+	"sort"
+	"time"
+
 	"github.com/valinurovam/garagemq/amqp"
 )
 
+const (
+	// confirmFlushInterval is max time confirm waits to be sent to publisher
+	confirmFlushInterval = 20 * time.Millisecond
+	// confirmFlushSize is a number of collected confirms sent at once without waiting for interval
+	confirmFlushSize = 512
+)
+
 func (channel *Channel) confirmRoute(method amqp.Method) *amqp.Error {
 	switch method := method.(type) {
 	case *amqp.ConfirmSelect:
@@ -14,10 +24,108 @@ func (channel *Channel) confirmRoute(method amqp.Method) *amqp.Error {
 }
 
 func (channel *Channel) confirmSelect(method *amqp.ConfirmSelect) (err *amqp.Error) {
-	channel.confirmMode = true
-	go channel.sendConfirms()
+	// repeated confirm.select keeps the only sender, otherwise coalesced acks of concurrent senders could be wrong
+	if !channel.confirmMode {
+		channel.confirmMode = true
+		done := make(chan struct{})
+		channel.confirmLock.Lock()
+		channel.confirmDone = done
+		channel.confirmLock.Unlock()
+		go channel.sendConfirms(done)
+	}
 	if !method.Nowait {
 		channel.SendMethod(&amqp.ConfirmSelectOk{})
 	}
 	return nil
 }
+
+// confirmBatcher coalesces confirmed delivery tags into basic.ack frames
+// Tags confirmed out of order are acked one by one, contiguous ones from the lowest not acked are acked by single
+// basic.ack with multiple flag, so publisher never gets ack of message which is not confirmed yet
+// Rejected tags are nacked one by one and split contiguous acks, so basic.ack with multiple flag never covers them
+type confirmBatcher struct {
+	// all tags up to acked are acked or nacked to publisher
+	acked uint64
+	// tags above acked which are already acked or nacked one by one, true for nacked ones
+	ahead map[uint64]bool
+}
+
+func newConfirmBatcher() *confirmBatcher {
+	return &confirmBatcher{ahead: make(map[uint64]bool)}
+}
+
+// add takes newly confirmed and rejected tags and returns basic.ack and basic.nack frames to send in given order
+func (batcher *confirmBatcher) add(tags []uint64, nacks []uint64) []amqp.Method {
+	// confirmed tags, true for rejected ones
+	confirmed := make(map[uint64]bool, len(tags)+len(nacks))
+	sorted := make([]uint64, 0, len(tags)+len(nacks))
+	for _, tag := range tags {
+		if _, sent := batcher.ahead[tag]; tag > batcher.acked && !sent {
+			confirmed[tag] = false
+			sorted = append(sorted, tag)
+		}
+	}
+	for _, tag := range nacks {
+		if _, sent := batcher.ahead[tag]; tag > batcher.acked && !sent {
+			confirmed[tag] = true
+			sorted = append(sorted, tag)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	frames := make([]amqp.Method, 0)
+	from := batcher.acked
+	// fresh is true if acks from the last split include newly confirmed tag, already acked ones are not acked again
+	fresh := false
+	flush := func() {
+		if batcher.acked > from && fresh {
+			frames = append(frames, &amqp.BasicAck{DeliveryTag: batcher.acked, Multiple: batcher.acked-from > 1})
+		}
+		from = batcher.acked
+		fresh = false
+	}
+	for {
+		tag := batcher.acked + 1
+		nack, isNew := confirmed[tag]
+		if isNew {
+			delete(confirmed, tag)
+		} else {
+			var sent bool
+			if nack, sent = batcher.ahead[tag]; !sent {
+				break
+			}
+			delete(batcher.ahead, tag)
+		}
+
+		if nack {
+			flush()
+			if isNew {
+				frames = append(frames, &amqp.BasicNack{DeliveryTag: tag})
+			}
+			batcher.acked = tag
+			from = tag
+			continue
+		}
+		batcher.acked = tag
+		fresh = fresh || isNew
+	}
+	flush()
+
+	for _, tag := range sorted {
+		nack, ok := confirmed[tag]
+		if !ok {
+			continue
+		}
+		delete(confirmed, tag)
+		batcher.ahead[tag] = nack
+		if nack {
+			frames = append(frames, &amqp.BasicNack{DeliveryTag: tag})
+		} else {
+			frames = append(frames, &amqp.BasicAck{DeliveryTag: tag})
+		}
+	}
+
+	return frames
+}
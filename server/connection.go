@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"net"
 	"sort"
 	"strings"
@@ -16,6 +17,7 @@ import (
 	"github.com/valinurovam/garagemq/amqp"
 	"github.com/valinurovam/garagemq/metrics"
 	"github.com/valinurovam/garagemq/qos"
+	"github.com/valinurovam/garagemq/spool"
 )
 
 // connection status list
@@ -28,6 +30,7 @@ const (
 	ConnTuneOK
 	ConnOpen
 	ConnOpenOK
+	ConnClosing
 	ConnCloseOK
 	ConnClosed
 )
@@ -42,20 +45,28 @@ const (
 // exceeding the MSS.
 const flushThreshold = 1414
 
+// closeOkTimeout is the time server waits for connection.close-ok after connection.close sent
+var closeOkTimeout = 10 * time.Second
+
+// frameOverhead is the size of frame header (7 octets) and frame-end octet
+const frameOverhead = 8
+
 type ConnMetricsState struct {
-	TrafficIn  *metrics.TrackCounter
-	TrafficOut *metrics.TrackCounter
+	TrafficIn     *metrics.TrackCounter
+	TrafficOut    *metrics.TrackCounter
+	HeartbeatsIn  *metrics.TrackCounter
+	HeartbeatsOut *metrics.TrackCounter
 }
 
 // Connection represents AMQP-connection
 type Connection struct {
 	id               uint64
 	server           *Server
-	netConn          *net.TCPConn
+	netConn          net.Conn
 	logger           *log.Entry
 	channelsLock     sync.RWMutex
 	channels         map[uint16]*Channel
-	outgoing         chan *amqp.Frame
+	outbound         *outbound
 	clientProperties *amqp.Table
 	maxChannels      uint16
 	maxFrameSize     uint32
@@ -68,6 +79,9 @@ type Connection struct {
 	srvMetrics       *SrvMetricsState
 	metrics          *ConnMetricsState
 	userName         string
+	// dialect of field tables and basic.qos global flag, see amqp.Proto091 and amqp.ProtoRabbit
+	// It is not negotiated, as both dialects have the same protocol header, so it is server config proto for all connections
+	protoVersion string
 
 	wg        *sync.WaitGroup
 	ctx       context.Context
@@ -75,26 +89,44 @@ type Connection struct {
 
 	heartbeatInterval uint16
 	heartbeatTimeout  uint16
+	// deadline of each socket write, so the client not reading frames can not block outgoing goroutine forever
+	writeTimeout time.Duration
 
 	lastOutgoingTS chan time.Time
+
+	// the last error server closed connection or any of its channels with
+	lastError lastErrorHolder
+	// parameters negotiated with client, nil until connection.tune-ok
+	tuneParams *TuneParams
+}
+
+// TuneParams are connection parameters agreed between server and client by connection.tune and connection.tune-ok
+type TuneParams struct {
+	ChannelMax uint16
+	FrameMax   uint32
+	// Heartbeat is interval in seconds, 0 means heartbeats are disabled
+	Heartbeat uint16
 }
 
 // NewConnection returns new instance of amqp Connection
-func NewConnection(server *Server, netConn *net.TCPConn) (connection *Connection) {
+func NewConnection(server *Server, netConn net.Conn) (connection *Connection) {
+	connConfig := server.getConfig().Connection
 	connection = &Connection{
 		id:                atomic.AddUint64(&server.connSeq, 1),
 		server:            server,
 		netConn:           netConn,
 		channels:          make(map[uint16]*Channel),
-		outgoing:          make(chan *amqp.Frame, 100),
-		maxChannels:       server.config.Connection.ChannelsMax,
-		maxFrameSize:      server.config.Connection.FrameMaxSize,
+		outbound:          newOutbound(),
+		maxChannels:       connConfig.ChannelsMax,
+		maxFrameSize:      connConfig.FrameMaxSize,
 		qos:               qos.NewAmqpQos(0, 0),
 		closeCh:           make(chan bool, 2),
 		srvMetrics:        server.metrics,
 		wg:                &sync.WaitGroup{},
 		lastOutgoingTS:    make(chan time.Time),
 		heartbeatInterval: 10,
+		writeTimeout:      time.Duration(connConfig.WriteTimeout) * time.Second,
+		protoVersion:      server.protoVersion,
 	}
 
 	connection.logger = log.WithFields(log.Fields{
@@ -108,8 +140,10 @@ func NewConnection(server *Server, netConn *net.TCPConn) (connection *Connection
 
 func (conn *Connection) initMetrics() {
 	conn.metrics = &ConnMetricsState{
-		TrafficIn:  metrics.AddCounter(fmt.Sprintf("conn.%d.traffic_in", conn.id)),
-		TrafficOut: metrics.AddCounter(fmt.Sprintf("conn.%d.traffic_out", conn.id)),
+		TrafficIn:     metrics.AddCounter(fmt.Sprintf("conn.%d.traffic_in", conn.id)),
+		TrafficOut:    metrics.AddCounter(fmt.Sprintf("conn.%d.traffic_out", conn.id)),
+		HeartbeatsIn:  metrics.AddCounter(fmt.Sprintf("conn.%d.heartbeats_in", conn.id)),
+		HeartbeatsOut: metrics.AddCounter(fmt.Sprintf("conn.%d.heartbeats_out", conn.id)),
 	}
 }
 
@@ -122,7 +156,9 @@ func (conn *Connection) close() {
 	conn.status = ConnClosed
 	conn.statusLock.Unlock()
 
-	conn.netConn.SetLinger(0)
+	if tcpConn := tcpConnOf(conn.netConn); tcpConn != nil {
+		tcpConn.SetLinger(0)
+	}
 	conn.netConn.Close()
 
 	conn.cancelCtx()
@@ -147,11 +183,48 @@ func (conn *Connection) close() {
 		"vhost": conn.vhostName,
 		"from":  conn.netConn.RemoteAddr(),
 	}).Info("Connection closed")
+	conn.keepClosedError()
 	conn.server.removeConnection(conn.id)
 
 	conn.closeCh <- true
 }
 
+// setClosing marks connection as closing after server sent connection.close
+// Returns false if connection is already closing or closed
+func (conn *Connection) setClosing() bool {
+	conn.statusLock.Lock()
+	defer conn.statusLock.Unlock()
+	if conn.status >= ConnClosing {
+		return false
+	}
+	conn.status = ConnClosing
+	return true
+}
+
+func (conn *Connection) isClosing() bool {
+	conn.statusLock.RLock()
+	defer conn.statusLock.RUnlock()
+	return conn.status == ConnClosing
+}
+
+// waitCloseOk drops connection if client does not answer connection.close-ok in time
+func (conn *Connection) waitCloseOk() {
+	select {
+	case <-time.After(closeOkTimeout):
+		conn.logger.Warn("connection.close-ok not received in time, dropping connection")
+		conn.close()
+	case <-conn.ctx.Done():
+	}
+}
+
+// bodyChunkSize returns max payload size of body frames sent to client
+func (conn *Connection) bodyChunkSize() int {
+	if conn.maxFrameSize == 0 {
+		return spool.DefaultChunkSize
+	}
+	return int(conn.maxFrameSize - frameOverhead)
+}
+
 func (conn *Connection) getChannel(id uint16) *Channel {
 	return conn.channels[id]
 }
@@ -163,15 +236,17 @@ func (conn *Connection) safeClose(wg *sync.WaitGroup) {
 	if ch == nil {
 		return
 	}
-	conn.channels[0].SendMethod(&amqp.ConnectionClose{
-		ReplyCode: amqp.ConnectionForced,
-		ReplyText: "Server shutdown",
-		ClassId:   0,
-		MethodId:  0,
-	})
+	if conn.setClosing() {
+		ch.SendMethod(&amqp.ConnectionClose{
+			ReplyCode: amqp.ConnectionForced,
+			ReplyText: "Server shutdown",
+			ClassId:   0,
+			MethodId:  0,
+		})
+	}
 
-	// let clients proper handle connection closing in 10 sec
-	timeOut := time.After(10 * time.Second)
+	// let clients proper handle connection closing
+	timeOut := time.After(closeOkTimeout)
 
 	select {
 	case <-timeOut:
@@ -196,12 +271,16 @@ func (conn *Connection) clearQueues() {
 }
 
 func (conn *Connection) handleConnection() {
+	// protocol header could come in several segments, so wait for all of its octets
 	buf := make([]byte, 8)
-	_, err := conn.netConn.Read(buf)
+	_, err := io.ReadFull(conn.netConn, buf)
 	if err != nil {
 		conn.logger.WithError(err).WithFields(log.Fields{
 			"read buffer": buf,
 		}).Error("Error on read protocol header")
+		// e.g. failed TLS handshake, connection is not open yet so just drop it
+		conn.netConn.Close()
+		conn.server.removeConnection(conn.id)
 		return
 	}
 
@@ -215,11 +294,17 @@ func (conn *Connection) handleConnection() {
 			"given":     buf,
 			"supported": supported,
 		}).Warn("Unsupported protocol")
+		// connection is not open yet, so socket is closed directly without close handshake
+		// and with default linger, zero linger of conn.close could reset it before client reads protocol header
 		conn.netConn.Write(supported)
-		conn.close()
+		conn.netConn.Close()
+		conn.server.removeConnection(conn.id)
 		return
 	}
 
+	// remote address is known only after protocol header, it could be given by PROXY protocol
+	conn.logger = conn.logger.WithField("from", conn.netConn.RemoteAddr().String())
+
 	conn.ctx, conn.cancelCtx = context.WithCancel(context.Background())
 
 	channel := NewChannel(0, conn)
@@ -243,53 +328,79 @@ func (conn *Connection) handleOutgoing() {
 
 	buffer := bufio.NewWriter(conn.netConn)
 	for {
-		select {
-		case <-conn.ctx.Done():
+		frame := conn.outbound.pop(conn.ctx.Done())
+		if frame == nil {
 			return
-		case frame := <-conn.outgoing:
-			if frame == nil {
-				return
-			}
-			if err := amqp.WriteFrame(buffer, frame); err != nil && !conn.isClosedError(err) {
-				conn.logger.WithError(err).Warn("writing frame")
-				return
-			}
+		}
+		conn.setWriteDeadline()
+		if err := amqp.WriteFrame(buffer, frame); err != nil && !conn.isClosedError(err) {
+			conn.logWriteError(err, "writing frame")
+			return
+		}
+		if frame.Type == amqp.FrameHeartbeat {
+			conn.srvMetrics.HeartbeatsOut.Counter.Inc(1)
+			conn.metrics.HeartbeatsOut.Counter.Inc(1)
+		}
 
-			if frame.CloseAfter {
-				buffer.Flush()
-				return
-			}
+		if frame.CloseAfter {
+			buffer.Flush()
+			return
+		}
 
-			if frame.Sync {
-				conn.srvMetrics.TrafficOut.Counter.Inc(int64(buffer.Buffered()))
-				conn.metrics.TrafficOut.Counter.Inc(int64(buffer.Buffered()))
-				buffer.Flush()
-			} else {
-				conn.mayBeFlushBuffer(buffer)
-			}
+		var err error
+		if frame.Sync {
+			conn.srvMetrics.TrafficOut.Counter.Inc(int64(buffer.Buffered()))
+			conn.metrics.TrafficOut.Counter.Inc(int64(buffer.Buffered()))
+			err = buffer.Flush()
+		} else {
+			err = conn.mayBeFlushBuffer(buffer)
+		}
+		if err != nil && !conn.isClosedError(err) {
+			conn.logWriteError(err, "flushing frames")
+			return
+		}
 
-			select {
-			case conn.lastOutgoingTS <- time.Now():
-			default:
-			}
+		select {
+		case conn.lastOutgoingTS <- time.Now():
+		default:
 		}
 	}
 }
 
-func (conn *Connection) mayBeFlushBuffer(buffer *bufio.Writer) {
+func (conn *Connection) mayBeFlushBuffer(buffer *bufio.Writer) error {
 	if buffer.Buffered() >= flushThreshold {
 		conn.srvMetrics.TrafficOut.Counter.Inc(int64(buffer.Buffered()))
 		conn.metrics.TrafficOut.Counter.Inc(int64(buffer.Buffered()))
-		buffer.Flush()
+		if err := buffer.Flush(); err != nil {
+			return err
+		}
 	}
 
-	if len(conn.outgoing) == 0 {
-		// outgoing channel is buffered and we can check is here more messages for store into buffer
+	if conn.outbound.len() == 0 {
+		// frames are queued by channels and we can check is here more messages for store into buffer
 		// if nothing to store into buffer - we flush
 		conn.srvMetrics.TrafficOut.Counter.Inc(int64(buffer.Buffered()))
 		conn.metrics.TrafficOut.Counter.Inc(int64(buffer.Buffered()))
-		buffer.Flush()
+		return buffer.Flush()
 	}
+
+	return nil
+}
+
+// setWriteDeadline moves deadline of socket writes, buffered frames are written on flush under the same deadline
+func (conn *Connection) setWriteDeadline() {
+	if conn.writeTimeout > 0 {
+		conn.netConn.SetWriteDeadline(time.Now().Add(conn.writeTimeout))
+	}
+}
+
+// logWriteError logs socket write error, timeout is logged with the reason connection is closed for
+func (conn *Connection) logWriteError(err error, action string) {
+	if isTimeoutError(err) {
+		conn.logger.WithError(err).Warnf("Client is not reading, write timeout %s exceeded, closing connection", conn.writeTimeout)
+		return
+	}
+	conn.logger.WithError(err).Warn(action)
 }
 
 func (conn *Connection) handleIncoming() {
@@ -301,21 +412,38 @@ func (conn *Connection) handleIncoming() {
 	buffer := bufio.NewReader(conn.netConn)
 
 	for {
-		// TODO
 		// @spec-note
 		// After sending connection.close , any received methods except Close and Close­OK MUST be discarded.
 		// The response to receiving a Close after sending Close must be to send Close­Ok.
+		// Frames for channels other than 0 are discarded here, channel 0 filters methods by itself
 		frame, err := amqp.ReadFrame(buffer)
 		if err != nil {
-			if err.Error() != "EOF" && !conn.isClosedError(err) {
+			if isTimeoutError(err) {
+				conn.logger.WithError(err).Warnf("Missed heartbeats from client, timeout %ds exceeded, closing connection", conn.heartbeatTimeout)
+			} else if err.Error() != "EOF" && !conn.isClosedError(err) {
 				conn.logger.WithError(err).Warn("reading frame")
 			}
 			return
 		}
 
+		if conn.isClosing() && frame.ChannelID != 0 {
+			continue
+		}
+
 		if conn.status < ConnOpen && frame.ChannelID != 0 {
-			conn.logger.WithError(err).Error("Frame not allowed for unopened connection")
-			return
+			conn.logger.Error("Frame not allowed for unopened connection")
+			conn.getChannel(0).sendError(amqp.NewConnectionError(amqp.ChannelError, "frame received before connection open", 0, 0))
+			continue
+		}
+
+		if conn.maxFrameSize > 0 && uint32(len(frame.Payload))+frameOverhead > conn.maxFrameSize {
+			conn.getChannel(0).sendError(amqp.NewConnectionError(
+				amqp.FrameError,
+				fmt.Sprintf("frame size %d exceeds negotiated frame_max %d", len(frame.Payload)+frameOverhead, conn.maxFrameSize),
+				0,
+				0,
+			))
+			continue
 		}
 		conn.srvMetrics.TrafficIn.Counter.Inc(int64(len(frame.Payload)))
 		conn.metrics.TrafficIn.Counter.Inc(int64(len(frame.Payload)))
@@ -338,8 +466,13 @@ func (conn *Connection) handleIncoming() {
 			conn.netConn.SetReadDeadline(time.Now().Add(time.Duration(conn.heartbeatTimeout) * time.Second))
 		}
 
-		if frame.Type == amqp.FrameHeartbeat && frame.ChannelID != 0 {
-			return
+		if frame.Type == amqp.FrameHeartbeat {
+			if frame.ChannelID != 0 {
+				return
+			}
+			conn.srvMetrics.HeartbeatsIn.Counter.Inc(1)
+			conn.metrics.HeartbeatsIn.Counter.Inc(1)
+			continue
 		}
 
 		select {
@@ -351,35 +484,34 @@ func (conn *Connection) handleIncoming() {
 	}
 }
 
+// heartBeater sends heartbeat frames at half of negotiated interval while connection is idle
+// Heartbeat is skipped if any frame was written since previous tick
 func (conn *Connection) heartBeater() {
-	interval := time.Duration(conn.heartbeatInterval) * time.Second
+	interval := time.Duration(conn.heartbeatInterval) * time.Second / 2
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	var (
-		ok       bool
-		lastTs   = time.Now()
-		tickTime time.Time
-	)
-
+	lastTs := time.Now()
+	prevTick := lastTs
 	heartbeatFrame := &amqp.Frame{Type: byte(amqp.FrameHeartbeat), ChannelID: 0, Payload: []byte{}, CloseAfter: false, Sync: true}
 
-	go func() {
-		for {
-			select {
-			case lastTs, ok = <-conn.lastOutgoingTS:
-				if !ok {
-					return
-				}
-			}
-		}
-	}()
-
 	for {
 		select {
-		case tickTime = <-ticker.C:
-			if tickTime.Sub(lastTs) >= interval-time.Second {
-				conn.outgoing <- heartbeatFrame
+		case <-conn.ctx.Done():
+			return
+		case ts, ok := <-conn.lastOutgoingTS:
+			if !ok {
+				return
+			}
+			lastTs = ts
+		case tickTime := <-ticker.C:
+			idle := !lastTs.After(prevTick)
+			prevTick = tickTime
+			if !idle {
+				continue
+			}
+			if !conn.outbound.push(conn.ctx.Done(), heartbeatFrame) {
+				return
 			}
 		}
 	}
@@ -410,6 +542,17 @@ func (conn *Connection) GetUsername() string {
 	return conn.userName
 }
 
+// GetProtoVersion returns protocol dialect used to read and write frames of connection
+// Dialect is fixed server-wide by config, client with other protocol header is rejected on connect
+func (conn *Connection) GetProtoVersion() string {
+	return conn.protoVersion
+}
+
+// GetTuneParams returns parameters negotiated with client or nil if connection is not tuned yet
+func (conn *Connection) GetTuneParams() *TuneParams {
+	return conn.tuneParams
+}
+
 // GetMetrics returns metrics
 func (conn *Connection) GetMetrics() *ConnMetricsState {
 	return conn.metrics
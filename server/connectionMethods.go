@@ -1,6 +1,7 @@
 package server
 
 import (
+	"fmt"
 	"os"
 	"runtime"
 
@@ -20,21 +21,40 @@ func (channel *Channel) connectionRoute(method amqp.Method) *amqp.Error {
 		return channel.connectionClose(method)
 	case *amqp.ConnectionCloseOk:
 		return channel.connectionCloseOk(method)
+	case *amqp.ConnectionUpdateSecret:
+		return channel.connectionUpdateSecret(method)
 	}
 
 	return amqp.NewConnectionError(amqp.NotImplemented, "unable to route connection method", method.ClassIdentifier(), method.MethodIdentifier())
 }
 
+// serverCapabilities returns RabbitMQ extensions advertised in connection.start
+// Clients rely on them, so flag should be true only if extension is really implemented
+func serverCapabilities() amqp.Table {
+	return amqp.Table{
+		// confirm.select and basic.ack/basic.nack to publishers
+		"publisher_confirms": true,
+		// exchange.bind and exchange.unbind are not implemented
+		"exchange_exchange_bindings": false,
+		// basic.nack with multiple and requeue
+		"basic.nack": true,
+		// basic.cancel sent to consumers of deleted queue
+		"consumer_cancel_notify": true,
+		// connection.blocked and connection.unblocked are sent on disk alarm
+		"connection.blocked": true,
+		// x-priority consume argument is ignored
+		"consumer_priorities": false,
+		// connection.close with ACCESS_REFUSED on login failure instead of just closing socket
+		"authentication_failure_close": true,
+		// basic.qos with global=false applies to each new consumer in amqp-rabbit proto
+		"per_consumer_qos": true,
+		// basic.routed with number of queues is sent after each publish to clients advertising it
+		basicRoutedCapability: true,
+	}
+}
+
 func (channel *Channel) connectionStart() {
-	var capabilities = amqp.Table{}
-	capabilities["publisher_confirms"] = true
-	capabilities["exchange_exchange_bindings"] = false
-	capabilities["basic.nack"] = true
-	capabilities["consumer_cancel_notify"] = true
-	capabilities["connection.blocked"] = false
-	capabilities["consumer_priorities"] = false
-	capabilities["authentication_failure_close"] = true
-	capabilities["per_consumer_qos"] = true
+	var capabilities = serverCapabilities()
 
 	var serverProps = amqp.Table{}
 	serverProps["product"] = "garagemq"
@@ -61,20 +81,19 @@ func (channel *Channel) connectionStartOk(method *amqp.ConnectionStartOk) *amqp.
 	var saslData auth.SaslData
 	var err error
 	if saslData, err = auth.ParsePlain(method.Response); err != nil {
-		return amqp.NewConnectionError(amqp.NotAllowed, "login failure", method.ClassIdentifier(), method.MethodIdentifier())
+		return amqp.NewConnectionError(amqp.AccessRefused, "login failure", method.ClassIdentifier(), method.MethodIdentifier())
 	}
 
 	if method.Mechanism != auth.SaslPlain {
-		channel.conn.close()
+		return amqp.NewConnectionError(amqp.NotAllowed, "unsupported mechanism "+method.Mechanism, method.ClassIdentifier(), method.MethodIdentifier())
 	}
 
 	if !channel.server.checkAuth(saslData) {
-		return amqp.NewConnectionError(amqp.NotAllowed, "login failure", method.ClassIdentifier(), method.MethodIdentifier())
+		return amqp.NewConnectionError(amqp.AccessRefused, "login failure", method.ClassIdentifier(), method.MethodIdentifier())
 	}
 	channel.conn.userName = saslData.Username
 	channel.conn.clientProperties = method.ClientProperties
 
-	// @todo Send HeartBeat 0 cause not supported yet
 	channel.SendMethod(&amqp.ConnectionTune{
 		ChannelMax: channel.conn.maxChannels,
 		FrameMax:   channel.conn.maxFrameSize,
@@ -88,25 +107,76 @@ func (channel *Channel) connectionStartOk(method *amqp.ConnectionStartOk) *amqp.
 func (channel *Channel) connectionTuneOk(method *amqp.ConnectionTuneOk) *amqp.Error {
 	channel.conn.status = ConnTuneOK
 
-	if method.ChannelMax > channel.conn.maxChannels || method.FrameMax > channel.conn.maxFrameSize {
-		channel.conn.close()
-		return nil
+	if method.ChannelMax > channel.conn.maxChannels {
+		return amqp.NewConnectionError(
+			amqp.NotAllowed,
+			fmt.Sprintf("channel_max %d is greater than server max %d", method.ChannelMax, channel.conn.maxChannels),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		)
 	}
 
-	channel.conn.maxChannels = method.ChannelMax
-	channel.conn.maxFrameSize = method.FrameMax
+	frameMax, err := negotiateFrameMax(channel.conn.maxFrameSize, method.FrameMax)
+	if err != nil {
+		return amqp.NewConnectionError(amqp.NotAllowed, err.Error(), method.ClassIdentifier(), method.MethodIdentifier())
+	}
 
+	// @spec-note
+	// channel-max: zero means the client does not impose a limit and server limit is used
+	if method.ChannelMax != 0 {
+		channel.conn.maxChannels = method.ChannelMax
+	}
+	channel.conn.maxFrameSize = frameMax
+
+	// heartbeats are disabled if client sent zero
+	var heartbeat uint16
 	if method.Heartbeat > 0 {
 		if method.Heartbeat < channel.conn.heartbeatInterval {
 			channel.conn.heartbeatInterval = method.Heartbeat
 		}
 		channel.conn.heartbeatTimeout = channel.conn.heartbeatInterval * 3
+		heartbeat = channel.conn.heartbeatInterval
 		go channel.conn.heartBeater()
 	}
 
+	channel.conn.tuneParams = &TuneParams{
+		ChannelMax: channel.conn.maxChannels,
+		FrameMax:   channel.conn.maxFrameSize,
+		Heartbeat:  heartbeat,
+	}
+
 	return nil
 }
 
+// negotiateFrameMax returns frame_max agreed between server and client
+// Zero client value means that the client accepts the server limit
+// The client value must not be less than amqp.FrameMinSize and greater than the server limit
+func negotiateFrameMax(serverMax uint32, clientMax uint32) (uint32, error) {
+	if clientMax == 0 {
+		return serverMax, nil
+	}
+
+	if clientMax < amqp.FrameMinSize {
+		return 0, fmt.Errorf("frame_max %d is less than minimum %d", clientMax, amqp.FrameMinSize)
+	}
+
+	if serverMax != 0 && clientMax > serverMax {
+		return 0, fmt.Errorf("frame_max %d is greater than server max %d", clientMax, serverMax)
+	}
+
+	return clientMax, nil
+}
+
+// normalizeFrameMax returns the frame_max the server will advertise
+// Zero means no limit, any other value is raised up to amqp.FrameMinSize
+func normalizeFrameMax(frameMax uint32) uint32 {
+	if frameMax != 0 && frameMax < amqp.FrameMinSize {
+		return amqp.FrameMinSize
+	}
+
+	return frameMax
+}
+
 func (channel *Channel) connectionOpen(method *amqp.ConnectionOpen) *amqp.Error {
 	channel.conn.status = ConnOpen
 	var vhostFound bool
@@ -119,10 +189,32 @@ func (channel *Channel) connectionOpen(method *amqp.ConnectionOpen) *amqp.Error
 	channel.SendMethod(&amqp.ConnectionOpenOk{})
 	channel.conn.status = ConnOpenOK
 
+	if raised, _ := channel.server.DiskAlarm(); raised && channel.server.getConfig().Db.DiskFullMode == diskFullModeBlock {
+		channel.conn.sendBlocked(true)
+	}
+
 	channel.logger.Info("AMQP connection open")
 	return nil
 }
 
+// connectionUpdateSecret checks new secret of open connection as password of its user
+// Connection keeps working if secret is valid, otherwise it is closed with ACCESS_REFUSED
+func (channel *Channel) connectionUpdateSecret(method *amqp.ConnectionUpdateSecret) *amqp.Error {
+	if channel.conn.status != ConnOpenOK {
+		return amqp.NewConnectionError(amqp.CommandInvalid, "connection is not open", method.ClassIdentifier(), method.MethodIdentifier())
+	}
+
+	saslData := auth.SaslData{Username: channel.conn.userName, Password: string(method.NewSecret)}
+	if !channel.server.checkAuth(saslData) {
+		channel.logger.WithField("reason", method.Reason).Warn("Connection secret update refused")
+		return amqp.NewConnectionError(amqp.AccessRefused, "new secret is refused", method.ClassIdentifier(), method.MethodIdentifier())
+	}
+
+	channel.logger.WithField("reason", method.Reason).Info("Connection secret updated")
+	channel.SendMethod(&amqp.ConnectionUpdateSecretOk{})
+	return nil
+}
+
 func (channel *Channel) connectionClose(method *amqp.ConnectionClose) *amqp.Error {
 	channel.logger.Infof("Connection closed by client, reason - [%d] %s", method.ReplyCode, method.ReplyText)
 	channel.SendMethod(&amqp.ConnectionCloseOk{})
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/queue"
+)
+
+// getQueueDeadLetter returns parsed x-dead-letter-exchange, x-dead-letter-routing-key and x-dead-letter-persistent
+// queue arguments or nil if dead-letter exchange is not set, empty exchange name means default exchange
+func getQueueDeadLetter(method *amqp.QueueDeclare) (*queue.DeadLetter, *amqp.Error) {
+	if method.Arguments == nil {
+		return nil, nil
+	}
+
+	exName, hasExchange, err := getStringArgument(*method.Arguments, "x-dead-letter-exchange", method)
+	if err != nil {
+		return nil, err
+	}
+	routingKey, hasRoutingKey, err := getStringArgument(*method.Arguments, "x-dead-letter-routing-key", method)
+	if err != nil {
+		return nil, err
+	}
+
+	persistent := false
+	value, hasPersistent := (*method.Arguments)["x-dead-letter-persistent"]
+	if hasPersistent {
+		if persistent, hasPersistent = value.(bool); !hasPersistent {
+			return nil, amqp.NewChannelError(amqp.PreconditionFailed, "x-dead-letter-persistent argument should be a boolean", method.ClassIdentifier(), method.MethodIdentifier())
+		}
+	}
+
+	if !hasExchange {
+		if hasRoutingKey {
+			return nil, amqp.NewChannelError(amqp.PreconditionFailed, "x-dead-letter-routing-key argument requires x-dead-letter-exchange", method.ClassIdentifier(), method.MethodIdentifier())
+		}
+		if persistent {
+			return nil, amqp.NewChannelError(amqp.PreconditionFailed, "x-dead-letter-persistent argument requires x-dead-letter-exchange", method.ClassIdentifier(), method.MethodIdentifier())
+		}
+		return nil, nil
+	}
+
+	return &queue.DeadLetter{Exchange: exName, RoutingKey: routingKey, Persistent: persistent}, nil
+}
+
+func getStringArgument(args amqp.Table, name string, method amqp.Method) (string, bool, *amqp.Error) {
+	value, ok := args[name]
+	if !ok {
+		return "", false, nil
+	}
+
+	switch value := value.(type) {
+	case string:
+		return value, true, nil
+	case []byte:
+		return string(value), true, nil
+	}
+
+	return "", false, amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("%s argument should be a string", name), method.ClassIdentifier(), method.MethodIdentifier())
+}
+
+// deadLetter republishes messages dropped from queue into its dead-letter exchange
+// Messages are routed in given order, message is not routed back into queue it has cycled through without rejection
+func (vhost *VirtualHost) deadLetter(qu *queue.Queue, messages []*amqp.Message, reason string) {
+	deadLetter := qu.GetDeadLetter()
+	if deadLetter == nil {
+		return
+	}
+
+	ex := vhost.GetExchange(deadLetter.Exchange)
+	if ex == nil {
+		vhost.logger.WithFields(log.Fields{
+			"queueName": qu.GetName(),
+			"exchange":  deadLetter.Exchange,
+		}).Warn("Dead-letter exchange not found, messages dropped")
+		return
+	}
+
+	for _, message := range messages {
+		dlMessage := deadLetterMessage(message, qu.GetName(), reason, deadLetter)
+		ex.StampProperties(dlMessage)
+		ex.GetMetrics().MsgIn.Counter.Inc(1)
+
+		routed := false
+		for queueName := range ex.GetMatchedQueues(dlMessage) {
+			target := vhost.GetQueue(queueName)
+			if target == nil || isDeathCycle(dlMessage, queueName) {
+				continue
+			}
+			// dead-lettered message is dropped by queue without consumers, it is not dead-lettered again
+			if target.IsDropIfNoConsumers() && target.ConsumersCount() == 0 {
+				continue
+			}
+			if err := vhost.pushCopy(target, dlMessage); err != nil {
+				vhost.logger.WithError(err).WithField("queueName", queueName).Error("Error on dead-lettering message")
+				continue
+			}
+			ex.GetMetrics().MsgOut.Counter.Inc(1)
+			routed = true
+		}
+		if routed {
+			ex.GetMetrics().MsgRouted.Counter.Inc(1)
+		} else {
+			ex.GetMetrics().MsgUnroutable.Counter.Inc(1)
+		}
+	}
+}
+
+// deadLetterMessage returns copy of message to publish into dead-letter exchange
+// Properties are kept except expiration, which is moved into x-death entry of queue and reason
+// Delivery mode is kept as well, unless dead-letter exchange forces messages to be persistent
+func deadLetterMessage(message *amqp.Message, queueName string, reason string, deadLetter *queue.DeadLetter) *amqp.Message {
+	properties := *message.Header.PropertyList
+	headers := amqp.Table{}
+	if properties.Headers != nil {
+		for key, value := range *properties.Headers {
+			headers[key] = value
+		}
+	}
+
+	routingKeys := make([]interface{}, 0)
+	for _, key := range message.GetRoutingKeys() {
+		routingKeys = append(routingKeys, key)
+	}
+	death := amqp.Table{
+		"queue":        queueName,
+		"reason":       reason,
+		"count":        int64(1),
+		"exchange":     message.Exchange,
+		"routing-keys": routingKeys,
+		"time":         time.Now(),
+	}
+	if properties.Expiration != nil {
+		death["original-expiration"] = *properties.Expiration
+		properties.Expiration = nil
+	}
+
+	headers["x-death"] = appendDeath(headers["x-death"], death)
+	if _, ok := headers["x-first-death-queue"]; !ok {
+		headers["x-first-death-queue"] = queueName
+		headers["x-first-death-reason"] = reason
+		headers["x-first-death-exchange"] = message.Exchange
+	}
+	headers["x-last-death-queue"] = queueName
+	headers["x-last-death-reason"] = reason
+	headers["x-last-death-exchange"] = message.Exchange
+
+	routingKey := message.RoutingKey
+	if deadLetter.RoutingKey != "" {
+		routingKey = deadLetter.RoutingKey
+		delete(headers, "CC")
+	}
+
+	if deadLetter.Persistent {
+		deliveryMode := byte(2)
+		properties.DeliveryMode = &deliveryMode
+	}
+
+	properties.Headers = &headers
+	header := *message.Header
+	header.PropertyList = &properties
+
+	return &amqp.Message{
+		Exchange:   deadLetter.Exchange,
+		RoutingKey: routingKey,
+		Header:     &header,
+		Body:       message.Body,
+		BodySize:   message.BodySize,
+		SpoolPath:  message.SpoolPath,
+	}
+}
+
+// appendDeath puts x-death entry at the head of array
+// Existing entry of the same queue and reason is moved to the head with incremented count instead
+func appendDeath(deaths interface{}, death amqp.Table) []interface{} {
+	entries, _ := deaths.([]interface{})
+	result := make([]interface{}, 1, len(entries)+1)
+	result[0] = death
+
+	for _, item := range entries {
+		entry, ok := deathEntry(item)
+		if ok && tableString(entry, "queue") == death["queue"] && tableString(entry, "reason") == death["reason"] {
+			updated := amqp.Table{}
+			for key, value := range entry {
+				updated[key] = value
+			}
+			updated["count"] = tableInt(entry, "count") + 1
+			result[0] = updated
+			continue
+		}
+		result = append(result, item)
+	}
+
+	return result
+}
+
+// isDeathCycle checks that message was dead-lettered from queue before without being rejected since
+func isDeathCycle(message *amqp.Message, queueName string) bool {
+	entries, _ := (*message.Header.PropertyList.Headers)["x-death"].([]interface{})
+	for _, item := range entries {
+		entry, ok := deathEntry(item)
+		if !ok {
+			continue
+		}
+		if tableString(entry, "reason") == queue.DeadLetterRejected {
+			return false
+		}
+		if tableString(entry, "queue") == queueName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deathEntry returns x-death entry, nested tables are read from client or storage as *amqp.Table
+func deathEntry(item interface{}) (amqp.Table, bool) {
+	switch entry := item.(type) {
+	case amqp.Table:
+		return entry, true
+	case *amqp.Table:
+		return *entry, entry != nil
+	}
+	return nil, false
+}
+
+func tableString(table amqp.Table, key string) string {
+	switch value := table[key].(type) {
+	case string:
+		return value
+	case []byte:
+		return string(value)
+	}
+	return ""
+}
+
+func tableInt(table amqp.Table, key string) int64 {
+	switch value := table[key].(type) {
+	case int8:
+		return int64(value)
+	case uint8:
+		return int64(value)
+	case int16:
+		return int64(value)
+	case uint16:
+		return int64(value)
+	case int32:
+		return int64(value)
+	case uint32:
+		return int64(value)
+	case int64:
+		return value
+	case uint64:
+		return int64(value)
+	}
+	return 0
+}
@@ -0,0 +1,491 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/exchange"
+	"github.com/valinurovam/garagemq/queue"
+)
+
+// Definitions represents broker topology, used to export and import it as a single document
+// System exchanges, exclusive queues and bindings into default exchange are not included
+type Definitions struct {
+	Vhosts    []*VhostDefinition    `json:"vhosts"`
+	Users     []*UserDefinition     `json:"users"`
+	Exchanges []*ExchangeDefinition `json:"exchanges"`
+	Queues    []*QueueDefinition    `json:"queues"`
+	Bindings  []*BindingDefinition  `json:"bindings"`
+}
+
+// VhostDefinition represents virtual host in definitions
+type VhostDefinition struct {
+	Name string `json:"name"`
+}
+
+// UserDefinition represents user in definitions
+// Users are configured in server config, so they are exported only
+// Password hashes are not exported, as definitions are served by admin server without authentication
+type UserDefinition struct {
+	Name string `json:"name"`
+}
+
+// ExchangeDefinition represents exchange in definitions
+// RoutingProperty is message property routed by x-property exchange, empty for other types
+// Meta is x-meta-* arguments of exchange, nil if exchange has no one
+// SetProperties and DefaultProperties are x-set-properties and x-default-properties arguments, nil if exchange has no one
+// Schema and SchemaType are x-schema and x-schema-type arguments, empty if exchange has no schema
+// AllowedContentTypes is x-allowed-content-types argument, empty if exchange accepts any message
+type ExchangeDefinition struct {
+	Vhost             string      `json:"vhost"`
+	Name              string      `json:"name"`
+	Type              string      `json:"type"`
+	Durable           bool        `json:"durable"`
+	AutoDelete        bool        `json:"auto_delete"`
+	Internal          bool        `json:"internal"`
+	RoutingProperty   string      `json:"routing_property,omitempty"`
+	Meta              *amqp.Table `json:"meta,omitempty"`
+	SetProperties     *amqp.Table `json:"set_properties,omitempty"`
+	DefaultProperties *amqp.Table `json:"default_properties,omitempty"`
+	Schema            string      `json:"schema,omitempty"`
+	SchemaType        string      `json:"schema_type,omitempty"`
+
+	AllowedContentTypes []string `json:"allowed_content_types,omitempty"`
+}
+
+// QueueDefinition represents queue in definitions
+// MessageTTL is x-message-ttl in milliseconds, nil if queue has no one
+// DeadLetterExchange is x-dead-letter-exchange, nil if queue has no one
+// ConsumerTimeout is x-consumer-timeout in milliseconds, nil if queue has no one
+// RetryDelays is x-retry-delays in milliseconds, empty if rejected messages are not retried
+// MaxLength is x-max-length with reject-publish overflow, 0 if queue length is not limited
+// Meta is x-meta-* arguments of queue, nil if queue has no one
+// Schema and SchemaType are x-schema and x-schema-type arguments, empty if queue has no schema
+type QueueDefinition struct {
+	Vhost                string      `json:"vhost"`
+	Name                 string      `json:"name"`
+	Durable              bool        `json:"durable"`
+	AutoDelete           bool        `json:"auto_delete"`
+	MessageTTL           *int64      `json:"message_ttl,omitempty"`
+	DeadLetterExchange   *string     `json:"dead_letter_exchange,omitempty"`
+	DeadLetterRoutingKey string      `json:"dead_letter_routing_key,omitempty"`
+	DeadLetterPersistent bool        `json:"dead_letter_persistent,omitempty"`
+	SingleActiveConsumer bool        `json:"single_active_consumer,omitempty"`
+	DropIfNoConsumers    bool        `json:"drop_if_no_consumers,omitempty"`
+	RetryDelays          []int64     `json:"retry_delays,omitempty"`
+	MaxLength            int64       `json:"max_length,omitempty"`
+	ConsumerTimeout      *int64      `json:"consumer_timeout,omitempty"`
+	Meta                 *amqp.Table `json:"meta,omitempty"`
+	Storage              string      `json:"storage,omitempty"`
+	Schema               string      `json:"schema,omitempty"`
+	SchemaType           string      `json:"schema_type,omitempty"`
+}
+
+// BindingDefinition represents binding of queue to exchange in definitions
+type BindingDefinition struct {
+	Vhost       string      `json:"vhost"`
+	Source      string      `json:"source"`
+	Destination string      `json:"destination"`
+	RoutingKey  string      `json:"routing_key"`
+	Arguments   *amqp.Table `json:"arguments"`
+}
+
+// ExportDefinitions returns current topology of all virtual hosts
+func (srv *Server) ExportDefinitions() *Definitions {
+	defs := &Definitions{
+		Vhosts:    []*VhostDefinition{},
+		Users:     []*UserDefinition{},
+		Exchanges: []*ExchangeDefinition{},
+		Queues:    []*QueueDefinition{},
+		Bindings:  []*BindingDefinition{},
+	}
+
+	srv.usersLock.RLock()
+	for name := range srv.users {
+		defs.Users = append(defs.Users, &UserDefinition{Name: name})
+	}
+	srv.usersLock.RUnlock()
+
+	srv.vhostsLock.Lock()
+	defer srv.vhostsLock.Unlock()
+	for vhName, vhost := range srv.vhosts {
+		defs.Vhosts = append(defs.Vhosts, &VhostDefinition{Name: vhName})
+
+		// exclusive queues are owned by connections, so they are skipped with their bindings
+		exclusive := make(map[string]bool)
+		vhost.quLock.RLock()
+		for _, qu := range vhost.queues {
+			if qu.IsExclusive() {
+				exclusive[qu.GetName()] = true
+				continue
+			}
+			quDef := &QueueDefinition{
+				Vhost:      vhName,
+				Name:       qu.GetName(),
+				Durable:    qu.IsDurable(),
+				AutoDelete: qu.IsAutoDelete(),
+
+				SingleActiveConsumer: qu.IsSingleActiveConsumer(),
+				DropIfNoConsumers:    qu.IsDropIfNoConsumers(),
+				RetryDelays:          qu.GetRetryDelays(),
+				MaxLength:            qu.GetMaxLength(),
+				Meta:                 qu.GetMeta(),
+				Storage:              qu.GetStorageName(),
+			}
+			quDef.SchemaType, quDef.Schema = exportSchema(qu.GetSchema())
+			if ttl := qu.GetMessageTTL(); ttl != queue.NoTTL {
+				quDef.MessageTTL = &ttl
+			}
+			if timeout := qu.GetConsumerTimeout(); timeout != queue.NoConsumerTimeout {
+				quDef.ConsumerTimeout = &timeout
+			}
+			if deadLetter := qu.GetDeadLetter(); deadLetter != nil {
+				exName := deadLetter.Exchange
+				quDef.DeadLetterExchange = &exName
+				quDef.DeadLetterRoutingKey = deadLetter.RoutingKey
+				quDef.DeadLetterPersistent = deadLetter.Persistent
+			}
+			defs.Queues = append(defs.Queues, quDef)
+		}
+		vhost.quLock.RUnlock()
+
+		vhost.exLock.RLock()
+		for _, ex := range vhost.exchanges {
+			if !ex.IsSystem() {
+				set, defaults := ex.GetProperties()
+				schemaType, definition := exportSchema(ex.GetSchema())
+				defs.Exchanges = append(defs.Exchanges, &ExchangeDefinition{
+					Vhost:      vhName,
+					Name:       ex.GetName(),
+					Type:       ex.GetTypeAlias(),
+					Durable:    ex.IsDurable(),
+					AutoDelete: ex.IsAutoDelete(),
+					Internal:   ex.IsInternal(),
+
+					RoutingProperty:   ex.GetRoutingProperty(),
+					Meta:              ex.GetMeta(),
+					SetProperties:     tableRef(set),
+					DefaultProperties: tableRef(defaults),
+					Schema:            definition,
+					SchemaType:        schemaType,
+
+					AllowedContentTypes: ex.GetAllowedContentTypes(),
+				})
+			}
+
+			if ex.GetName() == exDefaultName {
+				continue
+			}
+			for _, bind := range ex.GetBindings() {
+				if exclusive[bind.GetQueue()] {
+					continue
+				}
+				defs.Bindings = append(defs.Bindings, &BindingDefinition{
+					Vhost:       vhName,
+					Source:      bind.GetExchange(),
+					Destination: bind.GetQueue(),
+					RoutingKey:  bind.GetRoutingKey(),
+					Arguments:   bind.Arguments,
+				})
+			}
+		}
+		vhost.exLock.RUnlock()
+	}
+
+	defs.sort()
+	return defs
+}
+
+// ImportDefinitions creates exchanges, queues and bindings from definitions which do not exist yet
+// Definitions are validated before any change, import fails if object exists with other params
+// Virtual hosts must exist, users are not imported
+func (srv *Server) ImportDefinitions(defs *Definitions) error {
+	if err := srv.validateDefinitions(defs); err != nil {
+		return err
+	}
+
+	for _, exDef := range defs.Exchanges {
+		vhost := srv.getVhost(exDef.Vhost)
+		if vhost.GetExchange(exDef.Name) != nil {
+			continue
+		}
+		ex, _ := exDef.newExchange()
+		vhost.AppendExchange(ex)
+	}
+
+	for _, quDef := range defs.Queues {
+		vhost := srv.getVhost(quDef.Vhost)
+		if vhost.GetQueue(quDef.Name) != nil {
+			continue
+		}
+		qu := vhost.NewQueue(quDef.Name, 0, false, quDef.AutoDelete, quDef.Durable, srv.getConfig().Queue.ShardSize)
+		qu.SetMessageTTL(quDef.messageTTL())
+		qu.SetDeadLetter(quDef.deadLetter())
+		qu.SetSingleActiveConsumer(quDef.SingleActiveConsumer)
+		qu.SetDropIfNoConsumers(quDef.DropIfNoConsumers)
+		qu.SetRetryDelays(quDef.RetryDelays)
+		qu.SetMaxLength(quDef.MaxLength)
+		qu.SetConsumerTimeout(quDef.consumerTimeout())
+		qu.SetMeta(quDef.Meta)
+		validator, _ := newSchema(quDef.SchemaType, quDef.Schema)
+		qu.SetSchema(validator)
+		vhost.SetQueueStorage(qu, quDef.Storage)
+		qu.Start()
+		vhost.AppendQueue(qu)
+	}
+
+	for _, bindDef := range defs.Bindings {
+		vhost := srv.getVhost(bindDef.Vhost)
+		// rebinding is no-op, so existing bindings are not checked
+		if err := vhost.BindQueue(bindDef.Source, bindDef.Destination, bindDef.RoutingKey, bindDef.Arguments); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (srv *Server) validateDefinitions(defs *Definitions) error {
+	for _, vhDef := range defs.Vhosts {
+		if srv.getVhost(vhDef.Name) == nil {
+			return fmt.Errorf("vhost '%s' not found, vhosts creation is not supported", vhDef.Name)
+		}
+	}
+
+	exchanges := make(map[string]bool)
+	for _, exDef := range defs.Exchanges {
+		vhost := srv.getVhost(exDef.Vhost)
+		if vhost == nil {
+			return fmt.Errorf("vhost '%s' not found", exDef.Vhost)
+		}
+		if exDef.Name == "" {
+			return errors.New("exchange name is required")
+		}
+		newExchange, err := exDef.newExchange()
+		if err != nil {
+			return fmt.Errorf("exchange '%s': %s", exDef.Name, err)
+		}
+
+		if existing := vhost.GetExchange(exDef.Name); existing != nil {
+			if err := existing.EqualWithErr(newExchange); err != nil {
+				return err
+			}
+		} else if strings.HasPrefix(exDef.Name, "amq.") {
+			return fmt.Errorf("exchange name '%s' contains reserved prefix 'amq.*'", exDef.Name)
+		}
+		exchanges[exDef.Vhost+"/"+exDef.Name] = true
+	}
+
+	queues := make(map[string]bool)
+	for _, quDef := range defs.Queues {
+		vhost := srv.getVhost(quDef.Vhost)
+		if vhost == nil {
+			return fmt.Errorf("vhost '%s' not found", quDef.Vhost)
+		}
+		if quDef.Name == "" {
+			return errors.New("queue name is required")
+		}
+		if err := vhost.checkQuarantined(quDef.Name); err != nil {
+			return err
+		}
+		if quDef.MessageTTL != nil && *quDef.MessageTTL < 0 {
+			return fmt.Errorf("queue '%s': invalid message_ttl %d, should not be negative", quDef.Name, *quDef.MessageTTL)
+		}
+		if quDef.ConsumerTimeout != nil && *quDef.ConsumerTimeout < 0 {
+			return fmt.Errorf("queue '%s': invalid consumer_timeout %d, should not be negative", quDef.Name, *quDef.ConsumerTimeout)
+		}
+		if quDef.DeadLetterExchange == nil && quDef.DeadLetterRoutingKey != "" {
+			return fmt.Errorf("queue '%s': dead_letter_routing_key requires dead_letter_exchange", quDef.Name)
+		}
+		if quDef.DeadLetterExchange == nil && quDef.DeadLetterPersistent {
+			return fmt.Errorf("queue '%s': dead_letter_persistent requires dead_letter_exchange", quDef.Name)
+		}
+		for _, delay := range quDef.RetryDelays {
+			if delay < 0 {
+				return fmt.Errorf("queue '%s': retry_delays should not be negative", quDef.Name)
+			}
+		}
+		if quDef.MaxLength < 0 {
+			return fmt.Errorf("queue '%s': invalid max_length %d, should not be negative", quDef.Name, quDef.MaxLength)
+		}
+		if err := checkMeta(quDef.Meta); err != nil {
+			return fmt.Errorf("queue '%s': %s", quDef.Name, err)
+		}
+		if _, ok := srv.getConfig().Db.Storages[quDef.Storage]; quDef.Storage != "" && !ok {
+			return fmt.Errorf("queue '%s': storage '%s' is not configured", quDef.Name, quDef.Storage)
+		}
+		validator, err := newSchema(quDef.SchemaType, quDef.Schema)
+		if err != nil {
+			return fmt.Errorf("queue '%s': %s", quDef.Name, err)
+		}
+
+		if existing := vhost.GetQueue(quDef.Name); existing != nil {
+			if existing.IsExclusive() {
+				return fmt.Errorf("queue '%s' is locked to another connection", quDef.Name)
+			}
+			newQueue := vhost.NewQueue(quDef.Name, 0, false, quDef.AutoDelete, quDef.Durable, srv.getConfig().Queue.ShardSize)
+			newQueue.SetMessageTTL(quDef.messageTTL())
+			newQueue.SetDeadLetter(quDef.deadLetter())
+			newQueue.SetSingleActiveConsumer(quDef.SingleActiveConsumer)
+			newQueue.SetDropIfNoConsumers(quDef.DropIfNoConsumers)
+			newQueue.SetRetryDelays(quDef.RetryDelays)
+			newQueue.SetMaxLength(quDef.MaxLength)
+			newQueue.SetConsumerTimeout(quDef.consumerTimeout())
+			newQueue.SetSchema(validator)
+			if err := existing.EqualWithErr(newQueue); err != nil {
+				return err
+			}
+			if existing.GetStorageName() != quDef.Storage {
+				return fmt.Errorf("inequivalent arg 'x-queue-storage' for queue '%s': received '%s' but current is '%s'", quDef.Name, quDef.Storage, existing.GetStorageName())
+			}
+		}
+		queues[quDef.Vhost+"/"+quDef.Name] = true
+	}
+
+	for _, bindDef := range defs.Bindings {
+		vhost := srv.getVhost(bindDef.Vhost)
+		if vhost == nil {
+			return fmt.Errorf("vhost '%s' not found", bindDef.Vhost)
+		}
+		if bindDef.Source == exDefaultName {
+			return errors.New("operation not permitted on the default exchange")
+		}
+		if !exchanges[bindDef.Vhost+"/"+bindDef.Source] && vhost.GetExchange(bindDef.Source) == nil {
+			return fmt.Errorf("exchange '%s' not found", bindDef.Source)
+		}
+		if !queues[bindDef.Vhost+"/"+bindDef.Destination] {
+			qu := vhost.GetQueue(bindDef.Destination)
+			if qu == nil {
+				return fmt.Errorf("queue '%s' not found", bindDef.Destination)
+			}
+			if qu.IsExclusive() {
+				return fmt.Errorf("queue '%s' is locked to another connection", bindDef.Destination)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (exDef *ExchangeDefinition) newExchange() (*exchange.Exchange, error) {
+	exType, err := exchange.GetExchangeTypeID(exDef.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	ex := exchange.NewExchange(exDef.Name, exType, exDef.Durable, exDef.AutoDelete, exDef.Internal, false)
+	if exDef.RoutingProperty != "" {
+		if err := ex.SetRoutingProperty(exDef.RoutingProperty); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkMeta(exDef.Meta); err != nil {
+		return nil, err
+	}
+	ex.SetMeta(exDef.Meta)
+
+	var set, defaults amqp.Table
+	if exDef.SetProperties != nil {
+		set = *exDef.SetProperties
+	}
+	if exDef.DefaultProperties != nil {
+		defaults = *exDef.DefaultProperties
+	}
+	if err := ex.SetProperties(set, defaults); err != nil {
+		return nil, err
+	}
+
+	validator, err := newSchema(exDef.SchemaType, exDef.Schema)
+	if err != nil {
+		return nil, err
+	}
+	ex.SetSchema(validator)
+
+	if err := ex.SetAllowedContentTypes(exDef.AllowedContentTypes); err != nil {
+		return nil, err
+	}
+	return ex, nil
+}
+
+// tableRef returns reference to table, nil for nil table
+func tableRef(table amqp.Table) *amqp.Table {
+	if table == nil {
+		return nil
+	}
+	return &table
+}
+
+// checkMeta returns error if metadata has key without x-meta- prefix
+func checkMeta(meta *amqp.Table) error {
+	if meta == nil {
+		return nil
+	}
+	for key := range *meta {
+		if !strings.HasPrefix(key, metaArgumentPrefix) {
+			return fmt.Errorf("meta key '%s' should have prefix '%s'", key, metaArgumentPrefix)
+		}
+	}
+	return nil
+}
+
+func (quDef *QueueDefinition) messageTTL() int64 {
+	if quDef.MessageTTL == nil {
+		return queue.NoTTL
+	}
+	return *quDef.MessageTTL
+}
+
+func (quDef *QueueDefinition) consumerTimeout() int64 {
+	if quDef.ConsumerTimeout == nil {
+		return queue.NoConsumerTimeout
+	}
+	return *quDef.ConsumerTimeout
+}
+
+func (quDef *QueueDefinition) deadLetter() *queue.DeadLetter {
+	if quDef.DeadLetterExchange == nil {
+		return nil
+	}
+	return &queue.DeadLetter{
+		Exchange:   *quDef.DeadLetterExchange,
+		RoutingKey: quDef.DeadLetterRoutingKey,
+		Persistent: quDef.DeadLetterPersistent,
+	}
+}
+
+func (defs *Definitions) sort() {
+	sort.Slice(defs.Vhosts, func(i, j int) bool {
+		return defs.Vhosts[i].Name < defs.Vhosts[j].Name
+	})
+	sort.Slice(defs.Users, func(i, j int) bool {
+		return defs.Users[i].Name < defs.Users[j].Name
+	})
+	sort.Slice(defs.Exchanges, func(i, j int) bool {
+		if defs.Exchanges[i].Vhost != defs.Exchanges[j].Vhost {
+			return defs.Exchanges[i].Vhost < defs.Exchanges[j].Vhost
+		}
+		return defs.Exchanges[i].Name < defs.Exchanges[j].Name
+	})
+	sort.Slice(defs.Queues, func(i, j int) bool {
+		if defs.Queues[i].Vhost != defs.Queues[j].Vhost {
+			return defs.Queues[i].Vhost < defs.Queues[j].Vhost
+		}
+		return defs.Queues[i].Name < defs.Queues[j].Name
+	})
+	sort.Slice(defs.Bindings, func(i, j int) bool {
+		a, b := defs.Bindings[i], defs.Bindings[j]
+		if a.Vhost != b.Vhost {
+			return a.Vhost < b.Vhost
+		}
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		if a.Destination != b.Destination {
+			return a.Destination < b.Destination
+		}
+		return a.RoutingKey < b.RoutingKey
+	})
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// replyToQueue is the pseudo-queue name used for direct reply-to
+// Consumer on it does not consume any real queue, replies are delivered straight into its channel
+const replyToQueue = "amq.rabbitmq.reply-to"
+
+var replyCid uint64
+
+// directReply represents reply-to pseudo-consumer of the channel
+type directReply struct {
+	tag     string
+	address string
+}
+
+// isReplyAddress checks that routing key is generated reply address, not the pseudo-queue itself
+func isReplyAddress(routingKey string) bool {
+	return strings.HasPrefix(routingKey, replyToQueue+".")
+}
+
+func generateReplyAddress() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return replyToQueue + "." + hex.EncodeToString(token), nil
+}
+
+// addReplyConsumer starts consuming from reply-to pseudo-queue
+// Only one no-ack reply consumer is allowed per channel
+func (channel *Channel) addReplyConsumer(method *amqp.BasicConsume) (string, *amqp.Error) {
+	channel.cmrLock.Lock()
+	defer channel.cmrLock.Unlock()
+
+	if !method.NoAck {
+		return "", amqp.NewChannelError(amqp.PreconditionFailed, "reply consumer cannot acknowledge", method.ClassIdentifier(), method.MethodIdentifier())
+	}
+	if channel.replyTo != nil {
+		return "", amqp.NewChannelError(amqp.PreconditionFailed, "reply consumer already set", method.ClassIdentifier(), method.MethodIdentifier())
+	}
+
+	tag := method.ConsumerTag
+	if tag == "" {
+		tag = fmt.Sprintf("amq.ctag-reply-%d", atomic.AddUint64(&replyCid, 1))
+	}
+	if _, ok := channel.consumers[tag]; ok {
+		return "", amqp.NewChannelError(amqp.NotAllowed, fmt.Sprintf("Consumer with tag '%s' already exists", tag), method.ClassIdentifier(), method.MethodIdentifier())
+	}
+
+	address, err := generateReplyAddress()
+	if err != nil {
+		return "", amqp.NewChannelError(amqp.InternalError, "error on generating reply address", method.ClassIdentifier(), method.MethodIdentifier())
+	}
+
+	channel.replyTo = &directReply{tag: tag, address: address}
+	channel.conn.GetVirtualHost().addReplyChannel(address, channel)
+
+	return tag, nil
+}
+
+// removeReplyConsumer stops reply-to pseudo-consumer, returns false if channel has no one with such tag
+func (channel *Channel) removeReplyConsumer(cTag string) bool {
+	channel.cmrLock.Lock()
+	defer channel.cmrLock.Unlock()
+
+	if channel.replyTo == nil || channel.replyTo.tag != cTag {
+		return false
+	}
+	channel.conn.GetVirtualHost().removeReplyChannel(channel.replyTo.address)
+	channel.replyTo = nil
+
+	return true
+}
+
+// resolveReplyTo replaces reply-to pseudo-queue in message properties with reply address of the channel
+func (channel *Channel) resolveReplyTo(message *amqp.Message) *amqp.Error {
+	replyTo := message.Header.PropertyList.ReplyTo
+	if replyTo == nil || *replyTo != replyToQueue {
+		return nil
+	}
+
+	channel.cmrLock.Lock()
+	defer channel.cmrLock.Unlock()
+	if channel.replyTo == nil {
+		return amqp.NewChannelError(amqp.PreconditionFailed, "fast reply consumer does not exist", amqp.ClassBasic, amqp.MethodBasicPublish)
+	}
+
+	address := channel.replyTo.address
+	message.Header.PropertyList.ReplyTo = &address
+
+	return nil
+}
+
+// deliverReply sends message published to reply address directly to the requesting channel
+// Message is not queued, so reply to unknown or gone consumer is dropped or returned if mandatory
+func (channel *Channel) deliverReply(message *amqp.Message) *amqp.Error {
+	replyChannel := channel.conn.GetVirtualHost().getReplyChannel(message.RoutingKey)
+
+	var cTag string
+	if replyChannel != nil {
+		replyChannel.cmrLock.Lock()
+		if replyChannel.replyTo != nil {
+			cTag = replyChannel.replyTo.tag
+		}
+		replyChannel.cmrLock.Unlock()
+	}
+
+	if cTag == "" {
+		if message.Mandatory {
+			channel.returnMessage(message, "No route")
+		}
+		channel.addConfirm(message.ConfirmMeta)
+
+		return nil
+	}
+
+	channel.server.GetMetrics().Publish.Counter.Inc(1)
+	channel.metrics.Publish.Counter.Inc(1)
+
+	replyChannel.SendContent(&amqp.BasicDeliver{
+		ConsumerTag: cTag,
+		DeliveryTag: replyChannel.NextDeliveryTag(),
+		Redelivered: false,
+		Exchange:    message.Exchange,
+		RoutingKey:  message.RoutingKey,
+	}, message)
+	channel.addConfirm(message.ConfirmMeta)
+
+	return nil
+}
+
+func (vhost *VirtualHost) addReplyChannel(address string, channel *Channel) {
+	vhost.replyLock.Lock()
+	defer vhost.replyLock.Unlock()
+	vhost.replyChannels[address] = channel
+}
+
+func (vhost *VirtualHost) removeReplyChannel(address string) {
+	vhost.replyLock.Lock()
+	defer vhost.replyLock.Unlock()
+	delete(vhost.replyChannels, address)
+}
+
+func (vhost *VirtualHost) getReplyChannel(address string) *Channel {
+	vhost.replyLock.RLock()
+	defer vhost.replyLock.RUnlock()
+	return vhost.replyChannels[address]
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/msgstorage"
+	"github.com/valinurovam/garagemq/queue"
+)
+
+const (
+	// diskFullModeBlock holds persistent messages published into durable queues until disk space is freed
+	diskFullModeBlock = "block"
+	// diskFullModeTransient accepts persistent messages as transient ones, they are kept in memory only
+	diskFullModeTransient = "transient"
+	// diskFullModeReject rejects persistent messages published into durable queues
+	diskFullModeReject = "reject"
+)
+
+// diskAlarmReason is sent to clients in connection.blocked
+const diskAlarmReason = "low on disk"
+
+// diskAlarm is raised while any message storage fails to write because of no free disk space
+type diskAlarm struct {
+	lock  sync.Mutex
+	full  map[*msgstorage.MsgStorage]bool
+	since time.Time
+	// cleared is closed when alarm is cleared, publishers waiting for disk space are released
+	cleared chan struct{}
+}
+
+func newDiskAlarm() *diskAlarm {
+	return &diskAlarm{
+		full: make(map[*msgstorage.MsgStorage]bool),
+	}
+}
+
+// set changes full state of storage, returns true if alarm is raised or cleared by this change
+func (alarm *diskAlarm) set(storage *msgstorage.MsgStorage, full bool) bool {
+	alarm.lock.Lock()
+	defer alarm.lock.Unlock()
+
+	wasRaised := len(alarm.full) > 0
+	if full {
+		alarm.full[storage] = true
+	} else {
+		delete(alarm.full, storage)
+	}
+	isRaised := len(alarm.full) > 0
+
+	switch {
+	case isRaised && !wasRaised:
+		alarm.since = time.Now()
+		alarm.cleared = make(chan struct{})
+	case !isRaised && wasRaised:
+		alarm.since = time.Time{}
+		close(alarm.cleared)
+		alarm.cleared = nil
+	}
+
+	return isRaised != wasRaised
+}
+
+// state returns time alarm is raised at and channel closed on clear, nil channel if alarm is not raised
+func (alarm *diskAlarm) state() (time.Time, chan struct{}) {
+	alarm.lock.Lock()
+	defer alarm.lock.Unlock()
+	return alarm.since, alarm.cleared
+}
+
+// watchStorage raises disk alarm while storage is full
+func (srv *Server) watchStorage(storage *msgstorage.MsgStorage) {
+	storage.SetFullHandler(func(full bool) {
+		srv.setStorageFull(storage, full)
+	})
+}
+
+func (srv *Server) setStorageFull(storage *msgstorage.MsgStorage, full bool) {
+	if !srv.diskAlarm.set(storage, full) {
+		return
+	}
+
+	if full {
+		log.WithField("mode", srv.getConfig().Db.DiskFullMode).Warn("Disk alarm raised")
+		srv.metrics.DiskAlarm.Counter.Inc(1)
+	} else {
+		log.Info("Disk alarm cleared")
+		srv.metrics.DiskAlarm.Counter.Dec(1)
+	}
+
+	// only blocked publishers are notified, others are not held
+	if srv.getConfig().Db.DiskFullMode != diskFullModeBlock {
+		return
+	}
+	srv.connLock.Lock()
+	defer srv.connLock.Unlock()
+	for _, conn := range srv.connections {
+		conn.sendBlocked(full)
+	}
+}
+
+// DiskAlarm returns true and time alarm is raised at while any message storage has no free disk space
+func (srv *Server) DiskAlarm() (bool, time.Time) {
+	since, cleared := srv.diskAlarm.state()
+	return cleared != nil, since
+}
+
+// diskAlarmCleared returns channel closed on clear of raised disk alarm if alarm affects message,
+// that is persistent message routed into durable queues, nil otherwise
+func (srv *Server) diskAlarmCleared(message *amqp.Message, queues []*queue.Queue) chan struct{} {
+	_, cleared := srv.diskAlarm.state()
+	if cleared == nil || !message.IsPersistent() {
+		return nil
+	}
+
+	for _, qu := range queues {
+		if qu.IsDurable() {
+			return cleared
+		}
+	}
+	return nil
+}
+
+// isRejectedOnDiskFull returns true if message should be rejected because of raised disk alarm in reject mode
+func (srv *Server) isRejectedOnDiskFull(message *amqp.Message, queues []*queue.Queue) bool {
+	return srv.getConfig().Db.DiskFullMode == diskFullModeReject && srv.diskAlarmCleared(message, queues) != nil
+}
+
+// waitDiskSpace holds persistent message routed into durable queues while disk alarm is raised
+// In transient mode message is marked transient instead, so queues keep it in memory only
+// Returns false if done is closed before alarm is cleared
+func (srv *Server) waitDiskSpace(message *amqp.Message, queues []*queue.Queue, done <-chan struct{}) bool {
+	cleared := srv.diskAlarmCleared(message, queues)
+	if cleared == nil {
+		return true
+	}
+
+	if srv.getConfig().Db.DiskFullMode == diskFullModeTransient {
+		deliveryMode := byte(1)
+		message.Header.PropertyList.DeliveryMode = &deliveryMode
+		return true
+	}
+
+	select {
+	case <-cleared:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// sendBlocked notifies client supporting connection.blocked about disk alarm
+func (conn *Connection) sendBlocked(blocked bool) {
+	if conn.status < ConnOpenOK || !conn.supportsCapability("connection.blocked") {
+		return
+	}
+	ch := conn.getChannel(0)
+	if ch == nil {
+		return
+	}
+	if blocked {
+		ch.SendMethod(&amqp.ConnectionBlocked{Reason: diskAlarmReason})
+	} else {
+		ch.SendMethod(&amqp.ConnectionUnblocked{})
+	}
+}
+
+// supportsCapability returns true if client advertised capability in connection.start-ok
+func (conn *Connection) supportsCapability(name string) bool {
+	if conn.clientProperties == nil {
+		return false
+	}
+	capabilities, ok := (*conn.clientProperties)["capabilities"].(*amqp.Table)
+	if !ok || capabilities == nil {
+		return false
+	}
+	supported, _ := (*capabilities)[name].(bool)
+	return supported
+}
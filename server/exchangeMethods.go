@@ -19,9 +19,12 @@ func (channel *Channel) exchangeRoute(method amqp.Method) *amqp.Error {
 }
 
 func (channel *Channel) exchangeDeclare(method *amqp.ExchangeDeclare) *amqp.Error {
+	// @spec-note
+	// The client MUST NOT attempt to declare an exchange with a type that the server does not support.
+	// Types registered by exchange.Register are supported as well as built-in ones.
 	exTypeId, err := exchange.GetExchangeTypeID(method.Type)
 	if err != nil {
-		return amqp.NewChannelError(amqp.NotImplemented, err.Error(), method.ClassIdentifier(), method.MethodIdentifier())
+		return amqp.NewConnectionError(amqp.CommandInvalid, err.Error(), method.ClassIdentifier(), method.MethodIdentifier())
 	}
 
 	if method.Exchange == "" {
@@ -35,10 +38,6 @@ func (channel *Channel) exchangeDeclare(method *amqp.ExchangeDeclare) *amqp.Erro
 
 	existingExchange := channel.conn.GetVirtualHost().GetExchange(method.Exchange)
 	if method.Passive {
-		if method.NoWait {
-			return nil
-		}
-
 		if existingExchange == nil {
 			return amqp.NewChannelError(
 				amqp.NotFound,
@@ -48,7 +47,9 @@ func (channel *Channel) exchangeDeclare(method *amqp.ExchangeDeclare) *amqp.Erro
 			)
 		}
 
-		channel.SendMethod(&amqp.ExchangeDeclareOk{})
+		if !method.NoWait {
+			channel.SendMethod(&amqp.ExchangeDeclareOk{})
+		}
 
 		return nil
 	}
@@ -61,6 +62,9 @@ func (channel *Channel) exchangeDeclare(method *amqp.ExchangeDeclare) *amqp.Erro
 			method.MethodIdentifier(),
 		)
 	}
+	if err := channel.server.checkExchangeName(method.Exchange); err != nil {
+		return amqp.NewChannelError(amqp.PreconditionFailed, err.Error(), method.ClassIdentifier(), method.MethodIdentifier())
+	}
 
 	newExchange := exchange.NewExchange(
 		method.Exchange,
@@ -71,6 +75,48 @@ func (channel *Channel) exchangeDeclare(method *amqp.ExchangeDeclare) *amqp.Erro
 		false,
 	)
 
+	if exTypeId == exchange.ExTypeProperty && method.Arguments != nil {
+		property, ok, err := getStringArgument(*method.Arguments, "routing-property", method)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err := newExchange.SetRoutingProperty(property); err != nil {
+				return amqp.NewChannelError(amqp.PreconditionFailed, err.Error(), method.ClassIdentifier(), method.MethodIdentifier())
+			}
+		}
+	}
+
+	newExchange.SetMeta(getMetaArguments(method.Arguments))
+
+	if method.Arguments != nil {
+		set, err := getTableArgument(*method.Arguments, exchange.ArgSetProperties, method)
+		if err != nil {
+			return err
+		}
+		defaults, err := getTableArgument(*method.Arguments, exchange.ArgDefaultProperties, method)
+		if err != nil {
+			return err
+		}
+		if err := newExchange.SetProperties(set, defaults); err != nil {
+			return amqp.NewChannelError(amqp.PreconditionFailed, err.Error(), method.ClassIdentifier(), method.MethodIdentifier())
+		}
+
+		contentTypes, err := getStringListArgument(*method.Arguments, exchange.ArgAllowedContentTypes, method)
+		if err != nil {
+			return err
+		}
+		if err := newExchange.SetAllowedContentTypes(contentTypes); err != nil {
+			return amqp.NewChannelError(amqp.PreconditionFailed, err.Error(), method.ClassIdentifier(), method.MethodIdentifier())
+		}
+	}
+
+	validator, errSchema := getSchemaArgument(method.Arguments, method)
+	if errSchema != nil {
+		return errSchema
+	}
+	newExchange.SetSchema(validator)
+
 	if existingExchange != nil {
 		if err := existingExchange.EqualWithErr(newExchange); err != nil {
 			return amqp.NewChannelError(
@@ -80,7 +126,9 @@ func (channel *Channel) exchangeDeclare(method *amqp.ExchangeDeclare) *amqp.Erro
 				method.MethodIdentifier(),
 			)
 		}
-		channel.SendMethod(&amqp.ExchangeDeclareOk{})
+		if !method.NoWait {
+			channel.SendMethod(&amqp.ExchangeDeclareOk{})
+		}
 		return nil
 	}
 
@@ -92,6 +140,77 @@ func (channel *Channel) exchangeDeclare(method *amqp.ExchangeDeclare) *amqp.Erro
 	return nil
 }
 
+// getTableArgument returns table argument, nil if argument is not set
+func getTableArgument(args amqp.Table, name string, method amqp.Method) (amqp.Table, *amqp.Error) {
+	switch value := args[name].(type) {
+	case nil:
+		return nil, nil
+	case amqp.Table:
+		return value, nil
+	case *amqp.Table:
+		if value != nil {
+			return *value, nil
+		}
+		return nil, nil
+	}
+
+	return nil, amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("%s argument should be a table", name), method.ClassIdentifier(), method.MethodIdentifier())
+}
+
+// getStringListArgument returns strings of array argument, nil if argument is not set
+func getStringListArgument(args amqp.Table, name string, method amqp.Method) ([]string, *amqp.Error) {
+	value, ok := args[name]
+	if !ok {
+		return nil, nil
+	}
+
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("%s argument should be an array of strings", name), method.ClassIdentifier(), method.MethodIdentifier())
+	}
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		switch item := item.(type) {
+		case string:
+			list = append(list, item)
+		case []byte:
+			list = append(list, string(item))
+		default:
+			return nil, amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("%s argument should be an array of strings", name), method.ClassIdentifier(), method.MethodIdentifier())
+		}
+	}
+	return list, nil
+}
+
 func (channel *Channel) exchangeDelete(method *amqp.ExchangeDelete) *amqp.Error {
+	var ex *exchange.Exchange
+	var err *amqp.Error
+
+	if ex, err = channel.getExchangeWithError(method.Exchange, method); err != nil {
+		return err
+	}
+
+	if ex.IsSystem() {
+		return amqp.NewChannelError(
+			amqp.AccessRefused,
+			fmt.Sprintf("exchange '%s' can not be deleted", method.Exchange),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		)
+	}
+
+	if errDel := channel.conn.GetVirtualHost().DeleteExchange(method.Exchange, method.IfUnused); errDel != nil {
+		return amqp.NewChannelError(
+			amqp.PreconditionFailed,
+			fmt.Sprintf("exchange '%s' in vhost '%s' %s", method.Exchange, channel.conn.GetVirtualHost().name, errDel),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		)
+	}
+
+	if !method.NoWait {
+		channel.SendMethod(&amqp.ExchangeDeleteOk{})
+	}
+
 	return nil
 }
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package server
+
+// openFileDescriptors is not supported on this platform, -1 and 0 are returned
+func openFileDescriptors() (int, uint64) {
+	return -1, 0
+}
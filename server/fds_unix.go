@@ -0,0 +1,32 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// openFileDescriptors returns number of file descriptors opened by process and soft limit of them
+// Open descriptors are counted by /dev/fd entries, -1 is returned if it could not be read
+func openFileDescriptors() (int, uint64) {
+	var limit uint64
+	var rLimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit); err == nil {
+		limit = uint64(rLimit.Cur)
+	}
+
+	dir, err := os.Open("/dev/fd")
+	if err != nil {
+		return -1, limit
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return -1, limit
+	}
+
+	// descriptor of /dev/fd directory itself is not counted
+	return len(names) - 1, limit
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// lastErrorWindow is a time the last error of connection or channel is kept for admin listings
+const lastErrorWindow = 5 * time.Minute
+
+// closedErrorsMax is a max number of kept errors of closed connections
+const closedErrorsMax = 100
+
+// LastError is the last AMQP error server closed channel or connection with
+// ChannelID is the channel error is raised on, 0 for connection errors raised on channel 0
+type LastError struct {
+	ChannelID uint16
+	ReplyCode uint16
+	ReplyText string
+	ClassID   uint16
+	MethodID  uint16
+	// ConnectionError is true if error closed the whole connection
+	ConnectionError bool
+	Time            time.Time
+}
+
+func newLastError(channelID uint16, err *amqp.Error) *LastError {
+	return &LastError{
+		ChannelID:       channelID,
+		ReplyCode:       err.ReplyCode,
+		ReplyText:       err.ReplyText,
+		ClassID:         err.ClassID,
+		MethodID:        err.MethodID,
+		ConnectionError: err.ErrorType == amqp.ErrorOnConnection,
+		Time:            time.Now(),
+	}
+}
+
+func (lastErr *LastError) isExpired() bool {
+	return time.Since(lastErr.Time) > lastErrorWindow
+}
+
+// lastErrorHolder keeps the last error until it is cleared or expired
+type lastErrorHolder struct {
+	lock sync.Mutex
+	err  *LastError
+}
+
+func (holder *lastErrorHolder) set(err *LastError) {
+	holder.lock.Lock()
+	defer holder.lock.Unlock()
+	holder.err = err
+}
+
+// get returns kept error, nil if there is no one or it is expired
+func (holder *lastErrorHolder) get() *LastError {
+	holder.lock.Lock()
+	defer holder.lock.Unlock()
+	if holder.err != nil && holder.err.isExpired() {
+		holder.err = nil
+	}
+	return holder.err
+}
+
+// clearChannel clears kept error raised on channel
+func (holder *lastErrorHolder) clearChannel(channelID uint16) {
+	holder.lock.Lock()
+	defer holder.lock.Unlock()
+	if holder.err != nil && !holder.err.ConnectionError && holder.err.ChannelID == channelID {
+		holder.err = nil
+	}
+}
+
+// ClosedConnectionError is the last error of already closed connection
+type ClosedConnectionError struct {
+	ConnID uint64
+	Addr   net.Addr
+	User   string
+	Vhost  string
+	Err    *LastError
+}
+
+// closedErrors keeps the last errors of closed connections for lastErrorWindow
+type closedErrors struct {
+	lock  sync.Mutex
+	items []*ClosedConnectionError
+}
+
+func (closed *closedErrors) add(item *ClosedConnectionError) {
+	closed.lock.Lock()
+	defer closed.lock.Unlock()
+	closed.items = append(closed.items, item)
+	if len(closed.items) > closedErrorsMax {
+		closed.items = closed.items[len(closed.items)-closedErrorsMax:]
+	}
+}
+
+// list returns not expired errors from the oldest one
+func (closed *closedErrors) list() []*ClosedConnectionError {
+	closed.lock.Lock()
+	defer closed.lock.Unlock()
+	idx := 0
+	for idx < len(closed.items) && closed.items[idx].Err.isExpired() {
+		idx++
+	}
+	closed.items = closed.items[idx:]
+	return append([]*ClosedConnectionError(nil), closed.items...)
+}
+
+// setLastError keeps error server closes channel or connection with
+// Channel error is kept by channel and by its connection, connection error only by connection
+func (channel *Channel) setLastError(err *amqp.Error) {
+	lastErr := newLastError(channel.id, err)
+	if err.ErrorType == amqp.ErrorOnChannel {
+		channel.lastError.set(lastErr)
+	}
+	channel.conn.lastError.set(lastErr)
+}
+
+// GetLastError returns the last error server closed channel with during lastErrorWindow,
+// nil if there is no one or channel was opened again after it
+func (channel *Channel) GetLastError() *LastError {
+	return channel.lastError.get()
+}
+
+// GetLastError returns the last error server closed connection or any of its channels with during lastErrorWindow
+func (conn *Connection) GetLastError() *LastError {
+	return conn.lastError.get()
+}
+
+// keepClosedError keeps the last error of closing connection, so it is available after connection is removed
+func (conn *Connection) keepClosedError() {
+	lastErr := conn.lastError.get()
+	if lastErr == nil {
+		return
+	}
+	conn.server.closedErrors.add(&ClosedConnectionError{
+		ConnID: conn.id,
+		Addr:   conn.netConn.RemoteAddr(),
+		User:   conn.userName,
+		Vhost:  conn.vhostName,
+		Err:    lastErr,
+	})
+}
+
+// GetClosedConnectionErrors returns the last errors of connections closed during lastErrorWindow
+func (srv *Server) GetClosedConnectionErrors() []*ClosedConnectionError {
+	return srv.closedErrors.list()
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package server
+
+import (
+	"net"
+)
+
+// listenTCP starts TCP listener, listen backlog is not configurable on this platform and system default one is used
+func listenTCP(tcpAddr *net.TCPAddr, backlog int) (*net.TCPListener, error) {
+	return net.ListenTCP("tcp", tcpAddr)
+}
@@ -0,0 +1,80 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenTCP starts TCP listener with given listen backlog, system default one is used if backlog is not positive
+// Backlog is capped by system limit, e.g. net.core.somaxconn on Linux
+func listenTCP(tcpAddr *net.TCPAddr, backlog int) (*net.TCPListener, error) {
+	if backlog <= 0 {
+		return net.ListenTCP("tcp", tcpAddr)
+	}
+
+	family, sockAddr, err := tcpSockaddr(tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	syscall.CloseOnExec(fd)
+
+	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+
+	if err = syscall.Bind(fd, sockAddr); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err = syscall.Listen(fd, backlog); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("listen", err)
+	}
+
+	// file listener duplicates descriptor, so the original one is closed with file
+	file := os.NewFile(uintptr(fd), tcpAddr.String())
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return listener.(*net.TCPListener), nil
+}
+
+// tcpSockaddr returns socket family and address to bind listener to
+// IPv4 socket is used for IPv4 and empty address, IPv6 one for IPv6 address
+func tcpSockaddr(tcpAddr *net.TCPAddr) (int, syscall.Sockaddr, error) {
+	if tcpAddr.IP == nil || tcpAddr.IP.To4() != nil {
+		sockAddr := &syscall.SockaddrInet4{Port: tcpAddr.Port}
+		if ip := tcpAddr.IP.To4(); ip != nil {
+			copy(sockAddr.Addr[:], ip)
+		}
+		return syscall.AF_INET, sockAddr, nil
+	}
+
+	ip := tcpAddr.IP.To16()
+	if ip == nil {
+		return 0, nil, fmt.Errorf("invalid listen address %s", tcpAddr.IP)
+	}
+	sockAddr := &syscall.SockaddrInet6{Port: tcpAddr.Port}
+	copy(sockAddr.Addr[:], ip)
+	if tcpAddr.Zone != "" {
+		iface, err := net.InterfaceByName(tcpAddr.Zone)
+		if err != nil {
+			return 0, nil, err
+		}
+		sockAddr.ZoneId = uint32(iface.Index)
+	}
+	return syscall.AF_INET6, sockAddr, nil
+}
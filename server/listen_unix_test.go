@@ -0,0 +1,32 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_ListenTCP_Backlog_Address(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:0", "[::1]:0"} {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener, err := listenTCP(tcpAddr, 16)
+		if err != nil {
+			if tcpAddr.IP.To4() == nil {
+				t.Logf("IPv6 is not available: %v", err)
+				continue
+			}
+			t.Fatal(err)
+		}
+
+		addr := listener.Addr().(*net.TCPAddr)
+		listener.Close()
+		if !addr.IP.Equal(tcpAddr.IP) || addr.Port == 0 {
+			t.Fatalf("Expected listener bound to %s, actual %s", tcpAddr.IP, addr)
+		}
+	}
+}
@@ -0,0 +1,539 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/consumer"
+	"github.com/valinurovam/garagemq/exchange"
+	"github.com/valinurovam/garagemq/qos"
+	"github.com/valinurovam/garagemq/queue"
+	"github.com/valinurovam/garagemq/spool"
+)
+
+// Client represents minimal broker client API
+// It is implemented by in-process LocalClient, so the same code can be run against it and AMQP client adapter
+type Client interface {
+	ExchangeDeclare(name string, exType string, durable bool, autoDelete bool) error
+	QueueDeclare(name string, durable bool, autoDelete bool) error
+	QueueBind(queueName string, exchangeName string, routingKey string, arguments *amqp.Table) error
+	Publish(exchangeName string, routingKey string, properties *amqp.BasicPropertyList, body []byte) error
+	Consume(queueName string, consumerTag string, noAck bool) (<-chan *Delivery, error)
+	Cancel(consumerTag string) error
+	Ack(deliveryTag uint64, multiple bool) error
+	Nack(deliveryTag uint64, multiple bool, requeue bool) error
+	Close() error
+}
+
+// Delivery represents message delivered to consumer of LocalClient
+type Delivery struct {
+	ConsumerTag string
+	DeliveryTag uint64
+	Redelivered bool
+	Exchange    string
+	RoutingKey  string
+	Properties  *amqp.BasicPropertyList
+	Body        []byte
+}
+
+// LocalClient is in-process broker client
+// It works with vhost entities directly, so messages are published and consumed without AMQP framing and network.
+// Unacked messages are requeued on Close, as they are on closing of AMQP channel
+type LocalClient struct {
+	server      *Server
+	vhost       *VirtualHost
+	qos         *qos.AmqpQos
+	deliveryTag uint64
+	cmrLock     sync.Mutex
+	consumers   map[string]*localConsumer
+	ackLock     sync.Mutex
+	ackStore    map[uint64]*UnackedMessage
+	closed      int32
+}
+
+// localConsumer passes deliveries to client through pending list, so consumer never waits for client reading them
+type localConsumer struct {
+	client     *LocalClient
+	cmr        *consumer.Consumer
+	noAck      bool
+	lock       sync.Mutex
+	pending    []*Delivery
+	signal     chan struct{}
+	deliveries chan *Delivery
+	done       chan struct{}
+}
+
+func newLocalConsumer(client *LocalClient, cmr *consumer.Consumer, noAck bool) *localConsumer {
+	localCmr := &localConsumer{
+		client:     client,
+		cmr:        cmr,
+		noAck:      noAck,
+		signal:     make(chan struct{}, 1),
+		deliveries: make(chan *Delivery),
+		done:       make(chan struct{}),
+	}
+	go localCmr.forward()
+	return localCmr
+}
+
+func (localCmr *localConsumer) push(delivery *Delivery) {
+	localCmr.lock.Lock()
+	localCmr.pending = append(localCmr.pending, delivery)
+	localCmr.lock.Unlock()
+
+	select {
+	case localCmr.signal <- struct{}{}:
+	default:
+	}
+}
+
+// forward sends pending deliveries to client until consumer is stopped
+// Deliveries not taken by client are requeued, deliveries channel is closed at the end
+func (localCmr *localConsumer) forward() {
+	defer close(localCmr.deliveries)
+	for {
+		select {
+		case <-localCmr.signal:
+		case <-localCmr.done:
+			localCmr.requeuePending(nil)
+			return
+		}
+
+		localCmr.lock.Lock()
+		pending := localCmr.pending
+		localCmr.pending = nil
+		localCmr.lock.Unlock()
+
+		for idx, delivery := range pending {
+			select {
+			case localCmr.deliveries <- delivery:
+			case <-localCmr.done:
+				localCmr.requeuePending(pending[idx:])
+				return
+			}
+		}
+	}
+}
+
+func (localCmr *localConsumer) requeuePending(pending []*Delivery) {
+	if localCmr.noAck {
+		return
+	}
+
+	localCmr.lock.Lock()
+	pending = append(pending, localCmr.pending...)
+	localCmr.pending = nil
+	localCmr.lock.Unlock()
+
+	// requeued messages are pushed into queue head, so they are requeued in reverse order to keep it
+	for idx := len(pending) - 1; idx >= 0; idx-- {
+		localCmr.client.Nack(pending[idx].DeliveryTag, false, true)
+	}
+}
+
+// stop stops consumer, it is called once for removed from client consumer
+func (localCmr *localConsumer) stop() {
+	// consumer does not send deliveries after stop, so the rest of them could be requeued
+	localCmr.cmr.Stop()
+	close(localCmr.done)
+}
+
+// NewLocalClient returns in-process client of given virtual host
+// prefetchCount limits unacked messages of all client consumers, 0 means no limit
+func (srv *Server) NewLocalClient(vhostName string, prefetchCount uint16) (*LocalClient, error) {
+	vhost := srv.getVhost(vhostName)
+	if vhost == nil {
+		return nil, fmt.Errorf("vhost '%s' not found", vhostName)
+	}
+
+	return &LocalClient{
+		server:    srv,
+		vhost:     vhost,
+		qos:       qos.NewAmqpQos(prefetchCount, 0),
+		consumers: make(map[string]*localConsumer),
+		ackStore:  make(map[uint64]*UnackedMessage),
+	}, nil
+}
+
+func (client *LocalClient) isClosed() bool {
+	return atomic.LoadInt32(&client.closed) == 1
+}
+
+// ExchangeDeclare declares exchange of given type alias, e.g. "direct" or "topic"
+func (client *LocalClient) ExchangeDeclare(name string, exType string, durable bool, autoDelete bool) error {
+	exTypeID, err := exchange.GetExchangeTypeID(exType)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return errors.New("exchange name is required")
+	}
+
+	newExchange := exchange.NewExchange(name, exTypeID, durable, autoDelete, false, false)
+	if existing := client.vhost.GetExchange(name); existing != nil {
+		return existing.EqualWithErr(newExchange)
+	}
+	if strings.HasPrefix(name, "amq.") {
+		return fmt.Errorf("exchange name '%s' contains reserved prefix 'amq.*'", name)
+	}
+	if err := client.server.checkExchangeName(name); err != nil {
+		return err
+	}
+
+	client.vhost.AppendExchange(newExchange)
+	return nil
+}
+
+// QueueDeclare declares queue without arguments
+func (client *LocalClient) QueueDeclare(name string, durable bool, autoDelete bool) error {
+	if name == "" {
+		return errors.New("queue name is required")
+	}
+
+	newQueue := client.vhost.NewQueue(name, 0, false, autoDelete, durable, client.server.getConfig().Queue.ShardSize)
+	if existing := client.vhost.GetQueue(name); existing != nil {
+		if existing.IsExclusive() {
+			return fmt.Errorf("queue '%s' is locked to another connection", name)
+		}
+		return existing.EqualWithErr(newQueue)
+	}
+	if err := client.server.checkQueueName(name); err != nil {
+		return err
+	}
+	if err := client.vhost.checkQuarantined(name); err != nil {
+		return err
+	}
+
+	newQueue.Start()
+	client.vhost.AppendQueue(newQueue)
+	return nil
+}
+
+// QueueBind binds queue to exchange
+func (client *LocalClient) QueueBind(queueName string, exchangeName string, routingKey string, arguments *amqp.Table) error {
+	if exchangeName == exDefaultName {
+		return errors.New("operation not permitted on the default exchange")
+	}
+	return client.vhost.BindQueue(exchangeName, queueName, routingKey, arguments)
+}
+
+// Publish routes message into queues bound to exchange
+// Message is pushed into queues before method returns, unroutable message is dropped
+func (client *LocalClient) Publish(exchangeName string, routingKey string, properties *amqp.BasicPropertyList, body []byte) error {
+	if client.isClosed() {
+		return errors.New("client is closed")
+	}
+
+	if properties == nil {
+		properties = &amqp.BasicPropertyList{}
+	}
+	// exchange could stamp its properties, so properties of caller are copied
+	propertiesCopy := *properties
+	properties = &propertiesCopy
+	message := &amqp.Message{
+		Exchange:   exchangeName,
+		RoutingKey: routingKey,
+		BodySize:   uint64(len(body)),
+		Header: &amqp.ContentHeader{
+			BodySize:     uint64(len(body)),
+			ClassID:      amqp.ClassBasic,
+			PropertyList: properties,
+		},
+		Body: []*amqp.Frame{{Type: byte(amqp.FrameBody), Payload: body}},
+	}
+	if err := checkExpiration(message); err != nil {
+		return errors.New(err.ReplyText)
+	}
+
+	route, reason, err := client.vhost.routePublish(message)
+	if err != nil {
+		if reason != "" {
+			client.server.countRejectedPublish(reason)
+		}
+		return errors.New(err.ReplyText)
+	}
+	if len(route.queues) != 0 {
+		client.server.waitDiskSpace(message, route.queues, nil)
+		if _, err := client.server.enqueuePublish(message, route); err != nil {
+			return err
+		}
+	}
+
+	// error is returned if any queue is full, message is still pushed into the rest of them
+	if route.overflowed {
+		return errors.New(queueOverflowReason)
+	}
+	return nil
+}
+
+// Consume starts consumer of queue and returns channel of its deliveries
+// Channel is closed when consumer is cancelled by client or by broker, e.g. on queue deletion
+func (client *LocalClient) Consume(queueName string, consumerTag string, noAck bool) (<-chan *Delivery, error) {
+	if client.isClosed() {
+		return nil, errors.New("client is closed")
+	}
+	if client.server.IsMaintenance() {
+		return nil, errors.New("server is in maintenance mode")
+	}
+
+	client.cmrLock.Lock()
+	defer client.cmrLock.Unlock()
+
+	qu := client.vhost.GetQueue(queueName)
+	if qu == nil {
+		return nil, fmt.Errorf("queue '%s' not found", queueName)
+	}
+
+	cmr := consumer.NewConsumer(queueName, consumerTag, consumer.Options{NoAck: noAck}, client, qu, []*qos.AmqpQos{client.qos})
+	if _, ok := client.consumers[cmr.Tag()]; ok {
+		return nil, fmt.Errorf("consumer with tag '%s' already exists", cmr.Tag())
+	}
+	if err := qu.AddConsumer(cmr, false); err != nil {
+		return nil, err
+	}
+
+	localCmr := newLocalConsumer(client, cmr, noAck)
+	client.consumers[cmr.Tag()] = localCmr
+	cmr.Start()
+
+	return localCmr.deliveries, nil
+}
+
+// Cancel stops consumer, messages delivered to client are kept until they are acked or client is closed,
+// messages not taken by client yet are requeued
+func (client *LocalClient) Cancel(consumerTag string) error {
+	client.cmrLock.Lock()
+	localCmr, ok := client.consumers[consumerTag]
+	delete(client.consumers, consumerTag)
+	client.cmrLock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("consumer with tag '%s' not found", consumerTag)
+	}
+
+	localCmr.stop()
+	return nil
+}
+
+// Ack acknowledges delivered message, all messages up to delivery tag if multiple is set
+func (client *LocalClient) Ack(deliveryTag uint64, multiple bool) error {
+	client.ackLock.Lock()
+	defer client.ackLock.Unlock()
+
+	if multiple {
+		for tag, uMsg := range client.ackStore {
+			if deliveryTag == 0 || tag <= deliveryTag {
+				client.ackMsg(uMsg, tag)
+			}
+		}
+		return nil
+	}
+
+	uMsg, ok := client.ackStore[deliveryTag]
+	if !ok {
+		return fmt.Errorf("delivery tag [%d] not found", deliveryTag)
+	}
+	client.ackMsg(uMsg, deliveryTag)
+	return nil
+}
+
+func (client *LocalClient) ackMsg(unackedMessage *UnackedMessage, deliveryTag uint64) {
+	delete(client.ackStore, deliveryTag)
+	if qu := client.vhost.GetQueue(unackedMessage.queue); qu != nil {
+		qu.AckMsg(unackedMessage.msg)
+	} else {
+		spool.Release(unackedMessage.msg)
+	}
+	client.decQosAndConsumerNext(unackedMessage)
+}
+
+// Nack rejects delivered message, all messages up to delivery tag if multiple is set
+// Rejected message is returned into queue if requeue is set, otherwise it is dead-lettered or dropped
+func (client *LocalClient) Nack(deliveryTag uint64, multiple bool, requeue bool) error {
+	client.ackLock.Lock()
+	defer client.ackLock.Unlock()
+
+	if multiple {
+		deliveryTags := make([]uint64, 0, len(client.ackStore))
+		for tag := range client.ackStore {
+			if deliveryTag == 0 || tag <= deliveryTag {
+				deliveryTags = append(deliveryTags, tag)
+			}
+		}
+		// requeued messages are pushed into queue head, so they are rejected in reverse order to keep it
+		sort.Slice(deliveryTags, func(i, j int) bool {
+			return (deliveryTags[i] > deliveryTags[j]) == requeue
+		})
+		for _, tag := range deliveryTags {
+			client.rejectMsg(client.ackStore[tag], tag, requeue)
+		}
+		return nil
+	}
+
+	uMsg, ok := client.ackStore[deliveryTag]
+	if !ok {
+		return fmt.Errorf("delivery tag [%d] not found", deliveryTag)
+	}
+	client.rejectMsg(uMsg, deliveryTag, requeue)
+	return nil
+}
+
+func (client *LocalClient) rejectMsg(unackedMessage *UnackedMessage, deliveryTag uint64, requeue bool) {
+	delete(client.ackStore, deliveryTag)
+	if qu := client.vhost.GetQueue(unackedMessage.queue); qu != nil {
+		if requeue {
+			qu.Requeue(unackedMessage.msg)
+		} else if delay, retried, ok := qu.RetryDelay(unackedMessage.msg); ok {
+			qu.RequeueAfter(retried, delay)
+		} else {
+			client.vhost.deadLetter(qu, []*amqp.Message{unackedMessage.msg}, queue.DeadLetterRejected)
+			qu.AckMsg(unackedMessage.msg)
+		}
+	} else {
+		spool.Release(unackedMessage.msg)
+	}
+	client.decQosAndConsumerNext(unackedMessage)
+}
+
+func (client *LocalClient) decQosAndConsumerNext(unackedMessage *UnackedMessage) {
+	client.qos.Dec(1, uint32(unackedMessage.msg.BodySize))
+
+	client.cmrLock.Lock()
+	defer client.cmrLock.Unlock()
+	// credit is shared by all consumers of client, so each of them may take the next message
+	for _, localCmr := range client.consumers {
+		localCmr.cmr.Consume()
+	}
+}
+
+// Close cancels consumers and requeues unacked messages
+func (client *LocalClient) Close() error {
+	if !atomic.CompareAndSwapInt32(&client.closed, 0, 1) {
+		return nil
+	}
+
+	client.cmrLock.Lock()
+	consumers := client.consumers
+	client.consumers = make(map[string]*localConsumer)
+	client.cmrLock.Unlock()
+	for _, localCmr := range consumers {
+		localCmr.stop()
+	}
+
+	client.ackLock.Lock()
+	defer client.ackLock.Unlock()
+	deliveryTags := make([]uint64, 0, len(client.ackStore))
+	for tag := range client.ackStore {
+		deliveryTags = append(deliveryTags, tag)
+	}
+	sort.Slice(deliveryTags, func(i, j int) bool {
+		return deliveryTags[i] < deliveryTags[j]
+	})
+
+	queueMessages := make(map[string][]*amqp.Message)
+	for _, tag := range deliveryTags {
+		uMsg := client.ackStore[tag]
+		delete(client.ackStore, tag)
+		queueMessages[uMsg.queue] = append(queueMessages[uMsg.queue], uMsg.msg)
+	}
+	for queueName, messages := range queueMessages {
+		if qu := client.vhost.GetQueue(queueName); qu != nil {
+			qu.RequeueAll(messages)
+			continue
+		}
+		for _, message := range messages {
+			spool.Release(message)
+		}
+	}
+
+	return nil
+}
+
+// SendContent passes delivered message to its consumer without waiting for client
+// Method is called by consumer, it implements interfaces.Channel
+func (client *LocalClient) SendContent(method amqp.Method, message *amqp.Message) {
+	deliver, ok := method.(*amqp.BasicDeliver)
+	if !ok {
+		return
+	}
+
+	client.cmrLock.Lock()
+	localCmr, ok := client.consumers[deliver.ConsumerTag]
+	client.cmrLock.Unlock()
+	if !ok {
+		return
+	}
+
+	body, err := readMessageBody(message)
+	if err != nil {
+		log.WithError(err).Error("Error on reading spool file")
+		return
+	}
+
+	localCmr.push(&Delivery{
+		ConsumerTag: deliver.ConsumerTag,
+		DeliveryTag: deliver.DeliveryTag,
+		Redelivered: deliver.Redelivered,
+		Exchange:    deliver.Exchange,
+		RoutingKey:  deliver.RoutingKey,
+		Properties:  message.Header.PropertyList,
+		Body:        body,
+	})
+	client.server.GetMetrics().Deliver.Counter.Inc(1)
+}
+
+// SendMethod handles methods sent by broker to client
+// Consumer cancelled by broker gets its deliveries channel closed, other methods are not used by local client
+func (client *LocalClient) SendMethod(method amqp.Method) {
+	cancel, ok := method.(*amqp.BasicCancel)
+	if !ok {
+		return
+	}
+
+	client.cmrLock.Lock()
+	localCmr, ok := client.consumers[cancel.ConsumerTag]
+	delete(client.consumers, cancel.ConsumerTag)
+	client.cmrLock.Unlock()
+	if ok {
+		localCmr.stop()
+	}
+}
+
+// NextDeliveryTag returns next delivery tag of client, it implements interfaces.Channel
+func (client *LocalClient) NextDeliveryTag() uint64 {
+	return atomic.AddUint64(&client.deliveryTag, 1)
+}
+
+// AddUnackedMessage stores delivered message until it is acked, it implements interfaces.Channel
+func (client *LocalClient) AddUnackedMessage(dTag uint64, cTag string, queue string, message *amqp.Message) {
+	client.ackLock.Lock()
+	defer client.ackLock.Unlock()
+	client.ackStore[dTag] = &UnackedMessage{
+		cTag:  cTag,
+		msg:   message,
+		queue: queue,
+	}
+}
+
+// readMessageBody returns message body kept in memory or in spool file
+func readMessageBody(message *amqp.Message) ([]byte, error) {
+	body := make([]byte, 0, message.BodySize)
+	if message.SpoolPath != "" {
+		err := spool.ReadFrames(message, 0, spool.DefaultChunkSize, func(frame *amqp.Frame) {
+			body = append(body, frame.Payload...)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, frame := range message.Body {
+		body = append(body, frame.Payload...)
+	}
+	return body, nil
+}
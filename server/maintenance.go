@@ -0,0 +1,70 @@
+package server
+
+import (
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SetMaintenance turns maintenance mode on or off
+// In maintenance mode server refuses new connections and new consumers, existing consumers keep draining their queues
+func (srv *Server) SetMaintenance(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	if atomic.SwapInt32(&srv.maintenance, value) == value {
+		return
+	}
+
+	if enabled {
+		log.Warn("Maintenance mode is on, new connections and consumers are refused")
+	} else {
+		log.Info("Maintenance mode is off")
+	}
+}
+
+// IsMaintenance returns true if server is in maintenance mode
+func (srv *Server) IsMaintenance() bool {
+	return atomic.LoadInt32(&srv.maintenance) == 1
+}
+
+// IsDrained returns true if server is in maintenance mode and existing consumers have nothing left to drain:
+// queues with consumers are empty and no delivered message waits for acknowledgement
+// Messages of queues without consumers are kept and do not block drain
+func (srv *Server) IsDrained() bool {
+	if !srv.IsMaintenance() {
+		return false
+	}
+
+	srv.connLock.Lock()
+	connections := make([]*Connection, 0, len(srv.connections))
+	for _, conn := range srv.connections {
+		connections = append(connections, conn)
+	}
+	srv.connLock.Unlock()
+
+	for _, conn := range connections {
+		conn.channelsLock.RLock()
+		for _, channel := range conn.channels {
+			channel.ackLock.Lock()
+			unacked := len(channel.ackStore)
+			channel.ackLock.Unlock()
+			if unacked > 0 {
+				conn.channelsLock.RUnlock()
+				return false
+			}
+		}
+		conn.channelsLock.RUnlock()
+	}
+
+	for _, vhost := range srv.GetVhosts() {
+		for _, qu := range vhost.GetQueues() {
+			if qu.ConsumersCount() > 0 && qu.Length() > 0 {
+				return false
+			}
+		}
+	}
+
+	return true
+}
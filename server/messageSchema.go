@@ -0,0 +1,143 @@
+package server
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/exchange"
+	"github.com/valinurovam/garagemq/queue"
+	"github.com/valinurovam/garagemq/schema"
+	"github.com/valinurovam/garagemq/spool"
+)
+
+// Declaration arguments enabling validation of message bodies by exchange or queue
+const (
+	argSchema     = "x-schema"
+	argSchemaType = "x-schema-type"
+)
+
+// getSchemaArgument returns validator of x-schema argument of type x-schema-type, nil if argument is not set
+func getSchemaArgument(args *amqp.Table, method amqp.Method) (schema.Validator, *amqp.Error) {
+	if args == nil {
+		return nil, nil
+	}
+
+	definition, ok, err := getStringArgument(*args, argSchema, method)
+	if err != nil {
+		return nil, err
+	}
+	schemaType, hasType, err := getStringArgument(*args, argSchemaType, method)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if hasType {
+			return nil, amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("%s argument requires %s", argSchemaType, argSchema), method.ClassIdentifier(), method.MethodIdentifier())
+		}
+		return nil, nil
+	}
+
+	validator, errNew := schema.New(schemaType, definition)
+	if errNew != nil {
+		return nil, amqp.NewChannelError(amqp.PreconditionFailed, errNew.Error(), method.ClassIdentifier(), method.MethodIdentifier())
+	}
+	return validator, nil
+}
+
+// newSchema returns validator of exported definition, nil if definition is empty
+func newSchema(schemaType string, definition string) (schema.Validator, error) {
+	if definition == "" {
+		if schemaType != "" {
+			return nil, fmt.Errorf("schema_type requires schema")
+		}
+		return nil, nil
+	}
+	return schema.New(schemaType, definition)
+}
+
+// exportSchema returns type and definition of validator, empty strings for nil validator
+func exportSchema(validator schema.Validator) (schemaType string, definition string) {
+	if validator == nil {
+		return "", ""
+	}
+	return validator.Type(), validator.Definition()
+}
+
+// schemaChecker validates message body against schemas of exchange and queues message is routed into
+// Body is read only once and only if there is any schema, so messages of resources without schemas are not affected
+type schemaChecker struct {
+	message *amqp.Message
+	body    []byte
+	read    bool
+}
+
+func (checker *schemaChecker) validate(validator schema.Validator) error {
+	if !checker.read {
+		body, err := spool.ReadBody(checker.message)
+		if err != nil {
+			return fmt.Errorf("error on reading message body: %s", err.Error())
+		}
+		checker.body = body
+		checker.read = true
+	}
+	return validator.Validate(checker.body)
+}
+
+// checkExchangeSchema returns error if body of message does not conform to x-schema of exchange
+func checkExchangeSchema(ex *exchange.Exchange, checker *schemaChecker) error {
+	validator := ex.GetSchema()
+	if validator == nil {
+		return nil
+	}
+	if err := checker.validate(validator); err != nil {
+		return fmt.Errorf("message does not conform to schema of exchange '%s': %s", ex.GetName(), err.Error())
+	}
+	return nil
+}
+
+// checkQueueSchemas validates body of message against x-schema of queues message is routed into
+// Invalid message is dead-lettered from queues with dead-letter exchange and they are removed from returned queues
+// Error is returned if message is invalid for any queue without dead-letter exchange, nothing is dead-lettered then
+func (vhost *VirtualHost) checkQueueSchemas(queues []*queue.Queue, checker *schemaChecker) ([]*queue.Queue, error) {
+	var invalid []*queue.Queue
+	for _, qu := range queues {
+		validator := qu.GetSchema()
+		if validator == nil {
+			continue
+		}
+		if err := checker.validate(validator); err != nil {
+			if qu.GetDeadLetter() == nil {
+				return nil, fmt.Errorf("message does not conform to schema of queue '%s': %s", qu.GetName(), err.Error())
+			}
+			invalid = append(invalid, qu)
+		}
+	}
+	if len(invalid) == 0 {
+		return queues, nil
+	}
+
+	valid := make([]*queue.Queue, 0, len(queues)-len(invalid))
+	for _, qu := range queues {
+		if isInvalid(qu, invalid) {
+			vhost.logger.WithFields(log.Fields{
+				"queueName":  qu.GetName(),
+				"exchange":   checker.message.Exchange,
+				"routingKey": checker.message.RoutingKey,
+			}).Debug("Message does not conform to schema of queue, dead-lettered")
+			vhost.deadLetter(qu, []*amqp.Message{checker.message}, queue.DeadLetterRejected)
+			continue
+		}
+		valid = append(valid, qu)
+	}
+	return valid, nil
+}
+
+func isInvalid(qu *queue.Queue, invalid []*queue.Queue) bool {
+	for _, item := range invalid {
+		if item == qu {
+			return true
+		}
+	}
+	return false
+}
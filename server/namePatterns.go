@@ -0,0 +1,73 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/valinurovam/garagemq/config"
+)
+
+// reservedPrefix is the prefix of pre-declared exchanges and server-named queues, clients can not declare such names
+const reservedPrefix = "amq."
+
+// namePatterns are compiled patterns of exchange and queue names clients could declare, nil pattern allows any name
+type namePatterns struct {
+	exchange *regexp.Regexp
+	queue    *regexp.Regexp
+}
+
+func newNamePatterns(security config.Security) (*namePatterns, error) {
+	patterns := &namePatterns{}
+	var err error
+	if patterns.exchange, err = compileNamePattern("exchangeNamePattern", security.ExchangeNamePattern); err != nil {
+		return nil, err
+	}
+	if patterns.queue, err = compileNamePattern("queueNamePattern", security.QueueNamePattern); err != nil {
+		return nil, err
+	}
+	return patterns, nil
+}
+
+func compileNamePattern(setting string, pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid security %s '%s': %s", setting, pattern, err.Error())
+	}
+	return compiled, nil
+}
+
+func (srv *Server) getNamePatterns() *namePatterns {
+	srv.namePatternsLock.RLock()
+	defer srv.namePatternsLock.RUnlock()
+	return srv.namePatterns
+}
+
+func (srv *Server) setNamePatterns(patterns *namePatterns) {
+	srv.namePatternsLock.Lock()
+	defer srv.namePatternsLock.Unlock()
+	srv.namePatterns = patterns
+}
+
+// checkExchangeName returns error if exchange name does not match configured pattern
+// Reserved amq.* names are not checked, they could not be declared by clients anyway
+func (srv *Server) checkExchangeName(name string) error {
+	pattern := srv.getNamePatterns().exchange
+	if pattern == nil || strings.HasPrefix(name, reservedPrefix) || pattern.MatchString(name) {
+		return nil
+	}
+	return fmt.Errorf("exchange name '%s' does not match pattern '%s'", name, pattern.String())
+}
+
+// checkQueueName returns error if queue name does not match configured pattern
+// Server-named queues and other reserved amq.* names are not checked
+func (srv *Server) checkQueueName(name string) error {
+	pattern := srv.getNamePatterns().queue
+	if pattern == nil || strings.HasPrefix(name, reservedPrefix) || pattern.MatchString(name) {
+		return nil
+	}
+	return fmt.Errorf("queue name '%s' does not match pattern '%s'", name, pattern.String())
+}
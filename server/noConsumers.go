@@ -0,0 +1,39 @@
+package server
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/queue"
+)
+
+// dropIfNoConsumers removes queues with x-drop-if-no-consumers which have no consumers from queues message is routed into
+// Message is dead-lettered from such queues with dead-letter exchange and dropped from others
+// Waiting consumers of queue with single active consumer are counted too, so such queue has consumer while any of them is left
+func (vhost *VirtualHost) dropIfNoConsumers(queues []*queue.Queue, message *amqp.Message) []*queue.Queue {
+	var kept []*queue.Queue
+	for idx, qu := range queues {
+		if !qu.IsDropIfNoConsumers() || qu.ConsumersCount() != 0 {
+			if kept != nil {
+				kept = append(kept, qu)
+			}
+			continue
+		}
+		// queues are copied only if any of them is dropped
+		if kept == nil {
+			kept = make([]*queue.Queue, idx, len(queues)-1)
+			copy(kept, queues[:idx])
+		}
+
+		vhost.logger.WithFields(log.Fields{
+			"queueName":  qu.GetName(),
+			"exchange":   message.Exchange,
+			"routingKey": message.RoutingKey,
+		}).Debug("Message routed into queue without consumers is dropped")
+		vhost.deadLetter(qu, []*amqp.Message{message}, queue.DeadLetterNoConsumers)
+	}
+
+	if kept == nil {
+		return queues
+	}
+	return kept
+}
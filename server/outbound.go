@@ -0,0 +1,132 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// outboundChannelFrames is a max number of frames queued by one channel, sender of channel is blocked until writer takes them
+const outboundChannelFrames = 100
+
+// outboundQuantum is a number of payload bytes channel could send in its turn
+const outboundQuantum = 131072
+
+// outbound multiplexes frames of connection channels into socket writer
+// Channels with queued frames are served in round robin by payload bytes (deficit round robin),
+// so channel draining huge queue could not monopolize the socket and delay deliveries of other channels
+// Frames of each channel keep their order
+type outbound struct {
+	lock sync.Mutex
+	// frames of channels by channel id, channel is removed when all its frames are taken
+	queues map[uint16]*outboundQueue
+	// ring of channels with queued frames, head is the channel in its turn
+	active  []uint16
+	pending int
+	// signaled when frame is queued
+	ready chan struct{}
+}
+
+type outboundQueue struct {
+	frames  []*amqp.Frame
+	deficit int
+	// closed when frame is taken from full queue
+	space chan struct{}
+}
+
+func newOutbound() *outbound {
+	return &outbound{
+		queues: make(map[uint16]*outboundQueue),
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// push queues frame into its channel queue, blocks while channel queue is full
+// Returns false if done is closed before frame is queued
+func (out *outbound) push(done <-chan struct{}, frame *amqp.Frame) bool {
+	for {
+		out.lock.Lock()
+		queue, ok := out.queues[frame.ChannelID]
+		if !ok {
+			queue = &outboundQueue{space: make(chan struct{})}
+			out.queues[frame.ChannelID] = queue
+			out.active = append(out.active, frame.ChannelID)
+		}
+		if len(queue.frames) < outboundChannelFrames {
+			queue.frames = append(queue.frames, frame)
+			out.pending++
+			out.lock.Unlock()
+
+			select {
+			case out.ready <- struct{}{}:
+			default:
+			}
+			return true
+		}
+		space := queue.space
+		out.lock.Unlock()
+
+		select {
+		case <-space:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// pop returns next frame to write, blocks until any frame is queued
+// Returns nil if done is closed
+func (out *outbound) pop(done <-chan struct{}) *amqp.Frame {
+	for {
+		if frame := out.next(); frame != nil {
+			return frame
+		}
+
+		select {
+		case <-out.ready:
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// next takes frame of channel in its turn, nil if no frames are queued
+// Channel keeps its turn while it has enough deficit for the next frame, then it goes to the ring tail with new quantum
+func (out *outbound) next() *amqp.Frame {
+	out.lock.Lock()
+	defer out.lock.Unlock()
+
+	for len(out.active) > 0 {
+		id := out.active[0]
+		queue := out.queues[id]
+		frame := queue.frames[0]
+		if queue.deficit < len(frame.Payload) {
+			queue.deficit += outboundQuantum
+			out.active = append(out.active[1:], id)
+			continue
+		}
+
+		queue.deficit -= len(frame.Payload)
+		queue.frames[0] = nil
+		queue.frames = queue.frames[1:]
+		out.pending--
+		if len(queue.frames) == outboundChannelFrames-1 {
+			close(queue.space)
+			queue.space = make(chan struct{})
+		}
+		if len(queue.frames) == 0 {
+			delete(out.queues, id)
+			out.active = out.active[1:]
+		}
+		return frame
+	}
+
+	return nil
+}
+
+// len returns number of queued frames of all channels
+func (out *outbound) len() int {
+	out.lock.Lock()
+	defer out.lock.Unlock()
+	return out.pending
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/queue"
+)
+
+// queueOverflowReason is reply text of basic.return of mandatory message rejected by all full queues it is routed into
+const queueOverflowReason = "Queue overflow"
+
+// getQueueMaxLength returns parsed x-max-length queue argument, 0 if argument is not set
+// x-overflow is accepted only with reject-publish value, as other overflow behaviours are not implemented
+func getQueueMaxLength(method *amqp.QueueDeclare) (int64, *amqp.Error) {
+	if method.Arguments == nil {
+		return 0, nil
+	}
+
+	overflow, ok, err := getStringArgument(*method.Arguments, "x-overflow", method)
+	if err != nil {
+		return 0, err
+	}
+	if ok && overflow != queue.OverflowRejectPublish {
+		return 0, amqp.NewChannelError(
+			amqp.PreconditionFailed,
+			fmt.Sprintf("x-overflow '%s' is not supported, only '%s' is implemented", overflow, queue.OverflowRejectPublish),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		)
+	}
+
+	maxLength, _, err := getDurationArgument(*method.Arguments, "x-max-length", method)
+	return maxLength, err
+}
+
+// rejectOverflowed removes full queues with x-max-length from queues message is routed into
+// Returns true if message is rejected by any of them, message is still pushed into the rest of queues
+func rejectOverflowed(queues []*queue.Queue) ([]*queue.Queue, bool) {
+	var kept []*queue.Queue
+	for idx, qu := range queues {
+		if !qu.IsFull() {
+			if kept != nil {
+				kept = append(kept, qu)
+			}
+			continue
+		}
+		// queues are copied only if any of them is full
+		if kept == nil {
+			kept = make([]*queue.Queue, idx, len(queues)-1)
+			copy(kept, queues[:idx])
+		}
+	}
+
+	if kept == nil {
+		return queues, false
+	}
+	return kept, true
+}
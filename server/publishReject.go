@@ -0,0 +1,63 @@
+package server
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/metrics"
+)
+
+// Reasons of publishes rejected by broker, each one has its own counter server.publish_rejected.<reason>
+const (
+	// publishRejectExchangeDisabled - message is published into disabled exchange
+	publishRejectExchangeDisabled = "exchange_disabled"
+	// publishRejectDiskFull - persistent message is routed into durable queues while disk alarm is raised in reject mode
+	publishRejectDiskFull = "disk_full"
+	// publishRejectSchemaInvalid - message body does not conform to x-schema of exchange or queue without dead-letter exchange
+	publishRejectSchemaInvalid = "schema_invalid"
+	// publishRejectContentType - content-type of message is not listed in x-allowed-content-types of exchange
+	publishRejectContentType = "content_type"
+	// publishRejectQueueOverflow - message is routed into queue with x-max-length which is full
+	publishRejectQueueOverflow = "queue_overflow"
+)
+
+var publishRejectReasons = []string{
+	publishRejectExchangeDisabled,
+	publishRejectDiskFull,
+	publishRejectSchemaInvalid,
+	publishRejectContentType,
+	publishRejectQueueOverflow,
+}
+
+func newPublishRejectedMetrics() map[string]*metrics.TrackCounter {
+	counters := make(map[string]*metrics.TrackCounter, len(publishRejectReasons))
+	for _, reason := range publishRejectReasons {
+		counters[reason] = metrics.AddCounter(fmt.Sprintf("server.publish_rejected.%s", reason))
+	}
+	return counters
+}
+
+// countRejectedPublish counts publish rejected by broker in total and by reason counters
+func (srv *Server) countRejectedPublish(reason string) {
+	srv.metrics.PublishRejected.Counter.Inc(1)
+	srv.metrics.PublishRejectedBy[reason].Counter.Inc(1)
+}
+
+// rejectPublish rejects completely received message which broker does not accept
+// Publisher in confirm mode gets basic.nack and channel stays open, otherwise channel is closed with err
+func (channel *Channel) rejectPublish(message *amqp.Message, reason string, err *amqp.Error) *amqp.Error {
+	channel.server.countRejectedPublish(reason)
+	channel.logger.WithFields(log.Fields{
+		"exchange":   message.Exchange,
+		"routingKey": message.RoutingKey,
+		"reason":     reason,
+	}).Debug("Publish rejected")
+
+	if message.ConfirmMeta == nil {
+		return err
+	}
+	message.ConfirmMeta.Nack = true
+	channel.addConfirm(message.ConfirmMeta)
+	return nil
+}
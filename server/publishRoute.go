@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/exchange"
+	"github.com/valinurovam/garagemq/metrics"
+	"github.com/valinurovam/garagemq/queue"
+)
+
+// publishRoute is result of routing published message, it is shared by channel and local client publishes
+type publishRoute struct {
+	exchange *exchange.Exchange
+	// queues message should be pushed into, empty if message is unroutable, rejected or dropped by all of them
+	queues []*queue.Queue
+	// unroutable is set if message is not matched by any existing queue
+	unroutable bool
+	// overflowed is set if any queue message is routed into is full, message is still pushed into the rest of them
+	overflowed bool
+	// rejected is set if all queues message is routed into are full
+	rejected bool
+	// enqueueStart is start of enqueue stage of traced message
+	enqueueStart int64
+}
+
+// routePublish checks message published into exchange and matches it with queues
+// Error with not empty reason is publish rejected by broker, publisher in confirm mode gets basic.nack for it
+func (vhost *VirtualHost) routePublish(message *amqp.Message) (route *publishRoute, reason string, err *amqp.Error) {
+	ex := vhost.GetExchange(message.Exchange)
+	if ex == nil {
+		return nil, "", amqp.NewChannelError(
+			amqp.NotFound,
+			fmt.Sprintf("exchange '%s' not found", message.Exchange),
+			amqp.ClassBasic,
+			amqp.MethodBasicPublish,
+		)
+	}
+	if ex.IsDisabled() {
+		return nil, publishRejectExchangeDisabled, amqp.NewChannelError(
+			amqp.PreconditionFailed,
+			fmt.Sprintf("exchange '%s' is disabled", message.Exchange),
+			amqp.ClassBasic,
+			amqp.MethodBasicPublish,
+		)
+	}
+	checker := &schemaChecker{message: message}
+	if errSchema := checkExchangeSchema(ex, checker); errSchema != nil {
+		return nil, publishRejectSchemaInvalid, amqp.NewChannelError(
+			amqp.PreconditionFailed,
+			errSchema.Error(),
+			amqp.ClassBasic,
+			amqp.MethodBasicPublish,
+		)
+	}
+	ex.StampProperties(message)
+	// content-type is checked after stamping, so it may be set by x-default-properties of exchange
+	if errType := ex.CheckContentType(message); errType != nil {
+		return nil, publishRejectContentType, amqp.NewChannelError(
+			amqp.PreconditionFailed,
+			errType.Error(),
+			amqp.ClassBasic,
+			amqp.MethodBasicPublish,
+		)
+	}
+	ex.GetMetrics().MsgIn.Counter.Inc(1)
+	message.TraceStart = metrics.SampleTrace()
+	matchedQueues := ex.GetMatchedQueues(message)
+	if err = matchAdditionalExchanges(vhost, message, matchedQueues); err != nil {
+		return nil, "", err
+	}
+	route = &publishRoute{
+		exchange:     ex,
+		enqueueStart: traceMessage(metrics.TraceRouting, message.TraceStart, message),
+	}
+	message.StripBCC()
+
+	// queues could be deleted after routing, message is unroutable if none of them left
+	queues := make([]*queue.Queue, 0, len(matchedQueues))
+	for queueName := range matchedQueues {
+		if qu := vhost.GetQueue(queueName); qu != nil {
+			queues = append(queues, qu)
+		}
+	}
+	if len(queues) == 0 {
+		ex.GetMetrics().MsgUnroutable.Counter.Inc(1)
+		route.unroutable = true
+		return route, "", nil
+	}
+
+	if vhost.srv.isRejectedOnDiskFull(message, queues) {
+		return nil, publishRejectDiskFull, amqp.NewChannelError(
+			amqp.ResourceError,
+			diskAlarmReason,
+			amqp.ClassBasic,
+			amqp.MethodBasicPublish,
+		)
+	}
+	queues, errSchema := vhost.checkQueueSchemas(queues, checker)
+	if errSchema != nil {
+		return nil, publishRejectSchemaInvalid, amqp.NewChannelError(
+			amqp.PreconditionFailed,
+			errSchema.Error(),
+			amqp.ClassBasic,
+			amqp.MethodBasicPublish,
+		)
+	}
+	queues, route.overflowed = rejectOverflowed(queues)
+	if route.overflowed {
+		vhost.srv.countRejectedPublish(publishRejectQueueOverflow)
+		if len(queues) == 0 {
+			route.rejected = true
+			return route, "", nil
+		}
+	}
+	route.queues = vhost.dropIfNoConsumers(queues, message)
+
+	vhost.srv.GetMetrics().Publish.Counter.Inc(1)
+	ex.GetMetrics().MsgRouted.Counter.Inc(1)
+	return route, "", nil
+}
+
+// enqueuePublish pushes routed message into its queues
+// Returned number of queues is ones confirmed message at once, see pushToQueues
+func (srv *Server) enqueuePublish(message *amqp.Message, route *publishRoute) (int32, error) {
+	confirms, err := srv.pushToQueues(message, route.queues)
+	if err != nil {
+		return 0, err
+	}
+	traceMessage(metrics.TraceEnqueue, route.enqueueStart, message)
+	route.exchange.GetMetrics().MsgOut.Counter.Inc(int64(len(route.queues)))
+
+	return confirms, nil
+}
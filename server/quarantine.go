@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// QuarantinedQueue is durable queue which recovery failed on startup in safe mode
+// Queue is not served, its record, bindings and messages are left in storage until it is dropped
+type QuarantinedQueue struct {
+	Name  string
+	Error string
+	Since time.Time
+}
+
+// quarantineQueue is called on failed recovery of queue
+// Startup is aborted unless server runs in safe mode, otherwise the rest of vhost is brought up without the queue
+func (vhost *VirtualHost) quarantineQueue(name string, err error) {
+	if !vhost.srvConfig.Db.SafeMode {
+		vhost.logger.WithError(err).WithField("queueName", name).Error("Queue recovery failed, start server in safe mode to quarantine it")
+		panic(fmt.Errorf("recovery of queue '%s' failed: %s", name, err))
+	}
+
+	vhost.logger.WithError(err).WithField("queueName", name).Error("Queue recovery failed, queue is quarantined")
+
+	vhost.quarantineLock.Lock()
+	defer vhost.quarantineLock.Unlock()
+	if vhost.quarantined == nil {
+		vhost.quarantined = make(map[string]*QuarantinedQueue)
+	}
+	vhost.quarantined[name] = &QuarantinedQueue{
+		Name:  name,
+		Error: err.Error(),
+		Since: time.Now(),
+	}
+}
+
+// GetQuarantinedQueues returns queues quarantined on startup ordered by name
+func (vhost *VirtualHost) GetQuarantinedQueues() []QuarantinedQueue {
+	vhost.quarantineLock.RLock()
+	defer vhost.quarantineLock.RUnlock()
+	queues := make([]QuarantinedQueue, 0, len(vhost.quarantined))
+	for _, qu := range vhost.quarantined {
+		queues = append(queues, *qu)
+	}
+	sort.Slice(queues, func(i, j int) bool {
+		return queues[i].Name < queues[j].Name
+	})
+	return queues
+}
+
+// checkQuarantined refuses declare of queue with name of quarantined one, it should be dropped first
+func (vhost *VirtualHost) checkQuarantined(name string) error {
+	vhost.quarantineLock.RLock()
+	defer vhost.quarantineLock.RUnlock()
+	if _, ok := vhost.quarantined[name]; ok {
+		return fmt.Errorf("queue '%s' is quarantined, it should be dropped before declare", name)
+	}
+	return nil
+}
+
+// DropQuarantinedQueue removes record, bindings and messages of quarantined queue from storage
+// Storage of queue is unknown if its record can't be read, so messages are removed from all storages of vhost
+func (vhost *VirtualHost) DropQuarantinedQueue(name string) error {
+	vhost.quarantineLock.Lock()
+	defer vhost.quarantineLock.Unlock()
+	if _, ok := vhost.quarantined[name]; !ok {
+		return fmt.Errorf("queue '%s' is not quarantined", name)
+	}
+
+	for storageName := range vhost.srvConfig.Db.Storages {
+		if _, err := vhost.getNamedStorages(storageName); err != nil {
+			return err
+		}
+	}
+	vhost.storagesLock.Lock()
+	for _, storages := range vhost.storages {
+		storages.persistent.PurgeQueue(name)
+	}
+	vhost.storagesLock.Unlock()
+
+	for _, bind := range vhost.srvStorage.GetVhostBindings(vhost.name) {
+		if bind.Queue == name {
+			vhost.srvStorage.DelBinding(vhost.name, bind)
+		}
+	}
+	if err := vhost.srvStorage.DelQueueByName(vhost.name, name); err != nil {
+		return err
+	}
+	delete(vhost.quarantined, name)
+
+	vhost.logger.WithField("queueName", name).Info("Quarantined queue dropped")
+	return nil
+}
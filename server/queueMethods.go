@@ -1,8 +1,12 @@
 package server
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"fmt"
+	"strings"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/valinurovam/garagemq/amqp"
 	"github.com/valinurovam/garagemq/binding"
 	"github.com/valinurovam/garagemq/exchange"
@@ -30,23 +34,33 @@ func (channel *Channel) queueDeclare(method *amqp.QueueDeclare) *amqp.Error {
 	var existingQueue *queue.Queue
 	var notFoundErr, exclusiveErr *amqp.Error
 
-	if method.Queue == "" {
-		return amqp.NewChannelError(
-			amqp.CommandInvalid,
-			"queue name is required",
-			method.ClassIdentifier(),
-			method.MethodIdentifier(),
-		)
+	// @spec-note
+	// If the queue name is empty, the server MUST create a new queue with a unique generated name
+	// Passive declare with empty name checks the last queue declared on the channel
+	serverNamed := method.Queue == "" && !method.Passive
+	if serverNamed {
+		name, err := generateQueueName(channel.conn.GetVirtualHost())
+		if err != nil {
+			return amqp.NewChannelError(amqp.InternalError, "error on generating queue name", method.ClassIdentifier(), method.MethodIdentifier())
+		}
+		method.Queue = name
+	}
+	if err := channel.resolveQueueName(&method.Queue, method); err != nil {
+		return err
+	}
+
+	// reply-to pseudo-queue always exists, but only for passive declare
+	if method.Queue == replyToQueue && method.Passive {
+		if !method.NoWait {
+			channel.SendMethod(&amqp.QueueDeclareOk{Queue: method.Queue})
+		}
+		return nil
 	}
 
 	existingQueue, notFoundErr = channel.getQueueWithError(method.Queue, method)
 	exclusiveErr = channel.checkQueueLockWithError(existingQueue, method)
 
 	if method.Passive {
-		if method.NoWait {
-			return nil
-		}
-
 		if existingQueue == nil {
 			return notFoundErr
 		}
@@ -55,24 +69,103 @@ func (channel *Channel) queueDeclare(method *amqp.QueueDeclare) *amqp.Error {
 			return exclusiveErr
 		}
 
-		channel.SendMethod(&amqp.QueueDeclareOk{
-			Queue:         method.Queue,
-			MessageCount:  uint32(existingQueue.Length()),
-			ConsumerCount: uint32(existingQueue.ConsumersCount()),
-		})
+		channel.lastQueue = method.Queue
+		if !method.NoWait {
+			channel.SendMethod(&amqp.QueueDeclareOk{
+				Queue:         method.Queue,
+				MessageCount:  uint32(existingQueue.Length()),
+				ConsumerCount: uint32(existingQueue.ConsumersCount()),
+			})
+		}
 
 		return nil
 	}
 
+	// @spec-note
+	// Queue names starting with "amq." are reserved for pre-declared and standardised queues.
+	// The client MAY declare a queue starting with "amq." if the passive option is set, or the queue already exists.
+	if existingQueue == nil && !serverNamed && strings.HasPrefix(method.Queue, reservedPrefix) {
+		return amqp.NewChannelError(
+			amqp.AccessRefused,
+			fmt.Sprintf("queue name '%s' contains reserved prefix 'amq.*'", method.Queue),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		)
+	}
+	if err := channel.server.checkQueueName(method.Queue); err != nil {
+		return amqp.NewChannelError(amqp.PreconditionFailed, err.Error(), method.ClassIdentifier(), method.MethodIdentifier())
+	}
+	if err := channel.conn.GetVirtualHost().checkQuarantined(method.Queue); err != nil {
+		return amqp.NewChannelError(amqp.PreconditionFailed, err.Error(), method.ClassIdentifier(), method.MethodIdentifier())
+	}
+
+	channel.server.applyQueueDefaults(method)
 	newQueue := channel.conn.GetVirtualHost().NewQueue(
 		method.Queue,
 		channel.conn.id,
 		method.Exclusive,
 		method.AutoDelete,
 		method.Durable,
-		channel.server.config.Queue.ShardSize,
+		channel.server.getConfig().Queue.ShardSize,
 	)
 
+	messageTTL, err := getQueueMessageTTL(method)
+	if err != nil {
+		return err
+	}
+	newQueue.SetMessageTTL(messageTTL)
+
+	deadLetter, err := getQueueDeadLetter(method)
+	if err != nil {
+		return err
+	}
+	newQueue.SetDeadLetter(deadLetter)
+
+	singleActive, err := getQueueSingleActiveConsumer(method)
+	if err != nil {
+		return err
+	}
+	newQueue.SetSingleActiveConsumer(singleActive)
+
+	dropIfNoConsumers, err := getQueueDropIfNoConsumers(method)
+	if err != nil {
+		return err
+	}
+	newQueue.SetDropIfNoConsumers(dropIfNoConsumers)
+
+	retryDelays, err := getQueueRetryDelays(method)
+	if err != nil {
+		return err
+	}
+	newQueue.SetRetryDelays(retryDelays)
+
+	maxLength, err := getQueueMaxLength(method)
+	if err != nil {
+		return err
+	}
+	newQueue.SetMaxLength(maxLength)
+
+	consumerTimeout, err := getQueueConsumerTimeout(method)
+	if err != nil {
+		return err
+	}
+	newQueue.SetConsumerTimeout(consumerTimeout)
+	newQueue.SetMeta(getMetaArguments(method.Arguments))
+
+	validator, err := getSchemaArgument(method.Arguments, method)
+	if err != nil {
+		return err
+	}
+	newQueue.SetSchema(validator)
+
+	storageName, err := getQueueStorageName(method)
+	if err != nil {
+		return err
+	}
+	if err := channel.conn.GetVirtualHost().SetQueueStorage(newQueue, storageName); err != nil {
+		return amqp.NewChannelError(amqp.PreconditionFailed, err.Error(), method.ClassIdentifier(), method.MethodIdentifier())
+	}
+
 	if existingQueue != nil {
 		if exclusiveErr != nil {
 			return exclusiveErr
@@ -87,22 +180,57 @@ func (channel *Channel) queueDeclare(method *amqp.QueueDeclare) *amqp.Error {
 			)
 		}
 
-		channel.SendMethod(&amqp.QueueDeclareOk{
-			Queue:         method.Queue,
-			MessageCount:  uint32(existingQueue.Length()),
-			ConsumerCount: uint32(existingQueue.ConsumersCount()),
-		})
+		channel.lastQueue = method.Queue
+		if !method.NoWait {
+			channel.SendMethod(&amqp.QueueDeclareOk{
+				Queue:         method.Queue,
+				MessageCount:  uint32(existingQueue.Length()),
+				ConsumerCount: uint32(existingQueue.ConsumersCount()),
+			})
+		}
 		return nil
 	}
 
 	newQueue.Start()
 	channel.conn.GetVirtualHost().AppendQueue(newQueue)
-	channel.SendMethod(&amqp.QueueDeclareOk{
-		Queue:         method.Queue,
-		MessageCount:  0,
-		ConsumerCount: 0,
-	})
+	channel.lastQueue = method.Queue
+	if !method.NoWait {
+		channel.SendMethod(&amqp.QueueDeclareOk{
+			Queue:         method.Queue,
+			MessageCount:  0,
+			ConsumerCount: 0,
+		})
+	}
+
+	return nil
+}
+
+// serverNamedQueuePrefix is the prefix of queue names generated by server
+const serverNamedQueuePrefix = reservedPrefix + "gen-"
+
+// generateQueueName returns random name of server-named queue which is not used by any queue of vhost
+func generateQueueName(vhost *VirtualHost) (string, error) {
+	token := make([]byte, 16)
+	for {
+		if _, err := rand.Read(token); err != nil {
+			return "", err
+		}
+		name := serverNamedQueuePrefix + base64.RawURLEncoding.EncodeToString(token)
+		if vhost.GetQueue(name) == nil {
+			return name, nil
+		}
+	}
+}
 
+// resolveQueueName replaces empty queue name of method with the last queue declared on the channel
+func (channel *Channel) resolveQueueName(name *string, method amqp.Method) *amqp.Error {
+	if *name != "" {
+		return nil
+	}
+	if channel.lastQueue == "" {
+		return amqp.NewChannelError(amqp.NotFound, "no previously declared queue", method.ClassIdentifier(), method.MethodIdentifier())
+	}
+	*name = channel.lastQueue
 	return nil
 }
 
@@ -126,6 +254,9 @@ func (channel *Channel) queueBind(method *amqp.QueueBind) *amqp.Error {
 		)
 	}
 
+	if err = channel.resolveQueueName(&method.Queue, method); err != nil {
+		return err
+	}
 	if qu, err = channel.getQueueWithError(method.Queue, method); err != nil {
 		return err
 	}
@@ -159,6 +290,9 @@ func (channel *Channel) queueUnbind(method *amqp.QueueUnbind) *amqp.Error {
 		return err
 	}
 
+	if err = channel.resolveQueueName(&method.Queue, method); err != nil {
+		return err
+	}
 	if qu, err = channel.getQueueWithError(method.Queue, method); err != nil {
 		return err
 	}
@@ -168,8 +302,9 @@ func (channel *Channel) queueUnbind(method *amqp.QueueUnbind) *amqp.Error {
 	}
 
 	bind := binding.NewBinding(method.Queue, method.Exchange, method.RoutingKey, method.Arguments, ex.ExType() == exchange.ExTypeTopic)
-	ex.RemoveBinding(bind)
-	channel.conn.GetVirtualHost().RemoveBindings([]*binding.Binding{bind})
+	if removed := ex.RemoveBinding(bind); removed != nil {
+		channel.conn.GetVirtualHost().RemoveBindings([]*binding.Binding{removed})
+	}
 	channel.SendMethod(&amqp.QueueUnbindOk{})
 
 	return nil
@@ -179,6 +314,9 @@ func (channel *Channel) queuePurge(method *amqp.QueuePurge) *amqp.Error {
 	var qu *queue.Queue
 	var err *amqp.Error
 
+	if err = channel.resolveQueueName(&method.Queue, method); err != nil {
+		return err
+	}
 	if qu, err = channel.getQueueWithError(method.Queue, method); err != nil {
 		return err
 	}
@@ -198,6 +336,9 @@ func (channel *Channel) queueDelete(method *amqp.QueueDelete) *amqp.Error {
 	var qu *queue.Queue
 	var err *amqp.Error
 
+	if err = channel.resolveQueueName(&method.Queue, method); err != nil {
+		return err
+	}
 	if qu, err = channel.getQueueWithError(method.Queue, method); err != nil {
 		return err
 	}
@@ -208,9 +349,218 @@ func (channel *Channel) queueDelete(method *amqp.QueueDelete) *amqp.Error {
 
 	var length, errDel = channel.conn.GetVirtualHost().DeleteQueue(method.Queue, method.IfUnused, method.IfEmpty)
 	if errDel != nil {
-		return amqp.NewChannelError(amqp.PreconditionFailed, errDel.Error(), method.ClassIdentifier(), method.MethodIdentifier())
+		return amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("queue '%s' in vhost '%s' %s", method.Queue, channel.conn.GetVirtualHost().name, errDel), method.ClassIdentifier(), method.MethodIdentifier())
 	}
 
-	channel.SendMethod(&amqp.QueueDeleteOk{MessageCount: uint32(length)})
+	if !method.NoWait {
+		channel.SendMethod(&amqp.QueueDeleteOk{MessageCount: uint32(length)})
+	}
 	return nil
 }
+
+// getQueueSingleActiveConsumer returns parsed x-single-active-consumer queue argument
+func getQueueSingleActiveConsumer(method *amqp.QueueDeclare) (bool, *amqp.Error) {
+	if method.Arguments == nil {
+		return false, nil
+	}
+
+	value, ok := (*method.Arguments)["x-single-active-consumer"]
+	if !ok {
+		return false, nil
+	}
+	singleActive, ok := value.(bool)
+	if !ok {
+		return false, amqp.NewChannelError(amqp.PreconditionFailed, "x-single-active-consumer argument should be a boolean", method.ClassIdentifier(), method.MethodIdentifier())
+	}
+
+	return singleActive, nil
+}
+
+// getQueueDropIfNoConsumers returns parsed x-drop-if-no-consumers queue argument
+func getQueueDropIfNoConsumers(method *amqp.QueueDeclare) (bool, *amqp.Error) {
+	if method.Arguments == nil {
+		return false, nil
+	}
+
+	value, ok := (*method.Arguments)["x-drop-if-no-consumers"]
+	if !ok {
+		return false, nil
+	}
+	drop, ok := value.(bool)
+	if !ok {
+		return false, amqp.NewChannelError(amqp.PreconditionFailed, "x-drop-if-no-consumers argument should be a boolean", method.ClassIdentifier(), method.MethodIdentifier())
+	}
+
+	return drop, nil
+}
+
+// getQueueRetryDelays returns parsed x-retry-delays queue argument, nil if argument is not set or empty
+func getQueueRetryDelays(method *amqp.QueueDeclare) ([]int64, *amqp.Error) {
+	if method.Arguments == nil {
+		return nil, nil
+	}
+
+	value, ok := (*method.Arguments)["x-retry-delays"]
+	if !ok {
+		return nil, nil
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, amqp.NewChannelError(amqp.PreconditionFailed, "x-retry-delays argument should be an array of integers", method.ClassIdentifier(), method.MethodIdentifier())
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+
+	delays := make([]int64, 0, len(items))
+	for _, item := range items {
+		// each delay is validated as single integer argument
+		delay, _, err := getDurationArgument(amqp.Table{"x-retry-delays": item}, "x-retry-delays", method)
+		if err != nil {
+			return nil, err
+		}
+		delays = append(delays, delay)
+	}
+
+	return delays, nil
+}
+
+// getQueueMessageTTL returns parsed x-message-ttl queue argument or queue.NoTTL if argument is not set
+func getQueueMessageTTL(method *amqp.QueueDeclare) (int64, *amqp.Error) {
+	if method.Arguments == nil {
+		return queue.NoTTL, nil
+	}
+
+	ttl, ok, err := getDurationArgument(*method.Arguments, "x-message-ttl", method)
+	if err != nil || !ok {
+		return queue.NoTTL, err
+	}
+
+	return ttl, nil
+}
+
+// getQueueConsumerTimeout returns parsed x-consumer-timeout queue argument or queue.NoConsumerTimeout if argument is not set
+func getQueueConsumerTimeout(method *amqp.QueueDeclare) (int64, *amqp.Error) {
+	if method.Arguments == nil {
+		return queue.NoConsumerTimeout, nil
+	}
+
+	timeout, ok, err := getDurationArgument(*method.Arguments, "x-consumer-timeout", method)
+	if err != nil || !ok {
+		return queue.NoConsumerTimeout, err
+	}
+
+	return timeout, nil
+}
+
+// getQueueStorageName returns x-queue-storage argument, empty name means default storage
+func getQueueStorageName(method *amqp.QueueDeclare) (string, *amqp.Error) {
+	if method.Arguments == nil {
+		return "", nil
+	}
+
+	name, _, err := getStringArgument(*method.Arguments, "x-queue-storage", method)
+	return name, err
+}
+
+// metaArgumentPrefix is prefix of declaration arguments kept as queue and exchange metadata
+const metaArgumentPrefix = "x-meta-"
+
+// getMetaArguments returns x-meta-* arguments of declaration or nil if there are no ones
+// Broker does not interpret metadata, it is stored with queue or exchange and reported by admin API
+// applyQueueDefaults applies queue.defaults of config to declared queue
+// Default arguments are overridden by ones given by client, default durable flag is not applied
+// to exclusive and auto-delete queues, they are removed with connection or consumers anyway
+func (srv *Server) applyQueueDefaults(method *amqp.QueueDeclare) {
+	if srv.getConfig().Queue.Defaults.Durable && !method.Exclusive && !method.AutoDelete {
+		method.Durable = true
+	}
+	if len(srv.queueDefaultArguments) == 0 {
+		return
+	}
+
+	arguments := make(amqp.Table, len(srv.queueDefaultArguments))
+	for name, value := range srv.queueDefaultArguments {
+		arguments[name] = value
+	}
+	if method.Arguments != nil {
+		for name, value := range *method.Arguments {
+			arguments[name] = value
+		}
+	}
+	method.Arguments = &arguments
+}
+
+// queueDefaultArguments converts default queue arguments read from config into AMQP table values,
+// arguments of unsupported types are skipped
+func queueDefaultArguments(arguments map[string]interface{}) amqp.Table {
+	table := make(amqp.Table, len(arguments))
+	for name, value := range arguments {
+		switch value := value.(type) {
+		case int:
+			table[name] = int64(value)
+		case bool, string, float64:
+			table[name] = value
+		default:
+			log.WithField("argument", name).Warn("Unsupported type of default queue argument, it is skipped")
+		}
+	}
+	return table
+}
+
+func getMetaArguments(args *amqp.Table) *amqp.Table {
+	if args == nil {
+		return nil
+	}
+
+	var meta amqp.Table
+	for key, value := range *args {
+		if !strings.HasPrefix(key, metaArgumentPrefix) {
+			continue
+		}
+		if meta == nil {
+			meta = amqp.Table{}
+		}
+		meta[key] = value
+	}
+	if meta == nil {
+		return nil
+	}
+	return &meta
+}
+
+// getDurationArgument returns non-negative integer argument in milliseconds
+func getDurationArgument(args amqp.Table, name string, method amqp.Method) (int64, bool, *amqp.Error) {
+	value, ok := args[name]
+	if !ok {
+		return 0, false, nil
+	}
+
+	var duration int64
+	switch value := value.(type) {
+	case int8:
+		duration = int64(value)
+	case uint8:
+		duration = int64(value)
+	case int16:
+		duration = int64(value)
+	case uint16:
+		duration = int64(value)
+	case int32:
+		duration = int64(value)
+	case uint32:
+		duration = int64(value)
+	case int64:
+		duration = value
+	case uint64:
+		duration = int64(value)
+	default:
+		return 0, false, amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("%s argument should be an integer", name), method.ClassIdentifier(), method.MethodIdentifier())
+	}
+
+	if duration < 0 {
+		return 0, false, amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("invalid %s %d, should not be negative", name, duration), method.ClassIdentifier(), method.MethodIdentifier())
+	}
+
+	return duration, true, nil
+}
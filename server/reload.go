@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valinurovam/garagemq/config"
+)
+
+// SetConfigFile sets path of config file that is read again on SIGHUP
+func (srv *Server) SetConfigFile(path string) {
+	srv.configPath = path
+}
+
+// reloadConfigFile reads config file again and applies its hot-reloadable settings, current config is kept on error
+func (srv *Server) reloadConfigFile() {
+	if srv.configPath == "" {
+		log.Warn("Server is started without config file, nothing to reload")
+		return
+	}
+
+	cfg, err := config.CreateFromFile(srv.configPath)
+	if err == nil {
+		err = srv.ReloadConfig(cfg)
+	}
+	if err != nil {
+		log.WithError(err).WithField("path", srv.configPath).Error("Error on config reload, current config is kept")
+	}
+}
+
+// ReloadConfig applies hot-reloadable settings of given config without dropping connections:
+// log level, users, security checks, accept rate and burst, consumer timeout and limits of new connections
+// Other settings require restart, their changes are logged and ignored
+func (srv *Server) ReloadConfig(cfg *config.Config) error {
+	var level log.Level
+	var err error
+	if cfg.LogLevel != "" {
+		if level, err = log.ParseLevel(cfg.LogLevel); err != nil {
+			return err
+		}
+	}
+	if cfg.Security.PasswordCheck != "md5" && cfg.Security.PasswordCheck != "bcrypt" {
+		return fmt.Errorf("unsupported security passwordCheck '%s'", cfg.Security.PasswordCheck)
+	}
+	patterns, err := newNamePatterns(cfg.Security)
+	if err != nil {
+		return err
+	}
+
+	srv.reloadLock.Lock()
+	defer srv.reloadLock.Unlock()
+
+	current := srv.getConfig()
+	for _, setting := range restartRequired(current, cfg) {
+		log.WithField("setting", setting).Warn("Setting is changed, but it requires restart")
+	}
+
+	// current config could be read concurrently, so hot-reloadable settings are applied to its copy which replaces it
+	next := *current
+	next.LogLevel = cfg.LogLevel
+	next.Users = cfg.Users
+	next.Security = cfg.Security
+	next.TCP.AcceptRate = cfg.TCP.AcceptRate
+	next.TCP.AcceptBurst = cfg.TCP.AcceptBurst
+	next.Queue.ConsumerTimeout = cfg.Queue.ConsumerTimeout
+	next.Connection.ChannelsMax = cfg.Connection.ChannelsMax
+	next.Connection.FrameMaxSize = normalizeFrameMax(cfg.Connection.FrameMaxSize)
+	next.Connection.WriteTimeout = cfg.Connection.WriteTimeout
+	next.Connection.ChannelMaxUnacked = cfg.Connection.ChannelMaxUnacked
+
+	if cfg.LogLevel != "" {
+		log.SetLevel(level)
+	}
+
+	users := make(map[string]string, len(cfg.Users))
+	for _, user := range cfg.Users {
+		users[user.Username] = user.Password
+	}
+	srv.usersLock.Lock()
+	srv.users = users
+	srv.setConfig(&next)
+	srv.usersLock.Unlock()
+	srv.setNamePatterns(patterns)
+	srv.setAcceptLimiter(newAcceptLimiter(cfg.TCP.AcceptRate, cfg.TCP.AcceptBurst))
+
+	log.Info("Config reloaded")
+	return nil
+}
+
+// restartRequired returns names of changed settings that are not hot-reloadable
+func restartRequired(current *config.Config, next *config.Config) []string {
+	var changed []string
+	check := func(setting string, a interface{}, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			changed = append(changed, setting)
+		}
+	}
+
+	currentTCP, nextTCP := current.TCP, next.TCP
+	currentTCP.AcceptRate, currentTCP.AcceptBurst = 0, 0
+	nextTCP.AcceptRate, nextTCP.AcceptBurst = 0, 0
+	currentQueue, nextQueue := current.Queue, next.Queue
+	currentQueue.ConsumerTimeout, nextQueue.ConsumerTimeout = 0, 0
+
+	check("proto", current.Proto, next.Proto)
+	check("tcp", currentTCP, nextTCP)
+	check("listeners", current.Listeners, next.Listeners)
+	check("queue", currentQueue, nextQueue)
+	check("db", current.Db, next.Db)
+	check("vhost", current.Vhost, next.Vhost)
+	check("admin", current.Admin, next.Admin)
+	check("metrics", current.Metrics, next.Metrics)
+
+	return changed
+}
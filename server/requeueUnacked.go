@@ -0,0 +1,49 @@
+package server
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RequeueUnacked returns messages of queue delivered on any channel of vhost and not acknowledged yet into the queue head
+// Messages are redelivered with incremented delivery count, consumers are kept and may get them again
+// Later ack or reject of requeued delivery by client is ignored, so it is safe to call while consumers are connected
+// Returns number of requeued messages
+func (vhost *VirtualHost) RequeueUnacked(queueName string) (int, error) {
+	if vhost.GetQueue(queueName) == nil {
+		return 0, fmt.Errorf("queue '%s' not found", queueName)
+	}
+
+	vhost.srv.connLock.Lock()
+	connections := make([]*Connection, 0, len(vhost.srv.connections))
+	for _, conn := range vhost.srv.connections {
+		if conn.GetVirtualHost() == vhost {
+			connections = append(connections, conn)
+		}
+	}
+	vhost.srv.connLock.Unlock()
+
+	var requeued int
+	for _, conn := range connections {
+		conn.channelsLock.RLock()
+		channels := make([]*Channel, 0, len(conn.channels))
+		for _, channel := range conn.channels {
+			channels = append(channels, channel)
+		}
+		conn.channelsLock.RUnlock()
+
+		for _, channel := range channels {
+			requeued += channel.requeueUnackedMatched(true, func(uMsg *UnackedMessage) bool {
+				return uMsg.queue == queueName
+			})
+		}
+	}
+
+	vhost.logger.WithFields(log.Fields{
+		"queueName": queueName,
+		"requeued":  requeued,
+	}).Info("Unacked messages requeued")
+
+	return requeued, nil
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"crypto/md5"
+	"crypto/tls"
 	"encoding/hex"
 	"fmt"
 	"net"
@@ -9,6 +10,7 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/valinurovam/garagemq/amqp"
@@ -18,12 +20,20 @@ import (
 	"github.com/valinurovam/garagemq/metrics"
 	"github.com/valinurovam/garagemq/msgstorage"
 	"github.com/valinurovam/garagemq/pool"
+	"github.com/valinurovam/garagemq/proxyproto"
+	"github.com/valinurovam/garagemq/spool"
 	"github.com/valinurovam/garagemq/srvstorage"
 	"github.com/valinurovam/garagemq/storage"
 )
 
 var emptyBufferPool = pool.NewBufferPool(0)
 
+// msgIDBlockSize is how many message ids are reserved by one write of ids bound into server storage
+const msgIDBlockSize = 1 << 20
+
+// proxyHeaderTimeout is how long PROXY protocol header is waited on new connection
+var proxyHeaderTimeout = 5 * time.Second
+
 // server state statuses
 const (
 	Started = iota
@@ -43,28 +53,63 @@ type SrvMetricsState struct {
 
 	TrafficIn  *metrics.TrackCounter
 	TrafficOut *metrics.TrackCounter
+
+	HeartbeatsIn  *metrics.TrackCounter
+	HeartbeatsOut *metrics.TrackCounter
+
+	Connections *metrics.TrackCounter
+	Channels    *metrics.TrackCounter
+
+	StorageUsed *metrics.TrackCounter
+	// 1 while disk alarm is raised
+	DiskAlarm *metrics.TrackCounter
+
+	// publishes rejected by broker in total and by reason
+	PublishRejected   *metrics.TrackCounter
+	PublishRejectedBy map[string]*metrics.TrackCounter
 }
 
 // Server implements AMQP server
 type Server struct {
-	host         string
-	port         string
-	protoVersion string
-	listener     *net.TCPListener
-	connSeq      uint64
-	connLock     sync.Mutex
-	connections  map[uint64]*Connection
-	config       *config.Config
-	users        map[string]string
-	vhostsLock   sync.Mutex
-	vhosts       map[string]*VirtualHost
-	status       int
-	storage      *srvstorage.SrvStorage
-	metrics      *SrvMetricsState
+	host            string
+	port            string
+	protoVersion    string
+	listenerLock    sync.Mutex
+	listeners       []net.Listener
+	connSeq         uint64
+	connLock        sync.Mutex
+	connections     map[uint64]*Connection
+	configLock      sync.RWMutex
+	config          *config.Config
+	configPath      string
+	reloadLock      sync.Mutex
+	usersLock       sync.RWMutex
+	users           map[string]string
+	vhostsLock      sync.Mutex
+	vhosts          map[string]*VirtualHost
+	status          int
+	storage         *srvstorage.SrvStorage
+	spool           *spool.Spool
+	metrics         *SrvMetricsState
+	acceptLimitLock sync.RWMutex
+	acceptLimit     *acceptLimiter
+	diskAlarm       *diskAlarm
+	// queue.defaults.arguments of config converted into AMQP values
+	queueDefaultArguments amqp.Table
+	// 1 if server is in maintenance mode, see SetMaintenance
+	maintenance int32
+	// the last errors of closed connections, see GetClosedConnectionErrors
+	closedErrors closedErrors
+	// patterns of declared exchange and queue names from security config
+	namePatternsLock sync.RWMutex
+	namePatterns     *namePatterns
+	// audit log of publishes and consumer registrations, nil if disabled
+	accessLog *accessLog
 }
 
 // NewServer returns new instance of AMQP Server
-func NewServer(host string, port string, protoVersion string, config *config.Config) (server *Server) {
+// Returns error if spool directory could not be created
+func NewServer(host string, port string, protoVersion string, config *config.Config) (server *Server, err error) {
 	server = &Server{
 		host:         host,
 		port:         port,
@@ -74,9 +119,38 @@ func NewServer(host string, port string, protoVersion string, config *config.Con
 		users:        make(map[string]string),
 		vhosts:       make(map[string]*VirtualHost),
 		connSeq:      0,
+		acceptLimit:  newAcceptLimiter(config.TCP.AcceptRate, config.TCP.AcceptBurst),
+		diskAlarm:    newDiskAlarm(),
 	}
 	server.initMetrics()
 
+	if frameMax := normalizeFrameMax(config.Connection.FrameMaxSize); frameMax != config.Connection.FrameMaxSize {
+		log.WithFields(log.Fields{
+			"configured": config.Connection.FrameMaxSize,
+			"used":       frameMax,
+		}).Warn("Connection frameMaxSize is less than AMQP minimum frame size")
+		config.Connection.FrameMaxSize = frameMax
+	}
+
+	if mode := config.Db.DiskFullMode; mode != diskFullModeBlock && mode != diskFullModeTransient && mode != diskFullModeReject {
+		log.WithField("mode", mode).Warn("Unknown db diskFullMode, block is used")
+		config.Db.DiskFullMode = diskFullModeBlock
+	}
+
+	server.queueDefaultArguments = queueDefaultArguments(config.Queue.Defaults.Arguments)
+
+	patterns, err := newNamePatterns(config.Security)
+	if err != nil {
+		// invalid pattern could not be replaced by any other, as it would open namespace it should protect
+		return nil, err
+	}
+	server.namePatterns = patterns
+
+	spoolPath := fmt.Sprintf("%s/spool", config.Db.DefaultPath)
+	if server.spool, err = spool.NewSpool(spoolPath, config.Db.SpoolThreshold); err != nil {
+		return nil, fmt.Errorf("could not create spool directory: %s", err)
+	}
+
 	return
 }
 
@@ -94,6 +168,18 @@ func (srv *Server) initMetrics() {
 
 		TrafficIn:  metrics.AddCounter("server.traffic_in"),
 		TrafficOut: metrics.AddCounter("server.traffic_out"),
+
+		HeartbeatsIn:  metrics.AddCounter("server.heartbeats_in"),
+		HeartbeatsOut: metrics.AddCounter("server.heartbeats_out"),
+
+		Connections: metrics.AddCounter("server.connections"),
+		Channels:    metrics.AddCounter("server.channels"),
+
+		StorageUsed: metrics.AddCounter("server.storage_used"),
+		DiskAlarm:   metrics.AddCounter("server.disk_alarm"),
+
+		PublishRejected:   metrics.AddCounter("server.publish_rejected"),
+		PublishRejectedBy: newPublishRejectedMetrics(),
 	}
 }
 
@@ -113,7 +199,11 @@ func (srv *Server) Start() {
 		srv.initVirtualHostsFromStorage()
 	}
 
+	srv.initAccessLog()
 	go srv.listen()
+	if sweepInterval := srv.getConfig().Vhost.SweepInterval; sweepInterval > 0 {
+		go srv.sweepLoop(time.Duration(sweepInterval) * time.Second)
+	}
 
 	srv.storage.UpdateLastStart()
 	srv.status = Started
@@ -127,7 +217,11 @@ func (srv *Server) Stop() {
 	srv.status = Stopping
 
 	// stop accept new connections
-	srv.listener.Close()
+	srv.listenerLock.Lock()
+	for _, listener := range srv.listeners {
+		listener.Close()
+	}
+	srv.listenerLock.Unlock()
 
 	var wg sync.WaitGroup
 	for _, conn := range srv.connections {
@@ -154,65 +248,231 @@ func (srv *Server) getVhost(name string) *VirtualHost {
 	return srv.vhosts[name]
 }
 
+// listen starts all configured listeners and accepts connections on each of them concurrently
 func (srv *Server) listen() {
-	address := srv.host + ":" + srv.port
-	tcpAddr, err := net.ResolveTCPAddr("tcp4", address)
-	srv.listener, err = net.ListenTCP("tcp", tcpAddr)
-	if err != nil {
-		log.WithError(err).WithFields(log.Fields{
+	listeners := srv.getConfig().Listeners
+	if len(listeners) == 0 {
+		listeners = []config.Listener{{IP: srv.host, Port: srv.port}}
+	}
+
+	for _, lsConfig := range listeners {
+		listener, err := srv.startListener(lsConfig)
+		address := lsConfig.IP + ":" + lsConfig.Port
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"address": address,
+				"tls":     lsConfig.TLS,
+			}).Error("Error on listener start")
+			os.Exit(1)
+		}
+
+		log.WithFields(log.Fields{
 			"address": address,
-		}).Error("Error on listener start")
-		os.Exit(1)
+			"tls":     lsConfig.TLS,
+		}).Info("Server started")
+
+		srv.listenerLock.Lock()
+		srv.listeners = append(srv.listeners, listener)
+		srv.listenerLock.Unlock()
+
+		go srv.acceptLoop(listener, lsConfig.TLS)
 	}
+}
 
-	log.WithFields(log.Fields{
-		"address": address,
-	}).Info("Server started")
+func (srv *Server) startListener(lsConfig config.Listener) (net.Listener, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp4", lsConfig.IP+":"+lsConfig.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := listenTCP(tcpAddr, srv.getConfig().TCP.Backlog)
+	if err != nil {
+		return nil, err
+	}
+
+	amqpListener := &amqpListener{TCPListener: listener, proxyProtocol: lsConfig.ProxyProtocol}
+	if lsConfig.TLS {
+		cert, err := tls.LoadX509KeyPair(lsConfig.CertFile, lsConfig.KeyFile)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		amqpListener.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	return amqpListener, nil
+}
+
+// maxAcceptDelay is the longest pause of accepting connections after temporary accept error
+var maxAcceptDelay = time.Second
 
+// acceptLoop accepts connections of listener, pending connections over accept rate are kept in listen backlog
+// On temporary errors, e.g. file descriptors exhaustion, accepting is paused with growing delay instead of spinning
+func (srv *Server) acceptLoop(listener net.Listener, isTLS bool) {
+	var acceptDelay time.Duration
 	for {
-		conn, err := srv.listener.AcceptTCP()
+		srv.getAcceptLimiter().wait()
+		conn, err := listener.Accept()
 		if err != nil {
 			if srv.status == Stopping {
 				return
 			}
-			srv.stopWithError(err, "accepting connection")
+			if !isTemporaryAcceptError(err) {
+				srv.stopWithError(err, "accepting connection")
+			}
+
+			if acceptDelay == 0 {
+				acceptDelay = 5 * time.Millisecond
+			} else if acceptDelay *= 2; acceptDelay > maxAcceptDelay {
+				acceptDelay = maxAcceptDelay
+			}
+			logger := log.WithError(err).WithField("retryIn", acceptDelay.String())
+			if isFdExhaustedError(err) {
+				open, limit := srv.FileDescriptors()
+				logger.WithFields(log.Fields{
+					"openFiles": open,
+					"limit":     limit,
+				}).Warn("Out of file descriptors, accepting connections is paused")
+			} else {
+				logger.Warn("Temporary error on accepting connection")
+			}
+			time.Sleep(acceptDelay)
+			continue
 		}
+		acceptDelay = 0
+
 		log.WithFields(log.Fields{
 			"from": conn.RemoteAddr().String(),
 			"to":   conn.LocalAddr().String(),
+			"tls":  isTLS,
 		}).Info("accepting connection")
 
-		conn.SetReadBuffer(srv.config.TCP.ReadBufSize)
-		conn.SetWriteBuffer(srv.config.TCP.WriteBufSize)
-		conn.SetNoDelay(srv.config.TCP.Nodelay)
+		if tcpConn := tcpConnOf(conn); tcpConn != nil {
+			tcpConfig := srv.getConfig().TCP
+			tcpConn.SetReadBuffer(tcpConfig.ReadBufSize)
+			tcpConn.SetWriteBuffer(tcpConfig.WriteBufSize)
+			tcpConn.SetNoDelay(tcpConfig.Nodelay)
+		}
 
 		srv.acceptConnection(conn)
 	}
 }
 
+// amqpListener wraps accepted TCP connections into PROXY protocol and TLS connections if enabled
+// PROXY protocol header is sent by load balancer before TLS handshake, both are read on first read
+type amqpListener struct {
+	*net.TCPListener
+	tlsConfig     *tls.Config
+	proxyProtocol bool
+}
+
+func (listener *amqpListener) Accept() (net.Conn, error) {
+	tcpConn, err := listener.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+
+	if !listener.proxyProtocol && listener.tlsConfig == nil {
+		return tcpConn, nil
+	}
+	var conn net.Conn = tcpConn
+	if listener.proxyProtocol {
+		conn = proxyproto.NewConn(conn, proxyHeaderTimeout)
+	}
+	if listener.tlsConfig != nil {
+		conn = tls.Server(conn, listener.tlsConfig)
+	}
+	return &wrappedConn{Conn: conn, tcpConn: tcpConn}, nil
+}
+
+// wrappedConn is TLS or PROXY protocol connection keeping its accepted TCP connection to tune socket options
+type wrappedConn struct {
+	net.Conn
+	tcpConn *net.TCPConn
+}
+
 func (srv *Server) stopWithError(err error, msg string) {
 	log.WithError(err).Error(msg)
 	srv.Stop()
 	os.Exit(1)
 }
 
-func (srv *Server) acceptConnection(conn *net.TCPConn) {
+// isFdExhaustedError checks that error is caused by process or system limit of open files
+func isFdExhaustedError(err error) bool {
+	errno := syscallErrno(err)
+	return errno == syscall.EMFILE || errno == syscall.ENFILE
+}
+
+// isTemporaryAcceptError checks that accepting could succeed later, so listener should not be stopped
+func isTemporaryAcceptError(err error) bool {
+	errno := syscallErrno(err)
+	return isFdExhaustedError(err) || errno == syscall.ENOBUFS || errno == syscall.ENOMEM || isTimeoutError(err)
+}
+
+// isTimeoutError checks that error is caused by exceeded deadline of network operation
+func isTimeoutError(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// syscallErrno returns errno of network error wrapped by net.OpError and os.SyscallError, 0 for other errors
+func syscallErrno(err error) syscall.Errno {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if syscallErr, ok := err.(*os.SyscallError); ok {
+		err = syscallErr.Err
+	}
+	errno, _ := err.(syscall.Errno)
+	return errno
+}
+
+// FileDescriptors returns number of open file descriptors and its soft limit, -1 and 0 if unknown on the platform
+func (srv *Server) FileDescriptors() (int, uint64) {
+	return openFileDescriptors()
+}
+
+func (srv *Server) acceptConnection(conn net.Conn) {
+	if srv.IsMaintenance() {
+		log.WithField("from", conn.RemoteAddr().String()).Info("Connection refused in maintenance mode")
+		conn.Close()
+		return
+	}
+
 	srv.connLock.Lock()
 	defer srv.connLock.Unlock()
 
 	connection := NewConnection(srv, conn)
 	srv.connections[connection.id] = connection
+	srv.metrics.Connections.Counter.Inc(1)
 	go connection.handleConnection()
 }
 
+// tcpConnOf returns TCP connection of accepted connection, nil for other connections
+func tcpConnOf(conn net.Conn) *net.TCPConn {
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		return c
+	case *wrappedConn:
+		return c.tcpConn
+	default:
+		return nil
+	}
+}
+
 func (srv *Server) removeConnection(connID uint64) {
 	srv.connLock.Lock()
 	defer srv.connLock.Unlock()
 
-	delete(srv.connections, connID)
+	if _, ok := srv.connections[connID]; ok {
+		delete(srv.connections, connID)
+		srv.metrics.Connections.Counter.Dec(1)
+	}
 }
 
 func (srv *Server) checkAuth(saslData auth.SaslData) bool {
+	srv.usersLock.RLock()
+	defer srv.usersLock.RUnlock()
 	for userName, passwordHash := range srv.users {
 		if userName != saslData.Username {
 			continue
@@ -221,35 +481,80 @@ func (srv *Server) checkAuth(saslData auth.SaslData) bool {
 		return auth.CheckPasswordHash(
 			saslData.Password,
 			passwordHash,
-			srv.config.Security.PasswordCheck == "md5",
+			srv.getConfig().Security.PasswordCheck == "md5",
 		)
 	}
 	return false
 }
 
 func (srv *Server) initUsers() {
-	for _, user := range srv.config.Users {
+	srv.usersLock.Lock()
+	defer srv.usersLock.Unlock()
+	for _, user := range srv.getConfig().Users {
 		srv.users[user.Username] = user.Password
 	}
 }
 
+// getConfig returns current config, it is replaced as a whole on reload and should not be changed by caller
+func (srv *Server) getConfig() *config.Config {
+	srv.configLock.RLock()
+	defer srv.configLock.RUnlock()
+	return srv.config
+}
+
+func (srv *Server) setConfig(cfg *config.Config) {
+	srv.configLock.Lock()
+	defer srv.configLock.Unlock()
+	srv.config = cfg
+}
+
+func (srv *Server) getAcceptLimiter() *acceptLimiter {
+	srv.acceptLimitLock.RLock()
+	defer srv.acceptLimitLock.RUnlock()
+	return srv.acceptLimit
+}
+
+func (srv *Server) setAcceptLimiter(limiter *acceptLimiter) {
+	srv.acceptLimitLock.Lock()
+	defer srv.acceptLimitLock.Unlock()
+	srv.acceptLimit = limiter
+}
+
 func (srv *Server) initServerStorage() {
-	srv.storage = srvstorage.NewSrvStorage(srv.getStorageInstance("server", true), srv.protoVersion)
+	srv.storage = srvstorage.NewSrvStorage(srv.getStorageInstance(srv.getConfig().Db.DefaultPath, "server", true), srv.protoVersion)
+	srv.initMsgIDGenerator()
+}
+
+// initMsgIDGenerator resumes message ids from bound stored before restart
+// time-based start is used if it is greater, e.g. on first start
+func (srv *Server) initMsgIDGenerator() {
+	start := uint64(time.Now().UnixNano())
+	if lastID := srv.storage.GetLastMsgID(); lastID >= start {
+		start = lastID
+	}
+
+	amqp.SetIDGenerator(amqp.NewBlockIDGenerator(start, msgIDBlockSize, func(reserved uint64) error {
+		err := srv.storage.SetLastMsgID(reserved)
+		if err != nil {
+			log.WithError(err).Error("Error on store message id bound")
+		}
+		return err
+	}))
 }
 
 func (srv *Server) initDefaultVirtualHosts() {
+	vhostName := srv.getConfig().Vhost.DefaultPath
 	log.WithFields(log.Fields{
-		"vhost": srv.config.Vhost.DefaultPath,
+		"vhost": vhostName,
 	}).Info("Initialize default vhost")
 
 	log.Info("Initialize host message msgStorage")
-	msgStoragePersistent := msgstorage.NewMsgStorage(srv.getStorageInstance("vhost_default", true), srv.protoVersion)
-	msgStorageTransient := msgstorage.NewMsgStorage(srv.getStorageInstance("vhost_default", false), srv.protoVersion)
+	msgStoragePersistent, msgStorageTransient := srv.getVhostMsgStorages(vhostName)
 
 	srv.vhostsLock.Lock()
 	defer srv.vhostsLock.Unlock()
-	srv.vhosts[srv.config.Vhost.DefaultPath] = NewVhost(srv.config.Vhost.DefaultPath, true, msgStoragePersistent, msgStorageTransient, srv)
-	srv.storage.AddVhost(srv.config.Vhost.DefaultPath, true)
+	srv.vhosts[vhostName] = NewVhost(vhostName, true, msgStoragePersistent, msgStorageTransient, srv)
+	srv.storage.AddVhost(vhostName, true)
 }
 
 func (srv *Server) initVirtualHostsFromStorage() {
@@ -258,17 +563,10 @@ func (srv *Server) initVirtualHostsFromStorage() {
 	vhosts := srv.storage.GetVhosts()
 	for host, system := range vhosts {
 		log.WithFields(log.Fields{
-			"vhost": srv.config.Vhost.DefaultPath,
+			"vhost": host,
 		}).Info("Initialize host message msgStorage")
 
-		var storageName string
-		if host == srv.config.Vhost.DefaultPath {
-			storageName = "vhost_default"
-		} else {
-			storageName = host
-		}
-		msgStoragePersistent := msgstorage.NewMsgStorage(srv.getStorageInstance(storageName, true), srv.protoVersion)
-		msgStorageTransient := msgstorage.NewMsgStorage(srv.getStorageInstance(storageName, false), srv.protoVersion)
+		msgStoragePersistent, msgStorageTransient := srv.getVhostMsgStorages(host)
 		srv.vhosts[host] = NewVhost(host, system, msgStoragePersistent, msgStorageTransient, srv)
 	}
 
@@ -276,7 +574,38 @@ func (srv *Server) initVirtualHostsFromStorage() {
 	defer srv.vhostsLock.Unlock()
 }
 
-func (srv *Server) getStorageInstance(name string, isPersistent bool) interfaces.DbStorage {
+// getVhostMsgStorages returns persistent and transient message storages of vhost
+// Storages are placed at vhost path from db.vhostPaths or at db.defaultPath
+func (srv *Server) getVhostMsgStorages(host string) (*msgstorage.MsgStorage, *msgstorage.MsgStorage) {
+	return srv.newMsgStorages(srv.getVhostStoragePath(host), host)
+}
+
+// getVhostStoragePath returns base path of vhost messages from db.vhostPaths or db.defaultPath
+func (srv *Server) getVhostStoragePath(host string) string {
+	if basePath, ok := srv.getConfig().Db.VhostPaths[host]; ok {
+		return basePath
+	}
+	return srv.getConfig().Db.DefaultPath
+}
+
+// newMsgStorages opens persistent and transient message storages of vhost at given base path
+func (srv *Server) newMsgStorages(basePath string, host string) (*msgstorage.MsgStorage, *msgstorage.MsgStorage) {
+	storageName := host
+	if host == srv.getConfig().Vhost.DefaultPath {
+		storageName = "vhost_default"
+	}
+
+	msgStoragePersistent := msgstorage.NewMsgStorage(srv.getStorageInstance(basePath, storageName, true), srv.protoVersion)
+	msgStoragePersistent.SetUsedCounter(srv.metrics.StorageUsed.Counter)
+	srv.watchStorage(msgStoragePersistent)
+
+	msgStorageTransient := msgstorage.NewMsgStorage(srv.getStorageInstance(basePath, storageName, false), srv.protoVersion)
+	srv.watchStorage(msgStorageTransient)
+
+	return msgStoragePersistent, msgStorageTransient
+}
+
+func (srv *Server) getStorageInstance(basePath string, name string, isPersistent bool) interfaces.DbStorage {
 	// very ugly solution, but don't know how to deal with "/" vhost for example
 	// rabbitmq generate random uniq id for msgstore and touch .vhost file with vhost name into folder
 
@@ -284,7 +613,8 @@ func (srv *Server) getStorageInstance(name string, isPersistent bool) interfaces
 	h.Write([]byte(name))
 	name = hex.EncodeToString(h.Sum(nil))
 
-	stPath := fmt.Sprintf("%s/%s/%s", srv.config.Db.DefaultPath, srv.config.Db.Engine, name)
+	engine := srv.getConfig().Db.Engine
+	stPath := fmt.Sprintf("%s/%s/%s", basePath, engine, name)
 
 	if !isPersistent {
 		stPath += ".transient"
@@ -300,16 +630,16 @@ func (srv *Server) getStorageInstance(name string, isPersistent bool) interfaces
 
 	log.WithFields(log.Fields{
 		"path":   stPath,
-		"engine": srv.config.Db.Engine,
+		"engine": engine,
 	}).Info("Open db storage")
 
-	switch srv.config.Db.Engine {
+	switch engine {
 	case "badger":
 		return storage.NewBadger(stPath)
 	case "buntdb":
 		return storage.NewBuntDB(stPath)
 	default:
-		srv.stopWithError(nil, fmt.Sprintf("Unknown db engine '%s'", srv.config.Db.Engine))
+		srv.stopWithError(nil, fmt.Sprintf("Unknown db engine '%s'", engine))
 	}
 	return nil
 }
@@ -319,6 +649,8 @@ func (srv *Server) onSignal(sig os.Signal) {
 	case syscall.SIGTERM, syscall.SIGINT:
 		srv.Stop()
 		os.Exit(0)
+	case syscall.SIGHUP:
+		srv.reloadConfigFile()
 	}
 }
 
@@ -332,7 +664,7 @@ func (srv *Server) testOnSignal(sig os.Signal) {
 
 func (srv *Server) hookSignals() {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
 		for sig := range c {
 			log.Infof("Received [%d:%s] signal from OS", sig, sig.String())
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	amqpclient "github.com/streadway/amqp"
+	"github.com/valinurovam/garagemq/config"
+)
+
+// accessLogBuffer collects access log entries written by server goroutines
+type accessLogBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (buffer *accessLogBuffer) Write(p []byte) (int, error) {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	return buffer.buf.Write(p)
+}
+
+func (buffer *accessLogBuffer) entries(t *testing.T, msg string) []map[string]interface{} {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buffer.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		entry := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["msg"] == msg {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func Test_AccessLog_PublishAndConsume(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	output := &accessLogBuffer{}
+	sc.server.accessLog = newAccessLog(output, config.AccessLog{})
+
+	ch, _ := sc.client.Channel()
+	ch.Confirm(false)
+	confirms := ch.NotifyPublish(make(chan amqpclient.Confirmation, 2))
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	ch.Publish("", "testQu", false, false, amqpclient.Publishing{Body: []byte("test")})
+	ch.Publish("", "unknown", false, false, amqpclient.Publishing{Body: []byte("unroutable")})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-confirms:
+		case <-time.After(time.Second):
+			t.Fatal("Timeout on waiting confirm")
+		}
+	}
+	if _, err := ch.Consume("testQu", "testTag", true, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+
+	publishes := output.entries(t, "publish")
+	if len(publishes) != 2 {
+		t.Fatalf("Expected %d publish entries, actual %d", 2, len(publishes))
+	}
+	expected := map[string]interface{}{
+		"user":        "guest",
+		"vhost":       "/",
+		"exchange":    "",
+		"routing_key": "testQu",
+		"size":        float64(4),
+		"queues":      float64(1),
+	}
+	for field, value := range expected {
+		if publishes[0][field] != value {
+			t.Fatalf("Expected publish entry %s = %v, actual %v", field, value, publishes[0][field])
+		}
+	}
+	if publishes[1]["routing_key"] != "unknown" || publishes[1]["queues"] != float64(0) {
+		t.Fatalf("Unexpected entry of unroutable publish %v", publishes[1])
+	}
+
+	consumes := output.entries(t, "consume")
+	if len(consumes) != 1 || consumes[0]["queue"] != "testQu" || consumes[0]["consumer_tag"] != "testTag" || consumes[0]["user"] != "guest" {
+		t.Fatalf("Unexpected consume entries %v", consumes)
+	}
+}
+
+func Test_AccessLog_PublishSample(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	output := &accessLogBuffer{}
+	sc.server.accessLog = newAccessLog(output, config.AccessLog{PublishSample: 2})
+
+	ch, _ := sc.client.Channel()
+	ch.Confirm(false)
+	confirms := ch.NotifyPublish(make(chan amqpclient.Confirmation, 4))
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	for i := 0; i < 4; i++ {
+		ch.Publish("", "testQu", false, false, amqpclient.Publishing{Body: []byte("test")})
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case <-confirms:
+		case <-time.After(time.Second):
+			t.Fatal("Timeout on waiting confirm")
+		}
+	}
+
+	publishes := output.entries(t, "publish")
+	if len(publishes) != 2 {
+		t.Fatalf("Expected %d sampled publish entries, actual %d", 2, len(publishes))
+	}
+	if publishes[0]["sample"] != float64(2) {
+		t.Fatalf("Expected sample rate in entry, actual %v", publishes[0])
+	}
+}
+
+func Test_AccessLog_RateLimit(t *testing.T) {
+	output := &accessLogBuffer{}
+	accessLog := newAccessLog(output, config.AccessLog{RateLimit: 1})
+
+	if !accessLog.allow() || accessLog.allow() || accessLog.allow() {
+		t.Fatal("Expected only one entry allowed per second")
+	}
+
+	// the next second starts with number of dropped entries
+	accessLog.window--
+	if !accessLog.allow() {
+		t.Fatal("Expected entry allowed in the next second")
+	}
+	dropped := output.entries(t, "dropped")
+	if len(dropped) != 1 || dropped[0]["dropped"] != float64(2) {
+		t.Fatalf("Expected %d dropped entries logged, actual %v", 2, dropped)
+	}
+}
@@ -2,7 +2,11 @@ package server
 
 import (
 	"bytes"
+	"io/ioutil"
+	"math"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -157,6 +161,211 @@ func Test_BasicQos_Check_NonGlobal_Success(t *testing.T) {
 	}
 }
 
+func Test_BasicQos_Increase_ExistingConsumer_Success(t *testing.T) {
+	for _, global := range []bool{false, true} {
+		func() {
+			sc, _ := getNewSC(getDefaultTestConfig())
+			defer sc.clean()
+			ch, _ := sc.client.Channel()
+
+			if err := ch.Qos(1, 0, global); err != nil {
+				t.Fatal(err)
+			}
+			queue, _ := ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+			for i := 0; i < 10; i++ {
+				ch.Publish("", queue.Name, false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte("test")})
+			}
+
+			cmr, err := ch.Consume("testQu", "tag", false, false, false, false, emptyTable)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count := len(receiveDeliveries(cmr, 100*time.Millisecond)); count != 1 {
+				t.Fatalf("global=%t: expected %d messages before qos change, received %d", global, 1, count)
+			}
+
+			// no acks, only raised prefetch opens credit for the existing consumer
+			if err := ch.Qos(4, 0, global); err != nil {
+				t.Fatal(err)
+			}
+			if count := len(receiveDeliveries(cmr, 100*time.Millisecond)); count != 3 {
+				t.Fatalf("global=%t: expected %d messages after qos increase, received %d", global, 3, count)
+			}
+		}()
+	}
+}
+
+func Test_ChannelMaxUnacked_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Connection.ChannelMaxUnacked = 3
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	// limit applies to all consumers of channel without basic.qos
+	ch.QueueDeclare("testQu1", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu2", false, false, false, false, emptyTable)
+	for i := 0; i < 5; i++ {
+		ch.Publish("", "testQu1", false, false, amqp.Publishing{Body: []byte("test")})
+		ch.Publish("", "testQu2", false, false, amqp.Publishing{Body: []byte("test")})
+	}
+
+	cmr1, _ := ch.Consume("testQu1", "tag1", false, false, false, false, emptyTable)
+	cmr2, _ := ch.Consume("testQu2", "tag2", false, false, false, false, emptyTable)
+	deliveries := append(receiveDeliveries(cmr1, 100*time.Millisecond), receiveDeliveries(cmr2, 100*time.Millisecond)...)
+	if len(deliveries) != 3 {
+		t.Fatalf("Expected %d unacked messages, received %d", 3, len(deliveries))
+	}
+
+	deliveries[0].Ack(false)
+	deliveries = append(receiveDeliveries(cmr1, 100*time.Millisecond), receiveDeliveries(cmr2, 100*time.Millisecond)...)
+	if len(deliveries) != 1 {
+		t.Fatalf("Expected %d message delivered after ack, received %d", 1, len(deliveries))
+	}
+
+	// noAck consumer is not limited
+	ch2, _ := sc.client.Channel()
+	ch2.QueueDeclare("testQu3", false, false, false, false, emptyTable)
+	for i := 0; i < 5; i++ {
+		ch2.Publish("", "testQu3", false, false, amqp.Publishing{Body: []byte("test")})
+	}
+	cmr3, _ := ch2.Consume("testQu3", "tag3", true, false, false, false, emptyTable)
+	if count := len(receiveDeliveries(cmr3, 100*time.Millisecond)); count != 5 {
+		t.Fatalf("Expected %d messages to noAck consumer, received %d", 5, count)
+	}
+}
+
+func Test_ChannelMaxUnacked_BasicGet(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Connection.ChannelMaxUnacked = 2
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQu1", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu2", false, false, false, false, emptyTable)
+	for i := 0; i < 5; i++ {
+		ch.Publish("", "testQu1", false, false, amqp.Publishing{Body: []byte("test")})
+		ch.Publish("", "testQu2", false, false, amqp.Publishing{Body: []byte("test")})
+	}
+
+	cmr, _ := ch.Consume("testQu1", "tag1", false, false, false, false, emptyTable)
+	if count := len(receiveDeliveries(cmr, 100*time.Millisecond)); count != 2 {
+		t.Fatalf("Expected %d unacked messages, received %d", 2, count)
+	}
+
+	// basic.get is not counted by limit, so its ack does not release consumer
+	for i := 0; i < 2; i++ {
+		msg, ok, err := ch.Get("testQu2", false)
+		if err != nil || !ok {
+			t.Fatal("Expected message on basic.get", err)
+		}
+		msg.Ack(false)
+	}
+	ch.Publish("", "testQu1", false, false, amqp.Publishing{Body: []byte("test")})
+	if count := len(receiveDeliveries(cmr, 100*time.Millisecond)); count != 0 {
+		t.Fatalf("Expected no messages delivered after basic.get ack, received %d", count)
+	}
+}
+
+func Test_BasicQos_Decrease_ExistingConsumer_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if err := ch.Qos(3, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	queue, _ := ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	for i := 0; i < 10; i++ {
+		ch.Publish("", queue.Name, false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte("test")})
+	}
+
+	cmr, err := ch.Consume("testQu", "tag", false, false, false, false, emptyTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliveries := receiveDeliveries(cmr, 100*time.Millisecond)
+	if len(deliveries) != 3 {
+		t.Fatalf("Expected %d messages before qos change, received %d", 3, len(deliveries))
+	}
+
+	if err := ch.Qos(1, 0, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 messages are still unacked, so consumer is throttled by decreased prefetch
+	deliveries[0].Ack(false)
+	if count := len(receiveDeliveries(cmr, 100*time.Millisecond)); count != 0 {
+		t.Fatalf("Expected no messages over decreased prefetch, received %d", count)
+	}
+
+	deliveries[1].Ack(false)
+	deliveries[2].Ack(false)
+	if count := len(receiveDeliveries(cmr, 100*time.Millisecond)); count != 1 {
+		t.Fatalf("Expected %d message within decreased prefetch, received %d", 1, count)
+	}
+}
+
+func Test_BasicQos_ZeroPrefetch_Unlimited_Success(t *testing.T) {
+	for _, global := range []bool{false, true} {
+		func() {
+			sc, _ := getNewSC(getDefaultTestConfig())
+			defer sc.clean()
+			ch, _ := sc.client.Channel()
+
+			// @spec-note
+			// prefetch-count: The client can specify a prefetch window of zero, meaning "no specific limit"
+			if err := ch.Qos(0, 0, global); err != nil {
+				t.Fatal(err)
+			}
+			queue, _ := ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+			msgCount := 1000
+			for i := 0; i < msgCount; i++ {
+				ch.Publish("", queue.Name, false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte("test")})
+			}
+
+			cmr, err := ch.Consume("testQu", "tag", false, false, false, false, emptyTable)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count := len(receiveDeliveries(cmr, 300*time.Millisecond)); count != msgCount {
+				t.Fatalf("global=%t: expected %d messages without acks, received %d", global, msgCount, count)
+			}
+
+			// zero prefetch set over limited one removes the window of existing consumer
+			if err := ch.Qos(1, 0, global); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 10; i++ {
+				ch.Publish("", queue.Name, false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte("test")})
+			}
+			if count := len(receiveDeliveries(cmr, 100*time.Millisecond)); count != 0 {
+				t.Fatalf("global=%t: expected no messages over prefetch, received %d", global, count)
+			}
+			if err := ch.Qos(0, 0, global); err != nil {
+				t.Fatal(err)
+			}
+			if count := len(receiveDeliveries(cmr, 100*time.Millisecond)); count != 10 {
+				t.Fatalf("global=%t: expected %d messages after prefetch reset, received %d", global, 10, count)
+			}
+		}()
+	}
+}
+
+func receiveDeliveries(cmr <-chan amqp.Delivery, timeout time.Duration) []amqp.Delivery {
+	var deliveries []amqp.Delivery
+	tick := time.After(timeout)
+	for {
+		select {
+		case delivery := <-cmr:
+			deliveries = append(deliveries, delivery)
+		case <-tick:
+			return deliveries
+		}
+	}
+}
+
 func Test_BasicPublish_Success(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
@@ -175,6 +384,33 @@ func Test_BasicPublish_Success(t *testing.T) {
 	}
 }
 
+func Test_BasicPublish_EmptyBody_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	cmr, err := ch.Consume("testQu", "tag", true, false, false, false, emptyTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// header-only message has no body frames, next message should not be mixed with it
+	ch.Publish("", "testQu", false, false, amqp.Publishing{ContentType: "text/plain"})
+	ch.Publish("", "testQu", false, false, amqp.Publishing{Body: []byte("test")})
+
+	deliveries := receiveDeliveries(cmr, 100*time.Millisecond)
+	if len(deliveries) != 2 {
+		t.Fatalf("Expected %d deliveries, actual %d", 2, len(deliveries))
+	}
+	if len(deliveries[0].Body) != 0 || deliveries[0].ContentType != "text/plain" {
+		t.Fatalf("Expected empty body with content type, actual %q %q", deliveries[0].Body, deliveries[0].ContentType)
+	}
+	if string(deliveries[1].Body) != "test" {
+		t.Fatalf("Expected %q, actual %q", "test", deliveries[1].Body)
+	}
+}
+
 func Test_BasicPublish_Persistent_Success(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
@@ -246,8 +482,9 @@ func Test_BasicPublish_Failed_ExchangeNotFound(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
 	ch, _ := sc.client.Channel()
-	c := make(chan *amqp.Error)
+	c := make(chan *amqp.Error, 1)
 	ch.NotifyClose(c)
+	connClose := sc.client.NotifyClose(make(chan *amqp.Error, 1))
 
 	ch.ExchangeDeclare("testEx", "direct", false, false, false, false, emptyTable)
 	queue, _ := ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
@@ -261,55 +498,64 @@ func Test_BasicPublish_Failed_ExchangeNotFound(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	time.Sleep(100 * time.Millisecond)
 	select {
-	case <-c:
-	default:
+	case err := <-c:
+		if err == nil || err.Code != amqp.NotFound {
+			t.Fatalf("Expected exchange not found error, actual %v", err)
+		}
+	case <-time.After(time.Second):
 		t.Fatal("Expected exhchange not found error")
 	}
+
+	// content of failed publish must be discarded without connection error
+	select {
+	case err := <-connClose:
+		t.Fatalf("Unexpected connection close %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := sc.client.Channel(); err != nil {
+		t.Fatal(err)
+	}
 }
 
-func Test_BasicPublish_Failed_Immediate(t *testing.T) {
+func Test_BasicPublish_DefaultExchange_NoRoute_Success(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
 	ch, _ := sc.client.Channel()
-	c := make(chan *amqp.Error)
+	c := make(chan *amqp.Error, 1)
 	ch.NotifyClose(c)
 
-	ch.ExchangeDeclare("testEx", "direct", false, false, false, false, emptyTable)
-	queue, _ := ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
-
 	if err := ch.Publish(
-		"test",
-		queue.Name,
-		false, true,
+		"",
+		"unknownQu",
+		false, false,
 		amqp.Publishing{ContentType: "text/plain", Body: []byte("test")},
 	); err != nil {
 		t.Fatal(err)
 	}
 
-	time.Sleep(100 * time.Millisecond)
 	select {
-	case <-c:
-	default:
-		t.Fatal("Expected Immediate not implemented error")
+	case err := <-c:
+		t.Fatalf("Unexpected channel close %v", err)
+	case <-time.After(100 * time.Millisecond):
 	}
 }
 
-func Test_BasicPublish_Failed_Mandatory(t *testing.T) {
+func Test_BasicPublish_Failed_Immediate(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
 	ch, _ := sc.client.Channel()
-	r := make(chan amqp.Return)
-	ch.NotifyReturn(r)
+	c := make(chan *amqp.Error)
+	ch.NotifyClose(c)
 
 	ch.ExchangeDeclare("testEx", "direct", false, false, false, false, emptyTable)
 	queue, _ := ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
 
 	if err := ch.Publish(
-		"testEx",
+		"test",
 		queue.Name,
-		true, false,
+		false, true,
 		amqp.Publishing{ContentType: "text/plain", Body: []byte("test")},
 	); err != nil {
 		t.Fatal(err)
@@ -317,118 +563,385 @@ func Test_BasicPublish_Failed_Mandatory(t *testing.T) {
 
 	time.Sleep(100 * time.Millisecond)
 	select {
-	case <-r:
+	case <-c:
 	default:
-		t.Fatal("Expected No route error")
+		t.Fatal("Expected Immediate not implemented error")
 	}
 }
 
-func Test_BasicConsume_WithOrderCheck_Success(t *testing.T) {
-	sc, _ := getNewSC(getDefaultTestConfig())
+func Test_BasicPublish_UserID_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Security.UserIDCheck = true
+	sc, _ := getNewSC(cfg)
 	defer sc.clean()
 	ch, _ := sc.client.Channel()
 
-	queue, _ := ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	qu, _ := ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
 
-	msgCount := 10
-	for i := 0; i < msgCount; i++ {
-		ch.Publish("", queue.Name, false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte("test" + strconv.Itoa(i))})
+	if err := ch.Publish(
+		"",
+		qu.Name,
+		false, false,
+		amqp.Publishing{ContentType: "text/plain", Body: []byte("test"), UserId: "guest"},
+	); err != nil {
+		t.Fatal(err)
 	}
 
-	cmr, err := ch.Consume("testQu", "tag", false, false, false, false, emptyTable)
+	time.Sleep(50 * time.Millisecond)
+	msg, ok, err := ch.Get(qu.Name, true)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	if len(getServerChannel(sc, 1).consumers) != 1 {
-		t.Fatal("Expected consumers on channel consumers map")
+	if !ok {
+		t.Fatal("Expected message with valid user-id")
+	}
+	if msg.UserId != "guest" {
+		t.Fatalf("Expected user-id %s, actual %s", "guest", msg.UserId)
 	}
+}
 
-	tick := time.After(100 * time.Millisecond)
-	count := 0
-	leave := false
-	for {
-		select {
-		case msg := <-cmr:
-			err := ch.Ack(msg.DeliveryTag, false)
-			if err != nil {
-				t.Fatal(err)
-			}
-			// order check
-			expectedBody := []byte("test" + strconv.Itoa(count))
-			if !bytes.Equal(msg.Body, expectedBody) {
-				t.Fatalf("Expected body %s, actual %s", expectedBody, msg.Body)
-			}
-			count++
-		case <-tick:
-			leave = true
-		default:
+func Test_BasicPublish_Failed_UserIDMismatch(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Security.UserIDCheck = true
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	c := make(chan *amqp.Error, 1)
+	ch.NotifyClose(c)
 
+	qu, _ := ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+
+	if err := ch.Publish(
+		"",
+		qu.Name,
+		false, false,
+		amqp.Publishing{ContentType: "text/plain", Body: []byte("test"), UserId: "test"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-c:
+		if err == nil || err.Code != amqp.AccessRefused {
+			t.Fatalf("Expected access refused error, actual %v", err)
 		}
-		if leave {
-			break
-		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected user-id access refused error")
 	}
 
-	time.Sleep(100 * time.Millisecond)
-	if count != msgCount {
-		t.Fatalf("Expected %d messages, received %d", msgCount, count)
+	if sc.server.getVhost("/").GetQueue("testQu").Length() != 0 {
+		t.Fatal("Expected message with wrong user-id is not routed")
 	}
 }
 
-func Test_BasicConsume_Failed_QueueNotFound(t *testing.T) {
+func Test_BasicPublish_UserIDMismatch_CheckDisabled(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
 	ch, _ := sc.client.Channel()
 
-	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	qu, _ := ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
 
-	_, err := ch.Consume("test", "tag", false, false, false, false, emptyTable)
-	if err == nil {
-		t.Fatal("Expected NOT_FOUND error")
+	if err := ch.Publish(
+		"",
+		qu.Name,
+		false, false,
+		amqp.Publishing{ContentType: "text/plain", Body: []byte("test"), UserId: "test"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if _, ok, _ := ch.Get(qu.Name, true); !ok {
+		t.Fatal("Expected message with any user-id when check disabled")
 	}
 }
 
-func Test_BasicConsume_Failed_SameTag(t *testing.T) {
+func Test_BasicPublish_CC_BCC_Success(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
 	ch, _ := sc.client.Channel()
 
-	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	ch.ExchangeDeclare("testEx", "direct", false, false, false, false, emptyTable)
+	for _, name := range []string{"testQu1", "testQu2", "testQu3"} {
+		ch.QueueDeclare(name, false, false, false, false, emptyTable)
+		ch.QueueBind(name, name, "testEx", false, emptyTable)
+	}
 
-	_, err := ch.Consume("testQu", "tag", false, false, false, false, emptyTable)
-	if err != nil {
+	if err := ch.Publish(
+		"testEx",
+		"testQu1",
+		false, false,
+		amqp.Publishing{
+			Body:    []byte("test"),
+			Headers: amqp.Table{"CC": []interface{}{"testQu2"}, "BCC": []interface{}{"testQu3"}},
+		},
+	); err != nil {
 		t.Fatal(err)
 	}
 
-	_, err = ch.Consume("testQu", "tag", false, false, false, false, emptyTable)
-	if err == nil {
-		t.Fatal("Expected NOT_ALLOWED error")
+	time.Sleep(50 * time.Millisecond)
+	for _, name := range []string{"testQu1", "testQu2", "testQu3"} {
+		msg, ok, _ := ch.Get(name, true)
+		if !ok {
+			t.Fatalf("Expected message in queue %s", name)
+		}
+		if _, ok := msg.Headers["BCC"]; ok {
+			t.Fatal("Expected BCC header stripped")
+		}
+		if _, ok := msg.Headers["CC"]; !ok {
+			t.Fatal("Expected CC header delivered")
+		}
 	}
 }
 
-func Test_BasicConsume_Failed_ExclusiveQueue(t *testing.T) {
+func Test_BasicPublish_AdditionalExchanges_Success(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
-	ch1, _ := sc.client.Channel()
-	ch2, _ := sc.client.Channel()
-
-	ch1.QueueDeclare("testQu_Ex1", false, false, false, false, emptyTable)
-	ch1.QueueDeclare("testQu_Ex2", false, false, false, false, emptyTable)
-
-	_, err := ch1.Consume("testQu_Ex1", "tag_ex1", false, true, false, false, emptyTable)
-	if err != nil {
+	ch, _ := sc.client.Channel()
+	ch.Confirm(false)
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 2))
+
+	ch.ExchangeDeclare("testEx1", "direct", false, false, false, false, emptyTable)
+	ch.ExchangeDeclare("testEx2", "fanout", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu1", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu2", false, false, false, false, emptyTable)
+	ch.QueueBind("testQu1", "key", "testEx1", false, emptyTable)
+	// queue matched by both exchanges gets single message
+	ch.QueueBind("testQu1", "", "testEx2", false, emptyTable)
+	ch.QueueBind("testQu2", "", "testEx2", false, emptyTable)
+
+	if err := ch.Publish("testEx1", "key", false, false, amqp.Publishing{
+		Body: []byte("test"),
+		Headers: amqp.Table{"x-additional-exchanges": []interface{}{
+			amqp.Table{"exchange": "testEx2", "routing-key": "other"},
+		}},
+	}); err != nil {
 		t.Fatal(err)
 	}
 
-	_, err = ch1.Consume("testQu_Ex1", "tag1", false, false, false, false, emptyTable)
-	if err == nil {
-		t.Fatal("Expected ACCESS_REFUSED error")
+	select {
+	case confirm := <-confirms:
+		if !confirm.Ack || confirm.DeliveryTag != 1 {
+			t.Fatalf("Expected ack of single publish, actual %+v", confirm)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout on waiting confirm")
 	}
 
-	_, err = ch2.Consume("testQu_Ex2", "tag_ex2", false, false, false, false, emptyTable)
-	if err != nil {
-		t.Fatal(err)
+	for _, name := range []string{"testQu1", "testQu2"} {
+		msg, ok, _ := ch.Get(name, true)
+		if !ok {
+			t.Fatalf("Expected message in queue %s", name)
+		}
+		if msg.Exchange != "testEx1" || msg.RoutingKey != "key" {
+			t.Fatalf("Expected message with published exchange and key, actual %s %s", msg.Exchange, msg.RoutingKey)
+		}
+	}
+	if _, ok, _ := ch.Get("testQu1", true); ok {
+		t.Fatal("Expected single message in queue matched by both exchanges")
+	}
+}
+
+func Test_BasicPublish_AdditionalExchanges_Failed_NotFound(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	ch.ExchangeDeclare("testEx", "direct", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	ch.QueueBind("testQu", "key", "testEx", false, emptyTable)
+
+	ch.Publish("testEx", "key", false, false, amqp.Publishing{
+		Body: []byte("test"),
+		Headers: amqp.Table{"x-additional-exchanges": []interface{}{
+			amqp.Table{"exchange": "amq.direct", "routing-key": "key"},
+			amqp.Table{"exchange": "unknownEx"},
+		}},
+	})
+
+	select {
+	case err := <-closed:
+		if err == nil || err.Code != amqp.NotFound {
+			t.Fatalf("Expected channel closed with NOT_FOUND, actual %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected channel error on unknown additional exchange")
+	}
+
+	if length := sc.server.getVhost("/").GetQueue("testQu").Length(); length != 0 {
+		t.Fatalf("Expected message not routed, actual queue length %d", length)
+	}
+}
+
+func Test_BasicPublish_Mandatory_RoutedByCC(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+
+	ch.ExchangeDeclare("testEx", "direct", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	ch.QueueBind("testQu", "testQu", "testEx", false, emptyTable)
+
+	ch.Publish("testEx", "unknown", true, false, amqp.Publishing{
+		Body:    []byte("test"),
+		Headers: amqp.Table{"BCC": []interface{}{"testQu"}},
+	})
+	ch.Publish("testEx", "unknown", true, false, amqp.Publishing{
+		Body:    []byte("test"),
+		Headers: amqp.Table{"CC": []interface{}{"unknown2"}},
+	})
+
+	select {
+	case ret := <-returns:
+		if _, ok := ret.Headers["CC"]; !ok {
+			t.Fatal("Expected return of message not routed by any key")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected basic.return for unrouted message")
+	}
+
+	select {
+	case <-returns:
+		t.Fatal("Unexpected second basic.return")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func Test_BasicPublish_Failed_Mandatory(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	r := make(chan amqp.Return)
+	ch.NotifyReturn(r)
+
+	ch.ExchangeDeclare("testEx", "direct", false, false, false, false, emptyTable)
+	queue, _ := ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+
+	if err := ch.Publish(
+		"testEx",
+		queue.Name,
+		true, false,
+		amqp.Publishing{ContentType: "text/plain", Body: []byte("test")},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-r:
+	default:
+		t.Fatal("Expected No route error")
+	}
+}
+
+func Test_BasicConsume_WithOrderCheck_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	queue, _ := ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+
+	msgCount := 10
+	for i := 0; i < msgCount; i++ {
+		ch.Publish("", queue.Name, false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte("test" + strconv.Itoa(i))})
+	}
+
+	cmr, err := ch.Consume("testQu", "tag", false, false, false, false, emptyTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(getServerChannel(sc, 1).consumers) != 1 {
+		t.Fatal("Expected consumers on channel consumers map")
+	}
+
+	tick := time.After(100 * time.Millisecond)
+	count := 0
+	leave := false
+	for {
+		select {
+		case msg := <-cmr:
+			err := ch.Ack(msg.DeliveryTag, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// order check
+			expectedBody := []byte("test" + strconv.Itoa(count))
+			if !bytes.Equal(msg.Body, expectedBody) {
+				t.Fatalf("Expected body %s, actual %s", expectedBody, msg.Body)
+			}
+			count++
+		case <-tick:
+			leave = true
+		default:
+
+		}
+		if leave {
+			break
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if count != msgCount {
+		t.Fatalf("Expected %d messages, received %d", msgCount, count)
+	}
+}
+
+func Test_BasicConsume_Failed_QueueNotFound(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+
+	_, err := ch.Consume("test", "tag", false, false, false, false, emptyTable)
+	if err == nil {
+		t.Fatal("Expected NOT_FOUND error")
+	}
+}
+
+func Test_BasicConsume_Failed_SameTag(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+
+	_, err := ch.Consume("testQu", "tag", false, false, false, false, emptyTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ch.Consume("testQu", "tag", false, false, false, false, emptyTable)
+	if err == nil {
+		t.Fatal("Expected NOT_ALLOWED error")
+	}
+}
+
+func Test_BasicConsume_Failed_ExclusiveQueue(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch1, _ := sc.client.Channel()
+	ch2, _ := sc.client.Channel()
+
+	ch1.QueueDeclare("testQu_Ex1", false, false, false, false, emptyTable)
+	ch1.QueueDeclare("testQu_Ex2", false, false, false, false, emptyTable)
+
+	_, err := ch1.Consume("testQu_Ex1", "tag_ex1", false, true, false, false, emptyTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ch1.Consume("testQu_Ex1", "tag1", false, false, false, false, emptyTable)
+	if err == nil {
+		t.Fatal("Expected ACCESS_REFUSED error")
+	}
+
+	_, err = ch2.Consume("testQu_Ex2", "tag_ex2", false, false, false, false, emptyTable)
+	if err != nil {
+		t.Fatal(err)
 	}
 
 	_, err = ch2.Consume("testQu_Ex2", "tag2", false, true, false, false, emptyTable)
@@ -460,45 +973,815 @@ func Test_BasicConsume_Success_Exclusive_Reconsume(t *testing.T) {
 	}
 }
 
-func Test_BasicCancel_Success(t *testing.T) {
+func Test_BasicConsume_Filter_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	qu, _ := ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+
+	msgs, err := ch.Consume(qu.Name, "tag", true, false, false, false, amqp.Table{"x-filter": "format = json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{"xml", "json", "xml", "json"} {
+		ch.Publish("", qu.Name, false, false, amqp.Publishing{
+			Headers: amqp.Table{"format": format},
+			Body:    []byte(format),
+		})
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-msgs:
+			if msg.Headers["format"] != "json" {
+				t.Fatalf("Expected only filtered messages, received %v", msg.Headers["format"])
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected filtered message")
+		}
+	}
+
+	select {
+	case msg := <-msgs:
+		t.Fatalf("Unexpected message %v", msg.Headers["format"])
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// non-matched messages are still available for other consumers
+	for i := 0; i < 2; i++ {
+		msg, ok, _ := ch.Get(qu.Name, true)
+		if !ok || msg.Headers["format"] != "xml" {
+			t.Fatal("Expected non-matched message in queue")
+		}
+	}
+}
+
+func Test_BasicConsume_Failed_InvalidFilter(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
 	ch, _ := sc.client.Channel()
 
 	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
 
-	_, err := ch.Consume("testQu", "tag", false, false, false, false, emptyTable)
+	_, err := ch.Consume("testQu", "tag", false, false, false, false, amqp.Table{"x-filter": "format = "})
+	if err == nil {
+		t.Fatal("Expected invalid filter error")
+	}
+}
+
+func Test_BasicConsume_BatchSize_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	qu, _ := ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	for i := 0; i < 5; i++ {
+		ch.Publish("", qu.Name, false, false, amqp.Publishing{Body: []byte("test")})
+	}
+
+	cmr, err := ch.Consume(qu.Name, "tag", false, false, false, false, amqp.Table{"x-batch-size": int32(2)})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(getServerChannel(sc, 1).consumers) != 1 {
-		t.Fatal("Expected consumers on channel consumers map")
+	batch := receiveDeliveries(cmr, 100*time.Millisecond)
+	if len(batch) != 2 {
+		t.Fatalf("Expected %d messages of batch, received %d", 2, len(batch))
 	}
 
-	if err = ch.Cancel("tag", false); err != nil {
+	// next batch is delivered only after the whole batch is acked
+	batch[0].Ack(false)
+	if count := len(receiveDeliveries(cmr, 100*time.Millisecond)); count != 0 {
+		t.Fatalf("Expected no messages before batch is acked, received %d", count)
+	}
+	batch[1].Ack(true)
+	batch = receiveDeliveries(cmr, 100*time.Millisecond)
+	if len(batch) != 2 {
+		t.Fatalf("Expected %d messages of next batch, received %d", 2, len(batch))
+	}
+
+	batch[1].Ack(true)
+	if count := len(receiveDeliveries(cmr, 100*time.Millisecond)); count != 1 {
+		t.Fatalf("Expected %d message of last batch, received %d", 1, count)
+	}
+}
+
+func Test_BasicConsume_BatchSize_Qos(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	qu, _ := ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	for i := 0; i < 5; i++ {
+		ch.Publish("", qu.Name, false, false, amqp.Publishing{Body: []byte("test")})
+	}
+
+	// the smaller of prefetch count and batch size applies
+	ch.Qos(3, 0, false)
+	cmr, _ := ch.Consume(qu.Name, "tag", false, false, false, false, amqp.Table{"x-batch-size": int32(4)})
+	deliveries := receiveDeliveries(cmr, 100*time.Millisecond)
+	if len(deliveries) != 3 {
+		t.Fatalf("Expected %d messages limited by prefetch, received %d", 3, len(deliveries))
+	}
+
+	// prefetch does not refill batch, so the rest of batch is delivered
+	deliveries[0].Ack(false)
+	deliveries = receiveDeliveries(cmr, 100*time.Millisecond)
+	if len(deliveries) != 1 {
+		t.Fatalf("Expected %d message completing batch, received %d", 1, len(deliveries))
+	}
+	deliveries[0].Ack(false)
+	if count := len(receiveDeliveries(cmr, 100*time.Millisecond)); count != 0 {
+		t.Fatalf("Expected no messages before batch is acked, received %d", count)
+	}
+
+	// batch qos is not changed by basic.qos
+	ch.Qos(10, 0, false)
+	if count := len(receiveDeliveries(cmr, 100*time.Millisecond)); count != 0 {
+		t.Fatalf("Expected no messages before batch is acked, received %d", count)
+	}
+}
+
+func Test_BasicConsume_Failed_InvalidBatchSize(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	for _, args := range []struct {
+		noAck bool
+		size  interface{}
+	}{
+		{false, int32(0)},
+		{false, int32(65536)},
+		{false, "10"},
+		{true, int32(10)},
+	} {
+		ch, _ := sc.client.Channel()
+		ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+		if _, err := ch.Consume("testQu", "tag", args.noAck, false, false, false, amqp.Table{"x-batch-size": args.size}); err == nil {
+			t.Fatalf("Expected error for batch size %v with no-ack %t", args.size, args.noAck)
+		}
+	}
+}
+
+func Test_BasicConsume_MaxUnacked_SharedChannel(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	qu, _ := ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	for i := 0; i < 10; i++ {
+		ch.Publish("", qu.Name, false, false, amqp.Publishing{Body: []byte("test")})
+	}
+
+	// greedy consumer takes only its part of channel window
+	ch.Qos(5, 0, true)
+	greedy, err := ch.Consume(qu.Name, "greedy", false, false, false, false, amqp.Table{"x-max-unacked": int32(2)})
+	if err != nil {
 		t.Fatal(err)
 	}
+	greedyDeliveries := receiveDeliveries(greedy, 100*time.Millisecond)
+	if len(greedyDeliveries) != 2 {
+		t.Fatalf("Expected %d messages limited by x-max-unacked, received %d", 2, len(greedyDeliveries))
+	}
+
+	other, _ := ch.Consume(qu.Name, "other", false, false, false, false, emptyTable)
+	if count := len(receiveDeliveries(other, 100*time.Millisecond)); count != 3 {
+		t.Fatalf("Expected %d messages of the rest of channel window, received %d", 3, count)
+	}
+
+	// acked messages give credit to consumer up to its limit
+	greedyDeliveries[1].Ack(true)
+	if count := len(receiveDeliveries(greedy, 100*time.Millisecond)); count != 2 {
+		t.Fatalf("Expected %d messages after ack, received %d", 2, count)
+	}
+	if count := len(receiveDeliveries(other, 100*time.Millisecond)); count != 0 {
+		t.Fatalf("Expected no messages above channel window, received %d", count)
+	}
+}
+
+func Test_BasicConsume_MaxUnacked_Qos(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	qu, _ := ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	for i := 0; i < 10; i++ {
+		ch.Publish("", qu.Name, false, false, amqp.Publishing{Body: []byte("test")})
+	}
+
+	// the smaller of prefetch count and x-max-unacked applies
+	ch.Qos(1, 0, false)
+	cmr, _ := ch.Consume(qu.Name, "tag", false, false, false, false, amqp.Table{"x-max-unacked": int32(3)})
+	if count := len(receiveDeliveries(cmr, 100*time.Millisecond)); count != 1 {
+		t.Fatalf("Expected %d message limited by prefetch, received %d", 1, count)
+	}
+
+	// x-max-unacked is not changed by basic.qos
+	ch.Qos(10, 0, false)
+	if count := len(receiveDeliveries(cmr, 100*time.Millisecond)); count != 2 {
+		t.Fatalf("Expected %d messages limited by x-max-unacked, received %d", 2, count)
+	}
+}
+
+func Test_BasicConsume_Failed_InvalidMaxUnacked(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	for _, args := range []struct {
+		noAck      bool
+		maxUnacked interface{}
+	}{
+		{false, int32(0)},
+		{false, int32(65536)},
+		{false, "10"},
+		{true, int32(10)},
+	} {
+		ch, _ := sc.client.Channel()
+		ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+		if _, err := ch.Consume("testQu", "tag", args.noAck, false, false, false, amqp.Table{"x-max-unacked": args.maxUnacked}); err == nil {
+			t.Fatalf("Expected error for x-max-unacked %v with no-ack %t", args.maxUnacked, args.noAck)
+		}
+	}
+}
+
+// publishToQueues publishes count messages into each queue with queue name as body
+func publishToQueues(ch *amqp.Channel, queues []string, count int) {
+	for _, name := range queues {
+		ch.QueueDeclare(name, false, false, false, false, emptyTable)
+		for i := 0; i < count; i++ {
+			ch.Publish("", name, false, false, amqp.Publishing{Body: []byte(name)})
+		}
+	}
+}
+
+func deliveriesBodies(deliveries []amqp.Delivery) string {
+	bodies := ""
+	for _, delivery := range deliveries {
+		bodies += string(delivery.Body)
+	}
+	return bodies
+}
+
+func Test_BasicConsume_AdditionalQueues_RoundRobin(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	vhost := sc.server.getVhost("/")
+	publishToQueues(ch, []string{"a", "b", "c"}, 2)
+
+	args := amqp.Table{"x-additional-queues": []interface{}{"b", "c"}}
+	cmr, err := ch.Consume("a", "tag", false, false, false, false, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries := receiveDeliveries(cmr, 100*time.Millisecond)
+	if bodies := deliveriesBodies(deliveries); bodies != "abcabc" {
+		t.Fatalf("Expected deliveries of queues in round robin order, actual '%s'", bodies)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if count := vhost.GetQueue(name).ConsumersCount(); count != 1 {
+			t.Fatalf("Expected consumer registered in queue '%s'", name)
+		}
+	}
+
+	// acks and rejects go to source queue of message
+	deliveries[1].Nack(false, true)
+	deliveries[5].Ack(true)
+	redelivered := receiveDeliveries(cmr, 100*time.Millisecond)
+	if len(redelivered) != 1 || string(redelivered[0].Body) != "b" || !redelivered[0].Redelivered {
+		t.Fatalf("Expected message requeued into queue 'b' delivered again, received '%s'", deliveriesBodies(redelivered))
+	}
+	unacked := getServerChannel(sc, 1).GetUnackedMessages()
+	if len(unacked) != 1 || unacked[0].Queue != "b" {
+		t.Fatal("Expected the only unacked message is tracked for queue 'b'")
+	}
+
+	ch.Cancel("tag", false)
+	for _, name := range []string{"a", "b", "c"} {
+		if count := vhost.GetQueue(name).ConsumersCount(); count != 0 {
+			t.Fatalf("Expected consumer removed from queue '%s'", name)
+		}
+	}
+}
+
+func Test_BasicConsume_AdditionalQueues_Priority(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	publishToQueues(ch, []string{"a", "b"}, 2)
+
+	args := amqp.Table{"x-additional-queues": []interface{}{"b"}, "x-queue-order": "priority"}
+	cmr, err := ch.Consume("a", "tag", true, false, false, false, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodies := deliveriesBodies(receiveDeliveries(cmr, 100*time.Millisecond)); bodies != "aabb" {
+		t.Fatalf("Expected queue 'b' consumed after queue 'a' is empty, actual '%s'", bodies)
+	}
+
+	// message of the first queue goes first while both queues have messages
+	ch.Publish("", "b", false, false, amqp.Publishing{Body: []byte("b")})
+	ch.Publish("", "a", false, false, amqp.Publishing{Body: []byte("a")})
+	if bodies := deliveriesBodies(receiveDeliveries(cmr, 100*time.Millisecond)); len(bodies) != 2 {
+		t.Fatalf("Expected messages of both queues delivered, actual '%s'", bodies)
+	}
+}
+
+func Test_BasicConsume_Failed_AdditionalQueues(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	publishToQueues(ch, []string{"a", "b"}, 0)
+
+	for _, args := range []amqp.Table{
+		{"x-additional-queues": []interface{}{"unknown"}},
+		{"x-additional-queues": []interface{}{"b", "b"}},
+		{"x-additional-queues": []interface{}{"a"}},
+		{"x-additional-queues": "b"},
+		{"x-additional-queues": []interface{}{int32(1)}},
+		{"x-additional-queues": []interface{}{"b"}, "x-queue-order": "random"},
+	} {
+		ch, _ := sc.client.Channel()
+		if _, err := ch.Consume("a", "tag", false, false, false, false, args); err == nil {
+			t.Fatalf("Expected error for consumer arguments %v", args)
+		}
+	}
+
+	// exclusive consumer is registered in all queues or in none of them
+	ch, _ = sc.client.Channel()
+	ch.Consume("b", "other", false, false, false, false, emptyTable)
+	if _, err := ch.Consume("a", "tag", false, true, false, false, amqp.Table{"x-additional-queues": []interface{}{"b"}}); err == nil {
+		t.Fatal("Expected error for exclusive consumer of busy queue")
+	}
+	if count := sc.server.getVhost("/").GetQueue("a").ConsumersCount(); count != 0 {
+		t.Fatalf("Expected consumer removed from queue 'a', actual %d consumers", count)
+	}
+}
+
+func Test_BasicConsume_Weight(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+
+	chHeavy, _ := sc.client.Channel()
+	heavy, err := chHeavy.Consume("testQu", "heavy", true, false, false, false, amqp.Table{"x-consumer-weight": int32(3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chLight, _ := sc.client.Channel()
+	light, _ := chLight.Consume("testQu", "light", true, false, false, false, emptyTable)
+
+	// messages are held until both consumers are started
+	count := 400
+	qu := sc.server.getVhost("/").GetQueue("testQu")
+	qu.Pause()
+	for i := 0; i < count; i++ {
+		ch.Publish("", "testQu", false, false, amqp.Publishing{Body: []byte("test")})
+	}
+	ch.QueueInspect("testQu")
+	qu.Resume()
+
+	heavyCount, lightCount := 0, 0
+	for heavyCount+lightCount < count {
+		select {
+		case <-heavy:
+			heavyCount++
+		case <-light:
+			lightCount++
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %d deliveries, actual %d", count, heavyCount+lightCount)
+		}
+	}
+	if ratio := float64(heavyCount) / float64(lightCount); ratio < 2.5 || ratio > 3.5 {
+		t.Fatalf("Expected deliveries in ratio 3:1, actual %d:%d", heavyCount, lightCount)
+	}
+}
+
+func Test_BasicConsume_Weight_Qos(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+
+	// consumer at prefetch limit gives its turn to the next one
+	chHeavy, _ := sc.client.Channel()
+	chHeavy.Qos(1, 0, false)
+	heavy, _ := chHeavy.Consume("testQu", "heavy", false, false, false, false, amqp.Table{"x-consumer-weight": int32(3)})
+	chLight, _ := sc.client.Channel()
+	light, _ := chLight.Consume("testQu", "light", true, false, false, false, emptyTable)
+
+	for i := 0; i < 8; i++ {
+		ch.Publish("", "testQu", false, false, amqp.Publishing{Body: []byte("test")})
+	}
+
+	if deliveries := receiveDeliveries(heavy, 100*time.Millisecond); len(deliveries) != 1 {
+		t.Fatalf("Expected %d deliveries within prefetch, actual %d", 1, len(deliveries))
+	}
+	if deliveries := receiveDeliveries(light, 100*time.Millisecond); len(deliveries) != 7 {
+		t.Fatalf("Expected %d deliveries, actual %d", 7, len(deliveries))
+	}
+}
+
+func Test_BasicConsume_Failed_Weight(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	for _, weight := range []interface{}{int32(0), int32(-1), int32(math.MaxUint16 + 1), "3"} {
+		ch, _ := sc.client.Channel()
+		ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+		if _, err := ch.Consume("testQu", "", false, false, false, false, amqp.Table{"x-consumer-weight": weight}); err == nil {
+			t.Fatalf("Expected error on x-consumer-weight %v", weight)
+		}
+	}
+}
+
+func Test_BasicConsume_Options_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+
+	ch.Consume("testQu", "tag2", false, false, false, false, emptyTable)
+	ch.Consume("testQu", "tag1", true, false, true, false, amqp.Table{"x-filter": "format = json"})
+
+	consumers := getServerChannel(sc, 1).GetConsumers()
+	if len(consumers) != 2 || consumers[0].Tag() != "tag1" || consumers[1].Tag() != "tag2" {
+		t.Fatal("Expected consumers sorted by tag")
+	}
+
+	options := consumers[0].Options()
+	if !options.NoAck || !options.NoLocal || options.Exclusive || options.Filter == nil {
+		t.Fatalf("Unexpected consumer options %+v", options)
+	}
+	options = consumers[1].Options()
+	if options.NoAck || options.NoLocal || options.Exclusive || options.Filter != nil {
+		t.Fatalf("Unexpected consumer options %+v", options)
+	}
+}
+
+func Test_CancelConsumer_RequeueUnacked(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	cancels := ch.NotifyCancel(make(chan string, 1))
+
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	ch.Qos(3, 0, false)
+	msgCount := 5
+	for i := 0; i < msgCount; i++ {
+		ch.Publish("", "testQu", false, false, amqp.Publishing{Body: []byte(strconv.Itoa(i))})
+	}
+	cmr, _ := ch.Consume("testQu", "tag", false, false, false, false, emptyTable)
+	if count := len(receiveDeliveries(cmr, 100*time.Millisecond)); count != 3 {
+		t.Fatalf("Expected %d messages delivered, actual %d", 3, count)
+	}
+
+	requeued, ok := getServerChannel(sc, 1).CancelConsumer("tag")
+	if !ok || requeued != 3 {
+		t.Fatalf("Expected %d messages requeued, actual %d", 3, requeued)
+	}
+	select {
+	case tag := <-cancels:
+		if tag != "tag" {
+			t.Fatalf("Expected consumer %s cancelled, actual %s", "tag", tag)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected basic.cancel sent to client")
+	}
+	if _, ok = getServerChannel(sc, 1).CancelConsumer("tag"); ok {
+		t.Fatal("Expected cancelled consumer not found")
+	}
+
+	// channel keeps working, requeued messages are delivered first and in order
+	cmr, _ = ch.Consume("testQu", "tag2", true, false, false, false, emptyTable)
+	deliveries := receiveDeliveries(cmr, 100*time.Millisecond)
+	if len(deliveries) != msgCount {
+		t.Fatalf("Expected %d messages delivered to new consumer, actual %d", msgCount, len(deliveries))
+	}
+	for i, delivery := range deliveries {
+		if string(delivery.Body) != strconv.Itoa(i) || delivery.Redelivered != (i < 3) {
+			t.Fatalf("Unexpected delivery %d: %s, redelivered %t", i, delivery.Body, delivery.Redelivered)
+		}
+	}
+}
+
+func Test_RequeueUnacked(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch1, _ := sc.client.Channel()
+	ch2, _ := sc.client.Channel()
+
+	ch1.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	ch1.QueueDeclare("testQuOther", false, false, false, false, emptyTable)
+	for i := 0; i < 4; i++ {
+		ch1.Publish("", "testQu", false, false, amqp.Publishing{Body: []byte(strconv.Itoa(i))})
+	}
+	ch1.Publish("", "testQuOther", false, false, amqp.Publishing{Body: []byte("other")})
+
+	ch1.Qos(2, 0, false)
+	ch2.Qos(2, 0, false)
+	cmr1, _ := ch1.Consume("testQu", "tag1", false, false, false, false, emptyTable)
+	cmr2, _ := ch2.Consume("testQu", "tag2", false, false, false, false, emptyTable)
+	cmrOther, _ := ch1.Consume("testQuOther", "tagOther", false, false, false, false, emptyTable)
+	if count := len(receiveDeliveries(cmr1, 100*time.Millisecond)) + len(receiveDeliveries(cmr2, 100*time.Millisecond)); count != 4 {
+		t.Fatalf("Expected %d messages delivered, actual %d", 4, count)
+	}
+	if count := len(receiveDeliveries(cmrOther, 100*time.Millisecond)); count != 1 {
+		t.Fatalf("Expected %d messages delivered, actual %d", 1, count)
+	}
+
+	vhost := sc.server.getVhost("/")
+	if _, err := vhost.RequeueUnacked("unknownQu"); err == nil {
+		t.Fatal("Expected error on unknown queue")
+	}
+	requeued, err := vhost.RequeueUnacked("testQu")
+	if err != nil || requeued != 4 {
+		t.Fatalf("Expected %d messages requeued, actual %d, %v", 4, requeued, err)
+	}
+
+	// consumers are kept and get requeued messages again, messages of other queues stay unacked
+	deliveries := append(receiveDeliveries(cmr1, 100*time.Millisecond), receiveDeliveries(cmr2, 100*time.Millisecond)...)
+	if len(deliveries) != 4 {
+		t.Fatalf("Expected %d messages redelivered, actual %d", 4, len(deliveries))
+	}
+	for _, delivery := range deliveries {
+		if !delivery.Redelivered {
+			t.Fatalf("Expected delivery %s redelivered", delivery.Body)
+		}
+	}
+	if count := len(getServerChannel(sc, 1).GetUnackedMessages()); count != 3 {
+		t.Fatalf("Expected %d unacked messages on channel, actual %d", 3, count)
+	}
+}
+
+func Test_RequeueUnacked_AckRequeued(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	for i := 0; i < 2; i++ {
+		ch.Publish("", "testQu", false, false, amqp.Publishing{Body: []byte(strconv.Itoa(i))})
+	}
+
+	ch.Qos(2, 0, false)
+	cmr, _ := ch.Consume("testQu", "tag", false, false, false, false, emptyTable)
+	deliveries := receiveDeliveries(cmr, 100*time.Millisecond)
+	if len(deliveries) != 2 {
+		t.Fatalf("Expected %d messages delivered, actual %d", 2, len(deliveries))
+	}
+
+	if _, err := sc.server.getVhost("/").RequeueUnacked("testQu"); err != nil {
+		t.Fatal(err)
+	}
+	redeliveries := receiveDeliveries(cmr, 100*time.Millisecond)
+	if len(redeliveries) != 2 {
+		t.Fatalf("Expected %d messages redelivered, actual %d", 2, len(redeliveries))
+	}
+
+	// client acks and nacks deliveries made before requeue, they are ignored
+	deliveries[0].Ack(false)
+	deliveries[1].Nack(false, false)
+	for _, delivery := range redeliveries {
+		delivery.Ack(false)
+	}
+
+	if _, err := ch.QueueDeclarePassive("testQu", false, false, false, false, emptyTable); err != nil {
+		t.Fatal("Expected channel open, actual", err)
+	}
+	select {
+	case err := <-closed:
+		t.Fatal("Expected channel open, actual closed with", err)
+	default:
+	}
+	if count := len(getServerChannel(sc, 1).GetUnackedMessages()); count != 0 {
+		t.Fatalf("Expected %d unacked messages on channel, actual %d", 0, count)
+	}
+	if length := sc.server.getVhost("/").GetQueue("testQu").Length(); length != 0 {
+		t.Fatalf("Expected %d messages in queue, actual %d", 0, length)
+	}
+}
+
+func Test_BasicCancel_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+
+	_, err := ch.Consume("testQu", "tag", false, false, false, false, emptyTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(getServerChannel(sc, 1).consumers) != 1 {
+		t.Fatal("Expected consumers on channel consumers map")
+	}
+
+	if err = ch.Cancel("tag", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(getServerChannel(sc, 1).consumers) != 0 {
+		t.Fatal("Expected empty channel consumers map")
+	}
+}
+
+func Test_BasicCancel_Failed_Unknown_Tag(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+
+	_, err := ch.Consume("testQu", "tag", false, false, false, false, emptyTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ch.Cancel("tag_unknown", false); err == nil {
+		t.Fatal("Expected NOT_FOUND error")
+	}
+}
+
+func Test_BasicConsume_UnackedMessages_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	queue, _ := ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+
+	msgCount := 3
+	for i := 0; i < msgCount; i++ {
+		ch.Publish("", queue.Name, false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte("test")})
+	}
+
+	cmr, err := ch.Consume("testQu", "tag", false, false, false, false, emptyTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliveries := receiveDeliveries(cmr, 100*time.Millisecond)
+	if len(deliveries) != msgCount {
+		t.Fatalf("Expected %d deliveries, actual %d", msgCount, len(deliveries))
+	}
+	ch.Ack(deliveries[0].DeliveryTag, false)
+	time.Sleep(50 * time.Millisecond)
+
+	unacked := getServerChannel(sc, 1).GetUnackedMessages()
+	if len(unacked) != msgCount-1 {
+		t.Fatalf("Expected %d unacked, actual %d", msgCount-1, len(unacked))
+	}
+	for i, uMsg := range unacked {
+		if uMsg.DeliveryTag != deliveries[i+1].DeliveryTag {
+			t.Fatalf("Expected delivery tag %d, actual %d", deliveries[i+1].DeliveryTag, uMsg.DeliveryTag)
+		}
+		if uMsg.ConsumerTag != "tag" || uMsg.Queue != "testQu" || uMsg.Size != 4 {
+			t.Fatalf("Unexpected unacked message %+v", uMsg)
+		}
+		if uMsg.MessageID == 0 || uMsg.DeliveredAt.IsZero() {
+			t.Fatalf("Expected message id and delivery time, actual %+v", uMsg)
+		}
+	}
+}
+
+func Test_ChannelClose_RequeueUnacked_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	queue, _ := ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+
+	msgCount := 5
+	for i := 0; i < msgCount; i++ {
+		ch.Publish("", queue.Name, false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte(strconv.Itoa(i))})
+	}
+
+	cmr, _ := ch.Consume("testQu", "tag", false, false, false, false, emptyTable)
+	if deliveries := receiveDeliveries(cmr, 100*time.Millisecond); len(deliveries) != msgCount {
+		t.Fatalf("Expected %d deliveries, actual %d", msgCount, len(deliveries))
+	}
+
+	ch2, _ := sc.client.Channel()
+	cmr2, _ := ch2.Consume("testQu", "tag2", false, false, false, false, emptyTable)
+	ch.Close()
+
+	deliveries := receiveDeliveries(cmr2, 100*time.Millisecond)
+	if len(deliveries) != msgCount {
+		t.Fatalf("Expected %d redeliveries, actual %d", msgCount, len(deliveries))
+	}
+	for i, delivery := range deliveries {
+		if string(delivery.Body) != strconv.Itoa(i) {
+			t.Fatalf("Expected body %d, actual %s", i, delivery.Body)
+		}
+		if !delivery.Redelivered {
+			t.Fatalf("Expected redelivered message %d", i)
+		}
+	}
+}
+
+func Test_BasicConsume_SingleActiveConsumer_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch2, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQu", false, false, false, false, amqp.Table{"x-single-active-consumer": true})
+	if _, err := ch.QueueDeclare("testQu", false, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected: x-single-active-consumer inequivalent error")
+	}
+	ch, _ = sc.client.Channel()
+
+	cmrA, _ := ch.Consume("testQu", "a", true, false, false, false, emptyTable)
+	cmrB, _ := ch2.Consume("testQu", "b", true, false, false, false, emptyTable)
+
+	publish := func(count int) {
+		for i := 0; i < count; i++ {
+			ch.Publish("", "testQu", false, false, amqp.Publishing{Body: []byte("test")})
+		}
+	}
+
+	publish(3)
+	if deliveries := receiveDeliveries(cmrA, 100*time.Millisecond); len(deliveries) != 3 {
+		t.Fatalf("Expected %d deliveries to active consumer, actual %d", 3, len(deliveries))
+	}
+	if deliveries := receiveDeliveries(cmrB, 10*time.Millisecond); len(deliveries) != 0 {
+		t.Fatalf("Expected no deliveries to inactive consumer, actual %d", len(deliveries))
+	}
+
+	if tag, err := sc.server.getVhost("/").GetQueue("testQu").ElectNextConsumer(); err != nil || tag != "b" {
+		t.Fatalf("Expected consumer b elected, actual %s, %v", tag, err)
+	}
+	publish(2)
+	if deliveries := receiveDeliveries(cmrB, 100*time.Millisecond); len(deliveries) != 2 {
+		t.Fatalf("Expected %d deliveries to elected consumer, actual %d", 2, len(deliveries))
+	}
 
-	if len(getServerChannel(sc, 1).consumers) != 0 {
-		t.Fatal("Expected empty channel consumers map")
+	ch2.Cancel("b", false)
+	publish(1)
+	if deliveries := receiveDeliveries(cmrA, 100*time.Millisecond); len(deliveries) != 1 {
+		t.Fatalf("Expected %d deliveries to promoted consumer, actual %d", 1, len(deliveries))
 	}
 }
 
-func Test_BasicCancel_Failed_Unknown_Tag(t *testing.T) {
-	sc, _ := getNewSC(getDefaultTestConfig())
+func Test_BasicConsume_ConsumerTimeout_Requeue(t *testing.T) {
+	checkInterval := ackTimeoutCheckInterval
+	ackTimeoutCheckInterval = 20 * time.Millisecond
+	defer func() {
+		ackTimeoutCheckInterval = checkInterval
+	}()
+
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Queue.ConsumerTimeout = 100
+	sc, _ := getNewSC(cfg)
 	defer sc.clean()
-	ch, _ := sc.client.Channel()
 
+	// x-consumer-timeout 0 disables server timeout for queue
+	chNoTimeout, _ := sc.client.Channel()
+	noTimeoutClose := chNoTimeout.NotifyClose(make(chan *amqp.Error, 1))
+	chNoTimeout.QueueDeclare("testQuNoTimeout", false, false, false, false, amqp.Table{"x-consumer-timeout": int32(0)})
+	chNoTimeout.Publish("", "testQuNoTimeout", false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte("test")})
+	cmrNoTimeout, _ := chNoTimeout.Consume("testQuNoTimeout", "tag", false, false, false, false, emptyTable)
+	if count := len(receiveDeliveries(cmrNoTimeout, 50*time.Millisecond)); count != 1 {
+		t.Fatalf("Expected %d delivery, actual %d", 1, count)
+	}
+
+	ch, _ := sc.client.Channel()
+	chClose := ch.NotifyClose(make(chan *amqp.Error, 1))
 	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	ch.Publish("", "testQu", false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte("test")})
+	cmr, _ := ch.Consume("testQu", "tag", false, false, false, false, emptyTable)
+	if count := len(receiveDeliveries(cmr, 50*time.Millisecond)); count != 1 {
+		t.Fatalf("Expected %d delivery, actual %d", 1, count)
+	}
 
-	_, err := ch.Consume("testQu", "tag", false, false, false, false, emptyTable)
-	if err != nil {
-		t.Fatal(err)
+	select {
+	case err := <-chClose:
+		if err == nil || err.Code != amqp.PreconditionFailed {
+			t.Fatalf("Expected precondition failed error, actual %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected channel closed on consumer timeout")
+	}
+	select {
+	case err := <-noTimeoutClose:
+		t.Fatalf("Unexpected channel close %v", err)
+	default:
 	}
 
-	if err = ch.Cancel("tag_unknown", false); err == nil {
-		t.Fatal("Expected NOT_FOUND error")
+	// timed out message is requeued and redelivered to the next consumer
+	ch, _ = sc.client.Channel()
+	msg, ok, err := ch.Get("testQu", true)
+	if err != nil || !ok {
+		t.Fatalf("Expected requeued message, error %v", err)
+	}
+	if !msg.Redelivered {
+		t.Fatal("Expected redelivered message")
 	}
 }
 
@@ -606,6 +1889,67 @@ func Test_BasicAckMultiple_Success(t *testing.T) {
 	}
 }
 
+func Test_BasicAck_OutOfOrder_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	chClose := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	queue, _ := ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+
+	msgCount := 10
+	for i := 0; i < msgCount; i++ {
+		ch.Publish("", queue.Name, false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte("test")})
+	}
+
+	cmr, err := ch.Consume("testQu", "tag", false, false, false, false, emptyTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := len(receiveDeliveries(cmr, 100*time.Millisecond)); count != msgCount {
+		t.Fatalf("Expected %d deliveries, actual %d", msgCount, count)
+	}
+
+	checkUnacked := func(expected []uint64) {
+		time.Sleep(50 * time.Millisecond)
+		serverCh := getServerChannel(sc, 1)
+		serverCh.ackLock.Lock()
+		defer serverCh.ackLock.Unlock()
+		if len(serverCh.ackStore) != len(expected) {
+			t.Fatalf("Expected %d unacked, actual %d", len(expected), len(serverCh.ackStore))
+		}
+		for _, dTag := range expected {
+			if _, ok := serverCh.ackStore[dTag]; !ok {
+				t.Fatalf("Expected delivery tag %d unacked", dTag)
+			}
+		}
+	}
+
+	// single acks of arbitrary tags leave gaps in unacked set
+	for _, dTag := range []uint64{7, 2, 9, 4} {
+		ch.Ack(dTag, false)
+	}
+	checkUnacked([]uint64{1, 3, 5, 6, 8, 10})
+
+	// multiple ack covers range up to and including tag, already acked ones are skipped
+	ch.Ack(7, true)
+	checkUnacked([]uint64{8, 10})
+
+	ch.Ack(10, false)
+	ch.Ack(8, true)
+	checkUnacked([]uint64{})
+
+	select {
+	case err := <-chClose:
+		t.Fatalf("Unexpected channel close %v", err)
+	default:
+	}
+
+	if length := sc.server.getVhost("/").GetQueue(queue.Name).Length(); length != 0 {
+		t.Fatalf("Expected %d queue length, actual %d", 0, length)
+	}
+}
+
 func Test_BasicNack_RequeueTrue_Success(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
@@ -959,6 +2303,67 @@ func Test_BasicReject_RequeueFalse_Success(t *testing.T) {
 	}
 }
 
+func Test_BasicConsume_QueuePaused(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	qu := sc.server.getVhost("/").GetQueue("testQu")
+	qu.Pause()
+
+	cmr, _ := ch.Consume("testQu", "tag", true, false, false, false, emptyTable)
+	ch.Publish("", "testQu", false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte("test")})
+	if count := len(receiveDeliveries(cmr, 50*time.Millisecond)); count != 0 {
+		t.Fatalf("Expected %d deliveries from paused queue, actual %d", 0, count)
+	}
+	if qu.Length() != 1 {
+		t.Fatalf("Expected %d message in paused queue, actual %d", 1, qu.Length())
+	}
+
+	if _, ok, _ := ch.Get("testQu", true); ok {
+		t.Fatal("Expected BasicEmpty from paused queue")
+	}
+
+	qu.Resume()
+	if count := len(receiveDeliveries(cmr, 50*time.Millisecond)); count != 1 {
+		t.Fatalf("Expected %d delivery after resume, actual %d", 1, count)
+	}
+}
+
+func Test_BasicPublish_Failed_ExchangeDisabled(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	chClose := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	ch.ExchangeDeclare("testEx", "direct", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	ch.QueueBind("testQu", "key", "testEx", false, emptyTable)
+	sc.server.getVhost("/").GetExchange("testEx").SetDisabled(true)
+
+	ch.Publish("testEx", "key", false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte("test")})
+	select {
+	case err := <-chClose:
+		if err == nil || err.Code != amqp.PreconditionFailed {
+			t.Fatalf("Expected precondition failed error, actual %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected channel closed on publish into disabled exchange")
+	}
+	if length := sc.server.getVhost("/").GetQueue("testQu").Length(); length != 0 {
+		t.Fatalf("Expected %d messages, actual %d", 0, length)
+	}
+
+	sc.server.getVhost("/").GetExchange("testEx").SetDisabled(false)
+	ch, _ = sc.client.Channel()
+	ch.Publish("testEx", "key", false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte("test")})
+	time.Sleep(50 * time.Millisecond)
+	if length := sc.server.getVhost("/").GetQueue("testQu").Length(); length != 1 {
+		t.Fatalf("Expected %d message, actual %d", 1, length)
+	}
+}
+
 func Test_BasicGet_Success(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
@@ -1055,3 +2460,353 @@ func Test_BasicGet_Failed_QueueNotFound(t *testing.T) {
 		t.Fatal("Expected NOT_FOUND error")
 	}
 }
+
+func Test_BasicPublish_Spooled_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Db.SpoolThreshold = 1024
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQu1", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu2", false, false, false, false, emptyTable)
+	ch.QueueBind("testQu1", "", "amq.fanout", false, emptyTable)
+	ch.QueueBind("testQu2", "", "amq.fanout", false, emptyTable)
+
+	body := bytes.Repeat([]byte("0123456789"), 100000)
+	ch.Publish("amq.fanout", "", false, false, amqp.Publishing{Body: body})
+	ch.Publish("amq.fanout", "", false, false, amqp.Publishing{Body: []byte("small")})
+	time.Sleep(100 * time.Millisecond)
+
+	spoolFiles := func() int {
+		files, _ := ioutil.ReadDir(cfg.srvConfig.Db.DefaultPath + "/spool")
+		return len(files)
+	}
+	if spoolFiles() != 2 {
+		t.Fatalf("Expected spool file for each queue, actual %d", spoolFiles())
+	}
+
+	msg, ok, err := ch.Get("testQu1", true)
+	if err != nil || !ok || !bytes.Equal(msg.Body, body) {
+		t.Fatal("Expected spooled message body delivered", err)
+	}
+	if spoolFiles() != 1 {
+		t.Fatal("Expected spool file removed after delivery")
+	}
+
+	msg, ok, err = ch.Get("testQu2", false)
+	if err != nil || !ok || !bytes.Equal(msg.Body, body) {
+		t.Fatal("Expected spooled message body delivered into each queue", err)
+	}
+	msg.Ack(false)
+
+	msg, ok, err = ch.Get("testQu2", true)
+	if err != nil || !ok || string(msg.Body) != "small" {
+		t.Fatal("Expected small message not spooled", err)
+	}
+
+	if spoolFiles() != 0 {
+		t.Fatalf("Expected spool files removed after ack, actual %d", spoolFiles())
+	}
+}
+
+func Test_BasicConsume_RoundRobin_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+
+	cmrCount := 3
+	msgCount := 300
+	counts := make([]int64, cmrCount)
+	received := make(chan bool, msgCount)
+	for i := 0; i < cmrCount; i++ {
+		cmrCh, _ := sc.client.Channel()
+		cmrCh.Qos(5, 0, false)
+		deliveries, err := cmrCh.Consume("testQu", "", false, false, false, false, emptyTable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(idx int) {
+			for dlv := range deliveries {
+				atomic.AddInt64(&counts[idx], 1)
+				time.Sleep(time.Millisecond)
+				dlv.Ack(false)
+				received <- true
+			}
+		}(i)
+	}
+
+	for i := 0; i < msgCount; i++ {
+		ch.Publish("", "testQu", false, false, amqp.Publishing{Body: []byte("test" + strconv.Itoa(i))})
+	}
+
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < msgCount; i++ {
+		select {
+		case <-received:
+		case <-timeout:
+			t.Fatalf("Expected %d messages, received %d", msgCount, i)
+		}
+	}
+
+	// each consumer should get about msgCount/cmrCount messages
+	for idx := range counts {
+		count := atomic.LoadInt64(&counts[idx])
+		if count < int64(msgCount/cmrCount/2) {
+			t.Fatalf("Expected even distribution, consumer %d received %d of %d messages", idx, count, msgCount)
+		}
+	}
+}
+
+func Test_BasicConsume_DirectReplyTo_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	chEx, _ := sc.clientEx.Channel()
+
+	qu, _ := ch.QueueDeclare("rpcQu", false, false, false, false, emptyTable)
+
+	replies, err := ch.Consume("amq.rabbitmq.reply-to", "", true, false, false, false, emptyTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests, err := chEx.Consume(qu.Name, "", true, false, false, false, emptyTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch.Publish("", qu.Name, false, false, amqp.Publishing{ReplyTo: "amq.rabbitmq.reply-to", Body: []byte("request")})
+
+	var request amqp.Delivery
+	select {
+	case request = <-requests:
+	case <-time.After(time.Second):
+		t.Fatal("Expected request message")
+	}
+	if request.ReplyTo == "amq.rabbitmq.reply-to" || !strings.HasPrefix(request.ReplyTo, "amq.rabbitmq.reply-to.") {
+		t.Fatalf("Expected generated reply address, actual %s", request.ReplyTo)
+	}
+
+	chEx.Publish("", request.ReplyTo, true, false, amqp.Publishing{Body: []byte("reply")})
+
+	select {
+	case reply := <-replies:
+		if string(reply.Body) != "reply" || reply.RoutingKey != request.ReplyTo {
+			t.Fatalf("Unexpected reply %s with routing key %s", reply.Body, reply.RoutingKey)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected reply message")
+	}
+
+	if len(sc.server.getVhost("/").GetQueues()) != 1 {
+		t.Fatal("Expected reply is delivered without real queue")
+	}
+}
+
+func Test_BasicConsume_DirectReplyTo_Cancel_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if _, err := ch.Consume("amq.rabbitmq.reply-to", "replyTag", true, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+	if len(sc.server.getVhost("/").replyChannels) != 1 {
+		t.Fatal("Expected registered reply channel")
+	}
+
+	if err := ch.Cancel("replyTag", false); err != nil {
+		t.Fatal(err)
+	}
+	if len(sc.server.getVhost("/").replyChannels) != 0 {
+		t.Fatal("Expected reply channel is unregistered after cancel")
+	}
+}
+
+func Test_BasicConsume_DirectReplyTo_Failed_Ack(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if _, err := ch.Consume("amq.rabbitmq.reply-to", "", false, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected precondition failed error for reply consumer with ack")
+	}
+}
+
+func Test_BasicPublish_DirectReplyTo_Failed_NoConsumer(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	c := make(chan *amqp.Error, 1)
+	ch.NotifyClose(c)
+
+	qu, _ := ch.QueueDeclare("rpcQu", false, false, false, false, emptyTable)
+
+	ch.Publish("", qu.Name, false, false, amqp.Publishing{ReplyTo: "amq.rabbitmq.reply-to", Body: []byte("request")})
+
+	select {
+	case err := <-c:
+		if err == nil || err.Code != amqp.PreconditionFailed {
+			t.Fatalf("Expected precondition failed error, actual %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected precondition failed error")
+	}
+}
+
+func Test_BasicPublish_DirectReplyTo_UnknownAddress_Returned(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+
+	ch.Publish("", "amq.rabbitmq.reply-to.unknown", true, false, amqp.Publishing{Body: []byte("reply")})
+
+	select {
+	case ret := <-returns:
+		if ret.ReplyCode != amqp.NoRoute {
+			t.Fatalf("Expected NO_ROUTE, actual %d", ret.ReplyCode)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected returned reply")
+	}
+}
+
+func Test_BasicPublish_MessageTTL_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQuTTL", false, false, false, false, amqp.Table{"x-message-ttl": int32(100)})
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+
+	// zero expiration expires immediately, queue TTL is less than message one
+	ch.Publish("", "testQuTTL", false, false, amqp.Publishing{Body: []byte("zero"), Expiration: "0"})
+	ch.Publish("", "testQuTTL", false, false, amqp.Publishing{Body: []byte("no expiration")})
+	ch.Publish("", "testQuTTL", false, false, amqp.Publishing{Body: []byte("long expiration"), Expiration: "10000"})
+
+	// without queue TTL only message expiration is applied
+	ch.Publish("", "testQu", false, false, amqp.Publishing{Body: []byte("short expiration"), Expiration: "50"})
+	ch.Publish("", "testQu", false, false, amqp.Publishing{Body: []byte("no expiration")})
+	time.Sleep(20 * time.Millisecond)
+
+	if msg, ok, _ := ch.Get("testQuTTL", true); !ok || string(msg.Body) != "no expiration" {
+		t.Fatal("Expected message with zero expiration dropped")
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	if _, ok, _ := ch.Get("testQuTTL", true); ok {
+		t.Fatal("Expected message expired by queue TTL")
+	}
+	if msg, ok, _ := ch.Get("testQu", true); !ok || string(msg.Body) != "no expiration" {
+		t.Fatal("Expected only message with expiration dropped")
+	}
+	if length := sc.server.getVhost("/").GetQueue("testQuTTL").Length(); length != 0 {
+		t.Fatalf("Expected expired messages removed from queue, actual length %d", length)
+	}
+}
+
+func Test_BasicReject_DeadLetter_Twice_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	// rejected messages are retried after delay through queue with TTL
+	ch.QueueDeclare("work", false, false, false, false, amqp.Table{"x-dead-letter-exchange": "", "x-dead-letter-routing-key": "retry"})
+	ch.QueueDeclare("retry", false, false, false, false, amqp.Table{"x-message-ttl": int32(20), "x-dead-letter-exchange": "", "x-dead-letter-routing-key": "work"})
+
+	ch.Publish("", "work", false, false, amqp.Publishing{
+		Body:       []byte("test"),
+		Priority:   5,
+		Expiration: "60000",
+		Headers:    amqp.Table{"app": "test"},
+	})
+
+	for i := 0; i < 2; i++ {
+		msg, ok, _ := ch.Get("work", false)
+		if !ok {
+			t.Fatalf("Expected message in work queue on attempt %d", i)
+		}
+		msg.Reject(false)
+		time.Sleep(50 * time.Millisecond)
+
+		if _, ok, _ := ch.Get("retry", true); ok {
+			t.Fatalf("Expected message expired in retry queue on attempt %d", i)
+		}
+	}
+
+	msg, ok, _ := ch.Get("work", true)
+	if !ok {
+		t.Fatal("Expected dead-lettered message in work queue")
+	}
+	if string(msg.Body) != "test" || msg.Priority != 5 || msg.Expiration != "" || msg.Headers["app"] != "test" {
+		t.Fatalf("Expected properties kept and expiration removed, actual %+v", msg)
+	}
+
+	deaths, _ := msg.Headers["x-death"].([]interface{})
+	if len(deaths) != 2 {
+		t.Fatalf("Expected %d x-death entries, actual %v", 2, msg.Headers["x-death"])
+	}
+	expected := []amqp.Table{
+		{"queue": "retry", "reason": "expired", "count": int64(2)},
+		{"queue": "work", "reason": "rejected", "count": int64(2), "original-expiration": "60000"},
+	}
+	for i, entry := range expected {
+		death, _ := deaths[i].(amqp.Table)
+		for key, value := range entry {
+			if death[key] != value {
+				t.Fatalf("Expected x-death[%d] %s = %v, actual %v", i, key, value, death[key])
+			}
+		}
+	}
+
+	if msg.Headers["x-first-death-queue"] != "work" || msg.Headers["x-first-death-reason"] != "rejected" {
+		t.Fatalf("Unexpected first death %v/%v", msg.Headers["x-first-death-queue"], msg.Headers["x-first-death-reason"])
+	}
+	if msg.Headers["x-last-death-queue"] != "retry" || msg.Headers["x-last-death-reason"] != "expired" {
+		t.Fatalf("Unexpected last death %v/%v", msg.Headers["x-last-death-queue"], msg.Headers["x-last-death-reason"])
+	}
+}
+
+func Test_BasicPublish_DeadLetter_ExpiredCycle_Dropped(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("first", false, false, false, false, amqp.Table{"x-message-ttl": int32(10), "x-dead-letter-exchange": "", "x-dead-letter-routing-key": "second"})
+	ch.QueueDeclare("second", false, false, false, false, amqp.Table{"x-message-ttl": int32(10), "x-dead-letter-exchange": "", "x-dead-letter-routing-key": "first"})
+
+	ch.Publish("", "first", false, false, amqp.Publishing{Body: []byte("test")})
+	time.Sleep(30 * time.Millisecond)
+	ch.Get("first", true)
+	if length := sc.server.getVhost("/").GetQueue("second").Length(); length != 1 {
+		t.Fatalf("Expected expired message dead-lettered, actual length %d", length)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	ch.Get("second", true)
+	if length := sc.server.getVhost("/").GetQueue("first").Length(); length != 0 {
+		t.Fatalf("Expected message cycled by expiration dropped, actual length %d", length)
+	}
+}
+
+func Test_BasicPublish_Failed_InvalidExpiration(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	c := make(chan *amqp.Error, 1)
+	ch.NotifyClose(c)
+
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	ch.Publish("", "testQu", false, false, amqp.Publishing{Body: []byte("test"), Expiration: "-1"})
+
+	select {
+	case err := <-c:
+		if err == nil || err.Code != amqp.PreconditionFailed {
+			t.Fatalf("Expected precondition failed error, actual %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected invalid expiration error")
+	}
+}
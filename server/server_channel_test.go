@@ -111,3 +111,72 @@ func Test_ChannelFlow_Failed_FlowOkSend(t *testing.T) {
 		t.Fatal("Expected NOT_IMPLEMENTED error")
 	}
 }
+
+func Test_ChannelError_ConnectionAlive_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	connClose := sc.client.NotifyClose(make(chan *amqp2.Error, 1))
+
+	ch, _ := sc.client.Channel()
+	chOther, _ := sc.client.Channel()
+	chOther.QueueDeclare("testQu", false, false, false, false, emptyTable)
+
+	chClose := ch.NotifyClose(make(chan *amqp2.Error, 1))
+	if _, err := ch.QueueDeclarePassive("notExistingQu", false, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected queue not found error")
+	}
+
+	select {
+	case err := <-chClose:
+		if err == nil || err.Code != amqp2.NotFound {
+			t.Fatalf("Expected channel closed with not found error, actual %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected channel close")
+	}
+
+	select {
+	case err := <-connClose:
+		t.Fatalf("Unexpected connection close %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := chOther.QueueDeclarePassive("testQu", false, false, false, false, emptyTable); err != nil {
+		t.Fatal("Expected other channel alive", err)
+	}
+
+	if _, err := sc.client.Channel(); err != nil {
+		t.Fatal("Expected new channel opened", err)
+	}
+}
+
+func Test_ChannelError_UnackedRequeued_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	ch, _ := sc.client.Channel()
+	chOther, _ := sc.client.Channel()
+	chOther.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	chOther.Publish("", "testQu", false, false, amqp2.Publishing{Body: []byte("test")})
+	time.Sleep(50 * time.Millisecond)
+
+	if _, ok, _ := ch.Get("testQu", false); !ok {
+		t.Fatal("Expected message")
+	}
+
+	ch.QueueDeclarePassive("notExistingQu", false, false, false, false, emptyTable)
+	time.Sleep(50 * time.Millisecond)
+
+	channel := getServerChannel(sc, 1)
+	if channel.status != channelClosed {
+		t.Fatal("Expected channel closed after close-ok")
+	}
+
+	msg, ok, err := chOther.Get("testQu", false)
+	if err != nil || !ok {
+		t.Fatal("Expected unacked message requeued after channel error", err)
+	}
+	if string(msg.Body) != "test" {
+		t.Fatalf("Expected requeued message body 'test', actual %s", msg.Body)
+	}
+}
@@ -1,10 +1,13 @@
 package server
 
 import (
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/streadway/amqp"
+	amqp2 "github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/queue"
 )
 
 func Test_Confirm_Success(t *testing.T) {
@@ -105,6 +108,59 @@ func Test_ConfirmReceive_Acks_NoRoute_Success(t *testing.T) {
 	}
 }
 
+func Test_ConfirmReceive_Mandatory_Unroutable_ReturnedThenAcked(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.Confirm(false)
+
+	msgCount := 100
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, msgCount*2))
+	returns := ch.NotifyReturn(make(chan amqp.Return, msgCount))
+
+	// deliveries of the same channel are sent concurrently with returns and confirms
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	deliveries, _ := ch.Consume("testQu", "", true, false, false, false, emptyTable)
+
+	body := make([]byte, 3*1024*1024)
+	for i := 0; i < msgCount; i++ {
+		ch.Publish("", "testQu", true, false, amqp.Publishing{Body: body})
+		ch.Publish("", "bad-route", true, false, amqp.Publishing{Body: []byte("unroutable")})
+	}
+
+	for i := 1; i <= msgCount*2; i++ {
+		select {
+		case confirm := <-confirms:
+			if !confirm.Ack || confirm.DeliveryTag != uint64(i) {
+				t.Fatalf("Expected ack of %d, actual %+v", i, confirm)
+			}
+			if i%2 == 0 {
+				select {
+				case ret := <-returns:
+					if string(ret.Body) != "unroutable" {
+						t.Fatalf("Unexpected return %s", ret.Body)
+					}
+				default:
+					t.Fatalf("Expected basic.return before ack of %d", i)
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout on waiting confirm %d", i)
+		}
+	}
+
+	for i := 0; i < msgCount; i++ {
+		select {
+		case delivery := <-deliveries:
+			if len(delivery.Body) != len(body) {
+				t.Fatalf("Expected delivery of %d bytes, actual %d", len(body), len(delivery.Body))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout on waiting delivery %d", i)
+		}
+	}
+}
+
 func Test_ConfirmReceive_Acks_Persistent_Success(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
@@ -145,3 +201,336 @@ func Test_ConfirmReceive_Acks_Persistent_Success(t *testing.T) {
 		t.Fatalf("Expected %d confirms, actual %d", msgCount, confirmsCount)
 	}
 }
+
+func Test_ConfirmReceive_Fanout_Success(t *testing.T) {
+	workers := fanoutWorkers
+	fanoutWorkers = 4
+	defer func() {
+		fanoutWorkers = workers
+	}()
+
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.Confirm(false)
+
+	msgCount := 20
+	acks := make(chan uint64, msgCount*2)
+	nacks := make(chan uint64, msgCount*2)
+	ch.NotifyConfirm(acks, nacks)
+
+	// wide enough to be pushed by all workers, durable queues are confirmed by storage
+	quCount := fanoutMinQueuesPerWorker * 4
+	for i := 0; i < quCount; i++ {
+		name := "testQu" + strconv.Itoa(i)
+		ch.QueueDeclare(name, i%2 == 0, false, false, false, emptyTable)
+		ch.QueueBind(name, "", "amq.fanout", false, emptyTable)
+	}
+
+	for i := 0; i < msgCount; i++ {
+		ch.Publish("amq.fanout", "", false, false, amqp.Publishing{Body: []byte(strconv.Itoa(i)), DeliveryMode: amqp.Persistent})
+	}
+
+	confirmed := make(map[uint64]bool)
+	timeout := time.After(time.Second)
+	for len(confirmed) < msgCount {
+		select {
+		case tag := <-acks:
+			if confirmed[tag] {
+				t.Fatalf("Expected delivery tag %d confirmed once", tag)
+			}
+			confirmed[tag] = true
+		case tag := <-nacks:
+			t.Fatalf("Unexpected nack of delivery tag %d", tag)
+		case <-timeout:
+			t.Fatalf("Expected %d confirms, actual %d", msgCount, len(confirmed))
+		}
+	}
+	select {
+	case tag := <-acks:
+		t.Fatalf("Unexpected confirm of delivery tag %d", tag)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i := 0; i < quCount; i++ {
+		name := "testQu" + strconv.Itoa(i)
+		for j := 0; j < msgCount; j++ {
+			msg, ok, err := ch.Get(name, true)
+			if err != nil || !ok {
+				t.Fatalf("Expected message %d in queue %s", j, name)
+			}
+			if string(msg.Body) != strconv.Itoa(j) {
+				t.Fatalf("Expected message %d in queue %s, actual %s", j, name, msg.Body)
+			}
+		}
+	}
+}
+
+func Test_ConfirmReceive_RoutingCardinality_Success(t *testing.T) {
+	cases := []struct {
+		name    string
+		durable []bool
+	}{
+		{"zero queues", nil},
+		{"one transient queue", []bool{false}},
+		{"one durable queue", []bool{true}},
+		{"many durable queues", []bool{true, true, true}},
+		{"mixed queues", []bool{true, false, true, false}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sc, _ := getNewSC(getDefaultTestConfig())
+			defer sc.clean()
+			ch, _ := sc.client.Channel()
+			ch.Confirm(false)
+
+			msgCount := 10
+			acks := make(chan uint64, msgCount*2)
+			nacks := make(chan uint64, msgCount*2)
+			ch.NotifyConfirm(acks, nacks)
+
+			for i, durable := range tc.durable {
+				name := "testQu" + strconv.Itoa(i)
+				ch.QueueDeclare(name, durable, false, false, false, emptyTable)
+				ch.QueueBind(name, "", "amq.fanout", false, emptyTable)
+			}
+
+			for i := 0; i < msgCount; i++ {
+				ch.Publish("amq.fanout", "", false, false, amqp.Publishing{Body: []byte("test"), DeliveryMode: amqp.Persistent})
+			}
+
+			confirmed := make(map[uint64]bool)
+			timeout := time.After(time.Second)
+			for len(confirmed) < msgCount {
+				select {
+				case tag := <-acks:
+					if confirmed[tag] {
+						t.Fatalf("Expected delivery tag %d confirmed once", tag)
+					}
+					confirmed[tag] = true
+				case tag := <-nacks:
+					t.Fatalf("Unexpected nack of delivery tag %d", tag)
+				case <-timeout:
+					t.Fatalf("Expected %d confirms, actual %d", msgCount, len(confirmed))
+				}
+			}
+			select {
+			case tag := <-acks:
+				t.Fatalf("Unexpected confirm of delivery tag %d", tag)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func Test_PushToQueues_DeletedQueue_ConfirmedAtOnce(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.Confirm(false)
+	ch.QueueDeclare("testQuDurable", true, false, false, false, emptyTable)
+	ch.QueueDeclare("testQuTransient", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testQuDeleted", true, false, false, false, emptyTable)
+
+	// queue is deleted after message is routed into it
+	vhost := sc.server.getVhost("/")
+	deleted := vhost.GetQueue("testQuDeleted")
+	ch.QueueDelete("testQuDeleted", false, false, false)
+	queues := []*queue.Queue{vhost.GetQueue("testQuDurable"), vhost.GetQueue("testQuTransient"), deleted}
+
+	persistentMode := byte(amqp.Persistent)
+	message := &amqp2.Message{
+		Header: &amqp2.ContentHeader{PropertyList: &amqp2.BasicPropertyList{DeliveryMode: &persistentMode}},
+		ConfirmMeta: &amqp2.ConfirmMeta{
+			ExpectedConfirms: int32(len(queues)),
+		},
+	}
+	confirms, err := sc.server.pushToQueues(message, queues)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// durable queue confirms message after storage, transient and deleted ones at once
+	if confirms != 2 {
+		t.Fatalf("Expected %d confirms at once, actual %d", 2, confirms)
+	}
+}
+
+func Test_ConfirmBatcher_Coalesce(t *testing.T) {
+	type ack struct {
+		tag      uint64
+		multiple bool
+	}
+	batcher := newConfirmBatcher()
+	steps := []struct {
+		tags     []uint64
+		expected []ack
+	}{
+		{[]uint64{1}, []ack{{1, false}}},
+		{[]uint64{4, 2, 3}, []ack{{4, true}}},
+		// gap at 5, tags above it acked one by one
+		{[]uint64{8, 6}, []ack{{6, false}, {8, false}}},
+		// gap is filled, prefix is moved over already acked tags
+		{[]uint64{7, 5}, []ack{{8, true}}},
+		{[]uint64{9}, []ack{{9, false}}},
+		// already acked tags are not acked again
+		{[]uint64{9, 3}, []ack{}},
+	}
+
+	for i, step := range steps {
+		acks := batcher.add(step.tags, nil)
+		if len(acks) != len(step.expected) {
+			t.Fatalf("Step %d: expected %d acks, actual %d", i, len(step.expected), len(acks))
+		}
+		for j, expected := range step.expected {
+			ack, ok := acks[j].(*amqp2.BasicAck)
+			if !ok || ack.DeliveryTag != expected.tag || ack.Multiple != expected.multiple {
+				t.Fatalf("Step %d: expected ack %+v, actual %+v", i, expected, acks[j])
+			}
+		}
+	}
+}
+
+func Test_ConfirmBatcher_Nack(t *testing.T) {
+	type confirm struct {
+		tag      uint64
+		multiple bool
+		nack     bool
+	}
+	batcher := newConfirmBatcher()
+	steps := []struct {
+		tags     []uint64
+		nacks    []uint64
+		expected []confirm
+	}{
+		// nacked tag splits contiguous acks
+		{[]uint64{1, 2, 4, 5}, []uint64{3}, []confirm{{2, true, false}, {3, false, true}, {5, true, false}}},
+		// gap at 6, tags above it confirmed one by one
+		{[]uint64{8}, []uint64{7}, []confirm{{7, false, true}, {8, false, false}}},
+		// gap is filled, multiple ack does not cover already nacked tag
+		{[]uint64{6, 9}, nil, []confirm{{6, false, false}, {9, true, false}}},
+		{nil, []uint64{10}, []confirm{{10, false, true}}},
+		// already confirmed tags are not confirmed again
+		{[]uint64{10}, []uint64{9}, []confirm{}},
+	}
+
+	for i, step := range steps {
+		frames := batcher.add(step.tags, step.nacks)
+		if len(frames) != len(step.expected) {
+			t.Fatalf("Step %d: expected %d frames, actual %d", i, len(step.expected), len(frames))
+		}
+		for j, expected := range step.expected {
+			var actual confirm
+			switch frame := frames[j].(type) {
+			case *amqp2.BasicAck:
+				actual = confirm{frame.DeliveryTag, frame.Multiple, false}
+			case *amqp2.BasicNack:
+				actual = confirm{frame.DeliveryTag, frame.Multiple, true}
+			}
+			if actual != expected {
+				t.Fatalf("Step %d: expected %+v, actual %+v", i, expected, actual)
+			}
+		}
+	}
+}
+
+func Test_Confirm_Nack_ExchangeDisabled(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.trackMetrics = true
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.Confirm(false)
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 3))
+	ch.ExchangeDeclare("testEx", "direct", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	ch.QueueBind("testQu", "key", "testEx", false, emptyTable)
+	sc.server.getVhost("/").GetExchange("testEx").SetDisabled(true)
+
+	ch.Publish("", "testQu", false, false, amqp.Publishing{Body: []byte("test")})
+	ch.Publish("testEx", "key", false, false, amqp.Publishing{Body: []byte("test")})
+	ch.Publish("", "testQu", false, false, amqp.Publishing{Body: []byte("test")})
+
+	for i := 1; i <= 3; i++ {
+		select {
+		case confirm := <-confirms:
+			if confirm.DeliveryTag != uint64(i) || confirm.Ack != (i != 2) {
+				t.Fatalf("Unexpected confirm %+v", confirm)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout on waiting confirm %d", i)
+		}
+	}
+
+	// channel stays open after rejected publish
+	if _, err := ch.QueueInspect("testQu"); err != nil {
+		t.Fatal("Expected channel open after nack", err)
+	}
+	if length := sc.server.getVhost("/").GetQueue("testQu").Length(); length != 2 {
+		t.Fatalf("Expected %d messages, actual %d", 2, length)
+	}
+	if count := sc.server.GetMetrics().PublishRejectedBy[publishRejectExchangeDisabled].Counter.Count(); count != 1 {
+		t.Fatalf("Expected %d rejected publish, actual %d", 1, count)
+	}
+}
+
+func Test_ConfirmReceive_Coalesced_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.Confirm(false)
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, confirmFlushSize*2))
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+
+	// enough messages to flush confirms by size before timer
+	msgCount := confirmFlushSize + 10
+	for i := 0; i < msgCount; i++ {
+		ch.Publish("", "testQu", false, false, amqp.Publishing{Body: []byte("test")})
+	}
+
+	for i := 1; i <= msgCount; i++ {
+		select {
+		case confirm := <-confirms:
+			if !confirm.Ack || confirm.DeliveryTag != uint64(i) {
+				t.Fatalf("Expected ack of %d, actual %+v", i, confirm)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout on waiting confirm %d", i)
+		}
+	}
+}
+
+// BenchmarkChannel_PublishFanout measures publishing of single message into many queues bound to fanout exchange
+func BenchmarkChannel_PublishFanout(b *testing.B) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	sc.client.Channel()
+	vhost := sc.server.getVhost("/")
+	channel := getServerChannel(sc, 1)
+
+	for i := 0; i < 256; i++ {
+		qu := vhost.NewQueue("testQu"+strconv.Itoa(i), 0, false, false, false, 0)
+		qu.Start()
+		vhost.AppendQueue(qu)
+		vhost.BindQueue("amq.fanout", qu.GetName(), "", &amqp2.Table{})
+	}
+
+	workers := fanoutWorkers
+	defer func() {
+		fanoutWorkers = workers
+	}()
+	for _, count := range []int{1, workers} {
+		fanoutWorkers = count
+		b.Run("workers-"+strconv.Itoa(count), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				message := amqp2.NewMessage(&amqp2.BasicPublish{Exchange: "amq.fanout"})
+				message.Header = &amqp2.ContentHeader{PropertyList: &amqp2.BasicPropertyList{}}
+				channel.currentMessage = message
+				if err := channel.publishMessage(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
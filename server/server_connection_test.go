@@ -1,8 +1,29 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
 	"testing"
+	"time"
 
+	amqpclient "github.com/streadway/amqp"
+	"github.com/valinurovam/garagemq/amqp"
 	"github.com/valinurovam/garagemq/config"
 )
 
@@ -53,3 +74,864 @@ func Test_Connection_Failed_WhenWrongAuth_UnknownUser(t *testing.T) {
 		t.Fatal("Expected auth error")
 	}
 }
+
+func Test_Connection_Failed_WhenFrameMaxTooSmall(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.clientConfig.FrameSize = amqp.FrameMinSize / 2
+	sc, err := getNewSC(cfg)
+	defer sc.clean()
+	if err == nil {
+		t.Fatal("Expected frame_max negotiation error")
+	}
+}
+
+func Test_Connection_FrameMaxNegotiated(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.clientConfig.FrameSize = amqp.FrameMinSize * 2
+	sc, err := getNewSC(cfg)
+	defer sc.clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sc.client.Config.FrameSize != amqp.FrameMinSize*2 {
+		t.Fatalf("Expected frame_max %d, actual %d", amqp.FrameMinSize*2, sc.client.Config.FrameSize)
+	}
+}
+
+func Test_Connection_TuneParams(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.clientConfig.FrameSize = amqp.FrameMinSize * 2
+	cfg.clientConfig.ChannelMax = 100
+	cfg.clientConfig.Heartbeat = 5 * time.Second
+	sc, err := getNewSC(cfg)
+	defer sc.clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := TuneParams{ChannelMax: 100, FrameMax: amqp.FrameMinSize * 2, Heartbeat: 5}
+	for _, conn := range sc.server.GetConnections() {
+		if params := conn.GetTuneParams(); params == nil || *params != expected {
+			t.Fatalf("Expected tune params %+v, actual %+v", expected, params)
+		}
+	}
+}
+
+func Test_NegotiateFrameMax(t *testing.T) {
+	testCases := []struct {
+		serverMax uint32
+		clientMax uint32
+		expected  uint32
+		failed    bool
+	}{
+		{65536, 0, 65536, false},
+		{65536, 4096, 4096, false},
+		{65536, 65536, 65536, false},
+		{65536, 131072, 0, true},
+		{65536, 1024, 0, true},
+		{0, 0, 0, false},
+		{0, 1 << 20, 1 << 20, false},
+		{0, 4095, 0, true},
+	}
+
+	for _, tc := range testCases {
+		frameMax, err := negotiateFrameMax(tc.serverMax, tc.clientMax)
+		if tc.failed {
+			if err == nil {
+				t.Fatalf("Expected error for server %d and client %d", tc.serverMax, tc.clientMax)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frameMax != tc.expected {
+			t.Fatalf("Expected frame_max %d, actual %d", tc.expected, frameMax)
+		}
+	}
+}
+
+func Test_NormalizeFrameMax(t *testing.T) {
+	if normalizeFrameMax(0) != 0 {
+		t.Fatal("Expected zero frame_max without limit")
+	}
+
+	if normalizeFrameMax(1024) != amqp.FrameMinSize {
+		t.Fatalf("Expected frame_max raised to %d", amqp.FrameMinSize)
+	}
+
+	if normalizeFrameMax(131072) != 131072 {
+		t.Fatal("Expected frame_max unchanged")
+	}
+}
+
+type rawClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// properties are client properties sent in connection.start-ok by open
+	properties amqp.Table
+}
+
+func newRawClient(sc *ServerClient) (*rawClient, error) {
+	toServer, _, fromClient, _, err := networkSim()
+	if err != nil {
+		return nil, err
+	}
+	sc.server.acceptConnection(fromClient)
+
+	if _, err = toServer.Write([]byte{'A', 'M', 'Q', 'P', 0, 0, 9, 1}); err != nil {
+		return nil, err
+	}
+
+	return &rawClient{conn: toServer, reader: bufio.NewReader(toServer)}, nil
+}
+
+func (client *rawClient) send(method amqp.Method) error {
+	return client.sendOn(0, method)
+}
+
+func (client *rawClient) sendOn(channelID uint16, method amqp.Method) error {
+	buffer := bytes.NewBuffer([]byte{})
+	if err := amqp.WriteMethod(buffer, method, proto); err != nil {
+		return err
+	}
+
+	return amqp.WriteFrame(client.conn, &amqp.Frame{Type: byte(amqp.FrameMethod), ChannelID: channelID, Payload: buffer.Bytes()})
+}
+
+func (client *rawClient) read(timeout time.Duration) (amqp.Method, error) {
+	client.conn.SetReadDeadline(time.Now().Add(timeout))
+	frame, err := amqp.ReadFrame(client.reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return amqp.ReadMethod(bytes.NewReader(frame.Payload), proto)
+}
+
+// loginFailed passes connection.start with wrong credentials and expects connection.close from server
+func (client *rawClient) loginFailed(t *testing.T) {
+	if _, err := client.read(time.Second); err != nil {
+		t.Fatal("Expected connection.start", err)
+	}
+
+	client.send(&amqp.ConnectionStartOk{
+		ClientProperties: &amqp.Table{},
+		Mechanism:        "PLAIN",
+		Response:         []byte("\x00guest\x00wrong"),
+		Locale:           "en_US",
+	})
+
+	method, err := client.read(time.Second)
+	if err != nil {
+		t.Fatal("Expected connection.close", err)
+	}
+	if closeMethod, ok := method.(*amqp.ConnectionClose); !ok || closeMethod.ReplyCode != amqp.AccessRefused {
+		t.Fatalf("Expected connection.close with ACCESS_REFUSED, actual %s", method.Name())
+	}
+}
+
+// open passes handshake as guest user with given heartbeat interval
+func (client *rawClient) open(t *testing.T, heartbeat uint16) {
+	if _, err := client.read(time.Second); err != nil {
+		t.Fatal("Expected connection.start", err)
+	}
+	properties := amqp.Table{}
+	for name, value := range client.properties {
+		properties[name] = value
+	}
+	client.send(&amqp.ConnectionStartOk{
+		ClientProperties: &properties,
+		Mechanism:        "PLAIN",
+		Response:         []byte("\x00guest\x00guest"),
+		Locale:           "en_US",
+	})
+	if _, err := client.read(time.Second); err != nil {
+		t.Fatal("Expected connection.tune", err)
+	}
+	client.send(&amqp.ConnectionTuneOk{Heartbeat: heartbeat})
+	client.send(&amqp.ConnectionOpen{VirtualHost: "/"})
+	if _, err := client.read(time.Second); err != nil {
+		t.Fatal("Expected connection.open-ok", err)
+	}
+}
+
+func Test_Connection_UpdateSecret(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	client, err := newRawClient(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.open(t, 0)
+
+	client.send(&amqp.ConnectionUpdateSecret{NewSecret: []byte("guest"), Reason: "token refresh"})
+	method, err := client.read(time.Second)
+	if err != nil {
+		t.Fatal("Expected connection.update-secret-ok", err)
+	}
+	if _, ok := method.(*amqp.ConnectionUpdateSecretOk); !ok {
+		t.Fatalf("Expected connection.update-secret-ok, actual %s", method.Name())
+	}
+
+	client.send(&amqp.ConnectionUpdateSecret{NewSecret: []byte("wrong"), Reason: "token refresh"})
+	method, err = client.read(time.Second)
+	if err != nil {
+		t.Fatal("Expected connection.close", err)
+	}
+	if closeMethod, ok := method.(*amqp.ConnectionClose); !ok || closeMethod.ReplyCode != amqp.AccessRefused {
+		t.Fatalf("Expected connection.close with ACCESS_REFUSED, actual %s", method.Name())
+	}
+}
+
+func Test_Connection_ServerClose_WaitCloseOk(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	client, err := newRawClient(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.loginFailed(t)
+
+	// methods except close and close-ok are discarded after connection.close
+	client.send(&amqp.ConnectionTuneOk{})
+	if _, err := client.read(100 * time.Millisecond); !isTimeoutError(err) {
+		t.Fatal("Expected connection waiting for close-ok", err)
+	}
+
+	client.send(&amqp.ConnectionCloseOk{})
+	if _, err := client.read(time.Second); err == nil || isTimeoutError(err) {
+		t.Fatal("Expected connection closed after close-ok", err)
+	}
+}
+
+func Test_Connection_ServerClose_CloseOkTimeout(t *testing.T) {
+	defer func(timeout time.Duration) {
+		closeOkTimeout = timeout
+	}(closeOkTimeout)
+	closeOkTimeout = 200 * time.Millisecond
+
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	client, err := newRawClient(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.loginFailed(t)
+
+	if _, err := client.read(time.Second); err == nil || isTimeoutError(err) {
+		t.Fatal("Expected connection dropped without close-ok", err)
+	}
+}
+
+func Test_Connection_ServerClose_ClientClose(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	client, err := newRawClient(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.loginFailed(t)
+
+	// @spec-note
+	// The response to receiving a Close after sending Close must be to send Close-Ok.
+	client.send(&amqp.ConnectionClose{ReplyCode: amqp.ReplySuccess})
+	method, err := client.read(time.Second)
+	if err != nil {
+		t.Fatal("Expected connection.close-ok", err)
+	}
+	if _, ok := method.(*amqp.ConnectionCloseOk); !ok {
+		t.Fatalf("Expected connection.close-ok, actual %s", method.Name())
+	}
+
+	if _, err := client.read(time.Second); err == nil || isTimeoutError(err) {
+		t.Fatal("Expected connection closed after close-ok", err)
+	}
+}
+
+func Test_Connection_ClientClose_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	connID := sc.server.connSeq - 1
+	if err := sc.client.Close(); err != nil {
+		t.Fatal("Expected close-ok from server", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	sc.server.connLock.Lock()
+	_, ok := sc.server.connections[connID]
+	sc.server.connLock.Unlock()
+	if ok {
+		t.Fatal("Expected connection removed after close")
+	}
+}
+
+func Test_Connection_WriteTimeout_Closed(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Connection.WriteTimeout = 1
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+
+	// unbuffered pipe blocks server writes until client reads them
+	toServer, fromClient := net.Pipe()
+	defer toServer.Close()
+	sc.server.acceptConnection(fromClient)
+	sc.server.connLock.Lock()
+	connID := sc.server.connSeq
+	sc.server.connLock.Unlock()
+
+	if _, err := toServer.Write([]byte{'A', 'M', 'Q', 'P', 0, 0, 9, 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// client never reads connection.start
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sc.server.connLock.Lock()
+		_, ok := sc.server.connections[connID]
+		sc.server.connLock.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected connection closed on write timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_Connection_UnsupportedProtocol(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	toServer, fromClient := net.Pipe()
+	defer toServer.Close()
+	sc.server.acceptConnection(fromClient)
+	sc.server.connLock.Lock()
+	connID := sc.server.connSeq
+	sc.server.connLock.Unlock()
+
+	// header is split to check it is read completely before comparison
+	toServer.SetDeadline(time.Now().Add(time.Second))
+	if _, err := toServer.Write([]byte{'A', 'M', 'Q', 'P'}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := toServer.Write([]byte{0, 0, 8, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(toServer, buf); err != nil {
+		t.Fatal("Expected supported protocol header in response", err)
+	}
+	if !bytes.Equal(buf, []byte{'A', 'M', 'Q', 'P', 0, 0, 9, 1}) {
+		t.Fatalf("Expected supported protocol header, actual %v", buf)
+	}
+	if _, err := toServer.Read(buf); err != io.EOF {
+		t.Fatal("Expected connection closed after protocol header, actual", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		sc.server.connLock.Lock()
+		_, ok := sc.server.connections[connID]
+		sc.server.connLock.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected connection removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_Connection_Heartbeat_SentOnIdle(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	client, err := newRawClient(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.open(t, 1)
+
+	// heartbeat is sent at half of negotiated interval, so it is expected within the interval
+	client.conn.SetReadDeadline(time.Now().Add(1500 * time.Millisecond))
+	frame, err := amqp.ReadFrame(client.reader)
+	if err != nil {
+		t.Fatal("Expected heartbeat frame", err)
+	}
+	if frame.Type != amqp.FrameHeartbeat || frame.ChannelID != 0 {
+		t.Fatalf("Expected heartbeat frame on channel 0, actual type %d on channel %d", frame.Type, frame.ChannelID)
+	}
+}
+
+func Test_Connection_MultipleListeners_Success(t *testing.T) {
+	certFile, keyFile, err := writeTestCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(certFile))
+
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Listeners = []config.Listener{
+		{IP: "127.0.0.1", Port: "0"},
+		{IP: "127.0.0.1", Port: "0", TLS: true, CertFile: certFile, KeyFile: keyFile},
+	}
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	sc.server.listen()
+	defer func() {
+		sc.server.status = Stopping
+		for _, listener := range sc.server.listeners {
+			listener.Close()
+		}
+	}()
+
+	if len(sc.server.listeners) != 2 {
+		t.Fatal("Expected 2 listeners started")
+	}
+
+	plain, err := amqpclient.Dial("amqp://guest:guest@" + sc.server.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+
+	secure, err := amqpclient.DialTLS(
+		"amqps://guest:guest@"+sc.server.listeners[1].Addr().String(),
+		&tls.Config{InsecureSkipVerify: true},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secure.Close()
+
+	ch, _ := secure.Channel()
+	if _, err := ch.QueueDeclare("testQu", false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+
+	// socket options are applied to TCP connection under TLS connection too
+	sc.server.connLock.Lock()
+	for _, conn := range sc.server.connections {
+		if tcpConnOf(conn.netConn) == nil {
+			t.Error("Expected TCP connection of accepted connection")
+		}
+	}
+	sc.server.connLock.Unlock()
+
+	if _, err := amqpclient.Dial("amqp://guest:guest@" + sc.server.listeners[1].Addr().String()); err == nil {
+		t.Fatal("Expected plaintext connection refused by TLS listener")
+	}
+}
+
+func Test_Connection_AcceptRate_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.TCP.Backlog = 16
+	cfg.srvConfig.TCP.AcceptRate = 10
+	cfg.srvConfig.TCP.AcceptBurst = 1
+	cfg.srvConfig.Listeners = []config.Listener{{IP: "127.0.0.1", Port: "0"}}
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	sc.server.listen()
+	defer func() {
+		sc.server.status = Stopping
+		for _, listener := range sc.server.listeners {
+			listener.Close()
+		}
+	}()
+
+	started := time.Now()
+	for i := 0; i < 3; i++ {
+		conn, err := amqpclient.Dial("amqp://guest:guest@" + sc.server.listeners[0].Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+
+	// first connection uses burst token, each next one waits 100ms for token
+	if elapsed := time.Since(started); elapsed < 150*time.Millisecond {
+		t.Fatalf("Expected connections accepted at configured rate, accepted in %s", elapsed)
+	}
+}
+
+// exhaustedListener fails to accept with EMFILE given number of times before accepting conn
+type exhaustedListener struct {
+	fails  int
+	conn   net.Conn
+	closed chan struct{}
+}
+
+func (listener *exhaustedListener) Accept() (net.Conn, error) {
+	if listener.fails > 0 {
+		listener.fails--
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+	if listener.conn != nil {
+		conn := listener.conn
+		listener.conn = nil
+		return conn, nil
+	}
+	<-listener.closed
+	return nil, errors.New("listener closed")
+}
+
+func (listener *exhaustedListener) Close() error {
+	close(listener.closed)
+	return nil
+}
+
+func (listener *exhaustedListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func Test_Connection_AcceptFdExhausted_Backoff(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	connsCount := func() int {
+		sc.server.connLock.Lock()
+		defer sc.server.connLock.Unlock()
+		return len(sc.server.connections)
+	}
+	initialCount := connsCount()
+
+	toServer, fromClient := net.Pipe()
+	defer fromClient.Close()
+	listener := &exhaustedListener{fails: 4, conn: toServer, closed: make(chan struct{})}
+
+	started := time.Now()
+	done := make(chan struct{})
+	go func() {
+		sc.server.acceptLoop(listener, false)
+		close(done)
+	}()
+
+	// 5 + 10 + 20 + 40 ms of backoff before connection is accepted
+	deadline := time.Now().Add(5 * time.Second)
+	for connsCount() == initialCount {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected connection accepted after fd exhaustion")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if elapsed := time.Since(started); elapsed < 75*time.Millisecond {
+		t.Fatalf("Expected accepting paused on fd exhaustion, accepted in %s", elapsed)
+	}
+
+	sc.server.status = Stopping
+	listener.Close()
+	<-done
+}
+
+func TestFileDescriptors(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	open, limit := sc.server.FileDescriptors()
+	if runtime.GOOS == "linux" && (open <= 0 || limit == 0 || uint64(open) > limit) {
+		t.Fatalf("Unexpected file descriptors %d of %d", open, limit)
+	}
+}
+
+// writeTestCertificate writes self-signed certificate and its key into temp dir
+func writeTestCertificate() (string, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	dir, err := ioutil.TempDir("", "garagemq_tls")
+	if err != nil {
+		return "", "", err
+	}
+
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}), 0600); err != nil {
+		return "", "", err
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return "", "", err
+	}
+
+	return certFile, keyFile, nil
+}
+
+func Test_Connection_ProxyProtocol_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Listeners = []config.Listener{
+		{IP: "127.0.0.1", Port: "0", ProxyProtocol: true},
+	}
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	sc.server.listen()
+	defer func() {
+		sc.server.status = Stopping
+		for _, listener := range sc.server.listeners {
+			listener.Close()
+		}
+	}()
+
+	address := sc.server.listeners[0].Addr().String()
+	client, err := amqpclient.DialConfig("amqp://guest:guest@"+address, amqpclient.Config{
+		Dial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			_, err = conn.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 5672\r\n"))
+			return conn, err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	found := false
+	for _, conn := range sc.server.GetConnections() {
+		if conn.GetRemoteAddr().String() == "192.168.0.1:56324" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("Expected connection with remote address from PROXY protocol header")
+	}
+
+	if _, err := amqpclient.Dial("amqp://guest:guest@" + address); err == nil {
+		t.Fatal("Expected connection without PROXY protocol header refused")
+	}
+}
+
+func Test_Connection_ServerCapabilities(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	capabilities, ok := sc.client.Properties["capabilities"].(amqpclient.Table)
+	if !ok {
+		t.Fatal("Expected capabilities in server properties")
+	}
+
+	for name, expected := range serverCapabilities() {
+		if capabilities[name] != expected {
+			t.Fatalf("Expected capability '%s' = %v, actual %v", name, expected, capabilities[name])
+		}
+	}
+	if capabilities["exchange_exchange_bindings"] != false || capabilities["basic.nack"] != true {
+		t.Fatal("Expected capabilities reflect implemented features")
+	}
+}
+
+func Test_Maintenance_Drain(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testQuIdle", false, false, false, false, emptyTable)
+	ch.Publish("", "testQuIdle", false, false, amqpclient.Publishing{Body: []byte("kept")})
+	deliveries, _ := ch.Consume("testQu", "", false, false, false, false, emptyTable)
+	for i := 0; i < 2; i++ {
+		ch.Publish("", "testQu", false, false, amqpclient.Publishing{Body: []byte("test")})
+	}
+
+	sc.server.SetMaintenance(true)
+	if !sc.server.IsMaintenance() {
+		t.Fatal("Expected maintenance mode")
+	}
+
+	// existing consumer keeps receiving messages
+	var last amqpclient.Delivery
+	for i := 0; i < 2; i++ {
+		select {
+		case last = <-deliveries:
+		case <-time.After(time.Second):
+			t.Fatal("Expected delivery to existing consumer")
+		}
+	}
+	if sc.server.IsDrained() {
+		t.Fatal("Expected not drained with unacked messages")
+	}
+	last.Ack(true)
+	time.Sleep(50 * time.Millisecond)
+	if !sc.server.IsDrained() {
+		t.Fatal("Expected drained, queue without consumers does not block it")
+	}
+
+	newCh, _ := sc.client.Channel()
+	if _, err := newCh.Consume("testQuIdle", "", false, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected new consumer refused in maintenance mode")
+	}
+
+	toServer, fromClient := net.Pipe()
+	defer toServer.Close()
+	sc.server.acceptConnection(fromClient)
+	toServer.SetDeadline(time.Now().Add(time.Second))
+	if _, err := toServer.Write([]byte{'A', 'M', 'Q', 'P', 0, 0, 9, 1}); err == nil {
+		t.Fatal("Expected new connection refused in maintenance mode")
+	}
+
+	sc.server.SetMaintenance(false)
+	if sc.server.IsDrained() {
+		t.Fatal("Expected not drained out of maintenance mode")
+	}
+	newCh, _ = sc.client.Channel()
+	if _, err := newCh.Consume("testQuIdle", "", false, false, false, false, emptyTable); err != nil {
+		t.Fatal("Expected consumer accepted out of maintenance mode", err)
+	}
+}
+
+func Test_Outbound_Fair(t *testing.T) {
+	out := newOutbound()
+	var bulk []*amqp.Frame
+	for i := 0; i < 10; i++ {
+		frame := &amqp.Frame{Type: byte(amqp.FrameBody), ChannelID: 1, Payload: make([]byte, outboundQuantum)}
+		bulk = append(bulk, frame)
+		out.push(nil, frame)
+	}
+	for i := 0; i < 3; i++ {
+		out.push(nil, &amqp.Frame{Type: byte(amqp.FrameMethod), ChannelID: 2, Payload: []byte{1}})
+	}
+
+	if out.len() != 13 {
+		t.Fatalf("Expected 13 queued frames, actual %d", out.len())
+	}
+
+	var bulkIdx int
+	for i := 0; i < 13; i++ {
+		frame := out.pop(nil)
+		if frame.ChannelID == 2 {
+			if i > 3 {
+				t.Fatalf("Expected interactive frame is not delayed by bulk frames, popped at %d", i)
+			}
+			continue
+		}
+		if frame != bulk[bulkIdx] {
+			t.Fatal("Expected frames of channel keep their order")
+		}
+		bulkIdx++
+	}
+
+	if out.len() != 0 || out.next() != nil {
+		t.Fatal("Expected no frames left")
+	}
+}
+
+func Test_Outbound_ChannelBackpressure(t *testing.T) {
+	out := newOutbound()
+	for i := 0; i < outboundChannelFrames; i++ {
+		out.push(nil, &amqp.Frame{ChannelID: 1, Payload: []byte{1}})
+	}
+
+	done := make(chan struct{})
+	close(done)
+	if out.push(done, &amqp.Frame{ChannelID: 1}) {
+		t.Fatal("Expected frame is not queued into full channel queue")
+	}
+	if !out.push(done, &amqp.Frame{ChannelID: 2}) {
+		t.Fatal("Expected frame of other channel is queued")
+	}
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- out.push(nil, &amqp.Frame{ChannelID: 1})
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("Expected sender is blocked while channel queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for out.pop(nil).ChannelID != 1 {
+	}
+	select {
+	case ok := <-pushed:
+		if !ok {
+			t.Fatal("Expected frame is queued")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected sender is unblocked after frame is taken")
+	}
+}
+
+func Test_LastError_Channel(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if _, err := ch.QueueDeclarePassive("unknownQu", false, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected error on passive declare of unknown queue")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// error is kept after channel is closed
+	serverCh := getServerChannel(sc, 1)
+	lastErr := serverCh.GetLastError()
+	if lastErr == nil || lastErr.ReplyCode != amqp.NotFound || lastErr.ChannelID != 1 || lastErr.ConnectionError {
+		t.Fatalf("Unexpected channel last error %+v", lastErr)
+	}
+	if connErr := serverCh.conn.GetLastError(); connErr != lastErr {
+		t.Fatalf("Expected channel error kept by connection, actual %+v", connErr)
+	}
+
+	// reopened channel clears its error
+	serverCh.reset()
+	if lastErr := serverCh.GetLastError(); lastErr != nil {
+		t.Fatalf("Expected no last error after channel is opened again, actual %+v", lastErr)
+	}
+	if connErr := serverCh.conn.GetLastError(); connErr != nil {
+		t.Fatalf("Expected no connection last error after channel is opened again, actual %+v", connErr)
+	}
+}
+
+func Test_LastError_ClosedConnection(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	connClose := sc.client.NotifyClose(make(chan *amqpclient.Error, 1))
+	sc.client.Channel()
+
+	serverCh := getServerChannel(sc, 1)
+	connID := serverCh.conn.GetID()
+	serverCh.sendError(amqp.NewConnectionError(amqp.FrameError, "test error", 0, 0))
+	select {
+	case <-connClose:
+	case <-time.After(time.Second):
+		t.Fatal("Expected connection closed")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	var closed *ClosedConnectionError
+	for _, item := range sc.server.GetClosedConnectionErrors() {
+		if item.ConnID == connID {
+			closed = item
+		}
+	}
+	if closed == nil || closed.Err.ReplyCode != amqp.FrameError || !closed.Err.ConnectionError || closed.User != "guest" {
+		t.Fatalf("Unexpected closed connection error %+v", closed)
+	}
+}
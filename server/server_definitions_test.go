@@ -0,0 +1,121 @@
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+func Test_Definitions_ExportImport_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	ch, _ := sc.client.Channel()
+	chEx, _ := sc.clientEx.Channel()
+
+	ch.ExchangeDeclare("testEx", "topic", true, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu", true, false, false, false, emptyTable)
+	ch.QueueDeclare("testQuAuto", false, true, false, false, emptyTable)
+	chEx.QueueDeclare("testQuExclusive", false, false, true, false, emptyTable)
+	ch.QueueBind("testQu", "key.*", "testEx", false, map[string]interface{}{"x-arg": "value"})
+	ch.QueueBind("testQuAuto", "key.#", "amq.topic", false, emptyTable)
+	chEx.QueueBind("testQuExclusive", "key", "testEx", false, emptyTable)
+
+	defs := sc.server.ExportDefinitions()
+	if len(defs.Exchanges) != 1 || defs.Exchanges[0].Name != "testEx" || defs.Exchanges[0].Type != "topic" {
+		t.Fatal("Expected only user exchange exported")
+	}
+	if len(defs.Queues) != 2 {
+		t.Fatal("Expected exclusive queue skipped on export")
+	}
+	if len(defs.Bindings) != 2 {
+		t.Fatal("Expected bindings into default exchange and exclusive queue skipped on export")
+	}
+	if len(defs.Users) != 2 || len(defs.Vhosts) != 1 {
+		t.Fatal("Expected users and vhosts exported")
+	}
+
+	data, err := json.Marshal(defs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "password") {
+		t.Fatal("Expected user passwords not exported")
+	}
+	sc.server.Stop()
+	sc.clean()
+
+	sc, _ = getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	imported := &Definitions{}
+	if err := json.Unmarshal(data, imported); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.server.ImportDefinitions(imported); err != nil {
+		t.Fatal(err)
+	}
+	// import is idempotent
+	if err := sc.server.ImportDefinitions(imported); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(defs, sc.server.ExportDefinitions()) {
+		t.Fatal("Expected same definitions after import")
+	}
+}
+
+func Test_Definitions_Import_Failed(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("testEx", "direct", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+
+	cases := []*Definitions{
+		{Vhosts: []*VhostDefinition{{Name: "unknown"}}},
+		{Exchanges: []*ExchangeDefinition{{Vhost: "/", Name: "testEx", Type: "fanout"}}},
+		{Exchanges: []*ExchangeDefinition{{Vhost: "/", Name: "newEx", Type: "unknown"}}},
+		{Exchanges: []*ExchangeDefinition{{Vhost: "/", Name: "amq.new", Type: "direct"}}},
+		{Queues: []*QueueDefinition{{Vhost: "/", Name: "testQu", Durable: true}}},
+		{Bindings: []*BindingDefinition{{Vhost: "/", Source: "newEx", Destination: "testQu"}}},
+		{Bindings: []*BindingDefinition{{Vhost: "/", Source: "testEx", Destination: "newQu"}}},
+		{
+			Queues:   []*QueueDefinition{{Vhost: "/", Name: "newQu"}},
+			Bindings: []*BindingDefinition{{Vhost: "/", Source: "", Destination: "newQu"}},
+		},
+	}
+
+	for i, defs := range cases {
+		if err := sc.server.ImportDefinitions(defs); err == nil {
+			t.Fatalf("Expected error on import case %d", i)
+		}
+	}
+
+	if sc.server.getVhost("/").GetQueue("newQu") != nil {
+		t.Fatal("Expected nothing imported on invalid definitions")
+	}
+}
+
+func Test_Definitions_Import_Arguments_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	defs := &Definitions{
+		Exchanges: []*ExchangeDefinition{{Vhost: "/", Name: "testEx", Type: "headers", Durable: true}},
+		Queues:    []*QueueDefinition{{Vhost: "/", Name: "testQu", Durable: true}},
+		Bindings: []*BindingDefinition{
+			{Vhost: "/", Source: "testEx", Destination: "testQu", Arguments: &amqp.Table{"x-match": "all"}},
+		},
+	}
+	if err := sc.server.ImportDefinitions(defs); err != nil {
+		t.Fatal(err)
+	}
+
+	bindings := sc.server.getVhost("/").GetExchange("testEx").GetBindings()
+	if len(bindings) != 1 || (*bindings[0].Arguments)["x-match"] != "all" {
+		t.Fatal("Expected binding with arguments imported")
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	amqpclient "github.com/streadway/amqp"
+	"github.com/valinurovam/garagemq/metrics"
+)
+
+func Test_DiskAlarm_BlockPersistentPublisher(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	blockings := sc.client.NotifyBlocked(make(chan amqpclient.Blocking, 2))
+	ch, _ := sc.client.Channel()
+	chTransient, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQu", true, false, false, false, emptyTable)
+	ch.QueueDeclare("testQuTransient", false, false, false, false, emptyTable)
+	vhost := sc.server.getVhost("/")
+
+	sc.server.setStorageFull(vhost.msgStorageP, true)
+	if raised, _ := sc.server.DiskAlarm(); !raised {
+		t.Fatal("Expected disk alarm raised")
+	}
+	select {
+	case blocking := <-blockings:
+		if !blocking.Active || blocking.Reason != diskAlarmReason {
+			t.Fatalf("Unexpected blocking %+v", blocking)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected connection.blocked")
+	}
+
+	ch.Publish("", "testQu", false, false, amqpclient.Publishing{Body: []byte("test"), DeliveryMode: amqpclient.Persistent})
+	chTransient.Publish("", "testQu", false, false, amqpclient.Publishing{Body: []byte("test")})
+	chTransient.Publish("", "testQuTransient", false, false, amqpclient.Publishing{Body: []byte("test"), DeliveryMode: amqpclient.Persistent})
+	time.Sleep(50 * time.Millisecond)
+
+	if length := vhost.GetQueue("testQu").Length(); length != 1 {
+		t.Fatalf("Expected only transient message in durable queue, actual length %d", length)
+	}
+	if length := vhost.GetQueue("testQuTransient").Length(); length != 1 {
+		t.Fatalf("Expected persistent message in transient queue, actual length %d", length)
+	}
+
+	sc.server.setStorageFull(vhost.msgStorageP, false)
+	select {
+	case blocking := <-blockings:
+		if blocking.Active {
+			t.Fatalf("Unexpected blocking %+v", blocking)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected connection.unblocked")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if length := vhost.GetQueue("testQu").Length(); length != 2 {
+		t.Fatalf("Expected persistent message published after alarm cleared, actual length %d", length)
+	}
+	if raised, _ := sc.server.DiskAlarm(); raised {
+		t.Fatal("Expected disk alarm cleared")
+	}
+}
+
+func Test_DiskAlarm_SeveralStorages(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	vhost := sc.server.getVhost("/")
+
+	sc.server.setStorageFull(vhost.msgStorageP, true)
+	sc.server.setStorageFull(vhost.msgStorageT, true)
+	sc.server.setStorageFull(vhost.msgStorageP, false)
+	if raised, _ := sc.server.DiskAlarm(); !raised {
+		t.Fatal("Expected disk alarm raised while any storage is full")
+	}
+
+	sc.server.setStorageFull(vhost.msgStorageT, false)
+	if raised, _ := sc.server.DiskAlarm(); raised {
+		t.Fatal("Expected disk alarm cleared")
+	}
+}
+
+func Test_DiskAlarm_TransientMode(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Db.DiskFullMode = diskFullModeTransient
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQu", true, false, false, false, emptyTable)
+	vhost := sc.server.getVhost("/")
+	sc.server.setStorageFull(vhost.msgStorageP, true)
+
+	ch.Publish("", "testQu", false, false, amqpclient.Publishing{Body: []byte("test"), DeliveryMode: amqpclient.Persistent})
+	time.Sleep(50 * time.Millisecond)
+
+	msg, ok, err := ch.Get("testQu", true)
+	if err != nil || !ok {
+		t.Fatal("Expected message accepted while disk alarm is raised", err)
+	}
+	if msg.DeliveryMode != amqpclient.Transient {
+		t.Fatalf("Expected message accepted as transient, actual delivery mode %d", msg.DeliveryMode)
+	}
+}
+
+func Test_DiskAlarm_RejectMode(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Db.DiskFullMode = diskFullModeReject
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.Confirm(false)
+	confirms := ch.NotifyPublish(make(chan amqpclient.Confirmation, 2))
+
+	ch.QueueDeclare("testQu", true, false, false, false, emptyTable)
+	vhost := sc.server.getVhost("/")
+	sc.server.setStorageFull(vhost.msgStorageP, true)
+	sc.server.GetMetrics().PublishRejected = metrics.NewTrackCounter(0, false)
+
+	ch.Publish("", "testQu", false, false, amqpclient.Publishing{Body: []byte("test"), DeliveryMode: amqpclient.Persistent})
+	ch.Publish("", "testQu", false, false, amqpclient.Publishing{Body: []byte("test")})
+	for i := 1; i <= 2; i++ {
+		select {
+		case confirm := <-confirms:
+			if confirm.DeliveryTag != uint64(i) || confirm.Ack != (i == 2) {
+				t.Fatalf("Unexpected confirm %+v", confirm)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout on waiting confirm %d", i)
+		}
+	}
+	if length := vhost.GetQueue("testQu").Length(); length != 1 {
+		t.Fatalf("Expected only transient message in durable queue, actual length %d", length)
+	}
+
+	// publisher not in confirm mode gets channel error
+	chNoConfirm, _ := sc.client.Channel()
+	chClose := chNoConfirm.NotifyClose(make(chan *amqpclient.Error, 1))
+	chNoConfirm.Publish("", "testQu", false, false, amqpclient.Publishing{Body: []byte("test"), DeliveryMode: amqpclient.Persistent})
+	select {
+	case err := <-chClose:
+		if err == nil || err.Code != amqpclient.ResourceError {
+			t.Fatalf("Expected resource error, actual %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected channel closed on rejected publish")
+	}
+
+	if count := sc.server.GetMetrics().PublishRejected.Counter.Count(); count != 2 {
+		t.Fatalf("Expected %d rejected publishes, actual %d", 2, count)
+	}
+}
@@ -1,9 +1,16 @@
 package server
 
 import (
+	"fmt"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	amqpclient "github.com/streadway/amqp"
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/binding"
 	"github.com/valinurovam/garagemq/exchange"
+	"github.com/valinurovam/garagemq/metrics"
 )
 
 func Test_DefaultExchanges(t *testing.T) {
@@ -89,8 +96,53 @@ func Test_ExchangeDeclare_Failed_WrongType(t *testing.T) {
 	defer sc.clean()
 	ch, _ := sc.client.Channel()
 
-	if err := ch.ExchangeDeclare("test", "test", false, false, false, false, emptyTable); err == nil {
-		t.Fatal("Expected NotImplemented error")
+	err := ch.ExchangeDeclare("test", "test", false, false, false, false, emptyTable)
+	if amqpErr, ok := err.(*amqpclient.Error); !ok || amqpErr.Code != amqp.CommandInvalid {
+		t.Fatalf("Expected CommandInvalid error, actual %v", err)
+	}
+}
+
+// queueNameRouter routes message to bound queue named as routing key
+type queueNameRouter struct{}
+
+func (router *queueNameRouter) Bind(bind *binding.Binding) {}
+
+func (router *queueNameRouter) Unbind(bind *binding.Binding) {}
+
+func (router *queueNameRouter) GetMatchedQueues(message *amqp.Message, bindings map[string]map[string]*binding.Binding, matchedQueues map[string]bool) {
+	if len(bindings[message.RoutingKey]) > 0 {
+		matchedQueues[message.RoutingKey] = true
+	}
+}
+
+func Test_ExchangeDeclare_RegisteredType(t *testing.T) {
+	if _, err := exchange.Register("x-queue-name", func(ex *exchange.Exchange) exchange.Router {
+		return &queueNameRouter{}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if err := ch.ExchangeDeclare("testEx", "x-queue-name", false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"testQu1", "testQu2"} {
+		ch.QueueDeclare(name, false, false, false, false, emptyTable)
+		ch.QueueBind(name, "", "testEx", false, emptyTable)
+	}
+	ch.Publish("testEx", "testQu2", false, false, amqpclient.Publishing{Body: []byte("test")})
+	ch.Publish("testEx", "testQu3", false, false, amqpclient.Publishing{Body: []byte("test")})
+	ch.QueueInspect("testQu2")
+
+	vhost := sc.server.getVhost("/")
+	if vhost.GetExchange("testEx").GetTypeAlias() != "x-queue-name" {
+		t.Fatal("Expected exchange of registered type")
+	}
+	if vhost.GetQueue("testQu1").Length() != 0 || vhost.GetQueue("testQu2").Length() != 1 {
+		t.Fatal("Expected message routed by registered type")
 	}
 }
 
@@ -126,6 +178,136 @@ func Test_ExchangeDeclare_Failed_DefaultName(t *testing.T) {
 	}
 }
 
+func Test_ExchangeDeclare_Property_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if err := ch.ExchangeDeclare("testExType", "x-property", false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ExchangeDeclare("testExApp", "x-property", false, false, false, false, amqpclient.Table{"routing-property": "app-id"}); err != nil {
+		t.Fatal(err)
+	}
+	ch.QueueDeclare("testQuCreated", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testQuBilling", false, false, false, false, emptyTable)
+	ch.QueueBind("testQuCreated", "order.created", "testExType", false, emptyTable)
+	ch.QueueBind("testQuBilling", "billing", "testExApp", false, emptyTable)
+
+	msg := amqpclient.Publishing{Type: "order.created", AppId: "billing", Body: []byte("test")}
+	ch.Publish("testExType", "billing", false, false, msg)
+	ch.Publish("testExApp", "order.created", false, false, msg)
+	ch.Publish("testExType", "order.created", false, false, amqpclient.Publishing{Body: []byte("test")})
+	time.Sleep(50 * time.Millisecond)
+
+	vhost := sc.server.getVhost("/")
+	if length := vhost.GetQueue("testQuCreated").Length(); length != 1 {
+		t.Fatalf("Expected %d message routed by type, actual %d", 1, length)
+	}
+	if length := vhost.GetQueue("testQuBilling").Length(); length != 1 {
+		t.Fatalf("Expected %d message routed by app-id, actual %d", 1, length)
+	}
+
+	if err := ch.ExchangeDeclare("testExType", "x-property", false, false, false, false, amqpclient.Table{"routing-property": "user-id"}); err == nil {
+		t.Fatal("Expected: routing-property inequivalent error")
+	}
+	ch, _ = sc.client.Channel()
+	if err := ch.ExchangeDeclare("testExInvalid", "x-property", false, false, false, false, amqpclient.Table{"routing-property": "priority"}); err == nil {
+		t.Fatal("Expected: unsupported routing property error")
+	}
+}
+
+func Test_ExchangeDeclare_Properties_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	args := amqpclient.Table{
+		"x-set-properties":     amqpclient.Table{"app-id": "billing"},
+		"x-default-properties": amqpclient.Table{"type": "invoice", "delivery-mode": int32(2)},
+	}
+	if err := ch.ExchangeDeclare("testEx", "direct", false, false, false, false, args); err != nil {
+		t.Fatal(err)
+	}
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	ch.QueueBind("testQu", "key", "testEx", false, emptyTable)
+
+	ch.Publish("testEx", "key", false, false, amqpclient.Publishing{AppId: "client", Body: []byte("first")})
+	ch.Publish("testEx", "key", false, false, amqpclient.Publishing{AppId: "client", Type: "receipt", DeliveryMode: amqpclient.Transient, Body: []byte("second")})
+	time.Sleep(50 * time.Millisecond)
+
+	msg, ok, err := ch.Get("testQu", true)
+	if err != nil || !ok {
+		t.Fatal("Expected message", err)
+	}
+	if msg.AppId != "billing" || msg.Type != "invoice" || msg.DeliveryMode != amqpclient.Persistent {
+		t.Fatalf("Expected properties stamped by exchange, actual app-id %s, type %s, delivery-mode %d", msg.AppId, msg.Type, msg.DeliveryMode)
+	}
+
+	msg, ok, err = ch.Get("testQu", true)
+	if err != nil || !ok {
+		t.Fatal("Expected message", err)
+	}
+	if msg.AppId != "billing" || msg.Type != "receipt" || msg.DeliveryMode != amqpclient.Transient {
+		t.Fatalf("Expected only missing properties defaulted, actual app-id %s, type %s, delivery-mode %d", msg.AppId, msg.Type, msg.DeliveryMode)
+	}
+
+	if err := ch.ExchangeDeclare("testEx", "direct", false, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected: x-set-properties inequivalent error")
+	}
+	ch, _ = sc.client.Channel()
+	if err := ch.ExchangeDeclare("testExInvalid", "direct", false, false, false, false, amqpclient.Table{"x-set-properties": amqpclient.Table{"user-id": "guest"}}); err == nil {
+		t.Fatal("Expected: unsupported property error")
+	}
+	ch, _ = sc.client.Channel()
+	if err := ch.ExchangeDeclare("testExInvalid", "direct", false, false, false, false, amqpclient.Table{"x-default-properties": "app-id"}); err == nil {
+		t.Fatal("Expected: table argument error")
+	}
+}
+
+func Test_ExchangeDeclare_AllowedContentTypes(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.trackMetrics = true
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	closes := ch.NotifyClose(make(chan *amqpclient.Error, 1))
+
+	args := amqpclient.Table{"x-allowed-content-types": []interface{}{"application/json"}}
+	if err := ch.ExchangeDeclare("testEx", "direct", false, false, false, false, args); err != nil {
+		t.Fatal(err)
+	}
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	ch.QueueBind("testQu", "key", "testEx", false, emptyTable)
+
+	ch.Publish("testEx", "key", false, false, amqpclient.Publishing{ContentType: "application/json; charset=utf-8", Body: []byte(`{}`)})
+	ch.Publish("testEx", "key", false, false, amqpclient.Publishing{ContentType: "text/plain", Body: []byte("text")})
+
+	select {
+	case err := <-closes:
+		if err == nil || err.Code != amqp.PreconditionFailed {
+			t.Fatalf("Expected channel closed with %d, actual %v", amqp.PreconditionFailed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected channel closed on not allowed content type")
+	}
+	if length := sc.server.getVhost("/").GetQueue("testQu").Length(); length != 1 {
+		t.Fatalf("Expected %d messages, actual %d", 1, length)
+	}
+	if count := sc.server.GetMetrics().PublishRejectedBy[publishRejectContentType].Counter.Count(); count != 1 {
+		t.Fatalf("Expected %d rejected publish, actual %d", 1, count)
+	}
+
+	ch, _ = sc.client.Channel()
+	if err := ch.ExchangeDeclare("testEx", "direct", false, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected: x-allowed-content-types inequivalent error")
+	}
+	ch, _ = sc.client.Channel()
+	if err := ch.ExchangeDeclare("testExInvalid", "direct", false, false, false, false, amqpclient.Table{"x-allowed-content-types": "application/json"}); err == nil {
+		t.Fatal("Expected: array argument error")
+	}
+}
+
 func Test_ExchangeDeclarePassive_Success(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
@@ -149,3 +331,250 @@ func Test_ExchangeDeclarePassive_Failed_NotExists(t *testing.T) {
 		t.Fatal("Expected: exchange not found error")
 	}
 }
+
+func Test_ExchangeDelete_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("test", "direct", true, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu", true, false, false, false, emptyTable)
+	ch.QueueBind("testQu", "key", "test", false, emptyTable)
+
+	if err := ch.ExchangeDelete("test", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if sc.server.getVhost("/").GetExchange("test") != nil {
+		t.Fatal("Expected exchange deleted")
+	}
+	if err := ch.ExchangeDeclarePassive("test", "direct", true, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected: exchange not found error")
+	}
+}
+
+func Test_ExchangeDelete_Failed_IfUnused(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("test", "direct", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	ch.QueueBind("testQu", "key", "test", false, emptyTable)
+
+	if err := ch.ExchangeDelete("test", true, false); err == nil {
+		t.Fatal("Expected: exchange has bindings error")
+	}
+	if sc.server.getVhost("/").GetExchange("test") == nil {
+		t.Fatal("Expected exchange is not deleted")
+	}
+}
+
+func Test_ExchangeDelete_IfUnused_AfterUnbind(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("test", "direct", true, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu", true, false, false, false, emptyTable)
+	ch.QueueBind("testQu", "key", "test", false, emptyTable)
+
+	err := ch.ExchangeDelete("test", true, false)
+	if amqpErr, ok := err.(*amqpclient.Error); !ok || amqpErr.Code != amqpclient.PreconditionFailed {
+		t.Fatalf("Expected PRECONDITION_FAILED on delete of exchange with bindings, actual %v", err)
+	}
+	if sc.server.getVhost("/").GetExchange("test") == nil {
+		t.Fatal("Expected exchange is not deleted")
+	}
+
+	ch, _ = sc.client.Channel()
+	if err = ch.QueueUnbind("testQu", "key", "test", emptyTable); err != nil {
+		t.Fatal(err)
+	}
+	if err = ch.ExchangeDelete("test", true, false); err != nil {
+		t.Fatal("Expected exchange without bindings deleted with if-unused", err)
+	}
+
+	sc.server.Stop()
+	sc, _ = getNewSC(getDefaultTestConfig())
+	if sc.server.getVhost("/").GetExchange("test") != nil {
+		t.Fatal("Expected deleted exchange is not restored after restart")
+	}
+}
+
+func Test_ExchangeDelete_Bindings_Persist(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("test", "direct", true, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu", true, false, false, false, emptyTable)
+	ch.QueueBind("testQu", "key", "test", false, emptyTable)
+	if err := ch.ExchangeDelete("test", false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// redeclared exchange has no bindings of deleted one after restart
+	ch.ExchangeDeclare("test", "direct", true, false, false, false, emptyTable)
+	sc.server.Stop()
+	sc, _ = getNewSC(getDefaultTestConfig())
+	ex := sc.server.getVhost("/").GetExchange("test")
+	if ex == nil || len(ex.GetBindings()) != 0 {
+		t.Fatal("Expected bindings of deleted exchange removed from storage")
+	}
+}
+
+func Test_ExchangeDelete_Failed_System(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if err := ch.ExchangeDelete("amq.direct", false, false); err == nil {
+		t.Fatal("Expected: access refused error")
+	}
+}
+
+// Test_ExchangeMethods_NoWait checks that no-wait methods are not answered
+// Unexpected -ok reply would be taken by the next synchronous call as its own reply, so the call would fail
+func Test_ExchangeMethods_NoWait(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if err := ch.ExchangeDeclare("test", "direct", false, false, false, true, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+	ch.ExchangeDeclare("test", "direct", false, false, false, true, emptyTable)
+	ch.ExchangeDeclarePassive("test", "direct", false, false, false, true, emptyTable)
+	if err := ch.ExchangeDeclarePassive("test", "direct", false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+
+	ch.ExchangeDelete("test", false, true)
+	if err := ch.ExchangeDeclarePassive("test", "direct", false, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected: exchange not found error")
+	}
+
+	// errors are raised as channel exceptions
+	ch, _ = sc.client.Channel()
+	chClose := ch.NotifyClose(make(chan *amqpclient.Error, 1))
+	ch.ExchangeDeclarePassive("test2", "direct", false, false, false, true, emptyTable)
+	select {
+	case err := <-chClose:
+		if err == nil || err.Code != amqpclient.NotFound {
+			t.Fatalf("Expected not found error, actual %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected channel closed on passive declare of missing exchange")
+	}
+}
+
+// BenchmarkVhost_Route_ConcurrentPublishers measures registry lookups made on publishing by concurrent publishers
+// into many exchanges, while queues are declared and deleted in background
+func BenchmarkVhost_Route_ConcurrentPublishers(b *testing.B) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	vhost := sc.server.getVhost("/")
+
+	exCount := 100
+	for i := 0; i < exCount; i++ {
+		exName := fmt.Sprintf("testEx%d", i)
+		vhost.AppendExchange(exchange.NewExchange(exName, exchange.ExTypeDirect, false, false, false, false))
+		vhost.AppendQueue(vhost.NewQueue(fmt.Sprintf("testQu%d", i), 0, false, false, false, 0))
+		vhost.BindQueue(exName, fmt.Sprintf("testQu%d", i), "test", &amqp.Table{})
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			vhost.AppendQueue(vhost.NewQueue("testQuTemp", 0, false, false, false, 0))
+			vhost.DeleteQueue("testQuTemp", false, false)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	defer close(stop)
+
+	var publisherSeq uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		exName := fmt.Sprintf("testEx%d", atomic.AddUint64(&publisherSeq, 1)%uint64(exCount))
+		message := &amqp.Message{Exchange: exName, RoutingKey: "test"}
+		for pb.Next() {
+			ex := vhost.GetExchange(exName)
+			for queueName := range ex.GetMatchedQueues(message) {
+				if vhost.GetQueue(queueName) == nil {
+					b.Fatalf("Expected queue %s routed from %s", queueName, exName)
+				}
+			}
+		}
+	})
+}
+
+func Test_Exchange_RoutingStats(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	returns := ch.NotifyReturn(make(chan amqpclient.Return, 1))
+
+	ch.ExchangeDeclare("testEx", "direct", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	ch.QueueBind("testQu", "key", "testEx", false, emptyTable)
+
+	// test server has nil metrics, so exchange gets real counters
+	ex := sc.server.getVhost("/").GetExchange("testEx")
+	ex.SetMetrics(&exchange.MetricsState{
+		MsgIn:         metrics.NewTrackCounter(0, false),
+		MsgOut:        metrics.NewTrackCounter(0, false),
+		MsgRouted:     metrics.NewTrackCounter(0, false),
+		MsgUnroutable: metrics.NewTrackCounter(0, false),
+	})
+
+	ch.Publish("testEx", "key", false, false, amqpclient.Publishing{Body: []byte("routed")})
+	ch.Publish("testEx", "key", false, false, amqpclient.Publishing{Body: []byte("routed")})
+	ch.Publish("testEx", "unknown", false, false, amqpclient.Publishing{Body: []byte("dropped")})
+	ch.Publish("testEx", "unknown", true, false, amqpclient.Publishing{Body: []byte("returned")})
+
+	select {
+	case <-returns:
+	case <-time.After(time.Second):
+		t.Fatal("Expected basic.return for unrouted message")
+	}
+
+	if routed := ex.GetMetrics().MsgRouted.Counter.Count(); routed != 2 {
+		t.Fatalf("Expected %d routed messages, actual %d", 2, routed)
+	}
+	if unroutable := ex.GetMetrics().MsgUnroutable.Counter.Count(); unroutable != 2 {
+		t.Fatalf("Expected %d unroutable messages, actual %d", 2, unroutable)
+	}
+}
+
+func Test_ExchangeDeclare_NamePattern(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Security.ExchangeNamePattern = `^team\.`
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if err := ch.ExchangeDeclare("team.ex", "direct", false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+	// pre-declared exchanges are not checked
+	if err := ch.ExchangeDeclarePassive("amq.direct", "direct", true, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ExchangeDeclare("other.ex", "direct", false, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected: name does not match pattern error")
+	} else if amqpErr, ok := err.(*amqpclient.Error); !ok || amqpErr.Code != amqpclient.PreconditionFailed {
+		t.Fatalf("Expected precondition failed error, actual %v", err)
+	}
+
+	client, _ := sc.server.NewLocalClient("/", 0)
+	defer client.Close()
+	if err := client.ExchangeDeclare("other.ex", "direct", false, false); err == nil {
+		t.Fatal("Expected: local client name does not match pattern error")
+	}
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	amqpclient "github.com/streadway/amqp"
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/metrics"
+)
+
+func getLocalClient(t testing.TB, sc *ServerClient, prefetchCount uint16) *LocalClient {
+	client, err := sc.server.NewLocalClient("/", prefetchCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.QueueDeclare("testQu", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.ExchangeDeclare("testEx", "direct", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.QueueBind("testQu", "testEx", "key", nil); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func receiveLocalDelivery(t testing.TB, deliveries <-chan *Delivery) *Delivery {
+	select {
+	case delivery, ok := <-deliveries:
+		if !ok {
+			t.Fatal("Unexpected closed deliveries channel")
+		}
+		return delivery
+	case <-time.After(time.Second):
+		t.Fatal("Timeout on waiting delivery")
+	}
+	return nil
+}
+
+func Test_LocalClient_PublishConsume_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	client := getLocalClient(t, sc, 0)
+	defer client.Close()
+
+	msgCount := 10
+	for i := 0; i < msgCount; i++ {
+		messageID := strconv.Itoa(i)
+		if err := client.Publish("testEx", "key", &amqp.BasicPropertyList{MessageId: &messageID}, []byte("test"+messageID)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deliveries, err := client.Consume("testQu", "testCmr", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < msgCount; i++ {
+		delivery := receiveLocalDelivery(t, deliveries)
+		if string(delivery.Body) != "test"+strconv.Itoa(i) || *delivery.Properties.MessageId != strconv.Itoa(i) {
+			t.Fatalf("Expected message %d, actual '%s'", i, delivery.Body)
+		}
+		if delivery.ConsumerTag != "testCmr" || delivery.Exchange != "testEx" || delivery.RoutingKey != "key" {
+			t.Fatalf("Unexpected delivery %+v", delivery)
+		}
+		if err = client.Ack(delivery.DeliveryTag, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if length := sc.server.getVhost("/").GetQueue("testQu").Length(); length != 0 {
+		t.Fatalf("Expected empty queue, actual length %d", length)
+	}
+}
+
+func Test_LocalClient_Nack_Requeue(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	client := getLocalClient(t, sc, 0)
+	defer client.Close()
+
+	client.Publish("testEx", "key", nil, []byte("test"))
+	deliveries, _ := client.Consume("testQu", "", false)
+
+	delivery := receiveLocalDelivery(t, deliveries)
+	if delivery.Redelivered {
+		t.Fatal("Expected first delivery is not redelivered")
+	}
+	if err := client.Nack(delivery.DeliveryTag, false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	delivery = receiveLocalDelivery(t, deliveries)
+	if !delivery.Redelivered || string(delivery.Body) != "test" {
+		t.Fatalf("Expected redelivered message, actual %+v", delivery)
+	}
+	if err := client.Ack(delivery.DeliveryTag, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Ack(delivery.DeliveryTag, false); err == nil {
+		t.Fatal("Expected error on double ack")
+	}
+}
+
+func Test_LocalClient_Close_RequeueUnacked(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	client := getLocalClient(t, sc, 2)
+
+	msgCount := 5
+	for i := 0; i < msgCount; i++ {
+		client.Publish("testEx", "key", nil, []byte("test"))
+	}
+	deliveries, _ := client.Consume("testQu", "", false)
+	receiveLocalDelivery(t, deliveries)
+	receiveLocalDelivery(t, deliveries)
+	client.Close()
+
+	if _, ok := <-deliveries; ok {
+		t.Fatal("Expected deliveries channel closed")
+	}
+	if length := sc.server.getVhost("/").GetQueue("testQu").Length(); length != uint64(msgCount) {
+		t.Fatalf("Expected %d messages requeued, actual %d", msgCount, length)
+	}
+	if err := client.Publish("testEx", "key", nil, []byte("test")); err == nil {
+		t.Fatal("Expected error on publish into closed client")
+	}
+}
+
+func Test_LocalClient_Cancel_RequeueNotTaken(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	client := getLocalClient(t, sc, 0)
+	defer client.Close()
+
+	msgCount := 5
+	for i := 0; i < msgCount; i++ {
+		client.Publish("testEx", "key", nil, []byte(strconv.Itoa(i)))
+	}
+	deliveries, _ := client.Consume("testQu", "testCmr", false)
+	first := receiveLocalDelivery(t, deliveries)
+	// the rest of messages are delivered to consumer but not taken by client
+	time.Sleep(50 * time.Millisecond)
+	if err := client.Cancel("testCmr"); err != nil {
+		t.Fatal(err)
+	}
+	for range deliveries {
+	}
+
+	deliveries, _ = client.Consume("testQu", "", false)
+	for i := 1; i < msgCount; i++ {
+		delivery := receiveLocalDelivery(t, deliveries)
+		if string(delivery.Body) != strconv.Itoa(i) {
+			t.Fatalf("Expected message %d, actual %s", i, delivery.Body)
+		}
+	}
+	if err := client.Ack(first.DeliveryTag, false); err != nil {
+		t.Fatal("Expected delivery of cancelled consumer could be acked", err)
+	}
+}
+
+func Test_LocalClient_QueueDeleted_DeliveriesClosed(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	client := getLocalClient(t, sc, 0)
+	defer client.Close()
+
+	deliveries, _ := client.Consume("testQu", "", true)
+	if _, err := sc.server.getVhost("/").DeleteQueue("testQu", false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case _, ok := <-deliveries:
+		if ok {
+			t.Fatal("Unexpected delivery")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected deliveries channel closed on queue delete")
+	}
+}
+
+func Test_LocalClient_Failed(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	client := getLocalClient(t, sc, 0)
+	defer client.Close()
+
+	if _, err := sc.server.NewLocalClient("unknown", 0); err == nil {
+		t.Fatal("Expected error on unknown vhost")
+	}
+	if err := client.Publish("unknownEx", "key", nil, nil); err == nil {
+		t.Fatal("Expected error on publish into unknown exchange")
+	}
+	if _, err := client.Consume("unknownQu", "", false); err == nil {
+		t.Fatal("Expected error on consume from unknown queue")
+	}
+	if err := client.QueueDeclare("testQu", true, false); err == nil {
+		t.Fatal("Expected error on redeclare queue with other params")
+	}
+	if err := client.ExchangeDeclare("amq.test", "direct", false, false); err == nil {
+		t.Fatal("Expected error on declare exchange with reserved prefix")
+	}
+	if err := client.QueueBind("testQu", "", "key", nil); err == nil {
+		t.Fatal("Expected error on bind to default exchange")
+	}
+}
+
+func Test_LocalClient_AMQPConsumer_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	client := getLocalClient(t, sc, 0)
+	defer client.Close()
+	ch, _ := sc.client.Channel()
+
+	contentType := "text/plain"
+	client.Publish("testEx", "key", &amqp.BasicPropertyList{ContentType: &contentType}, []byte("local"))
+
+	msg, ok, err := ch.Get("testQu", true)
+	if err != nil || !ok {
+		t.Fatal("Expected message published by local client", err)
+	}
+	if string(msg.Body) != "local" || msg.ContentType != contentType {
+		t.Fatalf("Unexpected message %+v", msg)
+	}
+
+	// and back from AMQP publisher to local consumer
+	ch.Publish("testEx", "key", false, false, amqpclient.Publishing{Body: []byte("remote")})
+	deliveries, _ := client.Consume("testQu", "", true)
+	if delivery := receiveLocalDelivery(t, deliveries); string(delivery.Body) != "remote" {
+		t.Fatalf("Expected message published by AMQP client, actual %s", delivery.Body)
+	}
+}
+
+// BenchmarkLocalClient_PublishConsume measures publishing and consuming through in-process client
+func BenchmarkLocalClient_PublishConsume(b *testing.B) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	client := getLocalClient(b, sc, 100)
+	defer client.Close()
+
+	deliveries, _ := client.Consume("testQu", "", false)
+	body := make([]byte, 256)
+
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			client.Publish("testEx", "key", nil, body)
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		delivery := <-deliveries
+		client.Ack(delivery.DeliveryTag, false)
+	}
+}
+
+func Test_Tracer_Stages_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	slowStages := make(chan string, 10)
+	metrics.NewTracer(1, time.Nanosecond, func(stage string, duration time.Duration, fields map[string]interface{}) {
+		slowStages <- stage
+	})
+	defer metrics.DestroyTracer()
+
+	client, _ := sc.server.NewLocalClient("/", 0)
+	defer client.Close()
+	client.QueueDeclare("testQu", true, false)
+
+	deliveryMode := byte(2)
+	client.Publish("", "testQu", &amqp.BasicPropertyList{DeliveryMode: &deliveryMode}, []byte("test"))
+	deliveries, _ := client.Consume("testQu", "", true)
+	receiveLocalDelivery(t, deliveries)
+	time.Sleep(100 * time.Millisecond)
+
+	snapshots := metrics.TraceSnapshots()
+	for _, stage := range metrics.TraceStages {
+		if snapshots[stage].Count != 1 {
+			t.Fatalf("Expected 1 traced %s, actual %d", stage, snapshots[stage].Count)
+		}
+	}
+	if len(slowStages) != len(metrics.TraceStages) {
+		t.Fatalf("Expected all stages logged as slow, actual %d", len(slowStages))
+	}
+
+	metrics.NewTracer(0, 0, nil)
+	client.Publish("", "testQu", nil, []byte("test"))
+	receiveLocalDelivery(t, deliveries)
+	if snapshots = metrics.TraceSnapshots(); snapshots[metrics.TraceRouting].Count != 0 {
+		t.Fatal("Expected message is not traced with zero sample rate")
+	}
+}
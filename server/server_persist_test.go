@@ -1,8 +1,18 @@
 package server
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
 	"testing"
+	"time"
 
+	amqpclient "github.com/streadway/amqp"
+	"github.com/valinurovam/garagemq/amqp"
 	"github.com/valinurovam/garagemq/exchange"
 )
 
@@ -50,3 +60,578 @@ func Test_ServerPersist_Exchange_Success(t *testing.T) {
 		t.Fatal("Expected topic exchange")
 	}
 }
+
+func Test_ServerPersist_Binding_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("testExTopic", "topic", true, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu", true, false, false, false, emptyTable)
+	ch.QueueBind("testQu", "a.*.c", "testExTopic", false, emptyTable)
+	sc.server.Stop()
+
+	sc, _ = getNewSC(getDefaultTestConfig())
+	ch, _ = sc.client.Channel()
+
+	bindings := sc.server.getVhost("/").GetExchange("testExTopic").GetBindings()
+	if len(bindings) != 1 {
+		t.Fatalf("Expected 1 binding after server restart, actual %d", len(bindings))
+	}
+
+	ch.Publish("testExTopic", "a.b.c", false, false, amqpclient.Publishing{Body: []byte("test")})
+	time.Sleep(50 * time.Millisecond)
+
+	if _, ok, err := ch.Get("testQu", true); err != nil || !ok {
+		t.Fatal("Expected message routed by restored binding", err)
+	}
+}
+
+func Test_ServerPersist_Messages_Order_Success(t *testing.T) {
+	for _, engine := range []string{"badger", "buntdb"} {
+		cfg := getDefaultTestConfig()
+		cfg.srvConfig.Db.Engine = engine
+
+		sc, _ := getNewSC(cfg)
+		ch, _ := sc.client.Channel()
+
+		ch.QueueDeclare("testQu", true, false, false, false, emptyTable)
+		msgCount := 25
+		for i := 1; i <= msgCount; i++ {
+			ch.Publish("", "testQu", false, false, amqpclient.Publishing{
+				Body:         []byte(strconv.Itoa(i)),
+				DeliveryMode: amqpclient.Persistent,
+			})
+		}
+		time.Sleep(100 * time.Millisecond)
+		sc.server.Stop()
+
+		sc, _ = getNewSC(cfg)
+		ch, _ = sc.client.Channel()
+
+		for i := 1; i <= msgCount; i++ {
+			msg, ok, err := ch.Get("testQu", true)
+			if err != nil || !ok {
+				t.Fatalf("Expected message %d after server restart with %s engine", i, engine)
+			}
+			if string(msg.Body) != strconv.Itoa(i) {
+				t.Fatalf("Expected message %d, actual %s with %s engine", i, msg.Body, engine)
+			}
+		}
+		sc.clean()
+	}
+}
+
+func Test_ServerPersist_SpooledMessage_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Db.SpoolThreshold = 1024
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQu", true, false, false, false, emptyTable)
+	body := bytes.Repeat([]byte("0123456789"), 10000)
+	ch.Publish("", "testQu", false, false, amqpclient.Publishing{Body: body, DeliveryMode: amqpclient.Persistent})
+	time.Sleep(100 * time.Millisecond)
+	sc.server.Stop()
+
+	sc, _ = getNewSC(cfg)
+	ch, _ = sc.client.Channel()
+
+	msg, ok, err := ch.Get("testQu", true)
+	if err != nil || !ok || !bytes.Equal(msg.Body, body) {
+		t.Fatal("Expected spooled message restored after server restart", err)
+	}
+}
+
+func Test_ServerPersist_SpooledMessage_PurgeDelete(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Db.SpoolThreshold = 1024
+	cfg.srvConfig.Queue.MaxMessagesInRam = 2
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	spoolFiles := func() int {
+		files, _ := ioutil.ReadDir(cfg.srvConfig.Db.DefaultPath + "/spool")
+		return len(files)
+	}
+	body := bytes.Repeat([]byte("0123456789"), 1000)
+	publish := func() {
+		for i := 0; i < 10; i++ {
+			ch.Publish("", "testQu", false, false, amqpclient.Publishing{Body: body, DeliveryMode: amqpclient.Persistent})
+		}
+		time.Sleep(100 * time.Millisecond)
+		if spoolFiles() != 10 {
+			t.Fatalf("Expected %d spool files, actual %d", 10, spoolFiles())
+		}
+	}
+
+	// messages swapped to disk are released too
+	ch.QueueDeclare("testQu", true, false, false, false, emptyTable)
+	publish()
+	if _, err := ch.QueuePurge("testQu", false); err != nil {
+		t.Fatal(err)
+	}
+	if spoolFiles() != 0 {
+		t.Fatalf("Expected spool files removed on purge, actual %d", spoolFiles())
+	}
+
+	publish()
+	if _, err := ch.QueueDelete("testQu", false, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if spoolFiles() != 0 {
+		t.Fatalf("Expected spool files removed on delete, actual %d", spoolFiles())
+	}
+}
+
+func Test_ServerPersist_LazyBodies_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Queue.LazyBodies = true
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQu", true, false, false, false, emptyTable)
+	msgCount := 10
+	for i := 1; i <= msgCount; i++ {
+		ch.Publish("", "testQu", false, false, amqpclient.Publishing{
+			Body:         []byte(strconv.Itoa(i)),
+			DeliveryMode: amqpclient.Persistent,
+		})
+	}
+
+	// body of message not written into storage yet is read too
+	msg, ok, err := ch.Get("testQu", false)
+	if err != nil || !ok || string(msg.Body) != "1" {
+		t.Fatal("Expected first message with body", err)
+	}
+	msg.Nack(false, true)
+
+	time.Sleep(100 * time.Millisecond)
+	sc.server.Stop()
+
+	sc, _ = getNewSC(cfg)
+	ch, _ = sc.client.Channel()
+
+	for i := 1; i <= msgCount; i++ {
+		msg, ok, err := ch.Get("testQu", true)
+		if err != nil || !ok {
+			t.Fatalf("Expected message %d after server restart", i)
+		}
+		if string(msg.Body) != strconv.Itoa(i) {
+			t.Fatalf("Expected message %d, actual %s", i, msg.Body)
+		}
+	}
+}
+
+func Test_ServerPersist_EmptyBody_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQu", true, false, false, false, emptyTable)
+	ch.Publish("", "testQu", false, false, amqpclient.Publishing{MessageId: "empty", DeliveryMode: amqpclient.Persistent})
+	time.Sleep(100 * time.Millisecond)
+	sc.server.Stop()
+
+	sc, _ = getNewSC(cfg)
+	ch, _ = sc.client.Channel()
+
+	msg, ok, err := ch.Get("testQu", true)
+	if err != nil || !ok {
+		t.Fatal("Expected empty body message restored after server restart", err)
+	}
+	if len(msg.Body) != 0 || msg.MessageId != "empty" {
+		t.Fatalf("Expected empty body with message id, actual %q %q", msg.Body, msg.MessageId)
+	}
+}
+
+func Test_ServerPersist_MsgID_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	message := &amqp.Message{}
+	message.GenerateSeq()
+	if sc.server.storage.GetLastMsgID() < message.ID {
+		t.Fatal("Expected message id bound stored before id is used")
+	}
+
+	// e.g. clock goes back between restarts
+	future := uint64(time.Now().Add(time.Hour).UnixNano())
+	sc.server.storage.SetLastMsgID(future)
+	sc.server.Stop()
+
+	sc, _ = getNewSC(getDefaultTestConfig())
+	message = &amqp.Message{}
+	message.GenerateSeq()
+	if message.ID <= future {
+		t.Fatalf("Expected message id greater than stored bound %d, actual %d", future, message.ID)
+	}
+}
+
+func Test_ServerPersist_DurableQueue_TransientMessages(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	// message persistence depends only on delivery mode, queue durability decides only is queue restored
+	ch.QueueDeclare("testQuDurable", true, false, false, false, emptyTable)
+	ch.QueueDeclare("testQuTransient", false, false, false, false, emptyTable)
+	for _, queue := range []string{"testQuDurable", "testQuTransient"} {
+		ch.Publish("", queue, false, false, amqpclient.Publishing{Body: []byte("persistent"), DeliveryMode: amqpclient.Persistent})
+		ch.Publish("", queue, false, false, amqpclient.Publishing{Body: []byte("transient"), DeliveryMode: amqpclient.Transient})
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for _, queue := range []string{"testQuDurable", "testQuTransient"} {
+		if length := sc.server.getVhost("/").GetQueue(queue).Length(); length != 2 {
+			t.Fatalf("Expected 2 messages in queue %s before restart, actual %d", queue, length)
+		}
+	}
+	sc.server.Stop()
+
+	sc, _ = getNewSC(getDefaultTestConfig())
+	ch, _ = sc.client.Channel()
+
+	if sc.server.getVhost("/").GetQueue("testQuTransient") != nil {
+		t.Fatal("Expected non durable queue dropped after restart")
+	}
+
+	msg, ok, err := ch.Get("testQuDurable", true)
+	if err != nil || !ok || string(msg.Body) != "persistent" {
+		t.Fatal("Expected persistent message restored in durable queue after restart", err)
+	}
+	if _, ok, _ := ch.Get("testQuDurable", true); ok {
+		t.Fatal("Expected transient message dropped from durable queue after restart")
+	}
+}
+
+func Test_ServerPersist_DeadLetter_DeliveryMode(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testDlx", true, false, false, false, emptyTable)
+	ch.QueueDeclare("testDlxForced", true, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu", true, false, false, false, amqpclient.Table{"x-dead-letter-exchange": "", "x-dead-letter-routing-key": "testDlx"})
+	ch.QueueDeclare("testQuForced", true, false, false, false, amqpclient.Table{
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": "testDlxForced",
+		"x-dead-letter-persistent":  true,
+	})
+
+	// persistent message keeps delivery mode, transient one is forced persistent
+	ch.Publish("", "testQu", false, false, amqpclient.Publishing{Body: []byte("persistent"), DeliveryMode: amqpclient.Persistent})
+	ch.Publish("", "testQu", false, false, amqpclient.Publishing{Body: []byte("transient"), DeliveryMode: amqpclient.Transient})
+	ch.Publish("", "testQuForced", false, false, amqpclient.Publishing{Body: []byte("forced"), DeliveryMode: amqpclient.Transient})
+	for _, queue := range []string{"testQu", "testQu", "testQuForced"} {
+		msg, ok, _ := ch.Get(queue, false)
+		if !ok {
+			t.Fatalf("Expected message in queue %s", queue)
+		}
+		msg.Reject(false)
+	}
+	time.Sleep(100 * time.Millisecond)
+	sc.server.Stop()
+
+	sc, _ = getNewSC(getDefaultTestConfig())
+	ch, _ = sc.client.Channel()
+
+	msg, ok, _ := ch.Get("testDlx", true)
+	if !ok || string(msg.Body) != "persistent" || msg.DeliveryMode != amqpclient.Persistent {
+		t.Fatal("Expected persistent dead-lettered message restored after restart")
+	}
+	if _, ok, _ := ch.Get("testDlx", true); ok {
+		t.Fatal("Expected transient dead-lettered message dropped after restart")
+	}
+	msg, ok, _ = ch.Get("testDlxForced", true)
+	if !ok || string(msg.Body) != "forced" || msg.DeliveryMode != amqpclient.Persistent {
+		t.Fatal("Expected message forced persistent on dead-letter restored after restart")
+	}
+	if deadLetter := sc.server.getVhost("/").GetQueue("testQuForced").GetDeadLetter(); deadLetter == nil || !deadLetter.Persistent {
+		t.Fatalf("Expected x-dead-letter-persistent restored after restart, actual %v", deadLetter)
+	}
+}
+
+func Test_ServerPersist_Messages_Order_Swapped(t *testing.T) {
+	// ids of different decimal width, so key order differs from id order without fixed width keys
+	amqp.SetIDGenerator(amqp.NewSeqIDGenerator(0))
+	defer amqp.SetIDGenerator(amqp.NewSeqIDGenerator(uint64(time.Now().UnixNano())))
+
+	for _, engine := range []string{"badger", "buntdb"} {
+		cfg := getDefaultTestConfig()
+		cfg.srvConfig.Db.Engine = engine
+		cfg.srvConfig.Queue.MaxMessagesInRam = 4
+
+		sc, _ := getNewSC(cfg)
+		ch, _ := sc.client.Channel()
+
+		ch.QueueDeclare("testQu", true, false, false, false, emptyTable)
+		msgCount := 25
+		for i := 1; i <= msgCount; i++ {
+			ch.Publish("", "testQu", false, false, amqpclient.Publishing{
+				Body:         []byte(strconv.Itoa(i)),
+				DeliveryMode: amqpclient.Persistent,
+			})
+		}
+		time.Sleep(100 * time.Millisecond)
+		sc.server.Stop()
+
+		sc, _ = getNewSC(cfg)
+		ch, _ = sc.client.Channel()
+
+		for i := 1; i <= msgCount; i++ {
+			msg, ok, err := ch.Get("testQu", true)
+			if err != nil || !ok {
+				t.Fatalf("Expected message %d after server restart with %s engine", i, engine)
+			}
+			if string(msg.Body) != strconv.Itoa(i) {
+				t.Fatalf("Expected message %d, actual %s with %s engine", i, msg.Body, engine)
+			}
+		}
+		sc.clean()
+	}
+}
+
+func Test_ServerPersist_FindMessages_Swapped(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Queue.MaxMessagesInRam = 2
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQu", true, false, false, false, emptyTable)
+	for i := 0; i < 5; i++ {
+		ch.Publish("", "testQu", false, false, amqpclient.Publishing{
+			Body:         []byte("test" + strconv.Itoa(i)),
+			MessageId:    strconv.Itoa(i),
+			DeliveryMode: amqpclient.Persistent,
+		})
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	qu := sc.server.getVhost("/").GetQueue("testQu")
+	messages := qu.FindMessages(0, func(message *amqp.Message) bool { return true })
+	if len(messages) != 5 {
+		t.Fatalf("Expected %d messages found in memory and storage, actual %d", 5, len(messages))
+	}
+	for _, expected := range messages {
+		message := qu.GetMessage(expected.ID)
+		if message == nil || *message.Header.PropertyList.MessageId != *expected.Header.PropertyList.MessageId {
+			t.Fatalf("Expected message %d found by id", expected.ID)
+		}
+	}
+	if qu.GetMessage(messages[4].ID+100) != nil {
+		t.Fatal("Expected unknown message id not found")
+	}
+
+	messages = qu.FindMessages(1, func(message *amqp.Message) bool {
+		return *message.Header.PropertyList.MessageId == "4"
+	})
+	if len(messages) != 1 || messages[0].Body[0].Payload[4] != '4' {
+		t.Fatal("Expected swapped message found by message-id property")
+	}
+	if length := qu.Length(); length != 5 {
+		t.Fatalf("Expected messages kept in queue, actual length %d", length)
+	}
+}
+
+func Test_ServerPersist_QueueMessageTTL_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQu", true, false, false, false, amqpclient.Table{"x-message-ttl": int32(100000)})
+	sc.server.Stop()
+
+	sc, _ = getNewSC(getDefaultTestConfig())
+	if ttl := sc.server.getVhost("/").GetQueue("testQu").GetMessageTTL(); ttl != 100000 {
+		t.Fatalf("Expected x-message-ttl %d restored after restart, actual %d", 100000, ttl)
+	}
+}
+
+func Test_ServerPersist_Meta_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	args := amqpclient.Table{"x-meta-owner": "billing", "x-meta-team": "payments", "x-message-ttl": int32(100000)}
+	ch.QueueDeclare("testQu", true, false, false, false, args)
+	ch.ExchangeDeclare("testEx", "direct", true, false, false, false, amqpclient.Table{"x-meta-owner": "billing"})
+	sc.server.Stop()
+
+	sc, _ = getNewSC(getDefaultTestConfig())
+	vhost := sc.server.getVhost("/")
+
+	meta := vhost.GetQueue("testQu").GetMeta()
+	if meta == nil || len(*meta) != 2 || (*meta)["x-meta-owner"] != "billing" || (*meta)["x-meta-team"] != "payments" {
+		t.Fatalf("Expected queue metadata restored after restart, actual %v", meta)
+	}
+	meta = vhost.GetExchange("testEx").GetMeta()
+	if meta == nil || len(*meta) != 1 || (*meta)["x-meta-owner"] != "billing" {
+		t.Fatalf("Expected exchange metadata restored after restart, actual %v", meta)
+	}
+}
+
+func Test_ServerPersist_VhostPath_Success(t *testing.T) {
+	vhostPath := "db_test_vhost"
+	defer os.RemoveAll(vhostPath)
+
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Db.VhostPaths = map[string]string{"/": vhostPath}
+
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQu", true, false, false, false, emptyTable)
+	ch.Publish("", "testQu", false, false, amqpclient.Publishing{Body: []byte("test"), DeliveryMode: amqpclient.Persistent})
+	time.Sleep(100 * time.Millisecond)
+	sc.server.Stop()
+
+	h := md5.New()
+	h.Write([]byte("vhost_default"))
+	storageDir := fmt.Sprintf("%s/badger/%s", vhostPath, hex.EncodeToString(h.Sum(nil)))
+	if _, err := os.Stat(storageDir); err != nil {
+		t.Fatal("Expected vhost messages stored at vhost path", err)
+	}
+	if _, err := os.Stat(fmt.Sprintf("%s/badger/%s", cfg.srvConfig.Db.DefaultPath, hex.EncodeToString(h.Sum(nil)))); !os.IsNotExist(err) {
+		t.Fatal("Expected no vhost messages at default path")
+	}
+
+	sc, _ = getNewSC(cfg)
+	ch, _ = sc.client.Channel()
+
+	if msg, ok, err := ch.Get("testQu", true); err != nil || !ok || string(msg.Body) != "test" {
+		t.Fatal("Expected message restored from vhost path after restart", err)
+	}
+}
+
+func Test_ServerPersist_QueueStorage_Success(t *testing.T) {
+	storagePath := "db_test_ssd"
+	defer os.RemoveAll(storagePath)
+
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Db.Storages = map[string]string{"ssd": storagePath, "default": cfg.srvConfig.Db.DefaultPath}
+
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if _, err := ch.QueueDeclare("testQu", true, false, false, false, amqpclient.Table{"x-queue-storage": "ssd"}); err != nil {
+		t.Fatal(err)
+	}
+	ch.QueueDeclare("testQuDefault", true, false, false, false, amqpclient.Table{"x-queue-storage": "default"})
+	ch.Publish("", "testQu", false, false, amqpclient.Publishing{Body: []byte("test"), DeliveryMode: amqpclient.Persistent})
+	ch.Publish("", "testQuDefault", false, false, amqpclient.Publishing{Body: []byte("test"), DeliveryMode: amqpclient.Persistent})
+	time.Sleep(100 * time.Millisecond)
+
+	vhost := sc.server.getVhost("/")
+	if stats := vhost.GetQueueStorageStats("testQu"); stats.Messages != 1 {
+		t.Fatalf("Expected message stored at queue storage, actual %+v", stats)
+	}
+	if stats := vhost.msgStorageP.GetQueueStats("testQu"); stats.Messages != 0 {
+		t.Fatalf("Expected no message at default storage, actual %+v", stats)
+	}
+	// storage of the same path as vhost one is not opened twice
+	if stats := vhost.msgStorageP.GetQueueStats("testQuDefault"); stats.Messages != 1 {
+		t.Fatalf("Expected message at default storage, actual %+v", stats)
+	}
+	if used := vhost.StorageUsed(); used != vhost.GetQueueStorageStats("testQu").Bytes+vhost.GetQueueStorageStats("testQuDefault").Bytes {
+		t.Fatalf("Expected storage used counts all storages, actual %d", used)
+	}
+	sc.server.Stop()
+
+	h := md5.New()
+	h.Write([]byte("vhost_default"))
+	if _, err := os.Stat(fmt.Sprintf("%s/badger/%s", storagePath, hex.EncodeToString(h.Sum(nil)))); err != nil {
+		t.Fatal("Expected queue messages stored at storage path", err)
+	}
+
+	sc, _ = getNewSC(cfg)
+	ch, _ = sc.client.Channel()
+
+	if qu := sc.server.getVhost("/").GetQueue("testQu"); qu == nil || qu.GetStorageName() != "ssd" {
+		t.Fatal("Expected queue restored with its storage")
+	}
+	if msg, ok, err := ch.Get("testQu", true); err != nil || !ok || string(msg.Body) != "test" {
+		t.Fatal("Expected message restored from queue storage after restart", err)
+	}
+	if _, err := ch.QueueDeclare("testQu", true, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected error on redeclare queue with other storage")
+	}
+}
+
+func Test_QueueStorage_Failed(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if _, err := ch.QueueDeclare("testQu", true, false, false, false, amqpclient.Table{"x-queue-storage": "unknown"}); err == nil {
+		t.Fatal("Expected error on unknown queue storage")
+	}
+	ch, _ = sc.client.Channel()
+	if _, err := ch.QueueDeclare("testQu", true, false, false, false, amqpclient.Table{"x-queue-storage": int32(1)}); err == nil {
+		t.Fatal("Expected error on not string queue storage")
+	}
+}
+
+func Test_ServerPersist_QueueStorageStats(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	sc, _ := getNewSC(cfg)
+	ch, _ := sc.client.Channel()
+
+	// queue name with dots is parsed from message keys as well
+	ch.QueueDeclare("test.qu", true, false, false, false, emptyTable)
+	msgCount := 10
+	for i := 0; i < msgCount; i++ {
+		ch.Publish("", "test.qu", false, false, amqpclient.Publishing{Body: []byte("test"), DeliveryMode: amqpclient.Persistent})
+	}
+	ch.Publish("", "test.qu", false, false, amqpclient.Publishing{Body: []byte("transient")})
+	time.Sleep(100 * time.Millisecond)
+
+	stats := sc.server.getVhost("/").GetQueueStorageStats("test.qu")
+	if stats.Messages != int64(msgCount) || stats.Bytes <= 0 {
+		t.Fatalf("Expected %d stored messages, actual %+v", msgCount, stats)
+	}
+	if used := sc.server.getVhost("/").StorageUsed(); used != stats.Bytes {
+		t.Fatalf("Expected %d bytes used, actual %d", stats.Bytes, used)
+	}
+	sc.server.Stop()
+
+	sc, _ = getNewSC(cfg)
+	defer sc.clean()
+	ch, _ = sc.client.Channel()
+
+	if loaded := sc.server.getVhost("/").GetQueueStorageStats("test.qu"); loaded != stats {
+		t.Fatalf("Expected %+v stored after server restart, actual %+v", stats, loaded)
+	}
+	if used := sc.server.getVhost("/").StorageUsed(); used != stats.Bytes {
+		t.Fatalf("Expected %d bytes used after server restart, actual %d", stats.Bytes, used)
+	}
+
+	for i := 0; i < 4; i++ {
+		msg, ok, err := ch.Get("test.qu", false)
+		if err != nil || !ok {
+			t.Fatal("Expected message", err)
+		}
+		msg.Ack(false)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	left := sc.server.getVhost("/").GetQueueStorageStats("test.qu")
+	if left.Messages != int64(msgCount-4) || left.Bytes != stats.Bytes/int64(msgCount)*int64(msgCount-4) {
+		t.Fatalf("Expected %d stored messages after get, actual %+v", msgCount-4, left)
+	}
+
+	ch.QueuePurge("test.qu", false)
+	if purged := sc.server.getVhost("/").GetQueueStorageStats("test.qu"); purged.Messages != 0 || purged.Bytes != 0 {
+		t.Fatalf("Expected no stored messages after purge, actual %+v", purged)
+	}
+	if used := sc.server.getVhost("/").StorageUsed(); used != 0 {
+		t.Fatalf("Expected %d bytes used, actual %d", 0, used)
+	}
+}
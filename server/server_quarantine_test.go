@@ -0,0 +1,102 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	amqpclient "github.com/streadway/amqp"
+)
+
+func Test_SafeMode_QuarantineQueue(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.Confirm(false)
+	confirms := ch.NotifyPublish(make(chan amqpclient.Confirmation, 1))
+
+	ch.ExchangeDeclare("testEx", "direct", true, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu", true, false, false, false, emptyTable)
+	ch.QueueDeclare("testQuOk", true, false, false, false, emptyTable)
+	ch.QueueBind("testQu", "key", "testEx", false, emptyTable)
+	ch.QueueBind("testQuOk", "key", "testEx", false, emptyTable)
+	ch.Publish("testEx", "key", false, false, amqpclient.Publishing{Body: []byte("test"), DeliveryMode: amqpclient.Persistent})
+	select {
+	case <-confirms:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout on waiting confirm")
+	}
+	sc.server.Stop()
+
+	// queue record is cut after name
+	cfg := getDefaultTestConfig()
+	srv, _ := NewServer("localhost", "0", proto, &cfg.srvConfig)
+	storage := srv.getStorageInstance(cfg.srvConfig.Db.DefaultPath, "server", true)
+	storage.Set("vhost.queue./.testQu", []byte{6, 't', 'e', 's', 't', 'Q', 'u'})
+	storage.Close()
+
+	cfg.srvConfig.Db.SafeMode = true
+	sc, _ = getNewSC(cfg)
+	vhost := sc.server.getVhost("/")
+
+	quarantined := vhost.GetQuarantinedQueues()
+	if len(quarantined) != 1 || quarantined[0].Name != "testQu" || quarantined[0].Error == "" {
+		t.Fatalf("Expected quarantined queue 'testQu', actual %v", quarantined)
+	}
+	if vhost.GetQueue("testQu") != nil {
+		t.Fatal("Expected quarantined queue is not restored")
+	}
+	if qu := vhost.GetQueue("testQuOk"); qu == nil || qu.Length() != 1 {
+		t.Fatal("Expected healthy queue restored with its message")
+	}
+	if length := vhost.msgStorageP.GetQueueLength("testQu"); length != 1 {
+		t.Fatalf("Expected messages of quarantined queue kept in storage, actual %d", length)
+	}
+
+	ch, _ = sc.client.Channel()
+	if _, err := ch.QueueDeclare("testQu", true, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected error on declare of quarantined queue")
+	}
+
+	if err := vhost.DropQuarantinedQueue("testQu"); err != nil {
+		t.Fatal(err)
+	}
+	if err := vhost.DropQuarantinedQueue("testQu"); err == nil {
+		t.Fatal("Expected error on drop of not quarantined queue")
+	}
+	if len(vhost.GetQuarantinedQueues()) != 0 {
+		t.Fatal("Expected no quarantined queues after drop")
+	}
+	if length := vhost.msgStorageP.GetQueueLength("testQu"); length != 0 {
+		t.Fatalf("Expected messages of dropped queue removed from storage, actual %d", length)
+	}
+	for _, bind := range sc.server.storage.GetVhostBindings("/") {
+		if bind.Queue == "testQu" {
+			t.Fatal("Expected bindings of dropped queue removed from storage")
+		}
+	}
+
+	ch, _ = sc.client.Channel()
+	if _, err := ch.QueueDeclare("testQu", true, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+	if length := vhost.GetQueue("testQu").Length(); length != 0 {
+		t.Fatalf("Expected empty queue declared after drop, actual %d", length)
+	}
+}
+
+func Test_SafeMode_Disabled_AbortsStartup(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	vhost := sc.server.getVhost("/")
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected panic on failed queue recovery without safe mode")
+		}
+		if len(vhost.GetQuarantinedQueues()) != 0 {
+			t.Fatal("Expected queue is not quarantined without safe mode")
+		}
+	}()
+	vhost.quarantineQueue("testQu", errors.New("corrupt"))
+}
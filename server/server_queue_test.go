@@ -1,10 +1,17 @@
 package server
 
 import (
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/streadway/amqp"
+	amqp2 "github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/binding"
+	"github.com/valinurovam/garagemq/config"
+	"github.com/valinurovam/garagemq/metrics"
+	"github.com/valinurovam/garagemq/queue"
 )
 
 func Test_QueueDeclare_Success(t *testing.T) {
@@ -34,7 +41,7 @@ func Test_QueueDeclareDurable_Success(t *testing.T) {
 		t.Fatal("Queue does not exists after 'QueueDeclare'")
 	}
 
-	storedQueues := sc.server.storage.GetVhostQueues("/")
+	storedQueues, _ := sc.server.storage.GetVhostQueues("/")
 	if len(storedQueues) == 0 {
 		t.Fatal("Queue does not exists into storage after 'QueueDeclareDurable'")
 	}
@@ -96,13 +103,194 @@ func Test_QueueDeclare_Failed_RedeclareNotEqual(t *testing.T) {
 	}
 }
 
-func Test_QueueDeclare_Failed_EmptyName(t *testing.T) {
+func Test_QueueDeclare_Failed_EmptyNamePassive(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
 	ch, _ := sc.client.Channel()
 
-	if _, err := ch.QueueDeclare("", false, false, false, false, emptyTable); err == nil {
-		t.Fatal("Expected: queue name is required error")
+	if _, err := ch.QueueDeclarePassive("", false, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected: no previously declared queue error")
+	}
+}
+
+func Test_QueueDeclare_ServerNamed_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	qu, err := ch.QueueDeclare("", false, true, true, false, emptyTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(qu.Name, serverNamedQueuePrefix) || sc.server.getVhost("/").GetQueue(qu.Name) == nil {
+		t.Fatalf("Expected server-named queue, actual name '%s'", qu.Name)
+	}
+
+	other, _ := ch.QueueDeclare("", false, true, true, false, emptyTable)
+	if other.Name == qu.Name {
+		t.Fatalf("Expected unique names of server-named queues, both are '%s'", qu.Name)
+	}
+
+	// methods with empty queue name refer to the last declared queue
+	if err := ch.QueueBind("", "key", "amq.direct", false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+	bindings := sc.server.getVhost("/").GetExchange("amq.direct").GetBindings()
+	if len(bindings) != 1 || bindings[0].Queue != other.Name {
+		t.Fatalf("Expected last declared queue '%s' bound, actual bindings %v", other.Name, bindings)
+	}
+
+	msgs, err := ch.Consume(qu.Name, "tag", true, false, false, false, emptyTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.Publish("", qu.Name, false, false, amqp.Publishing{Body: []byte("test")})
+	select {
+	case msg := <-msgs:
+		if string(msg.Body) != "test" {
+			t.Fatalf("Unexpected message %s", msg.Body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected message from server-named queue")
+	}
+}
+
+func Test_QueueDeclare_MessageTTL_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if _, err := ch.QueueDeclare("test", false, false, false, false, amqp.Table{"x-message-ttl": int32(1000)}); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := sc.server.getVhost("/").GetQueue("test").GetMessageTTL(); ttl != 1000 {
+		t.Fatalf("Expected x-message-ttl %d, actual %d", 1000, ttl)
+	}
+
+	if _, err := ch.QueueDeclare("test", false, false, false, false, amqp.Table{"x-message-ttl": int64(1000)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("test", false, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected: x-message-ttl inequivalent error")
+	}
+}
+
+func Test_QueueDeclare_Failed_InvalidMessageTTL(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	for _, ttl := range []interface{}{int32(-1), "1000"} {
+		ch, _ := sc.client.Channel()
+		if _, err := ch.QueueDeclare("test", false, false, false, false, amqp.Table{"x-message-ttl": ttl}); err == nil {
+			t.Fatalf("Expected: invalid x-message-ttl %v error", ttl)
+		}
+	}
+}
+
+func Test_QueueDeclare_ConsumerTimeout_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if _, err := ch.QueueDeclare("test", false, false, false, false, amqp.Table{"x-consumer-timeout": int32(5000)}); err != nil {
+		t.Fatal(err)
+	}
+	if timeout := sc.server.getVhost("/").GetQueue("test").GetConsumerTimeout(); timeout != 5000 {
+		t.Fatalf("Expected x-consumer-timeout %d, actual %d", 5000, timeout)
+	}
+	if _, err := ch.QueueDeclare("test", false, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected: x-consumer-timeout inequivalent error")
+	}
+
+	for _, timeout := range []interface{}{int32(-1), "1000"} {
+		ch, _ := sc.client.Channel()
+		if _, err := ch.QueueDeclare("test2", false, false, false, false, amqp.Table{"x-consumer-timeout": timeout}); err == nil {
+			t.Fatalf("Expected: invalid x-consumer-timeout %v error", timeout)
+		}
+	}
+}
+
+func Test_QueueDeclare_DeadLetter_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	args := amqp.Table{"x-dead-letter-exchange": "dlx", "x-dead-letter-routing-key": "key"}
+	if _, err := ch.QueueDeclare("test", false, false, false, false, args); err != nil {
+		t.Fatal(err)
+	}
+	deadLetter := sc.server.getVhost("/").GetQueue("test").GetDeadLetter()
+	if deadLetter == nil || deadLetter.Exchange != "dlx" || deadLetter.RoutingKey != "key" {
+		t.Fatalf("Unexpected dead-letter exchange %v", deadLetter)
+	}
+
+	if _, err := ch.QueueDeclare("test", false, false, false, false, args); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("test", false, false, false, false, amqp.Table{"x-dead-letter-exchange": "dlx"}); err == nil {
+		t.Fatal("Expected: x-dead-letter-exchange inequivalent error")
+	}
+}
+
+func Test_QueueDeclare_Failed_InvalidDeadLetter(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	for _, args := range []amqp.Table{
+		{"x-dead-letter-exchange": int32(1)},
+		{"x-dead-letter-routing-key": "key"},
+		{"x-dead-letter-persistent": true},
+		{"x-dead-letter-exchange": "dlx", "x-dead-letter-persistent": "yes"},
+	} {
+		ch, _ := sc.client.Channel()
+		if _, err := ch.QueueDeclare("test", false, false, false, false, args); err == nil {
+			t.Fatalf("Expected: invalid dead-letter arguments %v error", args)
+		}
+	}
+}
+
+func Test_QueueDeclare_Defaults_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Queue.Defaults = config.QueueDefaults{
+		Durable: true,
+		Arguments: map[string]interface{}{
+			"x-message-ttl":          1000,
+			"x-dead-letter-exchange": "dlx",
+			"x-unsupported":          []interface{}{1},
+		},
+	}
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	vhost := sc.server.getVhost("/")
+
+	if _, err := ch.QueueDeclare("test", false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+	qu := vhost.GetQueue("test")
+	if !qu.IsDurable() || qu.GetMessageTTL() != 1000 || qu.GetDeadLetter() == nil || qu.GetDeadLetter().Exchange != "dlx" {
+		t.Fatal("Expected queue declared with default flags and arguments")
+	}
+	// redeclare gets the same defaults
+	if _, err := ch.QueueDeclare("test", false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+
+	// client arguments take precedence
+	args := amqp.Table{"x-message-ttl": int32(5000)}
+	if _, err := ch.QueueDeclare("testOverride", false, false, false, false, args); err != nil {
+		t.Fatal(err)
+	}
+	qu = vhost.GetQueue("testOverride")
+	if qu.GetMessageTTL() != 5000 || qu.GetDeadLetter() == nil {
+		t.Fatalf("Expected client message TTL and default dead-letter exchange, actual %d", qu.GetMessageTTL())
+	}
+
+	if _, err := ch.QueueDeclare("testExclusive", false, false, true, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+	if vhost.GetQueue("testExclusive").IsDurable() {
+		t.Fatal("Expected exclusive queue is not made durable")
 	}
 }
 
@@ -293,6 +481,89 @@ func Test_QueueUnbind_Success(t *testing.T) {
 	}
 }
 
+func Test_QueueUnbind_OnlyMatchedBinding(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("testEx", "direct", true, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu", true, false, false, false, emptyTable)
+
+	ch.QueueBind("testQu", "key", "testEx", false, emptyTable)
+	ch.QueueBind("testQu", "key2", "testEx", false, emptyTable)
+	ch.QueueBind("testQu", "key", "testEx", false, amqp.Table{"x-match": "all", "format": "pdf"})
+	ch.QueueBind("testQu", "key", "testEx", false, amqp.Table{"x-match": "any", "format": "pdf"})
+
+	ex := sc.server.getVhost("/").GetExchange("testEx")
+	if l := len(ex.GetBindings()); l != 4 {
+		t.Fatalf("Expected 4 bindings, actual %d", l)
+	}
+
+	if err := ch.QueueUnbind("testQu", "key", "testEx", amqp.Table{"format": "pdf", "x-match": "all"}); err != nil {
+		t.Fatal(err)
+	}
+	bindings := ex.GetBindings()
+	if len(bindings) != 3 {
+		t.Fatalf("Expected 3 bindings after unbind, actual %d", len(bindings))
+	}
+	for _, bind := range bindings {
+		if bind.GetRoutingKey() == "key" && (*bind.Arguments)["x-match"] == "all" {
+			t.Fatal("Unbound binding still exists")
+		}
+	}
+
+	// unbind of not existed binding removes nothing
+	if err := ch.QueueUnbind("testQu", "key", "testEx", amqp.Table{"x-match": "all"}); err != nil {
+		t.Fatal(err)
+	}
+	if l := len(ex.GetBindings()); l != 3 {
+		t.Fatalf("Expected 3 bindings after unbind of unknown binding, actual %d", l)
+	}
+
+	sc.server.Stop()
+	sc, _ = getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	if l := len(sc.server.getVhost("/").GetExchange("testEx").GetBindings()); l != 3 {
+		t.Fatalf("Expected 3 bindings after server restart, actual %d", l)
+	}
+}
+
+func Test_QueueUnbind_LegacyBindingKey(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("testEx", "headers", true, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu", true, false, false, false, emptyTable)
+	sc.server.Stop()
+
+	// binding with arguments stored by version without hash of arguments in binding name
+	arguments := &amqp2.Table{"x-match": "all", "format": "pdf"}
+	data, _ := binding.NewBinding("testQu", "testEx", "key", arguments, false).Marshal(cfg.srvConfig.Proto)
+	srv, _ := NewServer("localhost", "0", proto, &cfg.srvConfig)
+	storage := srv.getStorageInstance(cfg.srvConfig.Db.DefaultPath, "server", true)
+	storage.Set("vhost.binding./.testQu_testEx_key", data)
+	storage.Close()
+
+	sc, _ = getNewSC(cfg)
+	defer sc.clean()
+	ch, _ = sc.client.Channel()
+	if l := len(sc.server.getVhost("/").GetExchange("testEx").GetBindings()); l != 1 {
+		t.Fatalf("Expected legacy binding restored, actual %d bindings", l)
+	}
+	if err := ch.QueueUnbind("testQu", "key", "testEx", amqp.Table{"x-match": "all", "format": "pdf"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sc.server.Stop()
+	sc, _ = getNewSC(cfg)
+	defer sc.clean()
+	if l := len(sc.server.getVhost("/").GetExchange("testEx").GetBindings()); l != 0 {
+		t.Fatalf("Expected unbound legacy binding not restored after restart, actual %d bindings", l)
+	}
+}
+
 func Test_QueueUnbind_FailedExchangeNotExists(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
@@ -335,6 +606,57 @@ func Test_QueueUnbind_Failed_OnExclusiveQueue(t *testing.T) {
 	}
 }
 
+func Test_VhostBindQueue_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("testEx", "direct", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+
+	vhost := sc.server.getVhost("/")
+	if err := vhost.BindQueue("testEx", "testQu", "key", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ch.Publish("testEx", "key", false, false, amqp.Publishing{Body: []byte("test")})
+	time.Sleep(50 * time.Millisecond)
+	if _, ok, _ := ch.Get("testQu", true); !ok {
+		t.Fatal("Expected message routed through binding created by vhost")
+	}
+
+	if err := vhost.UnbindQueue("testEx", "testQu", "key", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(vhost.GetExchange("testEx").GetBindings()) != 0 {
+		t.Fatal("Binding exists after UnbindQueue")
+	}
+}
+
+func Test_VhostBindQueue_Failed(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("testEx", "direct", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testQuEx", false, false, true, false, emptyTable)
+
+	vhost := sc.server.getVhost("/")
+	if err := vhost.BindQueue("test_Ex", "testQu", "key", nil); err == nil {
+		t.Fatal("Expected: exchange does not exists")
+	}
+	if err := vhost.BindQueue("testEx", "test_Qu", "key", nil); err == nil {
+		t.Fatal("Expected: queue does not exists")
+	}
+	if err := vhost.BindQueue("", "testQu", "key", nil); err == nil {
+		t.Fatal("Expected: operation not permitted on the default exchange")
+	}
+	if err := vhost.BindQueue("testEx", "testQuEx", "key", nil); err == nil {
+		t.Fatal("Expected: queue is locked error")
+	}
+}
+
 func Test_QueuePurge_Success(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
@@ -417,6 +739,101 @@ func Test_QueueDelete_Success(t *testing.T) {
 	if q := sc.server.getVhost("/").GetQueue("test"); q != nil {
 		t.Fatalf("Queue exists after delete")
 	}
+
+	for _, name := range []string{"ready", "ack", "oldest_message_age"} {
+		if metrics.GetCounter("queue./.test."+name) != nil {
+			t.Fatalf("Expected queue metric %s removed after delete", name)
+		}
+	}
+	if metrics.GetHistogram("queue./.test.delivery_latency") != nil {
+		t.Fatal("Expected queue delivery latency histogram removed after delete")
+	}
+}
+
+func Test_QueueDelete_Consumed_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.QueueDeclare("test", false, false, false, false, emptyTable)
+	cancels := ch.NotifyCancel(make(chan string, 1))
+	ch.Consume("test", "testCmr", false, false, false, false, emptyTable)
+
+	chEx, _ := sc.clientEx.Channel()
+	if _, err := chEx.QueueDelete("test", false, false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case tag := <-cancels:
+		if tag != "testCmr" {
+			t.Fatalf("Expected consumer %s cancelled, actual %s", "testCmr", tag)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected consumer cancelled on queue delete")
+	}
+}
+
+func Test_QueueDelete_Failed_IfUnused(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.QueueDeclare("test", false, false, false, false, emptyTable)
+	msgs, _ := ch.Consume("test", "testCmr", true, false, false, false, emptyTable)
+
+	chEx, _ := sc.clientEx.Channel()
+	_, err := chEx.QueueDelete("test", true, false, false)
+	if amqpErr, ok := err.(*amqp.Error); !ok || amqpErr.Code != amqp.PreconditionFailed {
+		t.Fatalf("Expected PRECONDITION_FAILED on delete of queue with consumers, actual %v", err)
+	}
+
+	// refused queue keeps delivering to its consumers
+	ch.Publish("", "test", false, false, amqp.Publishing{Body: []byte("test")})
+	select {
+	case <-msgs:
+	case <-time.After(time.Second):
+		t.Fatal("Expected message delivered after refused delete")
+	}
+
+	ch.Cancel("testCmr", false)
+	chEx, _ = sc.clientEx.Channel()
+	if _, err = chEx.QueueDelete("test", true, false, false); err != nil {
+		t.Fatal("Expected queue without consumers deleted with if-unused", err)
+	}
+}
+
+func Test_QueueDelete_Failed_IfEmpty(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Queue.MaxMessagesInRam = 2
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.QueueDeclare("test", false, false, false, false, emptyTable)
+
+	// messages swapped to disk are counted too
+	msgCount := 5
+	for i := 0; i < msgCount; i++ {
+		ch.Publish("", "test", false, false, amqp.Publishing{Body: []byte("test")})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	chEx, _ := sc.clientEx.Channel()
+	_, err := chEx.QueueDelete("test", false, true, false)
+	if amqpErr, ok := err.(*amqp.Error); !ok || amqpErr.Code != amqp.PreconditionFailed {
+		t.Fatalf("Expected PRECONDITION_FAILED on delete of non empty queue, actual %v", err)
+	}
+
+	for i := 0; i < msgCount; i++ {
+		if _, ok, _ := ch.Get("test", true); !ok {
+			t.Fatalf("Expected message %d kept after refused delete", i)
+		}
+	}
+	chEx, _ = sc.clientEx.Channel()
+	if _, err = chEx.QueueDelete("test", false, true, false); err != nil {
+		t.Fatal("Expected empty queue deleted with if-empty", err)
+	}
+	if q := sc.server.getVhost("/").GetQueue("test"); q != nil {
+		t.Fatal("Queue exists after delete")
+	}
 }
 
 func Test_QueueDeleteDurable_Success(t *testing.T) {
@@ -444,7 +861,7 @@ func Test_QueueDeleteDurable_Success(t *testing.T) {
 		t.Fatalf("Queue exists after delete")
 	}
 
-	storedQueues := sc.server.storage.GetVhostQueues("/")
+	storedQueues, _ := sc.server.storage.GetVhostQueues("/")
 	if len(storedQueues) != 0 {
 		t.Fatal("Durable queue exists into storage after 'QueueDelete'")
 	}
@@ -532,3 +949,568 @@ func Test_Basic_AutoDelete(t *testing.T) {
 		t.Fatal("Expected empty queues")
 	}
 }
+
+func Test_QueueHistory_Success(t *testing.T) {
+	metrics.NewHistoryRegistry(10, 10*time.Millisecond, false)
+	defer metrics.DestroyHistory()
+
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	queue, _ := ch.QueueDeclare("test", false, false, false, false, emptyTable)
+
+	msgCount := 3
+	for i := 0; i < msgCount; i++ {
+		ch.Publish("", queue.Name, false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte("test")})
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	history := sc.server.getVhost("/").GetQueue("test").GetMetrics().History
+	if len(history) == 0 {
+		t.Fatal("Expected queue history")
+	}
+
+	// counters are nil in tests, so we check that history is sampled only
+	if ready := history["ready"].GetLastTrackItem(); ready == nil {
+		t.Fatal("Expected sampled ready history")
+	}
+
+	if track := history["incoming"].GetTrack(); len(track) != 10 {
+		t.Fatalf("Expected history length %d, actual %d", 10, len(track))
+	}
+}
+
+func Test_VhostMoveMessages_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQuSrc", true, false, false, false, emptyTable)
+	ch.QueueDeclare("testQuDst", true, false, false, false, emptyTable)
+	for i := 0; i < 5; i++ {
+		ch.Publish("", "testQuSrc", false, false, amqp.Publishing{
+			Body:         []byte{byte('0' + i)},
+			Headers:      amqp.Table{"idx": int32(i)},
+			DeliveryMode: amqp.Persistent,
+		})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	vhost := sc.server.getVhost("/")
+	moved, err := vhost.MoveMessages("testQuSrc", "testQuDst", 3, false)
+	if err != nil || moved != 3 {
+		t.Fatalf("Expected 3 messages moved, actual %d, %v", moved, err)
+	}
+	if vhost.GetQueue("testQuSrc").Length() != 2 || vhost.GetQueue("testQuDst").Length() != 3 {
+		t.Fatal("Expected messages removed from source queue and pushed into destination queue")
+	}
+
+	for i := 0; i < 3; i++ {
+		msg, ok, _ := ch.Get("testQuDst", true)
+		if !ok || msg.Body[0] != byte('0'+i) || msg.Headers["idx"] != int32(i) || msg.DeliveryMode != amqp.Persistent {
+			t.Fatalf("Expected message %d with properties and headers in destination queue", i)
+		}
+	}
+
+	// moving more than queue has
+	moved, _ = vhost.MoveMessages("testQuSrc", "testQuDst", 10, false)
+	if moved != 2 {
+		t.Fatalf("Expected 2 messages moved, actual %d", moved)
+	}
+}
+
+func Test_VhostMoveMessages_Copy_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQuSrc", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testQuDst", false, false, false, false, emptyTable)
+	for i := 0; i < 5; i++ {
+		ch.Publish("", "testQuSrc", false, false, amqp.Publishing{Body: []byte{byte('0' + i)}})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	vhost := sc.server.getVhost("/")
+	copied, err := vhost.MoveMessages("testQuSrc", "testQuDst", 3, true)
+	if err != nil || copied != 3 {
+		t.Fatalf("Expected 3 messages copied, actual %d, %v", copied, err)
+	}
+	if vhost.GetQueue("testQuSrc").Length() != 5 || vhost.GetQueue("testQuDst").Length() != 3 {
+		t.Fatal("Expected messages kept in source queue and pushed into destination queue")
+	}
+
+	for _, queue := range []string{"testQuSrc", "testQuDst"} {
+		msg, ok, _ := ch.Get(queue, true)
+		if !ok || string(msg.Body) != "0" || msg.Redelivered {
+			t.Fatalf("Expected first message at head of queue %s", queue)
+		}
+	}
+}
+
+func Test_VhostMoveMessages_DestinationRejects(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQuSrc", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testQuDst", false, false, false, false, amqp.Table{"x-max-length": int32(2)})
+	for i := 0; i < 5; i++ {
+		ch.Publish("", "testQuSrc", false, false, amqp.Publishing{Body: []byte{byte('0' + i)}})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	vhost := sc.server.getVhost("/")
+	moved, err := vhost.MoveMessages("testQuSrc", "testQuDst", 5, false)
+	if err == nil || moved != 2 {
+		t.Fatalf("Expected 2 messages moved into full queue, actual %d, %v", moved, err)
+	}
+	if vhost.GetQueue("testQuSrc").Length() != 3 || vhost.GetQueue("testQuDst").Length() != 2 {
+		t.Fatal("Expected rejected message kept in source queue")
+	}
+	if copied, err := vhost.MoveMessages("testQuSrc", "testQuDst", 1, true); err == nil || copied != 0 {
+		t.Fatalf("Expected no messages copied into full queue, actual %d, %v", copied, err)
+	}
+
+	// the rest of messages are kept in source in order
+	for i := 2; i < 5; i++ {
+		msg, ok, _ := ch.Get("testQuSrc", true)
+		if !ok || msg.Body[0] != byte('0'+i) {
+			t.Fatalf("Expected message %d in source queue", i)
+		}
+	}
+}
+
+func Test_VhostMoveMessages_Failed(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQuSrc", false, false, false, false, emptyTable)
+	ch.Publish("", "testQuSrc", false, false, amqp.Publishing{Body: []byte("test")})
+	time.Sleep(50 * time.Millisecond)
+
+	vhost := sc.server.getVhost("/")
+	if _, err := vhost.MoveMessages("testQuSrc", "testQuDst", 1, false); err == nil {
+		t.Fatal("Expected: destination queue does not exists")
+	}
+	if _, err := vhost.MoveMessages("test_Qu", "testQuSrc", 1, false); err == nil {
+		t.Fatal("Expected: source queue does not exists")
+	}
+	if _, err := vhost.MoveMessages("testQuSrc", "testQuSrc", 1, false); err == nil {
+		t.Fatal("Expected: same queues error")
+	}
+	if vhost.GetQueue("testQuSrc").Length() != 1 {
+		t.Fatal("Expected source queue untouched on error")
+	}
+}
+
+func Test_VhostSweep_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	vhost := sc.server.getVhost("/")
+
+	// exclusive queue of connection closed without clean up
+	orphaned := vhost.NewQueue("testQuOrphaned", sc.server.connSeq+100, true, false, false, sc.server.getConfig().Queue.ShardSize)
+	orphaned.Start()
+	vhost.AppendQueue(orphaned)
+	ch.QueueDeclare("testQuExclusive", false, false, true, false, emptyTable)
+
+	// auto-delete queue which lost its auto-delete event
+	unused := queue.NewQueue("testQuUnused", 0, false, true, false, sc.server.getConfig().Queue, vhost.msgStorageP, vhost.msgStorageT, make(chan string, 1))
+	unused.Start()
+	vhost.AppendQueue(unused)
+	ch.QueueDeclare("testQuAutoDelete", false, true, false, false, emptyTable)
+
+	ch.ExchangeDeclare("testExUnused", "direct", false, true, false, false, emptyTable)
+	ch.ExchangeDeclare("testExAutoDelete", "direct", false, true, false, false, emptyTable)
+	ch.ExchangeDeclare("testEx", "direct", false, false, false, false, emptyTable)
+	ch.QueueBind("testQuUnused", "key", "testExUnused", false, emptyTable)
+	ch.QueueBind("testQuUnused", "key", "testEx", false, emptyTable)
+
+	if _, err := ch.Consume("testQuUnused", "tag", false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Cancel("tag", false); err != nil {
+		t.Fatal(err)
+	}
+
+	results := sc.server.Sweep()
+	if len(results) != 1 {
+		t.Fatalf("Expected sweep result of %d vhost, actual %d", 1, len(results))
+	}
+	result := results[0]
+	if !reflect.DeepEqual(result.Queues, []string{"testQuOrphaned", "testQuUnused"}) {
+		t.Fatalf("Unexpected removed queues %v", result.Queues)
+	}
+	if !reflect.DeepEqual(result.Exchanges, []string{"testExUnused"}) {
+		t.Fatalf("Unexpected removed exchanges %v", result.Exchanges)
+	}
+
+	for _, name := range []string{"testQuExclusive", "testQuAutoDelete"} {
+		if vhost.GetQueue(name) == nil {
+			t.Fatalf("Expected queue %s kept", name)
+		}
+	}
+	for _, name := range []string{"testExAutoDelete", "testEx"} {
+		if vhost.GetExchange(name) == nil {
+			t.Fatalf("Expected exchange %s kept", name)
+		}
+	}
+
+	if result = sc.server.Sweep()[0]; len(result.Queues) != 0 || len(result.Exchanges) != 0 {
+		t.Fatalf("Expected nothing removed on repeated sweep, actual %v", result)
+	}
+}
+
+// Test_QueueMethods_NoWait checks that no-wait methods are not answered
+// Unexpected -ok reply would be taken by the next synchronous call as its own reply, so the call would fail
+func Test_QueueMethods_NoWait(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare("testQu", false, false, false, true, emptyTable)
+	ch.QueueDeclare("testQu", false, false, false, true, emptyTable)
+	ch.QueueDeclarePassive("testQu", false, false, false, true, emptyTable)
+	ch.QueueBind("testQu", "key", "amq.direct", true, emptyTable)
+	ch.Publish("amq.direct", "key", false, false, amqp.Publishing{Body: []byte("test")})
+	ch.QueuePurge("testQu", true)
+	if qu, err := ch.QueueDeclarePassive("testQu", false, false, false, false, emptyTable); err != nil || qu.Messages != 0 {
+		t.Fatal("Expected empty queue", err)
+	}
+	if len(sc.server.getVhost("/").GetExchange("amq.direct").GetBindings()) != 1 {
+		t.Fatal("Expected queue bound")
+	}
+
+	cmr, _ := ch.Consume("testQu", "tag", true, false, false, true, emptyTable)
+	ch.Publish("", "testQu", false, false, amqp.Publishing{Body: []byte("test")})
+	if count := len(receiveDeliveries(cmr, 50*time.Millisecond)); count != 1 {
+		t.Fatalf("Expected %d delivery, actual %d", 1, count)
+	}
+	ch.Cancel("tag", true)
+	if qu, err := ch.QueueDeclarePassive("testQu", false, false, false, false, emptyTable); err != nil || qu.Consumers != 0 {
+		t.Fatal("Expected queue without consumers", err)
+	}
+
+	ch.QueueDelete("testQu", false, false, true)
+	if _, err := ch.QueueDeclarePassive("testQu", false, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected: queue not found error")
+	}
+
+	// errors are raised as channel exceptions
+	ch, _ = sc.client.Channel()
+	chClose := ch.NotifyClose(make(chan *amqp.Error, 1))
+	ch.QueueDeclarePassive("testQu", false, false, false, true, emptyTable)
+	select {
+	case err := <-chClose:
+		if err == nil || err.Code != amqp.NotFound {
+			t.Fatalf("Expected not found error, actual %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected channel closed on passive declare of missing queue")
+	}
+}
+
+func Test_QueueDeclare_NamePattern(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Security.QueueNamePattern = `^team\.`
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if _, err := ch.QueueDeclare("team.qu", false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+	// server-named queues are not checked
+	if _, err := ch.QueueDeclare("", false, true, true, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("other.qu", false, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected: name does not match pattern error")
+	} else if amqpErr, ok := err.(*amqp.Error); !ok || amqpErr.Code != amqp.PreconditionFailed {
+		t.Fatalf("Expected precondition failed error, actual %v", err)
+	}
+
+	// pattern is reloaded with security settings
+	ch, _ = sc.client.Channel()
+	reloaded := *sc.server.getConfig()
+	reloaded.Security.QueueNamePattern = ""
+	if err := sc.server.ReloadConfig(&reloaded); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("other.qu", false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded.Security.QueueNamePattern = "("
+	if err := sc.server.ReloadConfig(&reloaded); err == nil {
+		t.Fatal("Expected invalid pattern error")
+	}
+}
+
+func Test_QueueDeclare_Failed_ReservedName(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if _, err := ch.QueueDeclare("amq.test", false, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected: reserved prefix error")
+	} else if amqpErr, ok := err.(*amqp.Error); !ok || amqpErr.Code != amqp.AccessRefused {
+		t.Fatalf("Expected access refused error, actual %v", err)
+	}
+
+	// existing server-named queue could be declared again
+	ch, _ = sc.client.Channel()
+	qu, _ := ch.QueueDeclare("", false, false, false, false, emptyTable)
+	if _, err := ch.QueueDeclare(qu.Name, false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_QueueDeclare_DropIfNoConsumers(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.Confirm(false)
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 2))
+	args := amqp.Table{"x-drop-if-no-consumers": true, "x-single-active-consumer": true}
+	if _, err := ch.QueueDeclare("testQu", false, false, false, false, args); err != nil {
+		t.Fatal(err)
+	}
+	qu := sc.server.getVhost("/").GetQueue("testQu")
+
+	// message routed into queue without consumers is dropped and confirmed
+	ch.Publish("", "testQu", false, false, amqp.Publishing{Body: []byte("stale")})
+	if confirm := <-confirms; !confirm.Ack {
+		t.Fatal("Expected dropped message is acked")
+	}
+	if qu.Length() != 0 {
+		t.Fatalf("Expected message dropped, actual %d messages", qu.Length())
+	}
+
+	// waiting consumer of queue with single active consumer counts too
+	chCmr, _ := sc.client.Channel()
+	chCmr.Qos(1, 0, false)
+	chCmr.Consume("testQu", "active", false, false, false, false, emptyTable)
+	chCmr.Consume("testQu", "waiting", false, false, false, false, emptyTable)
+	chCmr.Cancel("active", false)
+	ch.Publish("", "testQu", false, false, amqp.Publishing{Body: []byte("live")})
+	<-confirms
+	if qu.ConsumersCount() != 1 || qu.Length()+uint64(len(getServerChannel(sc, 2).GetUnackedMessages())) != 1 {
+		t.Fatal("Expected message kept for waiting consumer")
+	}
+
+	if _, err := ch.QueueDeclare("testQu", false, false, false, false, amqp.Table{"x-single-active-consumer": true}); err == nil {
+		t.Fatal("Expected: x-drop-if-no-consumers inequivalent error")
+	}
+	ch, _ = sc.client.Channel()
+	if _, err := ch.QueueDeclare("testQu2", false, false, false, false, amqp.Table{"x-drop-if-no-consumers": "true"}); err == nil {
+		t.Fatal("Expected: x-drop-if-no-consumers argument error")
+	}
+}
+
+func Test_QueueDeclare_RetryDelays(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.ExchangeDeclare("dlx", "fanout", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testDlq", false, false, false, false, emptyTable)
+	ch.QueueBind("testDlq", "", "dlx", false, emptyTable)
+	args := amqp.Table{"x-retry-delays": []interface{}{int32(50), int32(150)}, "x-dead-letter-exchange": "dlx"}
+	if _, err := ch.QueueDeclare("testQu", false, false, false, false, args); err != nil {
+		t.Fatal(err)
+	}
+
+	ch.Publish("", "testQu", false, false, amqp.Publishing{Body: []byte("test")})
+	cmr, _ := ch.Consume("testQu", "tag", false, false, false, false, emptyTable)
+
+	rejected := time.Now()
+	for attempt, delay := range []time.Duration{0, 50 * time.Millisecond, 150 * time.Millisecond} {
+		select {
+		case delivery := <-cmr:
+			if elapsed := time.Since(rejected); elapsed < delay {
+				t.Fatalf("Expected retry %d after %s, actual %s", attempt, delay, elapsed)
+			}
+			if attempt > 0 && (delivery.Headers["x-retry-count"] != int64(attempt) || !delivery.Redelivered) {
+				t.Fatalf("Unexpected retry %d headers %v", attempt, delivery.Headers)
+			}
+			rejected = time.Now()
+			delivery.Nack(false, false)
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout on waiting retry %d", attempt)
+		}
+	}
+
+	// message is dead-lettered after the last retry
+	time.Sleep(50 * time.Millisecond)
+	msg, ok, err := ch.Get("testDlq", true)
+	if err != nil || !ok {
+		t.Fatal("Expected message dead-lettered after retries", err)
+	}
+	if msg.Headers["x-retry-count"] != int64(2) {
+		t.Fatalf("Expected dead-lettered message keeps retry count, actual %v", msg.Headers)
+	}
+	if length := sc.server.getVhost("/").GetQueue("testQu").Length(); length != 0 {
+		t.Fatalf("Expected %d messages, actual %d", 0, length)
+	}
+}
+
+func Test_QueueDeclare_Failed_RetryDelays(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	for _, value := range []interface{}{int32(100), []interface{}{"100"}, []interface{}{int32(-1)}} {
+		ch, _ := sc.client.Channel()
+		if _, err := ch.QueueDeclare("testQu", false, false, false, false, amqp.Table{"x-retry-delays": value}); err == nil {
+			t.Fatalf("Expected error on x-retry-delays %v", value)
+		}
+	}
+
+	ch, _ := sc.client.Channel()
+	ch.QueueDeclare("testQu", false, false, false, false, amqp.Table{"x-retry-delays": []interface{}{int32(100)}})
+	if _, err := ch.QueueDeclare("testQu", false, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected: x-retry-delays inequivalent error")
+	}
+}
+
+func Test_QueueDeclare_MaxLength_ConfirmNack(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.trackMetrics = true
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.Confirm(false)
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 4))
+
+	ch.ExchangeDeclare("testEx", "fanout", false, false, false, false, emptyTable)
+	args := amqp.Table{"x-max-length": int32(2), "x-overflow": "reject-publish"}
+	if _, err := ch.QueueDeclare("testQu", false, false, false, false, args); err != nil {
+		t.Fatal(err)
+	}
+	ch.QueueDeclare("testQuAny", false, false, false, false, emptyTable)
+	ch.QueueBind("testQu", "", "testEx", false, emptyTable)
+	ch.QueueBind("testQuAny", "", "testEx", false, emptyTable)
+
+	for i := 0; i < 3; i++ {
+		ch.Publish("", "testQu", true, false, amqp.Publishing{Body: []byte("test")})
+	}
+	// message is nacked if any queue is full, but still pushed into the rest of them
+	ch.Publish("testEx", "", false, false, amqp.Publishing{Body: []byte("test")})
+
+	for i := 1; i <= 4; i++ {
+		select {
+		case confirm := <-confirms:
+			if confirm.DeliveryTag != uint64(i) || confirm.Ack != (i <= 2) {
+				t.Fatalf("Unexpected confirm %+v", confirm)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout on waiting confirm %d", i)
+		}
+	}
+
+	vhost := sc.server.getVhost("/")
+	if length := vhost.GetQueue("testQu").Length(); length != 2 {
+		t.Fatalf("Expected %d messages in full queue, actual %d", 2, length)
+	}
+	if length := vhost.GetQueue("testQuAny").Length(); length != 1 {
+		t.Fatalf("Expected %d messages in not limited queue, actual %d", 1, length)
+	}
+	if count := sc.server.GetMetrics().PublishRejectedBy[publishRejectQueueOverflow].Counter.Count(); count != 2 {
+		t.Fatalf("Expected %d rejected publishes, actual %d", 2, count)
+	}
+
+	// queue accepts messages again after it is drained
+	ch.Get("testQu", true)
+	ch.Publish("", "testQu", false, false, amqp.Publishing{Body: []byte("test")})
+	select {
+	case confirm := <-confirms:
+		if !confirm.Ack {
+			t.Fatalf("Expected ack after queue is drained, actual %+v", confirm)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout on waiting confirm")
+	}
+}
+
+func Test_QueueDeclare_MaxLength_MandatoryReturned(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	returns := ch.NotifyReturn(make(chan amqp.Return, 2))
+	if _, err := ch.QueueDeclare("testQu", false, false, false, false, amqp.Table{"x-max-length": int32(1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	ch.Publish("", "testQu", true, false, amqp.Publishing{Body: []byte("first")})
+	ch.Publish("", "testQu", true, false, amqp.Publishing{Body: []byte("second")})
+	// not mandatory message is dropped silently
+	ch.Publish("", "testQu", false, false, amqp.Publishing{Body: []byte("third")})
+
+	select {
+	case ret := <-returns:
+		if string(ret.Body) != "second" || ret.ReplyCode != amqp.NoRoute || ret.ReplyText != queueOverflowReason {
+			t.Fatalf("Unexpected return %+v", ret)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected mandatory message returned from full queue")
+	}
+
+	if _, err := ch.QueueInspect("testQu"); err != nil {
+		t.Fatal("Expected channel open after overflow", err)
+	}
+	select {
+	case ret := <-returns:
+		t.Fatalf("Unexpected return %+v", ret)
+	default:
+	}
+	if length := sc.server.getVhost("/").GetQueue("testQu").Length(); length != 1 {
+		t.Fatalf("Expected %d messages, actual %d", 1, length)
+	}
+}
+
+func Test_QueueDeclare_Failed_MaxLength(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	for _, args := range []amqp.Table{
+		{"x-max-length": "1"},
+		{"x-max-length": int32(-1)},
+		{"x-max-length": int32(1), "x-overflow": "drop-head"},
+		{"x-max-length": int32(1), "x-overflow": int32(1)},
+	} {
+		ch, _ := sc.client.Channel()
+		if _, err := ch.QueueDeclare("testQu", false, false, false, false, args); err == nil {
+			t.Fatalf("Expected error on arguments %v", args)
+		}
+	}
+
+	ch, _ := sc.client.Channel()
+	ch.QueueDeclare("testQu", false, false, false, false, amqp.Table{"x-max-length": int32(1)})
+	if _, err := ch.QueueDeclare("testQu", false, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected: x-max-length inequivalent error")
+	}
+}
+
+func Test_QueueDeclare_DropIfNoConsumers_DeadLetter(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.ExchangeDeclare("dlx", "fanout", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testDlq", false, false, false, false, emptyTable)
+	ch.QueueBind("testDlq", "", "dlx", false, emptyTable)
+	ch.QueueDeclare("testQu", false, false, false, false, amqp.Table{"x-drop-if-no-consumers": true, "x-dead-letter-exchange": "dlx"})
+
+	ch.Publish("", "testQu", false, false, amqp.Publishing{Body: []byte("stale")})
+
+	msg, ok, err := ch.Get("testDlq", true)
+	if err != nil || !ok {
+		t.Fatal("Expected message dead-lettered", err)
+	}
+	deaths, _ := msg.Headers["x-death"].([]interface{})
+	if len(deaths) != 1 || deaths[0].(amqp.Table)["reason"] != "no_consumers" {
+		t.Fatalf("Unexpected x-death %v", msg.Headers["x-death"])
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// publish sends basic.publish with content of body on channel
+func (client *rawClient) publish(t *testing.T, channelID uint16, exchange string, routingKey string, body []byte) {
+	client.sendOn(channelID, &amqp.BasicPublish{Exchange: exchange, RoutingKey: routingKey})
+
+	header := bytes.NewBuffer([]byte{})
+	amqp.WriteContentHeader(header, &amqp.ContentHeader{
+		ClassID:      amqp.ClassBasic,
+		BodySize:     uint64(len(body)),
+		PropertyList: &amqp.BasicPropertyList{},
+	}, proto)
+	if err := amqp.WriteFrame(client.conn, &amqp.Frame{Type: byte(amqp.FrameHeader), ChannelID: channelID, Payload: header.Bytes()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := amqp.WriteFrame(client.conn, &amqp.Frame{Type: byte(amqp.FrameBody), ChannelID: channelID, Payload: body}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readRouted reads methods until basic.routed, confirms of publishes are skipped
+func (client *rawClient) readRouted(t *testing.T) *amqp.BasicRouted {
+	for {
+		method, err := client.read(time.Second)
+		if err != nil {
+			t.Fatal("Expected basic.routed", err)
+		}
+		switch method := method.(type) {
+		case *amqp.BasicRouted:
+			return method
+		case *amqp.BasicAck:
+		default:
+			t.Fatalf("Expected basic.routed, actual %s", method.Name())
+		}
+	}
+}
+
+func Test_BasicRouted(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	client, err := newRawClient(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.properties = amqp.Table{"capabilities": &amqp.Table{basicRoutedCapability: true}}
+	client.open(t, 0)
+
+	client.sendOn(1, &amqp.ChannelOpen{})
+	client.sendOn(1, &amqp.QueueDeclare{Queue: "testQu", Arguments: &amqp.Table{}})
+	for _, expected := range []string{"ChannelOpenOk", "QueueDeclareOk"} {
+		method, err := client.read(time.Second)
+		if err != nil || method.Name() != expected {
+			t.Fatalf("Expected %s, actual %v %v", expected, method, err)
+		}
+	}
+
+	// delivery tag is not set without confirm mode
+	client.publish(t, 1, "", "testQu", []byte("test"))
+	if routed := client.readRouted(t); routed.DeliveryTag != 0 || routed.QueueCount != 1 {
+		t.Fatalf("Expected message routed into %d queue, actual %+v", 1, routed)
+	}
+
+	client.sendOn(1, &amqp.ConfirmSelect{})
+	if method, err := client.read(time.Second); err != nil || method.Name() != "ConfirmSelectOk" {
+		t.Fatalf("Expected ConfirmSelectOk, actual %v %v", method, err)
+	}
+	client.publish(t, 1, "", "unknown", []byte("test"))
+	client.publish(t, 1, "", "testQu", []byte("test"))
+	if routed := client.readRouted(t); routed.DeliveryTag != 1 || routed.QueueCount != 0 {
+		t.Fatalf("Expected unroutable message, actual %+v", routed)
+	}
+	if routed := client.readRouted(t); routed.DeliveryTag != 2 || routed.QueueCount != 1 {
+		t.Fatalf("Expected message routed into %d queue, actual %+v", 1, routed)
+	}
+}
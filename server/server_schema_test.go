@@ -0,0 +1,180 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	amqpclient "github.com/streadway/amqp"
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+const testSchema = `{"type": "object", "required": ["id"], "properties": {"id": {"type": "integer"}}}`
+
+func Test_Schema_Declare_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	vhost := sc.server.getVhost("/")
+
+	args := amqpclient.Table{"x-schema": testSchema, "x-schema-type": "json"}
+	if err := ch.ExchangeDeclare("testEx", "direct", false, false, false, false, args); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("testQu", false, false, false, false, amqpclient.Table{"x-schema": testSchema}); err != nil {
+		t.Fatal(err)
+	}
+	if vhost.GetExchange("testEx").GetSchema() == nil || vhost.GetQueue("testQu").GetSchema() == nil {
+		t.Fatal("Expected schemas of exchange and queue are set")
+	}
+
+	// the same schema is equivalent, the other one is not
+	if err := ch.ExchangeDeclare("testEx", "direct", false, false, false, false, args); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("testQu", false, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected: x-schema inequivalent error")
+	}
+}
+
+func Test_Schema_Declare_Failed(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	for _, args := range []amqpclient.Table{
+		{"x-schema": "{"},
+		{"x-schema": int32(1)},
+		{"x-schema": `{"type": "record"}`},
+		{"x-schema": testSchema, "x-schema-type": "avro"},
+		{"x-schema-type": "json"},
+	} {
+		ch, _ := sc.client.Channel()
+		if err := ch.ExchangeDeclare("testEx", "direct", false, false, false, false, args); err == nil {
+			t.Fatalf("Expected: invalid exchange schema arguments %v error", args)
+		}
+		ch, _ = sc.client.Channel()
+		if _, err := ch.QueueDeclare("testQu", false, false, false, false, args); err == nil {
+			t.Fatalf("Expected: invalid queue schema arguments %v error", args)
+		}
+	}
+}
+
+func Test_Schema_Exchange_Failed_InvalidBody(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	closes := ch.NotifyClose(make(chan *amqpclient.Error, 1))
+	ch.ExchangeDeclare("testEx", "direct", false, false, false, false, amqpclient.Table{"x-schema": testSchema})
+	ch.QueueDeclare("testQu", false, false, false, false, emptyTable)
+	ch.QueueBind("testQu", "key", "testEx", false, emptyTable)
+
+	ch.Publish("testEx", "key", false, false, amqpclient.Publishing{Body: []byte(`{"id": 1}`)})
+	ch.Publish("testEx", "key", false, false, amqpclient.Publishing{Body: []byte(`{"id": "1"}`)})
+
+	select {
+	case err := <-closes:
+		if err == nil || err.Code != amqp.PreconditionFailed {
+			t.Fatalf("Expected channel closed with %d, actual %v", amqp.PreconditionFailed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected channel closed on invalid body")
+	}
+	if length := sc.server.getVhost("/").GetQueue("testQu").Length(); length != 1 {
+		t.Fatalf("Expected %d messages, actual %d", 1, length)
+	}
+}
+
+func Test_Schema_Queue_ConfirmNack(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.trackMetrics = true
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.Confirm(false)
+	confirms := ch.NotifyPublish(make(chan amqpclient.Confirmation, 2))
+	ch.QueueDeclare("testQu", false, false, false, false, amqpclient.Table{"x-schema": testSchema})
+
+	ch.Publish("", "testQu", false, false, amqpclient.Publishing{Body: []byte(`not json`)})
+	ch.Publish("", "testQu", false, false, amqpclient.Publishing{Body: []byte(`{"id": 1}`)})
+
+	for i := 1; i <= 2; i++ {
+		select {
+		case confirm := <-confirms:
+			if confirm.DeliveryTag != uint64(i) || confirm.Ack != (i == 2) {
+				t.Fatalf("Unexpected confirm %+v", confirm)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout on waiting confirm %d", i)
+		}
+	}
+
+	if length := sc.server.getVhost("/").GetQueue("testQu").Length(); length != 1 {
+		t.Fatalf("Expected %d messages, actual %d", 1, length)
+	}
+	if count := sc.server.GetMetrics().PublishRejectedBy[publishRejectSchemaInvalid].Counter.Count(); count != 1 {
+		t.Fatalf("Expected %d rejected publish, actual %d", 1, count)
+	}
+}
+
+func Test_Schema_Queue_DeadLetter(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.ExchangeDeclare("testEx", "fanout", false, false, false, false, emptyTable)
+	ch.ExchangeDeclare("dlx", "fanout", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testQu", false, false, false, false, amqpclient.Table{"x-schema": testSchema, "x-dead-letter-exchange": "dlx"})
+	ch.QueueDeclare("testQuAny", false, false, false, false, emptyTable)
+	ch.QueueDeclare("testDlq", false, false, false, false, emptyTable)
+	ch.QueueBind("testQu", "", "testEx", false, emptyTable)
+	ch.QueueBind("testQuAny", "", "testEx", false, emptyTable)
+	ch.QueueBind("testDlq", "", "dlx", false, emptyTable)
+
+	if err := ch.Publish("testEx", "", false, false, amqpclient.Publishing{Body: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueInspect("testQu"); err != nil {
+		t.Fatal("Expected channel open after dead-lettering", err)
+	}
+
+	vhost := sc.server.getVhost("/")
+	if length := vhost.GetQueue("testQu").Length(); length != 0 {
+		t.Fatalf("Expected invalid message is not pushed into queue with schema, actual %d", length)
+	}
+	if length := vhost.GetQueue("testQuAny").Length(); length != 1 {
+		t.Fatalf("Expected message pushed into queue without schema, actual %d", length)
+	}
+
+	msg, ok, err := ch.Get("testDlq", true)
+	if err != nil || !ok {
+		t.Fatal("Expected invalid message dead-lettered", err)
+	}
+	deaths, _ := msg.Headers["x-death"].([]interface{})
+	if len(deaths) != 1 {
+		t.Fatalf("Expected x-death entry, actual %v", msg.Headers["x-death"])
+	}
+	if death := deaths[0].(amqpclient.Table); death["queue"] != "testQu" || death["reason"] != "rejected" {
+		t.Fatalf("Unexpected x-death entry %v", death)
+	}
+}
+
+func Test_Schema_LocalClient(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.trackMetrics = true
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.QueueDeclare("testQu", false, false, false, false, amqpclient.Table{"x-schema": testSchema})
+
+	client, err := sc.server.NewLocalClient("/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Publish("", "testQu", nil, []byte(`{"id": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Publish("", "testQu", nil, []byte(`[]`)); err == nil {
+		t.Fatal("Expected error on publishing invalid body")
+	}
+	if length := sc.server.getVhost("/").GetQueue("testQu").Length(); length != 1 {
+		t.Fatalf("Expected %d messages, actual %d", 1, length)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/sirupsen/logrus"
 	amqpclient "github.com/streadway/amqp"
 	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/auth"
 	"github.com/valinurovam/garagemq/config"
 	"github.com/valinurovam/garagemq/metrics"
 )
@@ -34,6 +35,8 @@ type ServerClient struct {
 type TestConfig struct {
 	srvConfig    config.Config
 	clientConfig amqpclient.Config
+	// trackMetrics makes counters of test server real instead of nil ones, so tests could check them
+	trackMetrics bool
 }
 
 func (sc *ServerClient) clean() {
@@ -87,9 +90,13 @@ func getDefaultTestConfig() TestConfig {
 	}
 }
 func getNewSC(config TestConfig) (*ServerClient, error) {
-	metrics.NewTrackRegistry(15, time.Second, true)
+	metrics.NewTrackRegistry(15, time.Second, !config.trackMetrics)
 	sc := &ServerClient{}
-	sc.server = NewServer("localhost", "0", proto, &config.srvConfig)
+	server, err := NewServer("localhost", "0", proto, &config.srvConfig)
+	if err != nil {
+		return sc, err
+	}
+	sc.server = server
 	sc.server.initServerStorage()
 	sc.server.initUsers()
 	sc.server.initDefaultVirtualHosts()
@@ -177,6 +184,22 @@ func TestServer_GetProtoVersion(t *testing.T) {
 	}
 }
 
+func TestConnection_GetProtoVersion(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	for _, conn := range sc.server.GetConnections() {
+		if version := conn.GetProtoVersion(); version != proto {
+			t.Fatalf("Expected %s, actual %s", proto, version)
+		}
+		for _, channel := range conn.GetChannels() {
+			if channel.protoVersion != proto {
+				t.Fatalf("Expected channel %s, actual %s", proto, channel.protoVersion)
+			}
+		}
+	}
+}
+
 func TestServer_GetVhosts(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
@@ -196,7 +219,10 @@ func TestServer_RealStart(t *testing.T) {
 	defer (&ServerClient{}).clean()
 	cfg := getDefaultTestConfig()
 	metrics.NewTrackRegistry(15, time.Second, true)
-	server := NewServer("localhost", "55672", proto, &cfg.srvConfig)
+	server, err := NewServer("localhost", "55672", proto, &cfg.srvConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
 	go server.Start()
 	time.Sleep(2 * time.Second)
 	defer server.Stop()
@@ -216,3 +242,89 @@ func TestServer_RealStart(t *testing.T) {
 	}
 	defer conn.Close()
 }
+
+func TestNewServer_InvalidNamePattern(t *testing.T) {
+	defer (&ServerClient{}).clean()
+	metrics.NewTrackRegistry(15, time.Second, true)
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Security.QueueNamePattern = "("
+	if err := cfg.srvConfig.Validate(); err == nil {
+		t.Fatal("Expected invalid pattern error on config validation")
+	}
+	if _, err := NewServer("localhost", "0", proto, &cfg.srvConfig); err == nil {
+		t.Fatal("Expected invalid pattern error on server creation")
+	}
+}
+
+func TestServer_ReloadConfig(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	previous := sc.server.getConfig()
+	cfg := *previous
+	cfg.Users = []config.User{{Username: "reloaded", Password: "084e0343a0486ff05530df6c705c8bb4"}}
+	cfg.TCP.Port = "15673"
+	cfg.TCP.AcceptRate = 10
+	cfg.Queue.ConsumerTimeout = 500
+
+	if changed := restartRequired(sc.server.getConfig(), &cfg); len(changed) != 1 || changed[0] != "tcp" {
+		t.Fatalf("Expected only tcp setting requires restart, actual %v", changed)
+	}
+	if err := sc.server.ReloadConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if !sc.server.checkAuth(auth.SaslData{Username: "reloaded", Password: "guest"}) {
+		t.Fatal("Expected reloaded user authenticated")
+	}
+	if sc.server.checkAuth(auth.SaslData{Username: "guest", Password: "guest"}) {
+		t.Fatal("Expected removed user not authenticated")
+	}
+	if sc.server.getAcceptLimiter() == nil {
+		t.Fatal("Expected accept rate applied")
+	}
+	if sc.server.getConfig().Queue.ConsumerTimeout != 500 {
+		t.Fatalf("Expected consumer timeout %d, actual %d", 500, sc.server.getConfig().Queue.ConsumerTimeout)
+	}
+	if sc.server.getConfig().TCP.Port == "15673" {
+		t.Fatal("Expected tcp port is not reloaded")
+	}
+	// config read before reload is replaced, not changed
+	if previous.Queue.ConsumerTimeout == 500 || sc.server.getConfig() == previous {
+		t.Fatal("Expected reloaded settings applied to new config")
+	}
+
+	// invalid config is rejected as a whole
+	cfg.Users = nil
+	cfg.LogLevel = "verbose"
+	if err := sc.server.ReloadConfig(&cfg); err == nil {
+		t.Fatal("Expected invalid log level error")
+	}
+	if !sc.server.checkAuth(auth.SaslData{Username: "reloaded", Password: "guest"}) {
+		t.Fatal("Expected users kept on invalid config")
+	}
+
+	// existing connections are kept
+	if _, err := sc.client.Channel(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_ReloadConfigFile(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	file, err := ioutil.TempFile("", "garagemq-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("users:\n  - username: reloaded\n    password: 084e0343a0486ff05530df6c705c8bb4\nsecurity:\n  passwordCheck: md5\n")
+	file.Close()
+
+	sc.server.SetConfigFile(file.Name())
+	sc.server.reloadConfigFile()
+	if !sc.server.checkAuth(auth.SaslData{Username: "reloaded", Password: "guest"}) {
+		t.Fatal("Expected users reloaded from config file")
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SweepResult lists queues and exchanges removed from virtual host by sweep
+type SweepResult struct {
+	Vhost     string
+	Queues    []string
+	Exchanges []string
+}
+
+// Sweep removes queues and exchanges of all virtual hosts that should have been deleted automatically,
+// e.g. after connection ended uncleanly, see VirtualHost.Sweep
+func (srv *Server) Sweep() []*SweepResult {
+	srv.vhostsLock.Lock()
+	defer srv.vhostsLock.Unlock()
+
+	results := make([]*SweepResult, 0, len(srv.vhosts))
+	// vhosts are stopped with their queues under the same lock
+	if srv.status == Stopping {
+		return results
+	}
+	for _, vhost := range srv.vhosts {
+		results = append(results, vhost.Sweep())
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Vhost < results[j].Vhost
+	})
+
+	return results
+}
+
+// sweepLoop runs sweep of all virtual hosts with given interval until server is stopped
+func (srv *Server) sweepLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if srv.status == Stopping {
+			return
+		}
+		for _, result := range srv.Sweep() {
+			if len(result.Queues) == 0 && len(result.Exchanges) == 0 {
+				continue
+			}
+			log.WithFields(log.Fields{
+				"vhost":     result.Vhost,
+				"queues":    result.Queues,
+				"exchanges": result.Exchanges,
+			}).Warn("Orphaned queues and exchanges removed")
+		}
+	}
+}
+
+// hasConnection checks that connection with given id is not closed yet
+func (srv *Server) hasConnection(connID uint64) bool {
+	srv.connLock.Lock()
+	defer srv.connLock.Unlock()
+	_, ok := srv.connections[connID]
+	return ok
+}
+
+// Sweep removes queues and exchanges that should have been deleted automatically:
+// exclusive queues of closed connections, auto-delete queues without consumers after they had any
+// and auto-delete exchanges without bindings after they had any
+// Queues are removed first, so exchanges left without bindings by them are removed as well
+func (vhost *VirtualHost) Sweep() *SweepResult {
+	result := &SweepResult{Vhost: vhost.name, Queues: []string{}, Exchanges: []string{}}
+
+	for name, qu := range vhost.GetQueues() {
+		orphaned := qu.IsExclusive() && !vhost.srv.hasConnection(qu.ConnID())
+		if !orphaned && !(qu.IsAutoDelete() && qu.IsUnused()) {
+			continue
+		}
+		if _, err := vhost.DeleteQueue(name, false, false); err == nil {
+			result.Queues = append(result.Queues, name)
+		}
+	}
+
+	for name, ex := range vhost.GetExchanges() {
+		if ex.IsSystem() || !ex.IsAutoDelete() || !ex.IsUnused() {
+			continue
+		}
+		if vhost.deleteExchange(name) {
+			result.Exchanges = append(result.Exchanges, name)
+		}
+	}
+
+	sort.Strings(result.Queues)
+	sort.Strings(result.Exchanges)
+	return result
+}
+
+// deleteExchange removes exchange from virtual host and server storage, returns false if exchange is not found
+func (vhost *VirtualHost) deleteExchange(name string) bool {
+	vhost.exLock.Lock()
+	ex, ok := vhost.exchanges[name]
+	delete(vhost.exchanges, name)
+	vhost.exLock.Unlock()
+	if !ok {
+		return false
+	}
+
+	if ex.IsDurable() && !ex.IsSystem() {
+		vhost.srvStorage.DelExchange(vhost.name, ex)
+	}
+	return true
+}
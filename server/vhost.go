@@ -3,6 +3,7 @@ package server
 import (
 	"errors"
 	"fmt"
+	"path/filepath"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
@@ -13,6 +14,7 @@ import (
 	"github.com/valinurovam/garagemq/metrics"
 	"github.com/valinurovam/garagemq/msgstorage"
 	"github.com/valinurovam/garagemq/queue"
+	"github.com/valinurovam/garagemq/spool"
 	"github.com/valinurovam/garagemq/srvstorage"
 )
 
@@ -20,20 +22,35 @@ const exDefaultName = ""
 
 // VirtualHost represents AMQP virtual host
 // Each virtual host is "parent" for its queues and exchanges
+// Registry locks are held for map access only, so lookups on publishing are not serialized behind declares
 type VirtualHost struct {
 	name            string
 	system          bool
-	exLock          sync.Mutex
+	exLock          sync.RWMutex
 	exchanges       map[string]*exchange.Exchange
 	quLock          sync.RWMutex
 	queues          map[string]*queue.Queue
+	quDeleteLock    sync.Mutex
 	msgStorageP     *msgstorage.MsgStorage
 	msgStorageT     *msgstorage.MsgStorage
+	storagesLock    sync.Mutex
+	storages        map[string]*msgStorages
 	srv             *Server
 	srvStorage      *srvstorage.SrvStorage
 	srvConfig       *config.Config
 	logger          *log.Entry
 	autoDeleteQueue chan string
+	replyLock       sync.RWMutex
+	replyChannels   map[string]*Channel
+	quarantineLock  sync.RWMutex
+	quarantined     map[string]*QuarantinedQueue
+}
+
+// msgStorages is pair of persistent and transient message storages placed at the same path
+// Vhost keeps them by base path, so named storages of the same path are shared
+type msgStorages struct {
+	persistent *msgstorage.MsgStorage
+	transient  *msgstorage.MsgStorage
 }
 
 // NewVhost returns instance of VirtualHost
@@ -52,9 +69,13 @@ func NewVhost(name string, system bool, msgStoragePersistent *msgstorage.MsgStor
 		msgStorageP:     msgStoragePersistent,
 		msgStorageT:     msgStorageTransient,
 		srvStorage:      srv.storage,
-		srvConfig:       srv.config,
+		srvConfig:       srv.getConfig(),
 		srv:             srv,
 		autoDeleteQueue: make(chan string, 1),
+		replyChannels:   make(map[string]*Channel),
+	}
+	vhost.storages = map[string]*msgStorages{
+		filepath.Clean(srv.getVhostStoragePath(name)): {persistent: msgStoragePersistent, transient: msgStorageTransient},
 	}
 
 	vhost.logger = log.WithFields(log.Fields{
@@ -77,7 +98,7 @@ func NewVhost(name string, system bool, msgStoragePersistent *msgstorage.MsgStor
 		}).Info("Messages loaded into queue")
 	}
 
-	go vhost.handleConfirms()
+	go vhost.handleConfirms(vhost.msgStorageP)
 	go vhost.handleAutoDeleteQueue()
 
 	return vhost
@@ -90,12 +111,10 @@ func (vhost *VirtualHost) handleAutoDeleteQueue() {
 	}
 }
 
-func (vhost *VirtualHost) handleConfirms() {
-	confirmsChan := vhost.msgStorageP.ReceiveConfirms()
+func (vhost *VirtualHost) handleConfirms(storage *msgstorage.MsgStorage) {
+	confirmsChan := storage.ReceiveConfirms()
+	// storage sends only messages got all expected confirms
 	for confirm := range confirmsChan {
-		if !confirm.ConfirmMeta.CanConfirm() {
-			continue
-		}
 		channel := vhost.srv.getConfirmChannel(confirm.ConfirmMeta)
 		if channel == nil {
 			continue
@@ -137,21 +156,86 @@ func (vhost *VirtualHost) GetQueue(name string) *queue.Queue {
 	return vhost.getQueue(name)
 }
 
-// GetQueues return all vhost's queues
+// GetQueues return snapshot of all vhost's queues
 func (vhost *VirtualHost) GetQueues() map[string]*queue.Queue {
 	vhost.quLock.RLock()
 	defer vhost.quLock.RUnlock()
-	return vhost.queues
+	queues := make(map[string]*queue.Queue, len(vhost.queues))
+	for name, qu := range vhost.queues {
+		queues[name] = qu
+	}
+	return queues
 }
 
 func (vhost *VirtualHost) getQueue(name string) *queue.Queue {
 	return vhost.queues[name]
 }
 
+// GetQueueStorageStats returns number and size of persisted messages of queue
+func (vhost *VirtualHost) GetQueueStorageStats(name string) msgstorage.QueueStats {
+	storage := vhost.msgStorageP
+	if qu := vhost.GetQueue(name); qu != nil && qu.GetStorageName() != "" {
+		if storages, err := vhost.getNamedStorages(qu.GetStorageName()); err == nil {
+			storage = storages.persistent
+		}
+	}
+	return storage.GetQueueStats(name)
+}
+
+// StorageUsed returns size of all persisted messages of vhost
+func (vhost *VirtualHost) StorageUsed() int64 {
+	vhost.storagesLock.Lock()
+	defer vhost.storagesLock.Unlock()
+	var used int64
+	for _, storages := range vhost.storages {
+		used += storages.persistent.UsedBytes()
+	}
+	return used
+}
+
+// SetQueueStorage places messages of queue at named storage from db.storages, empty name means default storage
+// Storage is opened on first use and shared by queues of vhost
+func (vhost *VirtualHost) SetQueueStorage(qu *queue.Queue, name string) error {
+	if name == "" {
+		return nil
+	}
+	storages, err := vhost.getNamedStorages(name)
+	if err != nil {
+		return err
+	}
+	qu.SetMsgStorages(name, storages.persistent, storages.transient)
+	return nil
+}
+
+func (vhost *VirtualHost) getNamedStorages(name string) (*msgStorages, error) {
+	basePath, ok := vhost.srvConfig.Db.Storages[name]
+	if !ok {
+		return nil, fmt.Errorf("queue storage '%s' is not configured", name)
+	}
+	basePath = filepath.Clean(basePath)
+
+	vhost.storagesLock.Lock()
+	defer vhost.storagesLock.Unlock()
+	if storages, ok := vhost.storages[basePath]; ok {
+		return storages, nil
+	}
+
+	vhost.logger.WithFields(log.Fields{
+		"storage": name,
+		"path":    basePath,
+	}).Info("Open queue storage")
+	persistent, transient := vhost.srv.newMsgStorages(basePath, vhost.name)
+	storages := &msgStorages{persistent: persistent, transient: transient}
+	vhost.storages[basePath] = storages
+	go vhost.handleConfirms(persistent)
+
+	return storages, nil
+}
+
 // GetExchange returns exchange by name or nil if not exists
 func (vhost *VirtualHost) GetExchange(name string) *exchange.Exchange {
-	vhost.exLock.Lock()
-	defer vhost.exLock.Unlock()
+	vhost.exLock.RLock()
+	defer vhost.exLock.RUnlock()
 	return vhost.getExchange(name)
 }
 
@@ -159,35 +243,44 @@ func (vhost *VirtualHost) getExchange(name string) *exchange.Exchange {
 	return vhost.exchanges[name]
 }
 
+// GetExchanges return snapshot of all vhost's exchanges
 func (vhost *VirtualHost) GetExchanges() map[string]*exchange.Exchange {
-	return vhost.exchanges
+	vhost.exLock.RLock()
+	defer vhost.exLock.RUnlock()
+	exchanges := make(map[string]*exchange.Exchange, len(vhost.exchanges))
+	for name, ex := range vhost.exchanges {
+		exchanges[name] = ex
+	}
+	return exchanges
 }
 
 // GetDefaultExchange returns default exchange
 func (vhost *VirtualHost) GetDefaultExchange() *exchange.Exchange {
-	return vhost.exchanges[exDefaultName]
+	return vhost.GetExchange(exDefaultName)
 }
 
 // AppendExchange append new exchange and persist if it is durable
 func (vhost *VirtualHost) AppendExchange(ex *exchange.Exchange) {
-	vhost.exLock.Lock()
-	defer vhost.exLock.Unlock()
 	exTypeAlias, _ := exchange.GetExchangeTypeAlias(ex.ExType())
 	vhost.logger.WithFields(log.Fields{
 		"name": ex.GetName(),
 		"type": exTypeAlias,
 	}).Info("Append exchange")
-	vhost.exchanges[ex.GetName()] = ex
 
 	if ex.IsDurable() && !ex.IsSystem() {
 		vhost.srvStorage.AddExchange(vhost.name, ex)
 	}
 
 	ex.SetMetrics(&exchange.MetricsState{
-		MsgIn:  metrics.AddCounter(fmt.Sprintf("exchange.%s.%s.msg_in", vhost.name, ex.GetName())),
-		MsgOut: metrics.AddCounter(fmt.Sprintf("exchange.%s.%s.msg_out", vhost.name, ex.GetName())),
+		MsgIn:         metrics.AddCounter(fmt.Sprintf("exchange.%s.%s.msg_in", vhost.name, ex.GetName())),
+		MsgOut:        metrics.AddCounter(fmt.Sprintf("exchange.%s.%s.msg_out", vhost.name, ex.GetName())),
+		MsgRouted:     metrics.AddCounter(fmt.Sprintf("exchange.%s.%s.msg_routed", vhost.name, ex.GetName())),
+		MsgUnroutable: metrics.AddCounter(fmt.Sprintf("exchange.%s.%s.msg_unroutable", vhost.name, ex.GetName())),
 	})
 
+	vhost.exLock.Lock()
+	vhost.exchanges[ex.GetName()] = ex
+	vhost.exLock.Unlock()
 }
 
 // NewQueue returns new instance of queue by params
@@ -209,26 +302,16 @@ func (vhost *VirtualHost) NewQueue(name string, connID uint64, exclusive bool, a
 // AppendQueue append new queue and persist if it is durable and
 // bindings into default exchange
 func (vhost *VirtualHost) AppendQueue(qu *queue.Queue) {
-	vhost.quLock.Lock()
-	defer vhost.quLock.Unlock()
 	vhost.logger.WithFields(log.Fields{
 		"queueName": qu.GetName(),
 	}).Info("Append queue")
 
-	vhost.queues[qu.GetName()] = qu
-
-	// @spec-note
-	// The server MUST create a default binding for a newly­declared queue to the default exchange,
-	// which is an exchange of type 'direct' and use the queue name as the routing key.
-	ex := vhost.GetDefaultExchange()
-	bind := binding.NewBinding(qu.GetName(), exDefaultName, qu.GetName(), &amqp.Table{}, false)
-	ex.AppendBinding(bind)
-
+	qu.SetDeadLetterHandler(vhost.deadLetter)
 	if qu.IsDurable() {
 		vhost.srvStorage.AddQueue(vhost.name, qu)
 	}
 
-	qu.SetMetrics(&queue.MetricsState{
+	quMetrics := &queue.MetricsState{
 		Ready:    metrics.AddCounter(fmt.Sprintf("queue.%s.%s.ready", vhost.name, qu.GetName())),
 		Unacked:  metrics.AddCounter(fmt.Sprintf("queue.%s.%s.unacked", vhost.name, qu.GetName())),
 		Total:    metrics.AddCounter(fmt.Sprintf("queue.%s.%s.total", vhost.name, qu.GetName())),
@@ -237,12 +320,73 @@ func (vhost *VirtualHost) AppendQueue(qu *queue.Queue) {
 		Get:      metrics.AddCounter(fmt.Sprintf("queue.%s.%s.get", vhost.name, qu.GetName())),
 		Ack:      metrics.AddCounter(fmt.Sprintf("queue.%s.%s.ack", vhost.name, qu.GetName())),
 
+		DeliveryLatency: metrics.AddHistogram(fmt.Sprintf("queue.%s.%s.delivery_latency", vhost.name, qu.GetName())),
+		State:           metrics.AddCounter(fmt.Sprintf("queue.%s.%s.state", vhost.name, qu.GetName())),
+
+		OldestMessageAge: metrics.AddGauge(fmt.Sprintf("queue.%s.%s.oldest_message_age", vhost.name, qu.GetName()), qu.OldestMessageAge),
+
 		ServerReady:   vhost.srv.metrics.Ready,
 		ServerUnacked: vhost.srv.metrics.Unacked,
 		ServerTotal:   vhost.srv.metrics.Total,
 		ServerDeliver: vhost.srv.metrics.Deliver,
 		ServerAck:     vhost.srv.metrics.Ack,
-	})
+	}
+	quMetrics.History = vhost.addQueueHistory(qu.GetName(), quMetrics)
+	qu.SetMetrics(quMetrics)
+
+	vhost.quLock.Lock()
+	vhost.queues[qu.GetName()] = qu
+	vhost.quLock.Unlock()
+
+	// @spec-note
+	// The server MUST create a default binding for a newly­declared queue to the default exchange,
+	// which is an exchange of type 'direct' and use the queue name as the routing key.
+	ex := vhost.GetDefaultExchange()
+	bind := binding.NewBinding(qu.GetName(), exDefaultName, qu.GetName(), &amqp.Table{}, false)
+	ex.AppendBinding(bind)
+}
+
+// queueHistoryCounters returns queue counters which are sampled into history
+func queueHistoryCounters(quMetrics *queue.MetricsState) map[string]*metrics.TrackCounter {
+	return map[string]*metrics.TrackCounter{
+		"ready":    quMetrics.Ready,
+		"unacked":  quMetrics.Unacked,
+		"total":    quMetrics.Total,
+		"incoming": quMetrics.Incoming,
+		"deliver":  quMetrics.Deliver,
+		"get":      quMetrics.Get,
+		"ack":      quMetrics.Ack,
+		"state":    quMetrics.State,
+
+		"oldest_message_age": quMetrics.OldestMessageAge,
+	}
+}
+
+func (vhost *VirtualHost) addQueueHistory(queueName string, quMetrics *queue.MetricsState) map[string]*metrics.TrackBuffer {
+	history := make(map[string]*metrics.TrackBuffer)
+	for name, counter := range queueHistoryCounters(quMetrics) {
+		track := metrics.AddHistory(fmt.Sprintf("queue.%s.%s.%s", vhost.name, queueName, name), counter.Counter)
+		if track == nil {
+			return nil
+		}
+		history[name] = track
+	}
+
+	return history
+}
+
+// queueCounterNames are names of counters and gauges registered for each queue
+var queueCounterNames = []string{"ready", "unacked", "total", "incoming", "deliver", "get", "ack", "state", "oldest_message_age"}
+
+// removeQueueMetrics unregisters counters, gauges, histograms and history of removed queue
+func (vhost *VirtualHost) removeQueueMetrics(qu *queue.Queue) {
+	for _, name := range queueCounterNames {
+		metrics.RemoveCounter(fmt.Sprintf("queue.%s.%s.%s", vhost.name, qu.GetName(), name))
+	}
+	metrics.RemoveHistogram(fmt.Sprintf("queue.%s.%s.delivery_latency", vhost.name, qu.GetName()))
+	for name := range qu.GetMetrics().History {
+		metrics.RemoveHistory(fmt.Sprintf("queue.%s.%s.%s", vhost.name, qu.GetName(), name))
+	}
 }
 
 // PersistBinding store binding into server storage
@@ -257,29 +401,205 @@ func (vhost *VirtualHost) RemoveBindings(bindings []*binding.Binding) {
 	}
 }
 
+// BindQueue bind queue to exchange outside of any connection, as queue.bind does
+// Bindings of durable queues to durable exchanges are persisted
+func (vhost *VirtualHost) BindQueue(exName string, quName string, routingKey string, arguments *amqp.Table) error {
+	ex, qu, err := vhost.getBindingEnds(exName, quName)
+	if err != nil {
+		return err
+	}
+
+	if ex.GetName() == exDefaultName {
+		return errors.New("operation not permitted on the default exchange")
+	}
+
+	bind := binding.NewBinding(quName, exName, routingKey, arguments, ex.ExType() == exchange.ExTypeTopic)
+	ex.AppendBinding(bind)
+	if ex.IsDurable() && qu.IsDurable() {
+		vhost.PersistBinding(bind)
+	}
+
+	return nil
+}
+
+// UnbindQueue unbind queue from exchange outside of any connection, as queue.unbind does
+func (vhost *VirtualHost) UnbindQueue(exName string, quName string, routingKey string, arguments *amqp.Table) error {
+	ex, _, err := vhost.getBindingEnds(exName, quName)
+	if err != nil {
+		return err
+	}
+
+	bind := binding.NewBinding(quName, exName, routingKey, arguments, ex.ExType() == exchange.ExTypeTopic)
+	if removed := ex.RemoveBinding(bind); removed != nil {
+		vhost.RemoveBindings([]*binding.Binding{removed})
+	}
+
+	return nil
+}
+
+// MoveMessages moves up to limit messages from source queue head to destination queue, as local shovel does
+// With copyOnly messages are copied and stay in source queue, only messages loaded into memory are copied
+// Messages keep properties, headers and body, but get new ids in destination queue
+// Moving stops at the first message destination does not accept, e.g. full or deleted one, that message stays in source
+// Returns count of moved messages
+func (vhost *VirtualHost) MoveMessages(srcName string, dstName string, limit int, copyOnly bool) (int, error) {
+	src := vhost.GetQueue(srcName)
+	if src == nil {
+		return 0, fmt.Errorf("queue '%s' not found", srcName)
+	}
+	dst := vhost.GetQueue(dstName)
+	if dst == nil {
+		return 0, fmt.Errorf("queue '%s' not found", dstName)
+	}
+	if src == dst {
+		return 0, errors.New("source and destination queues are the same")
+	}
+	// exclusive queues are owned by connection
+	if dst.IsExclusive() {
+		return 0, fmt.Errorf("queue '%s' is locked to another connection", dstName)
+	}
+
+	if copyOnly {
+		copied := 0
+		for _, message := range src.Peek(limit) {
+			if err := vhost.pushCopy(dst, message); err != nil {
+				return copied, err
+			}
+			copied++
+		}
+		return copied, nil
+	}
+
+	moved := 0
+	for moved < limit {
+		message := src.Pop()
+		if message == nil {
+			break
+		}
+
+		if err := vhost.pushCopy(dst, message); err != nil {
+			src.GetMetrics().Unacked.Counter.Inc(1)
+			src.GetMetrics().ServerUnacked.Counter.Inc(1)
+			src.Requeue(message)
+			return moved, err
+		}
+
+		// message is removed from source as it was got and acked, after it is pushed into destination
+		src.GetMetrics().Ready.Counter.Dec(1)
+		src.GetMetrics().ServerReady.Counter.Dec(1)
+		src.GetMetrics().Unacked.Counter.Inc(1)
+		src.GetMetrics().ServerUnacked.Counter.Inc(1)
+		src.AckMsg(message)
+		moved++
+	}
+
+	return moved, nil
+}
+
+// pushCopy pushes copy of message into queue, spooled body is linked for destination queue
+// Error is returned if queue does not accept message
+func (vhost *VirtualHost) pushCopy(qu *queue.Queue, message *amqp.Message) error {
+	msgCopy := &amqp.Message{
+		BodySize:   message.BodySize,
+		Mandatory:  message.Mandatory,
+		Immediate:  message.Immediate,
+		Exchange:   message.Exchange,
+		RoutingKey: message.RoutingKey,
+		Header:     message.Header,
+		Body:       message.Body,
+	}
+
+	if message.SpoolPath != "" {
+		path, err := vhost.srv.spool.Link(message.SpoolPath)
+		if err != nil {
+			return err
+		}
+		msgCopy.SpoolPath = path
+	}
+
+	if !qu.PushChecked(msgCopy) {
+		spool.Release(msgCopy)
+		return fmt.Errorf("queue '%s' does not accept messages", qu.GetName())
+	}
+	return nil
+}
+
+func (vhost *VirtualHost) getBindingEnds(exName string, quName string) (*exchange.Exchange, *queue.Queue, error) {
+	ex := vhost.GetExchange(exName)
+	if ex == nil {
+		return nil, nil, fmt.Errorf("exchange '%s' not found", exName)
+	}
+
+	qu := vhost.GetQueue(quName)
+	if qu == nil {
+		return nil, nil, fmt.Errorf("queue '%s' not found", quName)
+	}
+
+	// exclusive queues are owned by connection, only it can change their bindings
+	if qu.IsExclusive() {
+		return nil, nil, fmt.Errorf("queue '%s' is locked to another connection", quName)
+	}
+
+	return ex, qu, nil
+}
+
 func (vhost *VirtualHost) loadQueues() {
 	vhost.logger.Info("Initialize queues...")
-	queues := vhost.srvStorage.GetVhostQueues(vhost.name)
-	if len(queues) == 0 {
-		return
+	queues, broken := vhost.srvStorage.GetVhostQueues(vhost.name)
+	for name, err := range broken {
+		vhost.quarantineQueue(name, err)
 	}
 	for _, q := range queues {
-		vhost.AppendQueue(
-			vhost.NewQueue(q.GetName(), 0, false, q.IsAutoDelete(), q.IsDurable(), vhost.srvConfig.Queue.ShardSize),
-		)
+		qu := vhost.NewQueue(q.GetName(), 0, false, q.IsAutoDelete(), q.IsDurable(), vhost.srvConfig.Queue.ShardSize)
+		if err := vhost.SetQueueStorage(qu, q.GetStorageName()); err != nil {
+			// messages are left at storage, queue is restored after storage is configured back
+			vhost.logger.WithError(err).WithField("queueName", q.GetName()).Error("Skip queue restore")
+			continue
+		}
+		qu.SetMessageTTL(q.GetMessageTTL())
+		qu.SetDeadLetter(q.GetDeadLetter())
+		qu.SetSingleActiveConsumer(q.IsSingleActiveConsumer())
+		qu.SetDropIfNoConsumers(q.IsDropIfNoConsumers())
+		qu.SetRetryDelays(q.GetRetryDelays())
+		qu.SetMaxLength(q.GetMaxLength())
+		qu.SetConsumerTimeout(q.GetConsumerTimeout())
+		qu.SetMeta(q.GetMeta())
+		qu.SetSchema(q.GetSchema())
+		vhost.AppendQueue(qu)
 	}
 }
 
 func (vhost *VirtualHost) loadMessagesIntoQueues() {
 	var wg sync.WaitGroup
+	var failedLock sync.Mutex
+	failed := make(map[string]error)
 	for queueName, q := range vhost.queues {
 		wg.Add(1)
 		go func(queueName string, queue *queue.Queue) {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					failedLock.Lock()
+					failed[queueName] = fmt.Errorf("error on loading messages: %v", r)
+					failedLock.Unlock()
+				}
+			}()
 			queue.LoadFromMsgStorage()
-			wg.Done()
 		}(queueName, q)
 	}
 	wg.Wait()
+
+	for queueName, err := range failed {
+		vhost.quarantineQueue(queueName, err)
+
+		// queue is removed from vhost only, its record, bindings and messages are kept in storage
+		qu := vhost.queues[queueName]
+		delete(vhost.queues, queueName)
+		for _, ex := range vhost.exchanges {
+			ex.RemoveQueueBindings(queueName)
+		}
+		vhost.removeQueueMetrics(qu)
+	}
 }
 
 func (vhost *VirtualHost) loadExchanges() {
@@ -301,38 +621,69 @@ func (vhost *VirtualHost) loadBindings() {
 	}
 	for _, bind := range bindings {
 		ex := vhost.getExchange(bind.Exchange)
-		if ex != nil {
-			ex.AppendBinding(bind)
+		if ex == nil || vhost.getQueue(bind.Queue) == nil {
+			vhost.logger.WithFields(log.Fields{
+				"exchange": bind.Exchange,
+				"queue":    bind.Queue,
+			}).Warn("Skip binding restore, exchange or queue does not exist")
+			continue
 		}
+		ex.AppendBinding(bind)
 	}
 }
 
 // DeleteQueue delete queue from virtual host and all bindings to that queue
 // Also queue will be removed from server storage
+// Deletes are serialized with each other, registry is locked only to remove the queue from it
 func (vhost *VirtualHost) DeleteQueue(queueName string, ifUnused bool, ifEmpty bool) (uint64, error) {
-	vhost.quLock.Lock()
-	defer vhost.quLock.Unlock()
+	vhost.quDeleteLock.Lock()
+	defer vhost.quDeleteLock.Unlock()
 
-	qu := vhost.getQueue(queueName)
+	qu := vhost.GetQueue(queueName)
 	if qu == nil {
 		return 0, errors.New("not found")
 	}
-	qu.Stop()
 
+	// queue is stopped only after if-unused and if-empty checks passed, refused one keeps working
 	var length, err = qu.Delete(ifUnused, ifEmpty)
 	if err != nil {
 		return 0, err
 	}
-	for _, ex := range vhost.exchanges {
+	qu.Stop()
+
+	vhost.quLock.Lock()
+	delete(vhost.queues, queueName)
+	vhost.quLock.Unlock()
+
+	for _, ex := range vhost.GetExchanges() {
 		removedBindings := ex.RemoveQueueBindings(queueName)
 		vhost.RemoveBindings(removedBindings)
 	}
 	vhost.srvStorage.DelQueue(vhost.name, qu)
-	delete(vhost.queues, queueName)
+	vhost.removeQueueMetrics(qu)
 
 	return length, nil
 }
 
+// DeleteExchange deletes exchange with its bindings, exchange with bindings is kept if ifUnused is set
+func (vhost *VirtualHost) DeleteExchange(exchangeName string, ifUnused bool) error {
+	ex := vhost.GetExchange(exchangeName)
+	if ex == nil {
+		return errors.New("not found")
+	}
+
+	if ifUnused && len(ex.GetBindings()) != 0 {
+		return errors.New("in use")
+	}
+
+	// bindings are taken after exchange is unregistered, so ones made meanwhile are removed from storage too
+	if vhost.deleteExchange(exchangeName) {
+		vhost.RemoveBindings(ex.GetBindings())
+	}
+
+	return nil
+}
+
 // Stop properly stop virtual host
 // TODO: properly stop confirm loop
 func (vhost *VirtualHost) Stop() error {
@@ -348,7 +699,11 @@ func (vhost *VirtualHost) Stop() error {
 		}).Info("Queue stopped")
 	}
 
-	vhost.msgStorageP.Close()
+	vhost.storagesLock.Lock()
+	for _, storages := range vhost.storages {
+		storages.persistent.Close()
+	}
+	vhost.storagesLock.Unlock()
 	vhost.logger.Info("Storage closed")
 	close(vhost.autoDeleteQueue)
 	return nil
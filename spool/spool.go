@@ -0,0 +1,138 @@
+package spool
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// DefaultChunkSize is the size of body frame payload used to stream spooled body if frame_max is not limited
+const DefaultChunkSize = 131072
+
+// Spool keeps bodies of large messages in files, so they are not buffered in memory
+// Each queue owns its own hard link to body file, body file is removed when message leaves the queue
+type Spool struct {
+	dir       string
+	threshold uint64
+	seq       uint64
+}
+
+// NewSpool returns new instance of Spool with files stored into dir
+// Zero threshold disables spooling
+func NewSpool(dir string, threshold uint64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	return &Spool{
+		dir:       dir,
+		threshold: threshold,
+		// when server restart we can't start again count files from 0
+		seq: uint64(time.Now().UnixNano()),
+	}, nil
+}
+
+// ShouldSpool returns is message body with bodySize should be spooled
+func (spool *Spool) ShouldSpool(bodySize uint64) bool {
+	return spool.threshold > 0 && bodySize >= spool.threshold
+}
+
+// Create creates new body file and returns writer for it
+func (spool *Spool) Create() (*Writer, error) {
+	file, err := os.OpenFile(spool.nextPath(), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{file: file}, nil
+}
+
+// Link creates new hard link to body file and returns its path
+func (spool *Spool) Link(path string) (string, error) {
+	linkPath := spool.nextPath()
+	if err := os.Link(path, linkPath); err != nil {
+		return "", err
+	}
+
+	return linkPath, nil
+}
+
+func (spool *Spool) nextPath() string {
+	return filepath.Join(spool.dir, strconv.FormatUint(atomic.AddUint64(&spool.seq, 1), 10))
+}
+
+// Writer writes body frames into spool file as they arrive
+type Writer struct {
+	file *os.File
+}
+
+// Path returns path of body file
+func (writer *Writer) Path() string {
+	return writer.file.Name()
+}
+
+// Write appends body frame payload into file
+func (writer *Writer) Write(payload []byte) error {
+	_, err := writer.file.Write(payload)
+	return err
+}
+
+// Close closes body file, file is kept on disk
+func (writer *Writer) Close() error {
+	return writer.file.Close()
+}
+
+// Discard closes and removes body file, used if message was not received completely
+func (writer *Writer) Discard() {
+	writer.file.Close()
+	os.Remove(writer.file.Name())
+}
+
+// Release removes spooled body of message, does nothing for not spooled messages
+func Release(message *amqp.Message) {
+	if message.SpoolPath != "" {
+		os.Remove(message.SpoolPath)
+	}
+}
+
+// ReadFrames reads spooled body of message and calls fn for each body frame with payload up to chunkSize
+// Only one chunk is held in memory at the moment
+func ReadFrames(message *amqp.Message, channelID uint16, chunkSize int, fn func(frame *amqp.Frame)) error {
+	file, err := os.Open(message.SpoolPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for {
+		payload := make([]byte, chunkSize)
+		n, err := io.ReadFull(file, payload)
+		if n > 0 {
+			fn(&amqp.Frame{Type: byte(amqp.FrameBody), ChannelID: channelID, Payload: payload[:n]})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ReadBody returns the whole body of message, spooled body is read from its file
+func ReadBody(message *amqp.Message) ([]byte, error) {
+	if message.SpoolPath != "" {
+		return ioutil.ReadFile(message.SpoolPath)
+	}
+	body := make([]byte, 0, message.BodySize)
+	for _, frame := range message.Body {
+		body = append(body, frame.Payload...)
+	}
+	return body, nil
+}
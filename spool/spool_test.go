@@ -0,0 +1,106 @@
+package spool_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/spool"
+)
+
+func newSpool(t *testing.T, threshold uint64) (*spool.Spool, string) {
+	dir, err := ioutil.TempDir("", "spool_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sp, err := spool.NewSpool(dir, threshold)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sp, dir
+}
+
+func TestSpool_ShouldSpool(t *testing.T) {
+	sp, dir := newSpool(t, 1024)
+	defer os.RemoveAll(dir)
+
+	if sp.ShouldSpool(1023) {
+		t.Fatal("Expected body less than threshold not spooled")
+	}
+	if !sp.ShouldSpool(1024) {
+		t.Fatal("Expected body equal to threshold spooled")
+	}
+
+	sp, dir = newSpool(t, 0)
+	defer os.RemoveAll(dir)
+	if sp.ShouldSpool(1 << 30) {
+		t.Fatal("Expected spool disabled with zero threshold")
+	}
+}
+
+func TestSpool_WriteLinkRead(t *testing.T) {
+	sp, dir := newSpool(t, 1)
+	defer os.RemoveAll(dir)
+
+	writer, err := sp.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := bytes.Repeat([]byte("0123456789"), 100)
+	writer.Write(body[:500])
+	writer.Write(body[500:])
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	linkPath, err := sp.Link(writer.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool.Release(&amqp.Message{SpoolPath: writer.Path()})
+
+	message := &amqp.Message{SpoolPath: linkPath}
+	var frames []*amqp.Frame
+	err = spool.ReadFrames(message, 5, 300, func(frame *amqp.Frame) {
+		frames = append(frames, frame)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(frames) != 4 {
+		t.Fatalf("Expected 4 frames, actual %d", len(frames))
+	}
+	read := []byte{}
+	for _, frame := range frames {
+		if frame.ChannelID != 5 || frame.Type != byte(amqp.FrameBody) {
+			t.Fatal("Unexpected frame type or channel")
+		}
+		read = append(read, frame.Payload...)
+	}
+	if !bytes.Equal(read, body) {
+		t.Fatal("Expected read body equal to written")
+	}
+
+	spool.Release(message)
+	if _, err = os.Stat(linkPath); !os.IsNotExist(err) {
+		t.Fatal("Expected body file removed on release")
+	}
+}
+
+func TestWriter_Discard(t *testing.T) {
+	sp, dir := newSpool(t, 1)
+	defer os.RemoveAll(dir)
+
+	writer, _ := sp.Create()
+	writer.Write([]byte("test"))
+	writer.Discard()
+
+	if _, err := os.Stat(writer.Path()); !os.IsNotExist(err) {
+		t.Fatal("Expected body file removed on discard")
+	}
+}
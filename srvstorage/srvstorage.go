@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/valinurovam/garagemq/binding"
 	"github.com/valinurovam/garagemq/exchange"
 	"github.com/valinurovam/garagemq/interfaces"
@@ -51,6 +52,24 @@ func (storage *SrvStorage) UpdateLastStart() error {
 	return storage.db.Set("lastStartTime", buf.Bytes())
 }
 
+// GetLastMsgID returns upper bound of message ids used before restart, 0 if not stored
+func (storage *SrvStorage) GetLastMsgID() uint64 {
+	// TODO Handle error
+	data, _ := storage.db.Get("lastMsgId")
+	if len(data) != 8 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(data)
+}
+
+// SetLastMsgID stores upper bound of used message ids
+func (storage *SrvStorage) SetLastMsgID(id uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, id)
+	return storage.db.Set("lastMsgId", buf)
+}
+
 // AddVhost add vhost into storage
 func (storage *SrvStorage) AddVhost(vhost string, system bool) error {
 	key := fmt.Sprintf("%s.%s", vhostPrefix, vhost)
@@ -81,7 +100,7 @@ func (storage *SrvStorage) GetVhosts() map[string]bool {
 // AddBinding add binding into storage
 func (storage *SrvStorage) AddBinding(vhost string, bind *binding.Binding) error {
 	key := fmt.Sprintf("%s.%s.%s", bindingPrefix, vhost, bind.GetName())
-	data, err := bind.Marshal()
+	data, err := bind.Marshal(storage.protoVersion)
 	if err != nil {
 		return err
 	}
@@ -122,25 +141,39 @@ func (storage *SrvStorage) AddQueue(vhost string, queue *queue.Queue) error {
 
 // DelQueue remove queue from storage
 func (storage *SrvStorage) DelQueue(vhost string, queue *queue.Queue) error {
-	key := fmt.Sprintf("%s.%s.%s", queuePrefix, vhost, queue.GetName())
+	return storage.DelQueueByName(vhost, queue.GetName())
+}
+
+// DelQueueByName remove queue from storage by name, e.g. queue which record can't be read
+func (storage *SrvStorage) DelQueueByName(vhost string, name string) error {
+	key := fmt.Sprintf("%s.%s.%s", queuePrefix, vhost, name)
 	return storage.db.Del(key)
 }
 
-// GetVhostQueues returns queue names that has given vhost
-func (storage *SrvStorage) GetVhostQueues(vhost string) []*queue.Queue {
+// GetVhostQueues returns queues that has given vhost
+// Queues which records can't be read are not returned, their errors are returned by queue name from record key
+func (storage *SrvStorage) GetVhostQueues(vhost string) ([]*queue.Queue, map[string]error) {
 	var queues []*queue.Queue
+	var broken map[string]error
+	keyPrefix := fmt.Sprintf("%s.%s.", queuePrefix, vhost)
 	storage.db.Iterate(
 		func(key []byte, value []byte) {
 			if !bytes.HasPrefix(key, []byte(queuePrefix)) || getVhostFromKey(string(key)) != vhost {
 				return
 			}
 			q := &queue.Queue{}
-			q.Unmarshal(value, storage.protoVersion)
+			if err := q.Unmarshal(value, storage.protoVersion); err != nil {
+				if broken == nil {
+					broken = make(map[string]error)
+				}
+				broken[strings.TrimPrefix(string(key), keyPrefix)] = err
+				return
+			}
 			queues = append(queues, q)
 		},
 	)
 
-	return queues
+	return queues, broken
 }
 
 // GetVhostExchanges returns exchanges that has given vhost
@@ -152,7 +185,11 @@ func (storage *SrvStorage) GetVhostExchanges(vhost string) []*exchange.Exchange
 				return
 			}
 			ex := &exchange.Exchange{}
-			ex.Unmarshal(value)
+			// exchange of custom type is skipped if its type is not registered at startup
+			if err := ex.Unmarshal(value, storage.protoVersion); err != nil {
+				log.WithError(err).WithField("exchange", ex.GetName()).Error("Skip exchange restore")
+				return
+			}
 			exchanges = append(exchanges, ex)
 		},
 	)
@@ -161,19 +198,33 @@ func (storage *SrvStorage) GetVhostExchanges(vhost string) []*exchange.Exchange
 }
 
 // GetVhostBindings returns bindings that has given vhost
+// Binding stored by older version under name without hash of arguments is moved to its current key,
+// so it is deleted by unbind
 func (storage *SrvStorage) GetVhostBindings(vhost string) []*binding.Binding {
 	var bindings []*binding.Binding
+	legacy := make(map[string]*binding.Binding)
 	storage.db.Iterate(
 		func(key []byte, value []byte) {
 			if !bytes.HasPrefix(key, []byte(bindingPrefix)) || getVhostFromKey(string(key)) != vhost {
 				return
 			}
 			bind := &binding.Binding{}
-			bind.Unmarshal(value)
+			bind.Unmarshal(value, storage.protoVersion)
 			bindings = append(bindings, bind)
+			if string(key) != fmt.Sprintf("%s.%s.%s", bindingPrefix, vhost, bind.GetName()) {
+				legacy[string(key)] = bind
+			}
 		},
 	)
 
+	for key, bind := range legacy {
+		if err := storage.AddBinding(vhost, bind); err != nil {
+			log.WithError(err).WithField("key", key).Error("Error on migrating binding key")
+			continue
+		}
+		storage.db.Del(key)
+	}
+
 	return bindings
 }
 
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/tidwall/buntdb"
@@ -97,27 +98,44 @@ func (storage *BuntDB) Iterate(fn func(key []byte, value []byte)) {
 
 // Iterate iterates over keys with prefix
 func (storage *BuntDB) IterateByPrefix(prefix []byte, limit uint64, fn func(key []byte, value []byte)) uint64 {
+	return storage.IterateByPrefixFrom(prefix, prefix, limit, fn)
+}
+
+// IterateByPrefixFrom iterates over keys with prefix in ascending key order starting from key from
+func (storage *BuntDB) IterateByPrefixFrom(prefix []byte, from []byte, limit uint64, fn func(key []byte, value []byte)) uint64 {
+	var totalIterated uint64
 	storage.db.View(func(tx *buntdb.Tx) error {
-		err := tx.AscendKeys(string(prefix), func(key, value string) bool {
+		return tx.AscendGreaterOrEqual("", string(from), func(key, value string) bool {
+			if !strings.HasPrefix(key, string(prefix)) || (limit > 0 && totalIterated >= limit) {
+				return false
+			}
 			fn([]byte(key), []byte(value))
+			totalIterated++
 			return true
 		})
-		return err
 	})
 
-	return 0
-}
-
-func (storage *BuntDB) IterateByPrefixFrom(prefix []byte, from []byte, limit uint64, fn func(key []byte, value []byte)) uint64 {
-	return 0
+	return totalIterated
 }
 
+// DeleteByPrefix deletes all keys with prefix
 func (storage *BuntDB) DeleteByPrefix(prefix []byte) {
+	var keys []string
+	storage.IterateByPrefix(prefix, 0, func(key []byte, value []byte) {
+		keys = append(keys, string(key))
+	})
 
+	storage.db.Update(func(tx *buntdb.Tx) error {
+		for _, key := range keys {
+			tx.Delete(key)
+		}
+		return nil
+	})
 }
 
+// KeysByPrefixCount returns count of keys with prefix
 func (storage *BuntDB) KeysByPrefixCount(prefix []byte) uint64 {
-	return 0
+	return storage.IterateByPrefix(prefix, 0, func(key []byte, value []byte) {})
 }
 
 func (storage *BuntDB) runStorageGC() {